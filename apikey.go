@@ -0,0 +1,320 @@
+package servicefoundation
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Prutswonder/go-servicefoundation/env"
+	"github.com/Prutswonder/go-servicefoundation/events"
+)
+
+const (
+	// DefaultAPIKeyHeader is the request header that carries the API key by default.
+	DefaultAPIKeyHeader = "X-API-Key"
+
+	defaultAPIKeyReloadInterval = 10 * time.Second
+)
+
+var (
+	// ErrAPIKeyMissing is returned when a request carries no API key.
+	ErrAPIKeyMissing = errors.New("API key missing")
+	// ErrAPIKeyUnknown is returned when an API key is not in the KeyStore.
+	ErrAPIKeyUnknown = errors.New("API key unknown")
+	// ErrAPIKeyExpired is returned when an API key has expired.
+	ErrAPIKeyExpired = errors.New("API key expired")
+	// ErrAPIKeyDisabled is returned when an API key has been disabled.
+	ErrAPIKeyDisabled = errors.New("API key disabled")
+)
+
+var apiKeysVariable = env.Register(envAPIKeys, env.TypeString, "",
+	`JSON array of API keys for NewStaticKeyStoreFromEnv, like [{"id":"partner-1","owner":"partner","hash":"<sha256>","scopes":["orders.read"]}]`)
+
+type (
+	// APIKey contains the metadata of an API key. Only the SHA-256 hash of the key is stored, hex encoded. An owner
+	// can have multiple keys, each with their own ID, so a new key can be handed out before the old one is disabled.
+	APIKey struct {
+		ID      string
+		Owner   string
+		Hash    string
+		Scopes  []string
+		Expires time.Time
+		Enabled bool
+	}
+
+	// KeyStore looks up API keys by the hex encoded SHA-256 hash of the key. It returns ErrAPIKeyUnknown when the key
+	// does not exist.
+	KeyStore interface {
+		Lookup(hash string) (APIKey, error)
+	}
+
+	// ReloadableKeyStore is a KeyStore that reloads its keys when its source changes.
+	ReloadableKeyStore interface {
+		KeyStore
+		Start(ctx context.Context)
+		Reload() error
+	}
+
+	// APIKeyOptions contains the settings of the API key middleware. Header defaults to X-API-Key. Keys are only
+	// accepted from the QueryParameter when it is set, which is discouraged because URLs end up in logs.
+	APIKeyOptions struct {
+		Header         string
+		QueryParameter string
+		Store          KeyStore
+		Clock          Clock
+	}
+
+	// apiKeyDocument is the JSON representation of an APIKey, in which keys are enabled unless stated otherwise.
+	apiKeyDocument struct {
+		ID      string    `json:"id"`
+		Owner   string    `json:"owner"`
+		Hash    string    `json:"hash"`
+		Scopes  []string  `json:"scopes"`
+		Expires time.Time `json:"expires"`
+		Enabled *bool     `json:"enabled"`
+	}
+
+	staticKeyStoreImpl struct {
+		keys []APIKey
+	}
+
+	fileKeyStoreImpl struct {
+		path     string
+		interval time.Duration
+		log      Logger
+		mutex    sync.RWMutex
+		store    KeyStore
+		modTime  time.Time
+	}
+)
+
+// NewAPIKeyMiddleware returns a MiddlewareFunc that authenticates requests by their API key. The identity of the key is
+// put on the context as JWTClaims, with the owner as sub, so it can be authorized like a JWT. Requests are counted per
+// key ID and rejected with a 401 problem when the key is missing, unknown, expired or disabled.
+func NewAPIKeyMiddleware(options APIKeyOptions, log Logger, metrics Metrics) MiddlewareFunc {
+	if options.Header == "" {
+		options.Header = DefaultAPIKeyHeader
+	}
+	if options.Store == nil {
+		options.Store = NewStaticKeyStore(nil)
+	}
+	if options.Clock == nil {
+		options.Clock = NewSystemClock()
+	}
+
+	return func(next Handle) Handle {
+		return func(w WrappedResponseWriter, r *http.Request, p RouterParams) {
+			key, err := authenticateAPIKey(options, r)
+
+			if err != nil {
+				log.Debug(events.APIKeyUnauthorized, "Rejecting request: %v", err)
+				metrics.CountLabels("apikey", "rejected_total", "Requests rejected by API key authentication.",
+					[]string{"reason"}, []string{apiKeyRejectionReason(err)})
+				w.Header().Set("WWW-Authenticate", "APIKey")
+				WriteProblem(w, http.StatusUnauthorized, err.Error())
+				return
+			}
+
+			metrics.CountLabels("apikey", "requests_total", "Requests authenticated by API key.",
+				[]string{"key"}, []string{key.ID})
+			next(w, r.WithContext(context.WithValue(r.Context(), jwtClaimsContextKey{}, key.Claims())), p)
+		}
+	}
+}
+
+// HashAPIKey returns the hex encoded SHA-256 hash of the API key, as stored in a KeyStore.
+func HashAPIKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+// NewStaticKeyStore creates and returns a KeyStore with a fixed set of keys.
+func NewStaticKeyStore(keys []APIKey) KeyStore {
+	return &staticKeyStoreImpl{keys: keys}
+}
+
+// NewStaticKeyStoreFromEnv creates and returns a KeyStore with the keys in the API_KEYS environment variable.
+func NewStaticKeyStoreFromEnv() (KeyStore, error) {
+	value := apiKeysVariable.String()
+	if value == "" {
+		return NewStaticKeyStore(nil), nil
+	}
+
+	keys, err := ParseAPIKeys([]byte(value))
+	if err != nil {
+		return nil, err
+	}
+	return NewStaticKeyStore(keys), nil
+}
+
+// ParseAPIKeys parses a JSON array of API keys, like the API_KEYS environment variable or a key file. Keys are
+// enabled unless their enabled field is false.
+func ParseAPIKeys(data []byte) ([]APIKey, error) {
+	var documents []apiKeyDocument
+	if err := json.Unmarshal(data, &documents); err != nil {
+		return nil, err
+	}
+
+	keys := make([]APIKey, len(documents))
+	for i, document := range documents {
+		keys[i] = APIKey{
+			ID:      document.ID,
+			Owner:   document.Owner,
+			Hash:    strings.ToLower(document.Hash),
+			Scopes:  document.Scopes,
+			Expires: document.Expires,
+			Enabled: document.Enabled == nil || *document.Enabled,
+		}
+	}
+	return keys, nil
+}
+
+// NewFileKeyStore creates and returns a ReloadableKeyStore with the keys in the JSON file at path. Once started, the
+// file is checked for changes every interval. When the file can not be loaded, the previous keys stay in use.
+func NewFileKeyStore(path string, interval time.Duration, log Logger) (ReloadableKeyStore, error) {
+	if interval <= 0 {
+		interval = defaultAPIKeyReloadInterval
+	}
+
+	store := &fileKeyStoreImpl{path: path, interval: interval, log: log, store: NewStaticKeyStore(nil)}
+	if err := store.Reload(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// Claims returns the identity of the key in the shape of the claims of a JWT.
+func (k APIKey) Claims() JWTClaims {
+	return JWTClaims{
+		"sub":        k.Owner,
+		"scope":      strings.Join(k.Scopes, " "),
+		"api_key_id": k.ID,
+	}
+}
+
+/* KeyStore implementation */
+
+// Lookup compares the hash with every key in constant time, so the duration does not reveal which key matched.
+func (s *staticKeyStoreImpl) Lookup(hash string) (APIKey, error) {
+	found := -1
+	for i, key := range s.keys {
+		if subtle.ConstantTimeCompare([]byte(key.Hash), []byte(hash)) == 1 {
+			found = i
+		}
+	}
+
+	if found < 0 {
+		return APIKey{}, ErrAPIKeyUnknown
+	}
+	return s.keys[found], nil
+}
+
+/* ReloadableKeyStore implementation */
+
+func (s *fileKeyStoreImpl) Lookup(hash string) (APIKey, error) {
+	s.mutex.RLock()
+	store := s.store
+	s.mutex.RUnlock()
+
+	return store.Lookup(hash)
+}
+
+// Start checks the file for changes until the context is cancelled.
+func (s *fileKeyStoreImpl) Start(ctx context.Context) {
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(s.interval):
+				if err := s.reloadIfChanged(); err != nil {
+					s.log.Error(events.APIKeyReload, "Failed reloading API keys from %s: %v", s.path, err)
+				}
+			}
+		}
+	}()
+}
+
+func (s *fileKeyStoreImpl) Reload() error {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	keys, err := ParseAPIKeys(data)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	s.store = NewStaticKeyStore(keys)
+	s.modTime = info.ModTime()
+	s.mutex.Unlock()
+
+	s.log.Info(events.APIKeyReload, "Loaded %d API keys from %s", len(keys), s.path)
+	return nil
+}
+
+func (s *fileKeyStoreImpl) reloadIfChanged() error {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.RLock()
+	changed := !info.ModTime().Equal(s.modTime)
+	s.mutex.RUnlock()
+
+	if !changed {
+		return nil
+	}
+	return s.Reload()
+}
+
+func authenticateAPIKey(options APIKeyOptions, r *http.Request) (APIKey, error) {
+	presented := r.Header.Get(options.Header)
+	if presented == "" && options.QueryParameter != "" {
+		presented = r.URL.Query().Get(options.QueryParameter)
+	}
+	if presented == "" {
+		return APIKey{}, ErrAPIKeyMissing
+	}
+
+	key, err := options.Store.Lookup(HashAPIKey(presented))
+	if err != nil {
+		return APIKey{}, err
+	}
+	if !key.Enabled {
+		return APIKey{}, ErrAPIKeyDisabled
+	}
+	if !key.Expires.IsZero() && !options.Clock.Now().Before(key.Expires) {
+		return APIKey{}, ErrAPIKeyExpired
+	}
+	return key, nil
+}
+
+func apiKeyRejectionReason(err error) string {
+	switch err {
+	case ErrAPIKeyMissing:
+		return "missing"
+	case ErrAPIKeyUnknown:
+		return "unknown"
+	case ErrAPIKeyExpired:
+		return "expired"
+	case ErrAPIKeyDisabled:
+		return "disabled"
+	}
+	return "error"
+}
@@ -0,0 +1,201 @@
+package servicefoundation_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	sf "github.com/Prutswonder/go-servicefoundation"
+	"github.com/Prutswonder/go-servicefoundation/servicetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+var apiKeyNow = time.Date(2017, 6, 15, 10, 0, 0, 0, time.UTC)
+
+func newTestAPIKeyMiddleware(store sf.KeyStore, m *mockMetrics) sf.MiddlewareFunc {
+	log := &mockLogger{}
+	log.On("Debug", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	m.On("CountLabels", "apikey", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+
+	return sf.NewAPIKeyMiddleware(sf.APIKeyOptions{Store: store, Clock: servicetest.NewFakeClock(apiKeyNow)}, log, m)
+}
+
+func apiKeyRequest(middleware sf.MiddlewareFunc, key string) (*httptest.ResponseRecorder, sf.JWTClaims) {
+	r, _ := http.NewRequest(http.MethodGet, "/orders", nil)
+	if key != "" {
+		r.Header.Set(sf.DefaultAPIKeyHeader, key)
+	}
+
+	var claims sf.JWTClaims
+	w, _ := servicetest.RunMiddlewareWithHandler(middleware, r,
+		func(w sf.WrappedResponseWriter, r *http.Request, _ sf.RouterParams) {
+			claims = sf.JWTClaimsFromContext(r.Context())
+			w.WriteHeader(http.StatusNoContent)
+		})
+	return w, claims
+}
+
+func TestAPIKeyMiddleware_Rejections(t *testing.T) {
+	store := sf.NewStaticKeyStore([]sf.APIKey{
+		{ID: "expired", Owner: "scripts", Hash: sf.HashAPIKey("expired-key"), Expires: apiKeyNow, Enabled: true},
+		{ID: "disabled", Owner: "scripts", Hash: sf.HashAPIKey("disabled-key")},
+	})
+
+	tests := []struct {
+		key    string
+		reason string
+		detail string
+	}{
+		{"", "missing", "API key missing"},
+		{"other-key", "unknown", "API key unknown"},
+		{"expired-key", "expired", "API key expired"},
+		{"disabled-key", "disabled", "API key disabled"},
+	}
+
+	for _, test := range tests {
+		m := &mockMetrics{}
+		sut := newTestAPIKeyMiddleware(store, m)
+
+		// Act
+		w, claims := apiKeyRequest(sut, test.key)
+
+		var problem sf.Problem
+		json.Unmarshal(w.Body.Bytes(), &problem)
+		assert.Equal(t, http.StatusUnauthorized, w.Code, test.reason)
+		assert.Equal(t, sf.ContentTypeProblemJSON, w.Header().Get(sf.ContentTypeHeader), test.reason)
+		assert.Equal(t, test.detail, problem.Detail, test.reason)
+		assert.Nil(t, claims, test.reason)
+		m.AssertCalled(t, "CountLabels", "apikey", "rejected_total", mock.Anything, []string{"reason"}, []string{test.reason})
+	}
+}
+
+func TestAPIKeyMiddleware_RotationOverlap(t *testing.T) {
+	store := sf.NewStaticKeyStore([]sf.APIKey{
+		{ID: "partner-2016", Owner: "partner", Hash: sf.HashAPIKey("old-key"), Scopes: []string{"orders.read"},
+			Expires: apiKeyNow.Add(24 * time.Hour), Enabled: true},
+		{ID: "partner-2017", Owner: "partner", Hash: sf.HashAPIKey("new-key"), Scopes: []string{"orders.read"},
+			Enabled: true},
+	})
+	m := &mockMetrics{}
+	sut := newTestAPIKeyMiddleware(store, m)
+
+	for _, test := range []struct{ key, id string }{{"old-key", "partner-2016"}, {"new-key", "partner-2017"}} {
+		// Act
+		w, claims := apiKeyRequest(sut, test.key)
+
+		assert.Equal(t, http.StatusNoContent, w.Code, test.id)
+		assert.Equal(t, "partner", claims["sub"], test.id)
+		assert.Equal(t, test.id, claims["api_key_id"], test.id)
+		assert.Equal(t, []string{"orders.read"}, claims.Scopes(), test.id)
+		m.AssertCalled(t, "CountLabels", "apikey", "requests_total", mock.Anything, []string{"key"}, []string{test.id})
+	}
+}
+
+func TestAPIKeyMiddleware_QueryParameter(t *testing.T) {
+	store := sf.NewStaticKeyStore([]sf.APIKey{{ID: "script", Hash: sf.HashAPIKey("secret"), Enabled: true}})
+	m := &mockMetrics{}
+	m.On("CountLabels", "apikey", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+	log := &mockLogger{}
+	log.On("Debug", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+
+	tests := []struct {
+		parameter string
+		expected  int
+	}{
+		{"", http.StatusUnauthorized},
+		{"api_key", http.StatusOK},
+	}
+
+	for _, test := range tests {
+		sut := sf.NewAPIKeyMiddleware(sf.APIKeyOptions{Store: store, QueryParameter: test.parameter}, log, m)
+		r, _ := http.NewRequest(http.MethodGet, "/orders?api_key=secret", nil)
+
+		// Act
+		w, _ := servicetest.RunMiddleware(sut, r)
+
+		assert.Equal(t, test.expected, w.Code, test.parameter)
+	}
+}
+
+func TestFileKeyStore_Reloads(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "apikeys")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "keys.json")
+	ioutil.WriteFile(path, []byte(`[{"id":"old","owner":"partner","hash":"`+sf.HashAPIKey("old-key")+`"}]`), 0644)
+	log := &mockLogger{}
+	log.On("Info", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	log.On("Error", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	sut, err := sf.NewFileKeyStore(path, 10*time.Millisecond, log)
+	assert.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Act
+	sut.Start(ctx)
+	key, oldErr := sut.Lookup(sf.HashAPIKey("old-key"))
+	ioutil.WriteFile(path, []byte(`[{"id":"new","owner":"partner","hash":"`+sf.HashAPIKey("new-key")+`"},
+		{"id":"old","owner":"partner","hash":"`+sf.HashAPIKey("old-key")+`","enabled":false}]`), 0644)
+	os.Chtimes(path, time.Now(), time.Now().Add(time.Second))
+
+	assert.NoError(t, oldErr)
+	assert.True(t, key.Enabled, "keys are enabled unless stated otherwise")
+	for i := 0; i < 100; i++ {
+		if _, err = sut.Lookup(sf.HashAPIKey("new-key")); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.NoError(t, err, "the changed file is reloaded")
+	key, _ = sut.Lookup(sf.HashAPIKey("old-key"))
+	assert.False(t, key.Enabled)
+
+	ioutil.WriteFile(path, []byte(`[{"id":`), 0644)
+	assert.Error(t, sut.Reload())
+	_, err = sut.Lookup(sf.HashAPIKey("new-key"))
+	assert.NoError(t, err, "the previous keys stay in use")
+}
+
+func TestRequireScopes(t *testing.T) {
+	store := sf.NewStaticKeyStore([]sf.APIKey{
+		{ID: "reader", Hash: sf.HashAPIKey("reader-key"), Scopes: []string{"orders.read"}, Enabled: true},
+		{ID: "writer", Hash: sf.HashAPIKey("writer-key"), Scopes: []string{"orders.read", "orders.write"}, Enabled: true},
+	})
+	apiKeys := newTestAPIKeyMiddleware(store, &mockMetrics{})
+	server := newTestOIDCServer("k1")
+	defer server.Close()
+	oidc := newTestOIDCAuthenticator(sf.OIDCOptions{Issuers: []sf.OIDCIssuerOptions{{IssuerURL: server.URL}}})
+	token := server.token("k1", map[string]interface{}{"sub": "user-1", "scope": "orders.read orders.write"})
+	jwt := func(next sf.Handle) sf.Handle {
+		return func(w sf.WrappedResponseWriter, r *http.Request, p sf.RouterParams) {
+			r.Header.Set("Authorization", "Bearer "+token)
+			oidc.Middleware()(next)(w, r, p)
+		}
+	}
+	policy := sf.RequireScopes("orders.write")
+
+	tests := []struct {
+		name       string
+		middleware sf.MiddlewareFunc
+		key        string
+		expected   int
+	}{
+		{"api key without scope", sf.NewChain(apiKeys, policy).Then, "reader-key", http.StatusForbidden},
+		{"api key with scope", sf.NewChain(apiKeys, policy).Then, "writer-key", http.StatusNoContent},
+		{"jwt with scope", sf.NewChain(jwt, policy).Then, "", http.StatusNoContent},
+		{"unauthenticated", policy, "", http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		// Act
+		w, _ := apiKeyRequest(test.middleware, test.key)
+
+		assert.Equal(t, test.expected, w.Code, test.name)
+	}
+}
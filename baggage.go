@@ -0,0 +1,317 @@
+package servicefoundation
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/Prutswonder/go-servicefoundation/events"
+)
+
+const (
+	// BaggageHeader is the W3C header that carries the baggage of a request.
+	BaggageHeader = "baggage"
+	// BaggageOtherValue is the metric label value of baggage values that are not listed in BaggageOptions.MetricKeys.
+	BaggageOtherValue = "other"
+
+	defaultBaggageMaxEntries = 64
+	defaultBaggageMaxBytes   = 8192
+
+	baggageSubsystem = "baggage"
+)
+
+type (
+	// BaggageOptions contains the settings of the baggage of inbound requests, which is read from the W3C baggage
+	// header and from the LegacyHeaders, which maps header names to baggage keys. Keys that are not in AllowedKeys are
+	// dropped, including those of legacy headers. The baggage is limited to MaxEntries entries and MaxBytes bytes in
+	// its encoded form, which default to 64 and 8192. LogKeys are added to the request logging. MetricKeys are added as
+	// labels to the request metrics, with their allowed values; other values are recorded as "other", to bound the
+	// cardinality.
+	BaggageOptions struct {
+		AllowedKeys   []string
+		LegacyHeaders map[string]string
+		MaxEntries    int
+		MaxBytes      int
+		LogKeys       []string
+		MetricKeys    map[string][]string
+	}
+
+	baggageConfig struct {
+		options      BaggageOptions
+		allowed      map[string]bool
+		metricKeys   []string
+		metricValues map[string]map[string]bool
+		metrics      Metrics
+	}
+
+	// baggageSet is the immutable baggage of a context. Config is nil for baggage that was added without the baggage
+	// middleware, which is propagated with the default limits but not logged or recorded.
+	baggageSet struct {
+		values map[string]string
+		config *baggageConfig
+	}
+
+	baggageTransport struct {
+		base http.RoundTripper
+	}
+
+	baggageContextKey struct{}
+)
+
+// NewBaggageMiddleware returns a MiddlewareFunc that puts the allowed baggage of the request on its context, where it
+// is available through Baggage and propagated by the clients of the ClientFactory and the webhook error reporter.
+// Baggage that exceeds the limits is truncated to the entries that fit in the order of their keys, and counted.
+func NewBaggageMiddleware(options BaggageOptions, log Logger, metrics Metrics) MiddlewareFunc {
+	if options.MaxEntries <= 0 {
+		options.MaxEntries = defaultBaggageMaxEntries
+	}
+	if options.MaxBytes <= 0 {
+		options.MaxBytes = defaultBaggageMaxBytes
+	}
+
+	c := &baggageConfig{
+		options:      options,
+		allowed:      make(map[string]bool),
+		metricValues: make(map[string]map[string]bool),
+		metrics:      metrics,
+	}
+	for _, key := range options.AllowedKeys {
+		c.allowed[key] = true
+	}
+	for header, key := range options.LegacyHeaders {
+		if !c.allowed[key] {
+			log.Error(events.Baggage, "Ignoring legacy baggage header %s, because key '%s' is not allowed", header, key)
+		}
+	}
+	for key, values := range options.MetricKeys {
+		if !c.allowed[key] {
+			log.Error(events.Baggage, "Ignoring baggage metric label, because key '%s' is not allowed", key)
+			continue
+		}
+		c.metricKeys = append(c.metricKeys, key)
+		c.metricValues[key] = make(map[string]bool)
+		for _, value := range values {
+			c.metricValues[key][value] = true
+		}
+	}
+	sort.Strings(c.metricKeys)
+
+	return c.middleware
+}
+
+// NewBaggageTransport returns a RoundTripper that sends the baggage of the request's context in the baggage header,
+// unless the request already has one.
+func NewBaggageTransport(base http.RoundTripper) http.RoundTripper {
+	return &baggageTransport{base: base}
+}
+
+// Baggage returns a copy of the baggage of the context, which is empty when the context has no baggage.
+func Baggage(ctx context.Context) map[string]string {
+	values := make(map[string]string)
+	if set := baggageOf(ctx); set != nil {
+		for key, value := range set.values {
+			values[key] = value
+		}
+	}
+	return values
+}
+
+// WithBaggageValue returns a copy of the context with the baggage value, which is propagated on outbound requests.
+// The allowed keys only apply to inbound baggage, but the limits do apply.
+func WithBaggageValue(ctx context.Context, key, value string) context.Context {
+	set := &baggageSet{values: Baggage(ctx)}
+	if current := baggageOf(ctx); current != nil {
+		set.config = current.config
+	}
+	set.values[key] = value
+
+	return context.WithValue(ctx, baggageContextKey{}, set.limited())
+}
+
+func (c *baggageConfig) middleware(next Handle) Handle {
+	return func(w WrappedResponseWriter, r *http.Request, p RouterParams) {
+		set := &baggageSet{values: make(map[string]string), config: c}
+
+		// The baggage header takes precedence over the legacy headers.
+		c.parse(strings.Join(r.Header[http.CanonicalHeaderKey(BaggageHeader)], ","), set.values)
+		for header, key := range c.options.LegacyHeaders {
+			if _, ok := set.values[key]; !ok && c.allowed[key] {
+				if value := strings.TrimSpace(r.Header.Get(header)); value != "" {
+					set.values[key] = value
+				}
+			}
+		}
+
+		ctx := context.WithValue(r.Context(), baggageContextKey{}, set.limited())
+		next(w, r.WithContext(ctx), p)
+	}
+}
+
+// parse adds the allowed members of the W3C baggage header to the values. Properties of members are ignored, and so
+// are invalid members and later members with the same key.
+func (c *baggageConfig) parse(header string, values map[string]string) {
+	for _, member := range strings.Split(header, ",") {
+		if i := strings.IndexByte(member, ';'); i >= 0 {
+			member = member[:i]
+		}
+		parts := strings.SplitN(member, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		key := strings.TrimSpace(parts[0])
+		value, err := url.PathUnescape(strings.TrimSpace(parts[1]))
+		if err != nil || !c.allowed[key] {
+			continue
+		}
+		if _, ok := values[key]; !ok {
+			values[key] = value
+		}
+	}
+}
+
+// limited returns the baggage with the entries that fit in the limits, in the order of their keys.
+func (b *baggageSet) limited() *baggageSet {
+	maxEntries, maxBytes := defaultBaggageMaxEntries, defaultBaggageMaxBytes
+	if b.config != nil {
+		maxEntries, maxBytes = b.config.options.MaxEntries, b.config.options.MaxBytes
+	}
+
+	keys := b.keys()
+	var size int
+	for i, key := range keys {
+		reason := ""
+		size += len(encodeBaggageMember(key, b.values[key]))
+		if i > 0 {
+			size++
+		}
+
+		switch {
+		case i >= maxEntries:
+			reason = "entries"
+		case size > maxBytes:
+			reason = "bytes"
+		}
+		if reason == "" {
+			continue
+		}
+
+		limited := &baggageSet{values: make(map[string]string, i), config: b.config}
+		for _, kept := range keys[:i] {
+			limited.values[kept] = b.values[kept]
+		}
+		if b.config != nil {
+			b.config.metrics.CountLabels(baggageSubsystem, "truncated_total", "Total baggage truncated to the limits.",
+				[]string{"reason"}, []string{reason})
+		}
+		return limited
+	}
+	return b
+}
+
+func (b *baggageSet) keys() []string {
+	keys := make([]string, 0, len(b.values))
+	for key := range b.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// header returns the baggage encoded for the W3C baggage header.
+func (b *baggageSet) header() string {
+	members := make([]string, 0, len(b.values))
+	for _, key := range b.keys() {
+		members = append(members, encodeBaggageMember(key, b.values[key]))
+	}
+	return strings.Join(members, ",")
+}
+
+func encodeBaggageMember(key, value string) string {
+	return key + "=" + url.PathEscape(value)
+}
+
+func baggageOf(ctx context.Context) *baggageSet {
+	set, _ := ctx.Value(baggageContextKey{}).(*baggageSet)
+	return set
+}
+
+// withBaggageOf returns a copy of the context with the baggage of another context, for work that outlives a request.
+func withBaggageOf(ctx context.Context, set *baggageSet) context.Context {
+	if set == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, baggageContextKey{}, set)
+}
+
+// setBaggageHeader sets the baggage header of the outbound request to the baggage of the context, unless the request
+// already has one.
+func setBaggageHeader(ctx context.Context, header http.Header) {
+	set := baggageOf(ctx)
+	if set == nil || len(set.values) == 0 || header.Get(BaggageHeader) != "" {
+		return
+	}
+	header.Set(BaggageHeader, set.header())
+}
+
+// baggageLogFields returns the log keys of the baggage of the context, like "tenant=acme, experiment=b".
+func baggageLogFields(ctx context.Context) string {
+	set := baggageOf(ctx)
+	if set == nil || set.config == nil {
+		return ""
+	}
+
+	var fields []string
+	for _, key := range set.config.options.LogKeys {
+		if value, ok := set.values[key]; ok {
+			fields = append(fields, key+"="+value)
+		}
+	}
+	return strings.Join(fields, ", ")
+}
+
+// baggageMetrics returns the labels and values with a baggage_<key> label per metric key. Values that are missing are
+// recorded as an empty string, and values that are not allowed as "other".
+func baggageMetrics(ctx context.Context, labels, values []string) ([]string, []string) {
+	set := baggageOf(ctx)
+	if set == nil || set.config == nil {
+		return labels, values
+	}
+
+	for _, key := range set.config.metricKeys {
+		value, ok := set.values[key]
+		if ok && !set.config.metricValues[key][value] {
+			value = BaggageOtherValue
+		}
+		labels = append(labels, "baggage_"+baggageLabelName(key))
+		values = append(values, value)
+	}
+	return labels, values
+}
+
+// baggageLabelName replaces the characters of the key that aren't valid in a metric label name.
+func baggageLabelName(key string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, key)
+}
+
+/* http.RoundTripper implementation */
+
+func (t *baggageTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	set := baggageOf(req.Context())
+	if set == nil || len(set.values) == 0 || req.Header.Get(BaggageHeader) != "" {
+		return t.base.RoundTrip(req)
+	}
+
+	// Never modify the original request.
+	propagated := req.WithContext(req.Context())
+	propagated.Header = cloneHeader(req.Header)
+	setBaggageHeader(req.Context(), propagated.Header)
+	return t.base.RoundTrip(propagated)
+}
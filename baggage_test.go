@@ -0,0 +1,216 @@
+package servicefoundation_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	sf "github.com/Prutswonder/go-servicefoundation"
+	"github.com/Prutswonder/go-servicefoundation/servicetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func runBaggageMiddleware(options sf.BaggageOptions, m sf.Metrics, header http.Header) map[string]string {
+	r, _ := http.NewRequest(http.MethodGet, "/orders", nil)
+	r.Header = header
+	log := &mockLogger{}
+	log.On("Error", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	var actual map[string]string
+
+	servicetest.RunMiddlewareWithHandler(sf.NewBaggageMiddleware(options, log, m), r,
+		func(_ sf.WrappedResponseWriter, r *http.Request, _ sf.RouterParams) {
+			actual = sf.Baggage(r.Context())
+		})
+	return actual
+}
+
+func TestBaggageMiddleware_Parsing(t *testing.T) {
+	options := sf.BaggageOptions{
+		AllowedKeys:   []string{"tenant", "experiment", "partner"},
+		LegacyHeaders: map[string]string{"X-Tenant-ID": "tenant", "X-Partner-ID": "partner", "X-Session": "session"},
+	}
+	tests := []struct {
+		header   http.Header
+		expected map[string]string
+	}{
+		{http.Header{}, map[string]string{}},
+		{http.Header{"Baggage": {"tenant=acme,experiment=variant"}}, map[string]string{"tenant": "acme", "experiment": "variant"}},
+		{http.Header{"Baggage": {" tenant = acme ; ttl=60 , experiment=a%2Cb%3Dc"}}, map[string]string{"tenant": "acme", "experiment": "a,b=c"}},
+		{http.Header{"Baggage": {"tenant=acme", "experiment=variant"}}, map[string]string{"tenant": "acme", "experiment": "variant"}},
+		{http.Header{"Baggage": {"tenant=acme,tenant=other"}}, map[string]string{"tenant": "acme"}},
+		{http.Header{"Baggage": {"user=alice,invalid,=empty,tenant=%zz"}}, map[string]string{}},
+		{http.Header{"X-Tenant-Id": {"acme"}, "X-Partner-Id": {"p-1"}, "X-Session": {"s-1"}}, map[string]string{"tenant": "acme", "partner": "p-1"}},
+		{http.Header{"Baggage": {"tenant=acme"}, "X-Tenant-Id": {"legacy"}}, map[string]string{"tenant": "acme"}},
+	}
+
+	for _, test := range tests {
+		// Act
+		actual := runBaggageMiddleware(options, &mockMetrics{}, test.header)
+
+		assert.Equal(t, test.expected, actual, "%v", test.header)
+	}
+}
+
+func TestBaggageMiddleware_Limits(t *testing.T) {
+	header := http.Header{"Baggage": {"d=4444,b=22,c=333,a=1"}}
+	tests := []struct {
+		maxEntries     int
+		maxBytes       int
+		expected       map[string]string
+		expectedReason string
+	}{
+		{0, 0, map[string]string{"a": "1", "b": "22", "c": "333", "d": "4444"}, ""},
+		{2, 0, map[string]string{"a": "1", "b": "22"}, "entries"},
+		{0, 12, map[string]string{"a": "1", "b": "22"}, "bytes"},
+		{0, 14, map[string]string{"a": "1", "b": "22", "c": "333"}, "bytes"},
+	}
+
+	for _, test := range tests {
+		m := &mockMetrics{}
+		m.On("CountLabels", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+		options := sf.BaggageOptions{
+			AllowedKeys: []string{"a", "b", "c", "d"},
+			MaxEntries:  test.maxEntries,
+			MaxBytes:    test.maxBytes,
+		}
+
+		// Act
+		actual := runBaggageMiddleware(options, m, header)
+
+		assert.Equal(t, test.expected, actual)
+		if test.expectedReason == "" {
+			m.AssertNotCalled(t, "CountLabels", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+		} else {
+			m.AssertCalled(t, "CountLabels", "baggage", "truncated_total", mock.Anything,
+				[]string{"reason"}, []string{test.expectedReason})
+		}
+	}
+}
+
+func TestWithBaggageValue(t *testing.T) {
+	ctx := sf.WithBaggageValue(context.Background(), "tenant", "acme")
+
+	// Act
+	actual := sf.WithBaggageValue(ctx, "experiment", "variant")
+
+	assert.Equal(t, map[string]string{"tenant": "acme"}, sf.Baggage(ctx), "the original context is unchanged")
+	assert.Equal(t, map[string]string{"tenant": "acme", "experiment": "variant"}, sf.Baggage(actual))
+	assert.Equal(t, map[string]string{}, sf.Baggage(context.Background()))
+}
+
+func newBaggageService(configure func(opt *sf.ServiceOptions, sut sf.Service)) *httptest.Server {
+	opt := sf.NewServiceOptions("baggage", []string{http.MethodGet}, nil)
+	opt.Baggage = sf.NewBaggageMiddleware(sf.BaggageOptions{
+		AllowedKeys:   []string{"tenant", "experiment"},
+		LegacyHeaders: map[string]string{"X-Tenant-ID": "tenant"},
+	}, opt.Logger, opt.Metrics)
+	opt.SetHandlers()
+	sut := sf.NewCustomService(opt)
+	configure(&opt, sut)
+	return httptest.NewServer(sut.Handler("public"))
+}
+
+func TestBaggage_PropagatesThroughChainedServices(t *testing.T) {
+	downstream := newBaggageService(func(_ *sf.ServiceOptions, sut sf.Service) {
+		sut.AddRoute("profile", []string{"/profile"}, sf.MethodsForGet, sf.DefaultMiddlewares,
+			func(w sf.WrappedResponseWriter, r *http.Request, _ sf.RouterParams) {
+				w.JSON(http.StatusOK, sf.Baggage(r.Context()))
+			})
+	})
+	defer downstream.Close()
+	upstream := newBaggageService(func(opt *sf.ServiceOptions, sut sf.Service) {
+		client := opt.ClientFactory.NewClient("profile")
+		sut.AddRoute("checkout", []string{"/checkout"}, sf.MethodsForGet, sf.DefaultMiddlewares,
+			func(w sf.WrappedResponseWriter, r *http.Request, _ sf.RouterParams) {
+				ctx := sf.WithBaggageValue(r.Context(), "experiment", "variant")
+				req, _ := http.NewRequest(http.MethodGet, downstream.URL+"/profile", nil)
+				resp, err := client.Do(req.WithContext(ctx))
+				if err != nil {
+					sf.WriteProblem(w, http.StatusBadGateway, err.Error())
+					return
+				}
+				defer resp.Body.Close()
+				body, _ := ioutil.ReadAll(resp.Body)
+				w.Write(body)
+			})
+	})
+	defer upstream.Close()
+	req, _ := http.NewRequest(http.MethodGet, upstream.URL+"/checkout", nil)
+	req.Header.Set("X-Tenant-ID", "acme")
+	req.Header.Set(sf.BaggageHeader, "user=alice")
+
+	// Act
+	resp, err := http.DefaultClient.Do(req)
+
+	if assert.NoError(t, err) {
+		defer resp.Body.Close()
+		var actual map[string]string
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&actual))
+		assert.Equal(t, map[string]string{"tenant": "acme", "experiment": "variant"}, actual)
+	}
+}
+
+func TestBaggage_WebhookErrorReporter(t *testing.T) {
+	received := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Get(sf.BaggageHeader)
+	}))
+	defer server.Close()
+	ctx := sf.WithBaggageValue(sf.WithBaggageValue(context.Background(), "tenant", "acme"), "experiment", "a b")
+	sut := sf.NewAsyncErrorReporter(sf.NewWebhookErrorReporter(server.URL, nil), sf.ErrorReportingOptions{},
+		sf.ServiceGlobals{}, &mockLogger{}, &mockMetrics{})
+
+	// Act
+	err := sut.Report(ctx, sf.ReportedError{Message: "boom"})
+
+	assert.NoError(t, err)
+	assert.Equal(t, "experiment=a%20b,tenant=acme", <-received, "the baggage outlives the request in the queue")
+}
+
+func TestBaggage_RequestLoggingAndMetrics(t *testing.T) {
+	m, _ := newSyntheticMetrics()
+	log := &mockLogger{}
+	log.On("Info", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	wrapper := sf.NewMiddlewareWrapper(log, m, &sf.CORSOptions{}, sf.ServiceGlobals{})
+	baggage := sf.NewBaggageMiddleware(sf.BaggageOptions{
+		AllowedKeys: []string{"tenant", "experiment", "partner-id"},
+		LogKeys:     []string{"tenant", "partner-id"},
+		MetricKeys:  map[string][]string{"experiment": {"control", "variant"}, "partner-id": {"p-1"}},
+	}, log, m)
+	tests := []struct {
+		header         string
+		expectedLog    string
+		expectedValues []string
+	}{
+		{"tenant=acme,experiment=variant,partner-id=p-1", "tenant=acme, partner-id=p-1", []string{"variant", "p-1"}},
+		{"tenant=acme,experiment=new", "tenant=acme", []string{sf.BaggageOtherValue, ""}},
+	}
+
+	for _, test := range tests {
+		r, _ := http.NewRequest(http.MethodGet, "/orders", nil)
+		r.Header.Set(sf.BaggageHeader, test.header)
+
+		// Act
+		baggage(wrapper.Wrap("public", "orders", sf.RequestLogging,
+			func(sf.WrappedResponseWriter, *http.Request, sf.RouterParams) {}))(
+			sf.NewWrappedResponseWriter(httptest.NewRecorder()), r, sf.RouterParams{})
+
+		log.AssertCalled(t, "Info", "Response-orders",
+			"Handled request, baggage: %v, duration_us: %v, method: %v, path: %v, remote_addr: %v, status: %v", mock.Anything)
+		var fields interface{} = mock.MatchedBy(func(args []interface{}) bool {
+			return len(args) == 6 && args[0] == test.expectedLog
+		})
+		log.AssertCalled(t, "Info", "Response-orders", mock.Anything, fields)
+		var values interface{} = mock.MatchedBy(func(values []string) bool {
+			return strings.Join(values[len(values)-2:], "|") == strings.Join(test.expectedValues, "|")
+		})
+		m.AssertCalled(t, "CountLabels", "", "http_requests_total", mock.Anything,
+			[]string{"app", "server", "env", "code", "method", "handler", "version", "subsystem",
+				"baggage_experiment", "baggage_partner_id"}, values)
+	}
+}
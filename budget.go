@@ -0,0 +1,198 @@
+package servicefoundation
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const budgetSubsystem = "budget"
+
+type (
+	// RouteBudget is the time budget of a route. Total is applied as the deadline of the request context and
+	// SubBudgets contain the parts of it that are reserved for named dependencies.
+	RouteBudget struct {
+		Total      time.Duration
+		SubBudgets map[string]time.Duration
+	}
+
+	// Budgets contains the RouteBudget per route name.
+	Budgets map[string]RouteBudget
+
+	budgetTracker struct {
+		route   string
+		budget  RouteBudget
+		metrics Metrics
+	}
+
+	budgetContextKey struct{}
+
+	budgetTransport struct {
+		base   http.RoundTripper
+		budget string
+	}
+
+	budgetReadCloser struct {
+		io.ReadCloser
+		cancel context.CancelFunc
+	}
+)
+
+// NewBudgetMiddleware returns a MiddlewareFunc that applies the total budget of the route as the deadline of the
+// request context, so sub-budgets can be taken from it using BudgetContext.
+func NewBudgetMiddleware(route string, budget RouteBudget, metrics Metrics) MiddlewareFunc {
+	return func(next Handle) Handle {
+		return func(w WrappedResponseWriter, r *http.Request, p RouterParams) {
+			ctx, cancel := context.WithTimeout(r.Context(), budget.Total)
+			defer cancel()
+
+			ctx = context.WithValue(ctx, budgetContextKey{}, &budgetTracker{
+				route:   route,
+				budget:  budget,
+				metrics: metrics,
+			})
+			next(w, r.WithContext(ctx), p)
+		}
+	}
+}
+
+// BudgetContext returns a child context with a deadline of the remaining route budget or the named sub-budget,
+// whichever ends first. Calling the returned CancelFunc releases the context and records the time used for the
+// sub-budget as a histogram. Without a route budget in the context, the context only gets cancelled.
+func BudgetContext(ctx context.Context, name string) (context.Context, context.CancelFunc) {
+	tracker, ok := ctx.Value(budgetContextKey{}).(*budgetTracker)
+	if !ok {
+		return context.WithCancel(ctx)
+	}
+
+	start := time.Now()
+
+	var child context.Context
+	var cancel context.CancelFunc
+	if subBudget, ok := tracker.budget.SubBudgets[name]; ok {
+		// The parent deadline still applies when it's earlier.
+		child, cancel = context.WithTimeout(ctx, subBudget)
+	} else {
+		child, cancel = context.WithCancel(ctx)
+	}
+
+	histogram := tracker.metrics.AddHistogramLabels(budgetSubsystem, "duration_seconds",
+		"Time used for the sub-budgets of routes.", []string{"route", "budget"}, []string{tracker.route, name})
+
+	once := sync.Once{}
+	return child, func() {
+		once.Do(func() {
+			cancel()
+			histogram.RecordTimeElapsed(start, time.Second)
+		})
+	}
+}
+
+// NewBudgetTransport returns a RoundTripper that runs every request within the named sub-budget of the request's
+// route budget. The sub-budget ends when the response body is closed.
+func NewBudgetTransport(base http.RoundTripper, budget string) http.RoundTripper {
+	return &budgetTransport{base: base, budget: budget}
+}
+
+// ParseBudgets parses a budget specification, like "checkout=800ms:inventory=300ms:payment=400ms;search=200ms".
+// Routes are separated by semicolons, and their sub-budgets by colons.
+func ParseBudgets(spec string) (Budgets, error) {
+	budgets := Budgets{}
+
+	for _, route := range strings.Split(spec, ";") {
+		if strings.TrimSpace(route) == "" {
+			continue
+		}
+
+		parts := strings.Split(route, ":")
+		name, total, err := parseBudget(parts[0])
+		if err != nil {
+			return nil, err
+		}
+
+		budget := RouteBudget{Total: total, SubBudgets: make(map[string]time.Duration)}
+		for _, part := range parts[1:] {
+			subName, subBudget, err := parseBudget(part)
+			if err != nil {
+				return nil, err
+			}
+			budget.SubBudgets[subName] = subBudget
+		}
+		budgets[name] = budget
+	}
+	return budgets, nil
+}
+
+// Validate returns an error when a budget references a route that isn't registered, or when the sub-budgets of a
+// route exceed its total budget.
+func (b Budgets) Validate(routes []string) error {
+	known := make(map[string]bool, len(routes))
+	for _, route := range routes {
+		known[route] = true
+	}
+
+	names := make([]string, 0, len(b))
+	for name := range b {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		budget := b[name]
+
+		if !known[name] {
+			return fmt.Errorf("Budget for unknown route '%s'", name)
+		}
+		if budget.Total <= 0 {
+			return fmt.Errorf("Budget for route '%s' has no total", name)
+		}
+
+		var sum time.Duration
+		for _, subBudget := range budget.SubBudgets {
+			sum += subBudget
+		}
+		if sum > budget.Total {
+			return fmt.Errorf("Sub-budgets of route '%s' (%v) exceed its total budget (%v)", name, sum, budget.Total)
+		}
+	}
+	return nil
+}
+
+func parseBudget(value string) (string, time.Duration, error) {
+	parts := strings.SplitN(strings.TrimSpace(value), "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return "", 0, fmt.Errorf("Invalid budget '%s'", value)
+	}
+
+	d, err := time.ParseDuration(parts[1])
+	if err != nil {
+		return "", 0, fmt.Errorf("Invalid budget '%s': %v", value, err)
+	}
+	return parts[0], d, nil
+}
+
+/* http.RoundTripper implementation */
+
+func (t *budgetTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, cancel := BudgetContext(req.Context(), t.budget)
+
+	resp, err := t.base.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	resp.Body = &budgetReadCloser{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+func (b *budgetReadCloser) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
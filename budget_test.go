@@ -0,0 +1,130 @@
+package servicefoundation_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	sf "github.com/Prutswonder/go-servicefoundation"
+	"github.com/Prutswonder/go-servicefoundation/servicetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+var checkoutBudget = sf.RouteBudget{
+	Total: 200 * time.Millisecond,
+	SubBudgets: map[string]time.Duration{
+		"inventory": 50 * time.Millisecond,
+		"payment":   150 * time.Millisecond,
+	},
+}
+
+func newBudgetMetrics() (*mockMetrics, *mockMetricsHistogram) {
+	m := &mockMetrics{}
+	h := &mockMetricsHistogram{}
+	m.On("AddHistogramLabels", "budget", "duration_seconds", mock.Anything, []string{"route", "budget"}, mock.Anything).
+		Return(h)
+	h.On("RecordTimeElapsed", mock.Anything, time.Second)
+	return m, h
+}
+
+func assertDeadline(t *testing.T, expected time.Time, ctx context.Context, msg string) {
+	deadline, ok := ctx.Deadline()
+
+	assert.True(t, ok, msg)
+	assert.True(t, deadline.Sub(expected) < 10*time.Millisecond && expected.Sub(deadline) < 10*time.Millisecond,
+		"%s: expected deadline %v, actual %v", msg, expected, deadline)
+}
+
+func TestBudgetContext_DeadlineMath(t *testing.T) {
+	m, _ := newBudgetMetrics()
+	r, _ := http.NewRequest(http.MethodGet, "/checkout", nil)
+	start := time.Now()
+
+	// Act
+	servicetest.RunMiddlewareWithHandler(sf.NewBudgetMiddleware("checkout", checkoutBudget, m), r,
+		func(w sf.WrappedResponseWriter, r *http.Request, _ sf.RouterParams) {
+			assertDeadline(t, start.Add(200*time.Millisecond), r.Context(), "total")
+
+			inventory, cancel := sf.BudgetContext(r.Context(), "inventory")
+			assertDeadline(t, time.Now().Add(50*time.Millisecond), inventory, "inventory")
+			cancel()
+
+			time.Sleep(100 * time.Millisecond)
+
+			// Only 100ms of the total is remaining, which is less than the payment budget.
+			payment, cancel := sf.BudgetContext(r.Context(), "payment")
+			assertDeadline(t, start.Add(200*time.Millisecond), payment, "payment")
+			cancel()
+
+			unknown, cancel := sf.BudgetContext(r.Context(), "unknown")
+			assertDeadline(t, start.Add(200*time.Millisecond), unknown, "unknown")
+			cancel()
+		})
+}
+
+func TestBudgetContext_WithoutRouteBudget(t *testing.T) {
+	// Act
+	ctx, cancel := sf.BudgetContext(context.Background(), "payment")
+	_, ok := ctx.Deadline()
+	cancel()
+
+	assert.False(t, ok)
+	assert.Error(t, ctx.Err())
+}
+
+func TestBudgetContext_MetricsAttribution(t *testing.T) {
+	m, h := newBudgetMetrics()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	client := sf.NewClientFactory(sf.ClientOptions{Budgets: map[string]string{"payments": "payment"}}).
+		NewClient("payments")
+	r, _ := http.NewRequest(http.MethodGet, "/checkout", nil)
+
+	// Act
+	servicetest.RunMiddlewareWithHandler(sf.NewBudgetMiddleware("checkout", checkoutBudget, m), r,
+		func(w sf.WrappedResponseWriter, r *http.Request, _ sf.RouterParams) {
+			_, cancel := sf.BudgetContext(r.Context(), "inventory")
+			cancel()
+			cancel()
+
+			req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+			resp, err := client.Do(req.WithContext(r.Context()))
+			assert.NoError(t, err)
+			resp.Body.Close()
+		})
+
+	m.AssertCalled(t, "AddHistogramLabels", "budget", "duration_seconds", mock.Anything, []string{"route", "budget"},
+		[]string{"checkout", "inventory"})
+	m.AssertCalled(t, "AddHistogramLabels", "budget", "duration_seconds", mock.Anything, []string{"route", "budget"},
+		[]string{"checkout", "payment"})
+	h.AssertNumberOfCalls(t, "RecordTimeElapsed", 2)
+}
+
+func TestBudgets_Validate(t *testing.T) {
+	tests := []struct {
+		spec  string
+		valid bool
+	}{
+		{"checkout=800ms:inventory=300ms:payment=400ms", true},
+		{"checkout=800ms:inventory=500ms:payment=400ms", false},
+		{"search=200ms", false},
+		{"checkout=0s", false},
+	}
+
+	for _, test := range tests {
+		budgets, err := sf.ParseBudgets(test.spec)
+		assert.NoError(t, err, test.spec)
+
+		// Act
+		err = budgets.Validate([]string{"checkout"})
+
+		assert.Equal(t, test.valid, err == nil, test.spec)
+	}
+
+	_, err := sf.ParseBudgets("checkout=fast")
+
+	assert.Error(t, err)
+}
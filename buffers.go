@@ -0,0 +1,253 @@
+package servicefoundation
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Prutswonder/go-servicefoundation/events"
+)
+
+const (
+	bufferPoolSubsystem = "buffers"
+	defaultJSONSizeHint = 512
+)
+
+// defaultBufferSizeClasses are the capacities of the pooled buffers, from small JSON documents to large chunks.
+var defaultBufferSizeClasses = []int{4 << 10, 64 << 10, 1 << 20}
+
+var sizeClassLabels = []string{"size_class"}
+
+type (
+	// Buffer is a byte buffer taken from a BufferPool. Release returns it to the pool, after which it must not be used
+	// anymore. Buffers taken with GetBuffer are released after the response when the handler didn't release them.
+	Buffer struct {
+		*bytes.Buffer
+		pool     *bufferPoolImpl
+		class    *bufferClass
+		released int32
+	}
+
+	// BufferPoolOptions contains the settings of a BufferPool. SizeClasses are the capacities of the pooled buffers in
+	// ascending order. Development logs buffers that are released twice, which is ignored otherwise.
+	BufferPoolOptions struct {
+		SizeClasses []int
+		Development bool
+	}
+
+	// BufferPoolStats contains the usage of a size class of a BufferPool. A SizeClass of 0 contains the buffers that
+	// are larger than the largest size class, which are never pooled.
+	BufferPoolStats struct {
+		SizeClass int    `json:"sizeClass"`
+		Gets      uint64 `json:"gets"`
+		Puts      uint64 `json:"puts"`
+		News      uint64 `json:"news"`
+		Discards  uint64 `json:"discards"`
+	}
+
+	// BufferPool reuses byte buffers in size classes, so small requests don't pin huge buffers.
+	BufferPool interface {
+		Get(sizeHint int) *Buffer
+		Stats() []BufferPoolStats
+	}
+
+	// BufferProvider is implemented by response writers that take the buffers of the response helpers from a pool.
+	BufferProvider interface {
+		GetBuffer(sizeHint int) *Buffer
+	}
+
+	bufferPoolImpl struct {
+		classes     []*bufferClass
+		oversized   *bufferClass
+		development bool
+		log         Logger
+		metrics     Metrics
+	}
+
+	bufferClass struct {
+		size     int
+		values   []string
+		pool     sync.Pool
+		gets     uint64
+		puts     uint64
+		news     uint64
+		discards uint64
+	}
+
+	// requestBuffers tracks the buffers taken during a request, so they can be released after the response.
+	requestBuffers struct {
+		pool    BufferPool
+		mutex   sync.Mutex
+		buffers []*Buffer
+	}
+
+	requestBuffersContextKey struct{}
+)
+
+// NewBufferPool instantiates a new BufferPool implementation, which exports its statistics as metrics.
+func NewBufferPool(options BufferPoolOptions, log Logger, metrics Metrics) BufferPool {
+	if len(options.SizeClasses) == 0 {
+		options.SizeClasses = defaultBufferSizeClasses
+	}
+
+	p := &bufferPoolImpl{
+		development: options.Development,
+		log:         log,
+		metrics:     metrics,
+		oversized:   &bufferClass{values: []string{"oversized"}},
+	}
+	for _, size := range options.SizeClasses {
+		p.classes = append(p.classes, &bufferClass{size: size, values: []string{strconv.Itoa(size)}})
+	}
+	return p
+}
+
+// GetBuffer returns a buffer of at least sizeHint bytes, which is released after the response if the handler doesn't
+// release it. Outside of a request of a Service, it returns a buffer that is not pooled.
+func GetBuffer(ctx context.Context, sizeHint int) *Buffer {
+	if buffers, ok := ctx.Value(requestBuffersContextKey{}).(*requestBuffers); ok {
+		return buffers.get(sizeHint)
+	}
+	return newUnpooledBuffer(sizeHint)
+}
+
+// withRequestBuffers returns a context from which GetBuffer takes buffers of the pool for the request.
+func withRequestBuffers(ctx context.Context, pool BufferPool) (context.Context, *requestBuffers) {
+	buffers := &requestBuffers{pool: pool}
+	return context.WithValue(ctx, requestBuffersContextKey{}, buffers), buffers
+}
+
+// bufferFor returns a buffer of the response writer if it is a BufferProvider, or a buffer that is not pooled.
+func bufferFor(w http.ResponseWriter, sizeHint int) *Buffer {
+	if provider, ok := w.(BufferProvider); ok {
+		return provider.GetBuffer(sizeHint)
+	}
+	return newUnpooledBuffer(sizeHint)
+}
+
+func newUnpooledBuffer(sizeHint int) *Buffer {
+	if sizeHint < 0 {
+		sizeHint = 0
+	}
+	return &Buffer{Buffer: bytes.NewBuffer(make([]byte, 0, sizeHint))}
+}
+
+/* Buffer implementation */
+
+// Release returns the buffer to its pool. Releasing a buffer twice is ignored, and logged in development mode,
+// because the second release usually means the buffer was still referenced after the first.
+func (b *Buffer) Release() {
+	if !b.release() && b.pool != nil && b.pool.development {
+		b.pool.log.Warn(events.BufferDoubleRelease, "Buffer of size class %d released twice", b.class.size)
+	}
+}
+
+func (b *Buffer) release() bool {
+	if !atomic.CompareAndSwapInt32(&b.released, 0, 1) {
+		return false
+	}
+	if b.pool != nil {
+		b.pool.put(b.Buffer)
+	}
+	return true
+}
+
+/* BufferPool implementation */
+
+func (p *bufferPoolImpl) Get(sizeHint int) *Buffer {
+	class := p.classFor(sizeHint)
+	atomic.AddUint64(&class.gets, 1)
+	p.metrics.CountLabels(bufferPoolSubsystem, "gets_total", "Total buffers taken from the pool.", sizeClassLabels, class.values)
+
+	if class != p.oversized {
+		if buffer, ok := class.pool.Get().(*bytes.Buffer); ok {
+			return &Buffer{Buffer: buffer, pool: p, class: class}
+		}
+	}
+
+	atomic.AddUint64(&class.news, 1)
+	p.metrics.CountLabels(bufferPoolSubsystem, "news_total", "Total buffers allocated by the pool.", sizeClassLabels, class.values)
+
+	size := class.size
+	if class == p.oversized {
+		size = sizeHint
+	}
+	return &Buffer{Buffer: bytes.NewBuffer(make([]byte, 0, size)), pool: p, class: class}
+}
+
+func (p *bufferPoolImpl) Stats() []BufferPoolStats {
+	classes := make([]*bufferClass, 0, len(p.classes)+1)
+	classes = append(append(classes, p.classes...), p.oversized)
+
+	stats := make([]BufferPoolStats, 0, len(classes))
+	for _, class := range classes {
+		stats = append(stats, BufferPoolStats{
+			SizeClass: class.size,
+			Gets:      atomic.LoadUint64(&class.gets),
+			Puts:      atomic.LoadUint64(&class.puts),
+			News:      atomic.LoadUint64(&class.news),
+			Discards:  atomic.LoadUint64(&class.discards),
+		})
+	}
+	return stats
+}
+
+// put returns the buffer to the largest size class it fits in. Buffers that grew far beyond their size class are
+// discarded, to avoid pinning their memory for small requests.
+func (p *bufferPoolImpl) put(buffer *bytes.Buffer) {
+	var class *bufferClass
+	for _, c := range p.classes {
+		if c.size <= buffer.Cap() {
+			class = c
+		}
+	}
+
+	if class == nil || buffer.Cap() > 2*class.size {
+		if class == nil {
+			class = p.oversized
+		}
+		atomic.AddUint64(&class.discards, 1)
+		p.metrics.CountLabels(bufferPoolSubsystem, "discards_total", "Total buffers discarded instead of pooled.", sizeClassLabels, class.values)
+		return
+	}
+
+	buffer.Reset()
+	class.pool.Put(buffer)
+	atomic.AddUint64(&class.puts, 1)
+	p.metrics.CountLabels(bufferPoolSubsystem, "puts_total", "Total buffers returned to the pool.", sizeClassLabels, class.values)
+}
+
+// classFor returns the smallest size class for the size hint.
+func (p *bufferPoolImpl) classFor(sizeHint int) *bufferClass {
+	for _, class := range p.classes {
+		if sizeHint <= class.size {
+			return class
+		}
+	}
+	return p.oversized
+}
+
+/* requestBuffers implementation */
+
+func (r *requestBuffers) get(sizeHint int) *Buffer {
+	buffer := r.pool.Get(sizeHint)
+
+	r.mutex.Lock()
+	r.buffers = append(r.buffers, buffer)
+	r.mutex.Unlock()
+	return buffer
+}
+
+// release returns the buffers the handler didn't release to the pool.
+func (r *requestBuffers) release() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, buffer := range r.buffers {
+		buffer.release()
+	}
+	r.buffers = nil
+}
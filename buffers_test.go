@@ -0,0 +1,252 @@
+package servicefoundation_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	sf "github.com/Prutswonder/go-servicefoundation"
+	"github.com/Prutswonder/go-servicefoundation/events"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// discardMetrics ignores all metrics, so benchmarks measure the buffers only.
+type discardMetrics struct {
+	sf.Metrics
+}
+
+func (discardMetrics) CountLabels(subsystem, name, help string, labels, values []string) {}
+
+// discardResponseWriter ignores the response body, so benchmarks measure the encoding only.
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func (w *discardResponseWriter) Header() http.Header         { return w.header }
+func (w *discardResponseWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (w *discardResponseWriter) WriteHeader(int)             {}
+
+func newTestBufferPool(development bool) (sf.BufferPool, *mockLogger) {
+	log := &mockLogger{}
+	log.On("Warn", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+
+	return sf.NewBufferPool(sf.BufferPoolOptions{SizeClasses: []int{1024, 8192}, Development: development}, log, discardMetrics{}), log
+}
+
+func statsOf(pool sf.BufferPool, sizeClass int) sf.BufferPoolStats {
+	for _, stats := range pool.Stats() {
+		if stats.SizeClass == sizeClass {
+			return stats
+		}
+	}
+	return sf.BufferPoolStats{}
+}
+
+func serveWithBuffers(pool sf.BufferPool, handle sf.Handle) *httptest.ResponseRecorder {
+	factory := sf.NewCustomServiceHandlerFactory(&mockMiddlewareWrapper{}, &mockVersionBuilder{}, &mockServiceStateReader{},
+		func(int) {}, sf.ServiceHandlerFactoryOptions{Buffers: pool})
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest(http.MethodGet, "/orders", nil)
+
+	factory.Wrap("public", "orders", nil, handle)(w, r, nil)
+	return w
+}
+
+func TestBufferPool_SizeClasses(t *testing.T) {
+	tests := []struct {
+		sizeHint  int
+		grow      int
+		sizeClass int
+		discarded bool
+	}{
+		{100, 0, 1024, false},
+		{1024, 0, 1024, false},
+		{1025, 0, 8192, false},
+		{100, 4096, 1024, true},
+		{20000, 0, 0, true},
+	}
+
+	for _, test := range tests {
+		sut, _ := newTestBufferPool(false)
+
+		// Act
+		buffer := sut.Get(test.sizeHint)
+		buffer.Write(make([]byte, test.grow))
+		buffer.Release()
+
+		stats := statsOf(sut, test.sizeClass)
+		assert.Equal(t, uint64(1), stats.Gets, "size hint %d", test.sizeHint)
+		assert.Equal(t, uint64(1), stats.News, "size hint %d", test.sizeHint)
+		assert.True(t, buffer.Cap() >= test.sizeHint, "size hint %d", test.sizeHint)
+		if test.discarded {
+			assert.Equal(t, uint64(1), stats.Discards+statsOf(sut, 8192).Discards, "size hint %d", test.sizeHint)
+		} else {
+			assert.Equal(t, uint64(1), stats.Puts, "size hint %d", test.sizeHint)
+
+			// The race detector makes sync.Pool drop buffers at random, so the reuse itself isn't asserted.
+			reused := sut.Get(test.sizeHint)
+			assert.Equal(t, 0, reused.Len(), "reused buffers are empty")
+		}
+	}
+}
+
+func TestGetBuffer_ReleasedAfterResponse(t *testing.T) {
+	sut, log := newTestBufferPool(true)
+
+	// Act
+	serveWithBuffers(sut, func(w sf.WrappedResponseWriter, r *http.Request, _ sf.RouterParams) {
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				buffer := sf.GetBuffer(r.Context(), 100)
+				buffer.WriteString("chunk")
+				if i%2 == 0 {
+					buffer.Release()
+				}
+			}(i)
+		}
+		wg.Wait()
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	stats := statsOf(sut, 1024)
+	assert.Equal(t, uint64(10), stats.Gets)
+	assert.Equal(t, uint64(10), stats.Puts, "all buffers are returned to the pool")
+	log.AssertNotCalled(t, "Warn", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestBuffer_DoubleRelease(t *testing.T) {
+	tests := []struct {
+		development bool
+		expected    int
+	}{
+		{true, 1},
+		{false, 0},
+	}
+
+	for _, test := range tests {
+		sut, log := newTestBufferPool(test.development)
+		var leaked *sf.Buffer
+		serveWithBuffers(sut, func(w sf.WrappedResponseWriter, r *http.Request, _ sf.RouterParams) {
+			leaked = sf.GetBuffer(r.Context(), 100)
+		})
+
+		// Act
+		var wg sync.WaitGroup
+		for i := 0; i < 2; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				leaked.Release()
+			}()
+		}
+		wg.Wait()
+
+		assert.Equal(t, uint64(1), statsOf(sut, 1024).Puts, "a buffer is returned to the pool once")
+		log.AssertNumberOfCalls(t, "Warn", test.expected*2)
+		if test.expected > 0 {
+			log.AssertCalled(t, "Warn", events.BufferDoubleRelease, mock.Anything, mock.Anything)
+		}
+	}
+}
+
+func TestGetBuffer_OutsideRequest(t *testing.T) {
+	r, _ := http.NewRequest(http.MethodGet, "/", nil)
+
+	// Act
+	buffer := sf.GetBuffer(r.Context(), 100)
+
+	assert.True(t, buffer.Cap() >= 100)
+	buffer.Release()
+	buffer.Release()
+}
+
+func TestPooledResponseWriter_JSON(t *testing.T) {
+	sut, _ := newTestBufferPool(false)
+
+	// Act
+	w := serveWithBuffers(sut, func(w sf.WrappedResponseWriter, _ *http.Request, _ sf.RouterParams) {
+		w.JSON(http.StatusCreated, map[string]int{"id": 1})
+	})
+
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, "{\"id\":1}\n", w.Body.String())
+	assert.Equal(t, uint64(1), statsOf(sut, 1024).Puts)
+
+	// Act
+	w = serveWithBuffers(sut, func(w sf.WrappedResponseWriter, _ *http.Request, _ sf.RouterParams) {
+		w.JSON(http.StatusOK, map[string]interface{}{"invalid": make(chan int)})
+	})
+
+	assert.Equal(t, http.StatusInternalServerError, w.Code, "unencodable content responds with a 500")
+	assert.Equal(t, sf.ContentTypeProblemJSON, w.Header().Get(sf.ContentTypeHeader))
+}
+
+func TestPooledResponseWriter_StreamJSON(t *testing.T) {
+	sut, _ := newTestBufferPool(false)
+	items := make(chan interface{}, 3)
+	items <- map[string]int{"id": 1}
+	items <- "b"
+	items <- 3
+	close(items)
+
+	// Act
+	w := serveWithBuffers(sut, func(w sf.WrappedResponseWriter, _ *http.Request, _ sf.RouterParams) {
+		sf.StreamJSON(w, http.StatusOK, items)
+	})
+
+	var actual []interface{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &actual))
+	assert.Equal(t, `[{"id":1},"b",3]`, w.Body.String())
+	assert.Equal(t, uint64(1), statsOf(sut, 1024).Gets)
+}
+
+type benchmarkOrder struct {
+	ID       int      `json:"id"`
+	Customer string   `json:"customer"`
+	Lines    []string `json:"lines"`
+	Total    float64  `json:"total"`
+}
+
+func newBenchmarkOrders() []benchmarkOrder {
+	orders := make([]benchmarkOrder, 100)
+	for i := range orders {
+		orders[i] = benchmarkOrder{ID: i, Customer: strings.Repeat("c", 20), Lines: []string{"a", "b", "c"}, Total: 12.5}
+	}
+	return orders
+}
+
+// BenchmarkJSON compares marshaling every response, as handlers do to respond with a 500 on encoding errors, with
+// encoding it in a pooled buffer, which does the same without allocating the document.
+func BenchmarkJSON(b *testing.B) {
+	orders := newBenchmarkOrders()
+	w := &discardResponseWriter{header: http.Header{}}
+
+	b.Run("marshal", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			body, err := json.Marshal(orders)
+			if err != nil {
+				b.Fatal(err)
+			}
+			ww := sf.NewWrappedResponseWriter(w)
+			ww.Header().Set(sf.ContentTypeHeader, sf.ContentTypeJSON)
+			ww.WriteHeader(http.StatusOK)
+			ww.Write(body)
+		}
+	})
+
+	b.Run("pooled", func(b *testing.B) {
+		pool := sf.NewBufferPool(sf.BufferPoolOptions{}, nil, discardMetrics{})
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			sf.NewPooledResponseWriter(w, pool).JSON(http.StatusOK, orders)
+		}
+	})
+}
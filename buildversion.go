@@ -2,6 +2,9 @@ package servicefoundation
 
 import (
 	"fmt"
+	"runtime"
+	"runtime/debug"
+	"time"
 
 	"github.com/Prutswonder/go-servicefoundation/env"
 )
@@ -12,16 +15,30 @@ type (
 		VersionNumber string `json:"version"`
 		BuildDate     string `json:"buildDate"`
 		GitHash       string `json:"gitHash"`
+		GoVersion     string `json:"goVersion"`
 	}
 
-	// VersionBuilder contains methods to output version information in string format.
+	// VersionInfo is the structured version document of the service, with the build version, the globals of the
+	// service and the uptime of the process.
+	VersionInfo struct {
+		BuildVersion
+		AppName           string    `json:"app,omitempty"`
+		ServerName        string    `json:"server,omitempty"`
+		DeployEnvironment string    `json:"env,omitempty"`
+		StartedAt         time.Time `json:"startedAt"`
+		UptimeSeconds     int64     `json:"uptimeSeconds"`
+	}
+
+	// VersionBuilder contains methods to output version information in string format, or as a structured document.
 	VersionBuilder interface {
 		ToString() string
 		ToMap() map[string]string
+		Version() VersionInfo
 	}
 
 	versionBuilderImpl struct {
 		version BuildVersion
+		globals ServiceGlobals
 	}
 )
 
@@ -29,13 +46,42 @@ const (
 	unknown = "?"
 )
 
-// NewBuildVersion creates and returns a new BuildVersion based on conventional environment variables.
+// The conventional environment variables of the build version.
+var (
+	versionNumberVariable = env.Register("GO_PIPELINE_LABEL", env.TypeString, unknown, "GOCD pipeline version number")
+	buildDateVariable     = env.Register("BUILD_DATE", env.TypeString, unknown, "Build date")
+	gitHashVariable       = env.Register("GIT_HASH", env.TypeString, unknown, "Git hash")
+)
+
+// processStarted is the start of the process, from which the uptime is measured.
+var processStarted = time.Now()
+
+// NewBuildVersion creates and returns a new BuildVersion based on conventional environment variables. The variables
+// that are not set are taken from the build info of the binary, when it was built from a module with version control.
 func NewBuildVersion() BuildVersion {
-	return BuildVersion{
-		VersionNumber: env.OrDefault("GO_PIPELINE_LABEL", unknown),
-		BuildDate:     env.OrDefault("BUILD_DATE", unknown),
-		GitHash:       env.OrDefault("GIT_HASH", unknown),
+	version := BuildVersion{
+		VersionNumber: versionNumberVariable.String(),
+		BuildDate:     buildDateVariable.String(),
+		GitHash:       gitHashVariable.String(),
+		GoVersion:     runtime.Version(),
+	}
+
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return version
 	}
+	if version.VersionNumber == unknown && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		version.VersionNumber = info.Main.Version
+	}
+	for _, setting := range info.Settings {
+		switch {
+		case setting.Key == "vcs.revision" && version.GitHash == unknown:
+			version.GitHash = setting.Value
+		case setting.Key == "vcs.time" && version.BuildDate == unknown:
+			version.BuildDate = setting.Value
+		}
+	}
+	return version
 }
 
 // NewVersionBuilder creates and returns a VersionBuilder based on conventional environment variables.
@@ -46,8 +92,15 @@ func NewVersionBuilder() VersionBuilder {
 
 // NewCustomVersionBuilder creates and returns a VersionBuilder for the given BuildVersion.
 func NewCustomVersionBuilder(version BuildVersion) VersionBuilder {
+	return NewServiceVersionBuilder(version, ServiceGlobals{})
+}
+
+// NewServiceVersionBuilder creates and returns a VersionBuilder for the given BuildVersion, of which the version
+// document contains the application, server and deployment environment of the globals.
+func NewServiceVersionBuilder(version BuildVersion, globals ServiceGlobals) VersionBuilder {
 	return &versionBuilderImpl{
 		version: version,
+		globals: globals,
 	}
 }
 
@@ -65,3 +118,14 @@ func (b *versionBuilderImpl) ToMap() map[string]string {
 		"gitHash":   b.version.GitHash,
 	}
 }
+
+func (b *versionBuilderImpl) Version() VersionInfo {
+	return VersionInfo{
+		BuildVersion:      b.version,
+		AppName:           b.globals.AppName,
+		ServerName:        b.globals.ServerName,
+		DeployEnvironment: b.globals.DeployEnvironment,
+		StartedAt:         processStarted.UTC(),
+		UptimeSeconds:     int64(time.Since(processStarted).Seconds()),
+	}
+}
@@ -1,7 +1,10 @@
 package servicefoundation_test
 
 import (
+	"encoding/json"
+	"runtime"
 	"testing"
+	"time"
 
 	sf "github.com/Prutswonder/go-servicefoundation"
 	"github.com/stretchr/testify/assert"
@@ -40,3 +43,37 @@ func TestCreateVersionBuilder(t *testing.T) {
 		"gitHash":   "hash",
 	}, actualMap)
 }
+
+func TestServiceVersionBuilder_Version(t *testing.T) {
+	version := sf.BuildVersion{
+		BuildDate:     "date",
+		VersionNumber: "nmbr",
+		GitHash:       "hash",
+		GoVersion:     "go1.x",
+	}
+	globals := sf.ServiceGlobals{AppName: "app", ServerName: "server", DeployEnvironment: "staging"}
+
+	sut := sf.NewServiceVersionBuilder(version, globals)
+
+	actual := sut.Version()
+
+	assert.Equal(t, version, actual.BuildVersion)
+	assert.Equal(t, "app", actual.AppName)
+	assert.Equal(t, "server", actual.ServerName)
+	assert.Equal(t, "staging", actual.DeployEnvironment)
+	assert.False(t, actual.StartedAt.After(time.Now()))
+	assert.True(t, actual.UptimeSeconds >= 0)
+	body, _ := json.Marshal(actual)
+	var document map[string]interface{}
+	assert.NoError(t, json.Unmarshal(body, &document))
+	for _, key := range []string{"version", "buildDate", "gitHash", "goVersion", "app", "server", "env", "startedAt", "uptimeSeconds"} {
+		assert.Contains(t, document, key)
+	}
+	assert.Equal(t, sut.ToMap()["version"], document["version"], "the version document extends the version map")
+}
+
+func TestNewBuildVersion_GoVersion(t *testing.T) {
+	actual := sf.NewBuildVersion()
+
+	assert.Equal(t, runtime.Version(), actual.GoVersion)
+}
@@ -0,0 +1,150 @@
+package servicefoundation
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/Prutswonder/go-servicefoundation/events"
+)
+
+const (
+	cacheControlHeader        = "Cache-Control"
+	expiresHeader             = "Expires"
+	lastModifiedHeader        = "Last-Modified"
+	ifModifiedSinceHeader     = "If-Modified-Since"
+	ifUnmodifiedSinceHeader   = "If-Unmodified-Since"
+	ifNoneMatchHeader         = "If-None-Match"
+	ifMatchHeader             = "If-Match"
+	cachePolicyImmutable      = "immutable"
+	cachePolicyPublic         = "public"
+	cachePolicyPrivateNoStore = "private-no-store"
+	cachePolicyRevalidate     = "revalidate"
+	immutableMaxAge           = 365 * 24 * time.Hour
+)
+
+type (
+	// CachePolicy is a declarative caching policy for a route, which results in the Cache-Control and Expires headers.
+	CachePolicy struct {
+		kind   string
+		maxAge time.Duration
+	}
+)
+
+// CacheImmutable returns a CachePolicy for resources that never change, like versioned assets.
+func CacheImmutable() CachePolicy {
+	return CachePolicy{kind: cachePolicyImmutable, maxAge: immutableMaxAge}
+}
+
+// CachePublicMaxAge returns a CachePolicy for resources that can be cached by any cache for the given duration.
+func CachePublicMaxAge(maxAge time.Duration) CachePolicy {
+	return CachePolicy{kind: cachePolicyPublic, maxAge: maxAge}
+}
+
+// CachePrivateNoStore returns a CachePolicy for resources that must not be stored by any cache.
+func CachePrivateNoStore() CachePolicy {
+	return CachePolicy{kind: cachePolicyPrivateNoStore}
+}
+
+// CacheRevalidate returns a CachePolicy for resources that can be stored, but must be revalidated on every use.
+func CacheRevalidate() CachePolicy {
+	return CachePolicy{kind: cachePolicyRevalidate}
+}
+
+// CacheControl returns the value of the Cache-Control header for the policy.
+func (p CachePolicy) CacheControl() string {
+	switch p.kind {
+	case cachePolicyImmutable:
+		return fmt.Sprintf("public, max-age=%d, immutable", int(p.maxAge.Seconds()))
+	case cachePolicyPublic:
+		return fmt.Sprintf("public, max-age=%d", int(p.maxAge.Seconds()))
+	case cachePolicyPrivateNoStore:
+		return "private, no-store"
+	case cachePolicyRevalidate:
+		return "no-cache"
+	}
+	return ""
+}
+
+func (p CachePolicy) isZero() bool {
+	return p.kind == ""
+}
+
+// String returns the name and Cache-Control value of the policy, for use in route metadata.
+func (p CachePolicy) String() string {
+	return fmt.Sprintf("%s (%s)", p.kind, p.CacheControl())
+}
+
+// Middleware returns a MiddlewareFunc that sets the Cache-Control and Expires headers of the policy. Headers that
+// were set by the NoCaching middleware are overridden by the explicit policy, which is logged as Debug. The policy
+// is meant to wrap the route handler, so it is applied after any middleware passed to AddRoute, like it is when the
+// policy is the CachePolicy of the RouteMetadata.
+func (p CachePolicy) Middleware(log Logger) MiddlewareFunc {
+	return func(next Handle) Handle {
+		return func(w WrappedResponseWriter, r *http.Request, params RouterParams) {
+			header := w.Header()
+
+			if existing := header.Get(cacheControlHeader); existing != "" {
+				log.Debug(events.CachePolicyOverride, "Cache policy %s overrides Cache-Control %q for %s",
+					p, existing, r.URL.Path)
+
+				// The Last-Modified set by NoCaching would break conditional requests.
+				header.Del(lastModifiedHeader)
+			}
+
+			header.Set(cacheControlHeader, p.CacheControl())
+			header.Set(expiresHeader, p.expires(time.Now()).Format(http.TimeFormat))
+
+			next(w, r, params)
+		}
+	}
+}
+
+func (p CachePolicy) expires(now time.Time) time.Time {
+	if p.maxAge > 0 {
+		return now.Add(p.maxAge).UTC()
+	}
+	// Expired, for proxies that only understand HTTP/1.0.
+	return time.Unix(0, 0).UTC()
+}
+
+// SetLastModified sets the Last-Modified header and evaluates the If-Unmodified-Since and If-Modified-Since
+// preconditions of the request, as specified in RFC 9110 section 13.2.2. Timestamps are compared with second
+// granularity. A precondition is skipped when the request carries the corresponding ETag precondition (If-Match or
+// If-None-Match), since those take precedence. When a precondition results in 412 or 304, the status code is written
+// and true is returned; the handler should not write a response body in that case.
+func SetLastModified(w WrappedResponseWriter, r *http.Request, modified time.Time) bool {
+	if modified.IsZero() || modified.Unix() == 0 {
+		return false
+	}
+
+	modified = modified.UTC().Truncate(time.Second)
+	w.Header().Set(lastModifiedHeader, modified.Format(http.TimeFormat))
+
+	if r.Header.Get(ifMatchHeader) == "" {
+		if since, ok := parseHTTPTime(r.Header.Get(ifUnmodifiedSinceHeader)); ok && modified.After(since) {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return true
+		}
+	}
+
+	if r.Header.Get(ifNoneMatchHeader) == "" && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+		if since, ok := parseHTTPTime(r.Header.Get(ifModifiedSinceHeader)); ok && !modified.After(since) {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+	return false
+}
+
+func parseHTTPTime(value string) (time.Time, bool) {
+	if value == "" {
+		return time.Time{}, false
+	}
+
+	t, err := http.ParseTime(value)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
@@ -0,0 +1,103 @@
+package servicefoundation_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	sf "github.com/Prutswonder/go-servicefoundation"
+	"github.com/Prutswonder/go-servicefoundation/servicetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestCachePolicy_Headers(t *testing.T) {
+	tests := []struct {
+		policy       sf.CachePolicy
+		cacheControl string
+		expired      bool
+	}{
+		{sf.CacheImmutable(), "public, max-age=31536000, immutable", false},
+		{sf.CachePublicMaxAge(time.Minute), "public, max-age=60", false},
+		{sf.CachePrivateNoStore(), "private, no-store", true},
+		{sf.CacheRevalidate(), "no-cache", true},
+	}
+
+	for _, test := range tests {
+		r, _ := http.NewRequest(http.MethodGet, "/orders", nil)
+
+		// Act
+		w, called := servicetest.RunMiddleware(test.policy.Middleware(&mockLogger{}), r)
+
+		assert.True(t, called)
+		assert.Equal(t, test.cacheControl, w.Header().Get("Cache-Control"))
+
+		expires, err := http.ParseTime(w.Header().Get("Expires"))
+
+		assert.NoError(t, err)
+		assert.Equal(t, test.expired, expires.Before(time.Now()), test.policy.String())
+	}
+}
+
+func TestCachePolicy_OverridesNoCaching(t *testing.T) {
+	log := &mockLogger{}
+	log.On("Debug", "CachePolicyOverride", mock.Anything, mock.Anything).Return(nil)
+	wrapper := sf.NewMiddlewareWrapper(log, &mockMetrics{}, &sf.CORSOptions{}, sf.ServiceGlobals{})
+	policy := sf.CachePublicMaxAge(time.Minute)
+	handler := sf.NewChain(policy.Middleware(log)).Then(func(w sf.WrappedResponseWriter, r *http.Request, _ sf.RouterParams) {
+		sf.SetLastModified(w, r, time.Date(2017, 8, 1, 10, 0, 0, 0, time.UTC))
+	})
+	r, _ := http.NewRequest(http.MethodGet, "/orders", nil)
+
+	// Act
+	w, _ := servicetest.RunMiddlewareWithHandler(sf.AsMiddlewareFunc(wrapper, "public", "orders", sf.NoCaching), r,
+		handler)
+
+	assert.Equal(t, "public, max-age=60", w.Header().Get("Cache-Control"))
+	assert.Equal(t, "Tue, 01 Aug 2017 10:00:00 GMT", w.Header().Get("Last-Modified"))
+	log.AssertExpectations(t)
+}
+
+func TestSetLastModified(t *testing.T) {
+	modified := time.Date(2017, 8, 1, 10, 0, 0, 500000000, time.UTC)
+	same := "Tue, 01 Aug 2017 10:00:00 GMT"
+	before := "Tue, 01 Aug 2017 09:59:59 GMT"
+	after := "Tue, 01 Aug 2017 10:00:01 GMT"
+
+	tests := []struct {
+		name     string
+		method   string
+		headers  map[string]string
+		expected int
+		handled  bool
+	}{
+		{"no preconditions", http.MethodGet, nil, http.StatusOK, false},
+		{"modified since", http.MethodGet, map[string]string{"If-Modified-Since": before}, http.StatusOK, false},
+		{"not modified, truncated", http.MethodGet, map[string]string{"If-Modified-Since": same}, http.StatusNotModified, true},
+		{"not modified, later", http.MethodHead, map[string]string{"If-Modified-Since": after}, http.StatusNotModified, true},
+		{"invalid date", http.MethodGet, map[string]string{"If-Modified-Since": "yesterday"}, http.StatusOK, false},
+		{"ignored for writes", http.MethodPost, map[string]string{"If-Modified-Since": same}, http.StatusOK, false},
+		{"etag wins", http.MethodGet, map[string]string{"If-Modified-Since": same, "If-None-Match": `"abc"`}, http.StatusOK, false},
+		{"unmodified since", http.MethodPut, map[string]string{"If-Unmodified-Since": same}, http.StatusOK, false},
+		{"modified, precondition failed", http.MethodPut, map[string]string{"If-Unmodified-Since": before}, http.StatusPreconditionFailed, true},
+		{"if-match wins", http.MethodPut, map[string]string{"If-Unmodified-Since": before, "If-Match": `"abc"`}, http.StatusOK, false},
+		{"unmodified before modified", http.MethodGet, map[string]string{"If-Unmodified-Since": before, "If-Modified-Since": same}, http.StatusPreconditionFailed, true},
+	}
+
+	for _, test := range tests {
+		r, _ := http.NewRequest(test.method, "/orders", nil)
+		for k, v := range test.headers {
+			r.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		w := sf.NewWrappedResponseWriter(rec)
+
+		// Act
+		handled := sf.SetLastModified(w, r, modified)
+
+		assert.Equal(t, test.handled, handled, test.name)
+		assert.Equal(t, test.expected, rec.Code, test.name)
+		assert.Equal(t, same, rec.Header().Get("Last-Modified"), test.name)
+	}
+}
@@ -0,0 +1,55 @@
+package servicefoundation
+
+type (
+	// MiddlewareFunc is the canonical signature for a middleware: it receives the next Handle in the chain and
+	// returns a new Handle that wraps it.
+	MiddlewareFunc func(next Handle) Handle
+
+	// Chain is an immutable list of MiddlewareFuncs that can be applied to a Handle.
+	Chain struct {
+		middlewares []MiddlewareFunc
+	}
+)
+
+// NewChain creates and returns a new Chain for the given MiddlewareFuncs. The first MiddlewareFunc is the outermost
+// one, meaning it is the first to receive the request.
+func NewChain(middlewares ...MiddlewareFunc) Chain {
+	return Chain{middlewares: append([]MiddlewareFunc(nil), middlewares...)}
+}
+
+// Append returns a new Chain with the given MiddlewareFuncs added to the end of the current Chain.
+func (c Chain) Append(middlewares ...MiddlewareFunc) Chain {
+	newMiddlewares := make([]MiddlewareFunc, 0, len(c.middlewares)+len(middlewares))
+	newMiddlewares = append(newMiddlewares, c.middlewares...)
+	newMiddlewares = append(newMiddlewares, middlewares...)
+
+	return Chain{middlewares: newMiddlewares}
+}
+
+// Then wraps the given Handle with all MiddlewareFuncs in the Chain and returns the result.
+func (c Chain) Then(handler Handle) Handle {
+	h := handler
+
+	for i := len(c.middlewares) - 1; i >= 0; i-- {
+		h = c.middlewares[i](h)
+	}
+	return h
+}
+
+// AsMiddlewareFunc converts an enumeration-based Middleware into a MiddlewareFunc, using the given MiddlewareWrapper.
+func AsMiddlewareFunc(wrapper MiddlewareWrapper, subsystem, name string, middleware Middleware) MiddlewareFunc {
+	return func(next Handle) Handle {
+		return wrapper.Wrap(subsystem, name, middleware, next)
+	}
+}
+
+// NewChainFor creates and returns a new Chain for the given enumeration-based Middlewares. The Middlewares are applied
+// in slice order, meaning the last Middleware in the slice is the outermost one.
+func NewChainFor(wrapper MiddlewareWrapper, subsystem, name string, middlewares []Middleware) Chain {
+	funcs := make([]MiddlewareFunc, len(middlewares))
+
+	for i, middleware := range middlewares {
+		funcs[len(middlewares)-1-i] = AsMiddlewareFunc(wrapper, subsystem, name, middleware)
+	}
+	return NewChain(funcs...)
+}
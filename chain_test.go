@@ -0,0 +1,54 @@
+package servicefoundation_test
+
+import (
+	"net/http"
+	"testing"
+
+	sf "github.com/Prutswonder/go-servicefoundation"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChain_Then(t *testing.T) {
+	var order []string
+	newMiddleware := func(name string) sf.MiddlewareFunc {
+		return func(next sf.Handle) sf.Handle {
+			return func(w sf.WrappedResponseWriter, r *http.Request, p sf.RouterParams) {
+				order = append(order, name)
+				next(w, r, p)
+			}
+		}
+	}
+	handle := func(sf.WrappedResponseWriter, *http.Request, sf.RouterParams) {
+		order = append(order, "handler")
+	}
+	sut := sf.NewChain(newMiddleware("first"), newMiddleware("second")).Append(newMiddleware("third"))
+
+	// Act
+	actual := sut.Then(handle)
+	actual(nil, nil, sf.RouterParams{})
+
+	assert.Equal(t, []string{"first", "second", "third", "handler"}, order)
+}
+
+type orderRecordingWrapper struct {
+	order *[]sf.Middleware
+}
+
+func (o *orderRecordingWrapper) Wrap(subsystem, name string, middleware sf.Middleware, handler sf.Handle) sf.Handle {
+	return func(w sf.WrappedResponseWriter, r *http.Request, p sf.RouterParams) {
+		*o.order = append(*o.order, middleware)
+		handler(w, r, p)
+	}
+}
+
+func TestNewChainFor_LastMiddlewareIsOutermost(t *testing.T) {
+	var order []sf.Middleware
+	wrapper := &orderRecordingWrapper{order: &order}
+	handle := func(sf.WrappedResponseWriter, *http.Request, sf.RouterParams) {}
+
+	// Act
+	actual := sf.NewChainFor(wrapper, "sub", "name", []sf.Middleware{sf.PanicTo500, sf.NoCaching}).Then(handle)
+	actual(nil, nil, sf.RouterParams{})
+
+	assert.Equal(t, []sf.Middleware{sf.NoCaching, sf.PanicTo500}, order)
+}
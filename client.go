@@ -0,0 +1,84 @@
+package servicefoundation
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+const defaultClientTimeout = 30 * time.Second
+
+type (
+	// ClientOptions contains the settings used by the ClientFactory for creating outbound http clients.
+	ClientOptions struct {
+		Timeout time.Duration
+		// Signers contains the RequestSigner to use per named client.
+		Signers map[string]RequestSigner
+		// MaxSignedBodySize is the maximum request body size that is buffered for calculating the body hash.
+		MaxSignedBodySize int
+		// Budgets contains the sub-budget of the route budget to use per named client.
+		Budgets map[string]string
+		// Transports contains the transport settings per named client. Other clients use the default settings.
+		Transports map[string]TransportOptions
+		// Metrics collects connection, dial and TLS handshake metrics of the clients, when set.
+		Metrics Metrics
+	}
+
+	// ClientFactory is an interface to create named outbound http clients.
+	ClientFactory interface {
+		NewClient(name string) *http.Client
+	}
+
+	clientFactoryImpl struct {
+		options    ClientOptions
+		mutex      sync.Mutex
+		transports map[string]*tracingTransport
+	}
+)
+
+// NewClientFactory instantiates a new ClientFactory implementation.
+func NewClientFactory(options ClientOptions) ClientFactory {
+	if options.Timeout <= 0 {
+		options.Timeout = defaultClientTimeout
+	}
+
+	return &clientFactoryImpl{
+		options:    options,
+		transports: make(map[string]*tracingTransport),
+	}
+}
+
+/* ClientFactory implementation */
+
+// NewClient returns a client with the transport of the given name. Clients with the same name share their
+// transport and its connection pool. The baggage and request ID of the request context are propagated to the
+// called service.
+func (f *clientFactoryImpl) NewClient(name string) *http.Client {
+	var transport http.RoundTripper = f.transport(name)
+
+	if signer, ok := f.options.Signers[name]; ok && signer != nil {
+		transport = NewSigningTransport(transport, signer, f.options.MaxSignedBodySize)
+	}
+	if budget, ok := f.options.Budgets[name]; ok {
+		transport = NewBudgetTransport(transport, budget)
+	}
+	// Outermost, so the baggage and request ID headers are signed.
+	transport = NewRequestIDTransport(NewBaggageTransport(transport))
+
+	return &http.Client{
+		Timeout:   f.options.Timeout,
+		Transport: transport,
+	}
+}
+
+func (f *clientFactoryImpl) transport(name string) *tracingTransport {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	transport, ok := f.transports[name]
+	if !ok {
+		transport = newTracingTransport(name, f.options.Transports[name], f.options.Metrics)
+		f.transports[name] = transport
+	}
+	return transport
+}
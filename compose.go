@@ -0,0 +1,221 @@
+package servicefoundation
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	composeSubsystem = "compose"
+
+	// DegradedReasonTimeout is the reason of a part that didn't complete within its timeout or the route budget.
+	DegradedReasonTimeout = "timeout"
+	// DegradedReasonCanceled is the reason of a part of which the request was canceled.
+	DegradedReasonCanceled = "canceled"
+	// DegradedReasonError is the reason of a part that failed or panicked.
+	DegradedReasonError = "error"
+)
+
+type (
+	// Part is a section of a composed response. Fetch must respect the cancellation of its context, although Compose
+	// doesn't wait for it after the Timeout or the route budget. A Timeout of 0 only applies the route budget.
+	Part struct {
+		Name     string
+		Fetch    func(ctx context.Context) (interface{}, error)
+		Critical bool
+		Timeout  time.Duration
+	}
+
+	// DegradedPart describes a non-critical part that was omitted from a composed response.
+	DegradedPart struct {
+		Name   string `json:"name"`
+		Reason string `json:"reason"`
+	}
+
+	// Composition is a composed response, which is encoded as an object with a property per section and a "meta"
+	// property listing the degraded parts.
+	Composition struct {
+		Sections map[string]interface{}
+		Degraded []DegradedPart
+	}
+
+	// PartError is returned by Compose when a critical part fails. Err is for logging and never written to clients.
+	PartError struct {
+		Part   string
+		Reason string
+		Err    error
+	}
+
+	compositionMeta struct {
+		Degraded []DegradedPart `json:"degraded"`
+	}
+
+	partResult struct {
+		value interface{}
+		err   error
+	}
+
+	// routeContext contains the route of a request, for the helpers that record metrics per route.
+	routeContext struct {
+		route   string
+		metrics Metrics
+	}
+
+	routeContextKey struct{}
+)
+
+// Compose fetches the parts concurrently, each within its own timeout and all within the route budget of the
+// context. Non-critical parts that fail or time out are omitted and listed as degraded, while a failing critical part
+// abandons the other parts and makes Compose return a *PartError. The duration of every part is recorded as a
+// histogram and failures are counted per route and part.
+func Compose(ctx context.Context, parts ...Part) (*Composition, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make([]partResult, len(parts))
+	var wg sync.WaitGroup
+	var failed sync.Once
+	var critical *PartError
+	for i, part := range parts {
+		wg.Add(1)
+		go func(i int, part Part) {
+			defer wg.Done()
+			results[i] = fetchPart(ctx, part)
+
+			if part.Critical && results[i].err != nil {
+				failed.Do(func() {
+					critical = &PartError{Part: part.Name, Reason: degradedReason(results[i].err), Err: results[i].err}
+					// The response fails anyway, so the other parts are abandoned.
+					cancel()
+				})
+			}
+		}(i, part)
+	}
+	wg.Wait()
+
+	if critical != nil {
+		recordPartFailure(ctx, critical.Part, critical.Reason)
+		return nil, critical
+	}
+
+	composition := &Composition{Sections: make(map[string]interface{}, len(parts))}
+	for i, part := range parts {
+		result := results[i]
+		if result.err == nil {
+			composition.Sections[part.Name] = result.value
+			continue
+		}
+
+		reason := degradedReason(result.err)
+		recordPartFailure(ctx, part.Name, reason)
+		composition.Degraded = append(composition.Degraded, DegradedPart{Name: part.Name, Reason: reason})
+	}
+	return composition, nil
+}
+
+// WriteComposition writes the composition, or a problem response if Compose failed. Critical parts that timed out
+// respond with a 504 and other failing critical parts with a 502, without the details of their errors.
+func WriteComposition(w WrappedResponseWriter, statusCode int, composition *Composition, err error) {
+	if partErr, ok := err.(*PartError); ok {
+		status := http.StatusBadGateway
+		if partErr.Reason == DegradedReasonTimeout {
+			status = http.StatusGatewayTimeout
+		}
+		WriteProblem(w, status, fmt.Sprintf("Part %s failed: %s", partErr.Part, partErr.Reason))
+		return
+	}
+	if err != nil {
+		WriteProblem(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	w.JSON(statusCode, composition)
+}
+
+// withRouteContext returns a context with the route of the request.
+func withRouteContext(ctx context.Context, route string, metrics Metrics) context.Context {
+	return context.WithValue(ctx, routeContextKey{}, &routeContext{route: route, metrics: metrics})
+}
+
+// fetchPart runs the fetch of the part within its timeout. The fetch is abandoned when it doesn't return in time.
+func fetchPart(ctx context.Context, part Part) (result partResult) {
+	ctx, cancel := BudgetContext(ctx, part.Name)
+	defer cancel()
+	if part.Timeout > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeout(ctx, part.Timeout)
+		defer cancelTimeout()
+	}
+
+	if rc, ok := ctx.Value(routeContextKey{}).(*routeContext); ok {
+		histogram := rc.metrics.AddHistogramLabels(composeSubsystem, "duration_seconds",
+			"Duration of the parts of composed responses.", []string{"route", "part"}, []string{rc.route, part.Name})
+		defer histogram.RecordTimeElapsed(time.Now(), time.Second)
+	}
+
+	done := make(chan partResult, 1)
+	go func() {
+		defer func() {
+			if rec := recover(); rec != nil {
+				done <- partResult{err: fmt.Errorf("Part %s panicked: %v", part.Name, rec)}
+			}
+		}()
+
+		value, err := part.Fetch(ctx)
+		done <- partResult{value: value, err: err}
+	}()
+
+	select {
+	case result = <-done:
+		if result.err == nil && ctx.Err() != nil {
+			// Results after the deadline are not used, to keep the outcome independent of the scheduling.
+			result = partResult{err: ctx.Err()}
+		}
+		return result
+	case <-ctx.Done():
+		return partResult{err: ctx.Err()}
+	}
+}
+
+func recordPartFailure(ctx context.Context, part, reason string) {
+	if rc, ok := ctx.Value(routeContextKey{}).(*routeContext); ok {
+		rc.metrics.CountLabels(composeSubsystem, "part_failures_total", "Total failed parts of composed responses.",
+			[]string{"route", "part", "reason"}, []string{rc.route, part, reason})
+	}
+}
+
+func degradedReason(err error) string {
+	switch err {
+	case context.DeadlineExceeded:
+		return DegradedReasonTimeout
+	case context.Canceled:
+		return DegradedReasonCanceled
+	}
+	return DegradedReasonError
+}
+
+/* json.Marshaler implementation */
+
+// MarshalJSON encodes the sections as properties, with the degraded parts in the "meta" property.
+func (c Composition) MarshalJSON() ([]byte, error) {
+	document := make(map[string]interface{}, len(c.Sections)+1)
+	for name, section := range c.Sections {
+		document[name] = section
+	}
+
+	degraded := c.Degraded
+	if degraded == nil {
+		degraded = []DegradedPart{}
+	}
+	document["meta"] = compositionMeta{Degraded: degraded}
+	return json.Marshal(document)
+}
+
+/* error implementation */
+
+func (e *PartError) Error() string {
+	return fmt.Sprintf("Part %s failed (%s): %v", e.Part, e.Reason, e.Err)
+}
@@ -0,0 +1,147 @@
+package servicefoundation_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	sf "github.com/Prutswonder/go-servicefoundation"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/stretchr/testify/assert"
+)
+
+func fetchAfter(delay time.Duration, value interface{}, err error) func(context.Context) (interface{}, error) {
+	return func(ctx context.Context) (interface{}, error) {
+		select {
+		case <-time.After(delay):
+			return value, err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func TestCompose_AllSucceed(t *testing.T) {
+	// Act
+	actual, err := sf.Compose(context.Background(),
+		sf.Part{Name: "profile", Fetch: fetchAfter(0, map[string]string{"name": "Jane"}, nil), Critical: true},
+		sf.Part{Name: "recommendations", Fetch: fetchAfter(0, []int{1, 2}, nil)},
+	)
+
+	assert.NoError(t, err)
+	b, _ := json.Marshal(actual)
+	assert.JSONEq(t, `{"profile":{"name":"Jane"},"recommendations":[1,2],"meta":{"degraded":[]}}`, string(b))
+}
+
+func TestCompose_OmitsFailingNonCriticalParts(t *testing.T) {
+	// Act
+	actual, err := sf.Compose(context.Background(),
+		sf.Part{Name: "profile", Fetch: fetchAfter(0, "ok", nil), Critical: true},
+		sf.Part{Name: "recommendations", Fetch: fetchAfter(0, nil, errors.New("connection refused to 10.0.0.1"))},
+		sf.Part{Name: "notifications", Fetch: func(context.Context) (interface{}, error) { panic("boom") }},
+	)
+
+	assert.NoError(t, err)
+	b, _ := json.Marshal(actual)
+	assert.JSONEq(t, `{"profile":"ok","meta":{"degraded":[
+		{"name":"recommendations","reason":"error"},
+		{"name":"notifications","reason":"error"}]}}`, string(b), "no internal details are exposed")
+}
+
+func TestCompose_CriticalFailure(t *testing.T) {
+	tests := []struct {
+		part     sf.Part
+		reason   string
+		expected int
+	}{
+		{sf.Part{Name: "profile", Fetch: fetchAfter(0, nil, errors.New("failed")), Critical: true}, sf.DegradedReasonError, http.StatusBadGateway},
+		{sf.Part{Name: "profile", Fetch: fetchAfter(time.Second, "late", nil), Critical: true, Timeout: 10 * time.Millisecond}, sf.DegradedReasonTimeout, http.StatusGatewayTimeout},
+	}
+
+	for _, test := range tests {
+		start := time.Now()
+
+		// Act
+		actual, err := sf.Compose(context.Background(), test.part,
+			sf.Part{Name: "recommendations", Fetch: fetchAfter(time.Second, "slow", nil)})
+
+		assert.Nil(t, actual)
+		assert.True(t, time.Since(start) < 500*time.Millisecond, "the other parts are abandoned")
+		if partErr, ok := err.(*sf.PartError); assert.True(t, ok) {
+			assert.Equal(t, "profile", partErr.Part)
+			assert.Equal(t, test.reason, partErr.Reason)
+		}
+
+		w := httptest.NewRecorder()
+		sf.WriteComposition(sf.NewWrappedResponseWriter(w), http.StatusOK, actual, err)
+		assert.Equal(t, test.expected, w.Code)
+		assert.NotContains(t, w.Body.String(), "failed\"", "the error is not exposed")
+	}
+}
+
+func TestCompose_PartTimeout(t *testing.T) {
+	// Act
+	actual, err := sf.Compose(context.Background(),
+		sf.Part{Name: "profile", Fetch: fetchAfter(0, "ok", nil), Critical: true, Timeout: time.Second},
+		sf.Part{Name: "recommendations", Fetch: fetchAfter(time.Second, "late", nil), Timeout: 10 * time.Millisecond},
+		sf.Part{Name: "notifications", Fetch: func(context.Context) (interface{}, error) {
+			// Ignores its context, so it has to be abandoned.
+			time.Sleep(time.Second)
+			return "late", nil
+		}, Timeout: 10 * time.Millisecond},
+	)
+
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"profile": "ok"}, actual.Sections)
+	assert.Equal(t, []sf.DegradedPart{
+		{Name: "recommendations", Reason: sf.DegradedReasonTimeout},
+		{Name: "notifications", Reason: sf.DegradedReasonTimeout},
+	}, actual.Degraded)
+}
+
+func TestCompose_BoundedByRouteBudget(t *testing.T) {
+	metrics, _ := newBudgetMetrics()
+	budget := sf.NewBudgetMiddleware("dashboard", sf.RouteBudget{Total: 100 * time.Millisecond}, metrics)
+	parts := []sf.Part{
+		{Name: "profile", Fetch: fetchAfter(50*time.Millisecond, "ok", nil), Critical: true},
+		{Name: "recommendations", Fetch: fetchAfter(50*time.Millisecond, "ok", nil)},
+		{Name: "notifications", Fetch: fetchAfter(50*time.Millisecond, "ok", nil)},
+		{Name: "ads", Fetch: fetchAfter(time.Second, "late", nil), Timeout: time.Second},
+	}
+	var actual *sf.Composition
+	var elapsed time.Duration
+	r, _ := http.NewRequest(http.MethodGet, "/dashboard", nil)
+
+	// Act
+	budget(func(_ sf.WrappedResponseWriter, r *http.Request, _ sf.RouterParams) {
+		start := time.Now()
+		actual, _ = sf.Compose(r.Context(), parts...)
+		elapsed = time.Since(start)
+	})(sf.NewWrappedResponseWriter(httptest.NewRecorder()), r, sf.RouterParams{})
+
+	assert.Len(t, actual.Sections, 3, "the parts run concurrently, so three 50ms parts fit in a 100ms budget")
+	assert.Equal(t, []sf.DegradedPart{{Name: "ads", Reason: sf.DegradedReasonTimeout}}, actual.Degraded)
+	assert.True(t, elapsed < 300*time.Millisecond, "the budget bounds the composition, took %v", elapsed)
+}
+
+func TestCompose_PartHistogramLabels(t *testing.T) {
+	opt := sf.NewServiceOptions("compose", []string{http.MethodGet}, nil)
+	opt.SetHandlers()
+	sut := sf.NewCustomService(opt)
+	sut.AddRoute("profile_page", []string{"/profile"}, sf.MethodsForGet, sf.DefaultMiddlewares,
+		func(w sf.WrappedResponseWriter, r *http.Request, _ sf.RouterParams) {
+			actual, err := sf.Compose(r.Context(), sf.Part{Name: "Profile", Fetch: fetchAfter(0, "ok", nil)})
+			sf.WriteComposition(w, http.StatusOK, actual, err)
+		})
+
+	// Act
+	sut.Handler("public").ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/profile", nil))
+
+	w := httptest.NewRecorder()
+	promhttp.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Contains(t, w.Body.String(), `compose_duration_seconds_count{part="Profile",route="profile_page"} 1`)
+}
@@ -0,0 +1,251 @@
+package servicefoundation
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	// AcceptEncodingHeader is the name of the http Accept-Encoding header.
+	AcceptEncodingHeader = "Accept-Encoding"
+	// ContentEncodingHeader is the name of the http Content-Encoding header.
+	ContentEncodingHeader = "Content-Encoding"
+
+	encodingGzip    = "gzip"
+	encodingDeflate = "deflate"
+
+	defaultCompressionMinSize = 1024
+)
+
+// incompressibleContentTypes are the prefixes of content types that are compressed already.
+var incompressibleContentTypes = []string{
+	"image/", "video/", "audio/", "font/woff",
+	"application/zip", "application/gzip", "application/x-gzip", "application/x-bzip2", "application/zstd",
+	"application/x-7z-compressed", "application/x-rar-compressed",
+}
+
+type (
+	// CompressionOptions contains the settings of the Compression middleware. Level is the compression level, from 1
+	// (fastest) to 9 (smallest), and defaults to the default level of compress/gzip. Responses smaller than MinSize
+	// bytes, which defaults to 1024, are sent uncompressed.
+	CompressionOptions struct {
+		Level   int
+		MinSize int
+	}
+
+	// compressionResponseWriter buffers the response until it reaches the minimum size, and then sends the status and
+	// compresses the rest of the response, or sends it as is.
+	compressionResponseWriter struct {
+		http.ResponseWriter
+		options     CompressionOptions
+		encoding    string
+		status      int
+		wroteHeader bool
+		committed   bool
+		buffer      []byte
+		compressor  io.WriteCloser
+	}
+)
+
+// NewCompressionMiddleware returns a MiddlewareFunc that compresses responses with gzip or deflate, as accepted by the
+// Accept-Encoding header of the request. Responses below the minimum size, with a content type that is compressed
+// already, with a Content-Encoding of the handler, and responses to HEAD requests are sent uncompressed. All
+// responses vary on Accept-Encoding. The middleware must be outside NewDigestMiddleware, which digests the identity
+// representation.
+func NewCompressionMiddleware(options CompressionOptions) MiddlewareFunc {
+	if options.Level < gzip.BestSpeed || options.Level > gzip.BestCompression {
+		options.Level = gzip.DefaultCompression
+	}
+	if options.MinSize <= 0 {
+		options.MinSize = defaultCompressionMinSize
+	}
+
+	return func(next Handle) Handle {
+		return func(w WrappedResponseWriter, r *http.Request, p RouterParams) {
+			cw := &compressionResponseWriter{
+				ResponseWriter: w,
+				options:        options,
+				status:         http.StatusOK,
+			}
+			if r.Method != http.MethodHead {
+				cw.encoding = negotiateEncoding(r.Header.Get(AcceptEncodingHeader))
+			}
+
+			defer func() {
+				if rec := recover(); rec != nil {
+					// Nothing is sent when the response is still buffered, so PanicTo500 can respond instead.
+					cw.abort()
+					panic(rec)
+				}
+			}()
+
+			next(NewWrappedResponseWriter(cw), r, p)
+			cw.finish()
+		}
+	}
+}
+
+// negotiateEncoding returns the encoding with the highest quality in the Accept-Encoding header, preferring gzip, or
+// an empty string when neither gzip nor deflate is accepted.
+func negotiateEncoding(header string) string {
+	var encoding string
+	var quality float64
+	for _, member := range strings.Split(header, ",") {
+		parts := strings.Split(member, ";")
+		name := strings.ToLower(strings.TrimSpace(parts[0]))
+		q := 1.0
+		for _, parameter := range parts[1:] {
+			parameter = strings.TrimSpace(parameter)
+			if strings.HasPrefix(parameter, "q=") {
+				var err error
+				if q, err = strconv.ParseFloat(parameter[2:], 64); err != nil {
+					q = 0
+				}
+			}
+		}
+
+		if name == "*" {
+			name = encodingGzip
+		}
+		if (name != encodingGzip && name != encodingDeflate) || q <= 0 {
+			continue
+		}
+		if q > quality || (q == quality && name == encodingGzip) {
+			encoding, quality = name, q
+		}
+	}
+	return encoding
+}
+
+func compressibleContentType(contentType string) bool {
+	contentType = strings.ToLower(contentType)
+	if strings.HasPrefix(contentType, "image/svg") {
+		return true
+	}
+	for _, prefix := range incompressibleContentTypes {
+		if strings.HasPrefix(contentType, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+/* http.ResponseWriter implementation */
+
+func (w *compressionResponseWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.status = code
+	w.wroteHeader = true
+
+	if w.encoding == "" {
+		w.commit(false)
+	}
+}
+
+func (w *compressionResponseWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.committed {
+		if w.compressor != nil {
+			return w.compressor.Write(p)
+		}
+		return w.ResponseWriter.Write(p)
+	}
+
+	w.buffer = append(w.buffer, p...)
+	if len(w.buffer) >= w.options.MinSize {
+		w.commit(w.compressible())
+	}
+	return len(p), nil
+}
+
+// Flush sends the buffered response, which is compressed regardless of its size, because more is likely to follow.
+func (w *compressionResponseWriter) Flush() {
+	if !w.committed {
+		w.commit(w.compressible())
+	}
+	if flusher, ok := w.compressor.(interface{ Flush() error }); ok {
+		flusher.Flush()
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap returns the underlying ResponseWriter, which lets http.ResponseController reach its deadlines.
+func (w *compressionResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// compressible reports whether the response can be compressed, apart from its size.
+func (w *compressionResponseWriter) compressible() bool {
+	if w.encoding == "" || w.status < http.StatusOK || w.status == http.StatusNoContent ||
+		w.status == http.StatusNotModified {
+		return false
+	}
+	if encoding := w.Header().Get(ContentEncodingHeader); encoding != "" && encoding != "identity" {
+		return false
+	}
+	return compressibleContentType(w.Header().Get(ContentTypeHeader))
+}
+
+// commit sends the status with the buffered response, compressed or as is.
+func (w *compressionResponseWriter) commit(compress bool) {
+	w.committed = true
+	w.Header().Add("Vary", AcceptEncodingHeader)
+
+	if compress {
+		if w.Header().Get(ContentTypeHeader) == "" {
+			// Sniffed before compressing, because the server would sniff the compressed content.
+			w.Header().Set(ContentTypeHeader, http.DetectContentType(w.buffer))
+		}
+		w.Header().Del("Content-Length")
+		w.Header().Set(ContentEncodingHeader, w.encoding)
+
+		if w.encoding == encodingGzip {
+			w.compressor, _ = gzip.NewWriterLevel(w.ResponseWriter, w.options.Level)
+		} else {
+			w.compressor, _ = zlib.NewWriterLevel(w.ResponseWriter, w.options.Level)
+		}
+	}
+
+	w.ResponseWriter.WriteHeader(w.status)
+	if len(w.buffer) == 0 {
+		return
+	}
+	if w.compressor != nil {
+		w.compressor.Write(w.buffer)
+	} else {
+		w.ResponseWriter.Write(w.buffer)
+	}
+	w.buffer = nil
+}
+
+// finish sends a response that is still buffered uncompressed, because it is below the minimum size, and completes
+// the compressed stream.
+func (w *compressionResponseWriter) finish() {
+	if !w.committed {
+		w.commit(false)
+	}
+	if w.compressor != nil {
+		w.compressor.Close()
+	}
+}
+
+// abort discards a buffered response, or completes the compressed stream of a response that was sent in part.
+func (w *compressionResponseWriter) abort() {
+	if !w.committed {
+		w.buffer = nil
+		return
+	}
+	if w.compressor != nil {
+		w.compressor.Close()
+	}
+}
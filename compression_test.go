@@ -0,0 +1,203 @@
+package servicefoundation_test
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	sf "github.com/Prutswonder/go-servicefoundation"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func writeBody(contentType string, status int, body string) sf.Handle {
+	return func(w sf.WrappedResponseWriter, _ *http.Request, _ sf.RouterParams) {
+		if contentType != "" {
+			w.Header().Set(sf.ContentTypeHeader, contentType)
+		}
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}
+}
+
+func decompress(t *testing.T, encoding string, body io.Reader) string {
+	var reader io.Reader
+	var err error
+	switch encoding {
+	case "gzip":
+		reader, err = gzip.NewReader(body)
+	case "deflate":
+		reader, err = zlib.NewReader(body)
+	default:
+		reader = body
+	}
+	assert.NoError(t, err)
+	if err != nil {
+		return ""
+	}
+	actual, err := ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	return string(actual)
+}
+
+func TestCompressionMiddleware(t *testing.T) {
+	large := strings.Repeat("compressible ", 200)
+	tests := []struct {
+		method         string
+		acceptEncoding string
+		contentType    string
+		status         int
+		body           string
+		expected       string
+	}{
+		{http.MethodGet, "gzip, deflate", "text/plain", http.StatusOK, large, "gzip"},
+		{http.MethodGet, "deflate", "application/json", http.StatusOK, large, "deflate"},
+		{http.MethodGet, "gzip;q=0.5, deflate", "text/plain", http.StatusOK, large, "deflate"},
+		{http.MethodGet, "*", "", http.StatusNotFound, large, "gzip"},
+		{http.MethodGet, "gzip;q=0, br", "text/plain", http.StatusOK, large, ""},
+		{http.MethodGet, "", "text/plain", http.StatusOK, large, ""},
+		{http.MethodGet, "gzip", "text/plain", http.StatusOK, "small", ""},
+		{http.MethodGet, "gzip", "image/png", http.StatusOK, large, ""},
+		{http.MethodGet, "gzip", "image/svg+xml", http.StatusOK, large, "gzip"},
+		{http.MethodGet, "gzip", "application/zip", http.StatusOK, large, ""},
+		{http.MethodHead, "gzip", "text/plain", http.StatusOK, large, ""},
+	}
+
+	for _, test := range tests {
+		sut := sf.NewCompressionMiddleware(sf.CompressionOptions{})
+		r := httptest.NewRequest(test.method, "/some/url", nil)
+		r.Header.Set(sf.AcceptEncodingHeader, test.acceptEncoding)
+		w := httptest.NewRecorder()
+		wrapped := sf.NewWrappedResponseWriter(w)
+
+		// Act
+		sut(writeBody(test.contentType, test.status, test.body))(wrapped, r, sf.RouterParams{})
+
+		assert.Equal(t, test.status, w.Code, "%s %s", test.acceptEncoding, test.contentType)
+		assert.Equal(t, test.status, wrapped.Status(), "%s %s", test.acceptEncoding, test.contentType)
+		assert.Equal(t, test.expected, w.Header().Get(sf.ContentEncodingHeader), "%s %s", test.acceptEncoding, test.contentType)
+		assert.Equal(t, "Accept-Encoding", w.Header().Get("Vary"))
+		assert.Equal(t, test.body, decompress(t, test.expected, w.Body), "%s %s", test.acceptEncoding, test.contentType)
+	}
+}
+
+func TestCompressionMiddleware_Options(t *testing.T) {
+	sut := sf.NewCompressionMiddleware(sf.CompressionOptions{Level: gzip.BestSpeed, MinSize: 4})
+	r := httptest.NewRequest(http.MethodGet, "/some/url", nil)
+	r.Header.Set(sf.AcceptEncodingHeader, "gzip")
+	w := httptest.NewRecorder()
+
+	// Act
+	sut(writeBody("", http.StatusOK, "<html>small</html>"))(sf.NewWrappedResponseWriter(w), r, sf.RouterParams{})
+
+	assert.Equal(t, "gzip", w.Header().Get(sf.ContentEncodingHeader))
+	assert.Equal(t, "text/html; charset=utf-8", w.Header().Get(sf.ContentTypeHeader), "sniffed before compressing")
+	assert.Equal(t, "<html>small</html>", decompress(t, "gzip", w.Body))
+}
+
+func TestCompressionMiddleware_KeepsContentEncodingOfHandler(t *testing.T) {
+	sut := sf.NewCompressionMiddleware(sf.CompressionOptions{MinSize: 1})
+	r := httptest.NewRequest(http.MethodGet, "/some/url", nil)
+	r.Header.Set(sf.AcceptEncodingHeader, "gzip")
+	w := httptest.NewRecorder()
+	handle := func(w sf.WrappedResponseWriter, _ *http.Request, _ sf.RouterParams) {
+		w.Header().Set(sf.ContentEncodingHeader, "br")
+		w.Write([]byte("brotli"))
+	}
+
+	// Act
+	sut(handle)(sf.NewWrappedResponseWriter(w), r, sf.RouterParams{})
+
+	assert.Equal(t, "br", w.Header().Get(sf.ContentEncodingHeader))
+	assert.Equal(t, "brotli", w.Body.String())
+}
+
+func TestCompressionMiddleware_Flush(t *testing.T) {
+	sut := sf.NewCompressionMiddleware(sf.CompressionOptions{})
+	r := httptest.NewRequest(http.MethodGet, "/some/url", nil)
+	r.Header.Set(sf.AcceptEncodingHeader, "gzip")
+	w := httptest.NewRecorder()
+
+	// Act
+	sut(writeChunks("first,", "second"))(sf.NewWrappedResponseWriter(w), r, sf.RouterParams{})
+
+	assert.True(t, w.Flushed)
+	assert.Equal(t, "gzip", w.Header().Get(sf.ContentEncodingHeader), "streamed responses are compressed")
+	assert.Equal(t, "first,second", decompress(t, "gzip", w.Body))
+}
+
+func TestCompressionMiddleware_WithCounterAndPanicTo500(t *testing.T) {
+	tests := []struct {
+		middlewares []sf.Middleware
+		partial     string
+		expected    int
+	}{
+		// Compression inside PanicTo500 discards the buffered response, so PanicTo500 can respond.
+		{[]sf.Middleware{sf.Compression, sf.PanicTo500, sf.Counter}, "partial", http.StatusInternalServerError},
+		{[]sf.Middleware{sf.Compression, sf.PanicTo500, sf.Counter}, "", http.StatusInternalServerError},
+		{[]sf.Middleware{sf.PanicTo500, sf.Compression, sf.Counter}, "", http.StatusInternalServerError},
+		// Compression outside PanicTo500 sends the response that was started, like without compression.
+		{[]sf.Middleware{sf.PanicTo500, sf.Compression, sf.Counter}, "partial", http.StatusOK},
+	}
+
+	for _, test := range tests {
+		log := &mockLogger{}
+		m := &mockMetrics{}
+		log.On("Error", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+		m.On("CountLabels", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+		wrapper := sf.NewMiddlewareWrapper(log, m, &sf.CORSOptions{}, sf.ServiceGlobals{})
+		partial := test.partial
+		handle := func(w sf.WrappedResponseWriter, _ *http.Request, _ sf.RouterParams) {
+			if partial != "" {
+				w.Write([]byte(partial))
+			}
+			panic("whoa")
+		}
+		for _, middleware := range test.middlewares {
+			handle = wrapper.Wrap("public", "compressed", middleware, handle)
+		}
+		r := httptest.NewRequest(http.MethodGet, "/some/url", nil)
+		r.Header.Set(sf.AcceptEncodingHeader, "gzip")
+		w := httptest.NewRecorder()
+
+		// Act
+		handle(sf.NewWrappedResponseWriter(w), r, sf.RouterParams{})
+
+		assert.Equal(t, test.expected, w.Code, "%v %s", test.middlewares, test.partial)
+		assert.Empty(t, w.Header().Get(sf.ContentEncodingHeader), "%v %s", test.middlewares, test.partial)
+		if test.expected == http.StatusOK {
+			assert.Equal(t, test.partial, w.Body.String())
+		} else {
+			assert.Empty(t, w.Body.String(), "%v %s", test.middlewares, test.partial)
+		}
+		expected := strconv.Itoa(test.expected)
+		var values interface{} = mock.MatchedBy(func(values []string) bool {
+			return values[3] == expected
+		})
+		m.AssertCalled(t, "CountLabels", "", "compressed_total", mock.Anything, mock.Anything, values)
+	}
+}
+
+func TestServiceOptions_Compression(t *testing.T) {
+	opt := sf.NewServiceOptions("compression", []string{http.MethodGet}, nil)
+	opt.Compression = sf.CompressionOptions{MinSize: 1}
+	opt.SetHandlers()
+	sut := sf.NewCustomService(opt)
+	sut.AddRoute("compressed", []string{"/compressed"}, []string{http.MethodGet}, []sf.Middleware{sf.Compression},
+		writeBody("text/plain", http.StatusOK, "tiny"))
+	r := httptest.NewRequest(http.MethodGet, "/compressed", nil)
+	r.Header.Set(sf.AcceptEncodingHeader, "gzip")
+	w := httptest.NewRecorder()
+
+	// Act
+	sut.Handler("public").ServeHTTP(w, r)
+
+	assert.Equal(t, "gzip", w.Header().Get(sf.ContentEncodingHeader))
+	assert.Equal(t, "tiny", decompress(t, "gzip", w.Body))
+}
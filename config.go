@@ -0,0 +1,36 @@
+package servicefoundation
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/Prutswonder/go-servicefoundation/env"
+)
+
+// ConfigSpec returns the specs of all environment variables registered by ServiceFoundation and the application,
+// including whether they are set in the current environment, but never their values.
+func ConfigSpec() []env.Spec {
+	return env.Registered()
+}
+
+// NewConfigSpecHandler returns a handler that responds with the ConfigSpec.
+func NewConfigSpecHandler() Handle {
+	return func(w WrappedResponseWriter, _ *http.Request, _ RouterParams) {
+		w.JSON(http.StatusOK, ConfigSpec())
+	}
+}
+
+// WriteConfigTemplate writes the ConfigSpec as a template for deployment manifests, with a commented line per
+// variable followed by its default value, like:
+//
+//	# Minimum filter for log writing (string)
+//	LOG_MINFILTER=Warning
+func WriteConfigTemplate(w io.Writer) error {
+	for _, spec := range ConfigSpec() {
+		if _, err := fmt.Fprintf(w, "# %s (%s)\n%s=%s\n", spec.Description, spec.Type, spec.Key, spec.Default); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package servicefoundation_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	sf "github.com/Prutswonder/go-servicefoundation"
+	"github.com/Prutswonder/go-servicefoundation/env"
+	"github.com/stretchr/testify/assert"
+)
+
+// envReaders are the functions that read environment variables without registering them.
+var envReaders = map[string][]string{
+	"os":  {"Getenv", "LookupEnv", "Environ"},
+	"env": {"OrDefault", "List", "ListOrDefault", "AsInt"},
+}
+
+// findEnvViolations returns the positions of the calls in the non-test Go files under dir that read environment
+// variables without registering them. The env package itself is skipped.
+func findEnvViolations(dir string) ([]string, error) {
+	var violations []string
+	fset := token.NewFileSet()
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			switch info.Name() {
+			case "env", "vendor", "testdata", ".git":
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasSuffix(path, ".go") || strings.HasSuffix(path, "_test.go") {
+			return nil
+		}
+
+		file, err := parser.ParseFile(fset, path, nil, 0)
+		if err != nil {
+			return err
+		}
+		ast.Inspect(file, func(n ast.Node) bool {
+			call, ok := n.(*ast.CallExpr)
+			if !ok {
+				return true
+			}
+			selector, ok := call.Fun.(*ast.SelectorExpr)
+			if !ok {
+				return true
+			}
+			if pkg, ok := selector.X.(*ast.Ident); ok && containsName(envReaders[pkg.Name], selector.Sel.Name) {
+				violations = append(violations, fset.Position(call.Pos()).String()+": "+pkg.Name+"."+selector.Sel.Name)
+			}
+			return true
+		})
+		return nil
+	})
+	return violations, err
+}
+
+func containsName(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+func TestFoundation_ReadsOnlyRegisteredEnvironmentVariables(t *testing.T) {
+	// Act
+	violations, err := findEnvViolations(".")
+
+	assert.NoError(t, err)
+	assert.Empty(t, violations, "read environment variables through env.Register")
+}
+
+func TestFindEnvViolations(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "envviolations")
+	defer os.RemoveAll(dir)
+	os.MkdirAll(filepath.Join(dir, "env"), 0755)
+	files := map[string]string{
+		"direct.go":       "package x\n\nimport \"os\"\n\nvar a = os.Getenv(\"A\")\n",
+		"unregistered.go": "package x\n\nimport \"env\"\n\nvar b = env.OrDefault(\"B\", \"\")\n",
+		"registered.go":   "package x\n\nimport \"env\"\n\nvar c = env.Register(\"C\", env.TypeString, \"\", \"\").List()\n",
+		"direct_test.go":  "package x\n\nimport \"os\"\n\nvar d = os.Getenv(\"D\")\n",
+		"env/env.go":      "package env\n\nimport \"os\"\n\nvar e = os.Getenv(\"E\")\n",
+	}
+	for name, content := range files {
+		ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+	}
+
+	// Act
+	violations, err := findEnvViolations(dir)
+
+	assert.NoError(t, err)
+	if assert.Len(t, violations, 2) {
+		assert.True(t, strings.HasSuffix(violations[0], "direct.go:5:9: os.Getenv"), violations[0])
+		assert.True(t, strings.HasSuffix(violations[1], "unregistered.go:5:9: env.OrDefault"), violations[1])
+	}
+}
+
+func specOf(specs []env.Spec, key string) (env.Spec, bool) {
+	for _, spec := range specs {
+		if spec.Key == key {
+			return spec, true
+		}
+	}
+	return env.Spec{}, false
+}
+
+func TestConfigSpec(t *testing.T) {
+	env.Register("ORDERS_DATABASE_URL", env.TypeString, "", "Connection string of the orders database")
+	os.Setenv("ORDERS_DATABASE_URL", "postgres://secret@db/orders")
+	defer os.Unsetenv("ORDERS_DATABASE_URL")
+	os.Unsetenv("HTTPPORT")
+
+	// Act
+	specs := sf.ConfigSpec()
+
+	for _, key := range []string{"CORS_ORIGINS", "LOG_MINFILTER", "LOG_SINKS", "ROUTE_BUDGETS", "RESPONSE_SHAPES_DIR",
+		"SHUTDOWN_MODE", "API_KEYS", "APP_NAME", "SERVER_NAME", "DEPLOY_ENVIRONMENT", "GO_PIPELINE_LABEL", "BUILD_DATE",
+		"GIT_HASH"} {
+		spec, ok := specOf(specs, key)
+		assert.True(t, ok, key)
+		assert.NotEmpty(t, spec.Description, key)
+	}
+	port, _ := specOf(specs, "HTTPPORT")
+	assert.Equal(t, env.TypeInt, port.Type)
+	assert.Equal(t, "8080", port.Default)
+	assert.False(t, port.Set)
+	application, ok := specOf(specs, "ORDERS_DATABASE_URL")
+	assert.True(t, ok, "application variables are part of the spec")
+	assert.True(t, application.Set)
+}
+
+func TestConfigSpecHandler(t *testing.T) {
+	w := httptest.NewRecorder()
+
+	// Act
+	sf.NewConfigSpecHandler()(sf.NewWrappedResponseWriter(w), nil, sf.RouterParams{})
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	var specs []env.Spec
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &specs))
+	assert.Equal(t, sf.ConfigSpec(), specs)
+}
+
+func TestWriteConfigTemplate(t *testing.T) {
+	var b bytes.Buffer
+
+	// Act
+	err := sf.WriteConfigTemplate(&b)
+
+	assert.NoError(t, err)
+	assert.Contains(t, b.String(), "# Minimum filter for log writing (string)\nLOG_MINFILTER=Warning\n")
+}
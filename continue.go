@@ -0,0 +1,76 @@
+package servicefoundation
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+const expectContinueSubsystem = "expect_continue"
+
+// ErrBodyNotAccepted is returned when the body of a request that expects 100-continue is read before the route
+// accepted it.
+var ErrBodyNotAccepted = errors.New("request body read before the request was accepted")
+
+type (
+	// continueGate holds back the body of a request that expects 100-continue. The server sends the 100 Continue when
+	// the body is first read, so reads fail until the route accepts the body.
+	continueGate struct {
+		io.ReadCloser
+		accepted int32
+	}
+)
+
+// NewExpectContinueMiddleware returns a MiddlewareFunc that defers the 100 Continue of requests with an
+// "Expect: 100-continue" header until their body is accepted by the route contract. Requests that are rejected before,
+// like by authentication or quota, get their final response without a 100 Continue, so the client doesn't send the
+// body. net/http sends the 100 Continue on the first read of the body for both HTTP/1.1 and HTTP/2, and closes
+// HTTP/1.1 connections of which the body wasn't read, which covers clients that send the body without waiting.
+func NewExpectContinueMiddleware(name string, metrics Metrics) MiddlewareFunc {
+	return func(next Handle) Handle {
+		return func(w WrappedResponseWriter, r *http.Request, p RouterParams) {
+			if !expectsContinue(r) || !hasBody(r) {
+				next(w, r, p)
+				return
+			}
+
+			gate := &continueGate{ReadCloser: r.Body}
+			r.Body = gate
+
+			next(w, r, p)
+
+			if !gate.isAccepted() {
+				metrics.CountLabels(expectContinueSubsystem, "rejected_total",
+					"Total requests expecting 100-continue that were rejected before their body was sent.",
+					[]string{"route", "code"}, []string{name, strconv.Itoa(w.Status())})
+			}
+		}
+	}
+}
+
+// acceptBody allows the body of the request to be read, which makes the server send the 100 Continue.
+func acceptBody(r *http.Request) {
+	if gate, ok := r.Body.(*continueGate); ok {
+		atomic.StoreInt32(&gate.accepted, 1)
+	}
+}
+
+func expectsContinue(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Expect"), "100-continue")
+}
+
+func (g *continueGate) isAccepted() bool {
+	return atomic.LoadInt32(&g.accepted) == 1
+}
+
+/* io.Reader implementation */
+
+func (g *continueGate) Read(p []byte) (int, error) {
+	if !g.isAccepted() {
+		return 0, ErrBodyNotAccepted
+	}
+	return g.ReadCloser.Read(p)
+}
@@ -0,0 +1,158 @@
+package servicefoundation_test
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	sf "github.com/Prutswonder/go-servicefoundation"
+	"github.com/Prutswonder/go-servicefoundation/servicetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+type uploadRequest struct {
+	token       string
+	contentType string
+	body        string
+	length      int
+}
+
+func newUploadServer(uploads *int) *httptest.Server {
+	opt := sf.NewServiceOptions("continue", []string{http.MethodPost}, nil)
+	opt.SetHandlers()
+	sut := sf.NewCustomService(opt)
+	auth := func(next sf.Handle) sf.Handle {
+		return func(w sf.WrappedResponseWriter, r *http.Request, p sf.RouterParams) {
+			if r.Header.Get("Authorization") != "Bearer upload-token" {
+				sf.WriteProblem(w, http.StatusUnauthorized, "Missing token")
+				return
+			}
+			next(w, r, p)
+		}
+	}
+	sut.AddRouteWithMetadata("upload", []string{"/upload"}, sf.MethodsForPost, sf.DefaultMiddlewares,
+		sf.RouteMetadata{ContentTypes: []string{"text/plain"}, MaxBodySize: 64, Auth: auth, ExpectContinue: true},
+		func(w sf.WrappedResponseWriter, r *http.Request, _ sf.RouterParams) {
+			*uploads++
+			body, _ := ioutil.ReadAll(r.Body)
+			w.Write(body)
+		})
+	return httptest.NewServer(sut.Handler("public"))
+}
+
+// upload sends the headers of the request with "Expect: 100-continue" over a raw connection. The body is sent right
+// away when waitForContinue is false, and otherwise only after a 100 Continue. It returns the interim and final
+// responses.
+func upload(t *testing.T, server *httptest.Server, request uploadRequest, waitForContinue bool) (*http.Response, *http.Response) {
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if !assert.NoError(t, err) {
+		return nil, nil
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	length := request.length
+	if length == 0 {
+		length = len(request.body)
+	}
+	head := fmt.Sprintf("POST /upload HTTP/1.1\r\nHost: uploads\r\nExpect: 100-continue\r\n"+
+		"Content-Type: %s\r\nContent-Length: %d\r\n", request.contentType, length)
+	if request.token != "" {
+		head += "Authorization: Bearer " + request.token + "\r\n"
+	}
+	head += "\r\n"
+	if !waitForContinue {
+		head += request.body
+	}
+	conn.Write([]byte(head))
+
+	reader := bufio.NewReader(conn)
+	first, err := http.ReadResponse(reader, nil)
+	if !assert.NoError(t, err) || first.StatusCode != http.StatusContinue {
+		return nil, first
+	}
+	if waitForContinue {
+		conn.Write([]byte(request.body))
+	}
+	final, err := http.ReadResponse(reader, nil)
+	assert.NoError(t, err)
+	return first, final
+}
+
+func readBody(response *http.Response) string {
+	body, _ := ioutil.ReadAll(response.Body)
+	return string(body)
+}
+
+func TestExpectContinue_EarlyRejection(t *testing.T) {
+	var uploads int
+	server := newUploadServer(&uploads)
+	defer server.Close()
+	tests := []struct {
+		request  uploadRequest
+		expected int
+	}{
+		{uploadRequest{contentType: "text/plain", body: "hello"}, http.StatusUnauthorized},
+		{uploadRequest{token: "upload-token", contentType: "text/plain", length: 1 << 20}, http.StatusRequestEntityTooLarge},
+		{uploadRequest{token: "upload-token", contentType: "application/xml", body: "<hello/>"}, http.StatusUnsupportedMediaType},
+	}
+
+	for _, test := range tests {
+		for _, wait := range []bool{true, false} {
+			// Act
+			interim, final := upload(t, server, test.request, wait)
+
+			assert.Nil(t, interim, "the body is not requested")
+			if assert.NotNil(t, final) {
+				assert.Equal(t, test.expected, final.StatusCode)
+				assert.True(t, final.Close, "the connection isn't reused, because the body may still arrive")
+			}
+		}
+	}
+	assert.Equal(t, 0, uploads)
+}
+
+func TestExpectContinue_Acceptance(t *testing.T) {
+	var uploads int
+	server := newUploadServer(&uploads)
+	defer server.Close()
+	request := uploadRequest{token: "upload-token", contentType: "text/plain", body: "hello"}
+
+	for _, wait := range []bool{true, false} {
+		// Act
+		interim, final := upload(t, server, request, wait)
+
+		if assert.NotNil(t, interim, "the body is requested") && assert.NotNil(t, final) {
+			assert.Equal(t, http.StatusContinue, interim.StatusCode)
+			assert.Equal(t, http.StatusOK, final.StatusCode)
+			assert.Equal(t, "hello", readBody(final))
+		}
+	}
+	assert.Equal(t, 2, uploads)
+}
+
+func TestExpectContinueMiddleware_BodyNotReadableBeforeAcceptance(t *testing.T) {
+	m := &mockMetrics{}
+	m.On("CountLabels", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+	r, _ := http.NewRequest(http.MethodPost, "/upload", strings.NewReader("hello"))
+	r.Header.Set("Expect", "100-continue")
+	var err error
+
+	// Act
+	servicetest.RunMiddlewareWithHandler(sf.NewExpectContinueMiddleware("upload", m), r,
+		func(w sf.WrappedResponseWriter, r *http.Request, _ sf.RouterParams) {
+			_, err = ioutil.ReadAll(r.Body)
+			w.WriteHeader(http.StatusForbidden)
+		})
+
+	assert.Equal(t, sf.ErrBodyNotAccepted, err)
+	m.AssertCalled(t, "CountLabels", "expect_continue", "rejected_total", mock.Anything,
+		[]string{"route", "code"}, []string{"upload", "403"})
+}
@@ -0,0 +1,190 @@
+package servicefoundation
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Prutswonder/go-servicefoundation/events"
+)
+
+const (
+	criticalSectionsSubsystem = "critical_sections"
+
+	defaultCriticalDeadline    = 60 * time.Second
+	defaultCriticalLogInterval = 5 * time.Second
+)
+
+// ErrShuttingDown is returned when a critical section is started after the shutdown has begun.
+var ErrShuttingDown = errors.New("service is shutting down")
+
+type (
+	// CriticalOperation is a registered critical section that must be ended by calling Done.
+	CriticalOperation interface {
+		Done()
+	}
+
+	// CriticalSections keeps track of in-flight operations that should not be interrupted by a shutdown.
+	CriticalSections interface {
+		Begin(name string) (CriticalOperation, error)
+		BeginShutdown()
+		Wait(deadline time.Duration) bool
+		Active() map[string]int
+	}
+
+	criticalSectionsImpl struct {
+		log         Logger
+		metrics     Metrics
+		logInterval time.Duration
+		mutex       sync.Mutex
+		shutdown    bool
+		active      map[string]int
+		wg          sync.WaitGroup
+	}
+
+	criticalOperationImpl struct {
+		sections *criticalSectionsImpl
+		name     string
+		once     sync.Once
+	}
+
+	noopCriticalOperation struct{}
+
+	criticalSectionsContextKey struct{}
+)
+
+// NewCriticalSections creates and returns a new CriticalSections implementation. While waiting for the shutdown, the
+// pending sections are logged every logInterval.
+func NewCriticalSections(log Logger, metrics Metrics, logInterval time.Duration) CriticalSections {
+	if logInterval <= 0 {
+		logInterval = defaultCriticalLogInterval
+	}
+
+	return &criticalSectionsImpl{
+		log:         log,
+		metrics:     metrics,
+		logInterval: logInterval,
+		active:      make(map[string]int),
+	}
+}
+
+// WithCriticalSections returns a copy of the context that carries the given CriticalSections.
+func WithCriticalSections(ctx context.Context, sections CriticalSections) context.Context {
+	return context.WithValue(ctx, criticalSectionsContextKey{}, sections)
+}
+
+// CriticalSection registers a named critical section with the CriticalSections carried by the context. The returned
+// operation must be ended by calling Done. Once the shutdown has begun, ErrShuttingDown is returned so the caller can
+// abort before performing any side effects. Without CriticalSections in the context, a no-op operation is returned.
+func CriticalSection(ctx context.Context, name string) (CriticalOperation, error) {
+	sections, ok := ctx.Value(criticalSectionsContextKey{}).(CriticalSections)
+
+	if !ok || sections == nil {
+		return noopCriticalOperation{}, nil
+	}
+	return sections.Begin(name)
+}
+
+/* CriticalSections implementation */
+
+func (c *criticalSectionsImpl) Begin(name string) (CriticalOperation, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.shutdown {
+		return nil, ErrShuttingDown
+	}
+
+	c.wg.Add(1)
+	c.active[name]++
+	c.setGauge(name)
+
+	return &criticalOperationImpl{sections: c, name: name}, nil
+}
+
+func (c *criticalSectionsImpl) BeginShutdown() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.shutdown = true
+}
+
+// Wait blocks until all critical sections are done or the deadline has passed. It returns false when sections were
+// still pending at the deadline.
+func (c *criticalSectionsImpl) Wait(deadline time.Duration) bool {
+	done := make(chan struct{})
+
+	go func() {
+		c.wg.Wait()
+		close(done)
+	}()
+
+	timeout := time.After(deadline)
+	ticker := time.NewTicker(c.logInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return true
+		case <-ticker.C:
+			c.log.Info(events.CriticalSectionsPending, "Waiting for critical sections: %s", c.pending())
+		case <-timeout:
+			c.log.Warn(events.CriticalSectionsAbandoned, "Deadline reached with pending critical sections: %s",
+				c.pending())
+			return false
+		}
+	}
+}
+
+func (c *criticalSectionsImpl) Active() map[string]int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	active := make(map[string]int, len(c.active))
+	for name, count := range c.active {
+		if count > 0 {
+			active[name] = count
+		}
+	}
+	return active
+}
+
+func (c *criticalSectionsImpl) done(name string) {
+	c.mutex.Lock()
+	c.active[name]--
+	c.setGauge(name)
+	c.mutex.Unlock()
+
+	c.wg.Done()
+}
+
+func (c *criticalSectionsImpl) pending() string {
+	active := c.Active()
+	names := make([]string, 0, len(active))
+
+	for name := range active {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+func (c *criticalSectionsImpl) setGauge(name string) {
+	c.metrics.SetGaugeLabels(float64(c.active[name]), criticalSectionsSubsystem, "active",
+		"Number of active critical sections.", []string{"name"}, []string{name})
+}
+
+/* CriticalOperation implementation */
+
+func (o *criticalOperationImpl) Done() {
+	o.once.Do(func() {
+		o.sections.done(o.name)
+	})
+}
+
+func (noopCriticalOperation) Done() {
+}
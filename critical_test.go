@@ -0,0 +1,89 @@
+package servicefoundation_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	sf "github.com/Prutswonder/go-servicefoundation"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func newTestCriticalSections() (sf.CriticalSections, *mockLogger, *mockMetrics) {
+	log := &mockLogger{}
+	m := &mockMetrics{}
+
+	m.On("SetGaugeLabels", mock.Anything, "critical_sections", "active", mock.Anything, []string{"name"},
+		[]string{"charge-card"})
+
+	return sf.NewCriticalSections(log, m, 5*time.Millisecond), log, m
+}
+
+func TestCriticalSections_WaitsForPendingSections(t *testing.T) {
+	sut, log, m := newTestCriticalSections()
+	ctx := sf.WithCriticalSections(context.Background(), sut)
+
+	log.On("Info", "CriticalSectionsPending", mock.Anything, mock.Anything).Return(nil)
+
+	op, err := sf.CriticalSection(ctx, "charge-card")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"charge-card": 1}, sut.Active())
+
+	sut.BeginShutdown()
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		op.Done()
+	}()
+	start := time.Now()
+
+	// Act
+	actual := sut.Wait(time.Second)
+
+	assert.True(t, actual)
+	assert.True(t, time.Since(start) >= 20*time.Millisecond)
+	assert.Empty(t, sut.Active())
+	m.AssertCalled(t, "SetGaugeLabels", float64(1), "critical_sections", "active", mock.Anything, []string{"name"},
+		[]string{"charge-card"})
+	m.AssertCalled(t, "SetGaugeLabels", float64(0), "critical_sections", "active", mock.Anything, []string{"name"},
+		[]string{"charge-card"})
+}
+
+func TestCriticalSections_RefusedAfterShutdownBegins(t *testing.T) {
+	sut, _, _ := newTestCriticalSections()
+	ctx := sf.WithCriticalSections(context.Background(), sut)
+
+	sut.BeginShutdown()
+
+	// Act
+	op, err := sf.CriticalSection(ctx, "charge-card")
+
+	assert.Nil(t, op)
+	assert.Equal(t, sf.ErrShuttingDown, err)
+}
+
+func TestCriticalSections_DeadlineLogsPendingSections(t *testing.T) {
+	sut, log, _ := newTestCriticalSections()
+
+	log.On("Info", "CriticalSectionsPending", mock.Anything, []interface{}{"charge-card"}).Return(nil)
+	log.On("Warn", "CriticalSectionsAbandoned", mock.Anything, []interface{}{"charge-card"}).Return(nil).Once()
+
+	_, err := sut.Begin("charge-card")
+	assert.NoError(t, err)
+	sut.BeginShutdown()
+
+	// Act
+	actual := sut.Wait(30 * time.Millisecond)
+
+	assert.False(t, actual)
+	log.AssertExpectations(t)
+}
+
+func TestCriticalSection_WithoutCriticalSectionsInContext(t *testing.T) {
+	// Act
+	op, err := sf.CriticalSection(context.Background(), "charge-card")
+
+	assert.NoError(t, err)
+	assert.NotNil(t, op)
+	op.Done()
+}
@@ -0,0 +1,243 @@
+package servicefoundation
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedules without a match within this many years are considered invalid, like "0 0 30 2 *".
+const cronSearchYears = 5
+
+var (
+	cronMacros = map[string]string{
+		"@yearly":   "0 0 0 1 1 *",
+		"@annually": "0 0 0 1 1 *",
+		"@monthly":  "0 0 0 1 * *",
+		"@weekly":   "0 0 0 * * 0",
+		"@daily":    "0 0 0 * * *",
+		"@midnight": "0 0 0 * * *",
+		"@hourly":   "0 0 * * * *",
+	}
+
+	cronMonthNames = map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}
+
+	cronDayNames = map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}
+)
+
+type (
+	// CronSchedule is a parsed cron expression.
+	CronSchedule interface {
+		Next(t time.Time) time.Time
+		String() string
+	}
+
+	cronScheduleImpl struct {
+		expression string
+		second     uint64
+		minute     uint64
+		hour       uint64
+		dom        uint64
+		month      uint64
+		dow        uint64
+		// The day of month and day of week match either when both are restricted, like in standard cron.
+		domStar bool
+		dowStar bool
+	}
+
+	cronField struct {
+		name  string
+		min   int
+		max   int
+		names map[string]int
+	}
+)
+
+var (
+	cronSecondField = cronField{name: "second", min: 0, max: 59}
+	cronMinuteField = cronField{name: "minute", min: 0, max: 59}
+	cronHourField   = cronField{name: "hour", min: 0, max: 23}
+	cronDomField    = cronField{name: "day of month", min: 1, max: 31}
+	cronMonthField  = cronField{name: "month", min: 1, max: 12, names: cronMonthNames}
+	// Both 0 and 7 are Sunday.
+	cronDowField = cronField{name: "day of week", min: 0, max: 7, names: cronDayNames}
+)
+
+// ParseCronExpression parses a cron expression with 5 fields (minute, hour, day of month, month and day of week) or
+// 6 fields (with a leading second). Fields support "*", lists, ranges, steps and the names of months and days. The
+// macros @yearly, @monthly, @weekly, @daily and @hourly are supported as well.
+func ParseCronExpression(expression string) (CronSchedule, error) {
+	spec := strings.TrimSpace(expression)
+	if macro, ok := cronMacros[strings.ToLower(spec)]; ok {
+		spec = macro
+	}
+
+	fields := strings.Fields(spec)
+	switch len(fields) {
+	case 5:
+		fields = append([]string{"0"}, fields...)
+	case 6:
+	default:
+		return nil, fmt.Errorf("Invalid cron expression '%s': expected 5 or 6 fields, got %d", expression, len(fields))
+	}
+
+	schedule := &cronScheduleImpl{
+		expression: expression,
+		domStar:    fields[3] == "*" || fields[3] == "?",
+		dowStar:    fields[5] == "*" || fields[5] == "?",
+	}
+
+	targets := []*uint64{&schedule.second, &schedule.minute, &schedule.hour, &schedule.dom, &schedule.month, &schedule.dow}
+	for i, field := range []cronField{cronSecondField, cronMinuteField, cronHourField, cronDomField, cronMonthField, cronDowField} {
+		bits, err := field.parse(fields[i])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid cron expression '%s': %v", expression, err)
+		}
+		*targets[i] = bits
+	}
+
+	if schedule.dow&(1<<7) != 0 {
+		schedule.dow |= 1
+	}
+	if schedule.Next(time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)).IsZero() {
+		return nil, fmt.Errorf("Invalid cron expression '%s': it never matches", expression)
+	}
+	return schedule, nil
+}
+
+func (f cronField) parse(value string) (uint64, error) {
+	var bits uint64
+
+	for _, part := range strings.Split(value, ",") {
+		rangePart, step := part, 1
+
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step in %s '%s'", f.name, part)
+			}
+			rangePart, step = part[:i], n
+		}
+
+		var from, to int
+		switch {
+		case rangePart == "*" || rangePart == "?":
+			from, to = f.min, f.max
+		case strings.Contains(rangePart, "-"):
+			bounds := strings.SplitN(rangePart, "-", 2)
+			var err error
+			if from, err = f.value(bounds[0]); err != nil {
+				return 0, err
+			}
+			if to, err = f.value(bounds[1]); err != nil {
+				return 0, err
+			}
+		default:
+			n, err := f.value(rangePart)
+			if err != nil {
+				return 0, err
+			}
+			from, to = n, n
+			if strings.Contains(part, "/") {
+				// "5/15" means from 5 to the maximum, in steps of 15.
+				to = f.max
+			}
+		}
+
+		if from > to {
+			return 0, fmt.Errorf("invalid range in %s '%s'", f.name, part)
+		}
+		for i := from; i <= to; i += step {
+			bits |= 1 << uint(i)
+		}
+	}
+	return bits, nil
+}
+
+func (f cronField) value(value string) (int, error) {
+	if n, ok := f.names[strings.ToLower(value)]; ok {
+		return n, nil
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n < f.min || n > f.max {
+		return 0, fmt.Errorf("invalid %s '%s', expected %d-%d", f.name, value, f.min, f.max)
+	}
+	return n, nil
+}
+
+/* CronSchedule implementation */
+
+// Next returns the first time after t that matches the schedule, in the location of t. It returns the zero time when
+// nothing matches within the next years.
+func (s *cronScheduleImpl) Next(t time.Time) time.Time {
+	loc := t.Location()
+	t = t.Truncate(time.Second).Add(time.Second)
+	limit := t.Year() + cronSearchYears
+
+wrap:
+	if t.Year() > limit {
+		return time.Time{}
+	}
+
+	for !cronBit(s.month, int(t.Month())) {
+		t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+		if t.Year() > limit {
+			return time.Time{}
+		}
+	}
+	for !s.dayMatches(t) {
+		t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+		if t.Day() == 1 {
+			goto wrap
+		}
+	}
+	for !cronBit(s.hour, t.Hour()) {
+		next := time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+		if !next.After(t) {
+			// Daylight saving time ended and the hour repeats.
+			next = t.Truncate(time.Hour).Add(time.Hour)
+		}
+		t = next
+		if t.Hour() == 0 {
+			goto wrap
+		}
+	}
+	for !cronBit(s.minute, t.Minute()) {
+		t = t.Truncate(time.Minute).Add(time.Minute)
+		if t.Minute() == 0 {
+			goto wrap
+		}
+	}
+	for !cronBit(s.second, t.Second()) {
+		t = t.Add(time.Second)
+		if t.Second() == 0 {
+			goto wrap
+		}
+	}
+	return t
+}
+
+func (s *cronScheduleImpl) String() string {
+	return s.expression
+}
+
+func (s *cronScheduleImpl) dayMatches(t time.Time) bool {
+	domMatch := cronBit(s.dom, t.Day())
+	dowMatch := cronBit(s.dow, int(t.Weekday()))
+
+	if s.domStar || s.dowStar {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
+
+func cronBit(bits uint64, n int) bool {
+	return bits&(1<<uint(n)) != 0
+}
@@ -0,0 +1,79 @@
+package servicefoundation_test
+
+import (
+	"testing"
+	"time"
+
+	sf "github.com/Prutswonder/go-servicefoundation"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCronExpression_Next(t *testing.T) {
+	// Thursday
+	from := time.Date(2017, 6, 15, 10, 7, 30, 0, time.UTC)
+
+	tests := []struct {
+		expression string
+		expected   time.Time
+	}{
+		{"* * * * *", time.Date(2017, 6, 15, 10, 8, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2017, 6, 15, 10, 15, 0, 0, time.UTC)},
+		{"0 3 * * 1-5", time.Date(2017, 6, 16, 3, 0, 0, 0, time.UTC)},
+		{"0 3 * * sat,sun", time.Date(2017, 6, 17, 3, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2017, 6, 18, 0, 0, 0, 0, time.UTC)},
+		{"30 9 1 * *", time.Date(2017, 7, 1, 9, 30, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2020, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 12 13 * fri", time.Date(2017, 6, 16, 12, 0, 0, 0, time.UTC)},
+		{"5/20 * * * * *", time.Date(2017, 6, 15, 10, 7, 45, 0, time.UTC)},
+		{"0 0 1 jan *", time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2017, 6, 15, 11, 0, 0, 0, time.UTC)},
+		{"@weekly", time.Date(2017, 6, 18, 0, 0, 0, 0, time.UTC)},
+	}
+
+	for _, test := range tests {
+		schedule, err := sf.ParseCronExpression(test.expression)
+
+		// Act
+		actual := schedule.Next(from)
+
+		assert.NoError(t, err, test.expression)
+		assert.Equal(t, test.expected, actual, test.expression)
+	}
+}
+
+func TestParseCronExpression_Timezone(t *testing.T) {
+	amsterdam, err := time.LoadLocation("Europe/Amsterdam")
+	if err != nil {
+		t.Skip("Timezone data not available")
+	}
+	schedule, _ := sf.ParseCronExpression("0 3 * * 1-5")
+
+	// Act
+	actual := schedule.Next(time.Date(2017, 6, 15, 12, 0, 0, 0, time.UTC).In(amsterdam))
+
+	assert.Equal(t, time.Date(2017, 6, 16, 1, 0, 0, 0, time.UTC), actual.UTC())
+}
+
+func TestParseCronExpression_Invalid(t *testing.T) {
+	expressions := []string{
+		"",
+		"* * * *",
+		"* * * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"10-5 * * * *",
+		"* * * foo *",
+		"0 0 30 2 *",
+	}
+
+	for _, expression := range expressions {
+		// Act
+		_, err := sf.ParseCronExpression(expression)
+
+		assert.Error(t, err, expression)
+	}
+}
@@ -0,0 +1,204 @@
+package servicefoundation
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Prutswonder/go-servicefoundation/events"
+)
+
+const (
+	// DuplicateHeader is the name of the response header that marks a suppressed duplicate request.
+	DuplicateHeader = "X-Duplicate"
+
+	defaultDeduplicationTTL    = 24 * time.Hour
+	defaultDeduplicationBody   = 64 << 10
+	defaultSeenStoreCapacity   = 100000
+	defaultDuplicateStatusCode = http.StatusOK
+)
+
+type (
+	// SeenStore keeps track of the keys of requests that were processed successfully.
+	SeenStore interface {
+		Seen(key string) (bool, error)
+		Record(key string, ttl time.Duration) error
+	}
+
+	// DeduplicationOptions contains the settings for suppressing duplicate inbound requests, like retried webhooks.
+	// The key is read from the Header, or extracted from the first MaxBodySize bytes of the body by BodyKey. Keys are
+	// stored for TTL after the handler responded with a 2xx status code. Duplicates get the DuplicateStatus without
+	// invoking the handler.
+	DeduplicationOptions struct {
+		Header          string
+		BodyKey         func(body []byte) (string, error)
+		MaxBodySize     int
+		Store           SeenStore
+		TTL             time.Duration
+		DuplicateStatus int
+	}
+
+	memorySeenStoreImpl struct {
+		capacity int
+		mutex    sync.Mutex
+		entries  map[string]*list.Element
+		order    *list.List
+	}
+
+	seenEntry struct {
+		key     string
+		expires time.Time
+	}
+)
+
+// NewInboundDeduplication returns a MiddlewareFunc that suppresses requests for the route with a key that was
+// processed successfully before. Requests without a key, or for which the store fails, are passed to the handler.
+func NewInboundDeduplication(route string, options DeduplicationOptions, log Logger, metrics Metrics) MiddlewareFunc {
+	if options.MaxBodySize <= 0 {
+		options.MaxBodySize = defaultDeduplicationBody
+	}
+	if options.Store == nil {
+		options.Store = NewMemorySeenStore(0)
+	}
+	if options.TTL <= 0 {
+		options.TTL = defaultDeduplicationTTL
+	}
+	if options.DuplicateStatus == 0 {
+		options.DuplicateStatus = defaultDuplicateStatusCode
+	}
+
+	return func(next Handle) Handle {
+		return func(w WrappedResponseWriter, r *http.Request, p RouterParams) {
+			key := deduplicationKey(r, options, log)
+			if key == "" {
+				next(w, r, p)
+				return
+			}
+
+			seen, err := options.Store.Seen(key)
+			if err != nil {
+				log.Warn(events.DeduplicationStore, "Failed checking key '%s' for %s: %v", key, route, err)
+			}
+			if seen {
+				metrics.CountLabels("", "duplicate_requests_total", "Total suppressed duplicate requests.",
+					[]string{"route"}, []string{route})
+
+				w.Header().Set(DuplicateHeader, "true")
+				w.WriteHeader(options.DuplicateStatus)
+				return
+			}
+
+			next(w, r, p)
+
+			// Failed processing is not recorded, so the retry of the sender is processed again.
+			if w.Status() < 200 || w.Status() >= 300 {
+				return
+			}
+			if err := options.Store.Record(key, options.TTL); err != nil {
+				log.Warn(events.DeduplicationStore, "Failed recording key '%s' for %s: %v", key, route, err)
+			}
+		}
+	}
+}
+
+// NewMemorySeenStore instantiates a new in-memory SeenStore, which evicts the least recently recorded keys when the
+// capacity is reached.
+func NewMemorySeenStore(capacity int) SeenStore {
+	if capacity <= 0 {
+		capacity = defaultSeenStoreCapacity
+	}
+
+	return &memorySeenStoreImpl{
+		capacity: capacity,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+// JSONBodyKey returns a BodyKey function that reads the given top-level field of a JSON body, like an event ID.
+func JSONBodyKey(field string) func(body []byte) (string, error) {
+	return func(body []byte) (string, error) {
+		var document map[string]interface{}
+
+		if err := json.Unmarshal(body, &document); err != nil {
+			return "", err
+		}
+		if value, ok := document[field]; ok && value != nil {
+			return fmt.Sprint(value), nil
+		}
+		return "", nil
+	}
+}
+
+func deduplicationKey(r *http.Request, options DeduplicationOptions, log Logger) string {
+	if options.Header != "" {
+		return r.Header.Get(options.Header)
+	}
+	if options.BodyKey == nil || r.Body == nil {
+		return ""
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, int64(options.MaxBodySize)))
+
+	// Replay the pre-read part, followed by the remainder of the body.
+	r.Body = readCloser{Reader: io.MultiReader(bytes.NewReader(body), r.Body), Closer: r.Body}
+
+	if err != nil {
+		log.Warn(events.DeduplicationKey, "Failed reading body: %v", err)
+		return ""
+	}
+
+	key, err := options.BodyKey(body)
+	if err != nil {
+		log.Debug(events.DeduplicationKey, "Failed extracting key from body: %v", err)
+		return ""
+	}
+	return key
+}
+
+/* SeenStore implementation */
+
+func (s *memorySeenStoreImpl) Seen(key string) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	element, ok := s.entries[key]
+	if !ok {
+		return false, nil
+	}
+
+	if time.Now().After(element.Value.(*seenEntry).expires) {
+		s.order.Remove(element)
+		delete(s.entries, key)
+		return false, nil
+	}
+	return true, nil
+}
+
+func (s *memorySeenStoreImpl) Record(key string, ttl time.Duration) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	expires := time.Now().Add(ttl)
+
+	if element, ok := s.entries[key]; ok {
+		element.Value.(*seenEntry).expires = expires
+		s.order.MoveToFront(element)
+		return nil
+	}
+
+	s.entries[key] = s.order.PushFront(&seenEntry{key: key, expires: expires})
+
+	for s.order.Len() > s.capacity {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.entries, oldest.Value.(*seenEntry).key)
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package servicefoundation_test
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	sf "github.com/Prutswonder/go-servicefoundation"
+	"github.com/Prutswonder/go-servicefoundation/servicetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func newTestDeduplication(options sf.DeduplicationOptions) (sf.MiddlewareFunc, *mockMetrics) {
+	log := &mockLogger{}
+	m := &mockMetrics{}
+	log.On("Debug", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	log.On("Warn", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	m.On("CountLabels", "", "duplicate_requests_total", mock.Anything, []string{"route"}, []string{"webhook"})
+
+	return sf.NewInboundDeduplication("webhook", options, log, m), m
+}
+
+func newWebhookRequest(eventID string) *http.Request {
+	r, _ := http.NewRequest(http.MethodPost, "/webhook", nil)
+	r.Header.Set("X-Event-Id", eventID)
+	return r
+}
+
+func TestInboundDeduplication_SuppressesDuplicates(t *testing.T) {
+	sut, m := newTestDeduplication(sf.DeduplicationOptions{Header: "X-Event-Id", DuplicateStatus: http.StatusAccepted})
+
+	// Act
+	w1, called1 := servicetest.RunMiddleware(sut, newWebhookRequest("evt-1"))
+	w2, called2 := servicetest.RunMiddleware(sut, newWebhookRequest("evt-1"))
+	_, called3 := servicetest.RunMiddleware(sut, newWebhookRequest("evt-2"))
+
+	assert.True(t, called1)
+	assert.Empty(t, w1.Header().Get("X-Duplicate"))
+	assert.False(t, called2)
+	assert.Equal(t, http.StatusAccepted, w2.Code)
+	assert.Equal(t, "true", w2.Header().Get("X-Duplicate"))
+	assert.True(t, called3)
+	m.AssertNumberOfCalls(t, "CountLabels", 1)
+}
+
+func TestInboundDeduplication_FailureAllowsRetry(t *testing.T) {
+	sut, _ := newTestDeduplication(sf.DeduplicationOptions{Header: "X-Event-Id"})
+	status := http.StatusInternalServerError
+	calls := 0
+	handler := func(w sf.WrappedResponseWriter, _ *http.Request, _ sf.RouterParams) {
+		calls++
+		w.WriteHeader(status)
+	}
+
+	// Act
+	servicetest.RunMiddlewareWithHandler(sut, newWebhookRequest("evt-1"), handler)
+	status = http.StatusOK
+	servicetest.RunMiddlewareWithHandler(sut, newWebhookRequest("evt-1"), handler)
+	servicetest.RunMiddlewareWithHandler(sut, newWebhookRequest("evt-1"), handler)
+
+	assert.Equal(t, 2, calls)
+}
+
+func TestInboundDeduplication_BodyRestored(t *testing.T) {
+	sut, _ := newTestDeduplication(sf.DeduplicationOptions{BodyKey: sf.JSONBodyKey("id"), MaxBodySize: 16})
+	small := `{"id":"evt-1"}`
+	large := `{"id":"evt-2","payload":"` + strings.Repeat("x", 100) + `"}`
+
+	for _, body := range []string{small, large, small} {
+		var received []string
+		r, _ := http.NewRequest(http.MethodPost, "/webhook", bytes.NewBufferString(body))
+		handler := func(w sf.WrappedResponseWriter, r *http.Request, _ sf.RouterParams) {
+			b, _ := ioutil.ReadAll(r.Body)
+			received = append(received, string(b))
+		}
+
+		// Act
+		servicetest.RunMiddlewareWithHandler(sut, r, handler)
+
+		if len(received) > 0 {
+			assert.Equal(t, body, received[0])
+		}
+	}
+}
+
+func TestInboundDeduplication_BodyKeyDuplicate(t *testing.T) {
+	sut, _ := newTestDeduplication(sf.DeduplicationOptions{BodyKey: sf.JSONBodyKey("id")})
+
+	// Act
+	_, called1 := servicetest.RunMiddleware(sut, newBodyRequest(`{"id":42}`))
+	_, called2 := servicetest.RunMiddleware(sut, newBodyRequest(`{"id":42,"retry":1}`))
+
+	assert.True(t, called1)
+	assert.False(t, called2)
+}
+
+func newBodyRequest(body string) *http.Request {
+	r, _ := http.NewRequest(http.MethodPost, "/webhook", bytes.NewBufferString(body))
+	return r
+}
+
+func TestMemorySeenStore_TTLAndCapacity(t *testing.T) {
+	sut := sf.NewMemorySeenStore(2)
+
+	// Act
+	sut.Record("a", 20*time.Millisecond)
+	sut.Record("b", time.Minute)
+	sut.Record("c", time.Minute)
+
+	seenA, _ := sut.Seen("a")
+	seenB, _ := sut.Seen("b")
+
+	assert.False(t, seenA)
+	assert.True(t, seenB)
+
+	sut = sf.NewMemorySeenStore(0)
+	sut.Record("a", 20*time.Millisecond)
+	seenBefore, _ := sut.Seen("a")
+	time.Sleep(30 * time.Millisecond)
+	seenAfter, _ := sut.Seen("a")
+
+	assert.True(t, seenBefore)
+	assert.False(t, seenAfter)
+}
+
+func TestRedisSeenStore(t *testing.T) {
+	var scripts []string
+	var keys [][]string
+	var args [][]interface{}
+	results := []interface{}{int64(0), int64(1), int64(1), "1"}
+	sut := sf.NewRedisSeenStore(sf.RedisEvalFunc(func(script string, k []string, a ...interface{}) (interface{}, error) {
+		scripts = append(scripts, script)
+		keys = append(keys, k)
+		args = append(args, a)
+		result := results[0]
+		results = results[1:]
+		return result, nil
+	}), "dedup:webhook:")
+
+	// Act
+	seenBefore, errBefore := sut.Seen("evt-1")
+	errRecord := sut.Record("evt-1", 24*time.Hour)
+	seenAfter, errAfter := sut.Seen("evt-1")
+	_, errUnexpected := sut.Seen("evt-1")
+	errTTL := sut.Record("evt-1", time.Microsecond)
+
+	assert.NoError(t, errBefore)
+	assert.False(t, seenBefore)
+	assert.NoError(t, errRecord)
+	assert.NoError(t, errAfter)
+	assert.True(t, seenAfter)
+	assert.Error(t, errUnexpected)
+	assert.Error(t, errTTL)
+	assert.Len(t, scripts, 4, "a TTL below a millisecond isn't sent to Redis")
+	assert.Equal(t, []string{"dedup:webhook:evt-1"}, keys[1])
+	// The key is only set when it doesn't exist, with an expiry in milliseconds, in a single atomic command.
+	assert.Contains(t, scripts[1], "'PX', ARGV[1], 'NX'")
+	assert.Equal(t, []interface{}{int64(24 * time.Hour / time.Millisecond)}, args[1])
+}
+
+func TestRedisSeenStore_Errors(t *testing.T) {
+	sut := sf.NewRedisSeenStore(sf.RedisEvalFunc(func(string, []string, ...interface{}) (interface{}, error) {
+		return nil, errors.New("connection refused")
+	}), "")
+	dedup, _ := newTestDeduplication(sf.DeduplicationOptions{Header: "X-Event-Id", Store: sut})
+
+	// Act
+	_, err := sut.Seen("evt-1")
+	_, called := servicetest.RunMiddleware(dedup, newWebhookRequest("evt-1"))
+
+	assert.EqualError(t, err, "connection refused")
+	assert.True(t, called, "requests are passed to the handler when the store fails")
+}
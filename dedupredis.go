@@ -0,0 +1,60 @@
+package servicefoundation
+
+import (
+	"fmt"
+	"time"
+)
+
+// seenScript returns 1 when KEYS[1] exists, or 0 otherwise.
+const seenScript = `return redis.call('EXISTS', KEYS[1])`
+
+// recordSeenScript sets KEYS[1] with an expiry of ARGV[1] milliseconds, unless it exists already. It returns 1 when
+// the key was set, or 0 otherwise, because a nil reply is an error for most Redis clients.
+const recordSeenScript = `
+if redis.call('SET', KEYS[1], '1', 'PX', ARGV[1], 'NX') then
+	return 1
+end
+return 0
+`
+
+type redisSeenStoreImpl struct {
+	redis  RedisEvaler
+	prefix string
+}
+
+// NewRedisSeenStore returns a SeenStore that keeps the keys in Redis, so duplicates are suppressed between replicas.
+// Keys are stored with the prefix, like "dedup:webhook:", to keep them apart from other keys. Redis expires the keys,
+// and recording a key that exists keeps its original expiry.
+func NewRedisSeenStore(redis RedisEvaler, prefix string) SeenStore {
+	return &redisSeenStoreImpl{redis: redis, prefix: prefix}
+}
+
+/* SeenStore implementation */
+
+func (s *redisSeenStoreImpl) Seen(key string) (bool, error) {
+	result, err := s.redis.Eval(seenScript, []string{s.prefix + key})
+	if err != nil {
+		return false, err
+	}
+
+	values, err := redisIntegers([]interface{}{result}, 1)
+	if err != nil {
+		return false, err
+	}
+	return values[0] == 1, nil
+}
+
+func (s *redisSeenStoreImpl) Record(key string, ttl time.Duration) error {
+	milliseconds := ttl.Nanoseconds() / int64(time.Millisecond)
+	if milliseconds < 1 {
+		return fmt.Errorf("TTL %v of key '%s' is shorter than a millisecond", ttl, key)
+	}
+
+	result, err := s.redis.Eval(recordSeenScript, []string{s.prefix + key}, milliseconds)
+	if err != nil {
+		return err
+	}
+
+	_, err = redisIntegers([]interface{}{result}, 1)
+	return err
+}
@@ -0,0 +1,218 @@
+package servicefoundation
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"hash"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/Prutswonder/go-servicefoundation/events"
+)
+
+const (
+	// ReprDigestHeader is the name of the response header with the digest of the representation (RFC 9530).
+	ReprDigestHeader = "Repr-Digest"
+	// ContentDigestHeader is the name of the request header with the digest of the content (RFC 9530).
+	ContentDigestHeader = "Content-Digest"
+	// DigestHeader is the name of the legacy digest header (RFC 3230).
+	DigestHeader = "Digest"
+
+	defaultDigestMaxBufferSize = 1 << 20
+)
+
+type (
+	// DigestOptions contains the settings of the digest middleware. Responses up to MaxBufferSize bytes are buffered
+	// to add the digest headers. Larger and flushed responses are streamed, with the digest as a trailer when Trailers
+	// is true and the client sends "TE: trailers". ValidateRequests makes the route reject requests of which the body
+	// doesn't match their Content-Digest header.
+	DigestOptions struct {
+		MaxBufferSize    int
+		Trailers         bool
+		ValidateRequests bool
+	}
+
+	digestResponseWriter struct {
+		http.ResponseWriter
+		hash        hash.Hash
+		buffer      bytes.Buffer
+		status      int
+		wroteHeader bool
+		streaming   bool
+		trailer     bool
+		maxBuffer   int
+	}
+)
+
+// NewDigestMiddleware returns a MiddlewareFunc that adds the SHA-256 digest of the response body as Repr-Digest and
+// Digest headers, and optionally validates the Content-Digest of requests. The digest is computed over the identity
+// representation, so the middleware must be inside any compression and outside middlewares that transform the
+// content, like NewFieldFilter. Responses of which the handler set a Content-Encoding get no digest.
+func NewDigestMiddleware(route string, options DigestOptions, log Logger, metrics Metrics) MiddlewareFunc {
+	if options.MaxBufferSize <= 0 {
+		options.MaxBufferSize = defaultDigestMaxBufferSize
+	}
+
+	return func(next Handle) Handle {
+		return func(w WrappedResponseWriter, r *http.Request, p RouterParams) {
+			if options.ValidateRequests && r.Header.Get(ContentDigestHeader) != "" {
+				if detail := validateContentDigest(r); detail != "" {
+					log.Warn(events.ContentDigestMismatch, "Rejecting request of %s: %s", route, detail)
+					metrics.CountLabels("digest", "request_mismatches_total",
+						"Total requests of which the body didn't match the Content-Digest.", []string{"route"}, []string{route})
+					WriteProblem(w, http.StatusBadRequest, detail)
+					return
+				}
+			}
+
+			dw := &digestResponseWriter{
+				ResponseWriter: w,
+				hash:           sha256.New(),
+				status:         http.StatusOK,
+				trailer:        options.Trailers && acceptsTrailers(r),
+				maxBuffer:      options.MaxBufferSize,
+			}
+
+			next(NewWrappedResponseWriter(dw), r, p)
+			dw.finish()
+		}
+	}
+}
+
+// DigestOf returns the SHA-256 digest of the body as structured field value, like "sha-256=:<base64>:".
+func DigestOf(body []byte) string {
+	sum := sha256.Sum256(body)
+	return formatDigest(sum[:])
+}
+
+/* http.ResponseWriter implementation */
+
+func (w *digestResponseWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.status = code
+	w.wroteHeader = true
+}
+
+func (w *digestResponseWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	w.hash.Write(p)
+
+	if w.streaming {
+		return w.ResponseWriter.Write(p)
+	}
+
+	n, err := w.buffer.Write(p)
+	if w.buffer.Len() > w.maxBuffer {
+		w.stream()
+	}
+	return n, err
+}
+
+// Flush streams the response, so the digest can only be sent as a trailer.
+func (w *digestResponseWriter) Flush() {
+	if !w.streaming {
+		w.stream()
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *digestResponseWriter) stream() {
+	w.streaming = true
+	if w.trailer && w.identity() {
+		w.Header().Add("Trailer", ReprDigestHeader)
+	}
+
+	w.ResponseWriter.WriteHeader(w.status)
+	w.ResponseWriter.Write(w.buffer.Bytes())
+	w.buffer.Reset()
+}
+
+func (w *digestResponseWriter) finish() {
+	if w.streaming {
+		if w.trailer && w.identity() {
+			w.Header().Set(ReprDigestHeader, formatDigest(w.hash.Sum(nil)))
+		}
+		return
+	}
+
+	if w.identity() {
+		sum := w.hash.Sum(nil)
+		w.Header().Set(ReprDigestHeader, formatDigest(sum))
+		w.Header().Set(DigestHeader, "SHA-256="+base64.StdEncoding.EncodeToString(sum))
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	w.ResponseWriter.Write(w.buffer.Bytes())
+}
+
+func (w *digestResponseWriter) identity() bool {
+	encoding := w.Header().Get("Content-Encoding")
+	return encoding == "" || encoding == "identity"
+}
+
+// validateContentDigest compares the sha-256 member of the Content-Digest header with the digest of the body, which
+// is replayed for the handler. It returns the detail of the problem if they don't match.
+func validateContentDigest(r *http.Request) string {
+	expected, ok := parseDigest(r.Header.Get(ContentDigestHeader), "sha-256")
+	if !ok {
+		return "Content-Digest without a valid sha-256 digest"
+	}
+
+	var body []byte
+	if r.Body != nil {
+		var err error
+		if body, err = ioutil.ReadAll(r.Body); err != nil {
+			return "Failed reading the body"
+		}
+		r.Body.Close()
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	actual := sha256.Sum256(body)
+	if subtle.ConstantTimeCompare(expected, actual[:]) != 1 {
+		return "Content-Digest does not match the body"
+	}
+	return ""
+}
+
+// parseDigest returns the digest of the algorithm in a structured field dictionary, like "sha-256=:<base64>:".
+func parseDigest(header, algorithm string) ([]byte, bool) {
+	for _, member := range strings.Split(header, ",") {
+		parts := strings.SplitN(strings.TrimSpace(member), "=", 2)
+		if len(parts) != 2 || !strings.EqualFold(parts[0], algorithm) {
+			continue
+		}
+
+		value := parts[1]
+		if len(value) < 2 || value[0] != ':' || value[len(value)-1] != ':' {
+			return nil, false
+		}
+		digest, err := base64.StdEncoding.DecodeString(value[1 : len(value)-1])
+		if err != nil {
+			return nil, false
+		}
+		return digest, true
+	}
+	return nil, false
+}
+
+func formatDigest(sum []byte) string {
+	return "sha-256=:" + base64.StdEncoding.EncodeToString(sum) + ":"
+}
+
+func acceptsTrailers(r *http.Request) bool {
+	for _, te := range strings.Split(r.Header.Get("TE"), ",") {
+		if strings.EqualFold(strings.TrimSpace(te), "trailers") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,173 @@
+package servicefoundation_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	sf "github.com/Prutswonder/go-servicefoundation"
+	"github.com/Prutswonder/go-servicefoundation/servicetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func newTestDigestMiddleware(options sf.DigestOptions, m *mockMetrics) sf.MiddlewareFunc {
+	log := &mockLogger{}
+	log.On("Warn", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+
+	return sf.NewDigestMiddleware("webhook", options, log, m)
+}
+
+func writeChunks(chunks ...string) sf.Handle {
+	return func(w sf.WrappedResponseWriter, _ *http.Request, _ sf.RouterParams) {
+		w.WriteHeader(http.StatusOK)
+		for _, chunk := range chunks {
+			w.Write([]byte(chunk))
+			w.(http.Flusher).Flush()
+		}
+	}
+}
+
+// gzipMiddleware compresses responses, like a compression middleware outside the digest middleware would.
+func gzipMiddleware(next sf.Handle) sf.Handle {
+	return func(w sf.WrappedResponseWriter, r *http.Request, p sf.RouterParams) {
+		var body bytes.Buffer
+		recorder := &bufferingResponseWriter{header: w.Header(), body: &body}
+
+		next(sf.NewWrappedResponseWriter(recorder), r, p)
+
+		w.Header().Set("Content-Encoding", "gzip")
+		w.WriteHeader(recorder.status)
+		zw := gzip.NewWriter(w)
+		zw.Write(body.Bytes())
+		zw.Close()
+	}
+}
+
+type bufferingResponseWriter struct {
+	header http.Header
+	body   *bytes.Buffer
+	status int
+}
+
+func (b *bufferingResponseWriter) Header() http.Header         { return b.header }
+func (b *bufferingResponseWriter) Write(p []byte) (int, error) { return b.body.Write(p) }
+func (b *bufferingResponseWriter) WriteHeader(status int)      { b.status = status }
+
+func TestDigestMiddleware_BufferedResponse(t *testing.T) {
+	sut := newTestDigestMiddleware(sf.DigestOptions{}, &mockMetrics{})
+	r, _ := http.NewRequest(http.MethodGet, "/orders/1", nil)
+
+	// Act
+	w, _ := servicetest.RunMiddlewareWithHandler(sut, r, func(w sf.WrappedResponseWriter, _ *http.Request, _ sf.RouterParams) {
+		w.JSON(http.StatusCreated, map[string]int{"id": 1})
+	})
+
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, sf.DigestOf(w.Body.Bytes()), w.Header().Get(sf.ReprDigestHeader))
+	assert.True(t, strings.HasPrefix(w.Header().Get(sf.DigestHeader), "SHA-256="))
+}
+
+func TestDigestMiddleware_StreamedResponse(t *testing.T) {
+	tests := []struct {
+		te       string
+		trailers bool
+		expected bool
+	}{
+		{"trailers", true, true},
+		{"", true, false},
+		{"trailers", false, false},
+	}
+
+	for _, test := range tests {
+		sut := newTestDigestMiddleware(sf.DigestOptions{Trailers: test.trailers, MaxBufferSize: 4}, &mockMetrics{})
+		r, _ := http.NewRequest(http.MethodGet, "/events", nil)
+		r.Header.Set("TE", test.te)
+
+		// Act
+		w, _ := servicetest.RunMiddlewareWithHandler(sut, r, writeChunks("first,", "second,", "third"))
+
+		resp := w.Result()
+		ioutil.ReadAll(resp.Body)
+		assert.Equal(t, "first,second,third", w.Body.String())
+		assert.True(t, w.Flushed)
+		assert.Empty(t, resp.Header.Get(sf.ReprDigestHeader), "streamed responses have no digest header")
+		if test.expected {
+			assert.Equal(t, sf.DigestOf([]byte("first,second,third")), resp.Trailer.Get(sf.ReprDigestHeader))
+		} else {
+			assert.Empty(t, resp.Trailer.Get(sf.ReprDigestHeader), "TE %q with trailers %v", test.te, test.trailers)
+		}
+	}
+}
+
+func TestDigestMiddleware_ValidatesRequests(t *testing.T) {
+	body := `{"event":"order.paid"}`
+
+	tests := []struct {
+		name     string
+		validate bool
+		digest   string
+		expected int
+	}{
+		{"matching digest", true, sf.DigestOf([]byte(body)), http.StatusNoContent},
+		{"mismatching digest", true, sf.DigestOf([]byte("tampered")), http.StatusBadRequest},
+		{"other algorithm only", true, "sha-512=:AAAA:", http.StatusBadRequest},
+		{"no digest", true, "", http.StatusNoContent},
+		{"not opted in", false, sf.DigestOf([]byte("tampered")), http.StatusNoContent},
+	}
+
+	for _, test := range tests {
+		m := &mockMetrics{}
+		m.On("CountLabels", "digest", "request_mismatches_total", mock.Anything, []string{"route"}, []string{"webhook"})
+		sut := newTestDigestMiddleware(sf.DigestOptions{ValidateRequests: test.validate}, m)
+		r, _ := http.NewRequest(http.MethodPost, "/webhook", strings.NewReader(body))
+		if test.digest != "" {
+			r.Header.Set(sf.ContentDigestHeader, "md5=:AAAA:, "+test.digest)
+		}
+		var received string
+
+		// Act
+		w, _ := servicetest.RunMiddlewareWithHandler(sut, r, func(w sf.WrappedResponseWriter, r *http.Request, _ sf.RouterParams) {
+			b, _ := ioutil.ReadAll(r.Body)
+			received = string(b)
+			w.WriteHeader(http.StatusNoContent)
+		})
+
+		assert.Equal(t, test.expected, w.Code, test.name)
+		if test.expected == http.StatusBadRequest {
+			m.AssertNumberOfCalls(t, "CountLabels", 1)
+			assert.Equal(t, sf.ContentTypeProblemJSON, w.Header().Get(sf.ContentTypeHeader), test.name)
+		} else {
+			m.AssertNotCalled(t, "CountLabels", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+			assert.Equal(t, body, received, "the body is replayed for the handler: %s", test.name)
+		}
+	}
+}
+
+func TestDigestMiddleware_Compression(t *testing.T) {
+	digest := newTestDigestMiddleware(sf.DigestOptions{}, &mockMetrics{})
+	r, _ := http.NewRequest(http.MethodGet, "/orders/1", nil)
+
+	// Act
+	w, _ := servicetest.RunMiddlewareWithHandler(gzipMiddleware, r, digest(func(w sf.WrappedResponseWriter, _ *http.Request, _ sf.RouterParams) {
+		w.JSON(http.StatusOK, map[string]int{"id": 1})
+	}))
+
+	zr, err := gzip.NewReader(w.Body)
+	assert.NoError(t, err)
+	identity, _ := ioutil.ReadAll(zr)
+	assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, sf.DigestOf(identity), w.Header().Get(sf.ReprDigestHeader),
+		"the digest is of the identity representation")
+
+	// Act
+	w, _ = servicetest.RunMiddlewareWithHandler(digest, r, func(w sf.WrappedResponseWriter, _ *http.Request, _ sf.RouterParams) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write([]byte("already compressed"))
+	})
+
+	assert.Empty(t, w.Header().Get(sf.ReprDigestHeader), "encoded responses of the handler get no digest")
+}
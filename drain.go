@@ -0,0 +1,217 @@
+package servicefoundation
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The states of a Drainer.
+const (
+	DrainStateServing  = "serving"
+	DrainStateDraining = "draining"
+	DrainStateStopped  = "stopped"
+
+	// RetryAfterHeader is the name of the response header with the number of seconds after which to retry.
+	RetryAfterHeader = "Retry-After"
+
+	defaultDrainRefreshInterval = time.Second
+	// The z-score of the 95th percentile, for estimating the duration of requests from their baseline.
+	drainPercentileScore = 1.645
+)
+
+type (
+	// DrainOptions contains the settings of a Drainer. HardDeadline is the maximum duration of the drain, which caps
+	// the estimated completion. Snapshots are refreshed at most once per RefreshInterval.
+	DrainOptions struct {
+		HardDeadline    time.Duration
+		RefreshInterval time.Duration
+		Clock           Clock
+	}
+
+	// DrainSnapshot contains the progress of draining the in-flight requests during shutdown.
+	DrainSnapshot struct {
+		State                      string    `json:"state"`
+		DrainStartedAt             time.Time `json:"drainStartedAt"`
+		InFlightRequests           int       `json:"inFlightRequests"`
+		EstimatedCompletionSeconds float64   `json:"estimatedCompletionSeconds"`
+		RetryAfterSeconds          int       `json:"-"`
+	}
+
+	// Drainer keeps track of the in-flight requests per route, so their completion can be estimated while draining.
+	Drainer interface {
+		Middleware(route string) MiddlewareFunc
+		ReadinessMiddleware() MiddlewareFunc
+		BeginDrain()
+		Stopped()
+		Snapshot() DrainSnapshot
+	}
+
+	drainerImpl struct {
+		options     DrainOptions
+		baselines   LatencyBaselines
+		mutex       sync.Mutex
+		nextID      uint64
+		inFlight    map[uint64]inFlightRequest
+		state       string
+		startedAt   time.Time
+		snapshot    DrainSnapshot
+		refreshedAt time.Time
+	}
+
+	inFlightRequest struct {
+		route string
+		start time.Time
+	}
+)
+
+// NewDrainer creates and returns a new Drainer implementation. The completion of in-flight requests is estimated from
+// the latency baselines of their routes; without baselines, requests are expected to take until the hard deadline.
+func NewDrainer(options DrainOptions, baselines LatencyBaselines) Drainer {
+	if options.HardDeadline <= 0 {
+		options.HardDeadline = defaultCriticalDeadline
+	}
+	if options.RefreshInterval <= 0 {
+		options.RefreshInterval = defaultDrainRefreshInterval
+	}
+	if options.Clock == nil {
+		options.Clock = NewSystemClock()
+	}
+
+	return &drainerImpl{
+		options:   options,
+		baselines: baselines,
+		inFlight:  make(map[uint64]inFlightRequest),
+		state:     DrainStateServing,
+	}
+}
+
+/* Drainer implementation */
+
+// Middleware returns a MiddlewareFunc that tracks the in-flight requests of the route.
+func (d *drainerImpl) Middleware(route string) MiddlewareFunc {
+	return func(next Handle) Handle {
+		return func(w WrappedResponseWriter, r *http.Request, p RouterParams) {
+			d.mutex.Lock()
+			d.nextID++
+			id := d.nextID
+			d.inFlight[id] = inFlightRequest{route: route, start: d.options.Clock.Now()}
+			d.mutex.Unlock()
+
+			defer func() {
+				d.mutex.Lock()
+				delete(d.inFlight, id)
+				d.mutex.Unlock()
+			}()
+
+			next(w, r, p)
+		}
+	}
+}
+
+// ReadinessMiddleware returns a MiddlewareFunc for the readiness handler, which responds with 503, the drain snapshot
+// and a Retry-After header once draining has begun.
+func (d *drainerImpl) ReadinessMiddleware() MiddlewareFunc {
+	return func(next Handle) Handle {
+		return func(w WrappedResponseWriter, r *http.Request, p RouterParams) {
+			snapshot := d.Snapshot()
+
+			if snapshot.State == DrainStateServing {
+				next(w, r, p)
+				return
+			}
+
+			if snapshot.RetryAfterSeconds > 0 {
+				w.Header().Set(RetryAfterHeader, strconv.Itoa(snapshot.RetryAfterSeconds))
+			}
+			w.JSON(http.StatusServiceUnavailable, snapshot)
+		}
+	}
+}
+
+func (d *drainerImpl) BeginDrain() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.state != DrainStateServing {
+		return
+	}
+	d.state = DrainStateDraining
+	d.startedAt = d.options.Clock.Now()
+	d.refreshedAt = time.Time{}
+}
+
+// Stopped marks the drain as completed, after the public server has stopped.
+func (d *drainerImpl) Stopped() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.startedAt.IsZero() {
+		d.startedAt = d.options.Clock.Now()
+	}
+	d.state = DrainStateStopped
+	d.refreshedAt = time.Time{}
+}
+
+// Snapshot returns the drain progress, which is cached for the refresh interval to keep probes cheap.
+func (d *drainerImpl) Snapshot() DrainSnapshot {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	now := d.options.Clock.Now()
+	if !d.refreshedAt.IsZero() && now.Sub(d.refreshedAt) < d.options.RefreshInterval {
+		return d.snapshot
+	}
+
+	d.snapshot = d.takeSnapshot(now)
+	d.refreshedAt = now
+	return d.snapshot
+}
+
+func (d *drainerImpl) takeSnapshot(now time.Time) DrainSnapshot {
+	snapshot := DrainSnapshot{State: d.state, DrainStartedAt: d.startedAt}
+
+	if d.state != DrainStateDraining {
+		return snapshot
+	}
+
+	snapshot.InFlightRequests = len(d.inFlight)
+
+	deadline := d.startedAt.Add(d.options.HardDeadline).Sub(now)
+	if deadline < 0 {
+		deadline = 0
+	}
+
+	var baselines map[string]LatencyBaseline
+	if d.baselines != nil {
+		baselines = d.baselines.Baselines()
+	}
+
+	var estimate time.Duration
+	for _, request := range d.inFlight {
+		remaining := deadline
+
+		if baseline, ok := baselines[request.route]; ok && baseline.Samples > 0 {
+			expected := baseline.MeanMilliseconds + drainPercentileScore*baseline.StdDevMilliseconds
+			remaining = time.Duration(expected*float64(time.Millisecond)) - now.Sub(request.start)
+		}
+		if remaining > estimate {
+			estimate = remaining
+		}
+	}
+	if estimate > deadline {
+		estimate = deadline
+	}
+
+	snapshot.EstimatedCompletionSeconds = estimate.Seconds()
+	snapshot.RetryAfterSeconds = int(math.Ceil(estimate.Seconds()))
+	if max := int(deadline.Seconds()); snapshot.RetryAfterSeconds > max {
+		snapshot.RetryAfterSeconds = max
+	}
+	if snapshot.RetryAfterSeconds < 1 {
+		snapshot.RetryAfterSeconds = 1
+	}
+	return snapshot
+}
@@ -0,0 +1,265 @@
+package servicefoundation_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	sf "github.com/Prutswonder/go-servicefoundation"
+	"github.com/Prutswonder/go-servicefoundation/servicetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func newTestDrainer(clock sf.Clock) sf.Drainer {
+	baselines := sf.NewLatencyBaselines(sf.LatencyOptions{MinSamples: 1}, &mockLogger{}, &mockMetrics{})
+	baselines.Observe("search", 2*time.Second)
+	baselines.Observe("search", 2*time.Second)
+
+	return sf.NewDrainer(sf.DrainOptions{HardDeadline: 10 * time.Second, Clock: clock}, baselines)
+}
+
+// startRequest runs a request for the route that stays in-flight until the returned func is called.
+func startRequest(drainer sf.Drainer, route string) func() {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	done := make(chan struct{})
+	r, _ := http.NewRequest(http.MethodGet, "/"+route, nil)
+
+	go func() {
+		servicetest.RunMiddlewareWithHandler(drainer.Middleware(route), r,
+			func(sf.WrappedResponseWriter, *http.Request, sf.RouterParams) {
+				close(started)
+				<-release
+			})
+		close(done)
+	}()
+
+	<-started
+	return func() {
+		close(release)
+		<-done
+	}
+}
+
+func readiness(drainer sf.Drainer) (int, string, sf.DrainSnapshot) {
+	r, _ := http.NewRequest(http.MethodGet, "/service/readiness", nil)
+	w, _ := servicetest.RunMiddlewareWithHandler(drainer.ReadinessMiddleware(), r,
+		func(w sf.WrappedResponseWriter, _ *http.Request, _ sf.RouterParams) {
+			w.JSON(http.StatusOK, "ok")
+		})
+
+	var snapshot sf.DrainSnapshot
+	json.Unmarshal(w.Body.Bytes(), &snapshot)
+	return w.Code, w.Header().Get(sf.RetryAfterHeader), snapshot
+}
+
+func TestDrainer_ReadyWhileServing(t *testing.T) {
+	sut := newTestDrainer(servicetest.NewFakeClock(time.Now()))
+	defer startRequest(sut, "search")()
+
+	// Act
+	status, retryAfter, _ := readiness(sut)
+
+	assert.Equal(t, http.StatusOK, status)
+	assert.Empty(t, retryAfter)
+}
+
+func TestDrainer_EstimatesCompletion(t *testing.T) {
+	start := time.Date(2017, 6, 15, 10, 0, 0, 0, time.UTC)
+	clock := servicetest.NewFakeClock(start)
+	sut := newTestDrainer(clock)
+	finishSearch := startRequest(sut, "search")
+	sut.BeginDrain()
+	clock.Advance(500 * time.Millisecond)
+
+	// Act
+	status, retryAfter, snapshot := readiness(sut)
+
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.Equal(t, "2", retryAfter)
+	assert.Equal(t, sf.DrainStateDraining, snapshot.State)
+	assert.Equal(t, start, snapshot.DrainStartedAt)
+	assert.Equal(t, 1, snapshot.InFlightRequests)
+	assert.InDelta(t, 1.5, snapshot.EstimatedCompletionSeconds, 0.001)
+	finishSearch()
+}
+
+func TestDrainer_EstimateCappedAtHardDeadline(t *testing.T) {
+	clock := servicetest.NewFakeClock(time.Date(2017, 6, 15, 10, 0, 0, 0, time.UTC))
+	sut := newTestDrainer(clock)
+	defer startRequest(sut, "search")()
+	// Without a baseline, the request is expected to take until the hard deadline.
+	defer startRequest(sut, "export")()
+	sut.BeginDrain()
+	clock.Advance(500 * time.Millisecond)
+
+	// Act
+	_, retryAfter, snapshot := readiness(sut)
+
+	assert.Equal(t, "9", retryAfter)
+	assert.Equal(t, 2, snapshot.InFlightRequests)
+	assert.InDelta(t, 9.5, snapshot.EstimatedCompletionSeconds, 0.001)
+}
+
+func TestDrainer_SnapshotIsCached(t *testing.T) {
+	clock := servicetest.NewFakeClock(time.Date(2017, 6, 15, 10, 0, 0, 0, time.UTC))
+	sut := newTestDrainer(clock)
+	finishSearch := startRequest(sut, "search")
+	sut.BeginDrain()
+	first := sut.Snapshot()
+	finishSearch()
+	clock.Advance(999 * time.Millisecond)
+
+	// Act
+	cached := sut.Snapshot()
+	clock.Advance(time.Millisecond)
+	refreshed := sut.Snapshot()
+
+	assert.Equal(t, 1, first.InFlightRequests)
+	assert.Equal(t, first, cached)
+	assert.Equal(t, 0, refreshed.InFlightRequests)
+}
+
+func TestDrainer_TerminalStateAfterStop(t *testing.T) {
+	clock := servicetest.NewFakeClock(time.Date(2017, 6, 15, 10, 0, 0, 0, time.UTC))
+	sut := newTestDrainer(clock)
+	sut.BeginDrain()
+	readiness(sut)
+
+	// Act
+	sut.Stopped()
+	status, retryAfter, snapshot := readiness(sut)
+
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.Empty(t, retryAfter)
+	assert.Equal(t, sf.DrainStateStopped, snapshot.State)
+	assert.Equal(t, 0, snapshot.InFlightRequests)
+}
+
+func TestServiceImpl_ReadinessReportsDrain(t *testing.T) {
+	drainer := &mockDrainer{}
+	drainer.On("ReadinessMiddleware").Return(sf.MiddlewareFunc(func(next sf.Handle) sf.Handle { return next }))
+	drainer.On("Middleware", "search").Return(sf.MiddlewareFunc(func(next sf.Handle) sf.Handle { return next }))
+	opt := sf.NewServiceOptions("drain", []string{http.MethodGet}, nil)
+	opt.Drainer = drainer
+	sut := sf.NewCustomService(opt)
+
+	// Act
+	sut.AddRoute("search", []string{"/search"}, sf.MethodsForGet, sf.DefaultMiddlewares,
+		func(sf.WrappedResponseWriter, *http.Request, sf.RouterParams) {})
+	sut.Routes()
+
+	drainer.AssertNumberOfCalls(t, "ReadinessMiddleware", 2)
+	drainer.AssertCalled(t, "Middleware", "search")
+}
+
+func TestServiceImpl_GracefulShutdownDrainsInFlightRequests(t *testing.T) {
+	sut, operation := newShutdownService(sf.ShutdownModeGraceful, sf.NewDrainer(sf.DrainOptions{}, nil), make(chan int, 1),
+		&mockLogger{})
+	operation.Done()
+	started := make(chan struct{})
+	sut.AddRoute("slow", []string{"/slow"}, sf.MethodsForGet, sf.DefaultMiddlewares,
+		func(w sf.WrappedResponseWriter, _ *http.Request, _ sf.RouterParams) {
+			close(started)
+			time.Sleep(300 * time.Millisecond)
+			w.JSON(http.StatusOK, "done")
+		})
+	ctx, cancel := context.WithCancel(context.Background())
+	returned := make(chan error, 1)
+	go func() { returned <- sut.Run(ctx) }()
+	public := waitForAddr(t, sut, "public")
+	readiness := "http://" + waitForAddr(t, sut, "readiness").String() + "/service/readiness"
+	slow := make(chan *http.Response, 1)
+	go func() {
+		resp, err := http.Get("http://" + public.String() + "/slow")
+		assert.NoError(t, err)
+		slow <- resp
+	}()
+	<-started
+
+	// Act
+	cancel()
+
+	var readinessStatus int
+	for i := 0; i < 50 && readinessStatus != http.StatusServiceUnavailable; i++ {
+		if resp, err := http.Get(readiness); err == nil {
+			readinessStatus = resp.StatusCode
+			resp.Body.Close()
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	assert.Equal(t, http.StatusServiceUnavailable, readinessStatus, "the readiness fails while the public server drains")
+	if resp := <-slow; resp != nil {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, `"done"`, strings.TrimSpace(string(body)), "the in-flight request completed")
+	}
+	select {
+	case err := <-returned:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("graceful shutdown did not return")
+	}
+}
+
+func TestServiceImpl_GracefulShutdownWaitsForCriticalRequests(t *testing.T) {
+	log := &mockLogger{}
+	log.On("Debug", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	log.On("Info", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	log.On("Warn", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	log.On("Error", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	m := &mockMetrics{}
+	m.On("SetGaugeLabels", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+	opt := sf.NewServiceOptions("critical", []string{http.MethodGet}, nil)
+	opt.Logger = log
+	opt.Port, opt.ReadinessPort, opt.InternalPort = 0, 0, 0
+	opt.ShutdownMode = sf.ShutdownModeGraceful
+	opt.ServerTimeout = 50 * time.Millisecond
+	opt.CriticalSections = sf.NewCriticalSections(log, m, 0)
+	opt.CriticalDeadline = 5 * time.Second
+	opt.ForceExitFunc = func(int) {}
+	sut := sf.NewCustomService(opt)
+	started := make(chan struct{})
+	sut.AddRoute("payment", []string{"/payment"}, sf.MethodsForGet, sf.DefaultMiddlewares,
+		func(w sf.WrappedResponseWriter, r *http.Request, _ sf.RouterParams) {
+			operation, err := sf.CriticalSection(r.Context(), "payment")
+			assert.NoError(t, err)
+			defer operation.Done()
+			close(started)
+			time.Sleep(300 * time.Millisecond)
+			w.JSON(http.StatusOK, "paid")
+		})
+	ctx, cancel := context.WithCancel(context.Background())
+	returned := make(chan error, 1)
+	go func() { returned <- sut.Run(ctx) }()
+	public := waitForAddr(t, sut, "public")
+	payment := make(chan *http.Response, 1)
+	go func() {
+		resp, err := http.Get("http://" + public.String() + "/payment")
+		assert.NoError(t, err)
+		payment <- resp
+	}()
+	<-started
+
+	// Act
+	cancel()
+
+	if resp := <-payment; resp != nil {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, `"paid"`, strings.TrimSpace(string(body)), "the request in a critical section outlives the server timeout")
+	}
+	select {
+	case err := <-returned:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("graceful shutdown did not return")
+	}
+}
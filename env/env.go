@@ -2,7 +2,6 @@ package env
 
 import (
 	"fmt"
-	"os"
 	"strconv"
 	"strings"
 )
@@ -11,7 +10,7 @@ const listSeparator = ","
 
 // OrDefault returns the value of the environment variable (name). If empty, it returns defaultValue.
 func OrDefault(name, defaultValue string) string {
-	strValue := os.Getenv(name)
+	strValue := lookup(name)
 
 	if strValue == "" {
 		return defaultValue
@@ -21,22 +20,22 @@ func OrDefault(name, defaultValue string) string {
 
 // List returns the value of the environment variable (name) as a list.
 func List(name string) []string {
-	return strings.Split(os.Getenv(name), listSeparator)
+	return strings.Split(lookup(name), listSeparator)
 }
 
 // ListOrDefault returns the value of the environment variable (name) as a list. If not defined, returns a default.
 func ListOrDefault(name string, defaultList []string) []string {
-	value := os.Getenv(name)
+	value := lookup(name)
 
 	if value == "" {
 		return defaultList
 	}
-	return strings.Split(os.Getenv(name), listSeparator)
+	return strings.Split(lookup(name), listSeparator)
 }
 
 // AsInt returns the value of the environment variable (name) as an int. If empty, it returns defaultValue.
 func AsInt(name string, defaultValue int) int {
-	strValue := os.Getenv(name)
+	strValue := lookup(name)
 
 	if strValue == "" {
 		return defaultValue
@@ -0,0 +1,135 @@
+package env
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The types of the values of environment variables.
+const (
+	TypeString Type = "string"
+	TypeInt    Type = "int"
+	TypeBool   Type = "bool"
+	TypeList   Type = "list"
+)
+
+type (
+	// Type is the type of the value of an environment variable.
+	Type string
+
+	// Variable is a registered environment variable, of which the typed getters return the value or the default.
+	Variable struct {
+		Key          string
+		Type         Type
+		DefaultValue string
+		Description  string
+	}
+
+	// Spec describes a registered environment variable and whether it is set in the current environment. It never
+	// contains the value, which may be a secret.
+	Spec struct {
+		Key         string `json:"key"`
+		Type        Type   `json:"type"`
+		Default     string `json:"default,omitempty"`
+		Description string `json:"description"`
+		Set         bool   `json:"set"`
+	}
+)
+
+var (
+	registry      = make(map[string]*Variable)
+	registryMutex sync.RWMutex
+)
+
+// Register registers the environment variable, so it is part of the Registered specs, and returns it for reading its
+// value. Registering a key again replaces its type, default and description.
+func Register(key string, typ Type, defaultValue, description string) *Variable {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+
+	if v, ok := registry[key]; ok {
+		v.Type, v.DefaultValue, v.Description = typ, defaultValue, description
+		return v
+	}
+
+	v := &Variable{Key: key, Type: typ, DefaultValue: defaultValue, Description: description}
+	registry[key] = v
+	return v
+}
+
+// Registered returns the specs of all registered environment variables, sorted by key.
+func Registered() []Spec {
+	registryMutex.RLock()
+	defer registryMutex.RUnlock()
+
+	specs := make([]Spec, 0, len(registry))
+	for _, v := range registry {
+		specs = append(specs, Spec{
+			Key:         v.Key,
+			Type:        v.Type,
+			Default:     v.DefaultValue,
+			Description: v.Description,
+			Set:         v.IsSet(),
+		})
+	}
+	sort.Slice(specs, func(i, j int) bool {
+		return specs[i].Key < specs[j].Key
+	})
+	return specs
+}
+
+/* Variable implementation */
+
+// IsSet returns true if the environment variable has a non-empty value.
+func (v *Variable) IsSet() bool {
+	return lookup(v.Key) != ""
+}
+
+// String returns the value of the environment variable. If empty, it returns the default.
+func (v *Variable) String() string {
+	return OrDefault(v.Key, v.DefaultValue)
+}
+
+// OrDefault returns the value of the environment variable. If empty, it returns defaultValue instead of the registered
+// default, which is meant for defaults that are only known at runtime.
+func (v *Variable) OrDefault(defaultValue string) string {
+	return OrDefault(v.Key, defaultValue)
+}
+
+// Int returns the value of the environment variable as an int. If empty, it returns the default.
+func (v *Variable) Int() int {
+	value := v.String()
+	if value == "" {
+		return 0
+	}
+
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		panic(fmt.Errorf("Failed parsing %s [%s]: %v", v.Key, value, err))
+	}
+	return i
+}
+
+// Bool returns the value of the environment variable as a bool. If empty or invalid, it returns false.
+func (v *Variable) Bool() bool {
+	value, _ := strconv.ParseBool(v.String())
+	return value
+}
+
+// List returns the value of the environment variable as a list. If empty, it returns the default as a list.
+func (v *Variable) List() []string {
+	value := v.String()
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, listSeparator)
+}
+
+// lookup is the only place where environment variables are read.
+func lookup(name string) string {
+	return os.Getenv(name)
+}
@@ -0,0 +1,76 @@
+package env_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/Prutswonder/go-servicefoundation/env"
+	"github.com/stretchr/testify/assert"
+)
+
+func specOf(key string) (env.Spec, bool) {
+	for _, spec := range env.Registered() {
+		if spec.Key == key {
+			return spec, true
+		}
+	}
+	return env.Spec{}, false
+}
+
+func TestRegister_Getters(t *testing.T) {
+	tests := []struct {
+		key      string
+		typ      env.Type
+		def      string
+		value    string
+		expected interface{}
+		get      func(v *env.Variable) interface{}
+	}{
+		{"RegisterString", env.TypeString, "a", "b", "b", func(v *env.Variable) interface{} { return v.String() }},
+		{"RegisterStringDefault", env.TypeString, "a", "", "a", func(v *env.Variable) interface{} { return v.String() }},
+		{"RegisterInt", env.TypeInt, "1", "2", 2, func(v *env.Variable) interface{} { return v.Int() }},
+		{"RegisterIntDefault", env.TypeInt, "1", "", 1, func(v *env.Variable) interface{} { return v.Int() }},
+		{"RegisterBool", env.TypeBool, "false", "true", true, func(v *env.Variable) interface{} { return v.Bool() }},
+		{"RegisterList", env.TypeList, "a", "b,c", []string{"b", "c"}, func(v *env.Variable) interface{} { return v.List() }},
+		{"RegisterListDefault", env.TypeList, "a", "", []string{"a"}, func(v *env.Variable) interface{} { return v.List() }},
+	}
+
+	for _, test := range tests {
+		os.Setenv(test.key, test.value)
+
+		// Act
+		sut := env.Register(test.key, test.typ, test.def, "Test variable")
+
+		assert.Equal(t, test.expected, test.get(sut), test.key)
+		os.Unsetenv(test.key)
+	}
+}
+
+func TestRegistered_SetDetection(t *testing.T) {
+	env.Register("RegisteredSet", env.TypeString, "", "Set variable")
+	env.Register("RegisteredUnset", env.TypeInt, "5", "Unset variable")
+	os.Setenv("RegisteredSet", "secret")
+	defer os.Unsetenv("RegisteredSet")
+
+	// Act
+	set, okSet := specOf("RegisteredSet")
+	unset, okUnset := specOf("RegisteredUnset")
+
+	assert.True(t, okSet)
+	assert.True(t, okUnset)
+	assert.Equal(t, env.Spec{Key: "RegisteredSet", Type: env.TypeString, Description: "Set variable", Set: true}, set,
+		"the spec never contains the value")
+	assert.Equal(t, env.Spec{Key: "RegisteredUnset", Type: env.TypeInt, Default: "5", Description: "Unset variable"}, unset)
+}
+
+func TestRegister_Again(t *testing.T) {
+	first := env.Register("RegisterAgain", env.TypeString, "a", "First")
+
+	// Act
+	second := env.Register("RegisterAgain", env.TypeString, "b", "Second")
+
+	spec, _ := specOf("RegisterAgain")
+	assert.True(t, first == second)
+	assert.Equal(t, "Second", spec.Description)
+	assert.Equal(t, "b", first.String())
+}
@@ -0,0 +1,321 @@
+package servicefoundation
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Prutswonder/go-servicefoundation/events"
+)
+
+// The severities of reported errors.
+const (
+	SeverityWarning Severity = "warning"
+	SeverityError   Severity = "error"
+	SeverityFatal   Severity = "fatal"
+
+	errorReportingSubsystem = "errorreporting"
+	redactedHeaderValue     = "[REDACTED]"
+
+	defaultErrorQueueSize         = 100
+	defaultErrorFingerprintLimit  = 5
+	defaultErrorFingerprintWindow = time.Minute
+	maxErrorFingerprints          = 10000
+)
+
+var defaultRedactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", "X-Api-Key"}
+
+type (
+	// Severity is the severity of a reported error.
+	Severity string
+
+	// RequestSummary contains the request in which an error occurred, with sensitive headers redacted.
+	RequestSummary struct {
+		Method  string            `json:"method"`
+		Path    string            `json:"path"`
+		Headers map[string]string `json:"headers"`
+	}
+
+	// ReportedError contains an error or recovered panic with the context in which it occurred. Route is set for
+	// errors in request handlers and Task for errors in background tasks.
+	ReportedError struct {
+		Err           error           `json:"-"`
+		Value         interface{}     `json:"-"`
+		Message       string          `json:"message"`
+		Panic         bool            `json:"panic"`
+		Stack         string          `json:"stack,omitempty"`
+		Route         string          `json:"route,omitempty"`
+		Task          string          `json:"task,omitempty"`
+		CorrelationID string          `json:"correlationId,omitempty"`
+		Request       *RequestSummary `json:"request,omitempty"`
+		Globals       ServiceGlobals  `json:"globals"`
+		Severity      Severity        `json:"severity"`
+		Fingerprint   string          `json:"fingerprint"`
+		Timestamp     time.Time       `json:"timestamp"`
+	}
+
+	// ErrorReporter ships reported errors to an error tracker.
+	ErrorReporter interface {
+		Report(ctx context.Context, reported ReportedError) error
+	}
+
+	// ErrorReportingOptions contains the settings for reporting errors asynchronously. Reports are queued up to
+	// QueueSize and a SampleRate between 0 and 1 of them is sent. Of every fingerprint, at most FingerprintLimit
+	// reports are sent per FingerprintWindow. RedactHeaders are redacted from request summaries, in addition to the
+	// headers that carry credentials.
+	ErrorReportingOptions struct {
+		QueueSize         int
+		SampleRate        float64
+		FingerprintLimit  int
+		FingerprintWindow time.Duration
+		RedactHeaders     []string
+	}
+
+	noopErrorReporter struct{}
+
+	webhookErrorReporter struct {
+		url    string
+		client *http.Client
+	}
+
+	asyncErrorReporter struct {
+		reporter     ErrorReporter
+		options      ErrorReportingOptions
+		globals      ServiceGlobals
+		log          Logger
+		metrics      Metrics
+		queue        chan queuedError
+		redact       map[string]bool
+		mutex        sync.Mutex
+		fingerprints map[string]*fingerprintWindow
+	}
+
+	// queuedError keeps the baggage of the reporting request, because the error is reported after the request.
+	queuedError struct {
+		reported ReportedError
+		baggage  *baggageSet
+	}
+
+	fingerprintWindow struct {
+		start time.Time
+		count int
+	}
+
+	errorReporterContextKey struct{}
+)
+
+// NewNoopErrorReporter returns an ErrorReporter that discards all errors.
+func NewNoopErrorReporter() ErrorReporter {
+	return &noopErrorReporter{}
+}
+
+// NewWebhookErrorReporter returns an ErrorReporter that posts every error as JSON to the URL, with the baggage of the
+// context.
+func NewWebhookErrorReporter(url string, client *http.Client) ErrorReporter {
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	return &webhookErrorReporter{url: url, client: client}
+}
+
+// NewAsyncErrorReporter returns an ErrorReporter that adds the service globals, redacts the request summary and
+// queues the error for the given reporter, so a slow reporter can't delay the caller. Errors that don't fit in the
+// queue, aren't sampled or exceed the limit of their fingerprint are dropped and counted.
+func NewAsyncErrorReporter(reporter ErrorReporter, options ErrorReportingOptions, globals ServiceGlobals, log Logger, metrics Metrics) ErrorReporter {
+	if options.QueueSize <= 0 {
+		options.QueueSize = defaultErrorQueueSize
+	}
+	if options.SampleRate <= 0 || options.SampleRate > 1 {
+		options.SampleRate = 1
+	}
+	if options.FingerprintLimit <= 0 {
+		options.FingerprintLimit = defaultErrorFingerprintLimit
+	}
+	if options.FingerprintWindow <= 0 {
+		options.FingerprintWindow = defaultErrorFingerprintWindow
+	}
+
+	redact := make(map[string]bool)
+	for _, header := range append(defaultRedactedHeaders, options.RedactHeaders...) {
+		redact[http.CanonicalHeaderKey(header)] = true
+	}
+
+	a := &asyncErrorReporter{
+		reporter:     reporter,
+		options:      options,
+		globals:      globals,
+		log:          log,
+		metrics:      metrics,
+		queue:        make(chan queuedError, options.QueueSize),
+		redact:       redact,
+		fingerprints: make(map[string]*fingerprintWindow),
+	}
+	go a.run()
+	return a
+}
+
+// NewRequestSummary returns the summary of the request for a ReportedError.
+func NewRequestSummary(r *http.Request) *RequestSummary {
+	headers := make(map[string]string, len(r.Header))
+	for name, values := range r.Header {
+		headers[name] = strings.Join(values, ", ")
+	}
+
+	return &RequestSummary{Method: r.Method, Path: r.URL.Path, Headers: headers}
+}
+
+// WithErrorReporter returns a copy of the context that carries the ErrorReporter.
+func WithErrorReporter(ctx context.Context, reporter ErrorReporter) context.Context {
+	return context.WithValue(ctx, errorReporterContextKey{}, reporter)
+}
+
+// ErrorReporterFromContext returns the ErrorReporter carried by the context, or nil if there is none.
+func ErrorReporterFromContext(ctx context.Context) ErrorReporter {
+	reporter, _ := ctx.Value(errorReporterContextKey{}).(ErrorReporter)
+	return reporter
+}
+
+// ReportError reports the error through the ErrorReporter carried by the context. Without one, the error is ignored.
+func ReportError(ctx context.Context, reported ReportedError) {
+	if reporter := ErrorReporterFromContext(ctx); reporter != nil {
+		reporter.Report(ctx, reported)
+	}
+}
+
+/* ErrorReporter implementations */
+
+func (r *noopErrorReporter) Report(context.Context, ReportedError) error {
+	return nil
+}
+
+func (r *webhookErrorReporter) Report(ctx context.Context, reported ReportedError) error {
+	body, err := json.Marshal(reported)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, r.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set(ContentTypeHeader, ContentTypeJSON)
+	setBaggageHeader(ctx, req.Header)
+
+	resp, err := r.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("Error webhook responded with %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Report queues the error and returns immediately. It only returns an error when the error is dropped.
+func (a *asyncErrorReporter) Report(ctx context.Context, reported ReportedError) error {
+	if reported.Message == "" {
+		switch {
+		case reported.Err != nil:
+			reported.Message = reported.Err.Error()
+		case reported.Value != nil:
+			reported.Message = fmt.Sprint(reported.Value)
+		}
+	}
+	if reported.Timestamp.IsZero() {
+		reported.Timestamp = time.Now().UTC()
+	}
+	if reported.Fingerprint == "" {
+		reported.Fingerprint = fingerprint(reported)
+	}
+	reported.Globals = a.globals
+
+	if reported.Request != nil {
+		reported.Request = a.redacted(reported.Request)
+	}
+
+	if rand.Float64() >= a.options.SampleRate {
+		return a.drop("sampled")
+	}
+	if !a.allow(reported.Fingerprint, reported.Timestamp) {
+		return a.drop("rate_limited")
+	}
+
+	select {
+	case a.queue <- queuedError{reported: reported, baggage: baggageOf(ctx)}:
+		return nil
+	default:
+		return a.drop("queue_full")
+	}
+}
+
+func (a *asyncErrorReporter) run() {
+	for queued := range a.queue {
+		// The queue decouples the reporter from the request, so it gets a context of its own.
+		ctx := withBaggageOf(context.Background(), queued.baggage)
+		if err := a.reporter.Report(ctx, queued.reported); err != nil {
+			a.log.Warn(events.ErrorReporting, "Failed reporting error %s: %v", queued.reported.Fingerprint, err)
+		}
+	}
+}
+
+func (a *asyncErrorReporter) drop(reason string) error {
+	a.metrics.CountLabels(errorReportingSubsystem, "dropped_total", "Total error reports that were not sent.",
+		[]string{"reason"}, []string{reason})
+	return fmt.Errorf("Error report dropped: %s", reason)
+}
+
+// allow returns true when the fingerprint is below its limit in the current window.
+func (a *asyncErrorReporter) allow(fingerprint string, now time.Time) bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	window, ok := a.fingerprints[fingerprint]
+	if !ok || now.Sub(window.start) >= a.options.FingerprintWindow {
+		if !ok && len(a.fingerprints) >= maxErrorFingerprints {
+			a.pruneFingerprints(now)
+		}
+		window = &fingerprintWindow{start: now}
+		a.fingerprints[fingerprint] = window
+	}
+
+	window.count++
+	return window.count <= a.options.FingerprintLimit
+}
+
+func (a *asyncErrorReporter) pruneFingerprints(now time.Time) {
+	for fingerprint, window := range a.fingerprints {
+		if now.Sub(window.start) >= a.options.FingerprintWindow {
+			delete(a.fingerprints, fingerprint)
+		}
+	}
+}
+
+func (a *asyncErrorReporter) redacted(request *RequestSummary) *RequestSummary {
+	headers := make(map[string]string, len(request.Headers))
+	for name, value := range request.Headers {
+		if a.redact[http.CanonicalHeaderKey(name)] {
+			value = redactedHeaderValue
+		}
+		headers[name] = value
+	}
+
+	return &RequestSummary{Method: request.Method, Path: request.Path, Headers: headers}
+}
+
+// fingerprint identifies errors that are the same, by where they occurred and their message. The stack is left out,
+// because its goroutine IDs and arguments differ between occurrences.
+func fingerprint(reported ReportedError) string {
+	h := sha1.New()
+	fmt.Fprintf(h, "%s|%s|%t|%s", reported.Route, reported.Task, reported.Panic, reported.Message)
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
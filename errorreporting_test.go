@@ -0,0 +1,268 @@
+package servicefoundation_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	sf "github.com/Prutswonder/go-servicefoundation"
+	"github.com/Prutswonder/go-servicefoundation/servicetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+type capturingReporter struct {
+	reports chan sf.ReportedError
+	block   chan struct{}
+}
+
+func newCapturingReporter() *capturingReporter {
+	return &capturingReporter{reports: make(chan sf.ReportedError, 100)}
+}
+
+func (c *capturingReporter) Report(_ context.Context, reported sf.ReportedError) error {
+	c.reports <- reported
+	if c.block != nil {
+		<-c.block
+	}
+	return nil
+}
+
+func (c *capturingReporter) next(t *testing.T) sf.ReportedError {
+	select {
+	case reported := <-c.reports:
+		return reported
+	case <-time.After(time.Second):
+		t.Fatal("Expected an error report")
+	}
+	return sf.ReportedError{}
+}
+
+func newReportingMetrics() *mockMetrics {
+	m := &mockMetrics{}
+	m.On("CountLabels", "errorreporting", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+	return m
+}
+
+func TestAsyncErrorReporter_RedactsAndAddsGlobals(t *testing.T) {
+	capture := newCapturingReporter()
+	globals := sf.ServiceGlobals{AppName: "checkout", DeployEnvironment: "test"}
+	sut := sf.NewAsyncErrorReporter(capture, sf.ErrorReportingOptions{RedactHeaders: []string{"x-session"}}, globals,
+		&mockLogger{}, newReportingMetrics())
+	r, _ := http.NewRequest(http.MethodPost, "/orders?card=4111", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	r.Header.Set("Cookie", "session=secret")
+	r.Header.Set("X-Session", "secret")
+	r.Header.Set("Accept", "application/json")
+
+	// Act
+	err := sut.Report(context.Background(), sf.ReportedError{
+		Err:      errors.New("boom"),
+		Route:    "orders",
+		Request:  sf.NewRequestSummary(r),
+		Severity: sf.SeverityError,
+	})
+
+	assert.NoError(t, err)
+	reported := capture.next(t)
+	assert.Equal(t, "boom", reported.Message)
+	assert.Equal(t, globals, reported.Globals)
+	assert.NotEmpty(t, reported.Fingerprint)
+	assert.Equal(t, "/orders", reported.Request.Path)
+	assert.Equal(t, "[REDACTED]", reported.Request.Headers["Authorization"])
+	assert.Equal(t, "[REDACTED]", reported.Request.Headers["Cookie"])
+	assert.Equal(t, "[REDACTED]", reported.Request.Headers["X-Session"])
+	assert.Equal(t, "application/json", reported.Request.Headers["Accept"])
+}
+
+func TestAsyncErrorReporter_DropsOnQueueOverflow(t *testing.T) {
+	capture := newCapturingReporter()
+	capture.block = make(chan struct{})
+	defer close(capture.block)
+	m := newReportingMetrics()
+	sut := sf.NewAsyncErrorReporter(capture, sf.ErrorReportingOptions{QueueSize: 1}, sf.ServiceGlobals{},
+		&mockLogger{}, m)
+
+	sut.Report(context.Background(), sf.ReportedError{Message: "first"})
+	capture.next(t)
+
+	// Act
+	queued := sut.Report(context.Background(), sf.ReportedError{Message: "second"})
+	dropped := sut.Report(context.Background(), sf.ReportedError{Message: "third"})
+
+	assert.NoError(t, queued)
+	assert.Error(t, dropped)
+	m.AssertCalled(t, "CountLabels", "errorreporting", "dropped_total", mock.Anything, []string{"reason"},
+		[]string{"queue_full"})
+}
+
+func TestAsyncErrorReporter_RateLimitsFingerprints(t *testing.T) {
+	m := newReportingMetrics()
+	sut := sf.NewAsyncErrorReporter(newCapturingReporter(), sf.ErrorReportingOptions{FingerprintLimit: 2},
+		sf.ServiceGlobals{}, &mockLogger{}, m)
+	panicked := sf.ReportedError{Message: "nil pointer", Panic: true, Route: "orders"}
+
+	// Act
+	first := sut.Report(context.Background(), panicked)
+	second := sut.Report(context.Background(), panicked)
+	third := sut.Report(context.Background(), panicked)
+	other := sut.Report(context.Background(), sf.ReportedError{Message: "nil pointer", Panic: true, Route: "search"})
+
+	assert.NoError(t, first)
+	assert.NoError(t, second)
+	assert.Error(t, third)
+	assert.NoError(t, other)
+	m.AssertCalled(t, "CountLabels", "errorreporting", "dropped_total", mock.Anything, []string{"reason"},
+		[]string{"rate_limited"})
+}
+
+func TestAsyncErrorReporter_Sampling(t *testing.T) {
+	m := newReportingMetrics()
+	sut := sf.NewAsyncErrorReporter(newCapturingReporter(), sf.ErrorReportingOptions{SampleRate: 1e-12},
+		sf.ServiceGlobals{}, &mockLogger{}, m)
+
+	// Act
+	err := sut.Report(context.Background(), sf.ReportedError{Message: "boom"})
+
+	assert.Error(t, err)
+	m.AssertCalled(t, "CountLabels", "errorreporting", "dropped_total", mock.Anything, []string{"reason"},
+		[]string{"sampled"})
+}
+
+func TestWebhookErrorReporter(t *testing.T) {
+	var received map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&received)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+	sut := sf.NewWebhookErrorReporter(server.URL, nil)
+
+	// Act
+	err := sut.Report(context.Background(), sf.ReportedError{Message: "boom", Route: "orders", Severity: sf.SeverityFatal})
+
+	assert.NoError(t, err)
+	assert.Equal(t, "boom", received["message"])
+	assert.Equal(t, "orders", received["route"])
+	assert.Equal(t, "fatal", received["severity"])
+}
+
+func newReportingService(capture *capturingReporter) sf.Service {
+	opt := sf.NewServiceOptions("errors", []string{http.MethodGet}, nil)
+	opt.ErrorReporter = capture
+	opt.SetHandlers()
+	return sf.NewCustomService(opt)
+}
+
+func TestServiceImpl_ReportsPanics(t *testing.T) {
+	capture := newCapturingReporter()
+	sut := newReportingService(capture)
+	sut.AddRoute("explode", []string{"/explode"}, sf.MethodsForGet, sf.DefaultMiddlewares,
+		func(sf.WrappedResponseWriter, *http.Request, sf.RouterParams) {
+			panic("kaboom")
+		})
+	r := httptest.NewRequest(http.MethodGet, "/explode", nil)
+	r.Header.Set("X-Request-Id", "abc")
+	w := httptest.NewRecorder()
+
+	// Act
+	sut.Handler("public").ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	reported := capture.next(t)
+	assert.True(t, reported.Panic)
+	assert.Equal(t, "kaboom", reported.Message)
+	assert.Equal(t, "explode", reported.Route)
+	assert.Equal(t, "abc", reported.CorrelationID)
+	assert.Equal(t, sf.SeverityFatal, reported.Severity)
+	assert.Contains(t, reported.Stack, "errorreporting_test.go")
+}
+
+func TestServiceImpl_Reports5xxResponses(t *testing.T) {
+	capture := newCapturingReporter()
+	sut := newReportingService(capture)
+	sut.AddRoute("unavailable", []string{"/unavailable"}, sf.MethodsForGet, sf.DefaultMiddlewares,
+		func(w sf.WrappedResponseWriter, _ *http.Request, _ sf.RouterParams) {
+			sf.WriteProblem(w, http.StatusBadGateway, "upstream failed")
+		})
+
+	// Act
+	sut.Handler("public").ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/unavailable", nil))
+
+	reported := capture.next(t)
+	assert.False(t, reported.Panic)
+	assert.Equal(t, "unavailable responded with 502", reported.Message)
+	assert.Equal(t, sf.SeverityError, reported.Severity)
+}
+
+func TestTaskQueue_ReportsFailures(t *testing.T) {
+	path, cleanup := newTaskQueuePath(t)
+	defer cleanup()
+	sut, _, _ := newTestTaskQueue(t, path)
+	capture := newCapturingReporter()
+	ctx, cancel := context.WithCancel(sf.WithErrorReporter(context.Background(), capture))
+	defer cancel()
+
+	sut.Subscribe("invoice", 1, func(_ context.Context, task sf.Task) error {
+		if string(task.Payload) == "panic" {
+			panic("bad invoice")
+		}
+		return errors.New("declined")
+	})
+	sut.Enqueue(ctx, sf.Task{Type: "invoice", Payload: []byte("panic")})
+
+	// Act
+	sut.Start(ctx)
+
+	reported := capture.next(t)
+	assert.True(t, reported.Panic)
+	assert.Equal(t, "invoice", reported.Task)
+	assert.NotEmpty(t, reported.Stack)
+
+	sut.Enqueue(ctx, sf.Task{Type: "invoice", Payload: []byte("error")})
+	for reported = capture.next(t); reported.Panic; reported = capture.next(t) {
+		// Skip the retry of the panicking task.
+	}
+	assert.Equal(t, "declined", reported.Err.Error())
+	cancel()
+	sut.Stop()
+}
+
+func TestScheduler_ReportsFailures(t *testing.T) {
+	sut, _ := newTestScheduler(sf.NewSystemClock(), "")
+	capture := newCapturingReporter()
+	ctx, cancel := context.WithCancel(sf.WithErrorReporter(context.Background(), capture))
+	defer cancel()
+	sut.AddCronTask("cleanup", "0 0 1 1 *", func(context.Context) error { return errors.New("disk full") },
+		sf.TaskOptions{})
+	sut.Start(ctx)
+
+	// Act
+	sut.Trigger("cleanup")
+
+	reported := capture.next(t)
+	assert.Equal(t, "cleanup", reported.Task)
+	assert.Equal(t, "disk full", reported.Err.Error())
+}
+
+func TestServiceImpl_ReportsShutdownErrors(t *testing.T) {
+	t.Parallel()
+	capture := newCapturingReporter()
+	queue := &mockTaskQueue{}
+	queue.On("Start", mock.Anything)
+	queue.On("Stop").Return(errors.New("checkpoint failed"))
+	opt := sf.NewServiceOptions("errors", []string{http.MethodGet}, nil)
+	opt.ErrorReporter = capture
+	opt.TaskQueue = queue
+	sut := servicetest.StartService(t, opt, nil)
+
+	// Act
+	sut.Stop()
+
+	reported := capture.next(t)
+	assert.Equal(t, "Failed stopping task queue: checkpoint failed", reported.Message)
+}
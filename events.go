@@ -0,0 +1,187 @@
+package servicefoundation
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Prutswonder/go-servicefoundation/events"
+)
+
+type (
+	// EventInfo describes a registered event and the number of times it was logged since startup.
+	EventInfo struct {
+		events.Definition
+		Count uint64 `json:"count"`
+	}
+
+	// EventRegistry contains the definitions of the events that are logged by the service. Applications register their
+	// own events, so they are validated and listed like the events of ServiceFoundation.
+	EventRegistry interface {
+		Register(definitions ...events.Definition)
+		// Observe counts the event and returns whether it is registered and expected at the level.
+		Observe(event string, level events.Level) (registered, expected bool)
+		Events() []EventInfo
+	}
+
+	eventRegistryImpl struct {
+		mutex    sync.RWMutex
+		byName   map[string]*registeredEvent
+		prefixes []*registeredEvent
+	}
+
+	registeredEvent struct {
+		definition events.Definition
+		count      uint64
+	}
+
+	eventLoggerImpl struct {
+		Logger
+		registry EventRegistry
+		validate bool
+		warned   *sync.Map
+	}
+)
+
+// NewEventRegistry instantiates a new EventRegistry implementation with the given definitions.
+func NewEventRegistry(definitions ...events.Definition) EventRegistry {
+	r := &eventRegistryImpl{byName: make(map[string]*registeredEvent)}
+	r.Register(definitions...)
+	return r
+}
+
+// NewEventLogger returns a Logger that counts the events in the registry. When validate is true, which is meant for
+// non-production environments, it warns once per event when an unregistered event is logged or an event is logged at
+// an unexpected level.
+func NewEventLogger(log Logger, registry EventRegistry, validate bool) Logger {
+	return &eventLoggerImpl{
+		Logger:   log,
+		registry: registry,
+		validate: validate,
+		warned:   &sync.Map{},
+	}
+}
+
+// NewEventsHandler returns a handler that lists the registered events with their observed counts.
+func NewEventsHandler(registry EventRegistry) Handle {
+	return func(w WrappedResponseWriter, _ *http.Request, _ RouterParams) {
+		w.JSON(http.StatusOK, registry.Events())
+	}
+}
+
+/* EventRegistry implementation */
+
+// Register adds the definitions to the registry. A definition replaces an earlier one with the same name, but keeps
+// its count.
+func (r *eventRegistryImpl) Register(definitions ...events.Definition) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, definition := range definitions {
+		if event, ok := r.byName[definition.Name]; ok {
+			event.definition = definition
+			continue
+		}
+
+		event := &registeredEvent{definition: definition}
+		r.byName[definition.Name] = event
+		if strings.HasSuffix(definition.Name, "*") {
+			r.prefixes = append(r.prefixes, event)
+		}
+	}
+}
+
+func (r *eventRegistryImpl) Observe(name string, level events.Level) (bool, bool) {
+	event := r.lookup(name)
+	if event == nil {
+		return false, false
+	}
+
+	atomic.AddUint64(&event.count, 1)
+	return true, event.definition.Allows(level)
+}
+
+func (r *eventRegistryImpl) Events() []EventInfo {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	infos := make([]EventInfo, 0, len(r.byName))
+	for _, event := range r.byName {
+		infos = append(infos, EventInfo{
+			Definition: event.definition,
+			Count:      atomic.LoadUint64(&event.count),
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+	return infos
+}
+
+func (r *eventRegistryImpl) lookup(name string) *registeredEvent {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	if event, ok := r.byName[name]; ok {
+		return event
+	}
+	for _, event := range r.prefixes {
+		if event.definition.Matches(name) {
+			return event
+		}
+	}
+	return nil
+}
+
+/* Logger implementation */
+
+func (l *eventLoggerImpl) Debug(event, formatOrMsg string, a ...interface{}) error {
+	l.observe(event, events.Debug)
+	return l.Logger.Debug(event, formatOrMsg, a...)
+}
+
+func (l *eventLoggerImpl) Info(event, formatOrMsg string, a ...interface{}) error {
+	l.observe(event, events.Info)
+	return l.Logger.Info(event, formatOrMsg, a...)
+}
+
+func (l *eventLoggerImpl) Warn(event, formatOrMsg string, a ...interface{}) error {
+	l.observe(event, events.Warn)
+	return l.Logger.Warn(event, formatOrMsg, a...)
+}
+
+func (l *eventLoggerImpl) Error(event, formatOrMsg string, a ...interface{}) error {
+	l.observe(event, events.Error)
+	return l.Logger.Error(event, formatOrMsg, a...)
+}
+
+// WithFields returns an event logger for the logger with the fields, which shares the registry and warnings.
+func (l *eventLoggerImpl) WithFields(fields map[string]interface{}) Logger {
+	return &eventLoggerImpl{
+		Logger:   WithFields(l.Logger, fields),
+		registry: l.registry,
+		validate: l.validate,
+		warned:   l.warned,
+	}
+}
+
+func (l *eventLoggerImpl) observe(event string, level events.Level) {
+	registered, expected := l.registry.Observe(event, level)
+	if !l.validate || expected {
+		return
+	}
+
+	if !registered {
+		if _, warned := l.warned.LoadOrStore(event, true); !warned {
+			l.registry.Observe(events.UnregisteredEvent, events.Warn)
+			l.Logger.Warn(events.UnregisteredEvent, "Event %s is not registered", event)
+		}
+		return
+	}
+	if _, warned := l.warned.LoadOrStore(event+"/"+string(level), true); !warned {
+		l.registry.Observe(events.UnexpectedEventLevel, events.Warn)
+		l.Logger.Warn(events.UnexpectedEventLevel, "Event %s is not expected at level %s", event, level)
+	}
+}
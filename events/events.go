@@ -0,0 +1,193 @@
+package events
+
+import "strings"
+
+// The levels at which events are logged, which match the level names of the log entries.
+const (
+	Debug Level = "debug"
+	Info  Level = "info"
+	Warn  Level = "warning"
+	Error Level = "error"
+)
+
+// The events that are logged by ServiceFoundation.
+const (
+	APIKeyReload               Name = "APIKeyReload"
+	APIKeyUnauthorized         Name = "APIKeyUnauthorized"
+	AnomalousLatency           Name = "AnomalousLatency"
+	Baggage                    Name = "Baggage"
+	BufferDoubleRelease        Name = "BufferDoubleRelease"
+	CachePolicyOverride        Name = "CachePolicyOverride"
+	ContentDigestMismatch      Name = "ContentDigestMismatch"
+	CriticalSectionsAbandoned  Name = "CriticalSectionsAbandoned"
+	CriticalSectionsPending    Name = "CriticalSectionsPending"
+	DeduplicationKey           Name = "DeduplicationKey"
+	DeduplicationStore         Name = "DeduplicationStore"
+	ErrorReporting             Name = "ErrorReporting"
+	FastShutdown               Name = "FastShutdown"
+	ForcedShutdown             Name = "ForcedShutdown"
+	GracefulShutdown           Name = "GracefulShutdown"
+	HealthCheck                Name = "HealthCheck"
+	InternalAuthUnauthorized   Name = "InternalAuthUnauthorized"
+	LazyResource               Name = "LazyResource"
+	ListenFailed               Name = "ListenFailed"
+	LogFormat                  Name = "LogFormat"
+	LogMinLevel                Name = "LogMinLevel"
+	LogSinks                   Name = "LogSinks"
+	MetricsBuckets             Name = "MetricsBuckets"
+	MetricsGauge               Name = "MetricsGauge"
+	MetricsHistogram           Name = "MetricsHistogram"
+	MetricsPush                Name = "MetricsPush"
+	MetricsPushOptions         Name = "MetricsPushOptions"
+	OIDCDiscovery              Name = "OIDCDiscovery"
+	OIDCFailOpen               Name = "OIDCFailOpen"
+	OIDCKey                    Name = "OIDCKey"
+	OIDCRefresh                Name = "OIDCRefresh"
+	OIDCUnauthorized           Name = "OIDCUnauthorized"
+	PanicAutorecover           Name = "PanicAutorecover"
+	PortConflict               Name = "PortConflict"
+	ProfileCapture             Name = "ProfileCapture"
+	ProfileUpload              Name = "ProfileUpload"
+	QuotaAdjusted              Name = "QuotaAdjusted"
+	QuotaStore                 Name = "QuotaStore"
+	Response                   Name = "Response-*"
+	ResponseShape              Name = "ResponseShape"
+	ResponseShapeMismatch      Name = "ResponseShapeMismatch"
+	RouteBudgets               Name = "RouteBudgets"
+	RouteConflict              Name = "RouteConflict"
+	RunInternalServer          Name = "RunInternalServer"
+	RunPublicService           Name = "RunPublicService"
+	RunReadinessServer         Name = "RunReadinessServer"
+	ScheduledTaskCatchUp       Name = "ScheduledTaskCatchUp"
+	ScheduledTaskFailed        Name = "ScheduledTaskFailed"
+	ScheduledTaskOverlap       Name = "ScheduledTaskOverlap"
+	Scheduler                  Name = "Scheduler"
+	SchedulerState             Name = "SchedulerState"
+	SelfTest                   Name = "SelfTest"
+	ServerRestart              Name = "ServerRestart"
+	ServerRestartFailed        Name = "ServerRestartFailed"
+	Service                    Name = "Service"
+	ServiceCancel              Name = "ServiceCancel"
+	ServiceExit                Name = "ServiceExit"
+	ShadowPanic                Name = "ShadowPanic"
+	ShutdownFunc               Name = "ShutdownFunc"
+	SyntheticTraffic           Name = "SyntheticTraffic"
+	TLS                        Name = "TLS"
+	TaskQueueClaim             Name = "TaskQueueClaim"
+	TaskQueueDeadLetter        Name = "TaskQueueDeadLetter"
+	TaskQueueStats             Name = "TaskQueueStats"
+	TaskQueueStop              Name = "TaskQueueStop"
+	TaskQueueUpdate            Name = "TaskQueueUpdate"
+	UnexpectedEventLevel       Name = "UnexpectedEventLevel"
+	UnexpectedShutdownReceived Name = "UnexpectedShutdownReceived"
+	UnhandledMiddleware        Name = "UnhandledMiddleware"
+	UnregisteredEvent          Name = "UnregisteredEvent"
+)
+
+type (
+	// Name is the name of a log event. It is an alias of string, so the constants can be passed to a Logger as is. A
+	// name ending with an asterisk matches all events with that prefix.
+	Name = string
+
+	// Level is the severity at which an event is expected to be logged.
+	Level string
+
+	// Definition declares an event with the levels it is expected to be logged at.
+	Definition struct {
+		Name        Name    `json:"name"`
+		Levels      []Level `json:"levels"`
+		Description string  `json:"description"`
+	}
+)
+
+// Foundation contains the definitions of the events that are logged by ServiceFoundation.
+var Foundation = []Definition{
+	{APIKeyReload, []Level{Info, Error}, "The API keys of a key store were reloaded, or reloading them failed."},
+	{APIKeyUnauthorized, []Level{Debug}, "A request was rejected because of a missing or invalid API key."},
+	{AnomalousLatency, []Level{Warn}, "The latency of a route deviates from its baseline."},
+	{Baggage, []Level{Error}, "The baggage options are invalid."},
+	{BufferDoubleRelease, []Level{Warn}, "A pooled buffer was released twice, so it was still referenced after its release."},
+	{CachePolicyOverride, []Level{Debug}, "The cache policy of a route overrides the Cache-Control of its handler."},
+	{ContentDigestMismatch, []Level{Warn}, "A request body didn't match its Content-Digest header."},
+	{CriticalSectionsAbandoned, []Level{Warn, Error}, "The shutdown continued with pending critical sections."},
+	{CriticalSectionsPending, []Level{Info}, "The shutdown is waiting for pending critical sections."},
+	{DeduplicationKey, []Level{Debug, Warn}, "The deduplication key could not be read from a request."},
+	{DeduplicationStore, []Level{Warn}, "The deduplication store failed."},
+	{ErrorReporting, []Level{Warn}, "Reporting an error to the error reporter failed."},
+	{FastShutdown, []Level{Warn}, "The shutdown hooks didn't complete within the fast shutdown deadline."},
+	{ForcedShutdown, []Level{Error}, "A second signal forced the exit during the shutdown."},
+	{GracefulShutdown, []Level{Debug, Warn}, "A signal or /quit started the graceful shutdown, or a server was closed with in-flight requests after the server timeout."},
+	{HealthCheck, []Level{Error}, "A health or readiness check could not be added, or its options are invalid."},
+	{InternalAuthUnauthorized, []Level{Warn}, "A request to an internal endpoint was rejected because of a missing or invalid token."},
+	{LazyResource, []Level{Info, Error}, "A lazy resource was initialized, or its initialization failed."},
+	{ListenFailed, []Level{Error}, "A server failed listening on its port."},
+	{LogFormat, []Level{Warn}, "The log format could not be parsed."},
+	{LogMinLevel, []Level{Warn}, "A log level could not be parsed."},
+	{LogSinks, []Level{Warn}, "The log sinks could not be parsed."},
+	{MetricsBuckets, []Level{Error}, "The histogram buckets could not be parsed."},
+	{MetricsGauge, []Level{Error}, "A gauge could not be registered or set, because its name or labels conflict with another metric."},
+	{MetricsHistogram, []Level{Error}, "A histogram could not be registered or recorded, because its name or labels conflict with another metric."},
+	{MetricsPush, []Level{Debug, Warn}, "The metrics are pushed before the shutdown, or pushing them failed."},
+	{MetricsPushOptions, []Level{Error}, "The metrics push options are invalid."},
+	{OIDCDiscovery, []Level{Error}, "Loading the OpenID configuration and signing keys of an issuer failed."},
+	{OIDCFailOpen, []Level{Warn}, "A request was allowed without validating its token, because no keys are available."},
+	{OIDCKey, []Level{Warn}, "A signing key of an issuer could not be used."},
+	{OIDCRefresh, []Level{Error}, "Refreshing the signing keys of an issuer failed."},
+	{OIDCUnauthorized, []Level{Debug}, "A request was rejected because of a missing or invalid token."},
+	{PanicAutorecover, []Level{Error}, "A handler panicked and responded with a 500."},
+	{PortConflict, []Level{Error}, "Two servers are configured to listen on the same port, which fails the startup."},
+	{ProfileCapture, []Level{Warn}, "Capturing or storing a profile failed."},
+	{ProfileUpload, []Level{Warn}, "Uploading a profile failed."},
+	{QuotaAdjusted, []Level{Info}, "The quota of a tenant was adjusted."},
+	{QuotaStore, []Level{Warn}, "Consuming quota from the quota store failed."},
+	{Response, []Level{Info}, "A route responded, logged by the RequestLogging middleware."},
+	{ResponseShape, []Level{Error}, "The golden response shape of a route could not be loaded."},
+	{ResponseShapeMismatch, []Level{Error}, "A response didn't match the recorded shape of its route."},
+	{RouteBudgets, []Level{Error}, "The route budgets are invalid."},
+	{RouteConflict, []Level{Error}, "A route path conflicts with a registered route and was not added."},
+	{RunInternalServer, []Level{Info}, "The internal server is running."},
+	{RunPublicService, []Level{Info}, "The public server is running."},
+	{RunReadinessServer, []Level{Info}, "The readiness server is running."},
+	{ScheduledTaskCatchUp, []Level{Info}, "A scheduled task runs to catch up on a missed run."},
+	{ScheduledTaskFailed, []Level{Error}, "A scheduled task failed."},
+	{ScheduledTaskOverlap, []Level{Warn}, "A scheduled task was skipped, because its previous run is still busy."},
+	{Scheduler, []Level{Error}, "The scheduled tasks are invalid."},
+	{SchedulerState, []Level{Warn}, "The state of the scheduler could not be read or written."},
+	{SelfTest, []Level{Info, Error}, "The self-test passed or failed."},
+	{ServerRestart, []Level{Info, Warn}, "A server is restarting or was restarted."},
+	{ServerRestartFailed, []Level{Error}, "Restarting a server failed, so the old server keeps running."},
+	{Service, []Level{Info}, "The service is starting."},
+	{ServiceCancel, []Level{Debug}, "The context of the service was cancelled."},
+	{ServiceExit, []Level{Debug}, "The service is exiting."},
+	{ShadowPanic, []Level{Warn}, "The canary handler of a route panicked."},
+	{ShutdownFunc, []Level{Debug, Warn}, "The shutdown func is called, or didn't complete in time."},
+	{SyntheticTraffic, []Level{Error}, "The synthetic traffic options are invalid."},
+	{TLS, []Level{Error}, "The TLS configuration of the servers is invalid."},
+	{TaskQueueClaim, []Level{Error}, "Claiming tasks from the task queue failed."},
+	{TaskQueueDeadLetter, []Level{Warn}, "A task failed too often and was dead-lettered."},
+	{TaskQueueStats, []Level{Error}, "The stats of the task queue could not be read."},
+	{TaskQueueStop, []Level{Debug, Error}, "The task queue is stopping, or stopping it failed."},
+	{TaskQueueUpdate, []Level{Error}, "Updating a task in the task queue failed."},
+	{UnexpectedEventLevel, []Level{Warn}, "An event was logged at a level it isn't registered for."},
+	{UnexpectedShutdownReceived, []Level{Error}, "A server stopped unexpectedly, like when it failed to listen, which shuts the service down."},
+	{UnhandledMiddleware, []Level{Warn}, "A middleware is not handled by the middleware wrapper."},
+	{UnregisteredEvent, []Level{Warn}, "An event was logged that isn't registered."},
+}
+
+// Matches returns true if the event name matches the definition.
+func (d Definition) Matches(name string) bool {
+	if strings.HasSuffix(d.Name, "*") {
+		return strings.HasPrefix(name, strings.TrimSuffix(d.Name, "*"))
+	}
+	return d.Name == name
+}
+
+// Allows returns true if the event is expected to be logged at the level.
+func (d Definition) Allows(level Level) bool {
+	for _, l := range d.Levels {
+		if l == level {
+			return true
+		}
+	}
+	return false
+}
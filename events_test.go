@@ -0,0 +1,109 @@
+package servicefoundation_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	sf "github.com/Prutswonder/go-servicefoundation"
+	"github.com/Prutswonder/go-servicefoundation/events"
+	"github.com/Prutswonder/go-servicefoundation/servicetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func newTestEventLogger(validate bool) (sf.Logger, sf.EventRegistry, *mockLogger) {
+	log := &mockLogger{}
+	log.On("Debug", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	log.On("Info", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	log.On("Warn", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	registry := sf.NewEventRegistry(events.Foundation...)
+	registry.Register(events.Definition{Name: "OrderPaid", Levels: []events.Level{events.Info}, Description: "An order was paid."})
+
+	return sf.NewEventLogger(log, registry, validate), registry, log
+}
+
+func countOf(registry sf.EventRegistry, name string) uint64 {
+	for _, event := range registry.Events() {
+		if event.Name == name {
+			return event.Count
+		}
+	}
+	return 0
+}
+
+func TestEventLogger_WarnsOnUnregisteredEvents(t *testing.T) {
+	tests := []struct {
+		name     string
+		validate bool
+		log      func(sf.Logger)
+		expected string
+	}{
+		{"registered", true, func(l sf.Logger) { l.Info("OrderPaid", "Paid") }, ""},
+		{"unregistered", true, func(l sf.Logger) { l.Info("OrderPayed", "Paid") }, events.UnregisteredEvent},
+		{"unexpected level", true, func(l sf.Logger) { l.Debug("OrderPaid", "Paid") }, events.UnexpectedEventLevel},
+		{"prefix", true, func(l sf.Logger) { l.Info("Response-orders", "Elapsed") }, ""},
+		{"production", false, func(l sf.Logger) { l.Info("OrderPayed", "Paid") }, ""},
+	}
+
+	for _, test := range tests {
+		sut, _, log := newTestEventLogger(test.validate)
+
+		// Act
+		test.log(sut)
+		test.log(sut)
+
+		if test.expected == "" {
+			log.AssertNotCalled(t, "Warn", mock.Anything, mock.Anything, mock.Anything)
+		} else {
+			log.AssertCalled(t, "Warn", test.expected, mock.Anything, mock.Anything)
+			log.AssertNumberOfCalls(t, "Warn", 1)
+		}
+	}
+}
+
+func TestEventLogger_CountsEvents(t *testing.T) {
+	sut, registry, _ := newTestEventLogger(true)
+
+	// Act
+	sut.Info("OrderPaid", "Paid")
+	sut.Info("OrderPaid", "Paid")
+	sut.Info(events.RunPublicService, "Running")
+	sut.Info("Response-orders", "Elapsed")
+	sut.Info("Response-customers", "Elapsed")
+
+	assert.Equal(t, uint64(2), countOf(registry, "OrderPaid"))
+	assert.Equal(t, uint64(1), countOf(registry, events.RunPublicService))
+	assert.Equal(t, uint64(2), countOf(registry, events.Response))
+	assert.Equal(t, uint64(0), countOf(registry, events.RunInternalServer))
+
+	// Act
+	registry.Register(events.Definition{Name: "OrderPaid", Levels: []events.Level{events.Info, events.Warn}})
+
+	assert.Equal(t, uint64(2), countOf(registry, "OrderPaid"), "registering again keeps the count")
+}
+
+func TestEventsHandler(t *testing.T) {
+	t.Parallel()
+	opt := sf.NewServiceOptions("events", []string{http.MethodGet}, nil)
+	opt.Events.Register(events.Definition{Name: "OrderPaid", Levels: []events.Level{events.Info}, Description: "An order was paid."})
+	sut := servicetest.StartService(t, opt, nil)
+	opt.Logger.Info("OrderPaid", "Paid order %d", 1)
+
+	// Act
+	resp, err := http.Get(sut.Internal + "/service/events")
+
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var listed []sf.EventInfo
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&listed))
+	found := map[string]sf.EventInfo{}
+	for _, event := range listed {
+		found[event.Name] = event
+	}
+	assert.Equal(t, uint64(1), found["OrderPaid"].Count)
+	assert.Equal(t, "An order was paid.", found["OrderPaid"].Description)
+	assert.Equal(t, uint64(1), found[events.RunInternalServer].Count)
+	assert.Equal(t, []events.Level{events.Info}, found[events.RunInternalServer].Levels)
+}
@@ -0,0 +1,197 @@
+package servicefoundation
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// The sources of the middlewares of a route.
+const (
+	// MiddlewareSourceDefault marks middlewares from DefaultMiddlewares.
+	MiddlewareSourceDefault = "default"
+	// MiddlewareSourceRoute marks middlewares from the middleware slice of the route.
+	MiddlewareSourceRoute = "route"
+	// MiddlewareSourceMetadata marks middlewares that enforce the RouteMetadata.
+	MiddlewareSourceMetadata = "metadata"
+	// MiddlewareSourceBuiltIn marks middlewares that the service adds to every route.
+	MiddlewareSourceBuiltIn = "built-in"
+)
+
+// ErrRouteNotFound is returned when a route with the given name does not exist.
+var ErrRouteNotFound = errors.New("route not found")
+
+type (
+	// ExplainedMiddleware describes a middleware in the chain of a route.
+	ExplainedMiddleware struct {
+		Name   string `json:"name"`
+		Source string `json:"source"`
+		Config string `json:"config,omitempty"`
+	}
+
+	// RouteExplanation describes the fully resolved chain of a route. Middlewares are in execution order, so the
+	// first one receives the request first. Timeouts contains the effective time budgets of the route.
+	RouteExplanation struct {
+		RouteInfo
+		Middlewares []ExplainedMiddleware `json:"middlewares"`
+		Timeouts    map[string]string     `json:"timeouts,omitempty"`
+		AuthPolicy  string                `json:"authPolicy"`
+		CachePolicy string                `json:"cachePolicy,omitempty"`
+	}
+
+	// routeComposer wraps the handler of a route and records every middleware at the moment it is applied, so the
+	// explanation describes the chain as it was composed.
+	routeComposer struct {
+		handler     Handle
+		middlewares []ExplainedMiddleware
+		timeouts    map[string]string
+	}
+
+	explainingMiddlewareWrapper struct {
+		source   string
+		composer *routeComposer
+	}
+)
+
+var middlewareNames = map[Middleware]string{
+	CORS:           "cors",
+	NoCaching:      "no_caching",
+	Counter:        "counter",
+	Histogram:      "histogram",
+	PanicTo500:     "panic_to_500",
+	RequestLogging: "request_logging",
+	RequestID:      "request_id",
+	Compression:    "compression",
+}
+
+// ExplainRoute returns the explanation of the route with the given name, or with the subsystem and name, like
+// "internal/health_check".
+func ExplainRoute(registry RouteRegistry, name string) (RouteExplanation, error) {
+	for _, route := range registry.Routes() {
+		if route.Name != name && route.Subsystem+"/"+route.Name != name {
+			continue
+		}
+		if route.explanation == nil {
+			return RouteExplanation{RouteInfo: route}, nil
+		}
+		return *route.explanation, nil
+	}
+	return RouteExplanation{}, ErrRouteNotFound
+}
+
+// NewExplainRouteHandler returns a handler that responds with the explanation of the route in the path. The
+// subsystem query parameter selects between routes with the same name.
+func NewExplainRouteHandler(registry RouteRegistry) Handle {
+	return func(w WrappedResponseWriter, r *http.Request, p RouterParams) {
+		name := p.Params.ByName("name")
+		if subsystem := r.URL.Query().Get("subsystem"); subsystem != "" {
+			name = subsystem + "/" + name
+		}
+
+		explanation, err := ExplainRoute(registry, name)
+
+		switch err {
+		case nil:
+			w.JSON(http.StatusOK, explanation)
+		case ErrRouteNotFound:
+			w.JSON(http.StatusNotFound, err.Error())
+		default:
+			w.JSON(http.StatusInternalServerError, err.Error())
+		}
+	}
+}
+
+// String returns the name of the middleware enumeration.
+func (m Middleware) String() string {
+	if name, ok := middlewareNames[m]; ok {
+		return name
+	}
+	if registered, ok := lookupMiddleware(m); ok {
+		return registered.name
+	}
+	return fmt.Sprintf("middleware_%d", int(m))
+}
+
+func newRouteComposer(handler Handle) *routeComposer {
+	return &routeComposer{handler: handler}
+}
+
+// wrap applies the middleware to the handler, which makes it the first one to receive requests.
+func (c *routeComposer) wrap(name, source, config string, middleware MiddlewareFunc) {
+	c.handler = middleware(c.handler)
+	c.middlewares = append([]ExplainedMiddleware{{Name: name, Source: source, Config: config}}, c.middlewares...)
+}
+
+// wrapEnumerated records the enumerated middlewares, which the WrapHandler applies around the composed handler for
+// every request. They are composed by NewChainFor, like the WrapHandler does, with a wrapper that only records them.
+func (c *routeComposer) wrapEnumerated(subsystem, name string, middlewares []Middleware) {
+	source := MiddlewareSourceRoute
+	if sameMiddlewares(middlewares, DefaultMiddlewares) {
+		source = MiddlewareSourceDefault
+	}
+
+	NewChainFor(&explainingMiddlewareWrapper{source: source, composer: c}, subsystem, name, middlewares).
+		Then(c.handler)
+}
+
+func (c *routeComposer) explain(route RouteInfo) *RouteExplanation {
+	explanation := &RouteExplanation{
+		RouteInfo:   route,
+		Middlewares: c.middlewares,
+		Timeouts:    c.timeouts,
+		AuthPolicy:  "anonymous",
+		CachePolicy: route.CachePolicy,
+	}
+
+	for _, middleware := range c.middlewares {
+		switch middleware.Name {
+		case "auth":
+			explanation.AuthPolicy = "authenticated"
+		case NoCaching.String():
+			if explanation.CachePolicy == "" {
+				explanation.CachePolicy = "no-cache"
+			}
+		}
+	}
+	return explanation
+}
+
+/* MiddlewareWrapper implementation */
+
+func (e *explainingMiddlewareWrapper) Wrap(_, _ string, middleware Middleware, handler Handle) Handle {
+	e.composer.middlewares = append([]ExplainedMiddleware{{Name: middleware.String(), Source: e.source}},
+		e.composer.middlewares...)
+	return handler
+}
+
+func budgetTimeouts(budget RouteBudget) map[string]string {
+	timeouts := map[string]string{"total": budget.Total.String()}
+	for name, subBudget := range budget.SubBudgets {
+		timeouts[name] = subBudget.String()
+	}
+	return timeouts
+}
+
+func routeContractConfig(metadata RouteMetadata) string {
+	var config []string
+	if len(metadata.ContentTypes) > 0 {
+		config = append(config, "contentTypes="+strings.Join(metadata.ContentTypes, ","))
+	}
+	if metadata.MaxBodySize > 0 {
+		config = append(config, fmt.Sprintf("maxBodySize=%d", metadata.MaxBodySize))
+	}
+	return strings.Join(config, " ")
+}
+
+func sameMiddlewares(a, b []Middleware) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,155 @@
+package servicefoundation_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	sf "github.com/Prutswonder/go-servicefoundation"
+	"github.com/stretchr/testify/assert"
+)
+
+// observingWrapper is a MiddlewareWrapper of no-op middlewares that record their execution.
+type observingWrapper struct {
+	executed *[]string
+}
+
+func (o *observingWrapper) Wrap(_, _ string, middleware sf.Middleware, handler sf.Handle) sf.Handle {
+	return o.observe(middleware.String())(handler)
+}
+
+func (o *observingWrapper) observe(name string) sf.MiddlewareFunc {
+	return func(next sf.Handle) sf.Handle {
+		return func(w sf.WrappedResponseWriter, r *http.Request, p sf.RouterParams) {
+			*o.executed = append(*o.executed, name)
+			next(w, r, p)
+		}
+	}
+}
+
+func newExplainedService(executed *[]string) sf.Service {
+	wrapper := &observingWrapper{executed: executed}
+	opt := sf.NewServiceOptions("explain", []string{http.MethodGet, http.MethodPost}, nil)
+	opt.MiddlewareWrapper = wrapper
+	opt.Budgets = sf.Budgets{"orders": {Total: 800 * time.Millisecond,
+		SubBudgets: map[string]time.Duration{"payment": 300 * time.Millisecond}}}
+	opt.SetHandlers()
+	sut := sf.NewCustomService(opt)
+
+	sut.AddRouteWithMetadata("orders", []string{"/orders"}, sf.MethodsForPost, []sf.Middleware{sf.RequestLogging, sf.CORS},
+		sf.RouteMetadata{ContentTypes: []string{sf.ContentTypeJSON}, MaxBodySize: 1024, Auth: wrapper.observe("auth")},
+		func(w sf.WrappedResponseWriter, _ *http.Request, _ sf.RouterParams) {
+			*executed = append(*executed, "handler")
+			w.WriteHeader(http.StatusNoContent)
+		})
+	return sut
+}
+
+func TestExplainRoute_MatchesExecutionOrder(t *testing.T) {
+	var executed []string
+	sut := newExplainedService(&executed)
+	sut.Handler("public").ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/orders", nil))
+
+	// Act
+	explanation, err := sf.ExplainRoute(sut, "orders")
+
+	assert.NoError(t, err)
+	var observable []string
+	for _, middleware := range explanation.Middlewares {
+		if middleware.Source == sf.MiddlewareSourceRoute || middleware.Name == "auth" {
+			observable = append(observable, middleware.Name)
+		}
+	}
+	assert.Equal(t, append(observable, "handler"), executed)
+	assert.Equal(t, []sf.ExplainedMiddleware{
+		{Name: "cors", Source: sf.MiddlewareSourceRoute},
+		{Name: "request_logging", Source: sf.MiddlewareSourceRoute},
+		{Name: "request_context", Source: sf.MiddlewareSourceBuiltIn},
+		{Name: "error_reporting", Source: sf.MiddlewareSourceBuiltIn},
+		{Name: "auth", Source: sf.MiddlewareSourceMetadata},
+		{Name: "route_contract", Source: sf.MiddlewareSourceMetadata, Config: "contentTypes=application/json maxBodySize=1024"},
+		{Name: "budget", Source: sf.MiddlewareSourceBuiltIn, Config: "800ms"},
+		{Name: "drain", Source: sf.MiddlewareSourceBuiltIn},
+	}, explanation.Middlewares)
+	assert.Equal(t, map[string]string{"total": "800ms", "payment": "300ms"}, explanation.Timeouts)
+	assert.Equal(t, "authenticated", explanation.AuthPolicy)
+	assert.Equal(t, "public", explanation.Subsystem)
+}
+
+func TestExplainRoute_DefaultMiddlewares(t *testing.T) {
+	var executed []string
+	sut := newExplainedService(&executed)
+
+	// Act
+	explanation, err := sf.ExplainRoute(sut, "internal/health_check")
+
+	assert.NoError(t, err)
+	assert.Equal(t, []sf.ExplainedMiddleware{
+		{Name: "request_id", Source: sf.MiddlewareSourceDefault},
+		{Name: "no_caching", Source: sf.MiddlewareSourceDefault},
+		{Name: "request_logging", Source: sf.MiddlewareSourceDefault},
+		{Name: "panic_to_500", Source: sf.MiddlewareSourceDefault},
+	}, explanation.Middlewares)
+	assert.Equal(t, "anonymous", explanation.AuthPolicy)
+	assert.Equal(t, "no-cache", explanation.CachePolicy)
+}
+
+func TestExplainRoute_CachePolicy(t *testing.T) {
+	opt := sf.NewServiceOptions("explain", []string{http.MethodGet}, nil)
+	opt.SetHandlers()
+	sut := sf.NewCustomService(opt)
+	sut.AddRouteWithMetadata("assets", []string{"/assets"}, sf.MethodsForGet, sf.DefaultMiddlewares,
+		sf.RouteMetadata{CachePolicy: sf.CachePublicMaxAge(time.Minute)},
+		func(w sf.WrappedResponseWriter, _ *http.Request, _ sf.RouterParams) {
+			w.WriteHeader(http.StatusOK)
+		})
+	w := httptest.NewRecorder()
+	sut.Handler("public").ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/assets", nil))
+
+	// Act
+	explanation, err := sf.ExplainRoute(sut, "assets")
+
+	assert.NoError(t, err)
+	assert.Equal(t, "public, max-age=60", w.Header().Get("Cache-Control"))
+	assert.Equal(t, "public (public, max-age=60)", explanation.CachePolicy)
+	assert.Contains(t, explanation.Middlewares, sf.ExplainedMiddleware{Name: "cache_policy",
+		Source: sf.MiddlewareSourceMetadata, Config: "public (public, max-age=60)"})
+	for _, route := range sut.Routes() {
+		if route.Name == "assets" {
+			assert.Equal(t, "public (public, max-age=60)", route.CachePolicy)
+		}
+	}
+}
+
+func TestExplainRouteHandler(t *testing.T) {
+	var executed []string
+	sut := newExplainedService(&executed)
+
+	tests := []struct {
+		path     string
+		status   int
+		expected string
+	}{
+		{"/service/routes/orders/explain", http.StatusOK, "orders"},
+		{"/service/routes/root/explain?subsystem=internal", http.StatusOK, "internal"},
+		{"/service/routes/missing/explain", http.StatusNotFound, ""},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+
+		// Act
+		sut.Handler("internal").ServeHTTP(w, httptest.NewRequest(http.MethodGet, test.path, nil))
+
+		assert.Equal(t, test.status, w.Code, test.path)
+		if test.status != http.StatusOK {
+			continue
+		}
+		var explanation sf.RouteExplanation
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &explanation))
+		assert.Contains(t, []string{explanation.Name, explanation.Subsystem}, test.expected, test.path)
+		assert.NotEmpty(t, explanation.Middlewares, test.path)
+	}
+}
@@ -0,0 +1,373 @@
+package servicefoundation
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+const (
+	// ContentTypeProblemJSON is the value of the http content type header for problem details (RFC 7807).
+	ContentTypeProblemJSON = "application/problem+json"
+
+	fieldsQueryParameter  = "fields"
+	defaultMaxFieldPaths  = 32
+	defaultMaxFieldsDepth = 5
+)
+
+var (
+	fieldNamePattern = regexp.MustCompile("^[A-Za-z0-9_-]+$")
+
+	jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+type (
+	// FieldFilterOptions contains the settings of the fields filter of a route. AllowedFields contains the paths that
+	// clients may select, including their nested fields; when empty, all fields can be selected. MaxPaths and MaxDepth
+	// limit the complexity of the fields expression.
+	FieldFilterOptions struct {
+		AllowedFields []string
+		MaxPaths      int
+		MaxDepth      int
+	}
+
+	// FieldProjector projects response content to the fields selected by the client.
+	FieldProjector interface {
+		Project(content interface{}) interface{}
+	}
+
+	// Problem contains the problem details of an error response, as specified in RFC 7807. Code is an extension
+	// member that identifies the problem for clients, when the status code is too generic.
+	Problem struct {
+		Type   string `json:"type"`
+		Title  string `json:"title"`
+		Status int    `json:"status"`
+		Detail string `json:"detail,omitempty"`
+		Code   string `json:"code,omitempty"`
+	}
+
+	fieldSelection map[string]fieldSelection
+
+	fieldFilterResponseWriter struct {
+		WrappedResponseWriter
+		selection fieldSelection
+	}
+)
+
+// NewFieldFilter returns a MiddlewareFunc that projects the JSON responses of the route to the fields in the "fields"
+// query parameter, like "?fields=id,name,address.city". Nested fields are selected with dot notation and selections
+// apply to every element of arrays. Malformed, too complex or disallowed expressions result in a 400 problem response.
+// The projection is applied to the Go value passed to JSON, WriteResponse or StreamJSON, so types are preserved.
+func NewFieldFilter(options FieldFilterOptions) MiddlewareFunc {
+	if options.MaxPaths <= 0 {
+		options.MaxPaths = defaultMaxFieldPaths
+	}
+	if options.MaxDepth <= 0 {
+		options.MaxDepth = defaultMaxFieldsDepth
+	}
+
+	return func(next Handle) Handle {
+		return func(w WrappedResponseWriter, r *http.Request, p RouterParams) {
+			expression := r.URL.Query().Get(fieldsQueryParameter)
+			if expression == "" {
+				next(w, r, p)
+				return
+			}
+
+			selection, err := parseFieldSelection(expression, options)
+			if err != nil {
+				WriteProblem(w, http.StatusBadRequest, err.Error())
+				return
+			}
+
+			next(&fieldFilterResponseWriter{WrappedResponseWriter: w, selection: selection}, r, p)
+		}
+	}
+}
+
+// WriteProblem writes a problem details response with the given status code and detail.
+func WriteProblem(w http.ResponseWriter, statusCode int, detail string) {
+	WriteProblemCode(w, statusCode, "", detail)
+}
+
+// WriteProblemCode writes a problem details response with the given status code, problem code and detail.
+func WriteProblemCode(w http.ResponseWriter, statusCode int, code, detail string) {
+	w.Header().Set(ContentTypeHeader, ContentTypeProblemJSON)
+	w.WriteHeader(statusCode)
+
+	json.NewEncoder(w).Encode(Problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(statusCode),
+		Status: statusCode,
+		Detail: detail,
+		Code:   code,
+	})
+}
+
+// StreamJSON writes the items from the channel as a JSON array, flushing after every item. When the response is
+// field filtered, the projection is applied to every item.
+func StreamJSON(w WrappedResponseWriter, statusCode int, items <-chan interface{}) error {
+	projector, _ := w.(FieldProjector)
+	flusher, _ := w.(http.Flusher)
+
+	buffer := bufferFor(w, defaultJSONSizeHint)
+	defer buffer.Release()
+	encoder := json.NewEncoder(buffer)
+
+	w.Header().Set(ContentTypeHeader, ContentTypeJSON)
+	w.WriteHeader(statusCode)
+
+	if _, err := w.Write([]byte("[")); err != nil {
+		return err
+	}
+
+	first := true
+	for item := range items {
+		if projector != nil {
+			item = projector.Project(item)
+		}
+
+		buffer.Reset()
+		if !first {
+			buffer.WriteByte(',')
+		}
+		first = false
+
+		if err := encoder.Encode(item); err != nil {
+			return err
+		}
+		// Strip the newline that terminates every encoded value.
+		buffer.Truncate(buffer.Len() - 1)
+
+		if _, err := w.Write(buffer.Bytes()); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	_, err := w.Write([]byte("]"))
+	return err
+}
+
+/* WrappedResponseWriter implementation */
+
+func (w *fieldFilterResponseWriter) JSON(statusCode int, content interface{}) {
+	w.WrappedResponseWriter.JSON(statusCode, w.Project(content))
+}
+
+func (w *fieldFilterResponseWriter) WriteResponse(r *http.Request, statusCode int, content interface{}) {
+	if w.AcceptsXML(r) {
+		// XML can't encode the projected maps, so the fields filter only applies to JSON.
+		w.XML(statusCode, content)
+		return
+	}
+	w.JSON(statusCode, content)
+}
+
+func (w *fieldFilterResponseWriter) GetBuffer(sizeHint int) *Buffer {
+	return bufferFor(w.WrappedResponseWriter, sizeHint)
+}
+
+func (w *fieldFilterResponseWriter) Flush() {
+	if flusher, ok := w.WrappedResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+/* FieldProjector implementation */
+
+func (w *fieldFilterResponseWriter) Project(content interface{}) interface{} {
+	return project(reflect.ValueOf(content), w.selection)
+}
+
+func parseFieldSelection(expression string, options FieldFilterOptions) (fieldSelection, error) {
+	paths := strings.Split(expression, ",")
+	if len(paths) > options.MaxPaths {
+		return nil, fmt.Errorf("Too many fields, at most %d are allowed", options.MaxPaths)
+	}
+
+	selection := fieldSelection{}
+	for _, path := range paths {
+		names := strings.Split(strings.TrimSpace(path), ".")
+
+		if len(names) > options.MaxDepth {
+			return nil, fmt.Errorf("Field '%s' is nested too deep, at most %d levels are allowed", path,
+				options.MaxDepth)
+		}
+		for _, name := range names {
+			if !fieldNamePattern.MatchString(name) {
+				return nil, fmt.Errorf("Malformed field '%s'", path)
+			}
+		}
+		if !isAllowedField(names, options.AllowedFields) {
+			return nil, fmt.Errorf("Field '%s' is not allowed", path)
+		}
+
+		selection.add(names)
+	}
+	return selection, nil
+}
+
+// isAllowedField returns true when the path is, or is nested in, one of the allowed paths.
+func isAllowedField(names []string, allowed []string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+
+	path := strings.Join(names, ".")
+	for _, a := range allowed {
+		if path == a || strings.HasPrefix(path, a+".") {
+			return true
+		}
+	}
+	return false
+}
+
+func (s fieldSelection) add(names []string) {
+	child, ok := s[names[0]]
+
+	if len(names) == 1 {
+		// Selecting a field as a whole overrides any nested selections.
+		s[names[0]] = nil
+		return
+	}
+	if ok && child == nil {
+		return
+	}
+	if !ok {
+		child = fieldSelection{}
+		s[names[0]] = child
+	}
+	child.add(names[1:])
+}
+
+// project returns the fields of v in the selection, as maps of the JSON field names. A nil selection returns v as a
+// whole.
+func project(v reflect.Value, selection fieldSelection) interface{} {
+	if !v.IsValid() {
+		return nil
+	}
+	if selection == nil || v.Type().Implements(jsonMarshalerType) || v.Type().Implements(textMarshalerType) {
+		return v.Interface()
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return project(v.Elem(), selection)
+	case reflect.Struct:
+		result := map[string]interface{}{}
+		projectStruct(v, selection, result)
+		return result
+	case reflect.Map:
+		if v.IsNil() || v.Type().Key().Kind() != reflect.String {
+			return v.Interface()
+		}
+		result := map[string]interface{}{}
+		for name, child := range selection {
+			if value := v.MapIndex(reflect.ValueOf(name).Convert(v.Type().Key())); value.IsValid() {
+				result[name] = project(value, child)
+			}
+		}
+		return result
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && (v.IsNil() || v.Type().Elem().Kind() == reflect.Uint8) {
+			return v.Interface()
+		}
+		result := make([]interface{}, v.Len())
+		for i := range result {
+			result[i] = project(v.Index(i), selection)
+		}
+		return result
+	}
+	return v.Interface()
+}
+
+func projectStruct(v reflect.Value, selection fieldSelection, result map[string]interface{}) {
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, omitEmpty, ok := jsonFieldName(field)
+
+		if !ok {
+			continue
+		}
+
+		value := v.Field(i)
+		if field.Anonymous && name == "" {
+			// Embedded structs without a JSON name have their fields promoted.
+			if value.Kind() == reflect.Ptr {
+				if value.IsNil() {
+					continue
+				}
+				value = value.Elem()
+			}
+			if value.Kind() == reflect.Struct {
+				projectStruct(value, selection, result)
+				continue
+			}
+			if field.PkgPath != "" {
+				continue
+			}
+			name = field.Name
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		child, selected := selection[name]
+		if !selected || (omitEmpty && isEmptyValue(value)) {
+			continue
+		}
+		result[name] = project(value, child)
+	}
+}
+
+func jsonFieldName(field reflect.StructField) (string, bool, bool) {
+	if field.PkgPath != "" && !field.Anonymous {
+		// Unexported field.
+		return "", false, false
+	}
+
+	tag := field.Tag.Get("json")
+	if tag == "-" {
+		return "", false, false
+	}
+
+	parts := strings.Split(tag, ",")
+	omitEmpty := false
+	for _, option := range parts[1:] {
+		if option == "omitempty" {
+			omitEmpty = true
+		}
+	}
+	return parts[0], omitEmpty, true
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
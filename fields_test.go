@@ -0,0 +1,142 @@
+package servicefoundation_test
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	sf "github.com/Prutswonder/go-servicefoundation"
+	"github.com/Prutswonder/go-servicefoundation/servicetest"
+	"github.com/stretchr/testify/assert"
+)
+
+type (
+	testAddress struct {
+		Street string `json:"street"`
+		City   string `json:"city"`
+	}
+
+	testAudit struct {
+		Created time.Time `json:"created"`
+	}
+
+	testLine struct {
+		SKU      string  `json:"sku"`
+		Quantity int     `json:"quantity"`
+		Price    float64 `json:"price"`
+	}
+
+	testOrder struct {
+		testAudit
+		ID       int64        `json:"id"`
+		Name     string       `json:"name"`
+		Address  *testAddress `json:"address,omitempty"`
+		Lines    []testLine   `json:"lines"`
+		Internal string       `json:"-"`
+		Secret   string       `json:"secret"`
+	}
+)
+
+func newTestOrder() testOrder {
+	return testOrder{
+		testAudit: testAudit{Created: time.Date(2017, 8, 1, 10, 0, 0, 0, time.UTC)},
+		ID:        1,
+		Name:      "order",
+		Address:   &testAddress{Street: "Main street", City: "Amsterdam"},
+		Lines:     []testLine{{SKU: "a", Quantity: 1, Price: 1.5}, {SKU: "b", Quantity: 2, Price: 2}},
+		Internal:  "internal",
+		Secret:    "secret",
+	}
+}
+
+func runFieldFilter(options sf.FieldFilterOptions, query string, content interface{}) (int, string, string) {
+	r, _ := http.NewRequest(http.MethodGet, "/orders"+query, nil)
+	w, _ := servicetest.RunMiddlewareWithHandler(sf.NewFieldFilter(options), r,
+		func(w sf.WrappedResponseWriter, r *http.Request, _ sf.RouterParams) {
+			w.WriteResponse(r, http.StatusOK, content)
+		})
+	return w.Code, w.Header().Get("Content-Type"), w.Body.String()
+}
+
+func TestFieldFilter_Projection(t *testing.T) {
+	tests := []struct {
+		query    string
+		expected string
+	}{
+		{"", `{"created":"2017-08-01T10:00:00Z","id":1,"name":"order","address":{"street":"Main street","city":"Amsterdam"},
+			"lines":[{"sku":"a","quantity":1,"price":1.5},{"sku":"b","quantity":2,"price":2}],"secret":"secret"}`},
+		{"?fields=id,name", `{"id":1,"name":"order"}`},
+		{"?fields=address.city", `{"address":{"city":"Amsterdam"}}`},
+		{"?fields=lines.sku,lines.quantity", `{"lines":[{"sku":"a","quantity":1},{"sku":"b","quantity":2}]}`},
+		{"?fields=address,address.city", `{"address":{"street":"Main street","city":"Amsterdam"}}`},
+		{"?fields=created,unknown,Internal", `{"created":"2017-08-01T10:00:00Z"}`},
+	}
+
+	for _, test := range tests {
+		// Act
+		status, _, body := runFieldFilter(sf.FieldFilterOptions{}, test.query, newTestOrder())
+
+		assert.Equal(t, http.StatusOK, status, test.query)
+		assert.JSONEq(t, test.expected, body, test.query)
+	}
+}
+
+func TestFieldFilter_Arrays(t *testing.T) {
+	content := []interface{}{
+		map[string]interface{}{"id": 1, "tags": []string{"x"}, "meta": map[string]int{"a": 1, "b": 2}},
+		newTestOrder(),
+	}
+
+	// Act
+	_, _, body := runFieldFilter(sf.FieldFilterOptions{}, "?fields=id,meta.b", content)
+
+	assert.JSONEq(t, `[{"id":1,"meta":{"b":2}},{"id":1}]`, body)
+}
+
+func TestFieldFilter_InvalidExpressions(t *testing.T) {
+	options := sf.FieldFilterOptions{
+		AllowedFields: []string{"id", "name", "address.city", "lines"},
+		MaxPaths:      3,
+		MaxDepth:      2,
+	}
+
+	tests := []string{
+		"?fields=secret",
+		"?fields=address",
+		"?fields=id,,name",
+		"?fields=id.",
+		"?fields=na%20me",
+		"?fields=id,name,lines,address.city",
+		"?fields=lines.sku.code",
+	}
+
+	for _, query := range tests {
+		// Act
+		status, contentType, body := runFieldFilter(options, query, newTestOrder())
+
+		assert.Equal(t, http.StatusBadRequest, status, query)
+		assert.Equal(t, "application/problem+json", contentType, query)
+		assert.Contains(t, body, `"status":400`, query)
+	}
+
+	status, _, body := runFieldFilter(options, "?fields=lines.sku,address.city", newTestOrder())
+
+	assert.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, `{"address":{"city":"Amsterdam"},"lines":[{"sku":"a"},{"sku":"b"}]}`, body)
+}
+
+func TestFieldFilter_StreamJSON(t *testing.T) {
+	r, _ := http.NewRequest(http.MethodGet, "/orders?fields=id,lines.sku", nil)
+	items := make(chan interface{}, 2)
+	items <- newTestOrder()
+	items <- &testOrder{ID: 2}
+	close(items)
+
+	// Act
+	w, _ := servicetest.RunMiddlewareWithHandler(sf.NewFieldFilter(sf.FieldFilterOptions{}), r,
+		func(w sf.WrappedResponseWriter, _ *http.Request, _ sf.RouterParams) {
+			sf.StreamJSON(w, http.StatusOK, items)
+		})
+
+	assert.JSONEq(t, `[{"id":1,"lines":[{"sku":"a"},{"sku":"b"}]},{"id":2,"lines":null}]`, w.Body.String())
+}
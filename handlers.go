@@ -1,7 +1,9 @@
 package servicefoundation
 
 import (
+	"io"
 	"net/http"
+	"strings"
 
 	"github.com/julienschmidt/httprouter"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -68,23 +70,49 @@ type (
 		QuitHandler      QuitHandler
 	}
 
+	// ServiceHandlerFactoryOptions contains the optional settings of a ServiceHandlerFactory. The Buffers are used by
+	// the response helpers and GetBuffer, and can be nil to disable pooling. The Synthetic middleware flags synthetic
+	// requests before any other middleware, and can be nil to disable synthetic traffic detection. The Baggage
+	// middleware puts the baggage on the request context for all other middleware, and can be nil to ignore inbound
+	// baggage.
+	ServiceHandlerFactoryOptions struct {
+		Buffers   BufferPool
+		Synthetic MiddlewareFunc
+		Baggage   MiddlewareFunc
+	}
+
 	serviceHandlerFactoryImpl struct {
 		versionBuilder    VersionBuilder
 		exitFunc          ExitFunc
 		middlewareWrapper MiddlewareWrapper
 		stateReader       ServiceStateReader
+		buffers           BufferPool
+		synthetic         MiddlewareFunc
+		baggage           MiddlewareFunc
 	}
 )
 
-// NewServiceHandlerFactory creates a new factory with handler implementations.
+// NewServiceHandlerFactory creates a new factory with handler implementations. The quit handler calls the exit func
+// after responding, which can be nil when the service shuts itself down after /quit.
 func NewServiceHandlerFactory(middlewareWrapper MiddlewareWrapper, versionBuilder VersionBuilder,
 	stateReader ServiceStateReader, exitFunc ExitFunc) ServiceHandlerFactory {
 
+	return NewCustomServiceHandlerFactory(middlewareWrapper, versionBuilder, stateReader, exitFunc,
+		ServiceHandlerFactoryOptions{})
+}
+
+// NewCustomServiceHandlerFactory creates a new factory with handler implementations that use the options.
+func NewCustomServiceHandlerFactory(middlewareWrapper MiddlewareWrapper, versionBuilder VersionBuilder,
+	stateReader ServiceStateReader, exitFunc ExitFunc, options ServiceHandlerFactoryOptions) ServiceHandlerFactory {
+
 	return &serviceHandlerFactoryImpl{
 		versionBuilder:    versionBuilder,
 		exitFunc:          exitFunc,
 		middlewareWrapper: middlewareWrapper,
 		stateReader:       stateReader,
+		buffers:           options.Buffers,
+		synthetic:         options.Synthetic,
+		baggage:           options.Baggage,
 	}
 }
 
@@ -93,12 +121,23 @@ func NewServiceHandlerFactory(middlewareWrapper MiddlewareWrapper, versionBuilde
 // Wrap wraps the specified Handle with the specified middleware wrappers.
 func (f *serviceHandlerFactoryImpl) Wrap(subsystem, name string, middlewares []Middleware, handle Handle) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-		h := handle
-
-		for _, middleware := range middlewares {
-			h = f.middlewareWrapper.Wrap(subsystem, name, middleware, h)
+		h := NewChainFor(f.middlewareWrapper, subsystem, name, middlewares).Then(handle)
+		if f.baggage != nil {
+			h = f.baggage(h)
 		}
-		h(NewWrappedResponseWriter(w), r, RouterParams{Params: p})
+		if f.synthetic != nil {
+			h = f.synthetic(h)
+		}
+		if f.buffers == nil {
+			h(NewWrappedResponseWriter(w), r, RouterParams{Params: p})
+			return
+		}
+
+		ctx, buffers := withRequestBuffers(r.Context(), f.buffers)
+		// Buffers that the handler didn't release are returned to the pool after the response.
+		defer buffers.release()
+
+		h(NewPooledResponseWriter(w, f.buffers), r.WithContext(ctx), RouterParams{Params: p})
 	}
 }
 
@@ -115,9 +154,15 @@ func (f *serviceHandlerFactoryImpl) NewHandlers() *Handlers {
 	}
 }
 
+// NewRootHandler returns a Handle that responds with the version of the service, as the version document when the
+// request accepts JSON, and as text otherwise.
 func (f *serviceHandlerFactoryImpl) NewRootHandler() Handle {
-	return func(w WrappedResponseWriter, _ *http.Request, _ RouterParams) {
-		w.WriteHeader(http.StatusOK)
+	return func(w WrappedResponseWriter, r *http.Request, _ RouterParams) {
+		if strings.Contains(r.Header.Get("Accept"), "application/json") {
+			w.JSON(http.StatusOK, f.versionBuilder.Version())
+			return
+		}
+		f.writeVersionText(w)
 	}
 }
 
@@ -126,7 +171,7 @@ func (f *serviceHandlerFactoryImpl) NewReadinessHandler() Handle {
 		if f.stateReader.IsReady() {
 			w.JSON(http.StatusOK, "ok")
 		} else {
-			w.JSON(http.StatusInternalServerError, "not ready")
+			w.JSON(http.StatusServiceUnavailable, "not ready")
 		}
 	}
 }
@@ -143,7 +188,9 @@ func (f *serviceHandlerFactoryImpl) NewLivenessHandler() Handle {
 
 func (f *serviceHandlerFactoryImpl) NewQuitHandler() Handle {
 	return func(w WrappedResponseWriter, _ *http.Request, _ RouterParams) {
-		defer f.exitFunc(0)
+		if f.exitFunc != nil {
+			defer f.exitFunc(0)
+		}
 
 		w.WriteHeader(http.StatusOK)
 
@@ -155,21 +202,41 @@ func (f *serviceHandlerFactoryImpl) NewQuitHandler() Handle {
 
 func (f *serviceHandlerFactoryImpl) NewHealthHandler() Handle {
 	return func(w WrappedResponseWriter, _ *http.Request, _ RouterParams) {
-		if f.stateReader.IsHealthy() {
-			w.JSON(http.StatusOK, "ok")
+		report := ReadHealthReport(f.stateReader)
+		w.Header().Set(HealthStateHeader, report.State)
+
+		// Degraded still serves traffic, so only unhealthy should make load balancers and monitors act.
+		if report.State == HealthStateUnhealthy {
+			w.JSON(http.StatusServiceUnavailable, report)
 		} else {
-			w.JSON(http.StatusInternalServerError, "not healthy")
+			w.JSON(http.StatusOK, report)
 		}
 	}
 }
 
+// NewVersionHandler returns a Handle that responds with the version document when the request accepts JSON, with the
+// version text when it accepts text/plain, and with the version map otherwise, like before the version document.
 func (f *serviceHandlerFactoryImpl) NewVersionHandler() Handle {
-	return func(w WrappedResponseWriter, _ *http.Request, _ RouterParams) {
-		version := f.versionBuilder.ToMap()
-		w.JSON(http.StatusOK, version)
+	return func(w WrappedResponseWriter, r *http.Request, _ RouterParams) {
+		accept := r.Header.Get("Accept")
+
+		switch {
+		case strings.Contains(accept, "application/json"):
+			w.JSON(http.StatusOK, f.versionBuilder.Version())
+		case strings.Contains(accept, "text/plain"):
+			f.writeVersionText(w)
+		default:
+			w.JSON(http.StatusOK, f.versionBuilder.ToMap())
+		}
 	}
 }
 
+func (f *serviceHandlerFactoryImpl) writeVersionText(w WrappedResponseWriter) {
+	w.Header().Set(ContentTypeHeader, "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, f.versionBuilder.ToString()+"\n")
+}
+
 func (f *serviceHandlerFactoryImpl) NewMetricsHandler() Handle {
 	return func(w WrappedResponseWriter, r *http.Request, _ RouterParams) {
 		promhttp.Handler().ServeHTTP(w, r)
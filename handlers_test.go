@@ -11,20 +11,47 @@ import (
 )
 
 func TestServiceHandlerFactoryImpl_CreateRootHandler(t *testing.T) {
-	m := &mockMiddlewareWrapper{}
-	v := &mockVersionBuilder{}
-	exitFn := func(int) {}
-	w := &mockResponseWriter{}
-	ssr := &mockServiceStateReader{}
-	sut := sf.NewServiceHandlerFactory(m, v, ssr, exitFn)
-
-	w.On("WriteHeader", http.StatusOK).Once()
-
-	// Act
-	actual := sut.NewHandlers().RootHandler.NewRootHandler()
-	actual(w, nil, sf.RouterParams{})
+	tests := []struct {
+		accept string
+		json   bool
+	}{
+		{"", false},
+		{"text/html", false},
+		{"application/json", true},
+	}
 
-	w.AssertExpectations(t)
+	for _, test := range tests {
+		m := &mockMiddlewareWrapper{}
+		v := &mockVersionBuilder{}
+		exitFn := func(int) {}
+		w := &mockResponseWriter{}
+		ssr := &mockServiceStateReader{}
+		sut := sf.NewServiceHandlerFactory(m, v, ssr, exitFn)
+		r, _ := http.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Accept", test.accept)
+		info := sf.VersionInfo{AppName: "app"}
+		header := http.Header{}
+
+		if test.json {
+			v.On("Version").Return(info).Once()
+			w.On("JSON", http.StatusOK, info).Once()
+		} else {
+			v.On("ToString").Return("version: 1").Once()
+			w.On("Header").Return(header)
+			w.On("WriteHeader", http.StatusOK).Once()
+			w.On("Write", []byte("version: 1\n")).Return(11, nil).Once()
+		}
+
+		// Act
+		actual := sut.NewHandlers().RootHandler.NewRootHandler()
+		actual(w, r, sf.RouterParams{})
+
+		w.AssertExpectations(t)
+		v.AssertExpectations(t)
+		if !test.json {
+			assert.Equal(t, "text/plain; charset=utf-8", header.Get("Content-Type"))
+		}
+	}
 }
 
 func TestServiceHandlerFactoryImpl_CreateReadinessHandler(t *testing.T) {
@@ -52,7 +79,7 @@ func TestServiceHandlerFactoryImpl_CreateReadinessHandler_NotReady(t *testing.T)
 	ssr := &mockServiceStateReader{}
 	sut := sf.NewServiceHandlerFactory(m, v, ssr, exitFn)
 
-	w.On("JSON", http.StatusInternalServerError, mock.Anything).Once()
+	w.On("JSON", http.StatusServiceUnavailable, mock.Anything).Once()
 	ssr.On("IsReady").Return(false)
 
 	// Act
@@ -106,7 +133,8 @@ func TestServiceHandlerFactoryImpl_CreateHealthHandler(t *testing.T) {
 	ssr := &mockServiceStateReader{}
 	sut := sf.NewServiceHandlerFactory(m, v, ssr, exitFn)
 
-	w.On("JSON", http.StatusOK, mock.Anything).Once()
+	w.On("Header").Return(http.Header{})
+	w.On("JSON", http.StatusOK, sf.HealthReport{State: sf.HealthStateHealthy}).Once()
 	ssr.On("IsHealthy").Return(true)
 
 	// Act
@@ -124,7 +152,8 @@ func TestServiceHandlerFactoryImpl_CreateHealthHandler_NotHealthy(t *testing.T)
 	ssr := &mockServiceStateReader{}
 	sut := sf.NewServiceHandlerFactory(m, v, ssr, exitFn)
 
-	w.On("JSON", http.StatusInternalServerError, mock.Anything).Once()
+	w.On("Header").Return(http.Header{})
+	w.On("JSON", http.StatusServiceUnavailable, sf.HealthReport{State: sf.HealthStateUnhealthy}).Once()
 	ssr.On("IsHealthy").Return(false)
 
 	// Act
@@ -135,23 +164,50 @@ func TestServiceHandlerFactoryImpl_CreateHealthHandler_NotHealthy(t *testing.T)
 }
 
 func TestServiceHandlerFactoryImpl_CreateVersionHandler(t *testing.T) {
-	m := &mockMiddlewareWrapper{}
-	v := &mockVersionBuilder{}
-	exitFn := func(int) {}
-	w := &mockResponseWriter{}
-	version := make(map[string]string)
-	ssr := &mockServiceStateReader{}
-	sut := sf.NewServiceHandlerFactory(m, v, ssr, exitFn)
-
-	v.On("ToMap").Return(version).Once()
-	w.On("JSON", http.StatusOK, version).Once()
-
-	// Act
-	actual := sut.NewHandlers().VersionHandler.NewVersionHandler()
-	actual(w, nil, sf.RouterParams{})
+	tests := []struct {
+		accept   string
+		expected string
+	}{
+		{"", "map"},
+		{"*/*", "map"},
+		{"application/json", "document"},
+		{"text/html, application/json;q=0.9", "document"},
+		{"text/plain", "text"},
+	}
 
-	w.AssertExpectations(t)
-	v.AssertExpectations(t)
+	for _, test := range tests {
+		m := &mockMiddlewareWrapper{}
+		v := &mockVersionBuilder{}
+		exitFn := func(int) {}
+		w := &mockResponseWriter{}
+		version := make(map[string]string)
+		info := sf.VersionInfo{AppName: "app"}
+		ssr := &mockServiceStateReader{}
+		sut := sf.NewServiceHandlerFactory(m, v, ssr, exitFn)
+		r, _ := http.NewRequest(http.MethodGet, "/service/version", nil)
+		r.Header.Set("Accept", test.accept)
+
+		switch test.expected {
+		case "map":
+			v.On("ToMap").Return(version).Once()
+			w.On("JSON", http.StatusOK, version).Once()
+		case "document":
+			v.On("Version").Return(info).Once()
+			w.On("JSON", http.StatusOK, info).Once()
+		case "text":
+			v.On("ToString").Return("version: 1").Once()
+			w.On("Header").Return(http.Header{})
+			w.On("WriteHeader", http.StatusOK).Once()
+			w.On("Write", []byte("version: 1\n")).Return(11, nil).Once()
+		}
+
+		// Act
+		actual := sut.NewHandlers().VersionHandler.NewVersionHandler()
+		actual(w, r, sf.RouterParams{})
+
+		w.AssertExpectations(t)
+		v.AssertExpectations(t)
+	}
 }
 
 func TestServiceHandlerFactoryImpl_CreateMetricsHandler(t *testing.T) {
@@ -0,0 +1,156 @@
+package servicefoundation
+
+const (
+	// HealthStateHealthy indicates that the service is fully functional.
+	HealthStateHealthy = "healthy"
+	// HealthStateDegraded indicates that the service is functional, but with reduced functionality.
+	HealthStateDegraded = "degraded"
+	// HealthStateUnhealthy indicates that the service is not functional.
+	HealthStateUnhealthy = "unhealthy"
+
+	// HealthStateHeader is the name of the response header containing the health state.
+	HealthStateHeader = "X-Health-State"
+
+	healthSubsystem = "health"
+)
+
+type (
+	// HealthStatus is the result of a single health check. Latency is only measured for the checks of the
+	// HealthRegistry.
+	HealthStatus struct {
+		State   string `json:"state"`
+		Reason  string `json:"reason,omitempty"`
+		Latency string `json:"latency,omitempty"`
+	}
+
+	// HealthCheckFunc is the function signature for a single health check.
+	HealthCheckFunc func() HealthStatus
+
+	// HealthCheck is a named health check. Only failing critical checks make the service unhealthy and not ready;
+	// failing non-critical checks make the service degraded.
+	HealthCheck struct {
+		Name     string
+		Critical bool
+		Check    HealthCheckFunc
+	}
+
+	// HealthReport contains the aggregated health state and the results of the individual health checks.
+	HealthReport struct {
+		State  string                  `json:"state"`
+		Checks map[string]HealthStatus `json:"checks,omitempty"`
+	}
+
+	// HealthStateReader is an optional extension of ServiceStateReader that reports one of the HealthState values.
+	HealthStateReader interface {
+		HealthState() string
+	}
+
+	// HealthReporter is an optional extension of ServiceStateReader that reports the individual health checks.
+	HealthReporter interface {
+		HealthReport() HealthReport
+	}
+
+	// HealthChecks is a ServiceStateReader based on a set of health checks.
+	HealthChecks interface {
+		ServiceStateReader
+		HealthStateReader
+		HealthReporter
+	}
+
+	healthChecksImpl struct {
+		checks  []HealthCheck
+		metrics Metrics
+	}
+)
+
+var healthStateValues = map[string]float64{
+	HealthStateHealthy:   0,
+	HealthStateDegraded:  1,
+	HealthStateUnhealthy: 2,
+}
+
+// Healthy returns a HealthStatus for a passing health check.
+func Healthy() HealthStatus {
+	return HealthStatus{State: HealthStateHealthy}
+}
+
+// Degraded returns a HealthStatus for a health check that passes with reduced functionality.
+func Degraded(reason string) HealthStatus {
+	return HealthStatus{State: HealthStateDegraded, Reason: reason}
+}
+
+// Unhealthy returns a HealthStatus for a failing health check.
+func Unhealthy(err error) HealthStatus {
+	status := HealthStatus{State: HealthStateUnhealthy}
+	if err != nil {
+		status.Reason = err.Error()
+	}
+	return status
+}
+
+// NewHealthChecks creates and returns a new HealthChecks implementation. The checks are evaluated on every call and
+// their states are reported as gauges, with 0 for healthy, 1 for degraded and 2 for unhealthy.
+func NewHealthChecks(checks []HealthCheck, metrics Metrics) HealthChecks {
+	return &healthChecksImpl{
+		checks:  checks,
+		metrics: metrics,
+	}
+}
+
+// ReadHealthReport returns the health report of the given ServiceStateReader, using the optional HealthReporter and
+// HealthStateReader extensions when implemented.
+func ReadHealthReport(reader ServiceStateReader) HealthReport {
+	if reporter, ok := reader.(HealthReporter); ok {
+		return reporter.HealthReport()
+	}
+	if stateReader, ok := reader.(HealthStateReader); ok {
+		return HealthReport{State: stateReader.HealthState()}
+	}
+	if reader.IsHealthy() {
+		return HealthReport{State: HealthStateHealthy}
+	}
+	return HealthReport{State: HealthStateUnhealthy}
+}
+
+/* HealthChecks implementation */
+
+func (h *healthChecksImpl) IsLive() bool {
+	return true
+}
+
+func (h *healthChecksImpl) IsReady() bool {
+	return h.HealthState() != HealthStateUnhealthy
+}
+
+func (h *healthChecksImpl) IsHealthy() bool {
+	return h.HealthState() != HealthStateUnhealthy
+}
+
+func (h *healthChecksImpl) HealthState() string {
+	return h.HealthReport().State
+}
+
+func (h *healthChecksImpl) HealthReport() HealthReport {
+	report := HealthReport{
+		State:  HealthStateHealthy,
+		Checks: make(map[string]HealthStatus, len(h.checks)),
+	}
+
+	for _, check := range h.checks {
+		status := check.Check()
+		report.Checks[check.Name] = status
+		h.metrics.SetGaugeLabels(healthStateValues[status.State], healthSubsystem, "dependency_state",
+			"Health state of the dependency.", []string{"name"}, []string{check.Name})
+
+		switch {
+		case status.State == HealthStateHealthy:
+		case check.Critical && status.State == HealthStateUnhealthy:
+			report.State = HealthStateUnhealthy
+		case report.State == HealthStateHealthy:
+			report.State = HealthStateDegraded
+		}
+	}
+
+	h.metrics.SetGauge(healthStateValues[report.State], healthSubsystem, "state", "Overall health state.")
+	return report
+}
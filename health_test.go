@@ -0,0 +1,100 @@
+package servicefoundation_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	sf "github.com/Prutswonder/go-servicefoundation"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func newStaticCheck(name string, critical bool, status sf.HealthStatus) sf.HealthCheck {
+	return sf.HealthCheck{
+		Name:     name,
+		Critical: critical,
+		Check: func() sf.HealthStatus {
+			return status
+		},
+	}
+}
+
+func newTestHealthChecks(checks ...sf.HealthCheck) (sf.HealthChecks, *mockMetrics) {
+	m := &mockMetrics{}
+	m.On("SetGauge", mock.Anything, "health", mock.Anything, mock.Anything)
+	m.On("SetGaugeLabels", mock.Anything, "health", "dependency_state", mock.Anything, []string{"name"}, mock.Anything)
+
+	return sf.NewHealthChecks(checks, m), m
+}
+
+func TestHealthChecks_Aggregation(t *testing.T) {
+	failure := errors.New("connection refused")
+
+	tests := []struct {
+		name     string
+		critical sf.HealthStatus
+		optional sf.HealthStatus
+		expected string
+		ready    bool
+	}{
+		{"all healthy", sf.Healthy(), sf.Healthy(), sf.HealthStateHealthy, true},
+		{"optional degraded", sf.Healthy(), sf.Degraded("slow"), sf.HealthStateDegraded, true},
+		{"optional unhealthy", sf.Healthy(), sf.Unhealthy(failure), sf.HealthStateDegraded, true},
+		{"critical degraded", sf.Degraded("slow"), sf.Healthy(), sf.HealthStateDegraded, true},
+		{"critical unhealthy", sf.Unhealthy(failure), sf.Healthy(), sf.HealthStateUnhealthy, false},
+		{"both unhealthy", sf.Unhealthy(failure), sf.Unhealthy(failure), sf.HealthStateUnhealthy, false},
+	}
+
+	for _, test := range tests {
+		sut, _ := newTestHealthChecks(
+			newStaticCheck("database", true, test.critical),
+			newStaticCheck("recommendations", false, test.optional),
+		)
+
+		// Act
+		report := sut.HealthReport()
+
+		assert.Equal(t, test.expected, report.State, test.name)
+		assert.Equal(t, test.optional, report.Checks["recommendations"], test.name)
+		assert.Equal(t, test.ready, sut.IsReady(), test.name)
+		assert.Equal(t, test.ready, sut.IsHealthy(), test.name)
+		assert.True(t, sut.IsLive(), test.name)
+	}
+}
+
+func TestHealthChecks_Gauges(t *testing.T) {
+	sut, m := newTestHealthChecks(newStaticCheck("Recommendation-Engine", false, sf.Degraded("down")))
+
+	// Act
+	sut.HealthState()
+
+	m.AssertCalled(t, "SetGaugeLabels", float64(1), "health", "dependency_state", mock.Anything, []string{"name"},
+		[]string{"Recommendation-Engine"})
+	m.AssertCalled(t, "SetGauge", float64(1), "health", "state", mock.Anything)
+}
+
+func TestHealthHandler_StatusCodes(t *testing.T) {
+	tests := []struct {
+		status   sf.HealthStatus
+		expected int
+	}{
+		{sf.Healthy(), http.StatusOK},
+		{sf.Degraded("slow"), http.StatusOK},
+		{sf.Unhealthy(nil), http.StatusServiceUnavailable},
+	}
+
+	for _, test := range tests {
+		checks, _ := newTestHealthChecks(newStaticCheck("database", true, test.status))
+		sut := sf.NewServiceHandlerFactory(&mockMiddlewareWrapper{}, &mockVersionBuilder{}, checks, func(int) {})
+		w := httptest.NewRecorder()
+
+		// Act
+		sut.NewHandlers().HealthHandler.NewHealthHandler()(sf.NewWrappedResponseWriter(w), nil, sf.RouterParams{})
+
+		assert.Equal(t, test.expected, w.Code, test.status.State)
+		assert.Equal(t, test.status.State, w.Header().Get("X-Health-State"))
+		assert.Contains(t, w.Body.String(), `"state":"`+test.status.State+`"`)
+	}
+}
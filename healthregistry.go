@@ -0,0 +1,229 @@
+package servicefoundation
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	defaultHealthCheckTimeout = 5 * time.Second
+
+	readinessCheckPrefix = "readiness_"
+)
+
+type (
+	// CheckFunc checks a dependency of the service, like a database, queue or downstream API, and returns an error
+	// when it is unavailable. The context is cancelled after the timeout of the HealthRegistry.
+	CheckFunc func(ctx context.Context) error
+
+	// HealthRegistryOptions contains the settings of the HealthRegistry. Every check is cancelled after Timeout, which
+	// defaults to 5 seconds. The results are reused for CacheInterval, so frequent health scrapes don't hammer the
+	// dependencies; a zero CacheInterval runs the checks on every call.
+	HealthRegistryOptions struct {
+		Timeout       time.Duration
+		CacheInterval time.Duration
+		Clock         Clock
+	}
+
+	// HealthRegistry contains the health checks and readiness checks that are added to the service. All checks of a
+	// kind run concurrently, and a failing check makes the service unhealthy or not ready.
+	HealthRegistry interface {
+		AddHealthCheck(name string, check CheckFunc)
+		AddReadinessCheck(name string, check CheckFunc)
+		Health() HealthReport
+		Readiness() HealthReport
+	}
+
+	healthRegistryImpl struct {
+		options   HealthRegistryOptions
+		metrics   Metrics
+		health    *checkSet
+		readiness *checkSet
+	}
+
+	// checkSet runs the checks of a kind. Its mutex is held while the checks run, so concurrent callers share the
+	// cached result.
+	checkSet struct {
+		prefix    string
+		mutex     sync.Mutex
+		names     []string
+		checks    map[string]CheckFunc
+		report    HealthReport
+		checkedAt time.Time
+	}
+
+	// registryStateReader adds the checks of the registry to the state and health report of a ServiceStateReader.
+	registryStateReader struct {
+		ServiceStateReader
+		registry HealthRegistry
+	}
+)
+
+// NewHealthRegistry instantiates a new HealthRegistry implementation. The states of the checks are reported as gauges,
+// with 0 for healthy and 2 for unhealthy, and their latencies in seconds.
+func NewHealthRegistry(options HealthRegistryOptions, metrics Metrics) HealthRegistry {
+	if options.Timeout <= 0 {
+		options.Timeout = defaultHealthCheckTimeout
+	}
+	if options.Clock == nil {
+		options.Clock = NewSystemClock()
+	}
+
+	return &healthRegistryImpl{
+		options:   options,
+		metrics:   metrics,
+		health:    &checkSet{checks: make(map[string]CheckFunc)},
+		readiness: &checkSet{prefix: readinessCheckPrefix, checks: make(map[string]CheckFunc)},
+	}
+}
+
+// NewHealthRegistryStateReader returns a HealthChecks implementation that is only healthy and ready when the reader
+// is, and the health checks and readiness checks of the registry pass. Its health report contains the checks of both
+// the reader and the registry.
+func NewHealthRegistryStateReader(reader ServiceStateReader, registry HealthRegistry) HealthChecks {
+	return &registryStateReader{ServiceStateReader: reader, registry: registry}
+}
+
+/* HealthRegistry implementation */
+
+// AddHealthCheck adds a check of the health. A check with the same name replaces the previous one.
+func (h *healthRegistryImpl) AddHealthCheck(name string, check CheckFunc) {
+	h.health.add(name, check)
+}
+
+// AddReadinessCheck adds a check of the readiness. A check with the same name replaces the previous one.
+func (h *healthRegistryImpl) AddReadinessCheck(name string, check CheckFunc) {
+	h.readiness.add(name, check)
+}
+
+func (h *healthRegistryImpl) Health() HealthReport {
+	return h.run(h.health)
+}
+
+func (h *healthRegistryImpl) Readiness() HealthReport {
+	return h.run(h.readiness)
+}
+
+// run returns the cached report of the checks, or runs them concurrently when the cache expired.
+func (h *healthRegistryImpl) run(set *checkSet) HealthReport {
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+
+	now := h.options.Clock.Now()
+	if !set.checkedAt.IsZero() && now.Sub(set.checkedAt) < h.options.CacheInterval {
+		return set.report
+	}
+
+	report := HealthReport{State: HealthStateHealthy, Checks: make(map[string]HealthStatus, len(set.names))}
+	statuses := make([]HealthStatus, len(set.names))
+	latencies := make([]time.Duration, len(set.names))
+	var wg sync.WaitGroup
+	for i, name := range set.names {
+		wg.Add(1)
+		go func(i int, name string) {
+			defer wg.Done()
+			statuses[i], latencies[i] = h.check(name, set.checks[name])
+		}(i, name)
+	}
+	wg.Wait()
+
+	for i, name := range set.names {
+		status := statuses[i]
+		report.Checks[name] = status
+		if status.State == HealthStateUnhealthy {
+			report.State = HealthStateUnhealthy
+		}
+
+		h.metrics.SetGaugeLabels(healthStateValues[status.State], healthSubsystem, set.prefix+"check_state",
+			"Health state of the checks.", []string{"check"}, []string{name})
+		h.metrics.SetGaugeLabels(latencies[i].Seconds(), healthSubsystem, set.prefix+"check_seconds",
+			"Latency of the last run of the checks in seconds.", []string{"check"}, []string{name})
+	}
+
+	set.report, set.checkedAt = report, now
+	return report
+}
+
+// check runs the check with the timeout, and returns its status and latency. A check that ignores its context is
+// abandoned after the timeout.
+func (h *healthRegistryImpl) check(name string, check CheckFunc) (HealthStatus, time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), h.options.Timeout)
+	defer cancel()
+
+	start := time.Now()
+	result := make(chan error, 1)
+	go func() {
+		defer func() {
+			if rec := recover(); rec != nil {
+				result <- fmt.Errorf("check %s panicked: %v", name, rec)
+			}
+		}()
+		result <- check(ctx)
+	}()
+
+	var err error
+	select {
+	case err = <-result:
+	case <-ctx.Done():
+	}
+	if ctx.Err() != nil {
+		err = fmt.Errorf("check %s timed out after %v", name, h.options.Timeout)
+	}
+
+	status := Healthy()
+	if err != nil {
+		status = Unhealthy(err)
+	}
+	latency := time.Since(start)
+	status.Latency = latency.String()
+	return status, latency
+}
+
+func (c *checkSet) add(name string, check CheckFunc) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if _, ok := c.checks[name]; !ok {
+		c.names = append(c.names, name)
+	}
+	c.checks[name] = check
+	c.checkedAt = time.Time{}
+}
+
+/* HealthChecks implementation */
+
+func (r *registryStateReader) IsReady() bool {
+	return r.ServiceStateReader.IsReady() && r.registry.Readiness().State != HealthStateUnhealthy
+}
+
+func (r *registryStateReader) IsHealthy() bool {
+	return r.HealthState() != HealthStateUnhealthy
+}
+
+func (r *registryStateReader) HealthState() string {
+	return r.HealthReport().State
+}
+
+// HealthReport merges the health report of the reader with the health checks of the registry, using the worst state.
+func (r *registryStateReader) HealthReport() HealthReport {
+	report := ReadHealthReport(r.ServiceStateReader)
+	registered := r.registry.Health()
+	if len(registered.Checks) == 0 {
+		return report
+	}
+
+	checks := make(map[string]HealthStatus, len(report.Checks)+len(registered.Checks))
+	for name, status := range report.Checks {
+		checks[name] = status
+	}
+	for name, status := range registered.Checks {
+		checks[name] = status
+	}
+	report.Checks = checks
+	if healthStateValues[registered.State] > healthStateValues[report.State] {
+		report.State = registered.State
+	}
+	return report
+}
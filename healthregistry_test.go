@@ -0,0 +1,119 @@
+package servicefoundation_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	sf "github.com/Prutswonder/go-servicefoundation"
+	"github.com/Prutswonder/go-servicefoundation/servicetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func newTestHealthRegistry(options sf.HealthRegistryOptions) (sf.HealthRegistry, *mockMetrics) {
+	m := &mockMetrics{}
+	m.On("SetGaugeLabels", mock.Anything, "health", mock.Anything, mock.Anything, []string{"check"}, mock.Anything)
+
+	return sf.NewHealthRegistry(options, m), m
+}
+
+func TestHealthRegistry_Health(t *testing.T) {
+	sut, m := newTestHealthRegistry(sf.HealthRegistryOptions{Timeout: 100 * time.Millisecond})
+	slow := func(ctx context.Context) error {
+		time.Sleep(50 * time.Millisecond)
+		return nil
+	}
+	sut.AddHealthCheck("database", slow)
+	sut.AddHealthCheck("queue", slow)
+	sut.AddHealthCheck("downstream-api", func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	sut.AddHealthCheck("cache", func(context.Context) error {
+		time.Sleep(time.Second)
+		return nil
+	})
+	sut.AddHealthCheck("search", func(context.Context) error { panic("boom") })
+	start := time.Now()
+
+	// Act
+	report := sut.Health()
+
+	assert.True(t, time.Since(start) < 500*time.Millisecond, "the checks run concurrently, took %v", time.Since(start))
+	assert.Equal(t, sf.HealthStateUnhealthy, report.State)
+	assert.Equal(t, sf.HealthStateHealthy, report.Checks["database"].State)
+	assert.Equal(t, sf.HealthStateHealthy, report.Checks["queue"].State)
+	assert.Equal(t, "check downstream-api timed out after 100ms", report.Checks["downstream-api"].Reason)
+	assert.Equal(t, "check cache timed out after 100ms", report.Checks["cache"].Reason)
+	assert.Equal(t, "check search panicked: boom", report.Checks["search"].Reason)
+	for name, status := range report.Checks {
+		assert.NotEmpty(t, status.Latency, name)
+	}
+	m.AssertCalled(t, "SetGaugeLabels", float64(2), "health", "check_state", mock.Anything, []string{"check"},
+		[]string{"downstream-api"})
+	m.AssertCalled(t, "SetGaugeLabels", mock.Anything, "health", "check_seconds", mock.Anything, []string{"check"},
+		[]string{"database"})
+	assert.Equal(t, sf.HealthStateHealthy, sut.Readiness().State, "the readiness has its own checks")
+}
+
+func TestHealthRegistry_CacheInterval(t *testing.T) {
+	clock := servicetest.NewFakeClock(time.Date(2017, 6, 15, 10, 0, 0, 0, time.UTC))
+	sut, m := newTestHealthRegistry(sf.HealthRegistryOptions{CacheInterval: 10 * time.Second, Clock: clock})
+	var checks int32
+	sut.AddReadinessCheck("database", func(context.Context) error {
+		atomic.AddInt32(&checks, 1)
+		return nil
+	})
+
+	// Act
+	sut.Readiness()
+	clock.Advance(9 * time.Second)
+	sut.Readiness()
+	cached := atomic.LoadInt32(&checks)
+	clock.Advance(time.Second)
+	sut.Readiness()
+
+	assert.Equal(t, int32(1), cached)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&checks))
+	m.AssertCalled(t, "SetGaugeLabels", float64(0), "health", "readiness_check_state", mock.Anything, []string{"check"},
+		[]string{"database"})
+}
+
+func TestService_HealthAndReadinessChecks(t *testing.T) {
+	opt := sf.NewServiceOptions("checks", []string{http.MethodGet}, nil)
+	sut := sf.NewCustomService(opt)
+	var queueDown int32
+	sut.AddHealthCheck("database", func(context.Context) error { return errors.New("connection refused") })
+	sut.AddReadinessCheck("queue", func(context.Context) error {
+		if atomic.LoadInt32(&queueDown) == 1 {
+			return errors.New("queue unavailable")
+		}
+		return nil
+	})
+	serve := func(subsystem, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		sut.Handler(subsystem).ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+
+	// Act
+	health := serve("internal", "/health_check")
+	ready := serve("readiness", "/service/readiness").Code
+	atomic.StoreInt32(&queueDown, 1)
+	notReady := serve("readiness", "/service/readiness").Code
+
+	assert.Equal(t, http.StatusServiceUnavailable, health.Code)
+	var report sf.HealthReport
+	assert.NoError(t, json.Unmarshal(health.Body.Bytes(), &report))
+	assert.Equal(t, sf.HealthStateUnhealthy, report.State)
+	assert.Equal(t, "connection refused", report.Checks["database"].Reason)
+	assert.NotEmpty(t, report.Checks["database"].Latency)
+	assert.Equal(t, http.StatusOK, ready)
+	assert.Equal(t, http.StatusServiceUnavailable, notReady)
+}
@@ -0,0 +1,70 @@
+package servicefoundation
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/Prutswonder/go-servicefoundation/events"
+)
+
+// InternalAuthHeader is the request header that carries the token of the internal endpoints, next to the
+// Authorization header with the Bearer scheme.
+const InternalAuthHeader = "X-Internal-Token"
+
+// InternalAuthOptions contains the settings of the token authentication of the internal endpoints. Without a Token,
+// the endpoints are not authenticated. Header defaults to X-Internal-Token. The operational endpoints, like /quit, and
+// the endpoints that expose the internals of the service, like /service/info, /service/logs and /debug/pprof/, are
+// always authenticated when a Token is set, and /metrics only with ProtectMetrics, because scrapers need to be
+// configured with the token.
+type InternalAuthOptions struct {
+	Token          string
+	Header         string
+	ProtectMetrics bool
+}
+
+// NewInternalAuthMiddleware returns a MiddlewareFunc that authenticates requests to the internal endpoint with the
+// given name by the shared token of the options, from the Authorization header with the Bearer scheme or from the
+// header of the options. Rejected requests are logged, counted per endpoint and answered with a 401 problem, without
+// calling the endpoint. Without a token, requests are passed on as is.
+func NewInternalAuthMiddleware(name string, options InternalAuthOptions, log Logger, metrics Metrics) MiddlewareFunc {
+	if options.Header == "" {
+		options.Header = InternalAuthHeader
+	}
+	expected := sha256.Sum256([]byte(options.Token))
+
+	return func(next Handle) Handle {
+		if options.Token == "" {
+			return next
+		}
+
+		return func(w WrappedResponseWriter, r *http.Request, p RouterParams) {
+			token := internalAuthToken(r, options.Header)
+			// Compared by hash, so the comparison takes as long for tokens of any length.
+			actual := sha256.Sum256([]byte(token))
+
+			if token == "" || subtle.ConstantTimeCompare(actual[:], expected[:]) != 1 {
+				reason := "invalid"
+				if token == "" {
+					reason = "missing"
+				}
+				NewRequestLogger(r.Context(), log).Warn(events.InternalAuthUnauthorized,
+					"Rejecting %s %s from %s: %s internal token", r.Method, r.URL.Path, r.RemoteAddr, reason)
+				metrics.CountLabels("internal", "unauthorized_total", "Requests to internal endpoints rejected by token authentication.",
+					[]string{"handler", "reason"}, []string{name, reason})
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				WriteProblem(w, http.StatusUnauthorized, "Internal token "+reason)
+				return
+			}
+
+			next(w, r, p)
+		}
+	}
+}
+
+func internalAuthToken(r *http.Request, header string) string {
+	if token := r.Header.Get(header); token != "" {
+		return token
+	}
+	return bearerToken(r)
+}
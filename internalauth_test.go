@@ -0,0 +1,199 @@
+package servicefoundation_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	sf "github.com/Prutswonder/go-servicefoundation"
+	"github.com/Prutswonder/go-servicefoundation/events"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestInternalAuthMiddleware(t *testing.T) {
+	tests := []struct {
+		token    string
+		header   string
+		value    string
+		expected int
+		reason   string
+	}{
+		{"", "", "", http.StatusOK, ""},
+		{"secret", "Authorization", "Bearer secret", http.StatusOK, ""},
+		{"secret", "Authorization", "bearer secret", http.StatusOK, ""},
+		{"secret", sf.InternalAuthHeader, "secret", http.StatusOK, ""},
+		{"secret", "", "", http.StatusUnauthorized, "missing"},
+		{"secret", "Authorization", "Basic c2VjcmV0", http.StatusUnauthorized, "missing"},
+		{"secret", "Authorization", "Bearer wrong", http.StatusUnauthorized, "invalid"},
+		{"secret", sf.InternalAuthHeader, "secret2", http.StatusUnauthorized, "invalid"},
+	}
+
+	for _, test := range tests {
+		log := &mockLogger{}
+		m := &mockMetrics{}
+		log.On("Warn", events.InternalAuthUnauthorized, mock.Anything, mock.Anything).Return(nil)
+		m.On("CountLabels", "internal", "unauthorized_total", mock.Anything, mock.Anything, mock.Anything)
+		called := false
+		sut := sf.NewInternalAuthMiddleware("quit", sf.InternalAuthOptions{Token: test.token}, log, m)
+		r := httptest.NewRequest(http.MethodGet, "/quit", nil)
+		if test.header != "" {
+			r.Header.Set(test.header, test.value)
+		}
+		w := httptest.NewRecorder()
+
+		// Act
+		sut(func(sf.WrappedResponseWriter, *http.Request, sf.RouterParams) {
+			called = true
+		})(sf.NewWrappedResponseWriter(w), r, sf.RouterParams{})
+
+		assert.Equal(t, test.expected, w.Code, "%s: %s", test.header, test.value)
+		assert.Equal(t, test.expected == http.StatusOK, called, "%s: %s", test.header, test.value)
+		if test.reason == "" {
+			m.AssertNotCalled(t, "CountLabels", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+			continue
+		}
+		assert.Equal(t, "Bearer", w.Header().Get("WWW-Authenticate"))
+		log.AssertCalled(t, "Warn", events.InternalAuthUnauthorized, mock.Anything, mock.Anything)
+		m.AssertCalled(t, "CountLabels", "internal", "unauthorized_total", mock.Anything, []string{"handler", "reason"},
+			[]string{"quit", test.reason})
+	}
+}
+
+func TestService_InternalAuth(t *testing.T) {
+	tests := []struct {
+		protectMetrics bool
+		method         string
+		path           string
+		authorized     bool
+		expected       int
+	}{
+		{false, http.MethodGet, "/quit", false, http.StatusUnauthorized},
+		{false, http.MethodPost, "/service/servers/public/restart", false, http.StatusUnauthorized},
+		{false, http.MethodGet, "/metrics", false, http.StatusOK},
+		{false, http.MethodGet, "/service/operations", false, http.StatusOK},
+		{true, http.MethodGet, "/metrics", false, http.StatusUnauthorized},
+		{true, http.MethodGet, "/metrics", true, http.StatusOK},
+		{false, http.MethodGet, "/service/info", false, http.StatusUnauthorized},
+		{false, http.MethodGet, "/service/info", true, http.StatusOK},
+		{false, http.MethodGet, "/service/config/spec", false, http.StatusUnauthorized},
+		{false, http.MethodGet, "/service/config/spec", true, http.StatusOK},
+		{false, http.MethodGet, "/service/logs", false, http.StatusUnauthorized},
+		{false, http.MethodGet, "/service/logs", true, http.StatusOK},
+		{false, http.MethodGet, "/service/profiles/heap/1", false, http.StatusUnauthorized},
+		{false, http.MethodGet, "/service/profiles/heap/1", true, http.StatusNotFound},
+		{false, http.MethodGet, "/debug/pprof/", false, http.StatusUnauthorized},
+		{false, http.MethodGet, "/debug/pprof/", true, http.StatusOK},
+		{false, http.MethodGet, "/debug/vars", false, http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		opt := sf.NewServiceOptions("internal-auth", []string{http.MethodGet}, nil)
+		opt.InternalAuth = sf.InternalAuthOptions{Token: "secret", ProtectMetrics: test.protectMetrics}
+		opt.LogBuffer = sf.NewRingBufferSink(10)
+		opt.Profiler = sf.NewProfiler(sf.ProfilerOptions{}, &mockLogger{}, &mockMetrics{})
+		opt.EnablePprof = true
+		sut := sf.NewCustomService(opt)
+		r := httptest.NewRequest(test.method, test.path, nil)
+		if test.authorized {
+			r.Header.Set("Authorization", "Bearer secret")
+		}
+		w := httptest.NewRecorder()
+
+		// Act
+		sut.Handler("internal").ServeHTTP(w, r)
+
+		assert.Equal(t, test.expected, w.Code, "%s %s", test.method, test.path)
+	}
+}
+
+func TestService_InternalAuthExplained(t *testing.T) {
+	opt := sf.NewServiceOptions("internal-auth", []string{http.MethodGet}, nil)
+	opt.InternalAuth = sf.InternalAuthOptions{Token: "secret"}
+	sut := sf.NewCustomService(opt)
+	sut.Handler("internal")
+
+	// Act
+	explanation, err := sf.ExplainRoute(sut, "internal/quit")
+
+	assert.NoError(t, err)
+	var middlewares []string
+	for _, middleware := range explanation.Middlewares {
+		middlewares = append(middlewares, middleware.Name)
+	}
+	assert.Contains(t, middlewares, "internal_auth")
+	for _, route := range sut.Routes() {
+		if route.Subsystem == "internal" && (route.Name == "quit" || route.Name == "metrics") {
+			assert.Equal(t, route.Name == "quit", route.Authenticated, route.Name)
+		}
+	}
+}
+
+func TestService_QuitOptions(t *testing.T) {
+	tests := []struct {
+		disable  bool
+		methods  []string
+		method   string
+		expected bool
+	}{
+		{false, nil, http.MethodGet, true},
+		{false, []string{http.MethodPost}, http.MethodPost, true},
+		{false, []string{http.MethodPost}, http.MethodGet, false},
+		{true, nil, http.MethodGet, false},
+	}
+
+	for _, test := range tests {
+		opt := sf.NewServiceOptions("quit", []string{http.MethodGet}, nil)
+		opt.DisableQuit = test.disable
+		opt.QuitMethods = test.methods
+		sut := sf.NewCustomService(opt)
+		w := httptest.NewRecorder()
+
+		// Act
+		sut.Handler("internal").ServeHTTP(w, httptest.NewRequest(test.method, "/quit", nil))
+
+		assert.Equal(t, test.expected, w.Code == http.StatusOK, "%v %v %s: %d", test.disable, test.methods, test.method, w.Code)
+		_, operations := readOperations(t, sut)
+		_, listed := operations[sf.OperationShutdown]
+		assert.Equal(t, !test.disable, listed)
+	}
+}
+
+func TestServiceImpl_QuitRequiresInternalToken(t *testing.T) {
+	shutdowns := make(chan string, 1)
+	exitCodes := make(chan int, 1)
+	sut := newRunService(shutdowns, exitCodes, func(opt *sf.ServiceOptions) {
+		opt.InternalAuth = sf.InternalAuthOptions{Token: "secret"}
+	})
+	go sut.RunAndExit(context.Background())
+	quit := "http://" + waitForAddr(t, sut, "internal").String() + "/quit"
+
+	// Act
+	resp, err := http.Get(quit)
+
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	}
+	select {
+	case <-exitCodes:
+		t.Fatal("an unauthenticated quit shut the service down")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	r, _ := http.NewRequest(http.MethodGet, quit, nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	resp, err = http.DefaultClient.Do(r)
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+	select {
+	case code := <-exitCodes:
+		assert.Equal(t, 0, code)
+	case <-time.After(5 * time.Second):
+		t.Fatal("quit did not shut the service down")
+	}
+}
@@ -0,0 +1,196 @@
+package servicefoundation
+
+import (
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Prutswonder/go-servicefoundation/events"
+)
+
+const (
+	defaultLatencyAlpha      = 0.05
+	defaultLatencyFactor     = 3
+	defaultLatencyFloor      = 50 * time.Millisecond
+	defaultLatencyMinSamples = 100
+)
+
+var correlationHeaders = []string{"X-Request-Id", "X-Correlation-Id"}
+
+type (
+	// LatencyOptions contains the settings for detecting requests that are slow compared to the baseline of their
+	// route. The baseline is an exponentially weighted moving average with weight Alpha for new samples, so it tracks
+	// gradual shifts. A request is anomalous when it takes longer than Factor times the baseline and longer than Floor,
+	// after at least MinSamples requests were observed for the route.
+	LatencyOptions struct {
+		Alpha      float64
+		Factor     float64
+		Floor      time.Duration
+		MinSamples int
+	}
+
+	// LatencyBaseline contains the current latency baseline of a route.
+	LatencyBaseline struct {
+		MeanMilliseconds   float64 `json:"mean_ms"`
+		StdDevMilliseconds float64 `json:"stddev_ms"`
+		Samples            int     `json:"samples"`
+	}
+
+	// LatencyBaselines keeps a latency baseline per route and detects requests that exceed it.
+	LatencyBaselines interface {
+		Middleware(route string) MiddlewareFunc
+		Observe(route string, duration time.Duration) (LatencyBaseline, bool)
+		Baselines() map[string]LatencyBaseline
+	}
+
+	latencyBaselinesImpl struct {
+		options LatencyOptions
+		log     Logger
+		metrics Metrics
+		mutex   sync.Mutex
+		routes  map[string]*latencyStats
+	}
+
+	latencyStats struct {
+		mean     float64
+		variance float64
+		samples  int
+	}
+)
+
+// NewLatencyBaselines creates and returns a new LatencyBaselines implementation.
+func NewLatencyBaselines(options LatencyOptions, log Logger, metrics Metrics) LatencyBaselines {
+	if options.Alpha <= 0 || options.Alpha >= 1 {
+		options.Alpha = defaultLatencyAlpha
+	}
+	if options.Factor <= 1 {
+		options.Factor = defaultLatencyFactor
+	}
+	if options.Floor <= 0 {
+		options.Floor = defaultLatencyFloor
+	}
+	if options.MinSamples <= 0 {
+		options.MinSamples = defaultLatencyMinSamples
+	}
+
+	return &latencyBaselinesImpl{
+		options: options,
+		log:     log,
+		metrics: metrics,
+		routes:  make(map[string]*latencyStats),
+	}
+}
+
+// NewLatencyBaselinesHandler returns a handler that returns the current latency baselines per route.
+func NewLatencyBaselinesHandler(baselines LatencyBaselines) Handle {
+	return func(w WrappedResponseWriter, _ *http.Request, _ RouterParams) {
+		w.JSON(http.StatusOK, baselines.Baselines())
+	}
+}
+
+/* LatencyBaselines implementation */
+
+// Middleware returns a MiddlewareFunc that measures the handler duration and logs it as a warning when it exceeds the
+// baseline of the route. Synthetic requests are not measured.
+func (l *latencyBaselinesImpl) Middleware(route string) MiddlewareFunc {
+	return func(next Handle) Handle {
+		return func(w WrappedResponseWriter, r *http.Request, p RouterParams) {
+			if IsSynthetic(r.Context()) {
+				// Synthetic traffic, like load tests, would skew the baseline.
+				next(w, r, p)
+				return
+			}
+			start := time.Now()
+
+			next(w, r, p)
+
+			duration := time.Since(start)
+			baseline, anomalous := l.Observe(route, duration)
+
+			if !anomalous {
+				return
+			}
+
+			l.log.Warn(events.AnomalousLatency,
+				"Route %s took %v, baseline %.2fms (stddev %.2fms, %d samples), status %d, correlation ID '%s'",
+				route, duration, baseline.MeanMilliseconds, baseline.StdDevMilliseconds, baseline.Samples, w.Status(),
+				correlationID(r))
+			l.metrics.CountLabels("", "anomalous_latency_total", "Total requests exceeding their latency baseline.",
+				[]string{"route"}, []string{route})
+		}
+	}
+}
+
+// Observe adds the duration to the baseline of the route. It returns the baseline before the duration was added and
+// whether the duration is anomalous.
+func (l *latencyBaselinesImpl) Observe(route string, duration time.Duration) (LatencyBaseline, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	stats, ok := l.routes[route]
+	if !ok {
+		stats = &latencyStats{}
+		l.routes[route] = stats
+	}
+
+	baseline := stats.baseline()
+	ms := durationToMilliseconds(duration)
+
+	anomalous := stats.samples >= l.options.MinSamples &&
+		duration > l.options.Floor &&
+		ms > stats.mean*l.options.Factor
+
+	stats.add(ms, l.options.Alpha)
+	return baseline, anomalous
+}
+
+func (l *latencyBaselinesImpl) Baselines() map[string]LatencyBaseline {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	baselines := make(map[string]LatencyBaseline, len(l.routes))
+	for route, stats := range l.routes {
+		baselines[route] = stats.baseline()
+	}
+	return baselines
+}
+
+func (s *latencyStats) add(ms, alpha float64) {
+	s.samples++
+
+	if s.samples == 1 {
+		s.mean = ms
+		return
+	}
+
+	// Incremental exponentially weighted mean and variance.
+	diff := ms - s.mean
+	increment := alpha * diff
+	s.mean += increment
+	s.variance = (1 - alpha) * (s.variance + diff*increment)
+}
+
+func (s *latencyStats) baseline() LatencyBaseline {
+	return LatencyBaseline{
+		MeanMilliseconds:   s.mean,
+		StdDevMilliseconds: math.Sqrt(s.variance),
+		Samples:            s.samples,
+	}
+}
+
+func durationToMilliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func correlationID(r *http.Request) string {
+	if id := RequestIDFromContext(r.Context()); id != "" {
+		return id
+	}
+	for _, header := range correlationHeaders {
+		if id := r.Header.Get(header); id != "" {
+			return id
+		}
+	}
+	return ""
+}
@@ -0,0 +1,105 @@
+package servicefoundation_test
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	sf "github.com/Prutswonder/go-servicefoundation"
+	"github.com/Prutswonder/go-servicefoundation/servicetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func newTestLatencyBaselines() (sf.LatencyBaselines, *mockLogger, *mockMetrics) {
+	log := &mockLogger{}
+	m := &mockMetrics{}
+	options := sf.LatencyOptions{Alpha: 0.1, Factor: 3, Floor: 10 * time.Millisecond, MinSamples: 10}
+
+	return sf.NewLatencyBaselines(options, log, m), log, m
+}
+
+func observeAll(sut sf.LatencyBaselines, route string, durations ...time.Duration) []int {
+	var triggered []int
+	for i, d := range durations {
+		if _, anomalous := sut.Observe(route, d); anomalous {
+			triggered = append(triggered, i)
+		}
+	}
+	return triggered
+}
+
+func repeat(d time.Duration, n int) []time.Duration {
+	durations := make([]time.Duration, n)
+	for i := range durations {
+		durations[i] = d
+	}
+	return durations
+}
+
+func TestLatencyBaselines_WarmUp(t *testing.T) {
+	sut, _, _ := newTestLatencyBaselines()
+	durations := append(repeat(20*time.Millisecond, 5), 200*time.Millisecond)
+	durations = append(durations, repeat(20*time.Millisecond, 5)...)
+	durations = append(durations, 200*time.Millisecond)
+
+	// Act
+	triggered := observeAll(sut, "orders", durations...)
+
+	// The first outlier is part of the warm-up, the second is not.
+	assert.Equal(t, []int{11}, triggered)
+}
+
+func TestLatencyBaselines_OnlyGenuineOutliers(t *testing.T) {
+	sut, _, _ := newTestLatencyBaselines()
+	durations := repeat(20*time.Millisecond, 20)
+	durations = append(durations, 50*time.Millisecond, 25*time.Millisecond, 70*time.Millisecond)
+
+	// Act
+	triggered := observeAll(sut, "orders", durations...)
+
+	assert.Equal(t, []int{22}, triggered)
+}
+
+func TestLatencyBaselines_AbsoluteFloor(t *testing.T) {
+	sut, _, _ := newTestLatencyBaselines()
+	durations := append(repeat(100*time.Microsecond, 20), 5*time.Millisecond)
+
+	// Act
+	triggered := observeAll(sut, "ping", durations...)
+
+	assert.Empty(t, triggered)
+}
+
+func TestLatencyBaselines_TracksGradualShift(t *testing.T) {
+	sut, _, _ := newTestLatencyBaselines()
+	var durations []time.Duration
+	for i := 0; i < 200; i++ {
+		durations = append(durations, time.Duration(20+i)*time.Millisecond)
+	}
+
+	// Act
+	triggered := observeAll(sut, "orders", durations...)
+
+	assert.Empty(t, triggered)
+	assert.True(t, sut.Baselines()["orders"].MeanMilliseconds > 150)
+}
+
+func TestLatencyBaselines_MiddlewareLogsOutlier(t *testing.T) {
+	sut, log, m := newTestLatencyBaselines()
+	log.On("Warn", "AnomalousLatency", mock.Anything, mock.Anything).Return(nil)
+	m.On("CountLabels", "", "anomalous_latency_total", mock.Anything, []string{"route"}, []string{"orders"})
+	observeAll(sut, "orders", repeat(time.Millisecond, 10)...)
+	r, _ := http.NewRequest(http.MethodGet, "/orders", nil)
+	r.Header.Set("X-Request-Id", "abc")
+	slow := func(w sf.WrappedResponseWriter, _ *http.Request, _ sf.RouterParams) {
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// Act
+	servicetest.RunMiddlewareWithHandler(sut.Middleware("orders"), r, slow)
+
+	log.AssertExpectations(t)
+	m.AssertExpectations(t)
+	assert.Equal(t, 11, sut.Baselines()["orders"].Samples)
+}
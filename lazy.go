@@ -0,0 +1,370 @@
+package servicefoundation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Prutswonder/go-servicefoundation/events"
+)
+
+// The initialization states of a lazy resource.
+const (
+	LazyStatePending      = "pending"
+	LazyStateInitializing = "initializing"
+	LazyStateReady        = "ready"
+	LazyStateFailed       = "failed"
+)
+
+// The initialization modes of a lazy resource.
+const (
+	// LazyModeOnDemand initializes the resource on its first use.
+	LazyModeOnDemand = "on_demand"
+	// LazyModePrewarm initializes the resource in the background after the service became ready.
+	LazyModePrewarm = "prewarm"
+	// LazyModeReadiness initializes the resource at startup, and keeps the service not ready until it succeeded.
+	LazyModeReadiness = "readiness"
+)
+
+const (
+	lazySubsystem = "lazy"
+
+	defaultLazyTimeout      = 30 * time.Second
+	defaultLazyRetryAfter   = 5 * time.Second
+	defaultLazyPollInterval = 100 * time.Millisecond
+)
+
+type (
+	// LazyInitFunc initializes a lazy resource. The context is cancelled after the timeout of the resource.
+	LazyInitFunc func(ctx context.Context) (interface{}, error)
+
+	// LazyOptions contains the settings of a lazy resource. Every initialization attempt is cancelled after Timeout,
+	// which defaults to 30 seconds. A failed attempt is returned to callers for RetryAfter, which defaults to 5
+	// seconds, after which the next use tries again. Mode is one of the LazyMode values, and defaults to on demand.
+	LazyOptions struct {
+		Timeout    time.Duration
+		RetryAfter time.Duration
+		Mode       string
+	}
+
+	// LazyResourcesOptions contains the settings of the LazyResources. PollInterval is the interval at which the
+	// readiness of the service is checked before pre-warming, and defaults to 100 milliseconds.
+	LazyResourcesOptions struct {
+		Clock        Clock
+		PollInterval time.Duration
+	}
+
+	// LazyStatus is the initialization state of a lazy resource, as listed in /service/info.
+	LazyStatus struct {
+		Name         string     `json:"name"`
+		Mode         string     `json:"mode"`
+		State        string     `json:"state"`
+		Attempts     int        `json:"attempts"`
+		InitDuration string     `json:"initDuration,omitempty"`
+		Error        string     `json:"error,omitempty"`
+		RetryAt      *time.Time `json:"retryAt,omitempty"`
+	}
+
+	// LazyResource is an expensive singleton that is initialized once, on its first use or by the warm-up of the
+	// service. Concurrent callers of Get share a single initialization.
+	LazyResource interface {
+		Get(ctx context.Context) (interface{}, error)
+		Status() LazyStatus
+	}
+
+	// LazyResources manages the lazy resources of the service. Start runs the warm-up: it initializes the resources
+	// with the readiness mode right away and pre-warms the others with the prewarm mode once ready returns true.
+	// IsReady returns true when all resources with the readiness mode are initialized.
+	LazyResources interface {
+		Lazy(name string, init LazyInitFunc, options LazyOptions) LazyResource
+		Start(ctx context.Context, ready func() bool)
+		IsReady() bool
+		Statuses() []LazyStatus
+	}
+
+	lazyResourcesImpl struct {
+		options   LazyResourcesOptions
+		log       Logger
+		metrics   Metrics
+		mutex     sync.Mutex
+		resources []*lazyResourceImpl
+	}
+
+	lazyResourceImpl struct {
+		name     string
+		init     LazyInitFunc
+		options  LazyOptions
+		parent   *lazyResourcesImpl
+		mutex    sync.Mutex
+		state    string
+		value    interface{}
+		err      error
+		attempts int
+		duration time.Duration
+		retryAt  time.Time
+		done     chan struct{}
+	}
+
+	// lazyStateReader adds the readiness of the lazy resources to the readiness of the service.
+	lazyStateReader struct {
+		ServiceStateReader
+		resources LazyResources
+	}
+)
+
+var lazyStateValues = map[string]float64{
+	LazyStatePending:      0,
+	LazyStateInitializing: 1,
+	LazyStateReady:        2,
+	LazyStateFailed:       3,
+}
+
+// NewLazyResources instantiates a new LazyResources implementation.
+func NewLazyResources(options LazyResourcesOptions, log Logger, metrics Metrics) LazyResources {
+	if options.Clock == nil {
+		options.Clock = NewSystemClock()
+	}
+	if options.PollInterval <= 0 {
+		options.PollInterval = defaultLazyPollInterval
+	}
+
+	return &lazyResourcesImpl{
+		options: options,
+		log:     log,
+		metrics: metrics,
+	}
+}
+
+// NewLazyStateReader returns a ServiceStateReader that is only ready when the reader is ready and all resources with
+// the readiness mode are initialized. Its health report is the one of the reader.
+func NewLazyStateReader(reader ServiceStateReader, resources LazyResources) ServiceStateReader {
+	return &lazyStateReader{ServiceStateReader: reader, resources: resources}
+}
+
+/* LazyResources implementation */
+
+// Lazy registers the lazy resource. The name must be unique; a duplicate name returns the registered resource.
+func (l *lazyResourcesImpl) Lazy(name string, init LazyInitFunc, options LazyOptions) LazyResource {
+	if options.Timeout <= 0 {
+		options.Timeout = defaultLazyTimeout
+	}
+	if options.RetryAfter <= 0 {
+		options.RetryAfter = defaultLazyRetryAfter
+	}
+	if options.Mode == "" {
+		options.Mode = LazyModeOnDemand
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for _, r := range l.resources {
+		if r.name == name {
+			l.log.Error(events.LazyResource, "Lazy resource %s is already registered", name)
+			return r
+		}
+	}
+
+	r := &lazyResourceImpl{name: name, init: init, options: options, parent: l, state: LazyStatePending}
+	l.resources = append(l.resources, r)
+	r.setGauges()
+	return r
+}
+
+func (l *lazyResourcesImpl) Start(ctx context.Context, ready func() bool) {
+	resources := l.registered()
+
+	for _, r := range resources {
+		if r.options.Mode == LazyModeReadiness {
+			go r.warmUp(ctx)
+		}
+	}
+
+	go func() {
+		for !l.IsReady() || !ready() {
+			select {
+			case <-ctx.Done():
+				return
+			case <-l.options.Clock.After(l.options.PollInterval):
+			}
+		}
+
+		// One at a time and in the order of registration, so pre-warming doesn't compete for resources with the
+		// first requests.
+		for _, r := range resources {
+			if r.options.Mode == LazyModePrewarm && ctx.Err() == nil {
+				r.Get(ctx)
+			}
+		}
+	}()
+}
+
+func (l *lazyResourcesImpl) IsReady() bool {
+	for _, r := range l.registered() {
+		if r.options.Mode == LazyModeReadiness && r.Status().State != LazyStateReady {
+			return false
+		}
+	}
+	return true
+}
+
+func (l *lazyResourcesImpl) Statuses() []LazyStatus {
+	resources := l.registered()
+	statuses := make([]LazyStatus, 0, len(resources))
+	for _, r := range resources {
+		statuses = append(statuses, r.Status())
+	}
+	return statuses
+}
+
+func (l *lazyResourcesImpl) registered() []*lazyResourceImpl {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return append([]*lazyResourceImpl(nil), l.resources...)
+}
+
+/* LazyResource implementation */
+
+// Get returns the resource, initializing it when it isn't yet. While a failed initialization is cached, its error is
+// returned without trying again. Get returns early when the context is done, but the initialization continues for the
+// other callers.
+func (r *lazyResourceImpl) Get(ctx context.Context) (interface{}, error) {
+	r.mutex.Lock()
+	switch {
+	case r.state == LazyStateReady:
+		r.mutex.Unlock()
+		return r.value, nil
+	case r.state == LazyStateFailed && r.parent.options.Clock.Now().Before(r.retryAt):
+		err := r.err
+		r.mutex.Unlock()
+		return nil, err
+	case r.state != LazyStateInitializing:
+		r.state = LazyStateInitializing
+		r.attempts++
+		r.done = make(chan struct{})
+		r.setGauges()
+		go r.initialize(r.done)
+	}
+	done := r.done
+	r.mutex.Unlock()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.value, r.err
+}
+
+func (r *lazyResourceImpl) Status() LazyStatus {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	status := LazyStatus{Name: r.name, Mode: r.options.Mode, State: r.state, Attempts: r.attempts}
+	if r.duration > 0 {
+		status.InitDuration = r.duration.String()
+	}
+	if r.state == LazyStateFailed {
+		retryAt := r.retryAt
+		status.Error = r.err.Error()
+		status.RetryAt = &retryAt
+	}
+	return status
+}
+
+// initialize runs an initialization attempt with a context of its own, so a caller that gives up doesn't fail it for
+// the others.
+func (r *lazyResourceImpl) initialize(done chan struct{}) {
+	defer close(done)
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.options.Timeout)
+	defer cancel()
+
+	start := r.parent.options.Clock.Now()
+	value, err := r.safeInit(ctx)
+	if err == nil && ctx.Err() != nil {
+		err = fmt.Errorf("Initialization of %s timed out after %v", r.name, r.options.Timeout)
+	}
+	duration := r.parent.options.Clock.Now().Sub(start)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.duration = duration
+	result := "success"
+	if err != nil {
+		r.state, r.value, r.err = LazyStateFailed, nil, err
+		r.retryAt = r.parent.options.Clock.Now().Add(r.options.RetryAfter)
+		result = "failure"
+		r.parent.log.Error(events.LazyResource, "Initializing %s failed, retrying after %v: %v", r.name,
+			r.options.RetryAfter, err)
+	} else {
+		r.state, r.value, r.err = LazyStateReady, value, nil
+		r.parent.log.Info(events.LazyResource, "Initialized %s in %v", r.name, duration)
+	}
+
+	r.parent.metrics.CountLabels(lazySubsystem, "init_total", "Total initialization attempts of lazy resources.",
+		[]string{"resource", "result"}, []string{r.name, result})
+	r.parent.metrics.SetGaugeLabels(duration.Seconds(), lazySubsystem, "init_seconds",
+		"Duration of the last initialization attempt of lazy resources in seconds.", []string{"resource"},
+		[]string{r.name})
+	r.setGauges()
+}
+
+// safeInit runs the init func, returning a panic as an error so the resource can be retried.
+func (r *lazyResourceImpl) safeInit(ctx context.Context) (value interface{}, err error) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			err = fmt.Errorf("Initialization of %s panicked: %v", r.name, rec)
+		}
+	}()
+
+	value, err = r.init(ctx)
+	if err == nil && value == nil {
+		err = errors.New("Initialization of " + r.name + " returned nil")
+	}
+	return value, err
+}
+
+// warmUp initializes the resource until it succeeds, because the service isn't ready before.
+func (r *lazyResourceImpl) warmUp(ctx context.Context) {
+	for {
+		if _, err := r.Get(ctx); err == nil || ctx.Err() != nil {
+			return
+		}
+
+		r.mutex.Lock()
+		wait := r.retryAt.Sub(r.parent.options.Clock.Now())
+		r.mutex.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.parent.options.Clock.After(wait):
+		}
+	}
+}
+
+// setGauges reports the state of the resource. The caller must hold the mutex.
+func (r *lazyResourceImpl) setGauges() {
+	r.parent.metrics.SetGaugeLabels(lazyStateValues[r.state], lazySubsystem, "state",
+		"State of lazy resources: 0 pending, 1 initializing, 2 ready, 3 failed.", []string{"resource"},
+		[]string{r.name})
+}
+
+/* ServiceStateReader implementation */
+
+func (r *lazyStateReader) IsReady() bool {
+	return r.resources.IsReady() && r.ServiceStateReader.IsReady()
+}
+
+// HealthReport keeps the optional health extensions of the wrapped reader.
+func (r *lazyStateReader) HealthReport() HealthReport {
+	return ReadHealthReport(r.ServiceStateReader)
+}
@@ -0,0 +1,207 @@
+package servicefoundation_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	sf "github.com/Prutswonder/go-servicefoundation"
+	"github.com/Prutswonder/go-servicefoundation/servicetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func newTestLazyResources(clock sf.Clock) (sf.LazyResources, *mockMetrics) {
+	log := &mockLogger{}
+	log.On("Info", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	log.On("Error", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	m := &mockMetrics{}
+	m.On("CountLabels", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+	m.On("SetGaugeLabels", mock.Anything, "lazy", mock.Anything, mock.Anything, []string{"resource"}, mock.Anything)
+	return sf.NewLazyResources(sf.LazyResourcesOptions{Clock: clock, PollInterval: 5 * time.Millisecond}, log, m), m
+}
+
+// waitForLazy polls the condition, because the warm-up runs in the background.
+func waitForLazy(condition func() bool) bool {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if condition() {
+			return true
+		}
+	}
+	return false
+}
+
+func waitForLazyState(resource sf.LazyResource, state string) bool {
+	return waitForLazy(func() bool { return resource.Status().State == state })
+}
+
+func TestLazyResource_ConcurrentFirstAccess(t *testing.T) {
+	var inits int32
+	resources, m := newTestLazyResources(nil)
+	sut := resources.Lazy("templates", func(context.Context) (interface{}, error) {
+		atomic.AddInt32(&inits, 1)
+		time.Sleep(50 * time.Millisecond)
+		return "parsed", nil
+	}, sf.LazyOptions{})
+	var wg sync.WaitGroup
+	values := make([]interface{}, 20)
+
+	// Act
+	for i := range values {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			values[i], _ = sut.Get(context.Background())
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&inits))
+	for _, value := range values {
+		assert.Equal(t, "parsed", value)
+	}
+	status := sut.Status()
+	assert.Equal(t, sf.LazyStateReady, status.State)
+	assert.Equal(t, 1, status.Attempts)
+	assert.NotEmpty(t, status.InitDuration)
+	m.AssertCalled(t, "SetGaugeLabels", float64(2), "lazy", "state", mock.Anything, []string{"resource"},
+		[]string{"templates"})
+	m.AssertCalled(t, "SetGaugeLabels", mock.Anything, "lazy", "init_seconds", mock.Anything, []string{"resource"},
+		[]string{"templates"})
+}
+
+func TestLazyResource_FailedThenRetried(t *testing.T) {
+	clock := servicetest.NewFakeClock(time.Date(2017, 6, 15, 10, 0, 0, 0, time.UTC))
+	var inits int32
+	resources, _ := newTestLazyResources(clock)
+	sut := resources.Lazy("model", func(context.Context) (interface{}, error) {
+		if atomic.AddInt32(&inits, 1) == 1 {
+			return nil, errors.New("model store unavailable")
+		}
+		return "model", nil
+	}, sf.LazyOptions{RetryAfter: 10 * time.Second})
+
+	// Act
+	_, first := sut.Get(context.Background())
+	_, cached := sut.Get(context.Background())
+	failed := sut.Status()
+	clock.Advance(10 * time.Second)
+	value, err := sut.Get(context.Background())
+
+	assert.EqualError(t, first, "model store unavailable")
+	assert.Equal(t, first, cached, "the failure is cached until the retry")
+	assert.Equal(t, sf.LazyStateFailed, failed.State)
+	assert.Equal(t, "model store unavailable", failed.Error)
+	if assert.NotNil(t, failed.RetryAt) {
+		assert.Equal(t, clock.Now(), *failed.RetryAt)
+	}
+	assert.NoError(t, err)
+	assert.Equal(t, "model", value)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&inits))
+	assert.Equal(t, 2, sut.Status().Attempts)
+}
+
+func TestLazyResource_TimeoutAndCancelledCaller(t *testing.T) {
+	release := make(chan struct{})
+	resources, _ := newTestLazyResources(nil)
+	sut := resources.Lazy("lookup", func(ctx context.Context) (interface{}, error) {
+		select {
+		case <-release:
+			return "table", nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}, sf.LazyOptions{Timeout: time.Second})
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	// Act
+	_, err := sut.Get(ctx)
+	close(release)
+	value, _ := sut.Get(context.Background())
+
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Equal(t, "table", value, "the initialization continued for the other callers")
+	assert.Equal(t, 1, sut.Status().Attempts)
+}
+
+func TestLazyResources_PrewarmAfterReadiness(t *testing.T) {
+	sut, _ := newTestLazyResources(nil)
+	var ready int32
+	var prewarmedWhileNotReady int32
+	prewarm := sut.Lazy("templates", func(context.Context) (interface{}, error) {
+		if atomic.LoadInt32(&ready) == 0 {
+			atomic.StoreInt32(&prewarmedWhileNotReady, 1)
+		}
+		return "parsed", nil
+	}, sf.LazyOptions{Mode: sf.LazyModePrewarm})
+	onDemand := sut.Lazy("reports", func(context.Context) (interface{}, error) {
+		return "report", nil
+	}, sf.LazyOptions{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Act
+	sut.Start(ctx, func() bool { return atomic.LoadInt32(&ready) == 1 })
+	time.Sleep(50 * time.Millisecond)
+	pending := prewarm.Status().State
+	atomic.StoreInt32(&ready, 1)
+
+	assert.Equal(t, sf.LazyStatePending, pending, "nothing is pre-warmed before the service is ready")
+	assert.True(t, waitForLazyState(prewarm, sf.LazyStateReady))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&prewarmedWhileNotReady))
+	assert.Equal(t, sf.LazyStatePending, onDemand.Status().State, "on demand resources wait for their first use")
+	assert.True(t, sut.IsReady())
+}
+
+func TestLazyResources_ReadinessBlocking(t *testing.T) {
+	opt := sf.NewServiceOptions("lazy", []string{http.MethodGet}, nil)
+	release := make(chan struct{})
+	var inits int32
+	model := opt.LazyResources.Lazy("model", func(context.Context) (interface{}, error) {
+		if atomic.AddInt32(&inits, 1) == 1 {
+			return nil, errors.New("model store unavailable")
+		}
+		<-release
+		return "model", nil
+	}, sf.LazyOptions{Mode: sf.LazyModeReadiness, RetryAfter: 10 * time.Millisecond})
+	opt.SetHandlers()
+	sut := sf.NewCustomService(opt)
+	readiness := func() int {
+		w := httptest.NewRecorder()
+		sut.Handler("readiness").ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/service/readiness", nil))
+		return w.Code
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	assert.Equal(t, http.StatusServiceUnavailable, readiness(), "not ready before the warm-up")
+
+	// Act
+	opt.LazyResources.Start(ctx, func() bool { return true })
+
+	assert.True(t, waitForLazy(func() bool { return atomic.LoadInt32(&inits) == 2 }),
+		"the failed initialization is retried during the warm-up")
+	assert.Equal(t, http.StatusServiceUnavailable, readiness())
+	close(release)
+	assert.True(t, waitForLazyState(model, sf.LazyStateReady))
+	assert.Equal(t, http.StatusOK, readiness())
+
+	w := httptest.NewRecorder()
+	sut.Handler("internal").ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/service/info", nil))
+	var info struct {
+		LazyResources []sf.LazyStatus `json:"lazyResources"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &info))
+	if assert.Len(t, info.LazyResources, 1) {
+		assert.Equal(t, "model", info.LazyResources[0].Name)
+		assert.Equal(t, sf.LazyModeReadiness, info.LazyResources[0].Mode)
+		assert.Equal(t, sf.LazyStateReady, info.LazyResources[0].State)
+		assert.Equal(t, 2, info.LazyResources[0].Attempts)
+	}
+}
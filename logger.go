@@ -3,9 +3,12 @@ package servicefoundation
 import (
 	"fmt"
 	"os"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/Prutswonder/go-servicefoundation/events"
 	"github.com/Travix-International/logger"
 )
 
@@ -13,6 +16,7 @@ const (
 	minDebugLevel = 1
 	minInfoLevel  = 2
 	minWarnLevel  = 3
+	minErrorLevel = 4
 	defaultLevel  = "warning"
 )
 
@@ -26,95 +30,280 @@ type (
 		GetLogger() *logger.Logger
 	}
 
+	// StructuredLogger is a Logger that can attach fields to its entries, which sinks in the JSON format write as
+	// discrete fields. Use WithFields to attach fields to any Logger.
+	StructuredLogger interface {
+		Logger
+		WithFields(fields map[string]interface{}) Logger
+	}
+
+	// SinkLogger is a Logger that writes every entry to multiple sinks.
+	SinkLogger interface {
+		Logger
+		SinkErrors() map[string]int
+	}
+
+	// LogSink configures a named Sink with its own minimum log level.
+	LogSink struct {
+		Name     string
+		MinLevel string
+		Sink     Sink
+	}
+
 	loggerImpl struct {
-		logMinLevel int
-		logger      *logger.Logger
+		sinks      []LogSink
+		sinkLevels []int
+		globals    ServiceGlobals
+		mutex      sync.Mutex
+		errors     map[string]int
+	}
+
+	// fieldLogger writes the entries of the logger with fields.
+	fieldLogger struct {
+		*loggerImpl
+		fields map[string]interface{}
+	}
+
+	// messageFieldsLogger appends the fields to the messages of a Logger that can't attach them to its entries.
+	messageFieldsLogger struct {
+		Logger
+		fields map[string]interface{}
 	}
 )
 
 var (
-	levels          = []string{"debug", "info", "warning", "error"}
-	loggerInstances = make(map[string]*loggerImpl)
-	once            sync.Once
+	levels       = []string{"debug", "info", "warning", "error"}
+	sharedLogger *logger.Logger
+	once         sync.Once
 )
 
-// NewLogger instantiates a new Logger implementation.
+// NewLogger instantiates a new Logger implementation, which writes to stdout in the format configured by LOG_FORMAT:
+// text, or json for one JSON document per line.
 func NewLogger(logMinFilter string) Logger {
-	once.Do(func() {
-		for i, level := range levels {
-			log := logger.New()
-			consoleLogFormat := logger.NewStringFormat("[%s] ", "[%s] ", "%s\n", " (%s=", "%s)")
-			consoleTransport := logger.NewTransport(os.Stdout, consoleLogFormat)
-			log.AddTransport(consoleTransport)
-
-			loggerInstances[level] = &loggerImpl{
-				logger:      log,
-				logMinLevel: i + 1,
-			}
-		}
-	})
-	return getLogInstance(logMinFilter)
+	return newStdoutLogger(logMinFilter, ServiceGlobals{})
 }
 
-/* Logger implementation */
+// NewSinkLogger instantiates a new Logger implementation that fans out every entry to the sinks with a sufficient
+// minimum level. A failing sink does not affect the other sinks; its errors are counted and exposed via SinkErrors.
+func NewSinkLogger(sinks []LogSink) SinkLogger {
+	return newSinkLogger(sinks, ServiceGlobals{})
+}
 
-func (l *loggerImpl) Debug(event, formatOrMsg string, a ...interface{}) error {
-	if l.logMinLevel > minDebugLevel {
-		return nil
+// WithFields returns a Logger that attaches the fields to every entry of the logger, like the method and path of a
+// request. A Logger that isn't a StructuredLogger, like a mock, gets the fields appended to its messages instead.
+func WithFields(log Logger, fields map[string]interface{}) Logger {
+	if structured, ok := log.(StructuredLogger); ok {
+		return structured.WithFields(fields)
 	}
+	return &messageFieldsLogger{Logger: log, fields: mergeFields(nil, fields)}
+}
 
-	if len(a) == 0 {
-		return l.logger.Debug(event, formatOrMsg)
+// newStdoutLogger creates a Logger that writes to stdout, with the application, server and deployment environment of
+// the globals in every entry.
+func newStdoutLogger(logMinFilter string, globals ServiceGlobals) Logger {
+	format, err := parseLogFormat(logFormatVariable.String())
+	if err != nil {
+		format = TextFormat
 	}
-	return l.logger.Debug(event, fmt.Sprintf(formatOrMsg, a...))
+
+	l := newSinkLogger([]LogSink{
+		{Name: "stdout", MinLevel: logMinFilter, Sink: NewStdoutSink(format)},
+	}, globals)
+	if err != nil {
+		l.Warn(events.LogFormat, "Failed parsing log format '%s', defaulting to text", logFormatVariable.String())
+	}
+	return l
 }
 
-func (l *loggerImpl) Info(event, formatOrMsg string, a ...interface{}) error {
-	if l.logMinLevel > minInfoLevel {
-		return nil
+func newSinkLogger(sinks []LogSink, globals ServiceGlobals) SinkLogger {
+	l := &loggerImpl{
+		sinks:      sinks,
+		sinkLevels: make([]int, len(sinks)),
+		globals:    globals,
+		errors:     make(map[string]int),
 	}
 
-	if len(a) == 0 {
-		return l.logger.Info(event, formatOrMsg)
+	var invalid []string
+	for i, sink := range sinks {
+		level, ok := parseLogLevel(sink.MinLevel)
+		if !ok {
+			invalid = append(invalid, sink.MinLevel)
+		}
+		l.sinkLevels[i] = level
+	}
+
+	for _, level := range invalid {
+		l.Warn(events.LogMinLevel, "Failed parsing log level '%s', defaulting to '%s'", level, defaultLevel)
 	}
-	msg := fmt.Sprintf(formatOrMsg, a...)
-	return l.logger.Info(event, msg)
+	return l
+}
+
+/* Logger implementation */
+
+func (l *loggerImpl) Debug(event, formatOrMsg string, a ...interface{}) error {
+	return l.write(minDebugLevel, event, nil, formatOrMsg, a...)
+}
+
+func (l *loggerImpl) Info(event, formatOrMsg string, a ...interface{}) error {
+	return l.write(minInfoLevel, event, nil, formatOrMsg, a...)
 }
 
 func (l *loggerImpl) Warn(event, formatOrMsg string, a ...interface{}) error {
-	if l.logMinLevel > minWarnLevel {
-		return nil
-	}
+	return l.write(minWarnLevel, event, nil, formatOrMsg, a...)
+}
+
+func (l *loggerImpl) Error(event, formatOrMsg string, a ...interface{}) error {
+	return l.write(minErrorLevel, event, nil, formatOrMsg, a...)
+}
+
+// GetLogger returns the underlying logger, which is used by go-metrics and writes to stdout.
+func (l *loggerImpl) GetLogger() *logger.Logger {
+	once.Do(func() {
+		sharedLogger = logger.New()
+		consoleLogFormat := logger.NewStringFormat("[%s] ", "[%s] ", "%s\n", " (%s=", "%s)")
+		sharedLogger.AddTransport(logger.NewTransport(os.Stdout, consoleLogFormat))
+	})
+	return sharedLogger
+}
+
+/* StructuredLogger implementations */
+
+func (l *loggerImpl) WithFields(fields map[string]interface{}) Logger {
+	return &fieldLogger{loggerImpl: l, fields: mergeFields(nil, fields)}
+}
+
+func (l *fieldLogger) WithFields(fields map[string]interface{}) Logger {
+	return &fieldLogger{loggerImpl: l.loggerImpl, fields: mergeFields(l.fields, fields)}
+}
+
+func (l *fieldLogger) Debug(event, formatOrMsg string, a ...interface{}) error {
+	return l.write(minDebugLevel, event, l.fields, formatOrMsg, a...)
+}
+
+func (l *fieldLogger) Info(event, formatOrMsg string, a ...interface{}) error {
+	return l.write(minInfoLevel, event, l.fields, formatOrMsg, a...)
+}
+
+func (l *fieldLogger) Warn(event, formatOrMsg string, a ...interface{}) error {
+	return l.write(minWarnLevel, event, l.fields, formatOrMsg, a...)
+}
+
+func (l *fieldLogger) Error(event, formatOrMsg string, a ...interface{}) error {
+	return l.write(minErrorLevel, event, l.fields, formatOrMsg, a...)
+}
+
+func (l *messageFieldsLogger) WithFields(fields map[string]interface{}) Logger {
+	return &messageFieldsLogger{Logger: l.Logger, fields: mergeFields(l.fields, fields)}
+}
+
+func (l *messageFieldsLogger) Debug(event, formatOrMsg string, a ...interface{}) error {
+	formatOrMsg, a = l.withFields(formatOrMsg, a)
+	return l.Logger.Debug(event, formatOrMsg, a...)
+}
+
+func (l *messageFieldsLogger) Info(event, formatOrMsg string, a ...interface{}) error {
+	formatOrMsg, a = l.withFields(formatOrMsg, a)
+	return l.Logger.Info(event, formatOrMsg, a...)
+}
+
+func (l *messageFieldsLogger) Warn(event, formatOrMsg string, a ...interface{}) error {
+	formatOrMsg, a = l.withFields(formatOrMsg, a)
+	return l.Logger.Warn(event, formatOrMsg, a...)
+}
 
+func (l *messageFieldsLogger) Error(event, formatOrMsg string, a ...interface{}) error {
+	formatOrMsg, a = l.withFields(formatOrMsg, a)
+	return l.Logger.Error(event, formatOrMsg, a...)
+}
+
+// withFields appends the fields to the message as arguments, sorted by name. A message without arguments is escaped,
+// because it becomes a format.
+func (l *messageFieldsLogger) withFields(formatOrMsg string, a []interface{}) (string, []interface{}) {
 	if len(a) == 0 {
-		return l.logger.Warn(event, formatOrMsg)
+		formatOrMsg = strings.Replace(formatOrMsg, "%", "%%", -1)
+	}
+	a = a[:len(a):len(a)]
+	for _, name := range sortedFieldNames(l.fields) {
+		formatOrMsg += ", " + name + ": %v"
+		a = append(a, l.fields[name])
 	}
-	return l.logger.Warn(event, fmt.Sprintf(formatOrMsg, a...))
+	return formatOrMsg, a
 }
 
-func (l *loggerImpl) Error(event, formatOrMsg string, a ...interface{}) error {
-	if len(a) == 0 {
-		return l.logger.Error(event, formatOrMsg)
+/* SinkLogger implementation */
+
+func (l *loggerImpl) SinkErrors() map[string]int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	errors := make(map[string]int, len(l.errors))
+	for name, count := range l.errors {
+		errors[name] = count
 	}
-	return l.logger.Error(event, fmt.Sprintf(formatOrMsg, a...))
+	return errors
 }
 
-func getLogInstance(level string) *loggerImpl {
-	var inst *loggerImpl
+func (l *loggerImpl) write(level int, event string, fields map[string]interface{}, formatOrMsg string, a ...interface{}) error {
+	entry := Entry{
+		Time:        time.Now().UTC(),
+		Level:       levels[level-1],
+		Event:       event,
+		App:         l.globals.AppName,
+		Server:      l.globals.ServerName,
+		Environment: l.globals.DeployEnvironment,
+		Message:     formatOrMsg,
+		Fields:      fields,
+	}
+	if len(a) > 0 {
+		entry.Message = fmt.Sprintf(formatOrMsg, a...)
+	}
 
-	for i := 0; i < len(levels); i++ {
-		if inst = loggerInstances[strings.ToLower(level)]; inst != nil {
-			break
+	var firstErr error
+	for i, sink := range l.sinks {
+		if level < l.sinkLevels[i] {
+			continue
+		}
+
+		if err := sink.Sink.Write(entry); err != nil {
+			// Keep writing to the other sinks, a broken sink should not silence the others.
+			l.mutex.Lock()
+			l.errors[sink.Name]++
+			l.mutex.Unlock()
+
+			if firstErr == nil {
+				firstErr = err
+			}
 		}
 	}
+	return firstErr
+}
 
-	if inst == nil {
-		inst = loggerInstances[defaultLevel]
-		inst.Warn("LogMinLevel", "Failed parsing log level '%s', defaulting to '%s'", level, defaultLevel)
+// mergeFields returns a copy of the fields with the added fields, which replace fields with the same name.
+func mergeFields(fields, added map[string]interface{}) map[string]interface{} {
+	merged := make(map[string]interface{}, len(fields)+len(added))
+	for name, value := range fields {
+		merged[name] = value
 	}
-	return inst
+	for name, value := range added {
+		merged[name] = value
+	}
+	return merged
 }
 
-func (l *loggerImpl) GetLogger() *logger.Logger {
-	return l.logger
+func sortedFieldNames(fields map[string]interface{}) []string {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func parseLogLevel(level string) (int, bool) {
+	for i, name := range levels {
+		if strings.ToLower(level) == name {
+			return i + 1, true
+		}
+	}
+	return minWarnLevel, false
 }
@@ -1,10 +1,17 @@
 package servicefoundation_test
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
 	"testing"
 
 	sf "github.com/Prutswonder/go-servicefoundation"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
 )
 
 func TestLoggerImpl_GetLogger_DebugLevel(t *testing.T) {
@@ -58,3 +65,91 @@ func TestLoggerImpl_GetLogger_StaticMsg(t *testing.T) {
 
 	assert.NotNil(t, logger)
 }
+
+func TestWithFields_SinkLogger(t *testing.T) {
+	text := &bytes.Buffer{}
+	jsonBuf := &bytes.Buffer{}
+	sut := sf.NewSinkLogger([]sf.LogSink{
+		{Name: "text", MinLevel: "debug", Sink: sf.NewWriterSink(text, sf.TextFormat)},
+		{Name: "json", MinLevel: "debug", Sink: sf.NewWriterSink(jsonBuf, sf.JSONFormat)},
+	})
+
+	// Act
+	log := sf.WithFields(sut, map[string]interface{}{"method": "GET", "status": 200})
+	sf.WithFields(log, map[string]interface{}{"status": 404, "path": "/orders"}).Info("Event", "handled %s", "order")
+	log.Warn("Event", "no path")
+	sut.Error("Event", "no fields")
+
+	assert.Equal(t, "[INFO] [Event] handled order method=GET path=/orders status=404\n"+
+		"[WARNING] [Event] no path method=GET status=200\n"+
+		"[ERROR] [Event] no fields\n", text.String())
+
+	decoder := json.NewDecoder(jsonBuf)
+	var entry map[string]interface{}
+	assert.NoError(t, decoder.Decode(&entry))
+	assert.Equal(t, "handled order", entry["message"])
+	assert.Equal(t, map[string]interface{}{"method": "GET", "path": "/orders", "status": float64(404)}, entry["fields"])
+}
+
+func TestWithFields_AppendsToMessagesOfOtherLoggers(t *testing.T) {
+	log := &mockLogger{}
+	log.On("Info", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	sut := sf.WithFields(log, map[string]interface{}{"status": 200, "method": "GET"})
+
+	// Act
+	sut.Info("Event", "Order %s", "o-1")
+	sf.WithFields(sut, map[string]interface{}{"path": "/orders"}).Info("Event", "%s", "Stock at 10%")
+
+	log.AssertCalled(t, "Info", "Event", "Order %s, method: %v, status: %v", []interface{}{"o-1", "GET", 200})
+	log.AssertCalled(t, "Info", "Event", "%s, method: %v, path: %v, status: %v",
+		[]interface{}{"Stock at 10%", "GET", "/orders", 200})
+}
+
+func TestWithFields_EscapesMessagesWithoutArguments(t *testing.T) {
+	log := &mockLogger{}
+	log.On("Info", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	// Messages without arguments can be built at runtime, which vet doesn't check through a func value.
+	info := sf.WithFields(log, map[string]interface{}{"method": "GET"}).Info
+
+	// Act
+	info("Event", "Stock at 10%")
+
+	log.AssertCalled(t, "Info", "Event", "Stock at 10%%, method: %v", []interface{}{"GET"})
+}
+
+func TestNewServiceOptions_JSONLogFormat(t *testing.T) {
+	file, _ := ioutil.TempFile("", "stdout")
+	defer os.Remove(file.Name())
+	stdout := os.Stdout
+	os.Stdout = file
+	env := map[string]string{"LOG_FORMAT": "json", "LOG_MINFILTER": "info", "APP_NAME": "shop",
+		"SERVER_NAME": "shop-1", "DEPLOY_ENVIRONMENT": "staging"}
+	for key, value := range env {
+		os.Setenv(key, value)
+	}
+
+	// Act
+	opt := sf.NewServiceOptions("logs", []string{http.MethodGet}, nil)
+	sf.WithFields(opt.Logger, map[string]interface{}{"method": "GET"}).Info("Response-orders", "Handled request")
+
+	for key := range env {
+		os.Unsetenv(key)
+	}
+	os.Stdout = stdout
+	file.Seek(0, 0)
+	var entry sf.Entry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if bytes.Contains(scanner.Bytes(), []byte("Response-orders")) {
+			assert.NoError(t, json.Unmarshal(scanner.Bytes(), &entry))
+		}
+	}
+	file.Close()
+	assert.Equal(t, "Handled request", entry.Message)
+	assert.Equal(t, "info", entry.Level)
+	assert.Equal(t, "shop", entry.App)
+	assert.Equal(t, "shop-1", entry.Server)
+	assert.Equal(t, "staging", entry.Environment)
+	assert.Equal(t, map[string]interface{}{"method": "GET"}, entry.Fields)
+	assert.False(t, entry.Time.IsZero())
+}
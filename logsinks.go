@@ -0,0 +1,391 @@
+package servicefoundation
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Prutswonder/go-servicefoundation/events"
+)
+
+const (
+	// TextFormat formats log entries as "[level] [event] message" lines.
+	TextFormat LogFormat = 1
+	// JSONFormat formats log entries as JSON documents, one per line.
+	JSONFormat LogFormat = 2
+
+	defaultRingBufferSize  = 1000
+	defaultLogsLimit       = 100
+	defaultLogFileMaxSize  = 100 << 20
+	defaultLogFileMaxAge   = 7 * 24 * time.Hour
+	defaultLogFileBackups  = 5
+	logFileRotationLayout  = "20060102T150405.000000000"
+	logSinkSpecSeparator   = ","
+	logSinkLevelSeparator  = "@"
+	logSinkOptionSeparator = "="
+)
+
+type (
+	// Entry is a single log entry as written to a Sink. The application, server and deployment environment are set by
+	// the Logger of a Service, and Fields by WithFields.
+	Entry struct {
+		Time        time.Time              `json:"time"`
+		Level       string                 `json:"level"`
+		Event       string                 `json:"event"`
+		App         string                 `json:"app,omitempty"`
+		Server      string                 `json:"server,omitempty"`
+		Environment string                 `json:"env,omitempty"`
+		Message     string                 `json:"message"`
+		Fields      map[string]interface{} `json:"fields,omitempty"`
+	}
+
+	// Sink is a destination for log entries.
+	Sink interface {
+		Write(entry Entry) error
+	}
+
+	// LogFormat is an enumeration of the formats in which sinks can write log entries.
+	LogFormat int
+
+	// RingBufferSink is a Sink that keeps the most recent log entries in memory.
+	RingBufferSink interface {
+		Sink
+		Entries(minLevel string, limit int) []Entry
+	}
+
+	// RotatingFileOptions contains the settings of a rotating file sink. A log file is rotated when it would exceed
+	// MaxSize bytes or is older than MaxAge; only the most recent MaxBackups rotated files are kept.
+	RotatingFileOptions struct {
+		Path       string
+		Format     LogFormat
+		MaxSize    int64
+		MaxAge     time.Duration
+		MaxBackups int
+	}
+
+	writerSinkImpl struct {
+		writer io.Writer
+		format LogFormat
+		mutex  sync.Mutex
+	}
+
+	ringBufferSinkImpl struct {
+		entries []Entry
+		next    int
+		full    bool
+		mutex   sync.RWMutex
+	}
+
+	rotatingFileSinkImpl struct {
+		options RotatingFileOptions
+		file    *os.File
+		size    int64
+		opened  time.Time
+		mutex   sync.Mutex
+	}
+)
+
+// NewWriterSink instantiates a new Sink that writes log entries in the given format to w.
+func NewWriterSink(w io.Writer, format LogFormat) Sink {
+	return &writerSinkImpl{writer: w, format: format}
+}
+
+// NewStdoutSink instantiates a new Sink that writes log entries in the given format to stdout.
+func NewStdoutSink(format LogFormat) Sink {
+	return NewWriterSink(os.Stdout, format)
+}
+
+// NewRingBufferSink instantiates a new RingBufferSink that keeps the most recent size entries.
+func NewRingBufferSink(size int) RingBufferSink {
+	if size <= 0 {
+		size = defaultRingBufferSize
+	}
+
+	return &ringBufferSinkImpl{entries: make([]Entry, size)}
+}
+
+// NewRotatingFileSink instantiates a new Sink that writes log entries to a file, which is rotated based on its size
+// and age. The file is opened on the first write, so any errors surface as write errors.
+func NewRotatingFileSink(options RotatingFileOptions) Sink {
+	if options.Format == 0 {
+		options.Format = TextFormat
+	}
+	if options.MaxSize <= 0 {
+		options.MaxSize = defaultLogFileMaxSize
+	}
+	if options.MaxAge <= 0 {
+		options.MaxAge = defaultLogFileMaxAge
+	}
+	if options.MaxBackups <= 0 {
+		options.MaxBackups = defaultLogFileBackups
+	}
+
+	return &rotatingFileSinkImpl{options: options}
+}
+
+// ParseLogSinks parses a comma-separated LOG_SINKS specification, like
+// "stdout=json@info,ring=500@debug,file=/var/log/service.log@warning". Supported sinks are stdout (text or json),
+// ring (buffer size) and file (path, using the default rotation settings). Sinks without a level use defaultLevel.
+// The ring buffer is returned separately, so it can be exposed on the internal server.
+func ParseLogSinks(spec, defaultLevel string) ([]LogSink, RingBufferSink, error) {
+	var sinks []LogSink
+	var ring RingBufferSink
+
+	for _, part := range strings.Split(spec, logSinkSpecSeparator) {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		level := defaultLevel
+		if i := strings.LastIndex(part, logSinkLevelSeparator); i >= 0 {
+			part, level = part[:i], part[i+1:]
+		}
+
+		kind, value := part, ""
+		if i := strings.Index(part, logSinkOptionSeparator); i >= 0 {
+			kind, value = part[:i], part[i+1:]
+		}
+
+		switch kind {
+		case "stdout":
+			format, err := parseLogFormat(value)
+			if err != nil {
+				return nil, nil, err
+			}
+			sinks = append(sinks, LogSink{Name: kind, MinLevel: level, Sink: NewStdoutSink(format)})
+		case "ring":
+			size := 0
+			if value != "" {
+				var err error
+				if size, err = strconv.Atoi(value); err != nil {
+					return nil, nil, fmt.Errorf("Invalid ring buffer size '%s'", value)
+				}
+			}
+			ring = NewRingBufferSink(size)
+			sinks = append(sinks, LogSink{Name: kind, MinLevel: level, Sink: ring})
+		case "file":
+			if value == "" {
+				return nil, nil, fmt.Errorf("Missing path for file log sink")
+			}
+			sink := NewRotatingFileSink(RotatingFileOptions{Path: value})
+			sinks = append(sinks, LogSink{Name: kind + ":" + value, MinLevel: level, Sink: sink})
+		default:
+			return nil, nil, fmt.Errorf("Unknown log sink '%s'", kind)
+		}
+	}
+	return sinks, ring, nil
+}
+
+// NewLogsHandler returns a handler that returns the most recent entries of the given RingBufferSink, filtered by the
+// optional "level" and "limit" query parameters.
+func NewLogsHandler(ring RingBufferSink) Handle {
+	return func(w WrappedResponseWriter, r *http.Request, _ RouterParams) {
+		query := r.URL.Query()
+		limit := defaultLogsLimit
+
+		if value := query.Get("limit"); value != "" {
+			var err error
+			if limit, err = strconv.Atoi(value); err != nil || limit < 0 {
+				w.JSON(http.StatusBadRequest, "Invalid limit")
+				return
+			}
+		}
+
+		level := query.Get("level")
+		if level == "" {
+			level = levels[0]
+		}
+		if _, ok := parseLogLevel(level); !ok {
+			w.JSON(http.StatusBadRequest, "Invalid level")
+			return
+		}
+
+		w.JSON(http.StatusOK, ring.Entries(level, limit))
+	}
+}
+
+// newServiceLogger creates the Logger for the LOG_SINKS specification, or a stdout Logger when it is empty or invalid.
+// Its entries contain the application, server and deployment environment of the globals.
+func newServiceLogger(minLevel, spec string, globals ServiceGlobals) (Logger, RingBufferSink) {
+	if spec == "" {
+		return newStdoutLogger(minLevel, globals), nil
+	}
+
+	sinks, ring, err := ParseLogSinks(spec, minLevel)
+	if err != nil {
+		log := newStdoutLogger(minLevel, globals)
+		log.Warn(events.LogSinks, "Failed parsing log sinks '%s', defaulting to stdout: %v", spec, err)
+		return log, nil
+	}
+	return newSinkLogger(sinks, globals), ring
+}
+
+// parseLogFormat parses the format of a log sink. Without a format, the sink uses the format of LOG_FORMAT.
+func parseLogFormat(value string) (LogFormat, error) {
+	switch strings.ToLower(value) {
+	case "":
+		if strings.EqualFold(logFormatVariable.String(), "json") {
+			return JSONFormat, nil
+		}
+		return TextFormat, nil
+	case "text":
+		return TextFormat, nil
+	case "json":
+		return JSONFormat, nil
+	}
+	return 0, fmt.Errorf("Unknown log format '%s'", value)
+}
+
+/* LogFormat implementation */
+
+func (f LogFormat) format(entry Entry) ([]byte, error) {
+	if f == JSONFormat {
+		b, err := json.Marshal(entry)
+		if err != nil {
+			return nil, err
+		}
+		return append(b, '\n'), nil
+	}
+	line := fmt.Sprintf("[%s] [%s] %s", strings.ToUpper(entry.Level), entry.Event, entry.Message)
+	for _, name := range sortedFieldNames(entry.Fields) {
+		line += fmt.Sprintf(" %s=%v", name, entry.Fields[name])
+	}
+	return []byte(line + "\n"), nil
+}
+
+/* Sink implementations */
+
+func (s *writerSinkImpl) Write(entry Entry) error {
+	b, err := s.format.format(entry)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	_, err = s.writer.Write(b)
+	return err
+}
+
+func (s *ringBufferSinkImpl) Write(entry Entry) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.entries[s.next] = entry
+	s.next = (s.next + 1) % len(s.entries)
+	if s.next == 0 {
+		s.full = true
+	}
+	return nil
+}
+
+// Entries returns at most limit of the most recent entries with at least the given level, oldest first. A limit of
+// 0 returns all matching entries.
+func (s *ringBufferSinkImpl) Entries(minLevel string, limit int) []Entry {
+	min, _ := parseLogLevel(minLevel)
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	ordered := s.entries[:s.next]
+	if s.full {
+		ordered = append(append([]Entry{}, s.entries[s.next:]...), s.entries[:s.next]...)
+	}
+
+	entries := []Entry{}
+	for i := len(ordered) - 1; i >= 0 && (limit == 0 || len(entries) < limit); i-- {
+		if level, _ := parseLogLevel(ordered[i].Level); level >= min {
+			entries = append(entries, ordered[i])
+		}
+	}
+
+	// Restore the chronological order.
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return entries
+}
+
+func (s *rotatingFileSinkImpl) Write(entry Entry) error {
+	b, err := s.options.Format.format(entry)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.file != nil && (s.size+int64(len(b)) > s.options.MaxSize || time.Since(s.opened) > s.options.MaxAge) {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	if s.file == nil {
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+
+	n, err := s.file.Write(b)
+	s.size += int64(n)
+	return err
+}
+
+func (s *rotatingFileSinkImpl) open() error {
+	file, err := os.OpenFile(s.options.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	s.file = file
+	s.size = info.Size()
+	s.opened = time.Now()
+	return nil
+}
+
+func (s *rotatingFileSinkImpl) rotate() error {
+	s.file.Close()
+	s.file = nil
+
+	backup := s.options.Path + "." + time.Now().UTC().Format(logFileRotationLayout)
+	if err := os.Rename(s.options.Path, backup); err != nil {
+		return err
+	}
+
+	matches, err := filepath.Glob(s.options.Path + ".*")
+	if err != nil {
+		return err
+	}
+	// Only rotated files are pruned, not other files next to the log file, like app.log.bak.
+	var backups []string
+	for _, match := range matches {
+		if _, err := time.Parse(logFileRotationLayout, strings.TrimPrefix(match, s.options.Path+".")); err == nil {
+			backups = append(backups, match)
+		}
+	}
+
+	// The timestamp suffix sorts chronologically, so the oldest backups come first.
+	sort.Strings(backups)
+	for len(backups) > s.options.MaxBackups {
+		os.Remove(backups[0])
+		backups = backups[1:]
+	}
+	return nil
+}
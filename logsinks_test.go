@@ -0,0 +1,174 @@
+package servicefoundation_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	sf "github.com/Prutswonder/go-servicefoundation"
+	"github.com/stretchr/testify/assert"
+)
+
+type failingSink struct{}
+
+func (failingSink) Write(entry sf.Entry) error {
+	return errors.New("disk full")
+}
+
+func TestSinkLogger_FanOutWithLevels(t *testing.T) {
+	text := &bytes.Buffer{}
+	jsonBuf := &bytes.Buffer{}
+	sut := sf.NewSinkLogger([]sf.LogSink{
+		{Name: "text", MinLevel: "debug", Sink: sf.NewWriterSink(text, sf.TextFormat)},
+		{Name: "json", MinLevel: "warning", Sink: sf.NewWriterSink(jsonBuf, sf.JSONFormat)},
+	})
+
+	// Act
+	sut.Debug("Event", "debug %d", 1)
+	sut.Warn("Event", "warn")
+
+	assert.Equal(t, "[DEBUG] [Event] debug 1\n[WARNING] [Event] warn\n", text.String())
+
+	var entry sf.Entry
+	assert.NoError(t, json.Unmarshal(jsonBuf.Bytes(), &entry))
+	assert.Equal(t, "warning", entry.Level)
+	assert.Equal(t, "Event", entry.Event)
+	assert.Equal(t, "warn", entry.Message)
+}
+
+func TestSinkLogger_ErrorIsolation(t *testing.T) {
+	buf := &bytes.Buffer{}
+	sut := sf.NewSinkLogger([]sf.LogSink{
+		{Name: "broken", MinLevel: "debug", Sink: failingSink{}},
+		{Name: "text", MinLevel: "debug", Sink: sf.NewWriterSink(buf, sf.TextFormat)},
+	})
+
+	// Act
+	err1 := sut.Info("Event", "first")
+	err2 := sut.Error("Event", "second")
+
+	assert.Error(t, err1)
+	assert.Error(t, err2)
+	assert.Equal(t, "[INFO] [Event] first\n[ERROR] [Event] second\n", buf.String())
+	assert.Equal(t, map[string]int{"broken": 2}, sut.SinkErrors())
+}
+
+func TestRingBufferSink_Entries(t *testing.T) {
+	ring := sf.NewRingBufferSink(3)
+	sut := sf.NewSinkLogger([]sf.LogSink{{Name: "ring", MinLevel: "debug", Sink: ring}})
+
+	// Act
+	sut.Info("Event", "1")
+	sut.Warn("Event", "2")
+	sut.Debug("Event", "3")
+	sut.Warn("Event", "4")
+
+	messages := func(entries []sf.Entry) []string {
+		result := []string{}
+		for _, e := range entries {
+			result = append(result, e.Message)
+		}
+		return result
+	}
+
+	assert.Equal(t, []string{"2", "3", "4"}, messages(ring.Entries("debug", 0)))
+	assert.Equal(t, []string{"3", "4"}, messages(ring.Entries("debug", 2)))
+	assert.Equal(t, []string{"2", "4"}, messages(ring.Entries("warning", 0)))
+}
+
+func TestNewLogsHandler(t *testing.T) {
+	ring := sf.NewRingBufferSink(10)
+	ring.Write(sf.Entry{Level: "info", Message: "1"})
+	ring.Write(sf.Entry{Level: "error", Message: "2"})
+	ring.Write(sf.Entry{Level: "error", Message: "3"})
+	sut := sf.NewLogsHandler(ring)
+
+	tests := []struct {
+		query    string
+		status   int
+		messages int
+	}{
+		{"", http.StatusOK, 3},
+		{"?level=error&limit=1", http.StatusOK, 1},
+		{"?level=verbose", http.StatusBadRequest, 0},
+		{"?limit=-1", http.StatusBadRequest, 0},
+	}
+
+	for _, test := range tests {
+		r, _ := http.NewRequest(http.MethodGet, "/service/logs"+test.query, nil)
+		w := httptest.NewRecorder()
+
+		// Act
+		sut(sf.NewWrappedResponseWriter(w), r, sf.RouterParams{})
+
+		assert.Equal(t, test.status, w.Code, test.query)
+		if test.status == http.StatusOK {
+			var entries []sf.Entry
+			json.Unmarshal(w.Body.Bytes(), &entries)
+			assert.Len(t, entries, test.messages, test.query)
+		}
+	}
+}
+
+func TestRotatingFileSink_Rotates(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "service.log")
+	sut := sf.NewRotatingFileSink(sf.RotatingFileOptions{Path: path, MaxSize: 30, MaxBackups: 2})
+
+	// Act
+	for i := 0; i < 6; i++ {
+		assert.NoError(t, sut.Write(sf.Entry{Level: "info", Event: "Event", Message: "message"}))
+	}
+
+	backups, _ := filepath.Glob(path + ".*")
+	content, _ := ioutil.ReadFile(path)
+
+	assert.Len(t, backups, 2)
+	assert.Equal(t, "[INFO] [Event] message\n", string(content))
+}
+
+func TestRotatingFileSink_KeepsOtherFiles(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "service.log")
+	others := []string{path + ".bak", path + ".lock", path + ".1"}
+	for _, other := range others {
+		ioutil.WriteFile(other, []byte("other"), 0644)
+	}
+	sut := sf.NewRotatingFileSink(sf.RotatingFileOptions{Path: path, MaxSize: 30, MaxBackups: 1})
+
+	// Act
+	for i := 0; i < 6; i++ {
+		assert.NoError(t, sut.Write(sf.Entry{Level: "info", Event: "Event", Message: "message"}))
+	}
+
+	files, _ := filepath.Glob(path + ".*")
+	assert.Len(t, files, len(others)+1)
+	for _, other := range others {
+		_, err := os.Stat(other)
+		assert.NoError(t, err, other)
+	}
+}
+
+func TestParseLogSinks(t *testing.T) {
+	// Act
+	sinks, ring, err := sf.ParseLogSinks("stdout=json@info, ring=50, file=/tmp/service.log@error", "warning")
+
+	assert.NoError(t, err)
+	assert.NotNil(t, ring)
+	assert.Len(t, sinks, 3)
+	assert.Equal(t, "info", sinks[0].MinLevel)
+	assert.Equal(t, "warning", sinks[1].MinLevel)
+	assert.Equal(t, "file:/tmp/service.log", sinks[2].Name)
+
+	_, _, err = sf.ParseLogSinks("syslog", "warning")
+
+	assert.Error(t, err)
+}
@@ -1,11 +1,20 @@
 package servicefoundation
 
 import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/Prutswonder/go-servicefoundation/events"
 	"github.com/Travix-International/go-metrics"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
+// summaryObjectives are the quantiles of the summaries, with their allowed errors, like those of the go-metrics package.
+var summaryObjectives = map[float64]float64{0.5: 0.05, 0.75: 0.025, 0.9: 0.01, 0.95: 0.005, 0.99: 0.001, 0.999: 0.0001}
+
 type (
 	// MetricsHistogram is a wrapper around the MetricsHistogram from the go-metrics package.
 	MetricsHistogram interface {
@@ -16,33 +25,97 @@ type (
 	Metrics interface {
 		Count(subsystem, name, help string)
 		SetGauge(value float64, subsystem, name, help string)
+		SetGaugeLabels(value float64, subsystem, name, help string, labels, values []string)
 		CountLabels(subsystem, name, help string, labels, values []string)
 		IncreaseCounter(subsystem, name, help string, increment int)
 		AddHistogram(subsystem, name, help string) MetricsHistogram
+		AddHistogramWithBuckets(subsystem, name, help string, buckets []float64) MetricsHistogram
+		AddHistogramLabels(subsystem, name, help string, labels, values []string) MetricsHistogram
+	}
+
+	// MetricsOptions contains the settings of the Metrics. HistogramBuckets are the upper bounds of the buckets of the
+	// histograms in seconds, in increasing order, and default to the buckets of Prometheus.
+	MetricsOptions struct {
+		HistogramBuckets []float64
+	}
+
+	// observer is a Prometheus histogram of which the label values are set.
+	observer interface {
+		Observe(value float64)
 	}
 
 	metricsHistogramImpl struct {
-		histogram *metrics.MetricsHistogram
+		histogram observer
+		summary   observer
 	}
 
 	metricsImpl struct {
-		metrics *metrics.Metrics
+		metrics    *metrics.Metrics
+		options    MetricsOptions
+		logger     Logger
+		mutex      sync.Mutex
+		histograms map[string]*prometheus.HistogramVec
+		summaries  map[string]*prometheus.SummaryVec
+		gauges     map[string]*prometheus.GaugeVec
 	}
+
+	noopMetricsHistogram struct{}
 )
 
 // NewMetrics instantiates a new Metrics implementation.
 func NewMetrics(namespace string, logger Logger) Metrics {
+	return NewCustomMetrics(namespace, MetricsOptions{}, logger)
+}
+
+// NewCustomMetrics instantiates a new Metrics implementation, of which the histograms use the buckets of the options.
+func NewCustomMetrics(namespace string, options MetricsOptions, logger Logger) Metrics {
 	return &metricsImpl{
 		// We're not using the namespace in metrics, because we won't be able to write "basic" metrics.
-		metrics: metrics.NewMetrics("", logger.GetLogger()),
+		metrics:    metrics.NewMetrics("", logger.GetLogger()),
+		options:    options,
+		logger:     logger,
+		histograms: make(map[string]*prometheus.HistogramVec),
+		summaries:  make(map[string]*prometheus.SummaryVec),
+		gauges:     make(map[string]*prometheus.GaugeVec),
 	}
 }
 
-/* MetricsHistogram implementation */
+// ParseHistogramBuckets parses a comma-separated list of bucket upper bounds in seconds, like "0.001,0.005,0.01,0.1,1".
+// An empty specification returns no buckets, so the Prometheus default buckets are used.
+func ParseHistogramBuckets(spec string) ([]float64, error) {
+	var buckets []float64
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
 
+		bucket, err := strconv.ParseFloat(part, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid histogram bucket '%s'", part)
+		}
+		if len(buckets) > 0 && bucket <= buckets[len(buckets)-1] {
+			return nil, fmt.Errorf("Histogram bucket '%s' is not greater than the previous bucket", part)
+		}
+		buckets = append(buckets, bucket)
+	}
+	return buckets, nil
+}
+
+/* MetricsHistogram implementations */
+
+// RecordTimeElapsed records the elapsed time in seconds in the histogram and in milliseconds in the summary, like the
+// histograms of the go-metrics package.
 func (h *metricsHistogramImpl) RecordTimeElapsed(start time.Time, unit time.Duration) {
-	//TODO: Add unit as parameter to the go-metrics package
-	h.histogram.RecordTimeElapsed(start)
+	//TODO: Use the unit, once the names of the histograms of the RequestLogging middleware match their units.
+	elapsed := time.Since(start).Seconds()
+	h.histogram.Observe(elapsed)
+	if h.summary != nil {
+		h.summary.Observe(elapsed * 1000.0)
+	}
+}
+
+func (noopMetricsHistogram) RecordTimeElapsed(start time.Time, unit time.Duration) {
 }
 
 /* Metrics implementation */
@@ -55,6 +128,44 @@ func (m *metricsImpl) SetGauge(value float64, subsystem, name, help string) {
 	m.metrics.SetGauge(value, subsystem, name, help)
 }
 
+// SetGaugeLabels sets the gauge for the label values, which is registered on the first call. Like with CountLabels,
+// every call for the gauge must pass the same labels. A gauge that can't be registered, because a metric with the same
+// name has other labels, is logged and doesn't record anything.
+func (m *metricsImpl) SetGaugeLabels(value float64, subsystem, name, help string, labels, values []string) {
+	key := subsystem + "_" + name
+
+	m.mutex.Lock()
+	vec, ok := m.gauges[key]
+	if !ok {
+		vec = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Subsystem: subsystem,
+			Name:      name,
+			Help:      help,
+		}, labels)
+
+		if err := prometheus.Register(vec); err != nil {
+			if registered, ok := err.(prometheus.AlreadyRegisteredError); ok {
+				vec, _ = registered.ExistingCollector.(*prometheus.GaugeVec)
+			} else {
+				m.logger.Error(events.MetricsGauge, "Failed registering gauge %s: %v", key, err)
+				vec = nil
+			}
+		}
+		m.gauges[key] = vec
+	}
+	m.mutex.Unlock()
+
+	if vec == nil {
+		return
+	}
+	gauge, err := vec.GetMetricWithLabelValues(values...)
+	if err != nil {
+		m.logger.Error(events.MetricsGauge, "Failed setting gauge %s: %v", key, err)
+		return
+	}
+	gauge.Set(value)
+}
+
 func (m *metricsImpl) CountLabels(subsystem, name, help string, labels, values []string) {
 	m.metrics.CountLabels(subsystem, name, help, labels, values)
 }
@@ -63,6 +174,84 @@ func (m *metricsImpl) IncreaseCounter(subsystem, name, help string, increment in
 	m.metrics.IncreaseCounter(subsystem, name, help, increment)
 }
 
+// AddHistogram returns the histogram with the buckets of the options.
 func (m *metricsImpl) AddHistogram(subsystem, name, help string) MetricsHistogram {
-	return &metricsHistogramImpl{m.metrics.AddHistogram(subsystem, name, help)}
+	return m.addHistogram(subsystem, name, help, m.options.HistogramBuckets, nil, nil)
+}
+
+// AddHistogramWithBuckets returns the histogram with its own buckets, for durations that don't fit the buckets of the
+// options, like those of batch jobs. The buckets of the first call are used for the histogram.
+func (m *metricsImpl) AddHistogramWithBuckets(subsystem, name, help string, buckets []float64) MetricsHistogram {
+	return m.addHistogram(subsystem, name, help, buckets, nil, nil)
+}
+
+// AddHistogramLabels returns the histogram with the buckets of the options for the label values. Like with
+// CountLabels, every call for the histogram must pass the same labels.
+func (m *metricsImpl) AddHistogramLabels(subsystem, name, help string, labels, values []string) MetricsHistogram {
+	return m.addHistogram(subsystem, name, help, m.options.HistogramBuckets, labels, values)
+}
+
+// addHistogram returns the histogram for the label values, which is registered on the first call, next to a summary
+// with the "_summary" suffix, like the histograms of the go-metrics package. A histogram that was registered before,
+// by other Metrics of the process, is reused. A histogram that can't be registered, because a metric with the same
+// name has other labels or buckets, is logged and doesn't record anything.
+func (m *metricsImpl) addHistogram(subsystem, name, help string, buckets []float64, labels, values []string) MetricsHistogram {
+	key := subsystem + "_" + name
+
+	m.mutex.Lock()
+	vec, ok := m.histograms[key]
+	if !ok {
+		vec = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Subsystem: subsystem,
+			Name:      name,
+			Help:      help,
+			Buckets:   buckets,
+		}, labels)
+
+		if err := prometheus.Register(vec); err != nil {
+			if registered, ok := err.(prometheus.AlreadyRegisteredError); ok {
+				vec, _ = registered.ExistingCollector.(*prometheus.HistogramVec)
+			} else {
+				m.logger.Error(events.MetricsHistogram, "Failed registering histogram %s: %v", key, err)
+				vec = nil
+			}
+		}
+		m.histograms[key] = vec
+	}
+	summaryVec, ok := m.summaries[key]
+	if !ok && vec != nil {
+		summaryVec = prometheus.NewSummaryVec(prometheus.SummaryOpts{
+			Subsystem:  subsystem,
+			Name:       name + "_summary",
+			Help:       help,
+			Objectives: summaryObjectives,
+		}, labels)
+
+		if err := prometheus.Register(summaryVec); err != nil {
+			if registered, ok := err.(prometheus.AlreadyRegisteredError); ok {
+				summaryVec, _ = registered.ExistingCollector.(*prometheus.SummaryVec)
+			} else {
+				m.logger.Error(events.MetricsHistogram, "Failed registering summary %s_summary: %v", key, err)
+				summaryVec = nil
+			}
+		}
+		m.summaries[key] = summaryVec
+	}
+	m.mutex.Unlock()
+
+	if vec == nil {
+		return noopMetricsHistogram{}
+	}
+	histogram, err := vec.GetMetricWithLabelValues(values...)
+	if err != nil {
+		m.logger.Error(events.MetricsHistogram, "Failed recording histogram %s: %v", key, err)
+		return noopMetricsHistogram{}
+	}
+	h := &metricsHistogramImpl{histogram: histogram}
+	if summaryVec != nil {
+		if summary, err := summaryVec.GetMetricWithLabelValues(values...); err == nil {
+			h.summary = summary
+		}
+	}
+	return h
 }
@@ -1,12 +1,16 @@
 package servicefoundation_test
 
 import (
+	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 
 	sf "github.com/Prutswonder/go-servicefoundation"
 	"github.com/Travix-International/logger"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
 )
 
 func TestMetricsImpl(t *testing.T) {
@@ -27,3 +31,118 @@ func TestMetricsImpl(t *testing.T) {
 	assert.NotNil(t, h)
 	log.AssertExpectations(t)
 }
+
+func TestParseHistogramBuckets(t *testing.T) {
+	tests := []struct {
+		spec     string
+		expected []float64
+		err      bool
+	}{
+		{"", nil, false},
+		{"0.005, 0.01,0.1,1", []float64{0.005, 0.01, 0.1, 1}, false},
+		{"0.1,fast", nil, true},
+		{"1,0.5", nil, true},
+		{"1,1", nil, true},
+	}
+
+	for _, test := range tests {
+		// Act
+		actual, err := sf.ParseHistogramBuckets(test.spec)
+
+		assert.Equal(t, test.err, err != nil, test.spec)
+		assert.Equal(t, test.expected, actual, test.spec)
+	}
+}
+
+func TestMetricsImpl_HistogramBuckets(t *testing.T) {
+	log := &mockLogger{}
+	log.On("GetLogger").Return(logger.New())
+	log.On("Error", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	sut := sf.NewCustomMetrics("buckets", sf.MetricsOptions{HistogramBuckets: []float64{0.001, 0.01}}, log)
+
+	// Act
+	sut.AddHistogram("buckets", "fast_seconds", "help").RecordTimeElapsed(time.Now(), time.Second)
+	sut.AddHistogramWithBuckets("buckets", "batch_seconds", "help", []float64{1, 60}).
+		RecordTimeElapsed(time.Now(), time.Second)
+	sut.AddHistogramLabels("buckets", "route_seconds", "help", []string{"method", "code"}, []string{"get", "500"}).
+		RecordTimeElapsed(time.Now(), time.Second)
+	sf.NewCustomMetrics("buckets", sf.MetricsOptions{}, log).
+		AddHistogramLabels("buckets", "fast_seconds", "help", []string{"method"}, []string{"get"}).
+		RecordTimeElapsed(time.Now(), time.Second)
+
+	w := httptest.NewRecorder()
+	promhttp.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Contains(t, w.Body.String(), `buckets_fast_seconds_bucket{le="0.001"} 1`)
+	assert.Contains(t, w.Body.String(), `buckets_batch_seconds_bucket{le="60"} 1`)
+	assert.Contains(t, w.Body.String(), `buckets_route_seconds_bucket{code="500",method="get",le="0.01"} 1`)
+	assert.NotContains(t, w.Body.String(), `buckets_fast_seconds_bucket{method="get"`)
+	log.AssertCalled(t, "Error", "MetricsHistogram", mock.Anything, mock.Anything)
+}
+
+func TestMetricsImpl_HistogramSummaries(t *testing.T) {
+	log := &mockLogger{}
+	log.On("GetLogger").Return(logger.New())
+	log.On("Info", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	wrapper := sf.NewMiddlewareWrapper(log, sf.NewMetrics("summaries", log), &sf.CORSOptions{}, sf.ServiceGlobals{})
+	r, _ := http.NewRequest(http.MethodGet, "/summaries", nil)
+
+	// Act
+	sf.NewChainFor(wrapper, "public", "list_summaries", []sf.Middleware{sf.RequestLogging, sf.Histogram}).
+		Then(func(w sf.WrappedResponseWriter, _ *http.Request, _ sf.RouterParams) {
+			w.WriteHeader(http.StatusOK)
+		})(sf.NewWrappedResponseWriter(httptest.NewRecorder()), r, sf.RouterParams{})
+
+	w := httptest.NewRecorder()
+	promhttp.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	tests := []string{
+		`http_request_duration_seconds_bucket{le="+Inf"}`,
+		`http_request_duration_seconds_summary{quantile="0.5"}`,
+		`http_request_duration_microseconds_summary_count`,
+		`public_list_summaries_duration_milliseconds_bucket{code="200",method="get",le="+Inf"} 1`,
+		`public_list_summaries_duration_milliseconds_summary{code="200",method="get",quantile="0.999"}`,
+		`public_list_summaries_duration_milliseconds_summary_count{code="200",method="get"} 1`,
+	}
+	for _, test := range tests {
+		assert.Contains(t, w.Body.String(), test)
+	}
+}
+
+func TestMetricsImpl_GaugeLabels(t *testing.T) {
+	log := &mockLogger{}
+	log.On("GetLogger").Return(logger.New())
+	log.On("Error", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	sut := sf.NewMetrics("gauges", log)
+
+	// Act
+	sut.SetGaugeLabels(1, "gauges", "active", "help", []string{"name"}, []string{"charge-card"})
+	sut.SetGaugeLabels(2, "gauges", "active", "help", []string{"name"}, []string{"charge-card"})
+	sut.SetGaugeLabels(3, "gauges", "active", "help", []string{"name"}, []string{"send-mail"})
+	sf.NewMetrics("gauges", log).SetGaugeLabels(4, "gauges", "active", "help", []string{"kind"}, []string{"other"})
+
+	w := httptest.NewRecorder()
+	promhttp.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Contains(t, w.Body.String(), `gauges_active{name="charge-card"} 2`)
+	assert.Contains(t, w.Body.String(), `gauges_active{name="send-mail"} 3`)
+	assert.NotContains(t, w.Body.String(), `gauges_active{kind="other"}`)
+	log.AssertCalled(t, "Error", "MetricsGauge", mock.Anything, mock.Anything)
+}
+
+func TestMiddlewareWrapperImpl_CounterAndHistogramLabels(t *testing.T) {
+	m, h := newSyntheticMetrics()
+	wrapper := sf.NewMiddlewareWrapper(&mockLogger{}, m, &sf.CORSOptions{}, sf.ServiceGlobals{})
+	r, _ := http.NewRequest(http.MethodPost, "/orders", nil)
+
+	// Act
+	sf.NewChainFor(wrapper, "public", "create_order", []sf.Middleware{sf.Counter, sf.Histogram}).
+		Then(func(w sf.WrappedResponseWriter, _ *http.Request, _ sf.RouterParams) {
+			w.WriteHeader(http.StatusInternalServerError)
+		})(sf.NewWrappedResponseWriter(httptest.NewRecorder()), r, sf.RouterParams{})
+
+	var values interface{} = mock.MatchedBy(func(values []string) bool {
+		return values[3] == "500" && values[4] == "post" && values[5] == "create_order"
+	})
+	m.AssertCalled(t, "CountLabels", "", "create_order_total", mock.Anything, mock.Anything, values)
+	m.AssertCalled(t, "AddHistogramLabels", "public", "create_order_duration_milliseconds", mock.Anything,
+		[]string{"method", "code"}, []string{"post", "500"})
+	h.AssertNumberOfCalls(t, "RecordTimeElapsed", 1)
+}
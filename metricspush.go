@@ -0,0 +1,393 @@
+package servicefoundation
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Prutswonder/go-servicefoundation/events"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+const (
+	// PushFormatPushgateway pushes the metrics in the text exposition format to a Prometheus Pushgateway.
+	PushFormatPushgateway = "pushgateway"
+	// PushFormatRemoteWrite pushes the metrics as a Prometheus remote-write request.
+	PushFormatRemoteWrite = "remote_write"
+
+	metricsPushSubsystem = "metrics_push"
+
+	defaultMetricsPushInterval = 15 * time.Second
+	defaultMetricsPushTimeout  = 10 * time.Second
+	defaultMetricsPushRetries  = 3
+	defaultMetricsPushBackoff  = time.Second
+	defaultMetricsPushBuffer   = 10
+	finalMetricsPushTimeout    = 5 * time.Second
+)
+
+type (
+	// MetricsPushOptions contains the settings for pushing the metrics to URL every Interval, in the Pushgateway or
+	// remote-write Format. Every push is attempted Retries times, with a Backoff that doubles per attempt. Pushes that
+	// keep failing are buffered and retried with the next push, keeping the last BufferSize pushes. The bearer token
+	// and the PEM encoded client certificate, key and root CAs are resolved on every push, so rotations are picked up.
+	// The metrics are gathered from the Gatherer, which defaults to the registry that is scraped on /metrics.
+	MetricsPushOptions struct {
+		URL            string
+		Format         string
+		Interval       time.Duration
+		Timeout        time.Duration
+		Retries        int
+		Backoff        time.Duration
+		BufferSize     int
+		BearerToken    SecretFunc
+		TLSCertificate SecretFunc
+		TLSKey         SecretFunc
+		TLSRootCAs     SecretFunc
+		Gatherer       prometheus.Gatherer
+	}
+
+	// MetricsPushStatus describes the health of the metrics push.
+	MetricsPushStatus struct {
+		URL                 string     `json:"url"`
+		Format              string     `json:"format"`
+		LastSuccess         *time.Time `json:"lastSuccess,omitempty"`
+		ConsecutiveFailures int        `json:"consecutiveFailures"`
+		Buffered            int        `json:"buffered"`
+		Dropped             int        `json:"dropped"`
+	}
+
+	// MetricsPusher periodically pushes the metrics, for environments where they can't be scraped.
+	MetricsPusher interface {
+		Start(ctx context.Context)
+		Push(ctx context.Context) error
+		Status() MetricsPushStatus
+	}
+
+	metricsPusherImpl struct {
+		options     MetricsPushOptions
+		job         string
+		instance    string
+		log         Logger
+		metrics     Metrics
+		pushMutex   sync.Mutex
+		mutex       sync.Mutex
+		pending     [][]byte
+		lastSuccess time.Time
+		failures    int
+		dropped     int
+		client      *http.Client
+		tlsSecrets  string
+	}
+)
+
+// ErrUnknownPushFormat is returned when the metrics push format is neither pushgateway nor remote_write.
+var ErrUnknownPushFormat = errors.New("unknown metrics push format")
+
+// NewMetricsPusher creates and returns a new MetricsPusher implementation, with the application name as job label and
+// the server name as instance label. Pushing is only active after calling Start.
+func NewMetricsPusher(options MetricsPushOptions, globals ServiceGlobals, log Logger, metrics Metrics) MetricsPusher {
+	if options.Format == "" {
+		options.Format = PushFormatPushgateway
+	}
+	if options.Interval <= 0 {
+		options.Interval = defaultMetricsPushInterval
+	}
+	if options.Timeout <= 0 {
+		options.Timeout = defaultMetricsPushTimeout
+	}
+	if options.Retries <= 0 {
+		options.Retries = defaultMetricsPushRetries
+	}
+	if options.Backoff <= 0 {
+		options.Backoff = defaultMetricsPushBackoff
+	}
+	if options.BufferSize <= 0 {
+		options.BufferSize = defaultMetricsPushBuffer
+	}
+	if options.Gatherer == nil {
+		options.Gatherer = prometheus.DefaultGatherer
+	}
+
+	return &metricsPusherImpl{
+		options:  options,
+		job:      globals.AppName,
+		instance: globals.ServerName,
+		log:      log,
+		metrics:  metrics,
+	}
+}
+
+/* MetricsPusher implementation */
+
+func (p *metricsPusherImpl) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(p.options.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				p.Push(ctx)
+			}
+		}
+	}()
+}
+
+// Push collects the metrics and pushes them after the buffered pushes, oldest first. When a push fails, it and the
+// pushes after it are buffered, dropping the oldest ones when the buffer is full.
+func (p *metricsPusherImpl) Push(ctx context.Context) error {
+	p.pushMutex.Lock()
+	defer p.pushMutex.Unlock()
+
+	payload, err := p.collect()
+	if err != nil {
+		p.failed(err)
+		return err
+	}
+
+	p.mutex.Lock()
+	pending := append(p.pending, payload)
+	p.mutex.Unlock()
+
+	for len(pending) > 0 {
+		if err = p.send(ctx, pending[0]); err != nil {
+			break
+		}
+		pending = pending[1:]
+	}
+
+	dropped := 0
+	if len(pending) > p.options.BufferSize {
+		dropped = len(pending) - p.options.BufferSize
+		pending = pending[dropped:]
+	}
+
+	p.mutex.Lock()
+	p.pending = append([][]byte(nil), pending...)
+	p.dropped += dropped
+	p.mutex.Unlock()
+
+	if dropped > 0 {
+		p.metrics.IncreaseCounter(metricsPushSubsystem, "dropped_total",
+			"Total metrics pushes dropped from the full buffer.", dropped)
+	}
+	p.metrics.SetGauge(float64(len(pending)), metricsPushSubsystem, "buffered", "Number of buffered metrics pushes.")
+
+	if err != nil {
+		p.failed(err)
+		return err
+	}
+	p.succeeded()
+	return nil
+}
+
+func (p *metricsPusherImpl) Status() MetricsPushStatus {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	status := MetricsPushStatus{
+		URL:                 p.options.URL,
+		Format:              p.options.Format,
+		ConsecutiveFailures: p.failures,
+		Buffered:            len(p.pending),
+		Dropped:             p.dropped,
+	}
+	if !p.lastSuccess.IsZero() {
+		lastSuccess := p.lastSuccess
+		status.LastSuccess = &lastSuccess
+	}
+	return status
+}
+
+// collect gathers the metrics and encodes them in the push format. Remote-write samples get the collection time as
+// timestamp, so buffered pushes keep their place in the series.
+func (p *metricsPusherImpl) collect() ([]byte, error) {
+	now := time.Now()
+
+	families, err := p.options.Gatherer.Gather()
+	if err != nil {
+		return nil, err
+	}
+
+	switch p.options.Format {
+	case PushFormatPushgateway:
+		return encodeExposition(families)
+	case PushFormatRemoteWrite:
+		return encodeRemoteWrite(families, []promLabel{{"instance", p.instance}, {"job", p.job}}, now), nil
+	}
+	return nil, ErrUnknownPushFormat
+}
+
+// send posts the payload, retrying with a doubling backoff.
+func (p *metricsPusherImpl) send(ctx context.Context, payload []byte) error {
+	var err error
+	backoff := p.options.Backoff
+
+	for attempt := 1; attempt <= p.options.Retries; attempt++ {
+		if err = p.post(ctx, payload); err == nil {
+			return nil
+		}
+		if attempt == p.options.Retries {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+	return err
+}
+
+func (p *metricsPusherImpl) post(ctx context.Context, payload []byte) error {
+	client, err := p.httpClient()
+	if err != nil {
+		return err
+	}
+
+	target := p.options.URL
+	if p.options.Format == PushFormatPushgateway {
+		// The grouping key replaces the metrics of this instance on every push.
+		target = fmt.Sprintf("%s/metrics/job/%s/instance/%s", strings.TrimSuffix(target, "/"),
+			url.PathEscape(p.job), url.PathEscape(p.instance))
+	}
+
+	req, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	if p.options.Format == PushFormatRemoteWrite {
+		req.Header.Set(ContentTypeHeader, "application/x-protobuf")
+		req.Header.Set("Content-Encoding", "snappy")
+		req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	} else {
+		req.Header.Set(ContentTypeHeader, string(expfmt.FmtText))
+	}
+	if p.options.BearerToken != nil {
+		token, err := p.options.BearerToken()
+		if err != nil {
+			return fmt.Errorf("failed resolving bearer token: %v", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, p.options.Timeout)
+	defer cancel()
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// httpClient returns the client for the current TLS secrets, which is replaced when they are rotated.
+func (p *metricsPusherImpl) httpClient() (*http.Client, error) {
+	certificate, err := resolveSecret(p.options.TLSCertificate)
+	if err != nil {
+		return nil, err
+	}
+	key, err := resolveSecret(p.options.TLSKey)
+	if err != nil {
+		return nil, err
+	}
+	rootCAs, err := resolveSecret(p.options.TLSRootCAs)
+	if err != nil {
+		return nil, err
+	}
+
+	secrets := certificate + "\x00" + key + "\x00" + rootCAs
+	if p.client != nil && secrets == p.tlsSecrets {
+		return p.client, nil
+	}
+
+	var tlsConfig *tls.Config
+	if certificate != "" || rootCAs != "" {
+		tlsConfig = &tls.Config{}
+	}
+	if certificate != "" {
+		pair, err := tls.X509KeyPair([]byte(certificate), []byte(key))
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{pair}
+	}
+	if rootCAs != "" {
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM([]byte(rootCAs)) {
+			return nil, errors.New("no valid root CAs")
+		}
+	}
+
+	if p.client != nil {
+		p.client.Transport.(*http.Transport).CloseIdleConnections()
+	}
+	p.client = &http.Client{Transport: NewTransport(TransportOptions{TLSConfig: tlsConfig})}
+	p.tlsSecrets = secrets
+	return p.client, nil
+}
+
+func (p *metricsPusherImpl) succeeded() {
+	now := time.Now()
+
+	p.mutex.Lock()
+	p.lastSuccess = now
+	p.failures = 0
+	p.mutex.Unlock()
+
+	p.metrics.SetGauge(float64(now.Unix()), metricsPushSubsystem, "last_success_timestamp_seconds",
+		"Time of the last successful metrics push.")
+	p.metrics.SetGauge(0, metricsPushSubsystem, "consecutive_failures", "Number of consecutive failed metrics pushes.")
+}
+
+func (p *metricsPusherImpl) failed(err error) {
+	p.mutex.Lock()
+	p.failures++
+	failures := p.failures
+	p.mutex.Unlock()
+
+	p.log.Warn(events.MetricsPush, "Failed pushing metrics to %s (%d consecutive failures): %v", p.options.URL,
+		failures, err)
+	p.metrics.Count(metricsPushSubsystem, "failures_total", "Total failed metrics pushes.")
+	p.metrics.SetGauge(float64(failures), metricsPushSubsystem, "consecutive_failures",
+		"Number of consecutive failed metrics pushes.")
+}
+
+// encodeExposition encodes the metric families in the text exposition format, like the /metrics scrape handler.
+func encodeExposition(families []*dto.MetricFamily) ([]byte, error) {
+	var b bytes.Buffer
+	encoder := expfmt.NewEncoder(&b, expfmt.FmtText)
+
+	for _, family := range families {
+		if err := encoder.Encode(family); err != nil {
+			return nil, err
+		}
+	}
+	return b.Bytes(), nil
+}
+
+func resolveSecret(secret SecretFunc) (string, error) {
+	if secret == nil {
+		return "", nil
+	}
+	return secret()
+}
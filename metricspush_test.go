@@ -0,0 +1,379 @@
+package servicefoundation_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	sf "github.com/Prutswonder/go-servicefoundation"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+const pushExposition = `# HELP requests_total Total requests.
+# TYPE requests_total counter
+requests_total{code="200",route="orders"} 42
+# HELP up Whether the service is up.
+# TYPE up gauge
+up 1
+`
+
+type (
+	pushReceiver struct {
+		mutex    sync.Mutex
+		failures int
+		requests []*http.Request
+		bodies   [][]byte
+	}
+
+	remoteWriteSeries struct {
+		labels map[string]string
+		value  float64
+	}
+)
+
+// ServeHTTP records the push, failing the first failures pushes.
+func (r *pushReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := ioutil.ReadAll(req.Body)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.requests = append(r.requests, req)
+	r.bodies = append(r.bodies, body)
+	if r.failures > 0 {
+		r.failures--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (r *pushReceiver) count() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return len(r.requests)
+}
+
+func newPushMetrics() *mockMetrics {
+	m := &mockMetrics{}
+	m.On("SetGauge", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+	m.On("Count", mock.Anything, mock.Anything, mock.Anything)
+	m.On("IncreaseCounter", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+	return m
+}
+
+func newPushLogger() *mockLogger {
+	log := &mockLogger{}
+	log.On("Debug", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	log.On("Warn", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	return log
+}
+
+// newPushRegistry returns a registry with the metrics of pushExposition.
+func newPushRegistry() *prometheus.Registry {
+	requests := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "requests_total", Help: "Total requests."},
+		[]string{"route", "code"})
+	requests.WithLabelValues("orders", "200").Add(42)
+	up := prometheus.NewGauge(prometheus.GaugeOpts{Name: "up", Help: "Whether the service is up."})
+	up.Set(1)
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(requests, up)
+	return registry
+}
+
+func newTestPusher(url, format string, m sf.Metrics, configure func(o *sf.MetricsPushOptions)) sf.MetricsPusher {
+	options := sf.MetricsPushOptions{
+		URL:      url,
+		Format:   format,
+		Backoff:  time.Millisecond,
+		Gatherer: newPushRegistry(),
+	}
+	if configure != nil {
+		configure(&options)
+	}
+	return sf.NewMetricsPusher(options, sf.ServiceGlobals{AppName: "orders", ServerName: "edge-1"}, newPushLogger(), m)
+}
+
+// decodeRemoteWrite decodes the literals of a snappy block and the series of the WriteRequest it contains.
+func decodeRemoteWrite(t *testing.T, body []byte) []remoteWriteSeries {
+	r := bytes.NewReader(body)
+	length, _ := binary.ReadUvarint(r)
+	var data bytes.Buffer
+	for r.Len() > 0 {
+		tag, _ := r.ReadByte()
+		assert.Equal(t, byte(0), tag&3, "only literals are expected")
+		n := int(tag>>2) + 1
+		switch tag >> 2 {
+		case 60:
+			b, _ := r.ReadByte()
+			n = int(b) + 1
+		case 61:
+			var b uint16
+			binary.Read(r, binary.LittleEndian, &b)
+			n = int(b) + 1
+		}
+		literal := make([]byte, n)
+		r.Read(literal)
+		data.Write(literal)
+	}
+	assert.Equal(t, int(length), data.Len())
+
+	var series []remoteWriteSeries
+	for _, s := range protoFields(data.Bytes())[1] {
+		fields := protoFields(s)
+		decoded := remoteWriteSeries{labels: make(map[string]string)}
+		for _, l := range fields[1] {
+			label := protoFields(l)
+			decoded.labels[string(label[1][0])] = string(label[2][0])
+		}
+		sample := protoFields(fields[2][0])
+		decoded.value = math.Float64frombits(binary.LittleEndian.Uint64(sample[1][0]))
+		series = append(series, decoded)
+	}
+	return series
+}
+
+// protoFields returns the values of the length-delimited and fixed64 fields of a protobuf message by field number.
+func protoFields(message []byte) map[uint64][][]byte {
+	fields := make(map[uint64][][]byte)
+	r := bytes.NewReader(message)
+	for r.Len() > 0 {
+		key, _ := binary.ReadUvarint(r)
+		var value []byte
+		switch key & 7 {
+		case 0:
+			binary.ReadUvarint(r)
+		case 1:
+			value = make([]byte, 8)
+			r.Read(value)
+		case 2:
+			n, _ := binary.ReadUvarint(r)
+			value = make([]byte, n)
+			r.Read(value)
+		}
+		fields[key>>3] = append(fields[key>>3], value)
+	}
+	return fields
+}
+
+func TestMetricsPusher_Pushgateway(t *testing.T) {
+	receiver := &pushReceiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+	sut := newTestPusher(server.URL, sf.PushFormatPushgateway, newPushMetrics(), func(o *sf.MetricsPushOptions) {
+		o.BearerToken = func() (string, error) { return "push-token", nil }
+	})
+
+	// Act
+	err := sut.Push(context.Background())
+
+	assert.NoError(t, err)
+	if assert.Equal(t, 1, receiver.count()) {
+		req := receiver.requests[0]
+		assert.Equal(t, http.MethodPost, req.Method)
+		assert.Equal(t, "/metrics/job/orders/instance/edge-1", req.URL.Path)
+		assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", req.Header.Get("Content-Type"))
+		assert.Equal(t, "Bearer push-token", req.Header.Get("Authorization"))
+		assert.Equal(t, pushExposition, string(receiver.bodies[0]))
+	}
+	status := sut.Status()
+	assert.NotNil(t, status.LastSuccess)
+	assert.Equal(t, 0, status.ConsecutiveFailures)
+}
+
+func TestMetricsPusher_RemoteWrite(t *testing.T) {
+	receiver := &pushReceiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+	sut := newTestPusher(server.URL+"/api/v1/write", sf.PushFormatRemoteWrite, newPushMetrics(), nil)
+
+	// Act
+	err := sut.Push(context.Background())
+
+	assert.NoError(t, err)
+	if assert.Equal(t, 1, receiver.count()) {
+		req := receiver.requests[0]
+		assert.Equal(t, "/api/v1/write", req.URL.Path)
+		assert.Equal(t, "application/x-protobuf", req.Header.Get("Content-Type"))
+		assert.Equal(t, "snappy", req.Header.Get("Content-Encoding"))
+		assert.Equal(t, []remoteWriteSeries{
+			{map[string]string{"__name__": "requests_total", "route": "orders", "code": "200", "job": "orders", "instance": "edge-1"}, 42},
+			{map[string]string{"__name__": "up", "job": "orders", "instance": "edge-1"}, 1},
+		}, decodeRemoteWrite(t, receiver.bodies[0]))
+	}
+}
+
+func TestMetricsPusher_RemoteWriteHistogram(t *testing.T) {
+	receiver := &pushReceiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+	latency := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "latency_seconds", Help: "Latency.",
+		Buckets: []float64{0.1, 1}})
+	latency.Observe(0.5)
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(latency)
+	sut := newTestPusher(server.URL, sf.PushFormatRemoteWrite, newPushMetrics(), func(o *sf.MetricsPushOptions) {
+		o.Gatherer = registry
+	})
+
+	// Act
+	err := sut.Push(context.Background())
+
+	assert.NoError(t, err)
+	if assert.Equal(t, 1, receiver.count()) {
+		labels := func(name, le string) map[string]string {
+			l := map[string]string{"__name__": name, "job": "orders", "instance": "edge-1"}
+			if le != "" {
+				l["le"] = le
+			}
+			return l
+		}
+		assert.Equal(t, []remoteWriteSeries{
+			{labels("latency_seconds_bucket", "0.1"), 0},
+			{labels("latency_seconds_bucket", "1"), 1},
+			{labels("latency_seconds_bucket", "+Inf"), 1},
+			{labels("latency_seconds_sum", ""), 0.5},
+			{labels("latency_seconds_count", ""), 1},
+		}, decodeRemoteWrite(t, receiver.bodies[0]))
+	}
+}
+
+func TestMetricsPusher_TLS(t *testing.T) {
+	receiver := &pushReceiver{}
+	server := httptest.NewTLSServer(receiver)
+	defer server.Close()
+	rootCA := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}))
+	sut := newTestPusher(server.URL, sf.PushFormatPushgateway, newPushMetrics(), func(o *sf.MetricsPushOptions) {
+		o.TLSRootCAs = func() (string, error) { return rootCA, nil }
+	})
+
+	// Act
+	err := sut.Push(context.Background())
+
+	assert.NoError(t, err)
+	assert.Equal(t, 1, receiver.count())
+}
+
+func TestMetricsPusher_Retries(t *testing.T) {
+	receiver := &pushReceiver{failures: 2}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+	sut := newTestPusher(server.URL, sf.PushFormatPushgateway, newPushMetrics(), nil)
+
+	// Act
+	err := sut.Push(context.Background())
+
+	assert.NoError(t, err)
+	assert.Equal(t, 3, receiver.count())
+	assert.Equal(t, 0, sut.Status().Buffered)
+}
+
+func TestMetricsPusher_BufferOverflow(t *testing.T) {
+	receiver := &pushReceiver{failures: 4}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+	m := newPushMetrics()
+	sut := newTestPusher(server.URL, sf.PushFormatPushgateway, m, func(o *sf.MetricsPushOptions) {
+		o.Retries = 1
+		o.BufferSize = 2
+	})
+
+	// Act
+	for i := 0; i < 4; i++ {
+		assert.Error(t, sut.Push(context.Background()))
+	}
+
+	status := sut.Status()
+	assert.Nil(t, status.LastSuccess)
+	assert.Equal(t, 4, status.ConsecutiveFailures)
+	assert.Equal(t, 2, status.Buffered)
+	assert.Equal(t, 2, status.Dropped)
+	m.AssertCalled(t, "IncreaseCounter", "metrics_push", "dropped_total", mock.Anything, 1)
+
+	assert.NoError(t, sut.Push(context.Background()))
+	assert.Equal(t, 4+3, receiver.count(), "the buffered pushes are sent before the current one")
+	status = sut.Status()
+	assert.NotNil(t, status.LastSuccess)
+	assert.Equal(t, 0, status.ConsecutiveFailures)
+	assert.Equal(t, 0, status.Buffered)
+}
+
+func TestMetricsPusher_GatherFailure(t *testing.T) {
+	sut := newTestPusher("http://localhost:0", sf.PushFormatPushgateway, newPushMetrics(), func(o *sf.MetricsPushOptions) {
+		o.Gatherer = prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+			return nil, errors.New("gather failed")
+		})
+	})
+
+	// Act
+	err := sut.Push(context.Background())
+
+	assert.EqualError(t, err, "gather failed")
+	assert.Equal(t, 1, sut.Status().ConsecutiveFailures)
+}
+
+func TestServiceImpl_PushesMetricsOnShutdown(t *testing.T) {
+	receiver := &pushReceiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+	log := newPushLogger()
+	log.On("Info", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	log.On("Error", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	opt := sf.NewServiceOptions("push", []string{http.MethodGet}, nil)
+	opt.Logger = log
+	opt.Port, opt.ReadinessPort, opt.InternalPort = 0, 0, 0
+	opt.ShutdownMode = sf.ShutdownModeGraceful
+	opt.MetricsPusher = newTestPusher(server.URL, sf.PushFormatPushgateway, newPushMetrics(), func(o *sf.MetricsPushOptions) {
+		o.Interval = time.Hour
+	})
+	sut := sf.NewCustomService(opt)
+	ctx, cancel := context.WithCancel(context.Background())
+	returned := make(chan error, 1)
+
+	// Act
+	go func() { returned <- sut.Run(ctx) }()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	select {
+	case <-returned:
+		assert.Equal(t, 1, receiver.count(), "the metrics are pushed before Run returns")
+	case <-time.After(5 * time.Second):
+		t.Fatal("service didn't return")
+	}
+}
+
+func TestServiceInfoHandler_MetricsPush(t *testing.T) {
+	receiver := &pushReceiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+	pusher := newTestPusher(server.URL, sf.PushFormatPushgateway, newPushMetrics(), nil)
+	pusher.Push(context.Background())
+	manager := &mockServerManager{}
+	manager.On("Servers").Return(map[string]sf.ServerInfo{})
+	w := httptest.NewRecorder()
+
+	// Act
+	sf.NewServiceInfoHandler(sf.ServiceGlobals{AppName: "orders"}, manager, pusher, nil)(sf.NewWrappedResponseWriter(w), nil, sf.RouterParams{})
+
+	var actual struct {
+		MetricsPush sf.MetricsPushStatus `json:"metricsPush"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &actual))
+	assert.Equal(t, server.URL, actual.MetricsPush.URL)
+	assert.NotNil(t, actual.MetricsPush.LastSuccess)
+}
@@ -5,8 +5,10 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/Prutswonder/go-servicefoundation/events"
 	"github.com/rs/cors"
 )
 
@@ -15,14 +17,25 @@ const (
 	CORS Middleware = 1
 	// NoCaching is a middleware enumeration to adding no-caching headers to the response.
 	NoCaching Middleware = 2
-	// Counter is a middleware enumeration to add counter metrics to the current request/response.
+	// Counter is a middleware enumeration to add counter metrics with the method and status code to the current
+	// request/response.
 	Counter Middleware = 3
-	// Histogram is a middleware enumeration to add histogram metrics to the current request/response.
+	// Histogram is a middleware enumeration to add histogram metrics with the method and status code to the current
+	// request/response.
 	Histogram Middleware = 4
 	// PanicTo500 is a middleware enumeration to log panics as errors and respond with http status-code 500.
 	PanicTo500 Middleware = 5
 	// RequestLogging is a middleware enumeration to log the incoming request and response times.
 	RequestLogging Middleware = 6
+	// RequestID is a middleware enumeration to read or generate the ID of the request, and add it to the response and
+	// the request context.
+	RequestID Middleware = 7
+	// Compression is a middleware enumeration to compress the response with gzip or deflate, as accepted by the
+	// request. Its settings are the Compression options of ServiceOptions.
+	Compression Middleware = 8
+
+	// The values of registered middlewares follow the predefined ones.
+	firstRegisteredMiddleware Middleware = 100
 )
 
 type (
@@ -35,155 +48,243 @@ type (
 	}
 )
 
+type registeredMiddleware struct {
+	name       string
+	middleware MiddlewareFunc
+}
+
+var (
+	middlewareRegistry      = make(map[Middleware]registeredMiddleware)
+	middlewareRegistryNames = make(map[string]Middleware)
+	middlewareRegistryMutex sync.RWMutex
+)
+
 type middlewareWrapperImpl struct {
 	logger      Logger
 	metrics     Metrics
 	globals     ServiceGlobals
 	corsOptions *cors.Options
+	requestID   MiddlewareFunc
+	compression MiddlewareFunc
 }
 
-// NewMiddlewareWrapper instantiates a new MiddelwareWrapper implementation.
+// NewMiddlewareWrapper instantiates a new MiddelwareWrapper implementation. The RequestID middleware reads the header
+// that is configured by REQUEST_ID_HEADER.
 func NewMiddlewareWrapper(logger Logger, metrics Metrics, corsOptions *CORSOptions, globals ServiceGlobals) MiddlewareWrapper {
 	m := &middlewareWrapperImpl{
-		logger:  logger,
-		metrics: metrics,
-		globals: globals,
+		logger:      logger,
+		metrics:     metrics,
+		globals:     globals,
+		requestID:   NewRequestIDMiddleware(requestIDHeaderVariable.String()),
+		compression: NewCompressionMiddleware(CompressionOptions{}),
 	}
 	m.corsOptions = m.mergeCORSOptions(corsOptions)
 	return m
 }
 
+// RegisterMiddleware registers a custom middleware, like authentication or tenant extraction, and returns its
+// Middleware value, which can be used in the middlewares of routes next to the predefined ones. The middlewares of a
+// route are applied in slice order, so the last one receives requests first: list custom middlewares before
+// PanicTo500 and RequestLogging to have their panics recovered and their responses logged. The middleware can respond
+// without calling the next handle, and read the status of the response after calling it. Registering a name again
+// replaces its middleware.
+func RegisterMiddleware(name string, middleware MiddlewareFunc) Middleware {
+	middlewareRegistryMutex.Lock()
+	defer middlewareRegistryMutex.Unlock()
+
+	value, ok := middlewareRegistryNames[name]
+	if !ok {
+		value = firstRegisteredMiddleware + Middleware(len(middlewareRegistry))
+		middlewareRegistryNames[name] = value
+	}
+	middlewareRegistry[value] = registeredMiddleware{name: name, middleware: middleware}
+	return value
+}
+
+// withCompression returns a copy of the MiddlewareWrapper of which the Compression middleware uses the options.
+func (m *middlewareWrapperImpl) withCompression(options CompressionOptions) *middlewareWrapperImpl {
+	wrapper := *m
+	wrapper.compression = NewCompressionMiddleware(options)
+	return &wrapper
+}
+
+func lookupMiddleware(middleware Middleware) (registeredMiddleware, bool) {
+	middlewareRegistryMutex.RLock()
+	defer middlewareRegistryMutex.RUnlock()
+
+	registered, ok := middlewareRegistry[middleware]
+	return registered, ok
+}
+
 /* MiddlewareWrapper implementation */
 
 func (m *middlewareWrapperImpl) Wrap(subsystem, name string, middleware Middleware, handler Handle) Handle {
+	middlewareFunc := m.middlewareFunc(subsystem, name, middleware)
+
+	if middlewareFunc == nil {
+		m.logger.Warn(events.UnhandledMiddleware, "Unhandled middleware: %v", middleware)
+		return handler
+	}
+	return NewChain(middlewareFunc).Then(handler)
+}
+
+func (m *middlewareWrapperImpl) middlewareFunc(subsystem, name string, middleware Middleware) MiddlewareFunc {
 	switch middleware {
 	case CORS:
-		return m.wrapWithCORS(subsystem, name, handler)
+		return m.wrapWithCORS(subsystem, name)
 	case NoCaching:
-		return m.wrapWithNoCache(subsystem, name, handler)
+		return m.wrapWithNoCache(subsystem, name)
 	case Counter:
-		return m.wrapWithCounter("", name, handler)
+		return m.wrapWithCounter("", name)
 	case Histogram:
-		return m.wrapWithHistogram(subsystem, name, handler)
+		return m.wrapWithHistogram(subsystem, name)
 	case PanicTo500:
-		return m.wrapWithPanicHandler(subsystem, name, handler)
+		return m.wrapWithPanicHandler(subsystem, name)
 	case RequestLogging:
-		return m.wrapWithRequestLogging(subsystem, name, handler)
-	default:
-		m.logger.Warn("UnhandledMiddleware", "Unhandled middleware: %v", middleware)
+		return m.wrapWithRequestLogging(subsystem, name)
+	case RequestID:
+		return m.requestID
+	case Compression:
+		return m.compression
 	}
-	return handler
-}
-
-func (m *middlewareWrapperImpl) wrapWithCounter(subsystem, name string, handler Handle) Handle {
-	return func(w WrappedResponseWriter, r *http.Request, p RouterParams) {
-		lcName := strings.ToLower(name)
-		counterName := fmt.Sprintf("%v_total", lcName)
-		counterHelp := fmt.Sprintf("Totals for %v.", name)
-
-		m.metrics.CountLabels("", counterName, counterHelp,
-			[]string{"app", "server", "env", "code", "method", "handler", "version", "subsystem"},
-			[]string{
-				m.globals.AppName,
-				m.globals.ServerName,
-				m.globals.DeployEnvironment,
-				strconv.Itoa(w.Status()),
-				strings.ToLower(r.Method),
-				lcName,
-				m.globals.VersionNumber,
-				subsystem,
-			},
-		)
-
-		handler(w, r, p)
+	if registered, ok := lookupMiddleware(middleware); ok {
+		return registered.middleware
 	}
+	return nil
 }
 
-func (m *middlewareWrapperImpl) wrapWithHistogram(subsystem, name string, handler Handle) Handle {
-	return func(w WrappedResponseWriter, r *http.Request, p RouterParams) {
-		histogramName := fmt.Sprintf("%v_duration_milliseconds", strings.ToLower(name))
-		histogramHelp := fmt.Sprintf("Response times for %v in milliseconds.", name)
-
-		hist := m.metrics.AddHistogram(subsystem, histogramName, histogramHelp)
-		start := time.Now()
+func (m *middlewareWrapperImpl) wrapWithCounter(subsystem, name string) MiddlewareFunc {
+	return func(handler Handle) Handle {
+		return func(w WrappedResponseWriter, r *http.Request, p RouterParams) {
+			lcName := strings.ToLower(name)
+			counterName := fmt.Sprintf("%v_total", lcName)
+			counterHelp := fmt.Sprintf("Totals for %v.", name)
 
-		handler(w, r, p)
+			handler(w, r, p)
 
-		hist.RecordTimeElapsed(start, time.Second)
+			// Counted after the handler, so the code label has the status of the response.
+			m.countRequest(r, counterName, counterHelp, w.Status(), lcName, subsystem)
+		}
 	}
 }
 
-func (m *middlewareWrapperImpl) wrapWithRequestLogging(subsystem, name string, handler Handle) Handle {
-	return func(w WrappedResponseWriter, r *http.Request, p RouterParams) {
-		lcName := strings.ToLower(name)
-		log := m.logger
-		start := time.Now()
-
-		//TODO: Log message for requests
-		//log.Info(fmt.Sprintf("Request-%s", name), "TODO")
-		m.metrics.CountLabels("", "http_requests_total", "Total requests.",
-			[]string{"app", "server", "env", "code", "method", "handler", "version", "subsystem"},
-			[]string{
-				m.globals.AppName,
-				m.globals.ServerName,
-				m.globals.DeployEnvironment,
-				strconv.Itoa(w.Status()),
-				strings.ToLower(r.Method),
-				lcName,
-				m.globals.VersionNumber,
-				subsystem,
-			},
-		)
-		histSeconds := m.metrics.AddHistogram("", "http_request_duration_seconds",
-			"Response times for requests in seconds.")
-		histMicroSeconds := m.metrics.AddHistogram("", "http_request_duration_microseconds",
-			"Response times for requests in microseconds.")
-
-		handler(w, r, p)
-
-		elapsedMicroSeconds := time.Since(start).Nanoseconds() / int64(time.Microsecond)
-
-		//TODO: Histograms are always measured in seconds and Summaries in milliseconds. This should be made configurable in go-metrics:
-		histMicroSeconds.RecordTimeElapsed(start, time.Second)
-		histSeconds.RecordTimeElapsed(start, time.Microsecond)
-
-		//TODO: Log message for responses
-		log.Info(fmt.Sprintf("Response-%s", name), "Elapsed (microsec): %d", elapsedMicroSeconds)
-		m.metrics.CountLabels("", "http_responses_total", "Total responses.",
-			[]string{"app", "server", "env", "code", "method", "handler", "version", "subsystem"},
-			[]string{
-				m.globals.AppName,
-				m.globals.ServerName,
-				m.globals.DeployEnvironment,
-				strconv.Itoa(w.Status()),
-				strings.ToLower(r.Method),
-				lcName,
-				m.globals.VersionNumber,
-				subsystem,
-			},
-		)
+func (m *middlewareWrapperImpl) wrapWithHistogram(subsystem, name string) MiddlewareFunc {
+	return func(handler Handle) Handle {
+		return func(w WrappedResponseWriter, r *http.Request, p RouterParams) {
+			histogramName := fmt.Sprintf("%v_duration_milliseconds", strings.ToLower(name))
+			histogramHelp := fmt.Sprintf("Response times for %v in milliseconds.", name)
+
+			histogramSubsystem, record := syntheticHistogram(r.Context(), subsystem)
+			if !record {
+				handler(w, r, p)
+				return
+			}
+
+			start := time.Now()
+
+			handler(w, r, p)
+
+			hist := m.metrics.AddHistogramLabels(histogramSubsystem, histogramName, histogramHelp,
+				[]string{"method", "code"}, []string{strings.ToLower(r.Method), strconv.Itoa(w.Status())})
+			hist.RecordTimeElapsed(start, time.Second)
+		}
 	}
 }
 
-func (m *middlewareWrapperImpl) wrapWithNoCache(subsystem, name string, handler Handle) Handle {
-	return func(w WrappedResponseWriter, r *http.Request, p RouterParams) {
-		w.Header().Set("Cache-Control", "max-age: 0, private")
-		w.Header().Set("Last-Modified", time.Now().Format(http.TimeFormat))
-		w.Header().Set("Expires", time.Now().AddDate(-1, 0, 0).Format(http.TimeFormat))
+func (m *middlewareWrapperImpl) wrapWithRequestLogging(subsystem, name string) MiddlewareFunc {
+	return func(handler Handle) Handle {
+		return func(w WrappedResponseWriter, r *http.Request, p RouterParams) {
+			lcName := strings.ToLower(name)
+			log := NewRequestLogger(r.Context(), m.logger)
+			start := time.Now()
+
+			//TODO: Log message for requests
+			//log.Info(fmt.Sprintf("Request-%s", name), "TODO")
+			m.countRequest(r, "http_requests_total", "Total requests.", w.Status(), lcName, subsystem)
+			histogramSubsystem, record := syntheticHistogram(r.Context(), "")
+			var histSeconds, histMicroSeconds MetricsHistogram
+			if record {
+				histSeconds = m.metrics.AddHistogram(histogramSubsystem, "http_request_duration_seconds",
+					"Response times for requests in seconds.")
+				histMicroSeconds = m.metrics.AddHistogram(histogramSubsystem, "http_request_duration_microseconds",
+					"Response times for requests in microseconds.")
+			}
+
+			handler(w, r, p)
+
+			elapsedMicroSeconds := time.Since(start).Nanoseconds() / int64(time.Microsecond)
 
-		handler(w, r, p)
+			//TODO: Histograms are always measured in seconds and Summaries in milliseconds. This should be made configurable in go-metrics:
+			if record {
+				histMicroSeconds.RecordTimeElapsed(start, time.Second)
+				histSeconds.RecordTimeElapsed(start, time.Microsecond)
+			}
+
+			fields := map[string]interface{}{
+				"method":      r.Method,
+				"path":        r.URL.Path,
+				"status":      w.Status(),
+				"duration_us": elapsedMicroSeconds,
+				"remote_addr": r.RemoteAddr,
+			}
+			if source := SyntheticSource(r.Context()); source != "" {
+				// Marked, so log-based alerting can filter synthetic requests.
+				fields["synthetic_source"] = source
+			}
+			if baggage := baggageLogFields(r.Context()); baggage != "" {
+				fields["baggage"] = baggage
+			}
+			WithFields(log, fields).Info(fmt.Sprintf("Response-%s", name), "Handled request")
+			m.countRequest(r, "http_responses_total", "Total responses.", w.Status(), lcName, subsystem)
+		}
 	}
 }
 
-func (m *middlewareWrapperImpl) wrapWithCORS(subsystem, name string, handler Handle) Handle {
-	return func(w WrappedResponseWriter, r *http.Request, p RouterParams) {
-		c := cors.New(*m.corsOptions)
+// countRequest counts the request with the standard labels and the baggage labels, taking the synthetic traffic policy
+// into account.
+func (m *middlewareWrapperImpl) countRequest(r *http.Request, name, help string, status int, handler, subsystem string) {
+	labels, values := baggageMetrics(r.Context(),
+		[]string{"app", "server", "env", "code", "method", "handler", "version", "subsystem"},
+		[]string{
+			m.globals.AppName,
+			m.globals.ServerName,
+			m.globals.DeployEnvironment,
+			strconv.Itoa(status),
+			strings.ToLower(r.Method),
+			handler,
+			m.globals.VersionNumber,
+			subsystem,
+		},
+	)
+	labels, values, record := syntheticMetrics(r.Context(), labels, values)
+	if record {
+		m.metrics.CountLabels("", name, help, labels, values)
+	}
+}
+
+func (m *middlewareWrapperImpl) wrapWithNoCache(subsystem, name string) MiddlewareFunc {
+	return func(handler Handle) Handle {
+		return func(w WrappedResponseWriter, r *http.Request, p RouterParams) {
+			w.Header().Set("Cache-Control", "max-age: 0, private")
+			w.Header().Set("Last-Modified", time.Now().Format(http.TimeFormat))
+			w.Header().Set("Expires", time.Now().AddDate(-1, 0, 0).Format(http.TimeFormat))
 
-		h := func(ww http.ResponseWriter, r *http.Request) {
-			w := NewWrappedResponseWriter(ww)
 			handler(w, r, p)
 		}
-		c.ServeHTTP(w, r, h)
+	}
+}
+
+func (m *middlewareWrapperImpl) wrapWithCORS(subsystem, name string) MiddlewareFunc {
+	return func(handler Handle) Handle {
+		return func(w WrappedResponseWriter, r *http.Request, p RouterParams) {
+			c := cors.New(*m.corsOptions)
+
+			h := func(ww http.ResponseWriter, r *http.Request) {
+				w := NewWrappedResponseWriter(ww)
+				handler(w, r, p)
+			}
+			c.ServeHTTP(w, r, h)
+		}
 	}
 }
 
@@ -206,15 +307,17 @@ func (m *middlewareWrapperImpl) mergeCORSOptions(options *CORSOptions) *cors.Opt
 	return &corsOptions
 }
 
-func (m *middlewareWrapperImpl) wrapWithPanicHandler(subsystem, name string, handler Handle) Handle {
-	return func(w WrappedResponseWriter, r *http.Request, p RouterParams) {
-		defer func() {
-			if rec := recover(); rec != nil {
-				m.logger.Error("PanicAutorecover", "PANIC recovered: %v", rec)
-				w.WriteHeader(http.StatusInternalServerError)
-			}
-		}()
+func (m *middlewareWrapperImpl) wrapWithPanicHandler(subsystem, name string) MiddlewareFunc {
+	return func(handler Handle) Handle {
+		return func(w WrappedResponseWriter, r *http.Request, p RouterParams) {
+			defer func() {
+				if rec := recover(); rec != nil {
+					NewRequestLogger(r.Context(), m.logger).Error(events.PanicAutorecover, "PANIC recovered: %v", rec)
+					w.WriteHeader(http.StatusInternalServerError)
+				}
+			}()
 
-		handler(w, r, p)
+			handler(w, r, p)
+		}
 	}
 }
@@ -2,55 +2,51 @@ package servicefoundation_test
 
 import (
 	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 
 	sf "github.com/Prutswonder/go-servicefoundation"
+	"github.com/Prutswonder/go-servicefoundation/servicetest"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 )
 
 func TestMiddlewareWrapperImpl_Wrap(t *testing.T) {
-	scenarios := []sf.Middleware{
-		sf.CORS,
-		sf.NoCaching,
-		sf.Counter,
-		sf.Histogram,
-		sf.RequestLogging,
-		sf.PanicTo500,
+	tests := []struct {
+		middleware   sf.Middleware
+		cacheControl string
+	}{
+		{sf.CORS, ""},
+		{sf.NoCaching, "max-age: 0, private"},
+		{sf.Counter, ""},
+		{sf.Histogram, ""},
+		{sf.RequestLogging, ""},
+		{sf.PanicTo500, ""},
 	}
 
-	for i, scenario := range scenarios {
-		const subSystem = "my-sub"
-		const name = "my-name"
+	for _, test := range tests {
 		log := &mockLogger{}
 		m := &mockMetrics{}
-		corsOptions := &sf.CORSOptions{}
-		called := false
-		handle := func(sf.WrappedResponseWriter, *http.Request, sf.RouterParams) {
-			called = true
-		}
-		rdr := &mockReader{}
-		r, _ := http.NewRequest("GET", "https://www.sf.com/some/url", rdr)
-		w := &mockResponseWriter{}
 		h := &mockMetricsHistogram{}
-		p := sf.RouterParams{}
-		sut := sf.NewMiddlewareWrapper(log, m, corsOptions, sf.ServiceGlobals{})
+		r, _ := http.NewRequest(http.MethodGet, "https://www.sf.com/some/url", nil)
+		sut := sf.NewMiddlewareWrapper(log, m, &sf.CORSOptions{}, sf.ServiceGlobals{})
 
-		w.On("Header").Return(http.Header{})
-		w.On("Status").Return(http.StatusOK)
 		h.On("RecordTimeElapsed", mock.Anything, mock.Anything)
 		m.On("CountLabels", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
 		m.On("AddHistogram", mock.Anything, mock.Anything, mock.Anything).Return(h)
+		m.On("AddHistogramLabels", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(h)
 		log.On("Info", mock.Anything, mock.Anything, mock.Anything).Return(nil)
 
 		// Act
-		actual := sut.Wrap(subSystem, name, scenario, handle)
-
-		assert.NotNil(t, actual, "Scenario %n", i)
-		assert.NotEqual(t, handle, actual, "Scenario %n", i)
+		w, called := servicetest.RunMiddleware(sf.AsMiddlewareFunc(sut, "my-sub", "my-name", test.middleware), r)
 
-		actual(w, r, p)
-		assert.True(t, called, "Scenario %n", i)
+		assert.True(t, called, test.middleware.String())
+		assert.Equal(t, http.StatusOK, w.Code, test.middleware.String())
+		assert.Equal(t, test.cacheControl, w.Header().Get("Cache-Control"), test.middleware.String())
+		if test.cacheControl != "" {
+			assert.NotEmpty(t, w.Header().Get("Expires"))
+		}
 	}
 }
 
@@ -74,34 +70,124 @@ func TestMiddlewareWrapperImpl_Wrap_UnknownMiddleware_ReturnsUnwrappedHandler(t
 }
 
 func TestMiddlewareWrapperImpl_Wrap_PanicsAreHandled(t *testing.T) {
-	scenarios := []sf.Middleware{sf.PanicTo500}
+	log := &mockLogger{}
+	m := &mockMetrics{}
+	r, _ := http.NewRequest(http.MethodGet, "https://www.sf.com/some/url", nil)
+	sut := sf.NewMiddlewareWrapper(log, m, &sf.CORSOptions{}, sf.ServiceGlobals{})
+	handle := func(sf.WrappedResponseWriter, *http.Request, sf.RouterParams) {
+		panic("whoa")
+	}
 
-	for i, scenario := range scenarios {
-		const subSystem = "my-sub"
-		const name = "my-name"
-		log := &mockLogger{}
-		m := &mockMetrics{}
-		corsOptions := &sf.CORSOptions{}
-		handle := func(sf.WrappedResponseWriter, *http.Request, sf.RouterParams) {
+	log.On("Error", mock.Anything, mock.Anything, mock.Anything).Return(nil).Once()
+
+	// Act
+	w, called := servicetest.RunMiddlewareWithHandler(sf.AsMiddlewareFunc(sut, "my-sub", "my-name", sf.PanicTo500), r, handle)
+
+	assert.True(t, called)
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	log.AssertExpectations(t)
+}
+
+// recordingMiddleware returns a MiddlewareFunc that records the name when it receives the request, and the status of
+// the response after the next handle.
+func recordingMiddleware(name string, order *[]string) sf.MiddlewareFunc {
+	return func(next sf.Handle) sf.Handle {
+		return func(w sf.WrappedResponseWriter, r *http.Request, p sf.RouterParams) {
+			*order = append(*order, name)
+			next(w, r, p)
+			*order = append(*order, name+" saw "+http.StatusText(w.Status()))
+		}
+	}
+}
+
+func TestRegisterMiddleware_Ordering(t *testing.T) {
+	var order []string
+	auth := sf.RegisterMiddleware("test_auth", recordingMiddleware("auth", &order))
+	tenant := sf.RegisterMiddleware("test_tenant", recordingMiddleware("tenant", &order))
+	log := &mockLogger{}
+	log.On("Error", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	wrapper := sf.NewMiddlewareWrapper(log, &mockMetrics{}, &sf.CORSOptions{}, sf.ServiceGlobals{})
+	r, _ := http.NewRequest(http.MethodGet, "/orders", nil)
+
+	// Act
+	w, _ := servicetest.RunMiddlewareWithHandler(func(next sf.Handle) sf.Handle {
+		return sf.NewChainFor(wrapper, "public", "orders", []sf.Middleware{tenant, auth, sf.PanicTo500}).Then(next)
+	}, r, func(w sf.WrappedResponseWriter, _ *http.Request, _ sf.RouterParams) {
+		order = append(order, "handler")
+		w.WriteHeader(http.StatusCreated)
+	})
+
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, []string{"auth", "tenant", "handler", "tenant saw Created", "auth saw Created"}, order)
+	assert.Equal(t, "test_auth", auth.String())
+	assert.Equal(t, auth, sf.RegisterMiddleware("test_auth", recordingMiddleware("auth", &order)),
+		"registering a name again keeps its value")
+}
+
+func TestRegisterMiddleware_PanicsAreHandled(t *testing.T) {
+	broken := sf.RegisterMiddleware("test_broken", func(sf.Handle) sf.Handle {
+		return func(sf.WrappedResponseWriter, *http.Request, sf.RouterParams) {
 			panic("whoa")
 		}
-		rdr := &mockReader{}
-		r, _ := http.NewRequest("GET", "https://www.sf.com/some/url", rdr)
-		w := &mockResponseWriter{}
-		p := sf.RouterParams{}
-		sut := sf.NewMiddlewareWrapper(log, m, corsOptions, sf.ServiceGlobals{})
+	})
+	log := &mockLogger{}
+	log.On("Error", mock.Anything, mock.Anything, mock.Anything).Return(nil).Once()
+	wrapper := sf.NewMiddlewareWrapper(log, &mockMetrics{}, &sf.CORSOptions{}, sf.ServiceGlobals{})
+	r, _ := http.NewRequest(http.MethodGet, "/orders", nil)
 
-		log.On("Error", mock.Anything, mock.Anything, mock.Anything).Return(nil).Once()
-		w.On("WriteHeader", http.StatusInternalServerError).Once()
+	// Act
+	w, called := servicetest.RunMiddlewareWithHandler(func(next sf.Handle) sf.Handle {
+		return sf.NewChainFor(wrapper, "public", "orders", []sf.Middleware{broken, sf.PanicTo500}).Then(next)
+	}, r, func(sf.WrappedResponseWriter, *http.Request, sf.RouterParams) {})
 
-		// Act
-		actual := sut.Wrap(subSystem, name, scenario, handle)
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.False(t, called)
+	log.AssertExpectations(t)
+}
+
+func TestRegisterMiddleware_ShortCircuitsRoute(t *testing.T) {
+	token := sf.RegisterMiddleware("test_token", func(next sf.Handle) sf.Handle {
+		return func(w sf.WrappedResponseWriter, r *http.Request, p sf.RouterParams) {
+			if r.Header.Get("Authorization") != "Bearer secret" {
+				sf.WriteProblem(w, http.StatusUnauthorized, "Missing or invalid token")
+				return
+			}
+			next(w, r, p)
+		}
+	})
+	opt := sf.NewServiceOptions("middleware", []string{http.MethodGet}, nil)
+	sut := sf.NewCustomService(opt)
+	var calls int
+	sut.AddRoute("orders", []string{"/orders"}, sf.MethodsForGet, append([]sf.Middleware{token}, sf.DefaultMiddlewares...),
+		func(w sf.WrappedResponseWriter, _ *http.Request, _ sf.RouterParams) {
+			calls++
+			w.JSON(http.StatusOK, "orders")
+		})
+	tests := []struct {
+		authorization string
+		expected      int
+	}{
+		{"", http.StatusUnauthorized},
+		{"Bearer other", http.StatusUnauthorized},
+		{"Bearer secret", http.StatusOK},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/orders", nil)
+		r.Header.Set("Authorization", test.authorization)
+		w := httptest.NewRecorder()
 
-		assert.NotNil(t, actual, "Scenario %n", i)
-		assert.NotEqual(t, handle, actual, "Scenario %n", i)
+		// Act
+		sut.Handler("public").ServeHTTP(w, r)
 
-		actual(w, r, p)
-		log.AssertExpectations(t)
-		w.AssertExpectations(t)
+		assert.Equal(t, test.expected, w.Code, test.authorization)
+	}
+	assert.Equal(t, 1, calls)
+	explanation, _ := sf.ExplainRoute(sut, "orders")
+	var names []string
+	for _, middleware := range explanation.Middlewares {
+		names = append(names, middleware.Name)
 	}
+	assert.True(t, strings.HasPrefix(strings.Join(names, ","), "request_id,no_caching,request_logging,panic_to_500,test_token,"),
+		strings.Join(names, ","))
 }
@@ -1,6 +1,7 @@
 package servicefoundation_test
 
 import (
+	"context"
 	"io"
 	"net/http"
 	"time"
@@ -138,6 +139,10 @@ func (m *mockMetrics) SetGauge(value float64, subsystem, name, help string) {
 	m.Called(value, subsystem, name, help)
 }
 
+func (m *mockMetrics) SetGaugeLabels(value float64, subsystem, name, help string, labels, values []string) {
+	m.Called(value, subsystem, name, help, labels, values)
+}
+
 func (m *mockMetrics) CountLabels(subsystem, name, help string, labels, values []string) {
 	m.Called(subsystem, name, help, labels, values)
 }
@@ -151,6 +156,16 @@ func (m *mockMetrics) AddHistogram(subsystem, name, help string) sf.MetricsHisto
 	return a.Get(0).(sf.MetricsHistogram)
 }
 
+func (m *mockMetrics) AddHistogramWithBuckets(subsystem, name, help string, buckets []float64) sf.MetricsHistogram {
+	a := m.Called(subsystem, name, help, buckets)
+	return a.Get(0).(sf.MetricsHistogram)
+}
+
+func (m *mockMetrics) AddHistogramLabels(subsystem, name, help string, labels, values []string) sf.MetricsHistogram {
+	a := m.Called(subsystem, name, help, labels, values)
+	return a.Get(0).(sf.MetricsHistogram)
+}
+
 /* sf.VersionBuilder mock */
 
 type mockVersionBuilder struct {
@@ -168,6 +183,11 @@ func (m *mockVersionBuilder) ToMap() map[string]string {
 	return a.Get(0).(map[string]string)
 }
 
+func (m *mockVersionBuilder) Version() sf.VersionInfo {
+	a := m.Called()
+	return a.Get(0).(sf.VersionInfo)
+}
+
 /* sf.MiddlewareWrapper mock */
 
 type mockMiddlewareWrapper struct {
@@ -314,3 +334,52 @@ func (m *mockServiceStateReader) IsHealthy() bool {
 	a := m.Called()
 	return a.Bool(0)
 }
+
+/* sf.Drainer mock */
+
+type mockDrainer struct {
+	mock.Mock
+	sf.Drainer
+}
+
+func (m *mockDrainer) Middleware(route string) sf.MiddlewareFunc {
+	return m.Called(route).Get(0).(sf.MiddlewareFunc)
+}
+
+func (m *mockDrainer) ReadinessMiddleware() sf.MiddlewareFunc {
+	return m.Called().Get(0).(sf.MiddlewareFunc)
+}
+
+func (m *mockDrainer) BeginDrain() {
+	m.Called()
+}
+
+func (m *mockDrainer) Stopped() {
+	m.Called()
+}
+
+/* sf.TaskQueue mock */
+
+type mockTaskQueue struct {
+	mock.Mock
+	sf.TaskQueue
+}
+
+func (m *mockTaskQueue) Start(ctx context.Context) {
+	m.Called(ctx)
+}
+
+func (m *mockTaskQueue) Stop() error {
+	return m.Called().Error(0)
+}
+
+/* sf.ServerManager mock */
+
+type mockServerManager struct {
+	mock.Mock
+	sf.ServerManager
+}
+
+func (m *mockServerManager) Servers() map[string]sf.ServerInfo {
+	return m.Called().Get(0).(map[string]sf.ServerInfo)
+}
@@ -0,0 +1,566 @@
+package servicefoundation
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Prutswonder/go-servicefoundation/events"
+)
+
+const (
+	oidcDiscoveryPath = "/.well-known/openid-configuration"
+
+	defaultOIDCClockSkew          = 30 * time.Second
+	defaultOIDCMinRefreshInterval = 30 * time.Second
+	defaultOIDCRefreshInterval    = time.Hour
+)
+
+var (
+	// ErrInvalidToken is returned when a JWT can not be parsed or its signature is invalid.
+	ErrInvalidToken = errors.New("invalid token")
+	// ErrUnknownIssuer is returned when a JWT is issued by an issuer that is not configured.
+	ErrUnknownIssuer = errors.New("unknown issuer")
+	// ErrUnknownKey is returned when a JWT is signed by a key that is not in the key set of the issuer.
+	ErrUnknownKey = errors.New("unknown signing key")
+	// ErrTokenExpired is returned when a JWT has expired or is not valid yet.
+	ErrTokenExpired = errors.New("token expired or not yet valid")
+	// ErrNoExpiry is returned when a JWT has no exp claim, which would make it valid forever.
+	ErrNoExpiry = errors.New("token without expiry")
+	// ErrInvalidAudience is returned when a JWT does not contain any of the configured audiences.
+	ErrInvalidAudience = errors.New("invalid audience")
+	// ErrKeysUnavailable is returned when the key set of an issuer could not be loaded.
+	ErrKeysUnavailable = errors.New("signing keys unavailable")
+)
+
+type (
+	// JWTClaims contains the claims of a validated JWT.
+	JWTClaims map[string]interface{}
+
+	// OIDCIssuerOptions contains the validation rules for a single OpenID Connect issuer.
+	OIDCIssuerOptions struct {
+		// IssuerURL is the URL of the issuer, used for discovery and matched against the iss claim.
+		IssuerURL string
+		// Audiences contains the accepted values for the aud claim. When empty, the audience is not validated.
+		Audiences []string
+	}
+
+	// OIDCOptions contains the settings for the OpenID Connect authentication middleware.
+	OIDCOptions struct {
+		Issuers []OIDCIssuerOptions
+		// ClockSkew is the tolerance used when validating the exp and nbf claims.
+		ClockSkew time.Duration
+		// MinRefreshInterval is the minimum time between two key set refreshes of the same issuer.
+		MinRefreshInterval time.Duration
+		// RefreshInterval is used for refreshing the key set when the response has no caching headers.
+		RefreshInterval time.Duration
+		// FailOpen allows requests to pass without authentication while the key set of an issuer is unavailable.
+		FailOpen   bool
+		HTTPClient *http.Client
+	}
+
+	// OIDCAuthenticator validates JWTs using keys obtained through OpenID Connect discovery.
+	OIDCAuthenticator interface {
+		Start(ctx context.Context)
+		Validate(token string) (JWTClaims, error)
+		Middleware() MiddlewareFunc
+	}
+
+	oidcDiscoveryDocument struct {
+		Issuer  string `json:"issuer"`
+		JWKSURI string `json:"jwks_uri"`
+	}
+
+	jsonWebKey struct {
+		Kid string `json:"kid"`
+		Kty string `json:"kty"`
+		Crv string `json:"crv"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+		X   string `json:"x"`
+		Y   string `json:"y"`
+	}
+
+	jsonWebKeySet struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+
+	jwtHeader struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+
+	oidcIssuer struct {
+		options     OIDCIssuerOptions
+		mutex       sync.RWMutex
+		issuer      string
+		jwksURI     string
+		keys        map[string]crypto.PublicKey
+		lastRefresh time.Time
+		expiresAt   time.Time
+		refreshing  chan struct{}
+	}
+
+	oidcAuthenticatorImpl struct {
+		options OIDCOptions
+		log     Logger
+		issuers map[string]*oidcIssuer
+	}
+
+	jwtClaimsContextKey struct{}
+)
+
+// NewOIDCAuthenticator creates and returns a new OIDCAuthenticator for the issuers in the given options.
+func NewOIDCAuthenticator(options OIDCOptions, log Logger) OIDCAuthenticator {
+	if options.ClockSkew <= 0 {
+		options.ClockSkew = defaultOIDCClockSkew
+	}
+	if options.MinRefreshInterval <= 0 {
+		options.MinRefreshInterval = defaultOIDCMinRefreshInterval
+	}
+	if options.RefreshInterval <= 0 {
+		options.RefreshInterval = defaultOIDCRefreshInterval
+	}
+	if options.HTTPClient == nil {
+		options.HTTPClient = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	issuers := make(map[string]*oidcIssuer)
+
+	for _, issuer := range options.Issuers {
+		issuerURL := strings.TrimSuffix(issuer.IssuerURL, "/")
+		issuers[issuerURL] = &oidcIssuer{options: issuer, issuer: issuerURL}
+	}
+
+	return &oidcAuthenticatorImpl{
+		options: options,
+		log:     log,
+		issuers: issuers,
+	}
+}
+
+// JWTClaimsFromContext returns the claims of the validated JWT carried by the context, or nil if there are none.
+func JWTClaimsFromContext(ctx context.Context) JWTClaims {
+	claims, _ := ctx.Value(jwtClaimsContextKey{}).(JWTClaims)
+	return claims
+}
+
+// RequireScopes returns a MiddlewareFunc that only allows requests of which the claims on the context contain all
+// scopes. It works for both the OIDC and the API key middleware, which must precede it.
+func RequireScopes(scopes ...string) MiddlewareFunc {
+	return func(next Handle) Handle {
+		return func(w WrappedResponseWriter, r *http.Request, p RouterParams) {
+			claims := JWTClaimsFromContext(r.Context())
+			if claims == nil {
+				WriteProblem(w, http.StatusUnauthorized, "Authentication required")
+				return
+			}
+
+			granted := claims.Scopes()
+			for _, scope := range scopes {
+				if !containsString(granted, scope) {
+					WriteProblem(w, http.StatusForbidden, fmt.Sprintf("Scope %s required", scope))
+					return
+				}
+			}
+			next(w, r, p)
+		}
+	}
+}
+
+// Scopes returns the space separated scope claim, or the scp claim as used by some issuers.
+func (c JWTClaims) Scopes() []string {
+	if scope, ok := c["scope"].(string); ok {
+		return strings.Fields(scope)
+	}
+
+	var scopes []string
+	if scp, ok := c["scp"].([]interface{}); ok {
+		for _, v := range scp {
+			if s, ok := v.(string); ok {
+				scopes = append(scopes, s)
+			}
+		}
+	}
+	return scopes
+}
+
+/* OIDCAuthenticator implementation */
+
+// Start performs discovery for all issuers and keeps refreshing their key sets until the context is cancelled.
+func (a *oidcAuthenticatorImpl) Start(ctx context.Context) {
+	for _, issuer := range a.issuers {
+		if err := a.refresh(issuer); err != nil {
+			a.log.Error(events.OIDCDiscovery, "Failed loading keys for issuer %s: %v", issuer.issuer, err)
+		}
+		go a.keepRefreshing(ctx, issuer)
+	}
+}
+
+func (a *oidcAuthenticatorImpl) Validate(token string) (JWTClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+
+	header := jwtHeader{}
+	claims := JWTClaims{}
+	if err := decodeJWTSegment(parts[0], &header); err != nil {
+		return nil, ErrInvalidToken
+	}
+	if err := decodeJWTSegment(parts[1], &claims); err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	iss, _ := claims["iss"].(string)
+	issuer, ok := a.issuers[strings.TrimSuffix(iss, "/")]
+	if !ok {
+		return nil, ErrUnknownIssuer
+	}
+
+	key, err := a.key(issuer, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	if err := verifyJWTSignature(header.Alg, key, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+
+	if err := a.validateClaims(issuer, claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func (a *oidcAuthenticatorImpl) Middleware() MiddlewareFunc {
+	return func(next Handle) Handle {
+		return func(w WrappedResponseWriter, r *http.Request, p RouterParams) {
+			claims, err := a.Validate(bearerToken(r))
+
+			if err == ErrKeysUnavailable && a.options.FailOpen {
+				a.log.Warn(events.OIDCFailOpen, "Signing keys unavailable, allowing unauthenticated request")
+				next(w, r, p)
+				return
+			}
+
+			if err != nil {
+				a.log.Debug(events.OIDCUnauthorized, "Rejecting request: %v", err)
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				WriteProblem(w, http.StatusUnauthorized, "Authentication required")
+				return
+			}
+			next(w, r.WithContext(context.WithValue(r.Context(), jwtClaimsContextKey{}, claims)), p)
+		}
+	}
+}
+
+func (a *oidcAuthenticatorImpl) key(issuer *oidcIssuer, kid string) (crypto.PublicKey, error) {
+	issuer.mutex.RLock()
+	key, ok := issuer.keys[kid]
+	issuer.mutex.RUnlock()
+
+	if ok {
+		return key, nil
+	}
+
+	// The key set might have been rotated, so refresh before rejecting the token.
+	if err := a.refreshForKey(issuer, kid); err != nil {
+		a.log.Error(events.OIDCRefresh, "Failed refreshing keys for issuer %s: %v", issuer.issuer, err)
+	}
+
+	issuer.mutex.RLock()
+	key, ok = issuer.keys[kid]
+	loaded := issuer.keys != nil
+	issuer.mutex.RUnlock()
+
+	if ok {
+		return key, nil
+	}
+	if !loaded {
+		return nil, ErrKeysUnavailable
+	}
+	return nil, ErrUnknownKey
+}
+
+// refreshForKey refreshes the key set of the issuer when it does not contain the key and was not refreshed within the
+// minimum refresh interval. Requests that arrive during a refresh wait for it, instead of starting their own, so a
+// burst of tokens with an unknown kid results in a single request to the issuer.
+func (a *oidcAuthenticatorImpl) refreshForKey(issuer *oidcIssuer, kid string) error {
+	issuer.mutex.Lock()
+	if refreshing := issuer.refreshing; refreshing != nil {
+		issuer.mutex.Unlock()
+		<-refreshing
+		return nil
+	}
+	if _, ok := issuer.keys[kid]; ok || time.Since(issuer.lastRefresh) < a.options.MinRefreshInterval {
+		issuer.mutex.Unlock()
+		return nil
+	}
+	refreshing := make(chan struct{})
+	issuer.refreshing = refreshing
+	issuer.mutex.Unlock()
+
+	defer func() {
+		issuer.mutex.Lock()
+		issuer.refreshing = nil
+		issuer.mutex.Unlock()
+		close(refreshing)
+	}()
+	return a.refresh(issuer)
+}
+
+func (a *oidcAuthenticatorImpl) validateClaims(issuer *oidcIssuer, claims JWTClaims) error {
+	now := time.Now()
+	skew := a.options.ClockSkew
+
+	issuer.mutex.RLock()
+	expectedIssuer := issuer.issuer
+	issuer.mutex.RUnlock()
+
+	if iss, _ := claims["iss"].(string); strings.TrimSuffix(iss, "/") != strings.TrimSuffix(expectedIssuer, "/") {
+		return ErrUnknownIssuer
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return ErrNoExpiry
+	}
+	if now.Add(-skew).After(time.Unix(int64(exp), 0)) {
+		return ErrTokenExpired
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(skew).Before(time.Unix(int64(nbf), 0)) {
+		return ErrTokenExpired
+	}
+
+	if len(issuer.options.Audiences) == 0 {
+		return nil
+	}
+
+	var audiences []string
+	switch aud := claims["aud"].(type) {
+	case string:
+		audiences = []string{aud}
+	case []interface{}:
+		for _, v := range aud {
+			if s, ok := v.(string); ok {
+				audiences = append(audiences, s)
+			}
+		}
+	}
+
+	for _, expected := range issuer.options.Audiences {
+		for _, actual := range audiences {
+			if expected == actual {
+				return nil
+			}
+		}
+	}
+	return ErrInvalidAudience
+}
+
+func (a *oidcAuthenticatorImpl) keepRefreshing(ctx context.Context, issuer *oidcIssuer) {
+	for {
+		issuer.mutex.RLock()
+		wait := time.Until(issuer.expiresAt)
+		issuer.mutex.RUnlock()
+
+		if wait < a.options.MinRefreshInterval {
+			wait = a.options.MinRefreshInterval
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+			if err := a.refresh(issuer); err != nil {
+				a.log.Error(events.OIDCRefresh, "Failed refreshing keys for issuer %s: %v", issuer.issuer, err)
+			}
+		}
+	}
+}
+
+func (a *oidcAuthenticatorImpl) refresh(issuer *oidcIssuer) error {
+	issuer.mutex.Lock()
+	issuer.lastRefresh = time.Now()
+	jwksURI := issuer.jwksURI
+	issuer.mutex.Unlock()
+
+	if jwksURI == "" {
+		doc := oidcDiscoveryDocument{}
+		if _, err := a.getJSON(issuer.options.IssuerURL+oidcDiscoveryPath, &doc); err != nil {
+			return err
+		}
+		if doc.JWKSURI == "" {
+			return fmt.Errorf("No jwks_uri in discovery document of %s", issuer.options.IssuerURL)
+		}
+
+		issuer.mutex.Lock()
+		issuer.jwksURI = doc.JWKSURI
+		if doc.Issuer != "" {
+			issuer.issuer = doc.Issuer
+		}
+		issuer.mutex.Unlock()
+		jwksURI = doc.JWKSURI
+	}
+
+	keySet := jsonWebKeySet{}
+	maxAge, err := a.getJSON(jwksURI, &keySet)
+	if err != nil {
+		return err
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, jwk := range keySet.Keys {
+		key, err := jwk.publicKey()
+		if err != nil {
+			a.log.Warn(events.OIDCKey, "Skipping key %s of issuer %s: %v", jwk.Kid, issuer.issuer, err)
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+
+	if maxAge <= 0 {
+		maxAge = a.options.RefreshInterval
+	}
+
+	issuer.mutex.Lock()
+	issuer.keys = keys
+	issuer.expiresAt = time.Now().Add(maxAge)
+	issuer.mutex.Unlock()
+	return nil
+}
+
+// getJSON fetches and decodes the JSON document at the given URL and returns the max-age from its caching headers.
+func (a *oidcAuthenticatorImpl) getJSON(url string, v interface{}) (time.Duration, error) {
+	resp, err := a.options.HTTPClient.Get(url)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("Unexpected status %d from %s", resp.StatusCode, url)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return 0, err
+	}
+	return cacheMaxAge(resp.Header), nil
+}
+
+func cacheMaxAge(header http.Header) time.Duration {
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		directive = strings.TrimSpace(directive)
+
+		if strings.HasPrefix(directive, "max-age=") {
+			if seconds, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age=")); err == nil {
+				return time.Duration(seconds) * time.Second
+			}
+		}
+	}
+
+	if expires, err := http.ParseTime(header.Get("Expires")); err == nil {
+		return time.Until(expires)
+	}
+	return 0
+}
+
+// bearerToken returns the token of the Authorization header with the Bearer scheme, of which the name is case
+// insensitive, or an empty string when there is none.
+func bearerToken(r *http.Request) string {
+	const scheme = "Bearer "
+
+	authorization := r.Header.Get("Authorization")
+	if len(authorization) > len(scheme) && strings.EqualFold(authorization[:len(scheme)], scheme) {
+		return strings.TrimSpace(authorization[len(scheme):])
+	}
+	return ""
+}
+
+func decodeJWTSegment(segment string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func verifyJWTSignature(alg string, key crypto.PublicKey, signed string, signature []byte) error {
+	hash := sha256.Sum256([]byte(signed))
+
+	switch alg {
+	case "RS256":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok || rsa.VerifyPKCS1v15(pub, crypto.SHA256, hash[:], signature) != nil {
+			return ErrInvalidToken
+		}
+		return nil
+	case "ES256":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(signature) != 64 {
+			return ErrInvalidToken
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(pub, hash[:], r, s) {
+			return ErrInvalidToken
+		}
+		return nil
+	}
+	return ErrInvalidToken
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("Unsupported curve %s", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	}
+	return nil, fmt.Errorf("Unsupported key type %s", k.Kty)
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
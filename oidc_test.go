@@ -0,0 +1,365 @@
+package servicefoundation_test
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	sf "github.com/Prutswonder/go-servicefoundation"
+	"github.com/Prutswonder/go-servicefoundation/servicetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+type testOIDCServer struct {
+	*httptest.Server
+	mutex sync.Mutex
+	keys  map[string]*rsa.PrivateKey
+	fail  bool
+	// jwksRequests counts the requests for the key set.
+	jwksRequests int
+}
+
+func newTestOIDCServer(kids ...string) *testOIDCServer {
+	s := &testOIDCServer{keys: make(map[string]*rsa.PrivateKey)}
+	s.rotate(kids...)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		if s.fail {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"issuer": s.URL, "jwks_uri": s.URL + "/jwks"})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		s.jwksRequests++
+
+		keys := []map[string]string{}
+		for kid, key := range s.keys {
+			keys = append(keys, map[string]string{
+				"kid": kid,
+				"kty": "RSA",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			})
+		}
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+	})
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+func (s *testOIDCServer) rotate(kids ...string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.keys = make(map[string]*rsa.PrivateKey)
+	for _, kid := range kids {
+		s.keys[kid], _ = rsa.GenerateKey(rand.Reader, 2048)
+	}
+}
+
+func (s *testOIDCServer) token(kid string, claims map[string]interface{}) string {
+	s.mutex.Lock()
+	key := s.keys[kid]
+	s.mutex.Unlock()
+
+	if _, ok := claims["iss"]; !ok {
+		claims["iss"] = s.URL
+	}
+	// A nil exp leaves out the claim.
+	if exp, ok := claims["exp"]; !ok {
+		claims["exp"] = time.Now().Add(time.Hour).Unix()
+	} else if exp == nil {
+		delete(claims, "exp")
+	}
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	hash := sha256.Sum256([]byte(signed))
+	signature, _ := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func newTestOIDCAuthenticator(options sf.OIDCOptions) sf.OIDCAuthenticator {
+	log := &mockLogger{}
+
+	log.On("Debug", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	log.On("Warn", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	log.On("Error", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+
+	return sf.NewOIDCAuthenticator(options, log)
+}
+
+func TestOIDCAuthenticator_Discovery(t *testing.T) {
+	server := newTestOIDCServer("k1")
+	defer server.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sut := newTestOIDCAuthenticator(sf.OIDCOptions{
+		Issuers: []sf.OIDCIssuerOptions{{IssuerURL: server.URL, Audiences: []string{"my-api"}}},
+	})
+	sut.Start(ctx)
+
+	// Act
+	claims, err := sut.Validate(server.token("k1", map[string]interface{}{
+		"sub": "user-1",
+		"aud": "my-api",
+		"exp": time.Now().Add(time.Minute).Unix(),
+	}))
+
+	assert.NoError(t, err)
+	assert.Equal(t, "user-1", claims["sub"])
+
+	_, err = sut.Validate(server.token("k1", map[string]interface{}{"aud": "other-api"}))
+
+	assert.Equal(t, sf.ErrInvalidAudience, err)
+}
+
+func TestOIDCAuthenticator_UnknownKidTriggersRefresh(t *testing.T) {
+	server := newTestOIDCServer("k1")
+	defer server.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sut := newTestOIDCAuthenticator(sf.OIDCOptions{
+		Issuers:            []sf.OIDCIssuerOptions{{IssuerURL: server.URL}},
+		MinRefreshInterval: time.Millisecond,
+	})
+	sut.Start(ctx)
+	server.rotate("k2")
+	time.Sleep(2 * time.Millisecond)
+
+	// Act
+	_, err := sut.Validate(server.token("k2", map[string]interface{}{}))
+
+	assert.NoError(t, err)
+}
+
+func TestOIDCAuthenticator_UnknownKidRefreshesOnce(t *testing.T) {
+	server := newTestOIDCServer("k1")
+	defer server.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sut := newTestOIDCAuthenticator(sf.OIDCOptions{
+		Issuers:            []sf.OIDCIssuerOptions{{IssuerURL: server.URL}},
+		MinRefreshInterval: time.Millisecond,
+	})
+	sut.Start(ctx)
+	server.rotate("k2")
+	time.Sleep(2 * time.Millisecond)
+	token := server.token("k2", map[string]interface{}{})
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+
+	// Act
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := sut.Validate(token)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		assert.NoError(t, err)
+	}
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	assert.Equal(t, 2, server.jwksRequests, "one request on start and one for the unknown kid")
+}
+
+func TestOIDCAuthenticator_UnknownKidRefreshIsRateLimited(t *testing.T) {
+	server := newTestOIDCServer("k1")
+	defer server.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sut := newTestOIDCAuthenticator(sf.OIDCOptions{
+		Issuers:            []sf.OIDCIssuerOptions{{IssuerURL: server.URL}},
+		MinRefreshInterval: time.Hour,
+	})
+	sut.Start(ctx)
+	server.rotate("k2")
+
+	// Act
+	_, err := sut.Validate(server.token("k2", map[string]interface{}{}))
+
+	assert.Equal(t, sf.ErrUnknownKey, err)
+}
+
+func TestOIDCAuthenticator_MultipleIssuers(t *testing.T) {
+	server1 := newTestOIDCServer("k1")
+	defer server1.Close()
+	server2 := newTestOIDCServer("k1")
+	defer server2.Close()
+	unknown := newTestOIDCServer("k1")
+	defer unknown.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sut := newTestOIDCAuthenticator(sf.OIDCOptions{
+		Issuers: []sf.OIDCIssuerOptions{
+			{IssuerURL: server1.URL, Audiences: []string{"api-1"}},
+			{IssuerURL: server2.URL, Audiences: []string{"api-2"}},
+		},
+	})
+	sut.Start(ctx)
+
+	// Act
+	_, err1 := sut.Validate(server1.token("k1", map[string]interface{}{"aud": "api-1"}))
+	_, err2 := sut.Validate(server2.token("k1", map[string]interface{}{"aud": "api-2"}))
+	_, errAudience := sut.Validate(server2.token("k1", map[string]interface{}{"aud": "api-1"}))
+	_, errIssuer := sut.Validate(unknown.token("k1", map[string]interface{}{"aud": "api-1"}))
+
+	// Signed by the key of server2, but claiming to be issued by server1.
+	_, errSignature := sut.Validate(server2.token("k1", map[string]interface{}{"aud": "api-1", "iss": server1.URL}))
+
+	assert.NoError(t, err1)
+	assert.NoError(t, err2)
+	assert.Equal(t, sf.ErrInvalidAudience, errAudience)
+	assert.Equal(t, sf.ErrUnknownIssuer, errIssuer)
+	assert.Equal(t, sf.ErrInvalidToken, errSignature)
+}
+
+func TestOIDCAuthenticator_ClockSkew(t *testing.T) {
+	server := newTestOIDCServer("k1")
+	defer server.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tolerant := newTestOIDCAuthenticator(sf.OIDCOptions{
+		Issuers:   []sf.OIDCIssuerOptions{{IssuerURL: server.URL}},
+		ClockSkew: time.Minute,
+	})
+	strict := newTestOIDCAuthenticator(sf.OIDCOptions{
+		Issuers:   []sf.OIDCIssuerOptions{{IssuerURL: server.URL}},
+		ClockSkew: time.Second,
+	})
+	tolerant.Start(ctx)
+	strict.Start(ctx)
+	expired := server.token("k1", map[string]interface{}{"exp": time.Now().Add(-10 * time.Second).Unix()})
+	notYetValid := server.token("k1", map[string]interface{}{"nbf": time.Now().Add(10 * time.Second).Unix()})
+
+	// Act
+	_, errTolerantExp := tolerant.Validate(expired)
+	_, errTolerantNbf := tolerant.Validate(notYetValid)
+	_, errStrictExp := strict.Validate(expired)
+	_, errStrictNbf := strict.Validate(notYetValid)
+
+	assert.NoError(t, errTolerantExp)
+	assert.NoError(t, errTolerantNbf)
+	assert.Equal(t, sf.ErrTokenExpired, errStrictExp)
+	assert.Equal(t, sf.ErrTokenExpired, errStrictNbf)
+}
+
+func TestOIDCAuthenticator_RequiresExpiry(t *testing.T) {
+	server := newTestOIDCServer("k1")
+	defer server.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sut := newTestOIDCAuthenticator(sf.OIDCOptions{Issuers: []sf.OIDCIssuerOptions{{IssuerURL: server.URL}}})
+	sut.Start(ctx)
+
+	// Act
+	_, err := sut.Validate(server.token("k1", map[string]interface{}{"exp": nil}))
+
+	assert.Equal(t, sf.ErrNoExpiry, err)
+}
+
+func TestOIDCAuthenticator_Middleware_BearerScheme(t *testing.T) {
+	server := newTestOIDCServer("k1")
+	defer server.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sut := newTestOIDCAuthenticator(sf.OIDCOptions{Issuers: []sf.OIDCIssuerOptions{{IssuerURL: server.URL}}})
+	sut.Start(ctx)
+	token := server.token("k1", map[string]interface{}{})
+	tests := []struct {
+		authorization string
+		expected      bool
+	}{
+		{"Bearer " + token, true},
+		{"bearer " + token, true},
+		{"BEARER  " + token, true},
+		{token, false},
+		{"Basic " + token, false},
+		{"", false},
+	}
+
+	for _, test := range tests {
+		r, _ := http.NewRequest(http.MethodGet, "/secure", nil)
+		r.Header.Set("Authorization", test.authorization)
+
+		// Act
+		w, called := servicetest.RunMiddleware(sut.Middleware(), r)
+
+		assert.Equal(t, test.expected, called, test.authorization)
+		if !test.expected {
+			assert.Equal(t, http.StatusUnauthorized, w.Code)
+			assert.Equal(t, "Bearer", w.Header().Get("WWW-Authenticate"))
+			assert.Equal(t, sf.ContentTypeProblemJSON, w.Header().Get(sf.ContentTypeHeader))
+		}
+	}
+}
+
+func TestOIDCAuthenticator_Middleware_FailurePolicy(t *testing.T) {
+	server := newTestOIDCServer("k1")
+	defer server.Close()
+	server.fail = true
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r, _ := http.NewRequest(http.MethodGet, "/secure", nil)
+	r.Header.Set("Authorization", "Bearer "+server.token("k1", map[string]interface{}{}))
+
+	for _, failOpen := range []bool{true, false} {
+		sut := newTestOIDCAuthenticator(sf.OIDCOptions{
+			Issuers:  []sf.OIDCIssuerOptions{{IssuerURL: server.URL}},
+			FailOpen: failOpen,
+		})
+		sut.Start(ctx)
+
+		// Act
+		w, called := servicetest.RunMiddleware(sut.Middleware(), r)
+
+		assert.Equal(t, failOpen, called, "FailOpen %v", failOpen)
+		if !failOpen {
+			assert.Equal(t, http.StatusUnauthorized, w.Code)
+		}
+	}
+}
+
+func TestOIDCAuthenticator_Middleware_StoresClaimsInContext(t *testing.T) {
+	server := newTestOIDCServer("k1")
+	defer server.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sut := newTestOIDCAuthenticator(sf.OIDCOptions{Issuers: []sf.OIDCIssuerOptions{{IssuerURL: server.URL}}})
+	sut.Start(ctx)
+	r, _ := http.NewRequest(http.MethodGet, "/secure", nil)
+	r.Header.Set("Authorization", "Bearer "+server.token("k1", map[string]interface{}{"sub": "user-1"}))
+	var claims sf.JWTClaims
+
+	// Act
+	_, called := servicetest.RunMiddlewareWithHandler(sut.Middleware(), r,
+		func(_ sf.WrappedResponseWriter, r *http.Request, _ sf.RouterParams) {
+			claims = sf.JWTClaimsFromContext(r.Context())
+		})
+
+	assert.True(t, called)
+	assert.Equal(t, "user-1", claims["sub"])
+}
@@ -0,0 +1,202 @@
+package servicefoundation
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The operational features of the service, which are listed in the operations catalog when they are enabled.
+const (
+	OperationShutdown      = "shutdown"
+	OperationServerRestart = "server_restart"
+	OperationTaskQueue     = "task_queue"
+	OperationScheduler     = "scheduler"
+	OperationQuotas        = "quotas"
+
+	// OperatorHeader is the request header that identifies the operator using an operational endpoint.
+	OperatorHeader = "X-Operator"
+)
+
+type (
+	// Operation describes an operational feature of the service, with the internal endpoints that control it, its
+	// current state and the last change made through its endpoints.
+	Operation struct {
+		Name        string              `json:"name"`
+		Description string              `json:"description"`
+		Endpoints   []OperationEndpoint `json:"endpoints"`
+		State       interface{}         `json:"state,omitempty"`
+		LastChange  *OperationChange    `json:"lastChange,omitempty"`
+		RunbookURL  string              `json:"runbookUrl,omitempty"`
+	}
+
+	// OperationEndpoint is an endpoint of an operational feature on the internal server.
+	OperationEndpoint struct {
+		Method string `json:"method"`
+		Path   string `json:"path"`
+	}
+
+	// OperationChange is a successful request to an operational endpoint that isn't read-only, with the path that was
+	// requested. The actor is taken from the X-Operator header, or is the address of the client.
+	OperationChange struct {
+		At       time.Time         `json:"at"`
+		Actor    string            `json:"actor"`
+		Endpoint OperationEndpoint `json:"endpoint"`
+	}
+
+	// OperationsCatalog lists the operational features that are enabled in the service.
+	OperationsCatalog interface {
+		Operations() []Operation
+	}
+
+	operationsCatalogImpl struct {
+		mutex      sync.Mutex
+		runbooks   map[string]string
+		names      []string
+		operations map[string]*registeredOperation
+	}
+
+	registeredOperation struct {
+		operation Operation
+		state     func() interface{}
+	}
+)
+
+// NewOperationsHandler returns a handler that responds with the operations catalog, as JSON or as plain text when the
+// request accepts text/plain.
+func NewOperationsHandler(catalog OperationsCatalog) Handle {
+	return func(w WrappedResponseWriter, r *http.Request, _ RouterParams) {
+		operations := catalog.Operations()
+
+		if strings.Contains(r.Header.Get("Accept"), "text/plain") {
+			w.Header().Set(ContentTypeHeader, "text/plain; charset=utf-8")
+			w.WriteHeader(http.StatusOK)
+			WriteOperations(w, operations)
+			return
+		}
+		w.JSON(http.StatusOK, operations)
+	}
+}
+
+// WriteOperations writes the operations for humans, with a paragraph per operation like:
+//
+//	quotas: Inspects and adjusts the request quotas of tenants.
+//	  GET /service/quotas/:tenant
+//	  POST /service/quotas/:tenant
+//	  Last change: 2017-06-15T10:00:00Z by alice (POST /service/quotas/acme)
+//	  Runbook: https://runbooks.example.com/quotas
+func WriteOperations(w io.Writer, operations []Operation) error {
+	for _, operation := range operations {
+		lines := []string{fmt.Sprintf("%s: %s", operation.Name, operation.Description)}
+		for _, endpoint := range operation.Endpoints {
+			lines = append(lines, fmt.Sprintf("  %s %s", endpoint.Method, endpoint.Path))
+		}
+		if operation.State != nil {
+			lines = append(lines, fmt.Sprintf("  State: %+v", operation.State))
+		}
+		if change := operation.LastChange; change != nil {
+			lines = append(lines, fmt.Sprintf("  Last change: %s by %s (%s %s)", change.At.Format(time.RFC3339),
+				change.Actor, change.Endpoint.Method, change.Endpoint.Path))
+		}
+		if operation.RunbookURL != "" {
+			lines = append(lines, "  Runbook: "+operation.RunbookURL)
+		}
+
+		if _, err := fmt.Fprintf(w, "%s\n\n", strings.Join(lines, "\n")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newOperationsCatalog(runbooks map[string]string) *operationsCatalogImpl {
+	return &operationsCatalogImpl{
+		runbooks:   runbooks,
+		operations: make(map[string]*registeredOperation),
+	}
+}
+
+// register adds the feature to the catalog. The state func is called for every listing, and can be nil.
+func (c *operationsCatalogImpl) register(name, description string, state func() interface{}) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.names = append(c.names, name)
+	c.operations[name] = &registeredOperation{
+		operation: Operation{Name: name, Description: description, RunbookURL: c.runbooks[name]},
+		state:     state,
+	}
+}
+
+// endpoints adds the endpoints to the registered feature, and returns a MiddlewareFunc that records the changes made
+// through them.
+func (c *operationsCatalogImpl) endpoints(name string, paths []string, methods []string) MiddlewareFunc {
+	c.mutex.Lock()
+	operation := &c.operations[name].operation
+	for _, path := range paths {
+		for _, method := range methods {
+			operation.Endpoints = append(operation.Endpoints, OperationEndpoint{Method: method, Path: path})
+		}
+	}
+	c.mutex.Unlock()
+
+	return func(next Handle) Handle {
+		return func(w WrappedResponseWriter, r *http.Request, p RouterParams) {
+			next(w, r, p)
+
+			if r.Method == http.MethodGet || r.Method == http.MethodHead || w.Status() >= http.StatusBadRequest {
+				return
+			}
+			c.changed(name, OperationChange{
+				At:       time.Now().UTC(),
+				Actor:    operator(r),
+				Endpoint: OperationEndpoint{Method: r.Method, Path: r.URL.Path},
+			})
+		}
+	}
+}
+
+func (c *operationsCatalogImpl) changed(name string, change OperationChange) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.operations[name].operation.LastChange = &change
+}
+
+func operator(r *http.Request) string {
+	if actor := r.Header.Get(OperatorHeader); actor != "" {
+		return actor
+	}
+	if ip := remoteIP(r.RemoteAddr); ip != nil {
+		return ip.String()
+	}
+	return r.RemoteAddr
+}
+
+/* OperationsCatalog implementation */
+
+// Operations returns the registered features in the order of registration, with their current state.
+func (c *operationsCatalogImpl) Operations() []Operation {
+	c.mutex.Lock()
+	operations := make([]Operation, 0, len(c.names))
+	var states []func() interface{}
+	for _, name := range c.names {
+		registered := c.operations[name]
+		operation := registered.operation
+		operation.Endpoints = append([]OperationEndpoint(nil), operation.Endpoints...)
+		operations = append(operations, operation)
+		states = append(states, registered.state)
+	}
+	c.mutex.Unlock()
+
+	// The states are read outside the lock, because they may take locks of their own.
+	for i, state := range states {
+		if state != nil {
+			operations[i].State = state()
+		}
+	}
+	return operations
+}
@@ -0,0 +1,107 @@
+package servicefoundation_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	sf "github.com/Prutswonder/go-servicefoundation"
+	"github.com/Prutswonder/go-servicefoundation/servicetest"
+	"github.com/stretchr/testify/assert"
+)
+
+func newOperationsService(quotas bool) sf.Service {
+	opt := sf.NewServiceOptions("operations", []string{http.MethodGet}, nil)
+	opt.Runbooks = map[string]string{sf.OperationQuotas: "https://runbooks.example.com/quotas"}
+	if quotas {
+		opt.Quotas = newTestQuotaManager(servicetest.NewFakeClock(time.Date(2017, 6, 15, 10, 0, 0, 0, time.UTC)),
+			sf.Quota{Window: sf.QuotaWindowDay, Limit: 100})
+	}
+	return sf.NewCustomService(opt)
+}
+
+func readOperations(t *testing.T, sut sf.Service) ([]string, map[string]sf.Operation) {
+	w := httptest.NewRecorder()
+	sut.Handler("internal").ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/service/operations", nil))
+
+	var operations []sf.Operation
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &operations))
+	var names []string
+	byName := make(map[string]sf.Operation)
+	for _, operation := range operations {
+		names = append(names, operation.Name)
+		byName[operation.Name] = operation
+	}
+	return names, byName
+}
+
+func TestOperationsCatalog_OnlyEnabledFeatures(t *testing.T) {
+	tests := []struct {
+		quotas   bool
+		expected []string
+	}{
+		{false, []string{sf.OperationShutdown, sf.OperationServerRestart}},
+		{true, []string{sf.OperationShutdown, sf.OperationServerRestart, sf.OperationQuotas}},
+	}
+
+	for _, test := range tests {
+		sut := newOperationsService(test.quotas)
+
+		// Act
+		names, actual := readOperations(t, sut)
+
+		assert.Equal(t, test.expected, names)
+		assert.Equal(t, sf.DrainStateServing, actual[sf.OperationShutdown].State)
+		assert.Equal(t, []sf.OperationEndpoint{{Method: http.MethodGet, Path: "/quit"}}, actual[sf.OperationShutdown].Endpoints)
+		assert.NotEmpty(t, actual[sf.OperationShutdown].Description)
+	}
+}
+
+func TestOperationsCatalog_TracksChanges(t *testing.T) {
+	sut := newOperationsService(true)
+	internal := sut.Handler("internal")
+	_, operations := readOperations(t, sut)
+	quotas := operations[sf.OperationQuotas]
+	assert.Equal(t, []sf.OperationEndpoint{
+		{Method: http.MethodGet, Path: "/service/quotas/:tenant"},
+		{Method: http.MethodPost, Path: "/service/quotas/:tenant"},
+	}, quotas.Endpoints)
+	assert.Equal(t, "https://runbooks.example.com/quotas", quotas.RunbookURL)
+	assert.Nil(t, quotas.LastChange)
+
+	// Act
+	r := httptest.NewRequest(http.MethodPost, "/service/quotas/acme", strings.NewReader(`{"window":"day","delta":5}`))
+	r.Header.Set(sf.OperatorHeader, "alice")
+	internal.ServeHTTP(httptest.NewRecorder(), r)
+
+	_, operations = readOperations(t, sut)
+	change := operations[sf.OperationQuotas].LastChange
+	if assert.NotNil(t, change) {
+		assert.Equal(t, "alice", change.Actor)
+		assert.Equal(t, sf.OperationEndpoint{Method: http.MethodPost, Path: "/service/quotas/acme"}, change.Endpoint)
+		assert.WithinDuration(t, time.Now(), change.At, time.Minute)
+	}
+
+	internal.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/service/quotas/acme", nil))
+	internal.ServeHTTP(httptest.NewRecorder(),
+		httptest.NewRequest(http.MethodPost, "/service/quotas/acme", strings.NewReader(`{"window":"minute","delta":5}`)))
+	_, operations = readOperations(t, sut)
+	assert.Equal(t, change, operations[sf.OperationQuotas].LastChange, "reads and failed requests are no changes")
+}
+
+func TestOperationsHandler_PlainText(t *testing.T) {
+	sut := newOperationsService(true)
+	r := httptest.NewRequest(http.MethodGet, "/service/operations", nil)
+	r.Header.Set("Accept", "text/plain")
+	w := httptest.NewRecorder()
+
+	// Act
+	sut.Handler("internal").ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "quotas: Inspects the request quotas of tenants and adjusts their usage.\n"+
+		"  GET /service/quotas/:tenant\n  POST /service/quotas/:tenant\n  Runbook: https://runbooks.example.com/quotas\n")
+}
@@ -0,0 +1,327 @@
+package servicefoundation
+
+import (
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const (
+	// CursorNext is the direction of a cursor that continues after its sort keys.
+	CursorNext = "next"
+	// CursorPrev is the direction of a cursor that continues before its sort keys.
+	CursorPrev = "prev"
+
+	// ProblemCodeInvalidCursor is the problem code of requests with a malformed, tampered or unsupported cursor.
+	ProblemCodeInvalidCursor = "invalid_cursor"
+	// ProblemCodeInvalidPage is the problem code of requests with invalid page parameters.
+	ProblemCodeInvalidPage = "invalid_page"
+
+	// TotalCountHeader is the header containing the total number of items of a paginated list.
+	TotalCountHeader = "X-Total-Count"
+
+	pageQueryParameter    = "page"
+	perPageQueryParameter = "per_page"
+	cursorQueryParameter  = "cursor"
+
+	paginationSubsystem = "pagination"
+	defaultPerPage      = 20
+	defaultMaxPerPage   = 100
+	defaultMaxOffset    = 10000
+)
+
+// ErrInvalidCursor is returned when a cursor is malformed or its signature doesn't match.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+type (
+	// PaginationOptions contains the settings of a paginated list. Requested page sizes above MaxPerPage are capped
+	// and pages beyond MaxOffset items are rejected, because deep offsets are expensive; cursors have no such limit.
+	// Cursors are only accepted when a CursorCodec is set.
+	PaginationOptions struct {
+		DefaultPerPage int
+		MaxPerPage     int
+		MaxOffset      int
+		Cursors        CursorCodec
+	}
+
+	// PageRequest is the requested page of a paginated list. Cursor is nil for offset pagination, in which case Page
+	// is 1-based and Offset is the number of items before the page.
+	PageRequest struct {
+		Page    int
+		PerPage int
+		Offset  int
+		Cursor  *Cursor
+		cursors CursorCodec
+	}
+
+	// Cursor is the position in a list sorted by one or more keys. The sort keys of the item before (CursorNext) or
+	// after (CursorPrev) the page are embedded, which keeps pages stable when items are added or removed.
+	Cursor struct {
+		Keys      []string `json:"k"`
+		Direction string   `json:"d"`
+		PerPage   int      `json:"n,omitempty"`
+	}
+
+	// CursorCodec encodes cursors as opaque strings, which can't be forged or tampered with by clients.
+	CursorCodec interface {
+		Encode(cursor Cursor) (string, error)
+		Decode(encoded string) (Cursor, error)
+	}
+
+	// PaginationError is returned by ParsePageRequest for invalid page parameters.
+	PaginationError struct {
+		Code   string
+		Detail string
+	}
+
+	hmacCursorCodec struct {
+		secret SecretFunc
+	}
+)
+
+// NewCursorCodec creates and returns a CursorCodec that encodes cursors as base64 JSON, signed with HMAC-SHA256. The
+// secret is resolved for every cursor, so a rotated secret invalidates the outstanding cursors.
+func NewCursorCodec(secret SecretFunc) CursorCodec {
+	return &hmacCursorCodec{secret: secret}
+}
+
+// ParsePageRequest returns the page from the "page" and "per_page" query parameters, or from the "cursor" query
+// parameter. The requested page size is counted per route.
+func ParsePageRequest(r *http.Request, options PaginationOptions) (PageRequest, error) {
+	options = paginationDefaults(options)
+	query := r.URL.Query()
+
+	request := PageRequest{Page: 1, PerPage: options.DefaultPerPage, cursors: options.Cursors}
+
+	if encoded := query.Get(cursorQueryParameter); encoded != "" {
+		if options.Cursors == nil {
+			return PageRequest{}, &PaginationError{ProblemCodeInvalidCursor, "Cursors are not supported"}
+		}
+		if query.Get(pageQueryParameter) != "" {
+			return PageRequest{}, &PaginationError{ProblemCodeInvalidPage, "Use either cursor or page"}
+		}
+
+		cursor, err := options.Cursors.Decode(encoded)
+		if err != nil {
+			return PageRequest{}, &PaginationError{ProblemCodeInvalidCursor, "Invalid cursor"}
+		}
+		request.Cursor = &cursor
+		if cursor.PerPage > 0 {
+			request.PerPage = cursor.PerPage
+		}
+	}
+
+	if value := query.Get(pageQueryParameter); value != "" {
+		page, err := strconv.Atoi(value)
+		if err != nil || page < 1 {
+			return PageRequest{}, &PaginationError{ProblemCodeInvalidPage, "Page must be a positive integer"}
+		}
+		request.Page = page
+	}
+
+	if value := query.Get(perPageQueryParameter); value != "" {
+		perPage, err := strconv.Atoi(value)
+		if err != nil || perPage < 1 {
+			return PageRequest{}, &PaginationError{ProblemCodeInvalidPage, "Page size must be a positive integer"}
+		}
+		request.PerPage = perPage
+	}
+
+	capped := request.PerPage > options.MaxPerPage
+	if capped {
+		request.PerPage = options.MaxPerPage
+	}
+	recordPageSize(r, request.PerPage, capped)
+
+	request.Offset = (request.Page - 1) * request.PerPage
+	if request.Cursor == nil && request.Offset > options.MaxOffset {
+		return PageRequest{}, &PaginationError{ProblemCodeInvalidPage,
+			fmt.Sprintf("Pages beyond %d items are not available, use a narrower query", options.MaxOffset)}
+	}
+	return request, nil
+}
+
+// WritePaginationError writes the error returned by ParsePageRequest as a 400 problem response with its code.
+func WritePaginationError(w http.ResponseWriter, err error) {
+	if e, ok := err.(*PaginationError); ok {
+		WriteProblemCode(w, http.StatusBadRequest, e.Code, e.Detail)
+		return
+	}
+	WriteProblem(w, http.StatusBadRequest, err.Error())
+}
+
+// WritePage writes the items of the page, with Link headers (RFC 5988) to the adjacent pages and the total in the
+// X-Total-Count header when it isn't negative. With cursor pagination, the next and prev cursors are linked when they
+// aren't nil. With offset pagination, they are ignored and the adjacent pages are derived from the total, or from the
+// number of items when the total is unknown. Items is a slice, or a channel of which the items are streamed.
+func WritePage(w WrappedResponseWriter, r *http.Request, request PageRequest, items interface{}, next, prev *Cursor, total int) error {
+	links, err := request.links(r, items, next, prev, total)
+	if err != nil {
+		return err
+	}
+
+	if len(links) > 0 {
+		w.Header().Set("Link", strings.Join(links, ", "))
+	}
+	if total >= 0 {
+		w.Header().Set(TotalCountHeader, strconv.Itoa(total))
+	}
+
+	if stream, ok := items.(<-chan interface{}); ok {
+		return StreamJSON(w, http.StatusOK, stream)
+	}
+	w.JSON(http.StatusOK, items)
+	return nil
+}
+
+func (p PageRequest) links(r *http.Request, items interface{}, next, prev *Cursor, total int) ([]string, error) {
+	var links []string
+	link := func(rel string, query url.Values) {
+		links = append(links, fmt.Sprintf("<%s>; rel=\"%s\"", AbsoluteURL(r, r.URL.Path, query), rel))
+	}
+
+	if p.Cursor != nil || next != nil || prev != nil {
+		for _, c := range []struct {
+			rel    string
+			cursor *Cursor
+		}{{CursorNext, next}, {CursorPrev, prev}} {
+			if c.cursor == nil {
+				continue
+			}
+			if p.cursors == nil {
+				return nil, errors.New("cursors require a CursorCodec in the PaginationOptions")
+			}
+
+			cursor := *c.cursor
+			cursor.PerPage = p.PerPage
+			encoded, err := p.cursors.Encode(cursor)
+			if err != nil {
+				return nil, err
+			}
+			link(c.rel, p.query(r, url.Values{cursorQueryParameter: {encoded}}))
+		}
+		return links, nil
+	}
+
+	pageLink := func(rel string, page int) {
+		link(rel, p.query(r, url.Values{
+			pageQueryParameter:    {strconv.Itoa(page)},
+			perPageQueryParameter: {strconv.Itoa(p.PerPage)},
+		}))
+	}
+
+	hasNext := total >= 0 && p.Offset+p.PerPage < total
+	if total < 0 {
+		if v := reflect.ValueOf(items); v.Kind() == reflect.Slice {
+			hasNext = v.Len() >= p.PerPage
+		}
+	}
+	if hasNext {
+		pageLink(CursorNext, p.Page+1)
+	}
+	if p.Page > 1 {
+		pageLink(CursorPrev, p.Page-1)
+		pageLink("first", 1)
+	}
+	if total > 0 {
+		pageLink("last", (total+p.PerPage-1)/p.PerPage)
+	}
+	return links, nil
+}
+
+// query returns the query of the request with the pagination parameters replaced, so filters and sorting are kept.
+func (p PageRequest) query(r *http.Request, params url.Values) url.Values {
+	query := r.URL.Query()
+	for _, name := range []string{pageQueryParameter, perPageQueryParameter, cursorQueryParameter} {
+		query.Del(name)
+	}
+	for name, values := range params {
+		query[name] = values
+	}
+	return query
+}
+
+func paginationDefaults(options PaginationOptions) PaginationOptions {
+	if options.DefaultPerPage <= 0 {
+		options.DefaultPerPage = defaultPerPage
+	}
+	if options.MaxPerPage <= 0 {
+		options.MaxPerPage = defaultMaxPerPage
+	}
+	if options.DefaultPerPage > options.MaxPerPage {
+		options.DefaultPerPage = options.MaxPerPage
+	}
+	if options.MaxOffset <= 0 {
+		options.MaxOffset = defaultMaxOffset
+	}
+	return options
+}
+
+func recordPageSize(r *http.Request, perPage int, capped bool) {
+	if rc, ok := r.Context().Value(routeContextKey{}).(*routeContext); ok {
+		rc.metrics.CountLabels(paginationSubsystem, "page_size_requests_total", "Total page requests per page size.",
+			[]string{"route", "per_page", "capped"}, []string{rc.route, strconv.Itoa(perPage), strconv.FormatBool(capped)})
+	}
+}
+
+/* CursorCodec implementation */
+
+func (c *hmacCursorCodec) Encode(cursor Cursor) (string, error) {
+	secret, err := c.secret()
+	if err != nil {
+		return "", err
+	}
+
+	payload, err := json.Marshal(cursor)
+	if err != nil {
+		return "", err
+	}
+	signature := hmacSHA256([]byte(secret), string(payload))
+
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+func (c *hmacCursorCodec) Decode(encoded string) (Cursor, error) {
+	parts := strings.Split(encoded, ".")
+	if len(parts) != 2 {
+		return Cursor{}, ErrInvalidCursor
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return Cursor{}, ErrInvalidCursor
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return Cursor{}, ErrInvalidCursor
+	}
+
+	secret, err := c.secret()
+	if err != nil {
+		return Cursor{}, err
+	}
+	if !hmac.Equal(signature, hmacSHA256([]byte(secret), string(payload))) {
+		return Cursor{}, ErrInvalidCursor
+	}
+
+	var cursor Cursor
+	if err := json.Unmarshal(payload, &cursor); err != nil {
+		return Cursor{}, ErrInvalidCursor
+	}
+	if cursor.Direction != CursorNext && cursor.Direction != CursorPrev {
+		return Cursor{}, ErrInvalidCursor
+	}
+	return cursor, nil
+}
+
+/* error implementation */
+
+func (e *PaginationError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Detail)
+}
@@ -0,0 +1,203 @@
+package servicefoundation_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	sf "github.com/Prutswonder/go-servicefoundation"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestCursorCodec(secret string) sf.CursorCodec {
+	return sf.NewCursorCodec(func() (string, error) { return secret, nil })
+}
+
+func TestParsePageRequest(t *testing.T) {
+	options := sf.PaginationOptions{DefaultPerPage: 10, MaxPerPage: 50, MaxOffset: 1000}
+	tests := []struct {
+		query           string
+		expectedPage    int
+		expectedPerPage int
+		expectedOffset  int
+		expectedCode    string
+	}{
+		{"", 1, 10, 0, ""},
+		{"page=3", 3, 10, 20, ""},
+		{"page=2&per_page=25", 2, 25, 25, ""},
+		{"per_page=500", 1, 50, 0, ""},
+		{"page=0", 0, 0, 0, sf.ProblemCodeInvalidPage},
+		{"page=two", 0, 0, 0, sf.ProblemCodeInvalidPage},
+		{"per_page=-1", 0, 0, 0, sf.ProblemCodeInvalidPage},
+		{"page=102", 0, 0, 0, sf.ProblemCodeInvalidPage},
+		{"cursor=abc", 0, 0, 0, sf.ProblemCodeInvalidCursor},
+	}
+
+	for _, test := range tests {
+		r, _ := http.NewRequest(http.MethodGet, "/orders?"+test.query, nil)
+
+		// Act
+		actual, err := sf.ParsePageRequest(r, options)
+
+		if test.expectedCode != "" {
+			if assert.IsType(t, &sf.PaginationError{}, err, test.query) {
+				assert.Equal(t, test.expectedCode, err.(*sf.PaginationError).Code, test.query)
+			}
+			continue
+		}
+		assert.NoError(t, err, test.query)
+		assert.Equal(t, test.expectedPage, actual.Page, test.query)
+		assert.Equal(t, test.expectedPerPage, actual.PerPage, test.query)
+		assert.Equal(t, test.expectedOffset, actual.Offset, test.query)
+		assert.Nil(t, actual.Cursor, test.query)
+	}
+}
+
+func TestCursorCodec_RoundTrip(t *testing.T) {
+	sut := newTestCursorCodec("cursor-secret")
+	expected := sf.Cursor{Keys: []string{"2026-10-15T10:00:00Z", "order-42"}, Direction: sf.CursorNext, PerPage: 25}
+
+	// Act
+	encoded, err := sut.Encode(expected)
+
+	assert.NoError(t, err)
+	actual, err := sut.Decode(encoded)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, actual)
+}
+
+func TestCursorCodec_RejectsTamperedCursors(t *testing.T) {
+	sut := newTestCursorCodec("cursor-secret")
+	encoded, _ := sut.Encode(sf.Cursor{Keys: []string{"order-42"}, Direction: sf.CursorNext})
+	parts := strings.Split(encoded, ".")
+	forged, _ := newTestCursorCodec("other-secret").Encode(sf.Cursor{Keys: []string{"order-1"}, Direction: sf.CursorNext})
+	tests := []struct {
+		encoded     string
+		explanation string
+	}{
+		{"eyJrIjpbIm9yZGVyLTEiXSwiZCI6Im5leHQifQ." + parts[1], "payload replaced"},
+		{parts[0] + ".c2lnbmF0dXJl", "signature replaced"},
+		{parts[0], "signature missing"},
+		{"!!!." + parts[1], "payload isn't base64"},
+		{forged, "signed with another secret"},
+	}
+
+	for _, test := range tests {
+		// Act
+		_, err := sut.Decode(test.encoded)
+
+		assert.Equal(t, sf.ErrInvalidCursor, err, test.explanation)
+	}
+}
+
+func TestParsePageRequest_Cursor(t *testing.T) {
+	codec := newTestCursorCodec("cursor-secret")
+	encoded, _ := codec.Encode(sf.Cursor{Keys: []string{"order-42"}, Direction: sf.CursorPrev, PerPage: 5})
+	r, _ := http.NewRequest(http.MethodGet, "/orders?cursor="+encoded, nil)
+
+	// Act
+	actual, err := sf.ParsePageRequest(r, sf.PaginationOptions{Cursors: codec})
+
+	assert.NoError(t, err)
+	if assert.NotNil(t, actual.Cursor) {
+		assert.Equal(t, []string{"order-42"}, actual.Cursor.Keys)
+		assert.Equal(t, sf.CursorPrev, actual.Cursor.Direction)
+	}
+	assert.Equal(t, 5, actual.PerPage, "the page size of the cursor is kept")
+
+	r, _ = http.NewRequest(http.MethodGet, "/orders?page=2&cursor="+encoded, nil)
+	_, err = sf.ParsePageRequest(r, sf.PaginationOptions{Cursors: codec})
+	assert.Equal(t, sf.ProblemCodeInvalidPage, err.(*sf.PaginationError).Code, "cursor and page are exclusive")
+}
+
+func TestWritePaginationError_TamperedCursor(t *testing.T) {
+	r, _ := http.NewRequest(http.MethodGet, "/orders?cursor=eyJrIjpbXSwiZCI6Im5leHQifQ.c2lnbmF0dXJl", nil)
+	_, err := sf.ParsePageRequest(r, sf.PaginationOptions{Cursors: newTestCursorCodec("cursor-secret")})
+	w := httptest.NewRecorder()
+
+	// Act
+	sf.WritePaginationError(w, err)
+
+	var actual sf.Problem
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &actual))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, sf.ContentTypeProblemJSON, w.Header().Get(sf.ContentTypeHeader))
+	assert.Equal(t, sf.ProblemCodeInvalidCursor, actual.Code)
+}
+
+func TestWritePage_Offset(t *testing.T) {
+	tests := []struct {
+		query         string
+		items         []int
+		total         int
+		expectedLinks []string
+		expectedTotal string
+	}{
+		{"page=1&per_page=2", []int{1, 2}, 5, []string{
+			`<https://api.example.com/v1/orders?page=2&per_page=2&status=open>; rel="next"`,
+			`<https://api.example.com/v1/orders?page=3&per_page=2&status=open>; rel="last"`,
+		}, "5"},
+		{"page=3&per_page=2", []int{5}, 5, []string{
+			`<https://api.example.com/v1/orders?page=2&per_page=2&status=open>; rel="prev"`,
+			`<https://api.example.com/v1/orders?page=1&per_page=2&status=open>; rel="first"`,
+			`<https://api.example.com/v1/orders?page=3&per_page=2&status=open>; rel="last"`,
+		}, "5"},
+		{"page=2&per_page=2", []int{3, 4}, -1, []string{
+			`<https://api.example.com/v1/orders?page=3&per_page=2&status=open>; rel="next"`,
+			`<https://api.example.com/v1/orders?page=1&per_page=2&status=open>; rel="prev"`,
+			`<https://api.example.com/v1/orders?page=1&per_page=2&status=open>; rel="first"`,
+		}, ""},
+		{"page=1&per_page=2", []int{1}, -1, nil, ""},
+	}
+
+	for _, test := range tests {
+		r, _ := http.NewRequest(http.MethodGet, "http://orders:8080/orders?status=open&"+test.query, nil)
+		r.Header.Set("X-Forwarded-Proto", "https")
+		r.Header.Set("X-Forwarded-Host", "api.example.com, orders-lb")
+		r.Header.Set("X-Forwarded-Prefix", "/v1/")
+		request, _ := sf.ParsePageRequest(r, sf.PaginationOptions{})
+		w := httptest.NewRecorder()
+
+		// Act
+		err := sf.WritePage(sf.NewWrappedResponseWriter(w), r, request, test.items, nil, nil, test.total)
+
+		assert.NoError(t, err, test.query)
+		assert.Equal(t, http.StatusOK, w.Code, test.query)
+		assert.Equal(t, strings.Join(test.expectedLinks, ", "), w.Header().Get("Link"), test.query)
+		assert.Equal(t, test.expectedTotal, w.Header().Get(sf.TotalCountHeader), test.query)
+		var actual []int
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &actual), test.query)
+		assert.Equal(t, test.items, actual, test.query)
+	}
+}
+
+func TestWritePage_Cursor(t *testing.T) {
+	codec := newTestCursorCodec("cursor-secret")
+	r, _ := http.NewRequest(http.MethodGet, "http://orders.local/orders?status=open&per_page=3", nil)
+	request, _ := sf.ParsePageRequest(r, sf.PaginationOptions{Cursors: codec})
+	items := make(chan interface{}, 2)
+	items <- map[string]string{"id": "order-1"}
+	items <- map[string]string{"id": "order-2"}
+	close(items)
+	w := httptest.NewRecorder()
+
+	// Act
+	err := sf.WritePage(sf.NewWrappedResponseWriter(w), r, request, (<-chan interface{})(items),
+		&sf.Cursor{Keys: []string{"order-2"}, Direction: sf.CursorNext}, nil, -1)
+
+	assert.NoError(t, err)
+	assert.JSONEq(t, `[{"id":"order-1"},{"id":"order-2"}]`, w.Body.String())
+	link := w.Header().Get("Link")
+	assert.True(t, strings.HasPrefix(link, "<http://orders.local/orders?cursor="), link)
+	assert.True(t, strings.HasSuffix(link, `&status=open>; rel="next"`), link)
+
+	next, _ := url.Parse(strings.TrimPrefix(strings.Split(link, ">")[0], "<"))
+	r, _ = http.NewRequest(http.MethodGet, next.String(), nil)
+	actual, err := sf.ParsePageRequest(r, sf.PaginationOptions{Cursors: codec})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"order-2"}, actual.Cursor.Keys)
+	assert.Equal(t, 3, actual.PerPage, "the page size is carried by the cursor")
+}
@@ -0,0 +1,52 @@
+package servicefoundation
+
+import (
+	"context"
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+	"time"
+)
+
+// debugMiddlewares are the middlewares of the pprof and expvar endpoints. RequestLogging is left out, because profiles
+// and traces take as long as requested, which would skew the request counters and response time histograms.
+var debugMiddlewares = []Middleware{PanicTo500, NoCaching, RequestID}
+
+// NewPprofHandler returns a Handle that serves the net/http/pprof endpoints from a /debug/pprof/*profile route, like
+// the index, /debug/pprof/heap, /debug/pprof/profile and /debug/pprof/trace.
+func NewPprofHandler() Handle {
+	return NewStreamingHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch strings.Trim(r.URL.Path[len("/debug/pprof"):], "/") {
+		case "cmdline":
+			pprof.Cmdline(w, r)
+		case "profile":
+			pprof.Profile(w, r)
+		case "symbol":
+			pprof.Symbol(w, r)
+		case "trace":
+			pprof.Trace(w, r)
+		default:
+			pprof.Index(w, r)
+		}
+	}))
+}
+
+// NewExpvarHandler returns a Handle that serves the expvar variables as JSON.
+func NewExpvarHandler() Handle {
+	return NewStreamingHandler(expvar.Handler())
+}
+
+// NewStreamingHandler adapts an http.Handler that streams its response for a long time, like a CPU profile or a trace.
+// Its writes and flushes go straight to the client, and the WriteTimeout of the server doesn't apply to it.
+func NewStreamingHandler(handler http.Handler) Handle {
+	return func(w WrappedResponseWriter, r *http.Request, _ RouterParams) {
+		http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+		// net/http/pprof refuses durations beyond the WriteTimeout of the server in the context, which was just lifted.
+		if _, ok := r.Context().Value(http.ServerContextKey).(*http.Server); ok {
+			r = r.WithContext(context.WithValue(r.Context(), http.ServerContextKey, nil))
+		}
+		handler.ServeHTTP(w, r)
+	}
+}
@@ -0,0 +1,87 @@
+package servicefoundation_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	sf "github.com/Prutswonder/go-servicefoundation"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestService_PprofEndpoints(t *testing.T) {
+	tests := []struct {
+		enabled   bool
+		subsystem string
+		path      string
+		expected  int
+		contains  string
+	}{
+		{true, "internal", "/debug/pprof/", http.StatusOK, "goroutine"},
+		{true, "internal", "/debug/pprof/heap?debug=1", http.StatusOK, "heap profile"},
+		{true, "internal", "/debug/pprof/cmdline", http.StatusOK, ""},
+		{true, "internal", "/debug/vars", http.StatusOK, "memstats"},
+		{true, "public", "/debug/pprof/", http.StatusNotFound, ""},
+		{true, "readiness", "/debug/vars", http.StatusNotFound, ""},
+		{false, "internal", "/debug/pprof/", http.StatusNotFound, ""},
+		{false, "internal", "/debug/vars", http.StatusNotFound, ""},
+	}
+
+	for _, test := range tests {
+		opt := sf.NewServiceOptions("pprof", []string{http.MethodGet}, nil)
+		opt.EnablePprof = test.enabled
+		sut := sf.NewCustomService(opt)
+		w := httptest.NewRecorder()
+
+		// Act
+		sut.Handler(test.subsystem).ServeHTTP(w, httptest.NewRequest(http.MethodGet, test.path, nil))
+
+		assert.Equal(t, test.expected, w.Code, "%s %s", test.subsystem, test.path)
+		assert.Contains(t, w.Body.String(), test.contains, "%s %s", test.subsystem, test.path)
+	}
+}
+
+func TestService_PprofExcludedFromRequestMetrics(t *testing.T) {
+	opt := sf.NewServiceOptions("pprof", []string{http.MethodGet}, nil)
+	opt.EnablePprof = true
+	sut := sf.NewCustomService(opt)
+	sut.Handler("internal")
+
+	for _, name := range []string{"internal/pprof", "internal/expvar"} {
+		// Act
+		explanation, err := sf.ExplainRoute(sut, name)
+
+		assert.NoError(t, err)
+		var middlewares []string
+		for _, middleware := range explanation.Middlewares {
+			middlewares = append(middlewares, middleware.Name)
+		}
+		assert.Equal(t, []string{"request_id", "no_caching", "panic_to_500"}, middlewares, name)
+	}
+}
+
+func TestNewStreamingHandler_ExemptFromWriteTimeout(t *testing.T) {
+	opt := sf.NewServiceOptions("pprof", []string{http.MethodGet}, nil)
+	opt.EnablePprof = true
+	sut := sf.NewCustomService(opt)
+	server := httptest.NewUnstartedServer(sut.Handler("internal"))
+	server.Config.WriteTimeout = 200 * time.Millisecond
+	server.Start()
+	defer server.Close()
+
+	// Act
+	resp, err := http.Get(server.URL + "/debug/pprof/profile?seconds=1")
+
+	assert.NoError(t, err)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, strings.TrimSpace(string(body)))
+	assert.NotEmpty(t, body, "the CPU profile outlasts the WriteTimeout")
+}
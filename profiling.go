@@ -0,0 +1,450 @@
+package servicefoundation
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Prutswonder/go-servicefoundation/events"
+)
+
+const (
+	// ProfileCPU is the kind of a CPU profile.
+	ProfileCPU = "cpu"
+	// ProfileHeap is the kind of a heap profile.
+	ProfileHeap = "heap"
+	// ProfileGoroutine is the kind of a goroutine profile.
+	ProfileGoroutine = "goroutine"
+	// ProfileMutex is the kind of a mutex contention profile.
+	ProfileMutex = "mutex"
+
+	profilingSubsystem = "profiling"
+	profileTimeLayout  = "20060102T150405.000000000Z"
+	profileFileSuffix  = ".pprof"
+
+	defaultProfileInterval      = time.Minute
+	defaultProfileCPUDuration   = 10 * time.Second
+	defaultProfileRetention     = 10
+	defaultProfileUploadRetries = 3
+	defaultMutexProfileFraction = 5
+)
+
+var (
+	// ErrProfileNotFound is returned when a profile does not exist (anymore).
+	ErrProfileNotFound = errors.New("profile not found")
+
+	defaultProfileKinds = []string{ProfileCPU, ProfileHeap, ProfileGoroutine, ProfileMutex}
+)
+
+type (
+	// ProfilerOptions contains the settings for continuous profiling. Every Interval, the profiles of the given Kinds
+	// are captured, with CPU profiles covering CPUDuration. The last Retention profiles of each kind are kept in
+	// Directory, or in memory when Directory is empty. When UploadURL is set, every capture is posted to it as well.
+	ProfilerOptions struct {
+		Interval      time.Duration
+		CPUDuration   time.Duration
+		Kinds         []string
+		Retention     int
+		Directory     string
+		UploadURL     string
+		UploadRetries int
+		HTTPClient    *http.Client
+	}
+
+	// ProfileInfo describes a captured profile.
+	ProfileInfo struct {
+		Kind      string    `json:"kind"`
+		Timestamp string    `json:"timestamp"`
+		Time      time.Time `json:"time"`
+		Size      int       `json:"size"`
+	}
+
+	// Profiler periodically captures runtime profiles.
+	Profiler interface {
+		Start(ctx context.Context)
+		Capture(ctx context.Context) bool
+		Profiles() []ProfileInfo
+		Profile(kind, timestamp string) ([]byte, error)
+	}
+
+	profilerImpl struct {
+		options   ProfilerOptions
+		log       Logger
+		metrics   Metrics
+		store     profileStore
+		capturing int32
+		uploads   chan capturedProfile
+	}
+
+	capturedProfile struct {
+		info ProfileInfo
+		data []byte
+	}
+
+	profileStore interface {
+		add(info ProfileInfo, data []byte) error
+		list() []ProfileInfo
+		get(kind, timestamp string) ([]byte, error)
+	}
+
+	memoryProfileStore struct {
+		retention int
+		mutex     sync.RWMutex
+		profiles  map[string][]capturedProfile
+	}
+
+	diskProfileStore struct {
+		retention int
+		directory string
+		mutex     sync.Mutex
+	}
+)
+
+// NewProfiler creates and returns a new Profiler implementation. Profiling is only active after calling Start.
+func NewProfiler(options ProfilerOptions, log Logger, metrics Metrics) Profiler {
+	if options.Interval <= 0 {
+		options.Interval = defaultProfileInterval
+	}
+	if options.CPUDuration <= 0 {
+		options.CPUDuration = defaultProfileCPUDuration
+	}
+	if len(options.Kinds) == 0 {
+		options.Kinds = defaultProfileKinds
+	}
+	if options.Retention <= 0 {
+		options.Retention = defaultProfileRetention
+	}
+	if options.UploadRetries <= 0 {
+		options.UploadRetries = defaultProfileUploadRetries
+	}
+	if options.HTTPClient == nil {
+		options.HTTPClient = http.DefaultClient
+	}
+
+	var store profileStore = &memoryProfileStore{
+		retention: options.Retention,
+		profiles:  make(map[string][]capturedProfile),
+	}
+	if options.Directory != "" {
+		store = &diskProfileStore{retention: options.Retention, directory: options.Directory}
+	}
+
+	return &profilerImpl{
+		options: options,
+		log:     log,
+		metrics: metrics,
+		store:   store,
+		// A single pending upload; captures are dropped rather than queued when the backend is slow.
+		uploads: make(chan capturedProfile, 1),
+	}
+}
+
+// NewProfilesHandler returns a handler that lists the captured profiles.
+func NewProfilesHandler(profiler Profiler) Handle {
+	return func(w WrappedResponseWriter, _ *http.Request, _ RouterParams) {
+		w.JSON(http.StatusOK, profiler.Profiles())
+	}
+}
+
+// NewProfileDownloadHandler returns a handler that returns the profile with the "kind" and "timestamp" route
+// parameters, in the pprof format.
+func NewProfileDownloadHandler(profiler Profiler) Handle {
+	return func(w WrappedResponseWriter, _ *http.Request, p RouterParams) {
+		kind := p.Params.ByName("kind")
+		timestamp := p.Params.ByName("timestamp")
+
+		data, err := profiler.Profile(kind, timestamp)
+		switch err {
+		case nil:
+			w.Header().Set(ContentTypeHeader, "application/octet-stream")
+			w.Header().Set("Content-Disposition",
+				fmt.Sprintf("attachment; filename=%s-%s%s", kind, timestamp, profileFileSuffix))
+			w.WriteHeader(http.StatusOK)
+			w.Write(data)
+		case ErrProfileNotFound:
+			w.JSON(http.StatusNotFound, err.Error())
+		default:
+			w.JSON(http.StatusInternalServerError, err.Error())
+		}
+	}
+}
+
+/* Profiler implementation */
+
+func (p *profilerImpl) Start(ctx context.Context) {
+	for _, kind := range p.options.Kinds {
+		if kind == ProfileMutex && runtime.SetMutexProfileFraction(-1) == 0 {
+			runtime.SetMutexProfileFraction(defaultMutexProfileFraction)
+		}
+	}
+
+	if p.options.UploadURL != "" {
+		go p.uploadLoop(ctx)
+	}
+
+	go func() {
+		ticker := time.NewTicker(p.options.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				// Capturing in a separate go-routine keeps the ticker going, so busy cycles are skipped.
+				go p.Capture(ctx)
+			}
+		}
+	}()
+}
+
+// Capture captures all configured profiles. It returns false when the previous capture is still running, in which
+// case the capture is skipped to bound the overhead.
+func (p *profilerImpl) Capture(ctx context.Context) bool {
+	if !atomic.CompareAndSwapInt32(&p.capturing, 0, 1) {
+		p.metrics.Count(profilingSubsystem, "captures_skipped_total", "Total profile captures skipped while busy.")
+		return false
+	}
+	defer atomic.StoreInt32(&p.capturing, 0)
+
+	for _, kind := range p.options.Kinds {
+		data, err := p.captureProfile(ctx, kind)
+		if err != nil {
+			p.log.Warn(events.ProfileCapture, "Failed capturing %s profile: %v", kind, err)
+			continue
+		}
+
+		now := time.Now().UTC()
+		info := ProfileInfo{Kind: kind, Timestamp: now.Format(profileTimeLayout), Time: now, Size: len(data)}
+
+		if err := p.store.add(info, data); err != nil {
+			p.log.Warn(events.ProfileCapture, "Failed storing %s profile: %v", kind, err)
+		}
+		p.enqueueUpload(info, data)
+	}
+	return true
+}
+
+func (p *profilerImpl) Profiles() []ProfileInfo {
+	return p.store.list()
+}
+
+func (p *profilerImpl) Profile(kind, timestamp string) ([]byte, error) {
+	return p.store.get(kind, timestamp)
+}
+
+func (p *profilerImpl) captureProfile(ctx context.Context, kind string) ([]byte, error) {
+	buf := &bytes.Buffer{}
+
+	if kind != ProfileCPU {
+		profile := pprof.Lookup(kind)
+		if profile == nil {
+			return nil, fmt.Errorf("unknown profile kind '%s'", kind)
+		}
+		err := profile.WriteTo(buf, 0)
+		return buf.Bytes(), err
+	}
+
+	if err := pprof.StartCPUProfile(buf); err != nil {
+		return nil, err
+	}
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(p.options.CPUDuration):
+	}
+
+	pprof.StopCPUProfile()
+	return buf.Bytes(), nil
+}
+
+func (p *profilerImpl) enqueueUpload(info ProfileInfo, data []byte) {
+	if p.options.UploadURL == "" {
+		return
+	}
+
+	select {
+	case p.uploads <- capturedProfile{info: info, data: data}:
+	default:
+		p.metrics.Count(profilingSubsystem, "uploads_dropped_total", "Total profile uploads dropped while busy.")
+	}
+}
+
+func (p *profilerImpl) uploadLoop(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case profile := <-p.uploads:
+			if err := p.upload(ctx, profile); err != nil {
+				p.log.Warn(events.ProfileUpload, "Failed uploading %s profile %s: %v", profile.info.Kind,
+					profile.info.Timestamp, err)
+			}
+		}
+	}
+}
+
+func (p *profilerImpl) upload(ctx context.Context, profile capturedProfile) error {
+	var err error
+
+	for attempt := 1; attempt <= p.options.UploadRetries; attempt++ {
+		if err = p.post(ctx, profile); err == nil {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Duration(attempt) * time.Second):
+		}
+	}
+	return err
+}
+
+func (p *profilerImpl) post(ctx context.Context, profile capturedProfile) error {
+	url := fmt.Sprintf("%s?kind=%s&timestamp=%s", p.options.UploadURL, profile.info.Kind, profile.info.Timestamp)
+
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(profile.data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set(ContentTypeHeader, "application/octet-stream")
+
+	resp, err := p.options.HTTPClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+/* profileStore implementations */
+
+func (s *memoryProfileStore) add(info ProfileInfo, data []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	profiles := append(s.profiles[info.Kind], capturedProfile{info: info, data: data})
+	if len(profiles) > s.retention {
+		profiles = profiles[len(profiles)-s.retention:]
+	}
+	s.profiles[info.Kind] = profiles
+	return nil
+}
+
+func (s *memoryProfileStore) list() []ProfileInfo {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	infos := []ProfileInfo{}
+	for _, profiles := range s.profiles {
+		for _, profile := range profiles {
+			infos = append(infos, profile.info)
+		}
+	}
+	sortProfiles(infos)
+	return infos
+}
+
+func (s *memoryProfileStore) get(kind, timestamp string) ([]byte, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	for _, profile := range s.profiles[kind] {
+		if profile.info.Timestamp == timestamp {
+			return profile.data, nil
+		}
+	}
+	return nil, ErrProfileNotFound
+}
+
+func (s *diskProfileStore) add(info ProfileInfo, data []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := os.MkdirAll(s.directory, 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(s.path(info.Kind, info.Timestamp), data, 0644); err != nil {
+		return err
+	}
+
+	// The timestamps sort chronologically, so the oldest profiles come first.
+	files, err := filepath.Glob(filepath.Join(s.directory, info.Kind+"-*"+profileFileSuffix))
+	if err != nil {
+		return err
+	}
+	sort.Strings(files)
+
+	for len(files) > s.retention {
+		os.Remove(files[0])
+		files = files[1:]
+	}
+	return nil
+}
+
+func (s *diskProfileStore) list() []ProfileInfo {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	infos := []ProfileInfo{}
+	files, _ := ioutil.ReadDir(s.directory)
+
+	for _, file := range files {
+		name := strings.TrimSuffix(file.Name(), profileFileSuffix)
+		i := strings.LastIndex(name, "-")
+		if file.IsDir() || i < 0 || name == file.Name() {
+			continue
+		}
+
+		t, err := time.Parse(profileTimeLayout, name[i+1:])
+		if err != nil {
+			continue
+		}
+		infos = append(infos, ProfileInfo{Kind: name[:i], Timestamp: name[i+1:], Time: t, Size: int(file.Size())})
+	}
+	sortProfiles(infos)
+	return infos
+}
+
+func (s *diskProfileStore) get(kind, timestamp string) ([]byte, error) {
+	// Only accept valid names, so the parameters can't be used to read other files.
+	if _, err := time.Parse(profileTimeLayout, timestamp); err != nil || strings.ContainsAny(kind, `/\.`) {
+		return nil, ErrProfileNotFound
+	}
+
+	data, err := ioutil.ReadFile(s.path(kind, timestamp))
+	if os.IsNotExist(err) {
+		return nil, ErrProfileNotFound
+	}
+	return data, err
+}
+
+func (s *diskProfileStore) path(kind, timestamp string) string {
+	return filepath.Join(s.directory, kind+"-"+timestamp+profileFileSuffix)
+}
+
+func sortProfiles(infos []ProfileInfo) {
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].Kind != infos[j].Kind {
+			return infos[i].Kind < infos[j].Kind
+		}
+		return infos[i].Time.Before(infos[j].Time)
+	})
+}
@@ -0,0 +1,136 @@
+package servicefoundation_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	sf "github.com/Prutswonder/go-servicefoundation"
+	"github.com/julienschmidt/httprouter"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func newTestProfiler(options sf.ProfilerOptions) (sf.Profiler, *mockMetrics) {
+	log := &mockLogger{}
+	m := &mockMetrics{}
+	log.On("Warn", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	m.On("Count", "profiling", mock.Anything, mock.Anything)
+
+	return sf.NewProfiler(options, log, m), m
+}
+
+func TestProfiler_Retention(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "profiles")
+	defer os.RemoveAll(dir)
+
+	for _, directory := range []string{"", dir} {
+		sut, _ := newTestProfiler(sf.ProfilerOptions{
+			Kinds:     []string{sf.ProfileHeap, sf.ProfileGoroutine},
+			Retention: 2,
+			Directory: directory,
+		})
+
+		// Act
+		for i := 0; i < 3; i++ {
+			assert.True(t, sut.Capture(context.Background()))
+		}
+
+		profiles := sut.Profiles()
+
+		assert.Len(t, profiles, 4, directory)
+		assert.Equal(t, sf.ProfileGoroutine, profiles[0].Kind)
+		assert.Equal(t, sf.ProfileHeap, profiles[3].Kind)
+		assert.True(t, profiles[2].Time.Before(profiles[3].Time))
+	}
+}
+
+func TestProfiler_SkipWhenBusy(t *testing.T) {
+	sut, m := newTestProfiler(sf.ProfilerOptions{Kinds: []string{sf.ProfileCPU}, CPUDuration: 100 * time.Millisecond})
+	results := make([]bool, 2)
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+
+	// Act
+	go func() {
+		defer wg.Done()
+		results[0] = sut.Capture(context.Background())
+	}()
+	time.Sleep(20 * time.Millisecond)
+	results[1] = sut.Capture(context.Background())
+	wg.Wait()
+
+	assert.Equal(t, []bool{true, false}, results)
+	assert.Len(t, sut.Profiles(), 1)
+	m.AssertCalled(t, "Count", "profiling", "captures_skipped_total", mock.Anything)
+}
+
+func TestProfiler_Endpoints(t *testing.T) {
+	sut, _ := newTestProfiler(sf.ProfilerOptions{Kinds: []string{sf.ProfileHeap}})
+	sut.Capture(context.Background())
+	profile := sut.Profiles()[0]
+	list := sf.NewProfilesHandler(sut)
+	download := sf.NewProfileDownloadHandler(sut)
+
+	// Act
+	w := httptest.NewRecorder()
+	list(sf.NewWrappedResponseWriter(w), nil, sf.RouterParams{})
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), profile.Timestamp)
+
+	for _, test := range []struct {
+		kind      string
+		timestamp string
+		status    int
+	}{
+		{sf.ProfileHeap, profile.Timestamp, http.StatusOK},
+		{sf.ProfileCPU, profile.Timestamp, http.StatusNotFound},
+		{sf.ProfileHeap, "20170101T000000.000000000Z", http.StatusNotFound},
+	} {
+		w = httptest.NewRecorder()
+		p := sf.RouterParams{Params: httprouter.Params{
+			{Key: "kind", Value: test.kind},
+			{Key: "timestamp", Value: test.timestamp},
+		}}
+
+		download(sf.NewWrappedResponseWriter(w), nil, p)
+
+		assert.Equal(t, test.status, w.Code, test.kind)
+		if test.status == http.StatusOK {
+			assert.Equal(t, profile.Size, w.Body.Len())
+		}
+	}
+}
+
+func TestProfiler_UploadDropsWhenBusy(t *testing.T) {
+	release := make(chan struct{})
+	uploads := make(chan string, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uploads <- r.URL.Query().Get("kind")
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sut, m := newTestProfiler(sf.ProfilerOptions{
+		Kinds:     []string{sf.ProfileHeap},
+		Interval:  time.Hour,
+		UploadURL: server.URL,
+	})
+	sut.Start(ctx)
+
+	// Act
+	sut.Capture(ctx)
+	<-uploads
+	sut.Capture(ctx)
+	sut.Capture(ctx)
+
+	m.AssertCalled(t, "Count", "profiling", "uploads_dropped_total", mock.Anything)
+}
@@ -0,0 +1,440 @@
+package servicefoundation
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Prutswonder/go-servicefoundation/events"
+)
+
+// The windows of quotas, which start at the beginning of the minute, hour, day or month in UTC.
+const (
+	QuotaWindowMinute QuotaWindow = "minute"
+	QuotaWindowHour   QuotaWindow = "hour"
+	QuotaWindowDay    QuotaWindow = "day"
+	QuotaWindowMonth  QuotaWindow = "month"
+
+	// RateLimitLimitHeader is the name of the response header with the limit of the most exhausted quota window.
+	RateLimitLimitHeader = "X-RateLimit-Limit"
+	// RateLimitRemainingHeader is the name of the response header with the remaining requests in that window.
+	RateLimitRemainingHeader = "X-RateLimit-Remaining"
+	// RateLimitResetHeader is the name of the response header with the Unix time at which that window resets.
+	RateLimitResetHeader = "X-RateLimit-Reset"
+
+	// TenantHeader is the name of the request header from which the tenant is read by default.
+	TenantHeader = "X-Tenant-Id"
+
+	quotaSubsystem          = "quota"
+	quotaStorePruneInterval = time.Minute
+)
+
+// ErrQuotaNotFound is returned when a tenant has no quota for the given window.
+var ErrQuotaNotFound = errors.New("quota not found")
+
+type (
+	// QuotaWindow is the period in which the requests of a tenant are counted.
+	QuotaWindow string
+
+	// Quota is the maximum number of requests of a tenant per window.
+	Quota struct {
+		Window QuotaWindow
+		Limit  int64
+	}
+
+	// TenantExtractor resolves the tenant, or API key, of a request. An empty tenant isn't subject to quotas.
+	TenantExtractor func(r *http.Request) string
+
+	// QuotaOptions contains the settings of a QuotaManager. Quotas contains the quotas per tenant; tenants without
+	// quotas of their own get the DefaultQuotas. Counters are kept in the Store, which is shared between replicas to
+	// enforce quotas consistently.
+	QuotaOptions struct {
+		Quotas        map[string][]Quota
+		DefaultQuotas []Quota
+		Store         QuotaStore
+		Extractor     TenantExtractor
+		Clock         Clock
+	}
+
+	// QuotaCounter identifies the counter of a tenant in a single window, which expires after the window.
+	QuotaCounter struct {
+		Key     string
+		Limit   int64
+		Expires time.Time
+	}
+
+	// QuotaStore keeps the counters of quota windows.
+	QuotaStore interface {
+		// Consume atomically increments all counters, unless that would exceed the limit of any of them. It returns
+		// the counts after incrementing, or the current counts when the request is rejected.
+		Consume(counters []QuotaCounter) ([]int64, bool, error)
+		Get(keys []string) ([]int64, error)
+		// Adjust adds delta to the counter, which doesn't drop below zero, and returns the new count.
+		Adjust(counter QuotaCounter, delta int64) (int64, error)
+	}
+
+	// QuotaUsage contains the usage of a tenant in the current window of a quota.
+	QuotaUsage struct {
+		Window    QuotaWindow `json:"window"`
+		Limit     int64       `json:"limit"`
+		Used      int64       `json:"used"`
+		Remaining int64       `json:"remaining"`
+		Reset     time.Time   `json:"reset"`
+	}
+
+	// QuotaAdjustment is the request body for adjusting the usage of a tenant in the current window of a quota.
+	QuotaAdjustment struct {
+		Window QuotaWindow `json:"window"`
+		Delta  int64       `json:"delta"`
+	}
+
+	// QuotaManager enforces the request quotas of tenants.
+	QuotaManager interface {
+		Middleware() MiddlewareFunc
+		Usage(tenant string) ([]QuotaUsage, error)
+		Adjust(tenant string, window QuotaWindow, delta int64) (QuotaUsage, error)
+	}
+
+	quotaManagerImpl struct {
+		options QuotaOptions
+		log     Logger
+		metrics Metrics
+	}
+
+	memoryQuotaStoreImpl struct {
+		clock    Clock
+		mutex    sync.Mutex
+		counters map[string]*memoryQuotaCounter
+		prunedAt time.Time
+	}
+
+	memoryQuotaCounter struct {
+		count   int64
+		expires time.Time
+	}
+)
+
+// NewQuotaManager creates and returns a new QuotaManager implementation. Without a store, counters are kept in
+// memory, which only suits a single replica.
+func NewQuotaManager(options QuotaOptions, log Logger, metrics Metrics) QuotaManager {
+	if options.Clock == nil {
+		options.Clock = NewSystemClock()
+	}
+	if options.Store == nil {
+		options.Store = NewMemoryQuotaStore(options.Clock)
+	}
+	if options.Extractor == nil {
+		options.Extractor = TenantFromHeader(TenantHeader)
+	}
+
+	return &quotaManagerImpl{
+		options: options,
+		log:     log,
+		metrics: metrics,
+	}
+}
+
+// NewMemoryQuotaStore returns a QuotaStore that keeps the counters in memory. Counters are removed once the clock
+// passed their expiry.
+func NewMemoryQuotaStore(clock Clock) QuotaStore {
+	if clock == nil {
+		clock = NewSystemClock()
+	}
+	return &memoryQuotaStoreImpl{clock: clock, counters: make(map[string]*memoryQuotaCounter)}
+}
+
+// TenantFromHeader returns a TenantExtractor that reads the tenant from the request header.
+func TenantFromHeader(header string) TenantExtractor {
+	return func(r *http.Request) string {
+		return r.Header.Get(header)
+	}
+}
+
+// TenantFromClaim returns a TenantExtractor that reads the tenant from a string claim of the validated JWT.
+func TenantFromClaim(claim string) TenantExtractor {
+	return func(r *http.Request) string {
+		tenant, _ := JWTClaimsFromContext(r.Context())[claim].(string)
+		return tenant
+	}
+}
+
+// NewQuotaUsageHandler returns a handler that responds with the usage of the tenant in the route.
+func NewQuotaUsageHandler(manager QuotaManager) Handle {
+	return func(w WrappedResponseWriter, _ *http.Request, p RouterParams) {
+		usage, err := manager.Usage(p.Params.ByName("tenant"))
+
+		switch err {
+		case nil:
+			w.JSON(http.StatusOK, usage)
+		case ErrQuotaNotFound:
+			w.JSON(http.StatusNotFound, err.Error())
+		default:
+			w.JSON(http.StatusInternalServerError, err.Error())
+		}
+	}
+}
+
+// NewQuotaAdjustHandler returns a handler that adjusts the usage of the tenant in the route by the QuotaAdjustment
+// in the request body, like for crediting requests that failed on our side.
+func NewQuotaAdjustHandler(manager QuotaManager) Handle {
+	return func(w WrappedResponseWriter, r *http.Request, p RouterParams) {
+		var adjustment QuotaAdjustment
+		if err := json.NewDecoder(r.Body).Decode(&adjustment); err != nil {
+			w.JSON(http.StatusBadRequest, err.Error())
+			return
+		}
+
+		usage, err := manager.Adjust(p.Params.ByName("tenant"), adjustment.Window, adjustment.Delta)
+
+		switch err {
+		case nil:
+			w.JSON(http.StatusOK, usage)
+		case ErrQuotaNotFound:
+			w.JSON(http.StatusNotFound, err.Error())
+		default:
+			w.JSON(http.StatusInternalServerError, err.Error())
+		}
+	}
+}
+
+/* QuotaManager implementation */
+
+// Middleware returns a MiddlewareFunc that counts the request against the quotas of its tenant. The rate limit
+// headers describe the window with the fewest remaining requests. Requests over quota are rejected with 429. When the
+// store fails, requests are let through.
+func (m *quotaManagerImpl) Middleware() MiddlewareFunc {
+	return func(next Handle) Handle {
+		return func(w WrappedResponseWriter, r *http.Request, p RouterParams) {
+			tenant := m.options.Extractor(r)
+			quotas := m.quotas(tenant)
+			if tenant == "" || len(quotas) == 0 {
+				next(w, r, p)
+				return
+			}
+
+			now := m.options.Clock.Now()
+			counters := make([]QuotaCounter, len(quotas))
+			for i, quota := range quotas {
+				counters[i] = quotaCounter(tenant, quota, now)
+			}
+
+			counts, allowed, err := m.options.Store.Consume(counters)
+			if err != nil {
+				m.log.Warn(events.QuotaStore, "Failed consuming quota of %s: %v", tenant, err)
+				next(w, r, p)
+				return
+			}
+
+			usage := make([]QuotaUsage, len(quotas))
+			for i, quota := range quotas {
+				usage[i] = quotaUsage(quota, counts[i], counters[i].Expires)
+			}
+
+			exhausted := mostExhausted(usage, allowed)
+			setRateLimitHeaders(w, exhausted)
+
+			if !allowed {
+				m.metrics.CountLabels(quotaSubsystem, "rejected_total", "Total requests rejected for exceeding a quota.",
+					[]string{"window"}, []string{string(exhausted.Window)})
+				w.Header().Set(RetryAfterHeader, strconv.FormatInt(retryAfterSeconds(exhausted.Reset, now), 10))
+				WriteProblem(w, http.StatusTooManyRequests, fmt.Sprintf("Quota of %d requests per %s exhausted",
+					exhausted.Limit, exhausted.Window))
+				return
+			}
+
+			next(w, r, p)
+		}
+	}
+}
+
+func (m *quotaManagerImpl) Usage(tenant string) ([]QuotaUsage, error) {
+	quotas := m.quotas(tenant)
+	if len(quotas) == 0 {
+		return nil, ErrQuotaNotFound
+	}
+
+	now := m.options.Clock.Now()
+	keys := make([]string, len(quotas))
+	counters := make([]QuotaCounter, len(quotas))
+	for i, quota := range quotas {
+		counters[i] = quotaCounter(tenant, quota, now)
+		keys[i] = counters[i].Key
+	}
+
+	counts, err := m.options.Store.Get(keys)
+	if err != nil {
+		return nil, err
+	}
+
+	usage := make([]QuotaUsage, len(quotas))
+	for i, quota := range quotas {
+		usage[i] = quotaUsage(quota, counts[i], counters[i].Expires)
+	}
+	return usage, nil
+}
+
+func (m *quotaManagerImpl) Adjust(tenant string, window QuotaWindow, delta int64) (QuotaUsage, error) {
+	for _, quota := range m.quotas(tenant) {
+		if quota.Window != window {
+			continue
+		}
+
+		counter := quotaCounter(tenant, quota, m.options.Clock.Now())
+		count, err := m.options.Store.Adjust(counter, delta)
+		if err != nil {
+			return QuotaUsage{}, err
+		}
+
+		m.log.Info(events.QuotaAdjusted, "Adjusted %s quota of %s by %d to %d", window, tenant, delta, count)
+		return quotaUsage(quota, count, counter.Expires), nil
+	}
+	return QuotaUsage{}, ErrQuotaNotFound
+}
+
+func (m *quotaManagerImpl) quotas(tenant string) []Quota {
+	if quotas, ok := m.options.Quotas[tenant]; ok {
+		return quotas
+	}
+	return m.options.DefaultQuotas
+}
+
+/* QuotaStore implementation */
+
+func (s *memoryQuotaStoreImpl) Consume(counters []QuotaCounter) ([]int64, bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := s.clock.Now()
+	counts := make([]int64, len(counters))
+	allowed := true
+	for i, counter := range counters {
+		counts[i] = s.count(counter.Key, now)
+		if counts[i]+1 > counter.Limit {
+			allowed = false
+		}
+	}
+	if !allowed {
+		return counts, false, nil
+	}
+
+	for i, counter := range counters {
+		counts[i]++
+		s.counters[counter.Key] = &memoryQuotaCounter{count: counts[i], expires: counter.Expires}
+	}
+	return counts, true, nil
+}
+
+func (s *memoryQuotaStoreImpl) Get(keys []string) ([]int64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := s.clock.Now()
+	counts := make([]int64, len(keys))
+	for i, key := range keys {
+		counts[i] = s.count(key, now)
+	}
+	return counts, nil
+}
+
+func (s *memoryQuotaStoreImpl) Adjust(counter QuotaCounter, delta int64) (int64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	count := s.count(counter.Key, s.clock.Now()) + delta
+	if count < 0 {
+		count = 0
+	}
+	s.counters[counter.Key] = &memoryQuotaCounter{count: count, expires: counter.Expires}
+	return count, nil
+}
+
+// count returns the count of the key. Expired counters belong to windows that ended, so they are never read again
+// and are pruned periodically.
+func (s *memoryQuotaStoreImpl) count(key string, now time.Time) int64 {
+	if now.Sub(s.prunedAt) >= quotaStorePruneInterval {
+		for k, counter := range s.counters {
+			if !now.Before(counter.expires) {
+				delete(s.counters, k)
+			}
+		}
+		s.prunedAt = now
+	}
+
+	if counter, ok := s.counters[key]; ok && now.Before(counter.expires) {
+		return counter.count
+	}
+	return 0
+}
+
+// quotaCounter returns the counter of the current window of the quota. Every window has a key of its own, so a
+// rollover never has to reset a counter.
+func quotaCounter(tenant string, quota Quota, now time.Time) QuotaCounter {
+	start, end := quotaWindowBounds(quota.Window, now)
+
+	return QuotaCounter{
+		Key:     fmt.Sprintf("quota:%s:%s:%d", tenant, quota.Window, start.Unix()),
+		Limit:   quota.Limit,
+		Expires: end,
+	}
+}
+
+func quotaWindowBounds(window QuotaWindow, now time.Time) (time.Time, time.Time) {
+	now = now.UTC()
+
+	switch window {
+	case QuotaWindowMinute:
+		start := now.Truncate(time.Minute)
+		return start, start.Add(time.Minute)
+	case QuotaWindowHour:
+		start := now.Truncate(time.Hour)
+		return start, start.Add(time.Hour)
+	case QuotaWindowMonth:
+		start := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+		return start, start.AddDate(0, 1, 0)
+	default:
+		start := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+		return start, start.AddDate(0, 0, 1)
+	}
+}
+
+func quotaUsage(quota Quota, used int64, reset time.Time) QuotaUsage {
+	remaining := quota.Limit - used
+	if remaining < 0 {
+		remaining = 0
+	}
+	return QuotaUsage{Window: quota.Window, Limit: quota.Limit, Used: used, Remaining: remaining, Reset: reset}
+}
+
+// mostExhausted returns the usage of the window that rejected the request, or otherwise the window with the fewest
+// remaining requests.
+func mostExhausted(usage []QuotaUsage, allowed bool) QuotaUsage {
+	exhausted := usage[0]
+	for _, u := range usage {
+		if !allowed && u.Remaining == 0 {
+			return u
+		}
+		if u.Remaining < exhausted.Remaining {
+			exhausted = u
+		}
+	}
+	return exhausted
+}
+
+func setRateLimitHeaders(w http.ResponseWriter, usage QuotaUsage) {
+	w.Header().Set(RateLimitLimitHeader, strconv.FormatInt(usage.Limit, 10))
+	w.Header().Set(RateLimitRemainingHeader, strconv.FormatInt(usage.Remaining, 10))
+	w.Header().Set(RateLimitResetHeader, strconv.FormatInt(usage.Reset.Unix(), 10))
+}
+
+func retryAfterSeconds(reset, now time.Time) int64 {
+	seconds := int64(math.Ceil(reset.Sub(now).Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	return seconds
+}
@@ -0,0 +1,202 @@
+package servicefoundation_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	sf "github.com/Prutswonder/go-servicefoundation"
+	"github.com/Prutswonder/go-servicefoundation/servicetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func newTestQuotaManager(clock sf.Clock, quotas ...sf.Quota) sf.QuotaManager {
+	m := &mockMetrics{}
+	m.On("CountLabels", "quota", "rejected_total", mock.Anything, []string{"window"}, mock.Anything)
+	log := &mockLogger{}
+	log.On("Info", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+
+	return sf.NewQuotaManager(sf.QuotaOptions{
+		Quotas: map[string][]sf.Quota{"acme": quotas},
+		Clock:  clock,
+	}, log, m)
+}
+
+func quotaRequest(manager sf.QuotaManager, tenant string) (*httptest.ResponseRecorder, bool) {
+	r, _ := http.NewRequest(http.MethodGet, "/search", nil)
+	r.Header.Set(sf.TenantHeader, tenant)
+	return servicetest.RunMiddleware(manager.Middleware(), r)
+}
+
+func TestQuotaManager_WindowBoundaries(t *testing.T) {
+	tests := []struct {
+		window sf.QuotaWindow
+		start  time.Time
+		next   time.Duration
+	}{
+		{sf.QuotaWindowMinute, time.Date(2017, 6, 15, 10, 0, 59, 0, time.UTC), time.Second},
+		{sf.QuotaWindowHour, time.Date(2017, 6, 15, 10, 59, 59, 0, time.UTC), time.Second},
+		{sf.QuotaWindowDay, time.Date(2017, 6, 15, 23, 59, 59, 0, time.UTC), time.Second},
+		{sf.QuotaWindowMonth, time.Date(2017, 2, 28, 23, 59, 59, 0, time.UTC), time.Second},
+	}
+
+	for _, test := range tests {
+		clock := servicetest.NewFakeClock(test.start)
+		sut := newTestQuotaManager(clock, sf.Quota{Window: test.window, Limit: 2})
+		quotaRequest(sut, "acme")
+		_, second := quotaRequest(sut, "acme")
+		w, third := quotaRequest(sut, "acme")
+
+		// Act
+		clock.Advance(test.next)
+		_, next := quotaRequest(sut, "acme")
+
+		assert.True(t, second, string(test.window))
+		assert.False(t, third, string(test.window))
+		assert.Equal(t, http.StatusTooManyRequests, w.Code, string(test.window))
+		assert.Equal(t, "1", w.Header().Get(sf.RetryAfterHeader), string(test.window))
+		assert.True(t, next, "new %s window", test.window)
+	}
+}
+
+func TestQuotaManager_Headers(t *testing.T) {
+	start := time.Date(2017, 6, 15, 10, 0, 30, 0, time.UTC)
+	minuteEnd := strconv.FormatInt(start.Truncate(time.Minute).Add(time.Minute).Unix(), 10)
+	sut := newTestQuotaManager(servicetest.NewFakeClock(start),
+		sf.Quota{Window: sf.QuotaWindowDay, Limit: 3},
+		sf.Quota{Window: sf.QuotaWindowMinute, Limit: 2})
+
+	tests := []struct {
+		status    int
+		limit     string
+		remaining string
+		reset     string
+	}{
+		{http.StatusOK, "2", "1", minuteEnd},
+		{http.StatusOK, "2", "0", minuteEnd},
+		{http.StatusTooManyRequests, "2", "0", minuteEnd},
+	}
+
+	for i, test := range tests {
+		// Act
+		w, _ := quotaRequest(sut, "acme")
+
+		assert.Equal(t, test.status, w.Code, "request %d", i)
+		assert.Equal(t, test.limit, w.Header().Get(sf.RateLimitLimitHeader), "request %d", i)
+		assert.Equal(t, test.remaining, w.Header().Get(sf.RateLimitRemainingHeader), "request %d", i)
+		assert.Equal(t, test.reset, w.Header().Get(sf.RateLimitResetHeader), "request %d", i)
+	}
+
+	w, _ := quotaRequest(sut, "acme")
+	var problem sf.Problem
+	json.Unmarshal(w.Body.Bytes(), &problem)
+	assert.Equal(t, "Quota of 2 requests per minute exhausted", problem.Detail)
+	assert.Equal(t, "30", w.Header().Get(sf.RetryAfterHeader))
+
+	usage, _ := sut.Usage("acme")
+	assert.Equal(t, int64(2), usage[0].Used, "rejected requests aren't counted")
+}
+
+func TestQuotaManager_TenantsWithoutQuota(t *testing.T) {
+	sut := newTestQuotaManager(servicetest.NewFakeClock(time.Now()), sf.Quota{Window: sf.QuotaWindowDay, Limit: 1})
+
+	for _, tenant := range []string{"", "other", "other"} {
+		// Act
+		w, called := quotaRequest(sut, tenant)
+
+		assert.True(t, called)
+		assert.Empty(t, w.Header().Get(sf.RateLimitLimitHeader))
+	}
+}
+
+// TestRedisQuotaStore verifies the commands sent to Redis and the parsing of the results, using a fake RedisEvaler.
+// The Lua scripts themselves are not run here, so their behavior against Redis is not covered by the tests yet.
+func TestRedisQuotaStore(t *testing.T) {
+	expires := time.Date(2017, 6, 16, 0, 0, 0, 0, time.UTC)
+	var scripts []string
+	var keys [][]string
+	var args [][]interface{}
+	results := []interface{}{
+		[]interface{}{int64(1), int64(5), int64(1)},
+		[]interface{}{"5", nil},
+		int64(0),
+	}
+	sut := sf.NewRedisQuotaStore(sf.RedisEvalFunc(func(script string, k []string, a ...interface{}) (interface{}, error) {
+		scripts = append(scripts, script)
+		keys = append(keys, k)
+		args = append(args, a)
+		result := results[0]
+		results = results[1:]
+		return result, nil
+	}))
+	counters := []sf.QuotaCounter{
+		{Key: "quota:acme:day:1", Limit: 10, Expires: expires},
+		{Key: "quota:acme:minute:1", Limit: 2, Expires: expires},
+	}
+
+	// Act
+	counts, allowed, err := sut.Consume(counters)
+	current, getErr := sut.Get([]string{"quota:acme:day:1", "quota:acme:minute:1"})
+	adjusted, adjustErr := sut.Adjust(counters[0], -10)
+
+	assert.NoError(t, err)
+	assert.True(t, allowed)
+	assert.Equal(t, []int64{5, 1}, counts)
+	// The limits and expiries of all counters are passed to a single script, which Redis runs atomically.
+	assert.Contains(t, scripts[0], "INCR")
+	assert.Equal(t, []string{"quota:acme:day:1", "quota:acme:minute:1"}, keys[0])
+	assert.Equal(t, []interface{}{int64(10), expires.Unix() * 1000, int64(2), expires.Unix() * 1000}, args[0])
+
+	assert.NoError(t, getErr)
+	assert.Equal(t, []int64{5, 0}, current)
+
+	assert.NoError(t, adjustErr)
+	assert.Equal(t, int64(0), adjusted)
+	assert.Equal(t, []interface{}{int64(-10), expires.Unix() * 1000}, args[2])
+}
+
+func TestServiceImpl_QuotaEndpoints(t *testing.T) {
+	opt := sf.NewServiceOptions("quotas", []string{http.MethodGet}, nil)
+	opt.Quotas = newTestQuotaManager(servicetest.NewFakeClock(time.Date(2017, 6, 15, 10, 0, 0, 0, time.UTC)),
+		sf.Quota{Window: sf.QuotaWindowDay, Limit: 100})
+	sut := sf.NewCustomService(opt)
+	sut.AddRoute("search", []string{"/search"}, sf.MethodsForGet, sf.DefaultMiddlewares,
+		func(w sf.WrappedResponseWriter, _ *http.Request, _ sf.RouterParams) {
+			w.JSON(http.StatusOK, "ok")
+		})
+	for i := 0; i < 3; i++ {
+		r := httptest.NewRequest(http.MethodGet, "/search", nil)
+		r.Header.Set(sf.TenantHeader, "acme")
+		sut.Handler("public").ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	tests := []struct {
+		method   string
+		path     string
+		body     string
+		status   int
+		expected string
+	}{
+		{http.MethodGet, "/service/quotas/acme", "", http.StatusOK, `"used":3`},
+		{http.MethodPost, "/service/quotas/acme", `{"window":"day","delta":-2}`, http.StatusOK, `"used":1`},
+		{http.MethodGet, "/service/quotas/acme", "", http.StatusOK, `"remaining":99`},
+		{http.MethodPost, "/service/quotas/acme", `{"window":"minute","delta":-2}`, http.StatusNotFound, "quota not found"},
+		{http.MethodPost, "/service/quotas/acme", `{"window":`, http.StatusBadRequest, ""},
+		{http.MethodGet, "/service/quotas/other", "", http.StatusNotFound, "quota not found"},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+
+		// Act
+		sut.Handler("internal").ServeHTTP(w, httptest.NewRequest(test.method, test.path, strings.NewReader(test.body)))
+
+		assert.Equal(t, test.status, w.Code, test.body)
+		assert.Contains(t, w.Body.String(), test.expected, test.body)
+	}
+}
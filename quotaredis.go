@@ -0,0 +1,150 @@
+package servicefoundation
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// consumeQuotaScript increments all counters in KEYS, unless that exceeds the limit of any of them. ARGV contains the
+// limit and the expiry in Unix milliseconds per key. It returns 1 or 0 for allowed, followed by the counts.
+const consumeQuotaScript = `
+local counts = {}
+local allowed = 1
+for i, key in ipairs(KEYS) do
+	counts[i] = tonumber(redis.call('GET', key) or '0')
+	if counts[i] + 1 > tonumber(ARGV[i * 2 - 1]) then
+		allowed = 0
+	end
+end
+if allowed == 1 then
+	for i, key in ipairs(KEYS) do
+		counts[i] = redis.call('INCR', key)
+		redis.call('PEXPIREAT', key, ARGV[i * 2])
+	end
+end
+table.insert(counts, 1, allowed)
+return counts
+`
+
+// adjustQuotaScript adds ARGV[1] to the counter in KEYS[1] without dropping below zero and sets its expiry to the
+// Unix milliseconds in ARGV[2].
+const adjustQuotaScript = `
+local count = tonumber(redis.call('GET', KEYS[1]) or '0') + tonumber(ARGV[1])
+if count < 0 then
+	count = 0
+end
+redis.call('SET', KEYS[1], count)
+redis.call('PEXPIREAT', KEYS[1], ARGV[2])
+return count
+`
+
+type (
+	// RedisEvaler runs Lua scripts on Redis. Scripts are atomic, which makes the quota counters consistent between
+	// replicas.
+	RedisEvaler interface {
+		Eval(script string, keys []string, args ...interface{}) (interface{}, error)
+	}
+
+	// RedisEvalFunc is an adapter to use a function as RedisEvaler, like for wrapping the Eval of a Redis client.
+	RedisEvalFunc func(script string, keys []string, args ...interface{}) (interface{}, error)
+
+	redisQuotaStoreImpl struct {
+		redis RedisEvaler
+	}
+)
+
+// NewRedisQuotaStore returns a QuotaStore that keeps the counters in Redis, so they are shared between replicas.
+func NewRedisQuotaStore(redis RedisEvaler) QuotaStore {
+	return &redisQuotaStoreImpl{redis: redis}
+}
+
+/* RedisEvaler implementation */
+
+// Eval calls f(script, keys, args...).
+func (f RedisEvalFunc) Eval(script string, keys []string, args ...interface{}) (interface{}, error) {
+	return f(script, keys, args...)
+}
+
+/* QuotaStore implementation */
+
+func (s *redisQuotaStoreImpl) Consume(counters []QuotaCounter) ([]int64, bool, error) {
+	keys := make([]string, len(counters))
+	args := make([]interface{}, 0, 2*len(counters))
+	for i, counter := range counters {
+		keys[i] = counter.Key
+		args = append(args, counter.Limit, unixMilliseconds(counter))
+	}
+
+	result, err := s.redis.Eval(consumeQuotaScript, keys, args...)
+	if err != nil {
+		return nil, false, err
+	}
+
+	values, err := redisIntegers(result, len(counters)+1)
+	if err != nil {
+		return nil, false, err
+	}
+	return values[1:], values[0] == 1, nil
+}
+
+func (s *redisQuotaStoreImpl) Get(keys []string) ([]int64, error) {
+	result, err := s.redis.Eval("return redis.call('MGET', unpack(KEYS))", keys)
+	if err != nil {
+		return nil, err
+	}
+
+	values, ok := result.([]interface{})
+	if !ok || len(values) != len(keys) {
+		return nil, fmt.Errorf("Unexpected Redis result %v", result)
+	}
+
+	counts := make([]int64, len(keys))
+	for i, value := range values {
+		switch v := value.(type) {
+		case nil:
+		case string:
+			count, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			counts[i] = count
+		default:
+			return nil, fmt.Errorf("Unexpected Redis value %v", value)
+		}
+	}
+	return counts, nil
+}
+
+func (s *redisQuotaStoreImpl) Adjust(counter QuotaCounter, delta int64) (int64, error) {
+	result, err := s.redis.Eval(adjustQuotaScript, []string{counter.Key}, delta, unixMilliseconds(counter))
+	if err != nil {
+		return 0, err
+	}
+
+	values, err := redisIntegers([]interface{}{result}, 1)
+	if err != nil {
+		return 0, err
+	}
+	return values[0], nil
+}
+
+func unixMilliseconds(counter QuotaCounter) int64 {
+	return counter.Expires.UnixNano() / 1e6
+}
+
+func redisIntegers(result interface{}, length int) ([]int64, error) {
+	values, ok := result.([]interface{})
+	if !ok || len(values) != length {
+		return nil, fmt.Errorf("Unexpected Redis result %v", result)
+	}
+
+	integers := make([]int64, length)
+	for i, value := range values {
+		integer, ok := value.(int64)
+		if !ok {
+			return nil, fmt.Errorf("Unexpected Redis value %v", value)
+		}
+		integers[i] = integer
+	}
+	return integers, nil
+}
@@ -0,0 +1,178 @@
+package servicefoundation
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// The largest literal emitted in a snappy block, which matches the block size of the reference encoder.
+const snappyMaxLiteral = 1 << 16
+
+type (
+	// promSample is a sample of a metric family, with the metric name as the __name__ label.
+	promSample struct {
+		labels []promLabel
+		value  float64
+	}
+
+	promLabel struct {
+		name  string
+		value string
+	}
+)
+
+// encodeRemoteWrite encodes the samples of the metric families as a snappy compressed Prometheus remote-write
+// WriteRequest. The extra labels are added to every series, replacing labels with the same name.
+func encodeRemoteWrite(families []*dto.MetricFamily, extra []promLabel, timestamp time.Time) []byte {
+	var request bytes.Buffer
+	for _, family := range families {
+		for _, s := range familySamples(family) {
+			var series bytes.Buffer
+			for _, l := range withLabels(s.labels, extra) {
+				var encoded bytes.Buffer
+				protoString(&encoded, 1, l.name)
+				protoString(&encoded, 2, l.value)
+				protoBytes(&series, 1, encoded.Bytes())
+			}
+
+			var encoded bytes.Buffer
+			protoKey(&encoded, 1, 1)
+			binary.Write(&encoded, binary.LittleEndian, math.Float64bits(s.value))
+			protoKey(&encoded, 2, 0)
+			protoVarint(&encoded, uint64(timestamp.UnixNano()/int64(time.Millisecond)))
+			protoBytes(&series, 2, encoded.Bytes())
+
+			protoBytes(&request, 1, series.Bytes())
+		}
+	}
+	return snappyEncode(request.Bytes())
+}
+
+// familySamples returns the samples of the metric family as they appear in the text exposition format. Summaries and
+// histograms are split in the quantile or bucket series and the _sum and _count series.
+func familySamples(family *dto.MetricFamily) []promSample {
+	var samples []promSample
+
+	name := family.GetName()
+	for _, m := range family.GetMetric() {
+		labels := []promLabel{{name: "__name__", value: name}}
+		for _, l := range m.GetLabel() {
+			labels = append(labels, promLabel{name: l.GetName(), value: l.GetValue()})
+		}
+		sample := func(suffix string, value float64, extra ...promLabel) {
+			s := promSample{labels: append(append([]promLabel(nil), labels...), extra...), value: value}
+			s.labels[0].value = name + suffix
+			samples = append(samples, s)
+		}
+
+		switch family.GetType() {
+		case dto.MetricType_COUNTER:
+			sample("", m.GetCounter().GetValue())
+		case dto.MetricType_GAUGE:
+			sample("", m.GetGauge().GetValue())
+		case dto.MetricType_SUMMARY:
+			for _, q := range m.GetSummary().GetQuantile() {
+				sample("", q.GetValue(), promLabel{name: "quantile", value: formatFloat(q.GetQuantile())})
+			}
+			sample("_sum", m.GetSummary().GetSampleSum())
+			sample("_count", float64(m.GetSummary().GetSampleCount()))
+		case dto.MetricType_HISTOGRAM:
+			infinite := false
+			for _, b := range m.GetHistogram().GetBucket() {
+				infinite = math.IsInf(b.GetUpperBound(), 1)
+				sample("_bucket", float64(b.GetCumulativeCount()),
+					promLabel{name: "le", value: formatFloat(b.GetUpperBound())})
+			}
+			if !infinite {
+				sample("_bucket", float64(m.GetHistogram().GetSampleCount()), promLabel{name: "le", value: "+Inf"})
+			}
+			sample("_sum", m.GetHistogram().GetSampleSum())
+			sample("_count", float64(m.GetHistogram().GetSampleCount()))
+		default:
+			sample("", m.GetUntyped().GetValue())
+		}
+	}
+	return samples
+}
+
+// formatFloat formats the quantile or bucket bound like the text exposition format.
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// withLabels returns the labels with the extra labels, sorted by name as required by remote-write.
+func withLabels(labels, extra []promLabel) []promLabel {
+	merged := make([]promLabel, 0, len(labels)+len(extra))
+	for _, l := range labels {
+		replaced := false
+		for _, e := range extra {
+			replaced = replaced || e.name == l.name
+		}
+		if !replaced {
+			merged = append(merged, l)
+		}
+	}
+	merged = append(merged, extra...)
+
+	sort.Slice(merged, func(i, j int) bool { return merged[i].name < merged[j].name })
+	return merged
+}
+
+func protoKey(b *bytes.Buffer, field, wireType int) {
+	protoVarint(b, uint64(field<<3|wireType))
+}
+
+func protoVarint(b *bytes.Buffer, v uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	b.Write(buf[:binary.PutUvarint(buf[:], v)])
+}
+
+func protoBytes(b *bytes.Buffer, field int, value []byte) {
+	protoKey(b, field, 2)
+	protoVarint(b, uint64(len(value)))
+	b.Write(value)
+}
+
+func protoString(b *bytes.Buffer, field int, value string) {
+	protoBytes(b, field, []byte(value))
+}
+
+// snappyEncode encodes the data in the snappy block format, as literals only. This skips the compression, which
+// keeps the push free of dependencies, while every snappy decoder accepts the result.
+func snappyEncode(data []byte) []byte {
+	var b bytes.Buffer
+	protoVarint(&b, uint64(len(data)))
+
+	for len(data) > 0 {
+		n := len(data)
+		if n > snappyMaxLiteral {
+			n = snappyMaxLiteral
+		}
+
+		switch {
+		case n <= 60:
+			b.WriteByte(byte(n-1) << 2)
+		case n <= 1<<8:
+			b.WriteByte(60 << 2)
+			b.WriteByte(byte(n - 1))
+		default:
+			b.WriteByte(61 << 2)
+			binary.Write(&b, binary.LittleEndian, uint16(n-1))
+		}
+		b.Write(data[:n])
+		data = data[n:]
+	}
+	return b.Bytes()
+}
@@ -0,0 +1,167 @@
+package servicefoundation
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const (
+	// RequestIDHeader is the default header that carries the ID of a request.
+	RequestIDHeader = "X-Request-ID"
+
+	maxRequestIDLength = 128
+)
+
+type (
+	// requestID is the ID of a request with the header it was read from, which is also used to propagate it.
+	requestID struct {
+		header string
+		value  string
+	}
+
+	requestIDTransport struct {
+		base http.RoundTripper
+	}
+
+	// requestLogger adds the request ID to every message of a Logger that isn't a StructuredLogger.
+	requestLogger struct {
+		Logger
+		id string
+	}
+
+	requestIDContextKey struct{}
+)
+
+// NewRequestIDMiddleware returns a MiddlewareFunc that reads the ID of the request from the header, which defaults to
+// X-Request-ID, and generates a UUID when it is absent or invalid. The ID is set on the response header and on the
+// request context, where it is available through RequestIDFromContext, added to the request logging and propagated by
+// the clients of the ClientFactory.
+func NewRequestIDMiddleware(header string) MiddlewareFunc {
+	if header == "" {
+		header = RequestIDHeader
+	}
+	header = http.CanonicalHeaderKey(header)
+
+	return func(next Handle) Handle {
+		return func(w WrappedResponseWriter, r *http.Request, p RouterParams) {
+			id := r.Header.Get(header)
+			if !validRequestID(id) {
+				id = newUUID()
+			}
+			w.Header().Set(header, id)
+
+			ctx := context.WithValue(r.Context(), requestIDContextKey{}, &requestID{header: header, value: id})
+			next(w, r.WithContext(ctx), p)
+		}
+	}
+}
+
+// NewRequestIDTransport returns a RoundTripper that sends the request ID of the request's context in the header it was
+// received in, unless the request already has one.
+func NewRequestIDTransport(base http.RoundTripper) http.RoundTripper {
+	return &requestIDTransport{base: base}
+}
+
+// RequestIDFromContext returns the request ID of the context, which is empty when the context has none.
+func RequestIDFromContext(ctx context.Context) string {
+	if id := requestIDOf(ctx); id != nil {
+		return id.value
+	}
+	return ""
+}
+
+// WithRequestID returns a copy of the context with the request ID, for work that isn't started by a request, like
+// background tasks. The ID is propagated in the X-Request-ID header.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDContextKey{}, &requestID{header: RequestIDHeader, value: id})
+}
+
+// NewRequestLogger returns a Logger that adds the request ID of the context to every entry, so handlers can log with
+// the ID without passing it along. A StructuredLogger gets the ID as the request_id field, other loggers get it appended
+// to their messages. It returns the logger itself when the context has no request ID.
+func NewRequestLogger(ctx context.Context, log Logger) Logger {
+	id := RequestIDFromContext(ctx)
+	if id == "" {
+		return log
+	}
+	if structured, ok := log.(StructuredLogger); ok {
+		return structured.WithFields(map[string]interface{}{"request_id": id})
+	}
+	return &requestLogger{Logger: log, id: id}
+}
+
+func requestIDOf(ctx context.Context) *requestID {
+	id, _ := ctx.Value(requestIDContextKey{}).(*requestID)
+	return id
+}
+
+// validRequestID only accepts IDs of printable ASCII without spaces, so an inbound ID can't inject into the logs.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// newUUID returns a random UUID of version 4.
+func newUUID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+/* Logger implementation */
+
+func (l *requestLogger) Debug(event, formatOrMsg string, a ...interface{}) error {
+	formatOrMsg, a = l.withID(formatOrMsg, a)
+	return l.Logger.Debug(event, formatOrMsg, a...)
+}
+
+func (l *requestLogger) Info(event, formatOrMsg string, a ...interface{}) error {
+	formatOrMsg, a = l.withID(formatOrMsg, a)
+	return l.Logger.Info(event, formatOrMsg, a...)
+}
+
+func (l *requestLogger) Warn(event, formatOrMsg string, a ...interface{}) error {
+	formatOrMsg, a = l.withID(formatOrMsg, a)
+	return l.Logger.Warn(event, formatOrMsg, a...)
+}
+
+func (l *requestLogger) Error(event, formatOrMsg string, a ...interface{}) error {
+	formatOrMsg, a = l.withID(formatOrMsg, a)
+	return l.Logger.Error(event, formatOrMsg, a...)
+}
+
+// withID appends the request ID to the message as an argument. A message without arguments is escaped, because it
+// becomes a format.
+func (l *requestLogger) withID(formatOrMsg string, a []interface{}) (string, []interface{}) {
+	if len(a) == 0 {
+		formatOrMsg = strings.Replace(formatOrMsg, "%", "%%", -1)
+	}
+	return formatOrMsg + ", request ID: %s", append(a[:len(a):len(a)], l.id)
+}
+
+/* http.RoundTripper implementation */
+
+func (t *requestIDTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	id := requestIDOf(req.Context())
+	if id == nil || req.Header.Get(id.header) != "" {
+		return t.base.RoundTrip(req)
+	}
+
+	// Never modify the original request.
+	propagated := req.WithContext(req.Context())
+	propagated.Header = cloneHeader(req.Header)
+	propagated.Header.Set(id.header, id.value)
+	return t.base.RoundTrip(propagated)
+}
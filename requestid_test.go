@@ -0,0 +1,135 @@
+package servicefoundation_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	sf "github.com/Prutswonder/go-servicefoundation"
+	"github.com/Prutswonder/go-servicefoundation/servicetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+func TestRequestIDMiddleware(t *testing.T) {
+	tests := []struct {
+		header    string
+		incoming  string
+		expected  string
+		generated bool
+	}{
+		{"", "", "", true},
+		{"", "abc-123", "abc-123", false},
+		{"", "abc 123", "", true},
+		{"", "abc\n123", "", true},
+		{"", strings.Repeat("a", 129), "", true},
+		{"X-Correlation-ID", "corr-1", "corr-1", false},
+	}
+
+	for _, test := range tests {
+		header := test.header
+		if header == "" {
+			header = sf.RequestIDHeader
+		}
+		r, _ := http.NewRequest(http.MethodGet, "/orders", nil)
+		r.Header.Set(header, test.incoming)
+		var actual string
+
+		// Act
+		w, _ := servicetest.RunMiddlewareWithHandler(sf.NewRequestIDMiddleware(test.header), r,
+			func(_ sf.WrappedResponseWriter, r *http.Request, _ sf.RouterParams) {
+				actual = sf.RequestIDFromContext(r.Context())
+			})
+
+		if test.generated {
+			assert.True(t, uuidPattern.MatchString(actual), "%q is replaced by a UUID, got %q", test.incoming, actual)
+		} else {
+			assert.Equal(t, test.expected, actual)
+		}
+		assert.Equal(t, actual, w.Header().Get(header))
+	}
+}
+
+func TestRequestIDMiddleware_RequestLogging(t *testing.T) {
+	m, _ := newSyntheticMetrics()
+	log := &mockLogger{}
+	log.On("Info", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	wrapper := sf.NewMiddlewareWrapper(log, m, &sf.CORSOptions{}, sf.ServiceGlobals{})
+	r, _ := http.NewRequest(http.MethodGet, "/orders", nil)
+	r.Header.Set(sf.RequestIDHeader, "abc-123")
+
+	// Act
+	sf.NewChainFor(wrapper, "public", "orders", []sf.Middleware{sf.RequestLogging, sf.RequestID}).
+		Then(func(sf.WrappedResponseWriter, *http.Request, sf.RouterParams) {})(
+		sf.NewWrappedResponseWriter(httptest.NewRecorder()), r, sf.RouterParams{})
+
+	var args interface{} = mock.MatchedBy(func(args []interface{}) bool {
+		return len(args) == 6 && args[1] == http.MethodGet && args[2] == "/orders" && args[5] == "abc-123"
+	})
+	log.AssertCalled(t, "Info", "Response-orders",
+		"Handled request, duration_us: %v, method: %v, path: %v, remote_addr: %v, status: %v, request ID: %s", args)
+}
+
+func TestNewRequestLogger(t *testing.T) {
+	log := &mockLogger{}
+	log.On("Warn", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	ctx := sf.WithRequestID(context.Background(), "abc-123")
+
+	// Act
+	sf.NewRequestLogger(ctx, log).Warn("Orders", "Order %s is late", "o-1")
+	sf.NewRequestLogger(ctx, log).Warn("Orders", "%s", "Stock at 10%")
+	sf.NewRequestLogger(context.Background(), log).Warn("Orders", "No request")
+
+	log.AssertCalled(t, "Warn", "Orders", "Order %s is late, request ID: %s", []interface{}{"o-1", "abc-123"})
+	log.AssertCalled(t, "Warn", "Orders", "%s, request ID: %s", []interface{}{"Stock at 10%", "abc-123"})
+	log.AssertCalled(t, "Warn", "Orders", "No request", []interface{}(nil))
+}
+
+func TestNewRequestLogger_EscapesMessagesWithoutArguments(t *testing.T) {
+	log := &mockLogger{}
+	log.On("Warn", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	// Messages without arguments can be built at runtime, which vet doesn't check through a func value.
+	warn := sf.NewRequestLogger(sf.WithRequestID(context.Background(), "abc-123"), log).Warn
+
+	// Act
+	warn("Orders", "Stock at 10%")
+
+	log.AssertCalled(t, "Warn", "Orders", "Stock at 10%%, request ID: %s", []interface{}{"abc-123"})
+}
+
+func TestRequestID_PropagatesThroughClients(t *testing.T) {
+	received := make(chan string, 1)
+	downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Get(sf.RequestIDHeader)
+	}))
+	defer downstream.Close()
+	opt := sf.NewServiceOptions("requestid", []string{http.MethodGet}, nil)
+	sut := sf.NewCustomService(opt)
+	client := opt.ClientFactory.NewClient("inventory")
+	sut.AddRoute("checkout", []string{"/checkout"}, sf.MethodsForGet, sf.DefaultMiddlewares,
+		func(w sf.WrappedResponseWriter, r *http.Request, _ sf.RouterParams) {
+			req, _ := http.NewRequest(http.MethodGet, downstream.URL, nil)
+			resp, err := client.Do(req.WithContext(r.Context()))
+			if err != nil {
+				sf.WriteProblem(w, http.StatusBadGateway, err.Error())
+				return
+			}
+			defer resp.Body.Close()
+			ioutil.ReadAll(resp.Body)
+		})
+	w := httptest.NewRecorder()
+
+	// Act
+	sut.Handler("public").ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/checkout", nil))
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	id := w.Header().Get(sf.RequestIDHeader)
+	assert.True(t, uuidPattern.MatchString(id), "a UUID is generated, got %q", id)
+	assert.Equal(t, id, <-received)
+}
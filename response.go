@@ -5,6 +5,7 @@ import (
 	"encoding/xml"
 	"fmt"
 	"net/http"
+	"net/url"
 	"strings"
 )
 
@@ -23,6 +24,7 @@ type (
 
 	wrappedResponseWriterImpl struct {
 		http.ResponseWriter
+		buffers     BufferPool
 		status      int
 		wroteHeader bool
 	}
@@ -44,6 +46,42 @@ func NewWrappedResponseWriter(w http.ResponseWriter) WrappedResponseWriter {
 	return &wrappedResponseWriterImpl{ResponseWriter: w, status: http.StatusOK}
 }
 
+// NewPooledResponseWriter instantiates a new WrappedResponseWriter implementation, which encodes responses in buffers
+// of the pool.
+func NewPooledResponseWriter(w http.ResponseWriter, buffers BufferPool) WrappedResponseWriter {
+	return &wrappedResponseWriterImpl{ResponseWriter: w, buffers: buffers, status: http.StatusOK}
+}
+
+// AbsoluteURL returns the absolute URL of the path and query as seen by the client. Behind a proxy, the scheme, host
+// and path prefix are taken from the X-Forwarded-Proto, X-Forwarded-Host and X-Forwarded-Prefix headers.
+func AbsoluteURL(r *http.Request, path string, query url.Values) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := firstForwarded(r.Header.Get("X-Forwarded-Proto")); proto != "" {
+		scheme = proto
+	}
+
+	host := r.Host
+	if forwardedHost := firstForwarded(r.Header.Get("X-Forwarded-Host")); forwardedHost != "" {
+		host = forwardedHost
+	}
+
+	u := url.URL{
+		Scheme:   scheme,
+		Host:     host,
+		Path:     strings.TrimSuffix(firstForwarded(r.Header.Get("X-Forwarded-Prefix")), "/") + path,
+		RawQuery: query.Encode(),
+	}
+	return u.String()
+}
+
+// firstForwarded returns the first value of a forwarded header, which was set by the proxy closest to the client.
+func firstForwarded(value string) string {
+	return strings.TrimSpace(strings.Split(value, ",")[0])
+}
+
 /* WrappedResponseWriter implementation */
 
 func (w *wrappedResponseWriterImpl) Status() int {
@@ -69,10 +107,25 @@ func (w *wrappedResponseWriterImpl) WriteHeader(code int) {
 }
 
 func (w *wrappedResponseWriterImpl) JSON(statusCode int, content interface{}) {
+	if w.buffers == nil {
+		w.Header().Set(ContentTypeHeader, ContentTypeJSON)
+		w.WriteHeader(statusCode)
+
+		json.NewEncoder(w).Encode(content)
+		return
+	}
+
+	// Encoding in a buffer first allows responding with a 500 when the content can't be encoded.
+	buffer := w.buffers.Get(defaultJSONSizeHint)
+	defer buffer.Release()
+
+	if err := json.NewEncoder(buffer).Encode(content); err != nil {
+		WriteProblem(w, http.StatusInternalServerError, "Failed encoding the response")
+		return
+	}
 	w.Header().Set(ContentTypeHeader, ContentTypeJSON)
 	w.WriteHeader(statusCode)
-
-	json.NewEncoder(w).Encode(content)
+	w.Write(buffer.Bytes())
 }
 
 func (w *wrappedResponseWriterImpl) XML(statusCode int, content interface{}) {
@@ -100,3 +153,23 @@ func (w *wrappedResponseWriterImpl) SetCaching(maxAge int) {
 	w.Header().Set("Vary", "Accept, Origin") // Because we don't want to mix XML and JSON in the cache!
 	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%v", maxAge))
 }
+
+// GetBuffer returns a buffer of the pool of the response writer, or a buffer that is not pooled if it has none.
+func (w *wrappedResponseWriterImpl) GetBuffer(sizeHint int) *Buffer {
+	if w.buffers == nil {
+		return newUnpooledBuffer(sizeHint)
+	}
+	return w.buffers.Get(sizeHint)
+}
+
+// Flush sends the buffered data to the client, if the underlying ResponseWriter supports it.
+func (w *wrappedResponseWriterImpl) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap returns the underlying ResponseWriter, which lets http.ResponseController reach its deadlines.
+func (w *wrappedResponseWriterImpl) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
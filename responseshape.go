@@ -0,0 +1,286 @@
+package servicefoundation
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/Prutswonder/go-servicefoundation/events"
+)
+
+const (
+	productionEnvironment = "production"
+
+	shapeString  = "string"
+	shapeNumber  = "number"
+	shapeBoolean = "boolean"
+	shapeNull    = "null"
+)
+
+type (
+	// ResponseShapeOptions contains the settings for checking JSON responses against golden shapes. Dir contains a
+	// golden file per route, named after the route, like "search.json". When AllowAdditions is true, fields that
+	// aren't in the golden shape are allowed, otherwise they are reported like any other mismatch.
+	ResponseShapeOptions struct {
+		Dir            string
+		AllowAdditions bool
+	}
+
+	shapeGuardResponseWriter struct {
+		WrappedResponseWriter
+		route   string
+		golden  interface{}
+		options ResponseShapeOptions
+		log     Logger
+		metrics Metrics
+	}
+)
+
+// NewResponseShapeOptions returns the ResponseShapeOptions for the deployment environment, or nil in production, where
+// responses are never checked.
+func NewResponseShapeOptions(deployEnvironment, dir string, allowAdditions bool) *ResponseShapeOptions {
+	if dir == "" || strings.EqualFold(deployEnvironment, productionEnvironment) {
+		return nil
+	}
+	return &ResponseShapeOptions{Dir: dir, AllowAdditions: allowAdditions}
+}
+
+// NewResponseShapeGuard returns a MiddlewareFunc that checks the successful JSON responses of the route against its
+// golden shape, which contains the field names and types but not the values. Mismatches are logged with a structural
+// diff and counted. Routes without a golden file are passed through unchecked.
+func NewResponseShapeGuard(route string, options ResponseShapeOptions, log Logger, metrics Metrics) MiddlewareFunc {
+	golden, err := LoadResponseShape(ResponseShapePath(options.Dir, route))
+	if err != nil && !os.IsNotExist(err) {
+		log.Error(events.ResponseShape, "Failed loading golden shape of %s: %v", route, err)
+	}
+
+	return func(next Handle) Handle {
+		if golden == nil {
+			return next
+		}
+
+		return func(w WrappedResponseWriter, r *http.Request, p RouterParams) {
+			if r.URL.Query().Get(fieldsQueryParameter) != "" {
+				// Field filtered responses leave out fields on purpose.
+				next(w, r, p)
+				return
+			}
+
+			next(&shapeGuardResponseWriter{
+				WrappedResponseWriter: w,
+				route:                 route,
+				golden:                golden,
+				options:               options,
+				log:                   log,
+				metrics:               metrics,
+			}, r, p)
+		}
+	}
+}
+
+// ResponseShapePath returns the path of the golden shape file of the route.
+func ResponseShapePath(dir, route string) string {
+	return filepath.Join(dir, route+".json")
+}
+
+// LoadResponseShape reads a golden shape file.
+func LoadResponseShape(path string) (interface{}, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var shape interface{}
+	if err := json.Unmarshal(b, &shape); err != nil {
+		return nil, err
+	}
+	return shape, nil
+}
+
+// ResponseShapeOf returns the shape of a JSON document, in which every value is replaced by the name of its type and
+// arrays contain the merged shape of their elements.
+func ResponseShapeOf(body []byte) (interface{}, error) {
+	var value interface{}
+	if err := json.Unmarshal(body, &value); err != nil {
+		return nil, err
+	}
+	return shapeOf(value), nil
+}
+
+// MergeResponseShapes returns the union of two shapes, in which null is replaced by the type it occurs with.
+func MergeResponseShapes(a, b interface{}) interface{} {
+	if a == shapeNull {
+		return b
+	}
+	if b == shapeNull {
+		return a
+	}
+
+	switch av := a.(type) {
+	case map[string]interface{}:
+		bv, ok := b.(map[string]interface{})
+		if !ok {
+			return a
+		}
+		merged := make(map[string]interface{}, len(av))
+		for name, shape := range av {
+			merged[name] = shape
+		}
+		for name, shape := range bv {
+			if existing, ok := merged[name]; ok {
+				shape = MergeResponseShapes(existing, shape)
+			}
+			merged[name] = shape
+		}
+		return merged
+	case []interface{}:
+		bv, ok := b.([]interface{})
+		if !ok {
+			return a
+		}
+		if len(av) == 0 {
+			return bv
+		}
+		if len(bv) == 0 {
+			return av
+		}
+		return []interface{}{MergeResponseShapes(av[0], bv[0])}
+	}
+	return a
+}
+
+// CompareResponseShapes returns the structural differences between the golden and the actual shape, sorted by path.
+// Null is compatible with every type and empty arrays with every element shape. Fields that only exist in the actual
+// shape are differences, unless allowAdditions is true.
+func CompareResponseShapes(golden, actual interface{}, allowAdditions bool) []string {
+	var diff []string
+	compareShapes("$", golden, actual, allowAdditions, &diff)
+	sort.Strings(diff)
+	return diff
+}
+
+func compareShapes(path string, golden, actual interface{}, allowAdditions bool, diff *[]string) {
+	if golden == shapeNull || actual == shapeNull {
+		return
+	}
+
+	goldenKind, actualKind := shapeKind(golden), shapeKind(actual)
+	if goldenKind != actualKind {
+		*diff = append(*diff, fmt.Sprintf("%s: type changed from %s to %s", path, goldenKind, actualKind))
+		return
+	}
+
+	switch gv := golden.(type) {
+	case map[string]interface{}:
+		av := actual.(map[string]interface{})
+		for name, shape := range gv {
+			fieldPath := path + "." + name
+			if actualShape, ok := av[name]; ok {
+				compareShapes(fieldPath, shape, actualShape, allowAdditions, diff)
+				continue
+			}
+			*diff = append(*diff, fmt.Sprintf("%s: missing field", fieldPath))
+		}
+		if allowAdditions {
+			return
+		}
+		for name := range av {
+			if _, ok := gv[name]; !ok {
+				*diff = append(*diff, fmt.Sprintf("%s.%s: added field", path, name))
+			}
+		}
+	case []interface{}:
+		av := actual.([]interface{})
+		if len(gv) > 0 && len(av) > 0 {
+			compareShapes(path+"[]", gv[0], av[0], allowAdditions, diff)
+		}
+	}
+}
+
+func shapeOf(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		shape := make(map[string]interface{}, len(v))
+		for name, field := range v {
+			shape[name] = shapeOf(field)
+		}
+		return shape
+	case []interface{}:
+		var element interface{} = shapeNull
+		for _, item := range v {
+			element = MergeResponseShapes(element, shapeOf(item))
+		}
+		if len(v) == 0 {
+			return []interface{}{}
+		}
+		return []interface{}{element}
+	case string:
+		return shapeString
+	case float64:
+		return shapeNumber
+	case bool:
+		return shapeBoolean
+	}
+	return shapeNull
+}
+
+func shapeKind(shape interface{}) string {
+	switch v := shape.(type) {
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return v
+	}
+	return shapeNull
+}
+
+/* WrappedResponseWriter implementation */
+
+func (w *shapeGuardResponseWriter) JSON(statusCode int, content interface{}) {
+	if statusCode >= 200 && statusCode < 300 {
+		w.check(content)
+	}
+	w.WrappedResponseWriter.JSON(statusCode, content)
+}
+
+func (w *shapeGuardResponseWriter) WriteResponse(r *http.Request, statusCode int, content interface{}) {
+	if w.AcceptsXML(r) {
+		w.XML(statusCode, content)
+		return
+	}
+	w.JSON(statusCode, content)
+}
+
+func (w *shapeGuardResponseWriter) Flush() {
+	if flusher, ok := w.WrappedResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *shapeGuardResponseWriter) check(content interface{}) {
+	b, err := json.Marshal(content)
+	if err != nil {
+		return
+	}
+	actual, err := ResponseShapeOf(b)
+	if err != nil {
+		return
+	}
+
+	diff := CompareResponseShapes(w.golden, actual, w.options.AllowAdditions)
+	if len(diff) == 0 {
+		return
+	}
+
+	w.log.Error(events.ResponseShapeMismatch, "Response of %s doesn't match its golden shape:\n%s", w.route,
+		strings.Join(diff, "\n"))
+	w.metrics.CountLabels("", "response_shape_mismatches_total", "Total responses that didn't match their golden shape.",
+		[]string{"route"}, []string{w.route})
+}
@@ -0,0 +1,138 @@
+package servicefoundation_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	sf "github.com/Prutswonder/go-servicefoundation"
+	"github.com/Prutswonder/go-servicefoundation/servicetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+type product struct {
+	ID    int      `json:"id"`
+	Name  string   `json:"name"`
+	Tags  []string `json:"tags"`
+	Price *float64 `json:"price"`
+}
+
+type renamedProduct struct {
+	ID    int      `json:"id"`
+	Title string   `json:"title"`
+	Tags  []string `json:"tags"`
+	Price *float64 `json:"price"`
+}
+
+type extendedProduct struct {
+	product
+	Stock int `json:"stock"`
+}
+
+func newShapeDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "shapes")
+	assert.NoError(t, err)
+	golden := `{"id":"number","name":"string","tags":["string"],"price":"number"}`
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "product.json"), []byte(golden), 0644))
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func TestCompareResponseShapes(t *testing.T) {
+	golden, _ := sf.ResponseShapeOf([]byte(`{"id":1,"name":"a","tags":["x"],"items":[{"sku":"1"}],"price":null}`))
+
+	tests := []struct {
+		body           string
+		allowAdditions bool
+		expected       []string
+	}{
+		{`{"id":2,"name":"b","tags":[],"items":[],"price":9.5}`, false, nil},
+		{`{"id":2,"title":"b","tags":["y"],"items":[],"price":1}`, true, []string{"$.name: missing field"}},
+		{`{"id":2,"title":"b","tags":["y"],"items":[],"price":1}`, false,
+			[]string{"$.name: missing field", "$.title: added field"}},
+		{`{"id":"2","name":"b","tags":["y"],"items":[{"sku":1}],"price":1}`, false,
+			[]string{"$.id: type changed from number to string", "$.items[].sku: type changed from string to number"}},
+		{`{"id":2,"name":"b","tags":["y"],"items":[{"sku":"2","qty":1}],"price":1}`, true, nil},
+		{`{"id":2,"name":"b","tags":["y"],"items":[{"sku":"2","qty":1}],"price":1}`, false,
+			[]string{"$.items[].qty: added field"}},
+	}
+
+	for _, test := range tests {
+		actual, err := sf.ResponseShapeOf([]byte(test.body))
+		assert.NoError(t, err)
+
+		// Act
+		diff := sf.CompareResponseShapes(golden, actual, test.allowAdditions)
+
+		assert.Equal(t, test.expected, diff, test.body)
+	}
+}
+
+func TestNewResponseShapeOptions(t *testing.T) {
+	assert.Nil(t, sf.NewResponseShapeOptions("production", "shapes", true), "no checks in production")
+	assert.Nil(t, sf.NewResponseShapeOptions("staging", "", true))
+	assert.Equal(t, &sf.ResponseShapeOptions{Dir: "shapes"}, sf.NewResponseShapeOptions("staging", "shapes", false))
+}
+
+func TestNewResponseShapeGuard(t *testing.T) {
+	dir, cleanup := newShapeDir(t)
+	defer cleanup()
+	price := 9.5
+
+	tests := []struct {
+		content        interface{}
+		allowAdditions bool
+		mismatch       bool
+	}{
+		{product{ID: 1, Name: "a", Tags: []string{"x"}, Price: &price}, false, false},
+		{product{ID: 1, Name: "a"}, false, false},
+		{renamedProduct{ID: 1, Title: "a"}, true, true},
+		{extendedProduct{product: product{ID: 1, Name: "a"}, Stock: 3}, true, false},
+		{extendedProduct{product: product{ID: 1, Name: "a"}, Stock: 3}, false, true},
+	}
+
+	for _, test := range tests {
+		log := &mockLogger{}
+		log.On("Error", "ResponseShapeMismatch", mock.Anything, mock.Anything).Return(nil)
+		m := &mockMetrics{}
+		m.On("CountLabels", "", "response_shape_mismatches_total", mock.Anything, []string{"route"},
+			[]string{"product"})
+		guard := sf.NewResponseShapeGuard("product", sf.ResponseShapeOptions{Dir: dir, AllowAdditions: test.allowAdditions},
+			log, m)
+		r, _ := http.NewRequest(http.MethodGet, "/products/1", nil)
+
+		// Act
+		w, _ := servicetest.RunMiddlewareWithHandler(guard, r,
+			func(w sf.WrappedResponseWriter, _ *http.Request, _ sf.RouterParams) {
+				w.JSON(http.StatusOK, test.content)
+			})
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		if test.mismatch {
+			m.AssertNumberOfCalls(t, "CountLabels", 1)
+			log.AssertNumberOfCalls(t, "Error", 1)
+		} else {
+			m.AssertNotCalled(t, "CountLabels", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+		}
+	}
+}
+
+func TestNewResponseShapeGuard_WithoutGoldenShape(t *testing.T) {
+	dir, cleanup := newShapeDir(t)
+	defer cleanup()
+	m := &mockMetrics{}
+	guard := sf.NewResponseShapeGuard("search", sf.ResponseShapeOptions{Dir: dir}, &mockLogger{}, m)
+	r, _ := http.NewRequest(http.MethodGet, "/search", nil)
+
+	// Act
+	w, called := servicetest.RunMiddlewareWithHandler(guard, r,
+		func(w sf.WrappedResponseWriter, _ *http.Request, _ sf.RouterParams) {
+			w.JSON(http.StatusOK, renamedProduct{})
+		})
+
+	assert.True(t, called)
+	assert.Equal(t, http.StatusOK, w.Code)
+	m.AssertNotCalled(t, "CountLabels", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+}
@@ -0,0 +1,10 @@
+//go:build darwin || freebsd
+// +build darwin freebsd
+
+package servicefoundation
+
+import (
+	"syscall"
+)
+
+const soReusePort = syscall.SO_REUSEPORT
@@ -0,0 +1,7 @@
+//go:build linux && !mips && !mipsle && !mips64 && !mips64le
+// +build linux,!mips,!mipsle,!mips64,!mips64le
+
+package servicefoundation
+
+// soReusePort is SO_REUSEPORT, which the syscall package doesn't define for every Linux architecture.
+const soReusePort = 0xf
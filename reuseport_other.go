@@ -0,0 +1,16 @@
+//go:build !darwin && !freebsd && (!linux || mips || mipsle || mips64 || mips64le)
+// +build !darwin
+// +build !freebsd
+// +build !linux mips mipsle mips64 mips64le
+
+package servicefoundation
+
+import (
+	"syscall"
+)
+
+// reuseAddress leaves the socket options as they are on platforms without SO_REUSEPORT, where a restarted server can
+// only bind after the old one is closed and the bind is retried.
+func reuseAddress(_, _ string, _ syscall.RawConn) error {
+	return nil
+}
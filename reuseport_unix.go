@@ -0,0 +1,24 @@
+//go:build darwin || freebsd || (linux && !mips && !mipsle && !mips64 && !mips64le)
+// +build darwin freebsd linux,!mips,!mipsle,!mips64,!mips64le
+
+package servicefoundation
+
+import (
+	"syscall"
+)
+
+// reuseAddress sets SO_REUSEADDR and SO_REUSEPORT, which allows the replacement of a server to bind its port on another
+// address while the old server still listens.
+func reuseAddress(_, _ string, conn syscall.RawConn) error {
+	var err error
+	controlErr := conn.Control(func(fd uintptr) {
+		if err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+			return
+		}
+		err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+	})
+	if controlErr != nil {
+		return controlErr
+	}
+	return err
+}
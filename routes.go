@@ -0,0 +1,163 @@
+package servicefoundation
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// JSON bodies of routes without a MaxBodySize are only validated up to this size.
+const defaultMaxJSONValidationSize = 1 << 20
+
+type (
+	// RouteMetadata contains the declarations of a route, which are enforced for its requests and exposed through the
+	// RouteRegistry. ContentTypes contains the accepted media types of request bodies; JSON bodies are validated
+	// before they reach the handler. MaxBodySize limits the size of request bodies in bytes. Auth is the middleware
+	// that authenticates the requests of the route and is expected to respond with 401 to anonymous requests.
+	// ExpectContinue defers the 100 Continue of requests with an "Expect: 100-continue" header until they passed the
+	// authentication, quota and the checks of the route contract that don't need the body, so rejected uploads aren't
+	// sent. It moves the quota before the route contract. SelfTest is the probe of the route in the SelfTest.
+	// CachePolicy sets the caching headers of the responses, overriding those of the NoCaching middleware.
+	RouteMetadata struct {
+		ContentTypes   []string
+		MaxBodySize    int64
+		Auth           MiddlewareFunc
+		ExpectContinue bool
+		SelfTest       *SelfTestProbe
+		CachePolicy    CachePolicy
+	}
+
+	// RouteInfo describes a registered route.
+	RouteInfo struct {
+		Name           string   `json:"name"`
+		Subsystem      string   `json:"subsystem"`
+		Paths          []string `json:"paths"`
+		Methods        []string `json:"methods"`
+		ContentTypes   []string `json:"contentTypes,omitempty"`
+		MaxBodySize    int64    `json:"maxBodySize,omitempty"`
+		Authenticated  bool     `json:"authenticated"`
+		ExpectContinue bool     `json:"expectContinue,omitempty"`
+		CachePolicy    string   `json:"cachePolicy,omitempty"`
+		explanation    *RouteExplanation
+	}
+
+	// RouteRegistry provides the routes of a service and the in-process handlers of its subsystems.
+	RouteRegistry interface {
+		Routes() []RouteInfo
+		Handler(subsystem string) http.Handler
+	}
+)
+
+// NewRouteContract returns a MiddlewareFunc that enforces the route metadata: requests are authenticated by Auth,
+// bodies that exceed MaxBodySize are rejected with 413, bodies of other media types than ContentTypes with 415 and
+// malformed JSON bodies with 400. The body is accepted after the checks that only need the headers, so the 100
+// Continue of requests that expect it is only sent when the body is read after these checks.
+func NewRouteContract(metadata RouteMetadata) MiddlewareFunc {
+	return func(next Handle) Handle {
+		h := func(w WrappedResponseWriter, r *http.Request, p RouterParams) {
+			if !hasBody(r) {
+				next(w, r, p)
+				return
+			}
+
+			if metadata.MaxBodySize > 0 && r.ContentLength > metadata.MaxBodySize {
+				WriteProblem(w, http.StatusRequestEntityTooLarge,
+					fmt.Sprintf("Request body exceeds %d bytes", metadata.MaxBodySize))
+				return
+			}
+
+			mediaType, _, _ := mime.ParseMediaType(r.Header.Get(ContentTypeHeader))
+			if len(metadata.ContentTypes) > 0 && !containsMediaType(metadata.ContentTypes, mediaType) {
+				WriteProblem(w, http.StatusUnsupportedMediaType,
+					fmt.Sprintf("Content type '%s' is not supported", mediaType))
+				return
+			}
+
+			acceptBody(r)
+			if isJSONMediaType(mediaType) {
+				if status, detail := validateJSONBody(r, metadata.MaxBodySize); status != 0 {
+					WriteProblem(w, status, detail)
+					return
+				}
+			}
+			if metadata.MaxBodySize > 0 {
+				r.Body = http.MaxBytesReader(w, r.Body, metadata.MaxBodySize)
+			}
+
+			next(w, r, p)
+		}
+
+		if metadata.Auth != nil {
+			return metadata.Auth(h)
+		}
+		return h
+	}
+}
+
+func hasBody(r *http.Request) bool {
+	return r.Body != nil && r.Body != http.NoBody && r.ContentLength != 0
+}
+
+func containsMediaType(mediaTypes []string, mediaType string) bool {
+	for _, t := range mediaTypes {
+		if strings.EqualFold(t, mediaType) {
+			return true
+		}
+	}
+	return false
+}
+
+func isJSONMediaType(mediaType string) bool {
+	return mediaType == ContentTypeJSON || strings.HasSuffix(mediaType, "+json")
+}
+
+// validateJSONBody reads the body to check that it is valid JSON, and replays it for the handler. It returns the
+// status code and detail of the problem when it isn't.
+func validateJSONBody(r *http.Request, maxBodySize int64) (int, string) {
+	limit := maxBodySize
+	if limit <= 0 {
+		limit = defaultMaxJSONValidationSize
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, limit+1))
+	r.Body = readCloser{Reader: io.MultiReader(bytes.NewReader(body), r.Body), Closer: r.Body}
+
+	switch {
+	case err != nil:
+		return http.StatusBadRequest, fmt.Sprintf("Failed reading request body: %v", err)
+	case int64(len(body)) > limit && maxBodySize > 0:
+		return http.StatusRequestEntityTooLarge, fmt.Sprintf("Request body exceeds %d bytes", maxBodySize)
+	case int64(len(body)) > limit:
+		// Too large to validate up front; the handler will find out while decoding.
+		return 0, ""
+	case !json.Valid(body):
+		return http.StatusBadRequest, "Request body is not valid JSON"
+	}
+	return 0, ""
+}
+
+// routePathsConflict reports whether the router refuses to add both paths for the same method: when they are equal, or
+// when a parameter or catch-all segment shares its position with a different segment.
+func routePathsConflict(a, b string) bool {
+	as, bs := strings.Split(a, "/"), strings.Split(b, "/")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		switch {
+		case as[i] == bs[i]:
+			continue
+		case isWildcardSegment(as[i]) || isWildcardSegment(bs[i]):
+			return true
+		default:
+			return false
+		}
+	}
+	return len(as) == len(bs)
+}
+
+func isWildcardSegment(segment string) bool {
+	return strings.HasPrefix(segment, ":") || strings.HasPrefix(segment, "*")
+}
@@ -0,0 +1,159 @@
+package servicefoundation_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	sf "github.com/Prutswonder/go-servicefoundation"
+	"github.com/Prutswonder/go-servicefoundation/events"
+	"github.com/Prutswonder/go-servicefoundation/servicetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestNewRouteContract(t *testing.T) {
+	metadata := sf.RouteMetadata{
+		ContentTypes: []string{sf.ContentTypeJSON, "text/plain"},
+		MaxBodySize:  16,
+	}
+
+	tests := []struct {
+		contentType string
+		body        string
+		expected    int
+		called      bool
+	}{
+		{sf.ContentTypeJSON, `{"id":1}`, http.StatusOK, true},
+		{"application/json; charset=utf-8", `{"id":1}`, http.StatusOK, true},
+		{sf.ContentTypeJSON, `{"id":`, http.StatusBadRequest, false},
+		{"text/plain", `{"id":`, http.StatusOK, true},
+		{"application/xml", `<id/>`, http.StatusUnsupportedMediaType, false},
+		{sf.ContentTypeJSON, `{"id":"1234567890123"}`, http.StatusRequestEntityTooLarge, false},
+		{"", ``, http.StatusOK, true},
+	}
+
+	for _, test := range tests {
+		r, _ := http.NewRequest(http.MethodPost, "/orders", strings.NewReader(test.body))
+		r.Header.Set(sf.ContentTypeHeader, test.contentType)
+		var received string
+
+		// Act
+		w, called := servicetest.RunMiddlewareWithHandler(sf.NewRouteContract(metadata), r,
+			func(_ sf.WrappedResponseWriter, r *http.Request, _ sf.RouterParams) {
+				b, _ := ioutil.ReadAll(r.Body)
+				received = string(b)
+			})
+
+		assert.Equal(t, test.expected, w.Code, test.body)
+		assert.Equal(t, test.called, called, test.body)
+		if called {
+			assert.Equal(t, test.body, received, "body is replayed")
+		}
+	}
+}
+
+func TestNewRouteContract_Auth(t *testing.T) {
+	auth := func(next sf.Handle) sf.Handle {
+		return func(w sf.WrappedResponseWriter, r *http.Request, p sf.RouterParams) {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}
+	r, _ := http.NewRequest(http.MethodPost, "/orders", strings.NewReader(`{"id":`))
+	r.Header.Set(sf.ContentTypeHeader, sf.ContentTypeJSON)
+
+	// Act
+	w, called := servicetest.RunMiddleware(sf.NewRouteContract(sf.RouteMetadata{Auth: auth}), r)
+
+	assert.Equal(t, http.StatusUnauthorized, w.Code, "authentication comes before body validation")
+	assert.False(t, called)
+}
+
+func newRoutesService() (sf.Service, *mockLogger) {
+	log := &mockLogger{}
+	log.On("Info", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	log.On("Error", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	opt := sf.NewServiceOptions("routes", []string{http.MethodGet, http.MethodPost}, nil)
+	opt.Logger = log
+	return sf.NewCustomService(opt), log
+}
+
+func findRoute(routes []sf.RouteInfo, subsystem, name string) *sf.RouteInfo {
+	for _, route := range routes {
+		if route.Subsystem == subsystem && route.Name == name {
+			return &route
+		}
+	}
+	return nil
+}
+
+func TestServiceImpl_AddInternalRoute(t *testing.T) {
+	sut, log := newRoutesService()
+	handler := func(w sf.WrappedResponseWriter, r *http.Request, _ sf.RouterParams) {
+		w.JSON(http.StatusOK, r.URL.Path)
+	}
+	serve := func(subsystem, method, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		sut.Handler(subsystem).ServeHTTP(w, httptest.NewRequest(method, path, nil))
+		return w
+	}
+
+	// Act
+	sut.AddInternalRoute("cache_flush", []string{"/service/cache/flush"}, sf.MethodsForPost, sf.DefaultMiddlewares, handler)
+	sut.AddInternalRoute("debug_dump", []string{"/metrics", "/service/dump"}, sf.MethodsForGet, sf.DefaultMiddlewares, handler)
+	routes := sut.Routes()
+	sut.AddReadinessRoute("warm_up", []string{"/service/warm"}, sf.MethodsForGet, sf.DefaultMiddlewares, handler)
+
+	assert.Equal(t, http.StatusOK, serve("internal", http.MethodPost, "/service/cache/flush").Code)
+	assert.Equal(t, http.StatusNotFound, serve("public", http.MethodPost, "/service/cache/flush").Code)
+	assert.Equal(t, http.StatusOK, serve("internal", http.MethodGet, "/service/dump").Code)
+	assert.NotContains(t, serve("internal", http.MethodGet, "/metrics").Body.String(), "/metrics",
+		"the predefined route takes precedence")
+	assert.Equal(t, http.StatusOK, serve("readiness", http.MethodGet, "/service/warm").Code,
+		"routes are added right away after the predefined ones")
+	assert.Equal(t, http.StatusNotFound, serve("internal", http.MethodGet, "/service/warm").Code)
+	if route := findRoute(routes, "internal", "debug_dump"); assert.NotNil(t, route) {
+		assert.Equal(t, []string{"/service/dump"}, route.Paths)
+	}
+	assert.NotNil(t, findRoute(routes, "internal", "cache_flush"))
+	assert.Nil(t, findRoute(routes, "public", "cache_flush"))
+	log.AssertCalled(t, "Error", events.RouteConflict, mock.Anything,
+		[]interface{}{http.MethodGet, "/metrics", "internal", "debug_dump", "/metrics"})
+}
+
+func TestServiceImpl_AddInternalRouteConflicts(t *testing.T) {
+	tests := []struct {
+		path     string
+		method   string
+		conflict string
+	}{
+		{"/service/cache/:key", http.MethodGet, ""},
+		{"/metrics", http.MethodPost, ""},
+		{"/service/routes/:name", http.MethodGet, ""},
+		{"/quit", http.MethodGet, "/quit"},
+		{"/healthz", http.MethodGet, "/healthz"},
+		{"/", http.MethodGet, "/"},
+		{"/service/routes/all/explain", http.MethodGet, "/service/routes/:name/explain"},
+		{"/service/*path", http.MethodGet, "/service/config/spec"},
+	}
+
+	for _, test := range tests {
+		sut, log := newRoutesService()
+		sut.AddInternalRoute("custom", []string{test.path}, []string{test.method}, sf.DefaultMiddlewares,
+			func(sf.WrappedResponseWriter, *http.Request, sf.RouterParams) {})
+
+		// Act
+		routes := sut.Routes()
+
+		if test.conflict == "" {
+			assert.NotNil(t, findRoute(routes, "internal", "custom"), test.path)
+			log.AssertNotCalled(t, "Error", events.RouteConflict, mock.Anything, mock.Anything)
+		} else {
+			assert.Nil(t, findRoute(routes, "internal", "custom"), test.path)
+			log.AssertCalled(t, "Error", events.RouteConflict, mock.Anything,
+				[]interface{}{test.method, test.path, "internal", "custom", test.conflict})
+		}
+	}
+}
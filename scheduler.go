@@ -0,0 +1,415 @@
+package servicefoundation
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Prutswonder/go-servicefoundation/events"
+)
+
+const schedulerSubsystem = "scheduler"
+
+// The overlap policies of a scheduled task, for when a run is due while the previous run hasn't finished yet.
+const (
+	// OverlapSkip skips the run.
+	OverlapSkip OverlapPolicy = iota
+	// OverlapQueueOne starts the run after the previous one finished. At most one run is queued.
+	OverlapQueueOne
+	// OverlapConcurrent starts the run alongside the previous ones, up to MaxConcurrent runs.
+	OverlapConcurrent
+)
+
+type (
+	// OverlapPolicy defines what happens when a run of a scheduled task is due while the previous run is still busy.
+	OverlapPolicy int
+
+	// Clock provides the current time and timers to the Scheduler, so schedules can be tested with a fake clock.
+	Clock interface {
+		Now() time.Time
+		After(d time.Duration) <-chan time.Time
+	}
+
+	// TaskOptions contains the settings of a scheduled task. The cron expression is evaluated in Location, which
+	// defaults to UTC. Runs are delayed by a random duration up to Jitter and get cancelled after Timeout. With CatchUp,
+	// a run that was missed while the service was down is run once at startup.
+	TaskOptions struct {
+		Location      *time.Location
+		Overlap       OverlapPolicy
+		MaxConcurrent int
+		Jitter        time.Duration
+		Timeout       time.Duration
+		CatchUp       bool
+	}
+
+	// SchedulerOptions contains the settings of a Scheduler. StatePath is the file in which the last run per task is
+	// kept, which is needed to catch up on missed runs.
+	SchedulerOptions struct {
+		Clock     Clock
+		StatePath string
+	}
+
+	// ScheduledTaskInfo contains the schedule and the last run of a scheduled task.
+	ScheduledTaskInfo struct {
+		Name         string        `json:"name"`
+		Schedule     string        `json:"schedule"`
+		Location     string        `json:"location"`
+		Running      int           `json:"running"`
+		LastRun      time.Time     `json:"lastRun"`
+		LastStatus   string        `json:"lastStatus,omitempty"`
+		LastError    string        `json:"lastError,omitempty"`
+		LastDuration time.Duration `json:"lastDuration,omitempty"`
+		NextRun      time.Time     `json:"nextRun"`
+	}
+
+	// Scheduler runs tasks in-process according to cron expressions.
+	Scheduler interface {
+		AddCronTask(name, cronExpr string, fn func(ctx context.Context) error, opts TaskOptions) error
+		Validate() error
+		Start(ctx context.Context)
+		Trigger(name string) error
+		Tasks() []ScheduledTaskInfo
+	}
+
+	schedulerImpl struct {
+		options SchedulerOptions
+		log     Logger
+		metrics Metrics
+		mutex   sync.Mutex
+		tasks   map[string]*scheduledTask
+		errs    []string
+		ctx     context.Context
+	}
+
+	scheduledTask struct {
+		name      string
+		schedule  CronSchedule
+		fn        func(ctx context.Context) error
+		options   TaskOptions
+		histogram MetricsHistogram
+		running   int
+		queued    bool
+		lastRun   time.Time
+		lastErr   error
+		lastTook  time.Duration
+		hasRun    bool
+	}
+
+	systemClock struct{}
+)
+
+// NewScheduler creates and returns a new Scheduler implementation.
+func NewScheduler(options SchedulerOptions, log Logger, metrics Metrics) Scheduler {
+	if options.Clock == nil {
+		options.Clock = NewSystemClock()
+	}
+
+	return &schedulerImpl{
+		options: options,
+		log:     log,
+		metrics: metrics,
+		tasks:   make(map[string]*scheduledTask),
+		ctx:     context.Background(),
+	}
+}
+
+// NewSystemClock returns a Clock that uses the system time.
+func NewSystemClock() Clock {
+	return systemClock{}
+}
+
+// NewScheduledTasksHandler returns a handler that lists the scheduled tasks with their last and next run.
+func NewScheduledTasksHandler(scheduler Scheduler) Handle {
+	return func(w WrappedResponseWriter, _ *http.Request, _ RouterParams) {
+		w.JSON(http.StatusOK, scheduler.Tasks())
+	}
+}
+
+// NewTriggerTaskHandler returns a handler that runs the scheduled task with the name in the route immediately,
+// respecting its overlap policy.
+func NewTriggerTaskHandler(scheduler Scheduler) Handle {
+	return func(w WrappedResponseWriter, _ *http.Request, p RouterParams) {
+		err := scheduler.Trigger(p.Params.ByName("name"))
+
+		switch err {
+		case nil:
+			w.JSON(http.StatusAccepted, "ok")
+		case ErrTaskNotFound:
+			w.JSON(http.StatusNotFound, err.Error())
+		default:
+			w.JSON(http.StatusInternalServerError, err.Error())
+		}
+	}
+}
+
+/* Clock implementation */
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+/* Scheduler implementation */
+
+// AddCronTask adds a task that runs fn according to the cron expression. Invalid expressions are returned and also
+// fail Validate, so they can be checked at startup.
+func (s *schedulerImpl) AddCronTask(name, cronExpr string, fn func(ctx context.Context) error, opts TaskOptions) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	schedule, err := ParseCronExpression(cronExpr)
+	if err == nil && s.tasks[name] != nil {
+		err = fmt.Errorf("Scheduled task '%s' already exists", name)
+	}
+	if err != nil {
+		s.errs = append(s.errs, fmt.Sprintf("%s: %v", name, err))
+		return err
+	}
+
+	if opts.Location == nil {
+		opts.Location = time.UTC
+	}
+	if opts.MaxConcurrent <= 0 {
+		opts.MaxConcurrent = 1
+	}
+
+	s.tasks[name] = &scheduledTask{
+		name:     name,
+		schedule: schedule,
+		fn:       fn,
+		options:  opts,
+		histogram: s.metrics.AddHistogramLabels(schedulerSubsystem, "duration_seconds",
+			"Duration of the runs of scheduled tasks.", []string{"job"}, []string{name}),
+	}
+	return nil
+}
+
+// Validate returns an error when any of the added tasks was invalid.
+func (s *schedulerImpl) Validate() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if len(s.errs) > 0 {
+		return fmt.Errorf("Invalid scheduled tasks: %s", strings.Join(s.errs, "; "))
+	}
+	return nil
+}
+
+// Start schedules the tasks until the context is done. Tasks added afterwards are not scheduled.
+func (s *schedulerImpl) Start(ctx context.Context) {
+	state := s.readState()
+
+	s.mutex.Lock()
+	s.ctx = ctx
+	tasks := make([]*scheduledTask, 0, len(s.tasks))
+	for _, task := range s.tasks {
+		tasks = append(tasks, task)
+	}
+	s.mutex.Unlock()
+
+	for _, task := range tasks {
+		lastRun, ok := state[task.name]
+		if ok {
+			s.mutex.Lock()
+			task.lastRun = lastRun
+			s.mutex.Unlock()
+		}
+
+		if ok && task.options.CatchUp {
+			missed := task.schedule.Next(lastRun.In(task.options.Location))
+			if !missed.IsZero() && missed.Before(s.options.Clock.Now()) {
+				s.log.Info(events.ScheduledTaskCatchUp, "Running %s, which missed its run at %v", task.name, missed)
+				s.dispatch(task, false)
+			}
+		}
+
+		go s.schedule(ctx, task)
+	}
+}
+
+// Trigger runs the named task now, respecting its overlap policy but without jitter.
+func (s *schedulerImpl) Trigger(name string) error {
+	s.mutex.Lock()
+	task, ok := s.tasks[name]
+	s.mutex.Unlock()
+
+	if !ok {
+		return ErrTaskNotFound
+	}
+
+	s.dispatch(task, false)
+	return nil
+}
+
+func (s *schedulerImpl) Tasks() []ScheduledTaskInfo {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := s.options.Clock.Now()
+	tasks := make([]ScheduledTaskInfo, 0, len(s.tasks))
+
+	for _, task := range s.tasks {
+		info := ScheduledTaskInfo{
+			Name:     task.name,
+			Schedule: task.schedule.String(),
+			Location: task.options.Location.String(),
+			Running:  task.running,
+			LastRun:  task.lastRun,
+			NextRun:  task.schedule.Next(now.In(task.options.Location)),
+		}
+		if task.hasRun {
+			info.LastDuration = task.lastTook
+			info.LastStatus = "ok"
+			if task.lastErr != nil {
+				info.LastStatus = "failed"
+				info.LastError = task.lastErr.Error()
+			}
+		}
+		tasks = append(tasks, info)
+	}
+
+	sort.Slice(tasks, func(i, j int) bool { return tasks[i].Name < tasks[j].Name })
+	return tasks
+}
+
+func (s *schedulerImpl) schedule(ctx context.Context, task *scheduledTask) {
+	for {
+		now := s.options.Clock.Now()
+		next := task.schedule.Next(now.In(task.options.Location))
+		if next.IsZero() {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.options.Clock.After(next.Sub(now)):
+		}
+
+		s.dispatch(task, true)
+	}
+}
+
+// dispatch starts a run of the task in the background, unless the overlap policy prevents it.
+func (s *schedulerImpl) dispatch(task *scheduledTask, jitter bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if task.running >= task.options.MaxConcurrent || (task.running > 0 && task.options.Overlap != OverlapConcurrent) {
+		if task.options.Overlap == OverlapQueueOne && !task.queued {
+			task.queued = true
+			return
+		}
+
+		s.log.Warn(events.ScheduledTaskOverlap, "Skipping run of %s, because %d runs are still busy", task.name, task.running)
+		s.metrics.CountLabels(schedulerSubsystem, "skipped_overlaps_total", "Total skipped runs of scheduled tasks.",
+			[]string{"task"}, []string{task.name})
+		return
+	}
+
+	task.running++
+	go s.run(s.ctx, task, jitter)
+}
+
+func (s *schedulerImpl) run(ctx context.Context, task *scheduledTask, jitter bool) {
+	if jitter && task.options.Jitter > 0 {
+		select {
+		case <-ctx.Done():
+			s.mutex.Lock()
+			task.running--
+			s.mutex.Unlock()
+			return
+		case <-s.options.Clock.After(time.Duration(rand.Int63n(int64(task.options.Jitter)))):
+		}
+	}
+
+	cancel := context.CancelFunc(func() {})
+	if task.options.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, task.options.Timeout)
+	}
+
+	start := s.options.Clock.Now()
+	err := task.fn(ctx)
+	took := s.options.Clock.Now().Sub(start)
+	cancel()
+
+	task.histogram.RecordTimeElapsed(time.Now().Add(-took), time.Second)
+	s.metrics.CountLabels(schedulerSubsystem, "runs_total", "Total runs of scheduled tasks.",
+		[]string{"task"}, []string{task.name})
+
+	if err != nil {
+		ReportError(ctx, ReportedError{Err: err, Task: task.name, Severity: SeverityError})
+		s.log.Error(events.ScheduledTaskFailed, "Scheduled task %s failed after %v: %v", task.name, took, err)
+		s.metrics.CountLabels(schedulerSubsystem, "failures_total", "Total failed runs of scheduled tasks.",
+			[]string{"task"}, []string{task.name})
+	}
+
+	s.mutex.Lock()
+	task.running--
+	task.hasRun = true
+	task.lastRun = start
+	task.lastErr = err
+	task.lastTook = took
+
+	if task.queued {
+		task.queued = false
+		task.running++
+		go s.run(s.ctx, task, false)
+	}
+	s.mutex.Unlock()
+
+	s.writeState()
+}
+
+func (s *schedulerImpl) readState() map[string]time.Time {
+	state := make(map[string]time.Time)
+	if s.options.StatePath == "" {
+		return state
+	}
+
+	data, err := ioutil.ReadFile(s.options.StatePath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			s.log.Warn(events.SchedulerState, "Failed reading scheduler state: %v", err)
+		}
+		return state
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		s.log.Warn(events.SchedulerState, "Failed parsing scheduler state: %v", err)
+	}
+	return state
+}
+
+func (s *schedulerImpl) writeState() {
+	if s.options.StatePath == "" {
+		return
+	}
+
+	s.mutex.Lock()
+	state := make(map[string]time.Time, len(s.tasks))
+	for _, task := range s.tasks {
+		if !task.lastRun.IsZero() {
+			state[task.name] = task.lastRun
+		}
+	}
+	data, err := json.Marshal(state)
+	s.mutex.Unlock()
+
+	if err == nil {
+		err = ioutil.WriteFile(s.options.StatePath, data, 0644)
+	}
+	if err != nil {
+		s.log.Warn(events.SchedulerState, "Failed writing scheduler state: %v", err)
+	}
+}
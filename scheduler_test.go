@@ -0,0 +1,235 @@
+package servicefoundation_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	sf "github.com/Prutswonder/go-servicefoundation"
+	"github.com/Prutswonder/go-servicefoundation/servicetest"
+	"github.com/julienschmidt/httprouter"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+type taskProbe struct {
+	mutex   sync.Mutex
+	runs    int
+	release chan struct{}
+}
+
+func (p *taskProbe) run(ctx context.Context) error {
+	p.mutex.Lock()
+	p.runs++
+	p.mutex.Unlock()
+
+	if p.release != nil {
+		<-p.release
+	}
+	return nil
+}
+
+func (p *taskProbe) count() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.runs
+}
+
+func newTestScheduler(clock sf.Clock, statePath string) (sf.Scheduler, *mockMetrics) {
+	log := &mockLogger{}
+	log.On("Info", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	log.On("Warn", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	log.On("Error", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+
+	m := &mockMetrics{}
+	h := &mockMetricsHistogram{}
+	m.On("AddHistogramLabels", "scheduler", "duration_seconds", mock.Anything, []string{"job"}, mock.Anything).Return(h)
+	m.On("CountLabels", "scheduler", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+	h.On("RecordTimeElapsed", mock.Anything, time.Second)
+
+	return sf.NewScheduler(sf.SchedulerOptions{Clock: clock, StatePath: statePath}, log, m), m
+}
+
+func TestScheduler_RunsOnSchedule(t *testing.T) {
+	clock := servicetest.NewFakeClock(time.Date(2017, 6, 15, 10, 7, 30, 0, time.UTC))
+	sut, m := newTestScheduler(clock, "")
+	probe := &taskProbe{}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	assert.NoError(t, sut.AddCronTask("report", "*/15 * * * *", probe.run, sf.TaskOptions{}))
+	sut.Start(ctx)
+	assert.True(t, waitFor(func() bool { return clock.Waiters() == 1 }))
+
+	// Act
+	clock.Advance(7*time.Minute + 29*time.Second)
+	time.Sleep(20 * time.Millisecond)
+	notYet := probe.count()
+	clock.Advance(time.Second)
+
+	assert.Equal(t, 0, notYet)
+	assert.True(t, waitFor(func() bool { return probe.count() == 1 }))
+	assert.True(t, waitFor(func() bool { return clock.Waiters() == 1 }))
+	tasks := sut.Tasks()
+	assert.Equal(t, time.Date(2017, 6, 15, 10, 30, 0, 0, time.UTC), tasks[0].NextRun)
+	assert.True(t, waitFor(func() bool { return sut.Tasks()[0].LastStatus == "ok" }))
+	m.AssertCalled(t, "CountLabels", "scheduler", "runs_total", mock.Anything, []string{"task"}, []string{"report"})
+	m.AssertCalled(t, "AddHistogramLabels", "scheduler", "duration_seconds", mock.Anything, []string{"job"},
+		[]string{"report"})
+}
+
+func TestScheduler_Timezone(t *testing.T) {
+	amsterdam, err := time.LoadLocation("Europe/Amsterdam")
+	if err != nil {
+		t.Skip("Timezone data not available")
+	}
+	clock := servicetest.NewFakeClock(time.Date(2017, 6, 15, 12, 0, 0, 0, time.UTC))
+	sut, _ := newTestScheduler(clock, "")
+	probe := &taskProbe{}
+	sut.AddCronTask("nightly", "0 3 * * *", probe.run, sf.TaskOptions{Location: amsterdam})
+
+	// Act
+	tasks := sut.Tasks()
+
+	assert.Equal(t, "Europe/Amsterdam", tasks[0].Location)
+	assert.Equal(t, time.Date(2017, 6, 16, 1, 0, 0, 0, time.UTC), tasks[0].NextRun.UTC())
+}
+
+func TestScheduler_OverlapPolicies(t *testing.T) {
+	tests := []struct {
+		options      sf.TaskOptions
+		expectedRuns int
+		skipped      bool
+	}{
+		{sf.TaskOptions{Overlap: sf.OverlapSkip}, 1, true},
+		{sf.TaskOptions{Overlap: sf.OverlapQueueOne}, 2, true},
+		{sf.TaskOptions{Overlap: sf.OverlapConcurrent, MaxConcurrent: 3}, 3, false},
+	}
+
+	for _, test := range tests {
+		clock := servicetest.NewFakeClock(time.Date(2017, 6, 15, 10, 0, 0, 0, time.UTC))
+		sut, m := newTestScheduler(clock, "")
+		probe := &taskProbe{release: make(chan struct{})}
+		sut.AddCronTask("sync", "* * * * *", probe.run, test.options)
+
+		// Act
+		sut.Trigger("sync")
+		sut.Trigger("sync")
+		sut.Trigger("sync")
+		close(probe.release)
+
+		assert.True(t, waitFor(func() bool { return probe.count() == test.expectedRuns }),
+			"policy %v: %d runs", test.options.Overlap, probe.count())
+		assert.True(t, waitFor(func() bool { return sut.Tasks()[0].Running == 0 }))
+		if test.skipped {
+			m.AssertCalled(t, "CountLabels", "scheduler", "skipped_overlaps_total", mock.Anything, []string{"task"},
+				[]string{"sync"})
+		} else {
+			m.AssertNotCalled(t, "CountLabels", "scheduler", "skipped_overlaps_total", mock.Anything, mock.Anything,
+				mock.Anything)
+		}
+	}
+}
+
+func TestScheduler_FailureAndTimeout(t *testing.T) {
+	clock := servicetest.NewFakeClock(time.Date(2017, 6, 15, 10, 0, 0, 0, time.UTC))
+	sut, m := newTestScheduler(clock, "")
+	sut.AddCronTask("slow", "* * * * *", func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}, sf.TaskOptions{Timeout: 10 * time.Millisecond})
+
+	// Act
+	sut.Trigger("slow")
+
+	assert.True(t, waitFor(func() bool { return sut.Tasks()[0].LastStatus == "failed" }))
+	assert.Equal(t, context.DeadlineExceeded.Error(), sut.Tasks()[0].LastError)
+	m.AssertCalled(t, "CountLabels", "scheduler", "failures_total", mock.Anything, []string{"task"}, []string{"slow"})
+}
+
+func TestScheduler_Validate(t *testing.T) {
+	sut, _ := newTestScheduler(servicetest.NewFakeClock(time.Now()), "")
+	noop := func(context.Context) error { return nil }
+
+	// Act
+	addErr := sut.AddCronTask("broken", "61 * * * *", noop, sf.TaskOptions{})
+	validErr := sut.AddCronTask("valid", "* * * * *", noop, sf.TaskOptions{})
+	duplicateErr := sut.AddCronTask("valid", "* * * * *", noop, sf.TaskOptions{})
+
+	assert.Error(t, addErr)
+	assert.NoError(t, validErr)
+	assert.Error(t, duplicateErr)
+	assert.Error(t, sut.Validate())
+	assert.Len(t, sut.Tasks(), 1)
+}
+
+func TestScheduler_CatchUp(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scheduler")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+	ioutil.WriteFile(path, []byte(`{"daily":"2017-06-14T03:00:00Z","hourly":"2017-06-15T09:00:00Z"}`), 0644)
+
+	clock := servicetest.NewFakeClock(time.Date(2017, 6, 15, 9, 30, 0, 0, time.UTC))
+	sut, _ := newTestScheduler(clock, path)
+	daily := &taskProbe{}
+	hourly := &taskProbe{}
+	noCatchUp := &taskProbe{}
+	sut.AddCronTask("daily", "0 3 * * *", daily.run, sf.TaskOptions{CatchUp: true})
+	sut.AddCronTask("hourly", "0 * * * *", hourly.run, sf.TaskOptions{CatchUp: true})
+	sut.AddCronTask("other", "0 3 * * *", noCatchUp.run, sf.TaskOptions{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Act
+	sut.Start(ctx)
+
+	assert.True(t, waitFor(func() bool { return daily.count() == 1 }))
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, 0, hourly.count())
+	assert.Equal(t, 0, noCatchUp.count())
+}
+
+func TestTriggerTaskHandler(t *testing.T) {
+	sut, _ := newTestScheduler(servicetest.NewFakeClock(time.Now()), "")
+	probe := &taskProbe{}
+	sut.AddCronTask("report", "* * * * *", probe.run, sf.TaskOptions{})
+	handler := sf.NewTriggerTaskHandler(sut)
+
+	tests := []struct {
+		name     string
+		expected int
+	}{
+		{"report", http.StatusAccepted},
+		{"unknown", http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		w := &mockResponseWriter{}
+		w.On("JSON", test.expected, mock.Anything)
+		r, _ := http.NewRequest(http.MethodPost, "/service/tasks/run/"+test.name, nil)
+
+		// Act
+		handler(w, r, sf.RouterParams{Params: httprouter.Params{{Key: "name", Value: test.name}}})
+
+		w.AssertExpectations(t)
+	}
+	assert.True(t, waitFor(func() bool { return probe.count() == 1 }))
+}
+
+func TestScheduler_TaskError(t *testing.T) {
+	sut, _ := newTestScheduler(servicetest.NewFakeClock(time.Now()), "")
+	sut.AddCronTask("broken", "* * * * *", func(context.Context) error { return errors.New("boom") }, sf.TaskOptions{})
+
+	// Act
+	sut.Trigger("broken")
+
+	assert.True(t, waitFor(func() bool { return sut.Tasks()[0].LastError == "boom" }))
+}
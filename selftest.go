@@ -0,0 +1,350 @@
+package servicefoundation
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Prutswonder/go-servicefoundation/events"
+)
+
+const (
+	defaultSelfTestTimeout = 30 * time.Second
+	selfTestPollInterval   = 10 * time.Millisecond
+)
+
+type (
+	// SelfTestProbe is the synthetic request with which the self-test probes a route. Method and Path default to the
+	// first method and path of the route, and ExpectedStatus defaults to 200.
+	SelfTestProbe struct {
+		Method         string
+		Path           string
+		Header         http.Header
+		Body           string
+		ExpectedStatus int
+	}
+
+	// SelfTestOptions contains the settings of a self-test. Timeout bounds the whole run, including the startup and
+	// shutdown of the service, and defaults to 30 seconds.
+	SelfTestOptions struct {
+		Timeout time.Duration
+	}
+
+	// SelfTestReport is the outcome of a self-test, with a result per step in the order they ran.
+	SelfTestReport struct {
+		Passed   bool             `json:"passed"`
+		Duration string           `json:"duration"`
+		Error    string           `json:"error,omitempty"`
+		Results  []SelfTestResult `json:"results"`
+	}
+
+	// SelfTestResult is the outcome of a single step of the self-test: the startup, a probe or the shutdown.
+	SelfTestResult struct {
+		Name      string `json:"name"`
+		Subsystem string `json:"subsystem,omitempty"`
+		Method    string `json:"method,omitempty"`
+		Path      string `json:"path,omitempty"`
+		Status    int    `json:"status,omitempty"`
+		Passed    bool   `json:"passed"`
+		Error     string `json:"error,omitempty"`
+		Duration  string `json:"duration"`
+	}
+
+	selfTestRoute struct {
+		name  string
+		probe SelfTestProbe
+	}
+
+	selfTestCase struct {
+		subsystem string
+		name      string
+		probe     SelfTestProbe
+		check     func(body []byte) error
+	}
+
+	selfTestRun struct {
+		service *serviceImpl
+		ctx     context.Context
+		client  *http.Client
+		report  SelfTestReport
+	}
+)
+
+// SelfTest runs the service on ephemeral ports, probes its built-in endpoints and the routes with a SelfTestProbe,
+// and shuts it down gracefully. The health checks of the service participate through the health and readiness
+// endpoints, and fail the self-test with their names. The service must be created by NewCustomService, with its
+// routes added, and can't be run again afterwards.
+func SelfTest(service Service, options SelfTestOptions) SelfTestReport {
+	if options.Timeout <= 0 {
+		options.Timeout = defaultSelfTestTimeout
+	}
+	s, ok := service.(*serviceImpl)
+	if !ok {
+		return SelfTestReport{Error: "the self-test requires a service created by NewCustomService"}
+	}
+
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), options.Timeout)
+	defer cancel()
+
+	s.selfTesting = true
+	s.port, s.readinessPort, s.internalPort = 0, 0, 0
+
+	runCtx, stop := context.WithCancel(ctx)
+	returned := make(chan error, 1)
+	go func() {
+		returned <- s.Run(runCtx)
+	}()
+
+	run := &selfTestRun{
+		service: s,
+		ctx:     ctx,
+		// Without keep-alives, the graceful shutdown doesn't wait for idle connections of the probes. The certificate
+		// of a TLS server isn't issued for its loopback address, so it isn't verified.
+		client: &http.Client{Transport: &http.Transport{
+			DisableKeepAlives: true,
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		}},
+	}
+
+	if run.startup(returned) {
+		for _, c := range s.selfTestCases() {
+			run.probe(c)
+		}
+		stop()
+		run.shutdown(returned)
+	}
+	stop()
+
+	report := run.report
+	report.Duration = time.Since(start).String()
+	report.Passed = ctx.Err() == nil
+	for _, result := range report.Results {
+		report.Passed = report.Passed && result.Passed
+	}
+	if ctx.Err() != nil {
+		report.Error = fmt.Sprintf("self-test timed out after %v", options.Timeout)
+	}
+
+	if report.Passed {
+		s.log.Info(events.SelfTest, "Self-test passed in %s", report.Duration)
+	} else {
+		s.log.Error(events.SelfTest, "Self-test failed: %s", strings.Join(report.failures(), ", "))
+	}
+	return report
+}
+
+// ExitCode returns the exit code of the process that ran the self-test, which is 1 when the self-test failed.
+func (r SelfTestReport) ExitCode() int {
+	if r.Passed {
+		return 0
+	}
+	return 1
+}
+
+func (r SelfTestReport) failures() []string {
+	var failures []string
+	if r.Error != "" {
+		failures = append(failures, r.Error)
+	}
+	for _, result := range r.Results {
+		if result.Passed {
+			continue
+		}
+		name := result.Name
+		if result.Subsystem != "" {
+			name = result.Subsystem + "/" + name
+		}
+		failures = append(failures, fmt.Sprintf("%s: %s", name, result.Error))
+	}
+	return failures
+}
+
+// selfTestCases returns the probes of the built-in endpoints, followed by the probes of the routes.
+func (s *serviceImpl) selfTestCases() []selfTestCase {
+	get := func(path string) SelfTestProbe {
+		return SelfTestProbe{Method: http.MethodGet, Path: path, ExpectedStatus: http.StatusOK}
+	}
+
+	cases := []selfTestCase{
+		{publicSubsystem, "root", get("/"), nil},
+		{publicSubsystem, "version", get("/service/version"), checkJSONObject},
+		{publicSubsystem, "liveness", get("/service/liveness"), checkJSON},
+		{publicSubsystem, "readiness", get("/service/readiness"), checkJSON},
+		{readinessSubsystem, "liveness", get("/service/liveness"), checkJSON},
+		{readinessSubsystem, "readiness", get("/service/readiness"), checkJSON},
+		{internalSubsystem, "health_check", get("/health_check"), checkHealthReport},
+		{internalSubsystem, "metrics", get("/metrics"), checkNotEmpty},
+	}
+	for _, route := range s.selfTests {
+		cases = append(cases, selfTestCase{subsystem: publicSubsystem, name: route.name, probe: route.probe})
+	}
+	return cases
+}
+
+// startup waits until the servers of all subsystems are listening.
+func (r *selfTestRun) startup(returned <-chan error) bool {
+	start := time.Now()
+	result := SelfTestResult{Name: "startup"}
+	defer func() {
+		result.Duration = time.Since(start).String()
+		r.report.Results = append(r.report.Results, result)
+	}()
+
+	for {
+		listening := true
+		for _, subsystem := range []string{publicSubsystem, readinessSubsystem, internalSubsystem} {
+			listening = listening && r.service.Addr(subsystem) != nil
+		}
+		if listening {
+			result.Passed = true
+			return true
+		}
+
+		select {
+		case err := <-returned:
+			result.Error = fmt.Sprintf("the service stopped before listening: %v", err)
+			return false
+		case <-r.ctx.Done():
+			result.Error = "the servers didn't start listening in time"
+			return false
+		case <-time.After(selfTestPollInterval):
+		}
+	}
+}
+
+func (r *selfTestRun) probe(c selfTestCase) {
+	start := time.Now()
+	result := SelfTestResult{Name: c.name, Subsystem: c.subsystem, Method: c.probe.Method, Path: c.probe.Path}
+	defer func() {
+		result.Duration = time.Since(start).String()
+		r.report.Results = append(r.report.Results, result)
+	}()
+
+	addr := r.service.Addr(c.subsystem)
+	if addr == nil {
+		result.Error = "the server is not listening"
+		return
+	}
+	scheme := "http://"
+	if r.service.Servers()[c.subsystem].TLS {
+		scheme = "https://"
+	}
+	req, err := http.NewRequest(c.probe.Method, scheme+addr.String()+c.probe.Path, strings.NewReader(c.probe.Body))
+	if err != nil {
+		result.Error = err.Error()
+		return
+	}
+	for name, values := range c.probe.Header {
+		req.Header[name] = values
+	}
+
+	resp, err := r.client.Do(req.WithContext(r.ctx))
+	if err != nil {
+		result.Error = err.Error()
+		return
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	result.Status = resp.StatusCode
+	if err == nil && c.check != nil {
+		// The shape is checked first, because it explains failures better than the status, like unhealthy checks.
+		err = c.check(body)
+	}
+
+	switch {
+	case err != nil:
+		result.Error = err.Error()
+	case resp.StatusCode != c.probe.ExpectedStatus:
+		result.Error = fmt.Sprintf("status %d, expected %d", resp.StatusCode, c.probe.ExpectedStatus)
+	default:
+		result.Passed = true
+	}
+}
+
+// shutdown waits until the service completed its graceful shutdown.
+func (r *selfTestRun) shutdown(returned <-chan error) {
+	start := time.Now()
+	result := SelfTestResult{Name: "shutdown"}
+	defer func() {
+		result.Duration = time.Since(start).String()
+		r.report.Results = append(r.report.Results, result)
+	}()
+
+	select {
+	case err := <-returned:
+		if err != nil {
+			result.Error = fmt.Sprintf("the service shut down with an error: %v", err)
+			return
+		}
+		result.Passed = true
+	case <-r.ctx.Done():
+		result.Error = "the service didn't shut down in time"
+	}
+}
+
+// selfTestProbe returns the probe of the route with the defaults applied.
+func selfTestProbe(probe SelfTestProbe, routes []string, methods []string) SelfTestProbe {
+	if probe.Method == "" && len(methods) > 0 {
+		probe.Method = methods[0]
+	}
+	if probe.Path == "" && len(routes) > 0 {
+		probe.Path = routes[0]
+	}
+	if probe.ExpectedStatus == 0 {
+		probe.ExpectedStatus = http.StatusOK
+	}
+	return probe
+}
+
+func checkJSON(body []byte) error {
+	if !json.Valid(body) {
+		return errors.New("the response is not valid JSON")
+	}
+	return nil
+}
+
+func checkJSONObject(body []byte) error {
+	var object map[string]interface{}
+	if err := json.Unmarshal(body, &object); err != nil {
+		return errors.New("the response is not a JSON object")
+	}
+	return nil
+}
+
+func checkNotEmpty(body []byte) error {
+	if len(body) == 0 {
+		return errors.New("the response is empty")
+	}
+	return nil
+}
+
+// checkHealthReport fails with the names of the unhealthy checks.
+func checkHealthReport(body []byte) error {
+	var report HealthReport
+	if err := json.Unmarshal(body, &report); err != nil {
+		return errors.New("the response is not a health report")
+	}
+
+	var unhealthy []string
+	for name, status := range report.Checks {
+		if status.State == HealthStateUnhealthy {
+			unhealthy = append(unhealthy, name)
+		}
+	}
+	if len(unhealthy) > 0 {
+		sort.Strings(unhealthy)
+		return fmt.Errorf("unhealthy checks: %s", strings.Join(unhealthy, ", "))
+	}
+	if report.State == HealthStateUnhealthy {
+		return errors.New("the service is unhealthy")
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package servicefoundation_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	sf "github.com/Prutswonder/go-servicefoundation"
+	"github.com/stretchr/testify/assert"
+)
+
+func newSelfTestService(configure func(opt *sf.ServiceOptions), handler sf.Handle) sf.Service {
+	opt := sf.NewServiceOptions("selftest", []string{http.MethodGet, http.MethodPost}, nil)
+	opt.ShutdownMode = sf.ShutdownModeGraceful
+	if configure != nil {
+		configure(&opt)
+	}
+	sut := sf.NewCustomService(opt)
+	sut.AddRouteWithMetadata("orders", []string{"/orders"}, sf.MethodsForPost, sf.DefaultMiddlewares,
+		sf.RouteMetadata{SelfTest: &sf.SelfTestProbe{Body: `{"id":"smoke"}`, ExpectedStatus: http.StatusCreated}}, handler)
+	return sut
+}
+
+func selfTestResult(report sf.SelfTestReport, subsystem, name string) sf.SelfTestResult {
+	for _, result := range report.Results {
+		if result.Subsystem == subsystem && result.Name == name {
+			return result
+		}
+	}
+	return sf.SelfTestResult{}
+}
+
+func TestSelfTest_Passes(t *testing.T) {
+	var received string
+	sut := newSelfTestService(nil, func(w sf.WrappedResponseWriter, r *http.Request, _ sf.RouterParams) {
+		received = r.Method + " " + r.URL.Path
+		w.JSON(http.StatusCreated, "ok")
+	})
+
+	// Act
+	report := sf.SelfTest(sut, sf.SelfTestOptions{Timeout: 10 * time.Second})
+
+	assert.True(t, report.Passed, "%+v", report)
+	assert.Equal(t, 0, report.ExitCode())
+	assert.Equal(t, "POST /orders", received, "the probe defaults to the first method and path of the route")
+	var names []string
+	for _, result := range report.Results {
+		assert.True(t, result.Passed, result.Name)
+		assert.NotEmpty(t, result.Duration, result.Name)
+		names = append(names, result.Subsystem+"/"+result.Name)
+	}
+	assert.Equal(t, []string{"/startup", "public/root", "public/version", "public/liveness", "public/readiness",
+		"readiness/liveness", "readiness/readiness", "internal/health_check", "internal/metrics", "public/orders",
+		"/shutdown"}, names)
+}
+
+func TestSelfTest_TLS(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "tls")
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeCertificate(dir)
+	sut := newSelfTestService(func(opt *sf.ServiceOptions) {
+		opt.TLS = sf.TLSOptions{CertFile: certFile, KeyFile: keyFile, Subsystems: []string{"public", "readiness"}}
+	}, func(w sf.WrappedResponseWriter, _ *http.Request, _ sf.RouterParams) {
+		w.JSON(http.StatusCreated, "ok")
+	})
+
+	// Act
+	report := sf.SelfTest(sut, sf.SelfTestOptions{Timeout: 10 * time.Second})
+
+	assert.True(t, report.Passed, "%+v", report)
+	servers := sut.Servers()
+	assert.True(t, servers["public"].TLS)
+	assert.True(t, servers["readiness"].TLS)
+	assert.False(t, servers["internal"].TLS, "the internal server stays plain HTTP")
+}
+
+func TestSelfTest_FailingProbes(t *testing.T) {
+	sut := newSelfTestService(func(opt *sf.ServiceOptions) {
+		opt.ServiceStateReader = sf.NewHealthChecks([]sf.HealthCheck{
+			{Name: "cache", Check: sf.Healthy},
+			{Name: "database", Critical: true, Check: func() sf.HealthStatus { return sf.Unhealthy(errors.New("refused")) }},
+		}, opt.Metrics)
+		opt.SetHandlers()
+	}, func(w sf.WrappedResponseWriter, _ *http.Request, _ sf.RouterParams) {
+		sf.WriteProblem(w, http.StatusInternalServerError, "boom")
+	})
+
+	// Act
+	report := sf.SelfTest(sut, sf.SelfTestOptions{Timeout: 10 * time.Second})
+
+	assert.False(t, report.Passed)
+	assert.Equal(t, 1, report.ExitCode())
+	orders := selfTestResult(report, "public", "orders")
+	assert.Equal(t, http.StatusInternalServerError, orders.Status)
+	assert.Equal(t, "status 500, expected 201", orders.Error)
+	health := selfTestResult(report, "internal", "health_check")
+	assert.Equal(t, "unhealthy checks: database", health.Error)
+	assert.False(t, selfTestResult(report, "readiness", "readiness").Passed)
+	assert.True(t, selfTestResult(report, "", "shutdown").Passed, "the service still shuts down")
+}
+
+func TestSelfTest_Timeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	sut := newSelfTestService(nil, func(w sf.WrappedResponseWriter, _ *http.Request, _ sf.RouterParams) {
+		<-release
+		w.WriteHeader(http.StatusCreated)
+	})
+	start := time.Now()
+
+	// Act
+	report := sf.SelfTest(sut, sf.SelfTestOptions{Timeout: 500 * time.Millisecond})
+
+	assert.True(t, time.Since(start) < 3*time.Second, "the run is bounded by the timeout, took %v", time.Since(start))
+	assert.False(t, report.Passed)
+	assert.True(t, strings.HasPrefix(report.Error, "self-test timed out"), report.Error)
+	assert.False(t, selfTestResult(report, "public", "orders").Passed)
+}
@@ -0,0 +1,505 @@
+package servicefoundation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Prutswonder/go-servicefoundation/events"
+)
+
+const (
+	defaultServerTimeout        = 30 * time.Second
+	defaultRestartDrainDeadline = 5 * time.Second
+	restartBindAttempts         = 5
+	restartBindBackoff          = 200 * time.Millisecond
+)
+
+// ErrServerNotFound is returned when a subsystem has no running server.
+var ErrServerNotFound = errors.New("server not found")
+
+type (
+	// ServerOptions contains the settings of the server of a subsystem, which are applied whenever the server is
+	// (re)started. A zero Port keeps the configured or previously bound port, an empty Address keeps the configured
+	// bind address and zero timeouts use the defaults.
+	ServerOptions struct {
+		Address      string
+		Port         int
+		ReadTimeout  time.Duration
+		WriteTimeout time.Duration
+		IdleTimeout  time.Duration
+	}
+
+	// ServerRestart contains the outcome of the last restart of a server.
+	ServerRestart struct {
+		StartedAt time.Time `json:"startedAt"`
+		Duration  string    `json:"duration"`
+		Error     string    `json:"error,omitempty"`
+	}
+
+	// ServerInfo describes the server of a subsystem.
+	ServerInfo struct {
+		Address     string         `json:"address"`
+		TLS         bool           `json:"tls"`
+		LastRestart *ServerRestart `json:"lastRestart,omitempty"`
+	}
+
+	// ServerManager restarts the servers of individual subsystems and describes them.
+	ServerManager interface {
+		RestartServer(subsystem string) error
+		Servers() map[string]ServerInfo
+	}
+
+	// ServerError is returned by Run when the server of a subsystem stopped unexpectedly, like when it failed to listen
+	// on its port. It matches ErrServerStopped.
+	ServerError struct {
+		Subsystem string
+		Port      int
+		Err       error
+	}
+
+	// subsystemServer is the running server of a subsystem. A replaced server is shut down by a restart, which must
+	// not be mistaken for an unexpected shutdown.
+	subsystemServer struct {
+		server      *http.Server
+		listener    net.Listener
+		router      *Router
+		address     string
+		port        int
+		tls         bool
+		replaced    bool
+		lastRestart *ServerRestart
+		newConns    *newConns
+	}
+
+	// newConns tracks the connections of a server that haven't sent a request yet. Shutdown treats them as active for
+	// 5 seconds, so they are closed when the server shuts down instead.
+	newConns struct {
+		mutex sync.Mutex
+		conns map[net.Conn]struct{}
+	}
+)
+
+// NewRestartServerHandler returns a handler that restarts the server of the subsystem in the path. Restarting the
+// public server drops in-flight requests after the drain deadline, so it requires the confirm=true query parameter.
+func NewRestartServerHandler(manager ServerManager) Handle {
+	return func(w WrappedResponseWriter, r *http.Request, p RouterParams) {
+		subsystem := p.Params.ByName("subsystem")
+		if subsystem == publicSubsystem && r.URL.Query().Get("confirm") != "true" {
+			WriteProblem(w, http.StatusBadRequest, "Restarting the public server requires confirm=true")
+			return
+		}
+
+		err := manager.RestartServer(subsystem)
+
+		switch err {
+		case nil:
+			w.JSON(http.StatusOK, manager.Servers()[subsystem])
+		case ErrServerNotFound:
+			w.JSON(http.StatusNotFound, err.Error())
+		case ErrShuttingDown:
+			w.JSON(http.StatusServiceUnavailable, err.Error())
+		default:
+			w.JSON(http.StatusInternalServerError, err.Error())
+		}
+	}
+}
+
+// NewServiceInfoHandler returns a handler that responds with the name of the service and its servers, the status of
+// the metrics push when a pusher is given and the initialization state of the lazy resources when they are given.
+func NewServiceInfoHandler(globals ServiceGlobals, manager ServerManager, pusher MetricsPusher, lazy LazyResources) Handle {
+	return func(w WrappedResponseWriter, _ *http.Request, _ RouterParams) {
+		var push *MetricsPushStatus
+		if pusher != nil {
+			status := pusher.Status()
+			push = &status
+		}
+		var resources []LazyStatus
+		if lazy != nil {
+			resources = lazy.Statuses()
+		}
+
+		w.JSON(http.StatusOK, struct {
+			Name          string                `json:"name"`
+			Servers       map[string]ServerInfo `json:"servers"`
+			MetricsPush   *MetricsPushStatus    `json:"metricsPush,omitempty"`
+			LazyResources []LazyStatus          `json:"lazyResources,omitempty"`
+		}{globals.AppName, manager.Servers(), push, resources})
+	}
+}
+
+func (e *ServerError) Error() string {
+	return fmt.Sprintf("%s server on port %d stopped: %v", e.Subsystem, e.Port, e.Err)
+}
+
+// Unwrap returns the error of the server, like the error of listening on its port.
+func (e *ServerError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether the target is ErrServerStopped, which all ServerErrors are.
+func (e *ServerError) Is(target error) bool {
+	return target == ErrServerStopped
+}
+
+/* ServerManager implementation */
+
+// RestartServer replaces the server of the subsystem by one built from its current ServerOptions. The replacement is
+// bound before the old server is drained: on the same address and port, it accepts on a duplicate of the listener of
+// the old server, and on another address or port, it binds with address reuse. Bind failures are retried briefly,
+// after which the old server keeps running.
+func (s *serviceImpl) RestartServer(subsystem string) error {
+	s.restartMutex.Lock()
+	defer s.restartMutex.Unlock()
+
+	s.serverMutex.Lock()
+	current, ok := s.servers[subsystem]
+	stopping := s.stopping
+	s.serverMutex.Unlock()
+
+	if stopping {
+		return ErrShuttingDown
+	}
+	if !ok || current.listener == nil {
+		return ErrServerNotFound
+	}
+
+	start := time.Now()
+	restart := &ServerRestart{StartedAt: start}
+	options := s.serverOptions(subsystem)
+	address, port := options.Address, options.Port
+	if address == "" {
+		address = current.address
+	}
+	if port == 0 {
+		port = current.port
+	}
+	if port == 0 {
+		// Keep the ephemeral port, so clients can reconnect.
+		port = current.listener.Addr().(*net.TCPAddr).Port
+	}
+
+	s.log.Info(events.ServerRestart, "Restarting %s server on port %d", subsystem, port)
+
+	listener, err := s.listenReplacement(current, address, port)
+	if err != nil {
+		restart.Duration = time.Since(start).String()
+		restart.Error = err.Error()
+		s.setLastRestart(subsystem, restart)
+
+		s.log.Error(events.ServerRestartFailed, "Failed binding replacement %s server on port %d, keeping the old one: %v",
+			subsystem, port, err)
+		s.reporter.Report(context.Background(), ReportedError{
+			Err:      err,
+			Message:  fmt.Sprintf("Failed restarting %s server: %v", subsystem, err),
+			Severity: SeverityError,
+		})
+		return err
+	}
+
+	s.serverMutex.Lock()
+	if s.stopping {
+		s.serverMutex.Unlock()
+		listener.Close()
+		return ErrShuttingDown
+	}
+	current.replaced = true
+	replacement := s.serveLocked(subsystem, current.router, address, port, listener, options)
+	replacement.lastRestart = restart
+	s.serverMutex.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultRestartDrainDeadline)
+	defer cancel()
+	if err := current.server.Shutdown(ctx); err != nil {
+		s.log.Warn(events.ServerRestart, "Closing old %s server with in-flight requests: %v", subsystem, err)
+		current.server.Close()
+	}
+
+	s.serverMutex.Lock()
+	restart.Duration = time.Since(start).String()
+	s.serverMutex.Unlock()
+
+	s.log.Info(events.ServerRestart, "Restarted %s server in %v", subsystem, time.Since(start))
+	return nil
+}
+
+func (s *serviceImpl) Servers() map[string]ServerInfo {
+	s.serverMutex.Lock()
+	defer s.serverMutex.Unlock()
+
+	servers := make(map[string]ServerInfo, len(s.servers))
+	for subsystem, server := range s.servers {
+		info := ServerInfo{}
+		if server.listener != nil {
+			info.Address = server.listener.Addr().String()
+		}
+		info.TLS = server.tls
+		if server.lastRestart != nil {
+			restart := *server.lastRestart
+			info.LastRestart = &restart
+		}
+		servers[subsystem] = info
+	}
+	return servers
+}
+
+// Addr returns the address the server of the subsystem is listening on, which resolves port 0 to the ephemeral port.
+// It returns nil while the server is not listening.
+func (s *serviceImpl) Addr(subsystem string) net.Addr {
+	s.serverMutex.Lock()
+	defer s.serverMutex.Unlock()
+
+	server, ok := s.servers[subsystem]
+	if !ok || server.listener == nil {
+		return nil
+	}
+	return server.listener.Addr()
+}
+
+// serveLocked starts serving the router on the listener and registers it as the server of the subsystem. The caller
+// must hold the serverMutex.
+func (s *serviceImpl) serveLocked(subsystem string, router *Router, address string, port int, listener net.Listener, options ServerOptions) *subsystemServer {
+	server := &subsystemServer{
+		server: &http.Server{
+			ReadTimeout:  orDefaultDuration(options.ReadTimeout, defaultServerTimeout),
+			WriteTimeout: orDefaultDuration(options.WriteTimeout, defaultServerTimeout),
+			IdleTimeout:  orDefaultDuration(options.IdleTimeout, defaultServerTimeout),
+			Handler:      router.Router,
+		},
+		listener: listener,
+		router:   router,
+		address:  address,
+		port:     port,
+		newConns: &newConns{conns: make(map[net.Conn]struct{})},
+	}
+	server.server.ConnState = server.newConns.track
+	// Called after the listener was closed, so no new connections are tracked afterwards.
+	server.server.RegisterOnShutdown(server.newConns.close)
+	if s.tlsConfig != nil && s.tls.uses(subsystem) {
+		server.server.TLSConfig = s.tlsConfig
+		server.tls = true
+	}
+	if previous, ok := s.servers[subsystem]; ok {
+		server.lastRestart = previous.lastRestart
+	}
+	s.servers[subsystem] = server
+
+	go func() {
+		// Blocking until the server stops.
+		var err error
+		if server.tls {
+			// The certificates are in the TLS config.
+			err = server.server.ServeTLS(listener, "", "")
+		} else {
+			err = server.server.Serve(listener)
+		}
+
+		s.serverMutex.Lock()
+		expected := server.replaced || s.stopping
+		s.serverMutex.Unlock()
+
+		if !expected {
+			s.stopped(&ServerError{Subsystem: subsystem, Port: port, Err: err})
+		}
+	}()
+	return server
+}
+
+// closeServer shuts the server of the subsystem down and refuses restarts from then on. In the graceful mode, in-flight
+// requests get the server timeout to complete before the server is closed, and the readiness server keeps failing
+// the readiness until the public server is done. Requests in critical sections keep the server open until the sections
+// are done or the critical deadline passed, after which the requests get the server timeout again to respond. The fast
+// mode closes the server right away.
+func (s *serviceImpl) closeServer(subsystem string) {
+	if subsystem == publicSubsystem {
+		defer close(s.publicClosed)
+	}
+
+	s.serverMutex.Lock()
+	s.stopping = true
+	server, ok := s.servers[subsystem]
+	s.serverMutex.Unlock()
+
+	if !ok {
+		return
+	}
+	if s.shutdownMode == ShutdownModeFast {
+		server.server.Close()
+		return
+	}
+
+	timeout := orDefaultDuration(s.serverTimeout, defaultServerTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if subsystem == readinessSubsystem {
+		select {
+		case <-s.publicClosed:
+		case <-ctx.Done():
+		}
+	}
+	err := server.server.Shutdown(ctx)
+	if err != nil && s.critical != nil && len(s.critical.Active()) > 0 {
+		s.waitForCriticalSections(s.criticalTimeout)
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		err = server.server.Shutdown(ctx)
+	}
+	if err != nil {
+		s.log.Warn(events.GracefulShutdown, "Closing %s server with in-flight requests after %v: %v", subsystem, timeout, err)
+		server.server.Close()
+	}
+}
+
+func (c *newConns) track(conn net.Conn, state http.ConnState) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if state == http.StateNew {
+		c.conns[conn] = struct{}{}
+		return
+	}
+	delete(c.conns, conn)
+}
+
+// close closes the connections that haven't sent a request yet. A request that arrives on them afterwards isn't
+// served, like a request on a connection that is accepted after the listener was closed.
+func (c *newConns) close() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for conn := range c.conns {
+		conn.Close()
+		delete(c.conns, conn)
+	}
+}
+
+func (s *serviceImpl) serverOptions(subsystem string) ServerOptions {
+	if s.serverOptionsFunc == nil {
+		return ServerOptions{}
+	}
+	return s.serverOptionsFunc(subsystem)
+}
+
+func (s *serviceImpl) setLastRestart(subsystem string, restart *ServerRestart) {
+	s.serverMutex.Lock()
+	defer s.serverMutex.Unlock()
+
+	if server, ok := s.servers[subsystem]; ok {
+		server.lastRestart = restart
+	}
+}
+
+// listenReplacement returns the listener of the replacement of the current server. On the address and port of the
+// current server, the socket of the current listener is duplicated, so the port is never bound twice. Otherwise, or
+// on platforms that can't duplicate sockets, the port is bound with address reuse, which is retried briefly.
+func (s *serviceImpl) listenReplacement(current *subsystemServer, address string, port int) (net.Listener, error) {
+	if addr, ok := current.listener.Addr().(*net.TCPAddr); ok && addr.Port == port &&
+		(address == current.address || (isWildcardAddress(address) && isWildcardAddress(current.address))) {
+		if listener, err := duplicateListener(current.listener); err == nil {
+			return listener, nil
+		}
+	}
+
+	var err error
+	for attempt := 1; attempt <= restartBindAttempts; attempt++ {
+		var listener net.Listener
+		if listener, err = listenReusable(address, port); err == nil {
+			return listener, nil
+		}
+		if attempt < restartBindAttempts {
+			time.Sleep(restartBindBackoff)
+		}
+	}
+	return nil, err
+}
+
+// listen binds the port on the address, or on all interfaces when it is empty. It fails when the port is in use, like
+// by a second instance of the service.
+func listen(address string, port int) (net.Listener, error) {
+	return net.Listen("tcp", net.JoinHostPort(address, strconv.Itoa(port)))
+}
+
+// listenReusable binds the port like listen, with address reuse, so a replacement server can bind a port on another
+// address while the old server still listens.
+func listenReusable(address string, port int) (net.Listener, error) {
+	config := net.ListenConfig{Control: reuseAddress}
+	return config.Listen(context.Background(), "tcp", net.JoinHostPort(address, strconv.Itoa(port)))
+}
+
+// duplicateListener returns a second listener on the socket of the listener, which keeps accepting connections after
+// the listener is closed. It fails on platforms that can't duplicate sockets, like Windows.
+func duplicateListener(listener net.Listener) (net.Listener, error) {
+	tcp, ok := listener.(*net.TCPListener)
+	if !ok {
+		return nil, fmt.Errorf("Listener %T can't be duplicated", listener)
+	}
+
+	file, err := tcp.File()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return net.FileListener(file)
+}
+
+// configuredAddress returns the bind address and port of the server of the subsystem, of which the ServerOptions
+// override the ones of the service.
+func (s *serviceImpl) configuredAddress(subsystem string, options ServerOptions) (string, int) {
+	var port int
+	switch subsystem {
+	case publicSubsystem:
+		port = s.port
+	case readinessSubsystem:
+		port = s.readinessPort
+	case internalSubsystem:
+		port = s.internalPort
+	}
+	address := s.bindAddresses[subsystem]
+
+	if options.Address != "" {
+		address = options.Address
+	}
+	if options.Port != 0 {
+		port = options.Port
+	}
+	return address, port
+}
+
+// validateAddresses returns an error when two servers are configured to listen on the same port and overlapping
+// addresses, which names both servers instead of failing on the bind of the second one.
+func (s *serviceImpl) validateAddresses(options map[string]ServerOptions) error {
+	subsystems := []string{publicSubsystem, readinessSubsystem, internalSubsystem}
+	for i, subsystem := range subsystems {
+		address, port := s.configuredAddress(subsystem, options[subsystem])
+		if port == 0 {
+			continue
+		}
+
+		for _, other := range subsystems[i+1:] {
+			otherAddress, otherPort := s.configuredAddress(other, options[other])
+			if port == otherPort && (address == otherAddress || isWildcardAddress(address) || isWildcardAddress(otherAddress)) {
+				return fmt.Errorf("the %s and %s servers are both configured to listen on port %d", subsystem, other, port)
+			}
+		}
+	}
+	return nil
+}
+
+func isWildcardAddress(address string) bool {
+	return address == "" || address == "0.0.0.0" || address == "::"
+}
+
+func orDefaultDuration(value, defaultValue time.Duration) time.Duration {
+	if value <= 0 {
+		return defaultValue
+	}
+	return value
+}
@@ -0,0 +1,47 @@
+//go:build linux && !mips && !mipsle && !mips64 && !mips64le
+// +build linux,!mips,!mipsle,!mips64,!mips64le
+
+package servicefoundation_test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"syscall"
+	"testing"
+
+	sf "github.com/Prutswonder/go-servicefoundation"
+	"github.com/Prutswonder/go-servicefoundation/servicetest"
+	"github.com/stretchr/testify/assert"
+)
+
+// listenShared binds the address with SO_REUSEADDR and SO_REUSEPORT, like another process that wants to share the port.
+func listenShared(address string) (net.Listener, error) {
+	config := net.ListenConfig{Control: func(_, _ string, conn syscall.RawConn) error {
+		return conn.Control(func(fd uintptr) {
+			syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+			syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, 0xf, 1)
+		})
+	}}
+	return config.Listen(context.Background(), "tcp", address)
+}
+
+func TestServiceImpl_ListenersAreNotShared(t *testing.T) {
+	t.Parallel()
+	sut := servicetest.StartService(t, sf.NewServiceOptions("exclusive", []string{http.MethodGet}, nil), nil)
+	assert.NoError(t, sut.RestartServer("internal"))
+
+	for _, subsystem := range []string{"public", "readiness", "internal"} {
+		// Act
+		listener, err := listenShared(sut.Addr(subsystem).String())
+
+		if !assert.Error(t, err, "the %s server shares its port", subsystem) {
+			listener.Close()
+		}
+	}
+	resp, err := http.Get(sut.Internal + "/health_check")
+	if assert.NoError(t, err, "the restarted server accepts on the socket of the old one") {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+}
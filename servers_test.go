@@ -0,0 +1,334 @@
+package servicefoundation_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	sf "github.com/Prutswonder/go-servicefoundation"
+	"github.com/Prutswonder/go-servicefoundation/servicetest"
+	"github.com/stretchr/testify/assert"
+)
+
+// poll requests the URL on new connections until stop is closed and returns the number of failed requests.
+func poll(url string, stop <-chan struct{}) (int, int) {
+	client := &http.Client{Timeout: time.Second, Transport: &http.Transport{DisableKeepAlives: true}}
+	succeeded, failed := 0, 0
+
+	for {
+		select {
+		case <-stop:
+			return succeeded, failed
+		default:
+		}
+
+		resp, err := client.Get(url)
+		if err != nil || resp.StatusCode != http.StatusOK {
+			failed++
+		} else {
+			succeeded++
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestServiceImpl_RestartServer(t *testing.T) {
+	t.Parallel()
+	var mutex sync.Mutex
+	requested := map[string]int{}
+	opt := sf.NewServiceOptions("restart", []string{http.MethodGet}, nil)
+	opt.ServerOptions = func(subsystem string) sf.ServerOptions {
+		mutex.Lock()
+		defer mutex.Unlock()
+		requested[subsystem]++
+		return sf.ServerOptions{IdleTimeout: time.Minute}
+	}
+	sut := servicetest.StartService(t, opt, nil)
+	address := sut.Addr("internal").String()
+	stop := make(chan struct{})
+	results := make(chan [2]int)
+	go func() {
+		succeeded, failed := poll(sut.Internal+"/health_check", stop)
+		results <- [2]int{succeeded, failed}
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// Act
+	err := sut.RestartServer("internal")
+
+	time.Sleep(50 * time.Millisecond)
+	close(stop)
+	result := <-results
+	assert.NoError(t, err)
+	assert.True(t, result[0] > 10, "requests succeed around the restart")
+	assert.True(t, result[1] <= 3, "at most a bounded blip, but %d requests failed", result[1])
+	assert.Equal(t, address, sut.Addr("internal").String(), "the restarted server keeps its address")
+	mutex.Lock()
+	assert.Equal(t, 2, requested["internal"], "the server is rebuilt from its current options")
+	mutex.Unlock()
+
+	servers := sut.Servers()
+	assert.NotNil(t, servers["internal"].LastRestart)
+	assert.Empty(t, servers["internal"].LastRestart.Error)
+	assert.Nil(t, servers["public"].LastRestart)
+}
+
+func TestServiceImpl_RestartServerOnChangedPort(t *testing.T) {
+	t.Parallel()
+	first, _ := net.Listen("tcp", ":0")
+	second, _ := net.Listen("tcp", "127.0.0.1:0")
+	initial, port := first.Addr().(*net.TCPAddr).Port, second.Addr().(*net.TCPAddr).Port
+	first.Close()
+	second.Close()
+	var mutex sync.Mutex
+	requested := 0
+	opt := sf.NewServiceOptions("restart-port", []string{http.MethodGet}, nil)
+	opt.ServerOptions = func(subsystem string) sf.ServerOptions {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if subsystem != "internal" {
+			return sf.ServerOptions{}
+		}
+		requested++
+		switch requested {
+		case 1:
+			return sf.ServerOptions{Port: initial}
+		case 2:
+			return sf.ServerOptions{Address: "127.0.0.1", Port: port}
+		}
+		return sf.ServerOptions{}
+	}
+	sut := servicetest.StartService(t, opt, nil)
+
+	// Act
+	changed := sut.RestartServer("internal")
+	kept := sut.RestartServer("internal")
+
+	assert.NoError(t, changed)
+	assert.NoError(t, kept)
+	addr := sut.Addr("internal").(*net.TCPAddr)
+	assert.Equal(t, port, addr.Port, "a later restart keeps the port the server was moved to")
+	assert.True(t, addr.IP.IsLoopback(), "a later restart keeps the address the server was moved to")
+	assert.Equal(t, fmt.Sprintf("127.0.0.1:%d", port), sut.Servers()["internal"].Address)
+}
+
+func TestRestartServerHandler(t *testing.T) {
+	t.Parallel()
+	sut := servicetest.StartService(t, sf.NewServiceOptions("restart", []string{http.MethodGet}, nil), nil)
+
+	tests := []struct {
+		path     string
+		expected int
+	}{
+		{"/service/servers/public/restart", http.StatusBadRequest},
+		{"/service/servers/public/restart?confirm=true", http.StatusOK},
+		{"/service/servers/readiness/restart", http.StatusOK},
+		{"/service/servers/other/restart", http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		// Act
+		resp, err := http.Post(sut.Internal+test.path, "", nil)
+
+		if assert.NoError(t, err, test.path) {
+			resp.Body.Close()
+			assert.Equal(t, test.expected, resp.StatusCode, test.path)
+		}
+	}
+
+	resp, err := http.Get(sut.Internal + "/service/info")
+	assert.NoError(t, err)
+	var info struct {
+		Servers map[string]sf.ServerInfo `json:"servers"`
+	}
+	json.NewDecoder(resp.Body).Decode(&info)
+	resp.Body.Close()
+	assert.NotNil(t, info.Servers["public"].LastRestart)
+	assert.NotNil(t, info.Servers["readiness"].LastRestart)
+	assert.Nil(t, info.Servers["internal"].LastRestart)
+
+	sut.Stop()
+	assert.Equal(t, sf.ErrShuttingDown, sut.RestartServer("internal"), "restarts are refused during shutdown")
+}
+
+func TestNewServiceOptions_PortsAndBindAddresses(t *testing.T) {
+	tests := []struct {
+		env                   map[string]string
+		expectedPorts         [3]int
+		expectedEphemeral     bool
+		expectedBindAddresses [3]string
+	}{
+		{map[string]string{"HTTPPORT": "9000"}, [3]int{9000, 9001, 9002}, false, [3]string{}},
+		{map[string]string{"HTTPPORT": "9000", "INTERNAL_PORT": "7100"}, [3]int{9000, 9001, 7100}, false, [3]string{}},
+		{map[string]string{"HTTPPORT": "0"}, [3]int{0, 0, 0}, true, [3]string{}},
+		{map[string]string{"HTTPPORT": "0", "READINESS_PORT": "7000"}, [3]int{0, 7000, 0}, false, [3]string{}},
+		{map[string]string{"HTTPPORT": "9000", "READINESS_BIND_ADDRESS": "127.0.0.1", "INTERNAL_BIND_ADDRESS": "127.0.0.1"},
+			[3]int{9000, 9001, 9002}, false, [3]string{"", "127.0.0.1", "127.0.0.1"}},
+	}
+
+	for _, test := range tests {
+		for key, value := range test.env {
+			os.Setenv(key, value)
+		}
+
+		// Act
+		opt := sf.NewServiceOptions("ports", []string{http.MethodGet}, nil)
+
+		for key := range test.env {
+			os.Unsetenv(key)
+		}
+		assert.Equal(t, test.expectedPorts, [3]int{opt.Port, opt.ReadinessPort, opt.InternalPort}, "%v", test.env)
+		assert.Equal(t, test.expectedEphemeral, opt.EphemeralPorts, "%v", test.env)
+		assert.Equal(t, test.expectedBindAddresses,
+			[3]string{opt.BindAddress, opt.ReadinessBindAddress, opt.InternalBindAddress}, "%v", test.env)
+	}
+}
+
+func TestServiceImpl_BindAddresses(t *testing.T) {
+	opt := sf.NewServiceOptions("bind", []string{http.MethodGet}, nil)
+	opt.ReadinessBindAddress = "127.0.0.1"
+	opt.ServerOptions = func(subsystem string) sf.ServerOptions {
+		if subsystem == "internal" {
+			return sf.ServerOptions{Address: "127.0.0.1", WriteTimeout: time.Minute}
+		}
+		return sf.ServerOptions{}
+	}
+
+	// Act
+	sut := servicetest.StartService(t, opt, nil)
+
+	assert.True(t, sut.Addr("internal").(*net.TCPAddr).IP.IsLoopback())
+	assert.True(t, sut.Addr("readiness").(*net.TCPAddr).IP.IsLoopback())
+	assert.True(t, sut.Addr("public").(*net.TCPAddr).IP.IsUnspecified())
+	resp, err := http.Get(sut.Internal + "/health_check")
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+}
+
+func TestServiceImpl_RunFailsOnPortConflicts(t *testing.T) {
+	tests := []struct {
+		configure func(opt *sf.ServiceOptions, port int)
+		expected  string
+	}{
+		{func(opt *sf.ServiceOptions, port int) {
+			opt.Port, opt.ReadinessPort = port, port
+		}, "the public and readiness servers are both configured to listen on port %d"},
+		{func(opt *sf.ServiceOptions, port int) {
+			opt.Port, opt.ReadinessBindAddress = port, "127.0.0.1"
+			opt.ServerOptions = func(subsystem string) sf.ServerOptions {
+				if subsystem == "readiness" {
+					return sf.ServerOptions{Port: port}
+				}
+				return sf.ServerOptions{}
+			}
+		}, "the public and readiness servers are both configured to listen on port %d"},
+		{func(opt *sf.ServiceOptions, port int) {
+			opt.InternalPort, opt.ReadinessPort = port, port
+			opt.ReadinessBindAddress, opt.InternalBindAddress = "127.0.0.1", "127.0.0.1"
+		}, "the readiness and internal servers are both configured to listen on port %d"},
+	}
+
+	const port = 9090
+
+	for _, test := range tests {
+		opt := sf.NewServiceOptions("conflict", []string{http.MethodGet}, nil)
+		opt.Port, opt.ReadinessPort, opt.InternalPort = 0, 0, 0
+		test.configure(&opt, port)
+		sut := sf.NewCustomService(opt)
+
+		// Act
+		err := sut.Run(context.Background())
+
+		assert.EqualError(t, err, fmt.Sprintf(test.expected, port))
+		assert.Nil(t, sut.Addr("public"), "the servers are not started")
+	}
+}
+
+func TestServiceImpl_RunFailsWhenPortIsInUse(t *testing.T) {
+	running := servicetest.StartService(t, sf.NewServiceOptions("first", []string{http.MethodGet}, nil), nil)
+	port := running.Addr("public").(*net.TCPAddr).Port
+	exitCodes := make(chan int, 1)
+	opt := sf.NewServiceOptions("second", []string{http.MethodGet}, nil)
+	opt.Port, opt.ReadinessPort, opt.InternalPort = port, 0, 0
+	opt.ExitFunc = func(code int) { exitCodes <- code }
+	opt.ForceExitFunc = func(int) {}
+	sut := sf.NewCustomService(opt)
+	returned := make(chan error, 1)
+
+	// Act
+	go func() { returned <- sut.Run(context.Background()) }()
+
+	select {
+	case err := <-returned:
+		assert.True(t, errors.Is(err, sf.ErrServerStopped))
+		var serverErr *sf.ServerError
+		if assert.True(t, errors.As(err, &serverErr), "%v", err) {
+			assert.Equal(t, "public", serverErr.Subsystem)
+			assert.Equal(t, port, serverErr.Port)
+		}
+		assert.Nil(t, sut.Addr("public"))
+		for _, subsystem := range []string{"readiness", "internal"} {
+			if addr := sut.Addr(subsystem); addr != nil {
+				_, err := net.Dial("tcp", addr.String())
+				assert.Error(t, err, "the %s server is closed", subsystem)
+			}
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return on the port that is in use")
+	}
+	resp, err := http.Get(running.Public + "/service/liveness")
+	if assert.NoError(t, err, "the first service keeps running") {
+		resp.Body.Close()
+	}
+
+	sut = sf.NewCustomService(opt)
+	sut.RunAndExit(context.Background())
+	assert.Equal(t, 1, <-exitCodes)
+}
+
+func TestServiceImpl_RunClosesAllListeners(t *testing.T) {
+	opt := sf.NewServiceOptions("listeners", []string{http.MethodGet}, nil)
+	opt.EphemeralPorts = true
+	opt.ShutdownMode = sf.ShutdownModeGraceful
+	opt.ForceExitFunc = func(int) {}
+	sut := sf.NewCustomService(opt)
+	ctx, cancel := context.WithCancel(context.Background())
+	returned := make(chan error, 1)
+	go func() { returned <- sut.Run(ctx) }()
+	subsystems := []string{"public", "readiness", "internal"}
+	addresses := map[string]string{}
+	for len(addresses) < len(subsystems) {
+		for _, subsystem := range subsystems {
+			if addr := sut.Addr(subsystem); addr != nil {
+				addresses[subsystem] = addr.String()
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// Act
+	cancel()
+
+	select {
+	case err := <-returned:
+		assert.NoError(t, err)
+		for subsystem, address := range addresses {
+			_, err := net.Dial("tcp", address)
+			assert.Error(t, err, "the %s server is closed", subsystem)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return")
+	}
+}
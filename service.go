@@ -2,28 +2,156 @@ package servicefoundation
 
 import (
 	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/Prutswonder/go-servicefoundation/env"
+	"github.com/Prutswonder/go-servicefoundation/events"
 )
 
 const (
 	envCORSOrigins       string = "CORS_ORIGINS"
 	envHTTPpPort         string = "HTTPPORT"
 	envLogMinFilter      string = "LOG_MINFILTER"
+	envLogSinks          string = "LOG_SINKS"
+	envLogFormat         string = "LOG_FORMAT"
+	envRouteBudgets      string = "ROUTE_BUDGETS"
+	envResponseShapesDir string = "RESPONSE_SHAPES_DIR"
 	envAppName           string = "APP_NAME"
 	envServerName        string = "SERVER_NAME"
 	envDeployEnvironment string = "DEPLOY_ENVIRONMENT"
+	envShutdownMode      string = "SHUTDOWN_MODE"
+	envAPIKeys           string = "API_KEYS"
+	envMetricsPushURL    string = "METRICS_PUSH_URL"
+	envMetricsPushFormat string = "METRICS_PUSH_FORMAT"
+	envMetricsPushEvery  string = "METRICS_PUSH_INTERVAL"
+	envSyntheticSources  string = "SYNTHETIC_SOURCES"
+	envSyntheticCIDRs    string = "SYNTHETIC_CIDRS"
+	envSyntheticTrusted  string = "SYNTHETIC_TRUSTED_CIDRS"
+	envSyntheticPolicy   string = "SYNTHETIC_POLICY"
+	envSyntheticMax      string = "SYNTHETIC_MAX_CONCURRENT"
+	envSelfTest          string = "SELFTEST"
+	envBaggageKeys       string = "BAGGAGE_KEYS"
+	envBaggageLegacy     string = "BAGGAGE_LEGACY_HEADERS"
+	envBaggageLogKeys    string = "BAGGAGE_LOG_KEYS"
+	envBaggageMetricKeys string = "BAGGAGE_METRIC_KEYS"
+	envTLSCertFile       string = "TLS_CERT_FILE"
+	envTLSKeyFile        string = "TLS_KEY_FILE"
+	envTLSSubsystems     string = "TLS_SUBSYSTEMS"
+	envHealthTimeout     string = "HEALTH_CHECK_TIMEOUT"
+	envHealthCache       string = "HEALTH_CACHE_INTERVAL"
+	envRequestIDHeader   string = "REQUEST_ID_HEADER"
+	envReadinessPort     string = "READINESS_PORT"
+	envInternalPort      string = "INTERNAL_PORT"
+	envBindAddress       string = "BIND_ADDRESS"
+	envReadinessBind     string = "READINESS_BIND_ADDRESS"
+	envInternalBind      string = "INTERNAL_BIND_ADDRESS"
+	envEnablePprof       string = "ENABLE_PPROF"
+	envHistogramBuckets  string = "METRICS_HISTOGRAM_BUCKETS"
+	envInternalToken     string = "INTERNAL_AUTH_TOKEN"
+	envInternalMetrics   string = "INTERNAL_AUTH_METRICS"
+	envDisableQuit       string = "DISABLE_QUIT"
+	envQuitMethods       string = "QUIT_METHODS"
 
 	defaultHTTPPort     int    = 8080
 	defaultLogMinFilter string = "Warning"
 
-	publicSubsystem = "public"
+	publicSubsystem    = "public"
+	readinessSubsystem = "readiness"
+	internalSubsystem  = "internal"
+)
+
+// The environment variables that configure a Service, which are listed by ConfigSpec.
+var (
+	corsOriginsVariable = env.Register(envCORSOrigins, env.TypeList, "*", "Comma-separated list of CORS origins")
+	httpPortVariable    = env.Register(envHTTPpPort, env.TypeInt, strconv.Itoa(defaultHTTPPort),
+		"Port used for exposing the public endpoint, with the readiness and internal endpoints on the next two ports, or 0 for three ephemeral ports")
+	logMinFilterVariable = env.Register(envLogMinFilter, env.TypeString, defaultLogMinFilter, "Minimum filter for log writing")
+	logSinksVariable     = env.Register(envLogSinks, env.TypeString, "",
+		"Log sinks, like stdout=json@info,ring=500@debug,file=/var/log/app.log (default: stdout)")
+	logFormatVariable = env.Register(envLogFormat, env.TypeString, "text",
+		"Format of the stdout log and the log sinks without a format: text, or json for one JSON document per line")
+	routeBudgetsVariable = env.Register(envRouteBudgets, env.TypeString, "",
+		"Route budgets, like checkout=800ms:inventory=300ms:payment=400ms;search=200ms")
+	responseShapesDirVariable = env.Register(envResponseShapesDir, env.TypeString, "",
+		"Directory with the golden response shapes per route, which are checked outside production")
+	appNameVariable           = env.Register(envAppName, env.TypeString, "", "Name of the application (default: name of the service)")
+	serverNameVariable        = env.Register(envServerName, env.TypeString, "", "Name of the server instance (default: name of the service)")
+	deployEnvironmentVariable = env.Register(envDeployEnvironment, env.TypeString, "UNKNOWN", "Name of the deployment environment")
+	shutdownModeVariable      = env.Register(envShutdownMode, env.TypeString, "",
+		"graceful or fast (default: fast for development, dev and local, otherwise graceful)")
+	metricsPushURLVariable = env.Register(envMetricsPushURL, env.TypeString, "",
+		"Pushgateway or remote-write URL to push the metrics to, for environments where they can't be scraped")
+	metricsPushFormatVariable = env.Register(envMetricsPushFormat, env.TypeString, PushFormatPushgateway,
+		"Format of the metrics push: pushgateway or remote_write")
+	metricsPushIntervalVariable = env.Register(envMetricsPushEvery, env.TypeString, defaultMetricsPushInterval.String(),
+		"Interval of the metrics push")
+	syntheticSourcesVariable = env.Register(envSyntheticSources, env.TypeList, "",
+		"Comma-separated list of X-Synthetic-Source header values that mark synthetic requests, like uptime monitors and load tests")
+	syntheticCIDRsVariable = env.Register(envSyntheticCIDRs, env.TypeList, "",
+		"Comma-separated list of client networks of which all requests are synthetic")
+	syntheticTrustedVariable = env.Register(envSyntheticTrusted, env.TypeList, "",
+		"Comma-separated list of peer networks from which the X-Synthetic-Source and X-Forwarded-For headers are trusted")
+	syntheticPolicyVariable = env.Register(envSyntheticPolicy, env.TypeString, string(SyntheticPolicyLabel),
+		"label to record synthetic requests with a synthetic label, or exclude to leave them out of the request metrics")
+	syntheticMaxVariable = env.Register(envSyntheticMax, env.TypeInt, "0",
+		"Maximum number of concurrent synthetic requests, or 0 for no maximum")
+	selfTestVariable = env.Register(envSelfTest, env.TypeBool, "false",
+		"1 to run the self-test instead of the service, which writes its report to stdout and exits with 1 when it fails")
+	baggageKeysVariable = env.Register(envBaggageKeys, env.TypeList, "",
+		"Comma-separated list of the baggage keys that are accepted from inbound requests")
+	baggageLegacyVariable = env.Register(envBaggageLegacy, env.TypeList, "",
+		"Comma-separated list of legacy headers with their baggage key, like X-Tenant-ID=tenant")
+	baggageLogKeysVariable = env.Register(envBaggageLogKeys, env.TypeList, "",
+		"Comma-separated list of the baggage keys that are added to the request logging")
+	baggageMetricKeysVariable = env.Register(envBaggageMetricKeys, env.TypeList, "",
+		"Comma-separated list of the baggage keys that label the request metrics with their allowed values, like experiment=control|variant")
+	tlsCertFileVariable = env.Register(envTLSCertFile, env.TypeString, "",
+		"PEM certificate file of the servers that use TLS, which fails the startup when it can't be loaded")
+	tlsKeyFileVariable = env.Register(envTLSKeyFile, env.TypeString, "",
+		"PEM key file of the TLS certificate")
+	tlsSubsystemsVariable = env.Register(envTLSSubsystems, env.TypeList, publicSubsystem,
+		"Comma-separated list of the servers that use TLS when a certificate is configured: public, readiness and internal")
+	healthTimeoutVariable = env.Register(envHealthTimeout, env.TypeString, defaultHealthCheckTimeout.String(),
+		"Timeout of the health and readiness checks that are added to the service")
+	healthCacheVariable = env.Register(envHealthCache, env.TypeString, "0s",
+		"Interval for which the results of the health and readiness checks are reused, or 0s to run them on every request")
+	requestIDHeaderVariable = env.Register(envRequestIDHeader, env.TypeString, RequestIDHeader,
+		"Header of the request ID, which is read from requests, set on responses and propagated by the clients")
+	readinessPortVariable = env.Register(envReadinessPort, env.TypeInt, "",
+		"Port of the readiness endpoints (default: HTTPPORT+1)")
+	internalPortVariable = env.Register(envInternalPort, env.TypeInt, "",
+		"Port of the internal endpoints (default: HTTPPORT+2)")
+	bindAddressVariable = env.Register(envBindAddress, env.TypeString, "",
+		"Address the public server binds to, like 127.0.0.1 (default: all interfaces)")
+	readinessBindVariable = env.Register(envReadinessBind, env.TypeString, "",
+		"Address the readiness server binds to (default: all interfaces)")
+	internalBindVariable = env.Register(envInternalBind, env.TypeString, "",
+		"Address the internal server binds to (default: all interfaces)")
+	enablePprofVariable = env.Register(envEnablePprof, env.TypeBool, "false",
+		"true to serve the pprof and expvar endpoints under /debug/ on the internal server")
+	histogramBucketsVariable = env.Register(envHistogramBuckets, env.TypeString, "",
+		"Comma-separated upper bounds of the histogram buckets in seconds, like 0.005,0.01,0.05,0.1,0.5,1,5 (default: the Prometheus buckets)")
+	internalTokenVariable = env.Register(envInternalToken, env.TypeString, "",
+		"Shared token of the operational internal endpoints, like /quit, as Authorization: Bearer <token> or X-Internal-Token header (default: no authentication)")
+	internalMetricsVariable = env.Register(envInternalMetrics, env.TypeBool, "false",
+		"true to require the INTERNAL_AUTH_TOKEN for /metrics too")
+	disableQuitVariable = env.Register(envDisableQuit, env.TypeBool, "false",
+		"true to leave the /quit endpoint out of the internal server")
+	quitMethodsVariable = env.Register(envQuitMethods, env.TypeList, http.MethodGet,
+		"Comma-separated list of the methods of the /quit endpoint, like POST to keep prefetchers and scanners from triggering it")
 )
 
 type (
@@ -41,21 +169,57 @@ type (
 	// ServiceOptions contains value and references used by the Service implementation. The contents of ServiceOptions
 	// can be used to customize or extend ServiceFoundation.
 	ServiceOptions struct {
-		Globals            ServiceGlobals
-		Port               int
-		ReadinessPort      int
-		InternalPort       int
-		Logger             Logger
-		Metrics            Metrics
-		RouterFactory      RouterFactory
-		MiddlewareWrapper  MiddlewareWrapper
-		Handlers           *Handlers
-		WrapHandler        WrapHandler
-		VersionBuilder     VersionBuilder
-		ServiceStateReader ServiceStateReader
-		ShutdownFunc       ShutdownFunc
-		ExitFunc           ExitFunc
-		ServerTimeout      time.Duration
+		Globals              ServiceGlobals
+		Port                 int
+		ReadinessPort        int
+		InternalPort         int
+		BindAddress          string
+		ReadinessBindAddress string
+		InternalBindAddress  string
+		EphemeralPorts       bool
+		ServerOptions        func(subsystem string) ServerOptions
+		Logger               Logger
+		Metrics              Metrics
+		RouterFactory        RouterFactory
+		MiddlewareWrapper    MiddlewareWrapper
+		Handlers             *Handlers
+		WrapHandler          WrapHandler
+		VersionBuilder       VersionBuilder
+		ServiceStateReader   ServiceStateReader
+		ShutdownFunc         ShutdownFunc
+		ExitFunc             ExitFunc
+		ForceExitFunc        ExitFunc
+		ShutdownMode         ShutdownMode
+		ServerTimeout        time.Duration
+		TaskQueue            TaskQueue
+		ShadowComparer       ShadowComparer
+		CriticalSections     CriticalSections
+		CriticalDeadline     time.Duration
+		ClientFactory        ClientFactory
+		LogBuffer            RingBufferSink
+		LatencyBaselines     LatencyBaselines
+		Profiler             Profiler
+		Budgets              Budgets
+		Scheduler            Scheduler
+		Drainer              Drainer
+		ErrorReporter        ErrorReporter
+		ErrorReporting       ErrorReportingOptions
+		ResponseShapes       *ResponseShapeOptions
+		Quotas               QuotaManager
+		Events               EventRegistry
+		Buffers              BufferPool
+		MetricsPusher        MetricsPusher
+		SyntheticTraffic     MiddlewareFunc
+		Baggage              MiddlewareFunc
+		Runbooks             map[string]string
+		LazyResources        LazyResources
+		TLS                  TLSOptions
+		HealthRegistry       HealthRegistry
+		EnablePprof          bool
+		Compression          CompressionOptions
+		InternalAuth         InternalAuthOptions
+		DisableQuit          bool
+		QuitMethods          []string
 	}
 
 	// ServiceStateReader contains state methods used by the service's handler implementations.
@@ -67,42 +231,96 @@ type (
 
 	// Service is the main interface for ServiceFoundation and is used to define routing and running the service.
 	Service interface {
-		Run(ctx context.Context)
+		RouteRegistry
+		ServerManager
+		Run(ctx context.Context) error
+		RunAndExit(ctx context.Context)
+		Addr(subsystem string) net.Addr
 		AddRoute(name string, routes []string, methods []string, middlewares []Middleware, handler Handle)
+		AddRouteWithMetadata(name string, routes []string, methods []string, middlewares []Middleware, metadata RouteMetadata, handler Handle)
+		AddInternalRoute(name string, routes []string, methods []string, middlewares []Middleware, handler Handle)
+		AddReadinessRoute(name string, routes []string, methods []string, middlewares []Middleware, handler Handle)
+		AddHealthCheck(name string, check CheckFunc)
+		AddReadinessCheck(name string, check CheckFunc)
 	}
 
 	serviceStateReaderImpl struct {
 	}
 
 	serviceImpl struct {
-		globals         ServiceGlobals
-		serverTimeout   time.Duration
-		port            int
-		readinessPort   int
-		internalPort    int
-		log             Logger
-		metrics         Metrics
-		publicRouter    *Router
-		readinessRouter *Router
-		internalRouter  *Router
-		handlers        *Handlers
-		wrapHandler     WrapHandler
-		versionBuilder  VersionBuilder
-		stateReader     ServiceStateReader
-		shutdownFunc    ShutdownFunc
-		exitFunc        ExitFunc
-		quitting        bool
-		sendChan        chan bool
-		receiveChan     chan bool
-	}
-
-	serverInstance struct {
-		shutdownChan chan bool
+		globals           ServiceGlobals
+		serverTimeout     time.Duration
+		port              int
+		readinessPort     int
+		internalPort      int
+		bindAddresses     map[string]string
+		log               Logger
+		metrics           Metrics
+		publicRouter      *Router
+		readinessRouter   *Router
+		internalRouter    *Router
+		handlers          *Handlers
+		wrapHandler       WrapHandler
+		versionBuilder    VersionBuilder
+		stateReader       ServiceStateReader
+		shutdownFunc      ShutdownFunc
+		exitFunc          ExitFunc
+		forceExitFunc     ExitFunc
+		shutdownMode      ShutdownMode
+		taskQueue         TaskQueue
+		shadowComparer    ShadowComparer
+		critical          CriticalSections
+		criticalTimeout   time.Duration
+		criticalOnce      sync.Once
+		logBuffer         RingBufferSink
+		latency           LatencyBaselines
+		profiler          Profiler
+		budgets           Budgets
+		scheduler         Scheduler
+		drainer           Drainer
+		reporter          ErrorReporter
+		responseShapes    *ResponseShapeOptions
+		quotas            QuotaManager
+		events            EventRegistry
+		pusher            MetricsPusher
+		lazy              LazyResources
+		tls               TLSOptions
+		tlsConfig         *tls.Config
+		healthRegistry    HealthRegistry
+		enablePprof       bool
+		internalAuth      InternalAuthOptions
+		disableQuit       bool
+		quitMethods       []string
+		operations        *operationsCatalogImpl
+		selfTests         []selfTestRoute
+		selfTesting       bool
+		routeNames        []string
+		routes            []RouteInfo
+		routesOnce        sync.Once
+		routesRegistered  bool
+		pendingRoutes     []func()
+		routePaths        map[*Router]map[string][]string
+		serverMutex       sync.Mutex
+		restartMutex      sync.Mutex
+		servers           map[string]*subsystemServer
+		serverOptionsFunc func(subsystem string) ServerOptions
+		stopping          bool
+		quitting          bool
+		serversClosed     sync.WaitGroup
+		publicClosed      chan struct{}
+		stopServers       chan struct{}
+		serverStopped     chan error
+		quitChan          chan bool
 	}
 )
 
-// DefaultMiddlewares contains the default middleware wrappers for the predefined service endpoints.
-var DefaultMiddlewares = []Middleware{PanicTo500, RequestLogging, NoCaching}
+// DefaultMiddlewares contains the default middleware wrappers for the predefined service endpoints. RequestID is the
+// last one, so the ID is available to the others.
+var DefaultMiddlewares = []Middleware{PanicTo500, RequestLogging, NoCaching, RequestID}
+
+// ErrServerStopped is matched by the ServerError that Run returns when one of the servers stopped unexpectedly, like
+// when it failed to listen.
+var ErrServerStopped = errors.New("a server stopped unexpectedly")
 
 // NewService creates and returns a Service that uses environment variables for default configuration.
 func NewService(name string, allowedMethods []string, shutdownFunc ShutdownFunc) Service {
@@ -113,16 +331,22 @@ func NewService(name string, allowedMethods []string, shutdownFunc ShutdownFunc)
 
 // NewServiceOptions creates and returns ServiceOptions that use environment variables for default configuration.
 func NewServiceOptions(name string, allowedMethods []string, shutdownFunc ShutdownFunc) ServiceOptions {
-	appName := env.OrDefault(envAppName, name)
-	serverName := env.OrDefault(envServerName, name)
-	deployEnvironment := env.OrDefault(envDeployEnvironment, "UNKNOWN")
+	appName := appNameVariable.OrDefault(name)
+	serverName := serverNameVariable.OrDefault(name)
+	deployEnvironment := deployEnvironmentVariable.String()
 	corsOptions := CORSOptions{
-		AllowedOrigins: env.ListOrDefault(envCORSOrigins, []string{"*"}),
+		AllowedOrigins: corsOriginsVariable.List(),
 		AllowedMethods: allowedMethods,
 	}
-	logger := NewLogger(env.OrDefault(envLogMinFilter, defaultLogMinFilter))
-	metrics := NewMetrics(name, logger)
-	versionBuilder := NewVersionBuilder()
+	logger, logBuffer := newServiceLogger(logMinFilterVariable.String(), logSinksVariable.String(), ServiceGlobals{
+		AppName:           appName,
+		ServerName:        serverName,
+		DeployEnvironment: deployEnvironment,
+	})
+	eventRegistry := NewEventRegistry(events.Foundation...)
+	// Outside production, unregistered events and unexpected levels are reported to keep the event taxonomy consistent.
+	logger = NewEventLogger(logger, eventRegistry, !strings.EqualFold(deployEnvironment, productionEnvironment))
+	metrics := newEnvMetrics(name, logger)
 	version := NewBuildVersion()
 	globals := ServiceGlobals{
 		AppName:           appName,
@@ -130,24 +354,76 @@ func NewServiceOptions(name string, allowedMethods []string, shutdownFunc Shutdo
 		DeployEnvironment: deployEnvironment,
 		VersionNumber:     version.VersionNumber,
 	}
+	versionBuilder := NewServiceVersionBuilder(version, globals)
 	middlewareWrapper := NewMiddlewareWrapper(logger, metrics, &corsOptions, globals)
 	stateReader := NewServiceStateReader()
-	exitFunc := NewExitFunc(logger, shutdownFunc)
-	port := env.AsInt(envHTTPpPort, defaultHTTPPort)
+	shutdownMode := ResolveShutdownMode(shutdownModeVariable.String(), deployEnvironment)
+	port := httpPortVariable.Int()
+	readinessPort, internalPort := port+1, port+2
+	if port == 0 {
+		readinessPort, internalPort = 0, 0
+	}
+	if readinessPortVariable.IsSet() {
+		readinessPort = readinessPortVariable.Int()
+	}
+	if internalPortVariable.IsSet() {
+		internalPort = internalPortVariable.Int()
+	}
+	// Port 0 lets all three servers bind an ephemeral port, unless their ports are configured separately.
+	ephemeralPorts := port == 0 && !readinessPortVariable.IsSet() && !internalPortVariable.IsSet()
+
+	budgets, err := ParseBudgets(routeBudgetsVariable.String())
+	if err != nil {
+		logger.Error(events.RouteBudgets, "Failed parsing route budgets: %v", err)
+	}
 
 	opt := ServiceOptions{
-		Globals:            globals,
-		ServerTimeout:      time.Second * 20,
-		Port:               port,
-		ReadinessPort:      port + 1,
-		InternalPort:       port + 2,
-		MiddlewareWrapper:  middlewareWrapper,
-		RouterFactory:      NewRouterFactory(),
-		Logger:             logger,
-		Metrics:            metrics,
-		VersionBuilder:     versionBuilder,
-		ServiceStateReader: stateReader,
-		ExitFunc:           exitFunc,
+		Globals:              globals,
+		ServerTimeout:        time.Second * 20,
+		Port:                 port,
+		ReadinessPort:        readinessPort,
+		InternalPort:         internalPort,
+		BindAddress:          bindAddressVariable.String(),
+		ReadinessBindAddress: readinessBindVariable.String(),
+		InternalBindAddress:  internalBindVariable.String(),
+		EphemeralPorts:       ephemeralPorts,
+		MiddlewareWrapper:    middlewareWrapper,
+		RouterFactory:        NewRouterFactory(),
+		Logger:               logger,
+		Metrics:              metrics,
+		VersionBuilder:       versionBuilder,
+		ServiceStateReader:   stateReader,
+		ShutdownFunc:         shutdownFunc,
+		ExitFunc:             os.Exit,
+		ForceExitFunc:        os.Exit,
+		ShutdownMode:         shutdownMode,
+		CriticalSections:     NewCriticalSections(logger, metrics, 0),
+		CriticalDeadline:     defaultCriticalDeadline,
+		ClientFactory:        NewClientFactory(ClientOptions{Metrics: metrics}),
+		LogBuffer:            logBuffer,
+		Budgets:              budgets,
+		Drainer:              NewDrainer(DrainOptions{HardDeadline: defaultCriticalDeadline}, nil),
+		ErrorReporter:        NewNoopErrorReporter(),
+		ResponseShapes:       NewResponseShapeOptions(deployEnvironment, responseShapesDirVariable.String(), true),
+		Events:               eventRegistry,
+		Buffers:              NewBufferPool(BufferPoolOptions{Development: isDevelopmentEnvironment(deployEnvironment)}, logger, metrics),
+		MetricsPusher:        newEnvMetricsPusher(globals, logger, metrics),
+		SyntheticTraffic:     newEnvSyntheticTrafficMiddleware(logger, metrics),
+		Baggage:              newEnvBaggageMiddleware(logger, metrics),
+		LazyResources:        NewLazyResources(LazyResourcesOptions{}, logger, metrics),
+		HealthRegistry:       newEnvHealthRegistry(logger, metrics),
+		EnablePprof:          enablePprofVariable.Bool(),
+		InternalAuth: InternalAuthOptions{
+			Token:          internalTokenVariable.String(),
+			ProtectMetrics: internalMetricsVariable.Bool(),
+		},
+		DisableQuit: disableQuitVariable.Bool(),
+		QuitMethods: quitMethodsVariable.List(),
+		TLS: TLSOptions{
+			CertFile:   tlsCertFileVariable.String(),
+			KeyFile:    tlsKeyFileVariable.String(),
+			Subsystems: tlsSubsystemsVariable.List(),
+		},
 	}
 	opt.SetHandlers()
 	return opt
@@ -155,36 +431,93 @@ func NewServiceOptions(name string, allowedMethods []string, shutdownFunc Shutdo
 
 // NewCustomService allows you to customize ServiceFoundation using your own implementations of factories.
 func NewCustomService(options ServiceOptions) Service {
+	reporter := options.ErrorReporter
+	if reporter == nil {
+		reporter = NewNoopErrorReporter()
+	}
+	exitFunc := options.ExitFunc
+	if exitFunc == nil {
+		exitFunc = os.Exit
+	}
+	forceExitFunc := options.ForceExitFunc
+	if forceExitFunc == nil {
+		forceExitFunc = os.Exit
+	}
+	shutdownMode := options.ShutdownMode
+	if shutdownMode == "" {
+		shutdownMode = ShutdownModeGraceful
+	}
+	if options.EphemeralPorts {
+		options.Port, options.ReadinessPort, options.InternalPort = 0, 0, 0
+	}
+
 	return &serviceImpl{
-		globals:         options.Globals,
-		serverTimeout:   options.ServerTimeout,
-		port:            options.Port,
-		readinessPort:   options.ReadinessPort,
-		internalPort:    options.InternalPort,
-		log:             options.Logger,
-		metrics:         options.Metrics,
-		publicRouter:    options.RouterFactory.NewRouter(),
-		readinessRouter: options.RouterFactory.NewRouter(),
-		internalRouter:  options.RouterFactory.NewRouter(),
-		handlers:        options.Handlers,
-		wrapHandler:     options.WrapHandler,
-		versionBuilder:  options.VersionBuilder,
-		stateReader:     options.ServiceStateReader,
-		exitFunc:        options.ExitFunc,
-		sendChan:        make(chan bool, 1),
-		receiveChan:     make(chan bool, 1),
+		globals:       options.Globals,
+		serverTimeout: options.ServerTimeout,
+		port:          options.Port,
+		readinessPort: options.ReadinessPort,
+		internalPort:  options.InternalPort,
+		bindAddresses: map[string]string{
+			publicSubsystem:    options.BindAddress,
+			readinessSubsystem: options.ReadinessBindAddress,
+			internalSubsystem:  options.InternalBindAddress,
+		},
+		log:               options.Logger,
+		metrics:           options.Metrics,
+		publicRouter:      options.RouterFactory.NewRouter(),
+		readinessRouter:   options.RouterFactory.NewRouter(),
+		internalRouter:    options.RouterFactory.NewRouter(),
+		handlers:          options.Handlers,
+		wrapHandler:       options.WrapHandler,
+		versionBuilder:    options.VersionBuilder,
+		stateReader:       options.ServiceStateReader,
+		shutdownFunc:      options.ShutdownFunc,
+		exitFunc:          exitFunc,
+		forceExitFunc:     forceExitFunc,
+		shutdownMode:      shutdownMode,
+		taskQueue:         options.TaskQueue,
+		shadowComparer:    options.ShadowComparer,
+		critical:          options.CriticalSections,
+		criticalTimeout:   options.CriticalDeadline,
+		logBuffer:         options.LogBuffer,
+		latency:           options.LatencyBaselines,
+		profiler:          options.Profiler,
+		budgets:           options.Budgets,
+		scheduler:         options.Scheduler,
+		drainer:           options.Drainer,
+		reporter:          NewAsyncErrorReporter(reporter, options.ErrorReporting, options.Globals, options.Logger, options.Metrics),
+		responseShapes:    options.ResponseShapes,
+		quotas:            options.Quotas,
+		events:            options.Events,
+		pusher:            options.MetricsPusher,
+		lazy:              options.LazyResources,
+		tls:               options.TLS,
+		healthRegistry:    options.HealthRegistry,
+		enablePprof:       options.EnablePprof,
+		internalAuth:      options.InternalAuth,
+		disableQuit:       options.DisableQuit,
+		quitMethods:       options.QuitMethods,
+		operations:        newOperationsCatalog(options.Runbooks),
+		servers:           make(map[string]*subsystemServer),
+		serverOptionsFunc: options.ServerOptions,
+		publicClosed:      make(chan struct{}),
+		stopServers:       make(chan struct{}),
+		serverStopped:     make(chan error, 1),
+		quitChan:          make(chan bool, 1),
 	}
 }
 
 // NewExitFunc returns a new exit function. It wraps the shutdownFunc and executed an os.exit after the shutdown is
 // completed with a slight delay, giving the quit handler a chance to return a status.
+//
+// Deprecated: Run calls the ShutdownFunc of the ServiceOptions and returns; use RunAndExit to exit afterwards.
 func NewExitFunc(log Logger, shutdownFunc ShutdownFunc) func(int) {
 	return func(code int) {
-		log.Debug("ServiceExit", "Performing service exit")
+		log.Debug(events.ServiceExit, "Performing service exit")
 
 		go func() {
 			if shutdownFunc != nil {
-				log.Debug("ShutdownFunc", "Calling shutdown func")
+				log.Debug(events.ShutdownFunc, "Calling shutdown func")
 				shutdownFunc(log)
 			}
 
@@ -192,7 +525,7 @@ func NewExitFunc(log Logger, shutdownFunc ShutdownFunc) func(int) {
 				time.Sleep(500 * time.Millisecond)
 			}
 
-			log.Debug("ServiceExit", "Calling os.Exit(%v)", code)
+			log.Debug(events.ServiceExit, "Calling os.Exit(%v)", code)
 			os.Exit(code)
 		}()
 
@@ -225,147 +558,786 @@ func (s *serviceStateReaderImpl) IsHealthy() bool {
 
 // SetHandlers is used to update the handler references in ServiceOptions to use the correct middleware and state.
 func (o *ServiceOptions) SetHandlers() {
-	factory := NewServiceHandlerFactory(o.MiddlewareWrapper, o.VersionBuilder, o.ServiceStateReader, o.ExitFunc)
+	stateReader := o.ServiceStateReader
+	if o.LazyResources != nil {
+		stateReader = NewLazyStateReader(stateReader, o.LazyResources)
+	}
+	if o.HealthRegistry != nil {
+		stateReader = NewHealthRegistryStateReader(stateReader, o.HealthRegistry)
+	}
+	// The Compression middleware of the default MiddlewareWrapper follows the Compression options.
+	if wrapper, ok := o.MiddlewareWrapper.(*middlewareWrapperImpl); ok {
+		o.MiddlewareWrapper = wrapper.withCompression(o.Compression)
+	}
+	// Without an exit func, the quit handler leaves the shutdown to the service.
+	factory := NewCustomServiceHandlerFactory(o.MiddlewareWrapper, o.VersionBuilder, stateReader, nil,
+		ServiceHandlerFactoryOptions{Buffers: o.Buffers, Synthetic: o.SyntheticTraffic, Baggage: o.Baggage})
 	o.Handlers = factory.NewHandlers()
 	o.WrapHandler = factory
 }
 
 /* Service implementation */
 
-func (s *serviceImpl) Run(ctx context.Context) {
-	s.log.Info("Service", "%s: %s", s.globals.AppName, s.versionBuilder.ToString())
+// Run runs the servers until the context is cancelled, a signal is received, /quit is requested or a server stops
+// unexpectedly. It then shuts the servers down, runs the shutdown hooks and the ShutdownFunc, and returns. It returns
+// an error when the service can't start or a server stopped unexpectedly.
+func (s *serviceImpl) Run(ctx context.Context) error {
+	if selfTestVariable.Bool() && !s.selfTesting {
+		report := SelfTest(s, SelfTestOptions{})
+		json.NewEncoder(os.Stdout).Encode(report)
+		s.forceExitFunc(report.ExitCode())
+		return nil
+	}
+
+	s.log.Info(events.Service, "%s: %s (shutdown mode: %s)", s.globals.AppName, s.versionBuilder.ToString(), s.shutdownMode)
+
+	if err := s.budgets.Validate(s.routeNames); err != nil {
+		s.log.Error(events.RouteBudgets, "Invalid route budgets: %v", err)
+		return err
+	}
+	if s.scheduler != nil {
+		if err := s.scheduler.Validate(); err != nil {
+			s.log.Error(events.Scheduler, "%v", err)
+			return err
+		}
+	}
+	tlsConfig, err := s.tls.load()
+	if err != nil {
+		s.log.Error(events.TLS, "Invalid TLS configuration: %v", err)
+		return err
+	}
+	s.tlsConfig = tlsConfig
+	// The options are resolved once, so the servers start with the validated ones.
+	serverOptions := map[string]ServerOptions{
+		publicSubsystem:    s.serverOptions(publicSubsystem),
+		readinessSubsystem: s.serverOptions(readinessSubsystem),
+		internalSubsystem:  s.serverOptions(internalSubsystem),
+	}
+	if err := s.validateAddresses(serverOptions); err != nil {
+		s.log.Error(events.PortConflict, "Invalid server configuration: %v", err)
+		return err
+	}
 
 	sigs := make(chan os.Signal, 1)
-	done := make(chan bool, 1)
+	done := make(chan error, 1)
+	stopped := make(chan struct{})
 	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	// One for each of the readiness, internal and public servers.
+	s.serversClosed.Add(3)
 
 	go func() {
+		var err error
 		select {
-		case <-s.receiveChan:
-			s.log.Debug("UnexpectedShutdownReceived", "Server shut down unexpectedly")
+		case err = <-s.serverStopped:
 			// One of the servers has shut down unexpectedly. Because this makes the whole service unreliable, shutdown.
-			break
+			s.log.Error(events.UnexpectedShutdownReceived, "Shutting down, because %v", err)
 		case <-ctx.Done():
-			s.log.Debug("ServiceCancel", "Cancellation request received")
-
-			// Shutdown any running http servers
-			s.quitting = true
-			s.sendChan <- true
-			break
+			s.log.Debug(events.ServiceCancel, "Cancellation request received")
 		case <-sigs:
-			s.log.Debug("GracefulShutdown", "Handling Sigterm/SigInt")
-			break
+			s.log.Debug(events.GracefulShutdown, "Handling Sigterm/SigInt")
+		case <-s.quitChan:
+			s.log.Debug(events.GracefulShutdown, "Handling quit request")
+		}
+
+		// A second signal during the shutdown always forces the exit.
+		go s.forceOnSignal(sigs, stopped)
+
+		s.serverMutex.Lock()
+		s.stopping = true
+		s.serverMutex.Unlock()
+
+		if s.critical != nil {
+			// Refuse new critical sections before the servers are stopped.
+			s.critical.BeginShutdown()
+		}
+		if s.drainer != nil && s.shutdownMode != ShutdownModeFast {
+			s.drainer.BeginDrain()
 		}
 
 		if !s.quitting {
-			// Some other go-routine is already taking care of the shutdown
+			// Shutdown all running http servers at once, after the readiness started failing.
 			s.quitting = true
-			s.sendChan <- true
+			close(s.stopServers)
 		}
+		// Wait until the servers completed their in-flight requests.
+		s.serversClosed.Wait()
+
+		s.shutdownHooks()
+		s.runShutdownFunc()
 
-		// Trigger graceful shutdown
-		s.exitFunc(0)
-		done <- true
+		signal.Stop(sigs)
+		close(stopped)
+		done <- err
 	}()
 
-	s.runReadinessServer()
-	s.runInternalServer()
-	s.runPublicServer()
+	// Background work reports its errors through the context.
+	backgroundCtx := WithErrorReporter(ctx, s.reporter)
+
+	if s.taskQueue != nil {
+		s.taskQueue.Start(backgroundCtx)
+	}
+	if s.profiler != nil {
+		s.profiler.Start(backgroundCtx)
+	}
+	if s.scheduler != nil {
+		s.scheduler.Start(backgroundCtx)
+	}
+	if s.pusher != nil {
+		s.pusher.Start(backgroundCtx)
+	}
+	if s.lazy != nil {
+		s.lazy.Start(backgroundCtx, s.stateReader.IsReady)
+	}
+
+	s.routesOnce.Do(s.registerRoutes)
 
-	<-done // Wait for our shutdown
+	s.runReadinessServer(serverOptions[readinessSubsystem])
+	s.runInternalServer(serverOptions[internalSubsystem])
+	s.runPublicServer(serverOptions[publicSubsystem])
 
-	// since service.ExitFunc calls os.Exit(), we'll never get here
+	return <-done // Wait for our shutdown
+}
+
+// RunAndExit runs the service and calls the ExitFunc when Run returns, with 0 after a shutdown and 1 when Run returned
+// an error.
+func (s *serviceImpl) RunAndExit(ctx context.Context) {
+	code := 0
+	if err := s.Run(ctx); err != nil {
+		code = 1
+	}
+	s.log.Debug(events.ServiceExit, "Calling exit func with %d", code)
+	s.exitFunc(code)
 }
 
 func (s *serviceImpl) AddRoute(name string, routes []string, methods []string, middlewares []Middleware, handler Handle) {
-	s.addRoute(s.publicRouter, publicSubsystem, name, routes, methods, middlewares, handler)
+	s.AddRouteWithMetadata(name, routes, methods, middlewares, RouteMetadata{}, handler)
+}
+
+// AddRouteWithMetadata adds a route of which the metadata is enforced and exposed through the RouteRegistry.
+func (s *serviceImpl) AddRouteWithMetadata(name string, routes []string, methods []string, middlewares []Middleware, metadata RouteMetadata, handler Handle) {
+	s.routeNames = append(s.routeNames, name)
+
+	c := newRouteComposer(handler)
+	if !metadata.CachePolicy.isZero() {
+		// Around the handler, so the policy overrides the headers of the NoCaching middleware.
+		c.wrap("cache_policy", MiddlewareSourceMetadata, metadata.CachePolicy.String(), metadata.CachePolicy.Middleware(s.log))
+	}
+	if s.latency != nil {
+		c.wrap("latency", MiddlewareSourceBuiltIn, "", s.latency.Middleware(name))
+	}
+	if s.drainer != nil {
+		c.wrap("drain", MiddlewareSourceBuiltIn, "", s.drainer.Middleware(name))
+	}
+	if budget, ok := s.budgets[name]; ok {
+		c.wrap("budget", MiddlewareSourceBuiltIn, budget.Total.String(), NewBudgetMiddleware(name, budget, s.metrics))
+		c.timeouts = budgetTimeouts(budget)
+	}
+	if s.responseShapes != nil {
+		c.wrap("response_shape", MiddlewareSourceBuiltIn, s.responseShapes.Dir,
+			NewResponseShapeGuard(name, *s.responseShapes, s.log, s.metrics))
+	}
+	wrapQuota := func() {
+		if s.quotas != nil {
+			// Inside the authentication, so the tenant can be resolved from its claims.
+			c.wrap("quota", MiddlewareSourceBuiltIn, "", s.quotas.Middleware())
+		}
+	}
+	if !metadata.ExpectContinue {
+		wrapQuota()
+	}
+	c.wrap("route_contract", MiddlewareSourceMetadata, routeContractConfig(metadata),
+		NewRouteContract(RouteMetadata{ContentTypes: metadata.ContentTypes, MaxBodySize: metadata.MaxBodySize}))
+	if metadata.ExpectContinue {
+		// Before the route contract accepts the body, so requests over quota don't send it.
+		wrapQuota()
+	}
+	if metadata.Auth != nil {
+		c.wrap("auth", MiddlewareSourceMetadata, "", metadata.Auth)
+	}
+	if metadata.ExpectContinue {
+		c.wrap("expect_continue", MiddlewareSourceMetadata, "", NewExpectContinueMiddleware(name, s.metrics))
+	}
+	c.wrap("error_reporting", MiddlewareSourceBuiltIn, "", func(next Handle) Handle {
+		return s.withErrorReporting(name, next)
+	})
+	c.wrap("request_context", MiddlewareSourceBuiltIn, "", func(next Handle) Handle {
+		return s.withRequestContext(name, next)
+	})
+	if metadata.SelfTest != nil {
+		s.selfTests = append(s.selfTests, selfTestRoute{name: name, probe: selfTestProbe(*metadata.SelfTest, routes, methods)})
+	}
+	s.addRouteWithMetadata(s.publicRouter, publicSubsystem, name, routes, methods, middlewares, metadata, c)
+}
+
+// AddInternalRoute adds a route to the internal router, next to the predefined operational routes. Paths that
+// conflict with the predefined or other registered routes are logged and not added.
+func (s *serviceImpl) AddInternalRoute(name string, routes []string, methods []string, middlewares []Middleware, handler Handle) {
+	s.addSubsystemRoute(s.internalRouter, internalSubsystem, name, routes, methods, middlewares, handler)
+}
+
+// AddReadinessRoute adds a route to the readiness router. Paths that conflict with the predefined or other registered
+// routes are logged and not added.
+func (s *serviceImpl) AddReadinessRoute(name string, routes []string, methods []string, middlewares []Middleware, handler Handle) {
+	s.addSubsystemRoute(s.readinessRouter, readinessSubsystem, name, routes, methods, middlewares, handler)
+}
+
+// addSubsystemRoute adds the route after the predefined routes, so these take precedence on conflicts.
+func (s *serviceImpl) addSubsystemRoute(router *Router, subsystem, name string, routes []string, methods []string, middlewares []Middleware, handler Handle) {
+	add := func() {
+		s.addRoute(router, subsystem, name, routes, methods, middlewares, handler)
+	}
+
+	if s.routesRegistered {
+		add()
+		return
+	}
+	s.pendingRoutes = append(s.pendingRoutes, add)
+}
+
+// AddHealthCheck adds a check to the health of the service, which is reported by /health_check with its status and
+// latency. The service is unhealthy while the check fails.
+func (s *serviceImpl) AddHealthCheck(name string, check CheckFunc) {
+	if s.healthRegistry == nil {
+		s.log.Error(events.HealthCheck, "Not adding health check %s, because the service has no health registry", name)
+		return
+	}
+	s.healthRegistry.AddHealthCheck(name, check)
+}
+
+// AddReadinessCheck adds a check to the readiness of the service. The service is not ready while the check fails.
+func (s *serviceImpl) AddReadinessCheck(name string, check CheckFunc) {
+	if s.healthRegistry == nil {
+		s.log.Error(events.HealthCheck, "Not adding readiness check %s, because the service has no health registry", name)
+		return
+	}
+	s.healthRegistry.AddReadinessCheck(name, check)
+}
+
+// Routes returns all routes of the service, including the predefined ones.
+func (s *serviceImpl) Routes() []RouteInfo {
+	s.routesOnce.Do(s.registerRoutes)
+
+	return append([]RouteInfo(nil), s.routes...)
+}
+
+// Handler returns the router of the given subsystem, to serve requests in-process.
+func (s *serviceImpl) Handler(subsystem string) http.Handler {
+	s.routesOnce.Do(s.registerRoutes)
+
+	switch subsystem {
+	case publicSubsystem:
+		return s.publicRouter.Router
+	case readinessSubsystem:
+		return s.readinessRouter.Router
+	case internalSubsystem:
+		return s.internalRouter.Router
+	}
+	return nil
+}
+
+// withErrorReporting reports panics and 5xx responses of the route. Panics are passed on, so the PanicTo500
+// middleware still handles them.
+func (s *serviceImpl) withErrorReporting(name string, handler Handle) Handle {
+	return func(w WrappedResponseWriter, r *http.Request, p RouterParams) {
+		defer func() {
+			if rec := recover(); rec != nil {
+				s.reporter.Report(r.Context(), ReportedError{
+					Value:         rec,
+					Panic:         true,
+					Stack:         string(debug.Stack()),
+					Route:         name,
+					CorrelationID: correlationID(r),
+					Request:       NewRequestSummary(r),
+					Severity:      SeverityFatal,
+				})
+				panic(rec)
+			}
+		}()
+
+		handler(w, r, p)
+
+		if w.Status() >= http.StatusInternalServerError {
+			s.reporter.Report(r.Context(), ReportedError{
+				Message:       fmt.Sprintf("%s responded with %d", name, w.Status()),
+				Route:         name,
+				CorrelationID: correlationID(r),
+				Request:       NewRequestSummary(r),
+				Severity:      SeverityError,
+			})
+		}
+	}
+}
+
+// withRequestContext adds the service facilities that handlers can use through the request context.
+func (s *serviceImpl) withRequestContext(name string, handler Handle) Handle {
+	return func(w WrappedResponseWriter, r *http.Request, p RouterParams) {
+		ctx := WithErrorReporter(r.Context(), s.reporter)
+		ctx = withRouteContext(ctx, name, s.metrics)
+
+		if s.taskQueue != nil {
+			ctx = WithTaskQueue(ctx, s.taskQueue)
+		}
+		if s.critical != nil {
+			ctx = WithCriticalSections(ctx, s.critical)
+		}
+		handler(w, r.WithContext(ctx), p)
+	}
+}
+
+func (s *serviceImpl) waitForCriticalSections(deadline time.Duration) {
+	if s.critical == nil {
+		return
+	}
+
+	if deadline <= 0 {
+		deadline = defaultCriticalDeadline
+	}
+
+	// The servers and the shutdown hooks share one wait, so the deadline isn't applied twice.
+	s.criticalOnce.Do(func() {
+		if !s.critical.Wait(deadline) {
+			s.log.Error(events.CriticalSectionsAbandoned, "Forcing shutdown with pending critical sections")
+		}
+	})
+}
+
+func (s *serviceImpl) stopTaskQueue() {
+	if s.taskQueue == nil {
+		return
+	}
+
+	s.log.Debug(events.TaskQueueStop, "Checkpointing in-flight tasks")
+
+	if err := s.taskQueue.Stop(); err != nil {
+		s.log.Error(events.TaskQueueStop, "Failed stopping task queue: %v", err)
+		s.reporter.Report(context.Background(), ReportedError{
+			Err:      err,
+			Message:  fmt.Sprintf("Failed stopping task queue: %v", err),
+			Severity: SeverityError,
+		})
+	}
+}
+
+// pushMetrics makes a final attempt to push the metrics, so the last state before the shutdown is not lost.
+func (s *serviceImpl) pushMetrics() {
+	if s.pusher == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), finalMetricsPushTimeout)
+	defer cancel()
+
+	s.log.Debug(events.MetricsPush, "Pushing metrics before shutdown")
+	s.pusher.Push(ctx)
+}
+
+// newEnvMetricsPusher returns a MetricsPusher configured by the environment variables, or nil when no URL is set.
+func newEnvMetricsPusher(globals ServiceGlobals, log Logger, metrics Metrics) MetricsPusher {
+	if !metricsPushURLVariable.IsSet() {
+		return nil
+	}
+
+	interval, err := time.ParseDuration(metricsPushIntervalVariable.String())
+	if err != nil {
+		log.Error(events.MetricsPushOptions, "Failed parsing metrics push interval: %v", err)
+	}
+	format := metricsPushFormatVariable.String()
+	if format != PushFormatPushgateway && format != PushFormatRemoteWrite {
+		log.Error(events.MetricsPushOptions, "%v: %s", ErrUnknownPushFormat, format)
+		return nil
+	}
+
+	return NewMetricsPusher(MetricsPushOptions{
+		URL:      metricsPushURLVariable.String(),
+		Format:   format,
+		Interval: interval,
+	}, globals, log, metrics)
+}
+
+// newEnvMetrics returns the metrics with the histogram buckets configured by the environment variables, or the default
+// buckets when they are invalid.
+func newEnvMetrics(name string, log Logger) Metrics {
+	buckets, err := ParseHistogramBuckets(histogramBucketsVariable.String())
+	if err != nil {
+		log.Error(events.MetricsBuckets, "Failed parsing histogram buckets, using the default buckets: %v", err)
+	}
+
+	return NewCustomMetrics(name, MetricsOptions{HistogramBuckets: buckets}, log)
+}
+
+// newEnvHealthRegistry returns the health registry configured by the environment variables.
+func newEnvHealthRegistry(log Logger, metrics Metrics) HealthRegistry {
+	timeout, err := time.ParseDuration(healthTimeoutVariable.String())
+	if err != nil {
+		log.Error(events.HealthCheck, "Failed parsing health check timeout: %v", err)
+	}
+	cacheInterval, err := time.ParseDuration(healthCacheVariable.String())
+	if err != nil {
+		log.Error(events.HealthCheck, "Failed parsing health cache interval: %v", err)
+	}
+
+	return NewHealthRegistry(HealthRegistryOptions{Timeout: timeout, CacheInterval: cacheInterval}, metrics)
+}
+
+// newEnvSyntheticTrafficMiddleware returns the synthetic traffic detection configured by the environment variables, or
+// nil when no sources or networks are set.
+func newEnvSyntheticTrafficMiddleware(log Logger, metrics Metrics) MiddlewareFunc {
+	if !syntheticSourcesVariable.IsSet() && !syntheticCIDRsVariable.IsSet() {
+		return nil
+	}
+
+	policy := SyntheticPolicy(strings.ToLower(syntheticPolicyVariable.String()))
+	if policy != SyntheticPolicyLabel && policy != SyntheticPolicyExclude {
+		log.Error(events.SyntheticTraffic, "Unknown synthetic traffic policy '%s', using %s", policy, SyntheticPolicyLabel)
+		policy = SyntheticPolicyLabel
+	}
+
+	return NewSyntheticTrafficMiddleware(SyntheticOptions{
+		Sources:       syntheticSourcesVariable.List(),
+		CIDRs:         syntheticCIDRsVariable.List(),
+		TrustedCIDRs:  syntheticTrustedVariable.List(),
+		Policy:        policy,
+		MaxConcurrent: syntheticMaxVariable.Int(),
+	}, log, metrics)
+}
+
+// newEnvBaggageMiddleware returns the baggage middleware configured by the environment variables, or nil when no keys
+// are allowed.
+func newEnvBaggageMiddleware(log Logger, metrics Metrics) MiddlewareFunc {
+	if !baggageKeysVariable.IsSet() {
+		return nil
+	}
+
+	options := BaggageOptions{
+		AllowedKeys:   baggageKeysVariable.List(),
+		LegacyHeaders: make(map[string]string),
+		LogKeys:       baggageLogKeysVariable.List(),
+		MetricKeys:    make(map[string][]string),
+	}
+	for _, legacy := range baggageLegacyVariable.List() {
+		parts := strings.SplitN(legacy, "=", 2)
+		if len(parts) != 2 {
+			log.Error(events.Baggage, "Ignoring invalid legacy baggage header: %s", legacy)
+			continue
+		}
+		options.LegacyHeaders[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	for _, key := range baggageMetricKeysVariable.List() {
+		parts := strings.SplitN(key, "=", 2)
+		if len(parts) != 2 {
+			log.Error(events.Baggage, "Ignoring baggage metric label without allowed values: %s", key)
+			continue
+		}
+		options.MetricKeys[strings.TrimSpace(parts[0])] = strings.Split(parts[1], "|")
+	}
+
+	return NewBaggageMiddleware(options, log, metrics)
 }
 
 func (s *serviceImpl) addRoute(router *Router, subsystem, name string, routes []string, methods []string, middlewares []Middleware, handler Handle) {
+	s.addRouteWithMetadata(router, subsystem, name, routes, methods, middlewares, RouteMetadata{}, newRouteComposer(handler))
+}
+
+func (s *serviceImpl) addRouteWithMetadata(router *Router, subsystem, name string, routes []string, methods []string, middlewares []Middleware, metadata RouteMetadata, c *routeComposer) {
+	handler := c.handler
+	c.wrapEnumerated(subsystem, name, middlewares)
+
+	var paths []string
 	for _, path := range routes {
 		wrappedHandler := s.wrapHandler.Wrap(subsystem, name, middlewares, handler)
 
+		added := false
 		for _, method := range methods {
+			if conflict := s.conflictingPath(router, method, path); conflict != "" {
+				s.log.Error(events.RouteConflict, "Not adding %s %s of %s route %s, because it conflicts with %s",
+					method, path, subsystem, name, conflict)
+				continue
+			}
 			router.Router.Handle(method, path, wrappedHandler)
+			added = true
+		}
+		if added {
+			paths = append(paths, path)
 		}
 	}
+	if len(paths) == 0 {
+		return
+	}
+
+	route := RouteInfo{
+		Name:           name,
+		Subsystem:      subsystem,
+		Paths:          paths,
+		Methods:        methods,
+		ContentTypes:   metadata.ContentTypes,
+		MaxBodySize:    metadata.MaxBodySize,
+		Authenticated:  metadata.Auth != nil,
+		ExpectContinue: metadata.ExpectContinue,
+	}
+	if !metadata.CachePolicy.isZero() {
+		route.CachePolicy = metadata.CachePolicy.String()
+	}
+	route.explanation = c.explain(route)
+	s.routes = append(s.routes, route)
 }
 
-func (s *serviceImpl) runHTTPServer(port int, router *Router) {
-	addr := fmt.Sprintf(":%v", port)
-	svr := &http.Server{
-		ReadTimeout:  30 * time.Second,
-		WriteTimeout: 30 * time.Second,
-		IdleTimeout:  30 * time.Second,
-		Addr:         addr,
-		Handler:      router.Router,
+// conflictingPath returns the path of the router that conflicts with the path for the method, or records the path and
+// returns an empty string. The underlying router panics on conflicts instead.
+func (s *serviceImpl) conflictingPath(router *Router, method, path string) string {
+	if s.routePaths == nil {
+		s.routePaths = make(map[*Router]map[string][]string)
+	}
+	if s.routePaths[router] == nil {
+		s.routePaths[router] = make(map[string][]string)
 	}
 
-	go func() {
-		// Blocking until the server stops.
-		svr.ListenAndServe()
+	for _, registered := range s.routePaths[router][method] {
+		if routePathsConflict(registered, path) {
+			return registered
+		}
+	}
+	s.routePaths[router][method] = append(s.routePaths[router][method], path)
+	return ""
+}
 
-		// Notify the service that the server has stopped.
-		s.receiveChan <- true
-	}()
+// runHTTPServer runs a server for the router, which is shut down on shutdown, concurrently with the other servers.
+// The stopped func is called after the server was shut down. It returns the address the server listens on, or nil if
+// listening failed, which stops the service with a ServerError.
+func (s *serviceImpl) runHTTPServer(subsystem string, router *Router, options ServerOptions, stopped func()) net.Addr {
+	address, port := s.configuredAddress(subsystem, options)
+
+	listener, err := listen(address, port)
+	if err != nil {
+		s.log.Error(events.ListenFailed, "Failed listening on port %d for %s: %v", port, subsystem, err)
+		s.stopped(&ServerError{Subsystem: subsystem, Port: port, Err: err})
+	} else {
+		s.serverMutex.Lock()
+		s.serveLocked(subsystem, router, address, port, listener, options)
+		s.serverMutex.Unlock()
+	}
 
 	go func() {
-		// Monitor sender channel and close server on signal.
-		select {
-		case sig := <-s.sendChan:
-			// Properly close the server if possible.
-			if svr != nil {
-				svr.Close()
-				svr = nil
-			}
-			// Continue sending the message
-			s.sendChan <- sig
-			break
+		defer s.serversClosed.Done()
+
+		<-s.stopServers
+		s.closeServer(subsystem)
+		if stopped != nil {
+			stopped()
 		}
 	}()
+
+	if listener == nil {
+		return nil
+	}
+	return listener.Addr()
 }
 
-// RunReadinessServer runs the readiness service as a go-routine
-func (s *serviceImpl) runReadinessServer() {
-	const subsystem = "readiness"
+// stopped reports the unexpected stop of a server to Run. Only the first stop is reported, because it shuts the
+// service down already.
+func (s *serviceImpl) stopped(err error) {
+	select {
+	case s.serverStopped <- err:
+	default:
+	}
+}
+
+// registerRoutes adds the predefined routes to the routers of the subsystems.
+func (s *serviceImpl) registerRoutes() {
+	s.registerReadinessRoutes()
+	s.registerInternalRoutes()
+	s.registerPublicRoutes()
+
+	for _, add := range s.pendingRoutes {
+		add()
+	}
+	s.pendingRoutes = nil
+	s.routesRegistered = true
+}
+
+func (s *serviceImpl) registerReadinessRoutes() {
+	const subsystem = readinessSubsystem
 
 	router := s.readinessRouter
 
 	s.addRoute(router, subsystem, "root", []string{"/"}, MethodsForGet, DefaultMiddlewares, s.handlers.RootHandler.NewRootHandler())
 	s.addRoute(router, subsystem, "liveness", []string{"/service/liveness"}, MethodsForGet, DefaultMiddlewares, s.handlers.LivenessHandler.NewLivenessHandler())
-	s.addRoute(router, subsystem, "readiness", []string{"/service/readiness"}, MethodsForGet, DefaultMiddlewares, s.handlers.ReadinessHandler.NewReadinessHandler())
+	s.addRoute(router, subsystem, "readiness", []string{"/service/readiness"}, MethodsForGet, DefaultMiddlewares, s.readinessHandler())
+}
+
+// RunReadinessServer runs the readiness service as a go-routine
+func (s *serviceImpl) runReadinessServer(options ServerOptions) {
+	const subsystem = readinessSubsystem
 
-	s.log.Info("RunReadinessServer", "%s %s running on localhost:%d.", s.globals.AppName, subsystem, s.readinessPort)
+	router := s.readinessRouter
 
-	s.runHTTPServer(s.readinessPort, router)
+	addr := s.runHTTPServer(subsystem, router, options, nil)
+
+	s.log.Info(events.RunReadinessServer, "%s %s running on %v.", s.globals.AppName, subsystem, addr)
 }
 
-// RunInternalServer runs the internal service as a go-routine
-func (s *serviceImpl) runInternalServer() {
-	const subsystem = "internal"
+func (s *serviceImpl) registerInternalRoutes() {
+	const subsystem = internalSubsystem
 
 	router := s.internalRouter
 
 	s.addRoute(router, subsystem, "root", []string{"/"}, MethodsForGet, DefaultMiddlewares, s.handlers.RootHandler.NewRootHandler())
 	s.addRoute(router, subsystem, "health_check", []string{"/health_check", "/healthz"}, MethodsForGet, DefaultMiddlewares, s.handlers.HealthHandler.NewHealthHandler())
-	s.addRoute(router, subsystem, "metrics", []string{"/metrics"}, MethodsForGet, DefaultMiddlewares, s.handlers.MetricsHandler.NewMetricsHandler())
-	s.addRoute(router, subsystem, "quit", []string{"/quit"}, MethodsForGet, DefaultMiddlewares, s.handlers.QuitHandler.NewQuitHandler())
+	if s.internalAuth.ProtectMetrics {
+		s.addProtectedRoute("metrics", []string{"/metrics"}, MethodsForGet, DefaultMiddlewares, s.handlers.MetricsHandler.NewMetricsHandler())
+	} else {
+		s.addRoute(router, subsystem, "metrics", []string{"/metrics"}, MethodsForGet, DefaultMiddlewares, s.handlers.MetricsHandler.NewMetricsHandler())
+	}
 
-	s.log.Info("RunInternalServer", "%s %s running on localhost:%d.", s.globals.AppName, subsystem, s.internalPort)
+	if !s.disableQuit {
+		quitMethods := s.quitMethods
+		if len(quitMethods) == 0 {
+			quitMethods = MethodsForGet
+		}
+		s.operations.register(OperationShutdown, "Shuts the service down; in graceful mode, in-flight requests are drained first.",
+			s.shutdownState)
+		s.addOperationRoute(OperationShutdown, "quit", []string{"/quit"}, quitMethods, s.quitHandler())
+	}
 
-	s.runHTTPServer(s.internalPort, router)
+	if s.taskQueue != nil {
+		s.operations.register(OperationTaskQueue, "Lists the background tasks that exhausted their retries and redrives them.",
+			func() interface{} {
+				stats, _ := s.taskQueue.Stats()
+				return stats
+			})
+		s.addOperationRoute(OperationTaskQueue, "dead_tasks", []string{"/service/tasks/dead"}, MethodsForGet, NewDeadTasksHandler(s.taskQueue))
+		s.addOperationRoute(OperationTaskQueue, "redrive_task", []string{"/service/tasks/dead/:id"}, MethodsForPost, NewRedriveTaskHandler(s.taskQueue))
+	}
+	if s.scheduler != nil {
+		s.operations.register(OperationScheduler, "Lists the scheduled tasks and runs them immediately.",
+			func() interface{} { return s.scheduler.Tasks() })
+		s.addOperationRoute(OperationScheduler, "scheduled_tasks", []string{"/service/tasks"}, MethodsForGet, NewScheduledTasksHandler(s.scheduler))
+		s.addOperationRoute(OperationScheduler, "trigger_task", []string{"/service/tasks/run/:name"}, MethodsForPost, NewTriggerTaskHandler(s.scheduler))
+	}
+	s.addProtectedRoute("config_spec", []string{"/service/config/spec"}, MethodsForGet, DefaultMiddlewares, NewConfigSpecHandler())
+	s.addProtectedRoute("service_info", []string{"/service/info"}, MethodsForGet, DefaultMiddlewares, NewServiceInfoHandler(s.globals, s, s.pusher, s.lazy))
+	s.addRoute(router, subsystem, "operations", []string{"/service/operations"}, MethodsForGet, DefaultMiddlewares, NewOperationsHandler(s.operations))
+	s.operations.register(OperationServerRestart, "Restarts the server of a subsystem without dropping connections; the public server requires confirm=true.",
+		func() interface{} { return s.Servers() })
+	s.addOperationRoute(OperationServerRestart, "restart_server", []string{"/service/servers/:subsystem/restart"}, MethodsForPost, NewRestartServerHandler(s))
+	if s.events != nil {
+		s.addRoute(router, subsystem, "events", []string{"/service/events"}, MethodsForGet, DefaultMiddlewares, NewEventsHandler(s.events))
+	}
+	s.addRoute(router, subsystem, "explain_route", []string{"/service/routes/:name/explain"}, MethodsForGet, DefaultMiddlewares, NewExplainRouteHandler(s))
+	if s.quotas != nil {
+		s.operations.register(OperationQuotas, "Inspects the request quotas of tenants and adjusts their usage.", nil)
+		s.addOperationRoute(OperationQuotas, "quota_usage", []string{"/service/quotas/:tenant"}, MethodsForGet, NewQuotaUsageHandler(s.quotas))
+		s.addOperationRoute(OperationQuotas, "quota_adjust", []string{"/service/quotas/:tenant"}, MethodsForPost, NewQuotaAdjustHandler(s.quotas))
+	}
+	if s.shadowComparer != nil {
+		s.addRoute(router, subsystem, "shadow_mismatches", []string{"/service/shadow/mismatches"}, MethodsForGet, DefaultMiddlewares, NewShadowMismatchesHandler(s.shadowComparer))
+	}
+	if s.logBuffer != nil {
+		s.addProtectedRoute("logs", []string{"/service/logs"}, MethodsForGet, DefaultMiddlewares, NewLogsHandler(s.logBuffer))
+	}
+	if s.latency != nil {
+		s.addRoute(router, subsystem, "latency_baselines", []string{"/service/latency"}, MethodsForGet, DefaultMiddlewares, NewLatencyBaselinesHandler(s.latency))
+	}
+	if s.profiler != nil {
+		s.addProtectedRoute("profiles", []string{"/service/profiles"}, MethodsForGet, DefaultMiddlewares, NewProfilesHandler(s.profiler))
+		s.addProtectedRoute("profile", []string{"/service/profiles/:kind/:timestamp"}, MethodsForGet, DefaultMiddlewares, NewProfileDownloadHandler(s.profiler))
+	}
+	if s.enablePprof {
+		s.addProtectedRoute("pprof", []string{"/debug/pprof/*profile"}, []string{http.MethodGet, http.MethodPost}, debugMiddlewares, NewPprofHandler())
+		s.addProtectedRoute("expvar", []string{"/debug/vars"}, MethodsForGet, debugMiddlewares, NewExpvarHandler())
+	}
 }
 
-// RunPublicServer runs the public service on the current thread.
-func (s *serviceImpl) runPublicServer() {
+// addOperationRoute adds an internal route that controls the operational feature, which lists its endpoints in the
+// operations catalog and records the changes made through them.
+func (s *serviceImpl) addOperationRoute(feature, name string, routes []string, methods []string, handler Handle) {
+	s.addProtectedRoute(name, routes, methods, DefaultMiddlewares, s.operations.endpoints(feature, routes, methods)(handler))
+}
+
+// addProtectedRoute adds an internal route that requires the internal token, when it is configured.
+func (s *serviceImpl) addProtectedRoute(name string, routes []string, methods []string, middlewares []Middleware, handler Handle) {
+	c := newRouteComposer(handler)
+	var metadata RouteMetadata
+	if s.internalAuth.Token != "" {
+		metadata.Auth = NewInternalAuthMiddleware(name, s.internalAuth, s.log, s.metrics)
+		c.wrap("internal_auth", MiddlewareSourceBuiltIn, "", metadata.Auth)
+	}
+	s.addRouteWithMetadata(s.internalRouter, internalSubsystem, name, routes, methods, middlewares, metadata, c)
+}
+
+// shutdownState returns the drain state of the service, or serving when it doesn't drain.
+func (s *serviceImpl) shutdownState() interface{} {
+	if s.drainer != nil {
+		return s.drainer.Snapshot().State
+	}
+	return DrainStateServing
+}
+
+// RunInternalServer runs the internal service as a go-routine
+func (s *serviceImpl) runInternalServer(options ServerOptions) {
+	const subsystem = internalSubsystem
+
+	router := s.internalRouter
+
+	addr := s.runHTTPServer(subsystem, router, options, nil)
+
+	s.log.Info(events.RunInternalServer, "%s %s running on %v.", s.globals.AppName, subsystem, addr)
+}
+
+func (s *serviceImpl) registerPublicRoutes() {
 	router := s.publicRouter
 
 	s.addRoute(router, publicSubsystem, "root", []string{"/"}, MethodsForGet, DefaultMiddlewares, s.handlers.RootHandler.NewRootHandler())
 	s.addRoute(router, publicSubsystem, "version", []string{"/service/version"}, MethodsForGet, DefaultMiddlewares, s.handlers.VersionHandler.NewVersionHandler())
 	s.addRoute(router, publicSubsystem, "liveness", []string{"/service/liveness"}, MethodsForGet, DefaultMiddlewares, s.handlers.LivenessHandler.NewLivenessHandler())
-	s.addRoute(router, publicSubsystem, "readiness", []string{"/service/readiness"}, MethodsForGet, DefaultMiddlewares, s.handlers.ReadinessHandler.NewReadinessHandler())
+	s.addRoute(router, publicSubsystem, "readiness", []string{"/service/readiness"}, MethodsForGet, DefaultMiddlewares, s.readinessHandler())
+}
 
-	s.log.Info("RunPublicService", "%s %s running on localhost:%d.", s.globals.AppName, publicSubsystem, s.port)
+// readinessHandler returns the readiness handler, which reports the drain progress during shutdown.
+func (s *serviceImpl) readinessHandler() Handle {
+	handler := s.handlers.ReadinessHandler.NewReadinessHandler()
+
+	if s.drainer != nil {
+		return s.drainer.ReadinessMiddleware()(handler)
+	}
+
+	// Without a drainer, the readiness still fails as soon as the shutdown begins.
+	return func(w WrappedResponseWriter, r *http.Request, p RouterParams) {
+		s.serverMutex.Lock()
+		stopping := s.stopping
+		s.serverMutex.Unlock()
+
+		if stopping {
+			w.JSON(http.StatusServiceUnavailable, "shutting down")
+			return
+		}
+		handler(w, r, p)
+	}
+}
+
+// quitHandler responds with the quit handler and then shuts the service down, like a signal does.
+func (s *serviceImpl) quitHandler() Handle {
+	handler := s.handlers.QuitHandler.NewQuitHandler()
+
+	return func(w WrappedResponseWriter, r *http.Request, p RouterParams) {
+		handler(w, r, p)
+
+		select {
+		case s.quitChan <- true:
+		default:
+			// The shutdown was already requested.
+		}
+	}
+}
+
+// RunPublicServer runs the public service on the current thread.
+func (s *serviceImpl) runPublicServer(options ServerOptions) {
+	router := s.publicRouter
+
+	addr := s.runHTTPServer(publicSubsystem, router, options, func() {
+		if s.drainer != nil {
+			s.drainer.Stopped()
+		}
+	})
 
-	s.runHTTPServer(s.port, router)
+	s.log.Info(events.RunPublicService, "%s %s running on %v.", s.globals.AppName, publicSubsystem, addr)
 }
@@ -40,9 +40,7 @@ func TestServiceImpl_AddRoute(t *testing.T) {
 		},
 		Logger:         log,
 		Metrics:        m,
-		Port:           1234,
-		ReadinessPort:  1235,
-		InternalPort:   1236,
+		EphemeralPorts: true,
 		ShutdownFunc:   func(log sf.Logger) {},
 		VersionBuilder: v,
 		RouterFactory:  rf,
@@ -141,9 +139,7 @@ func TestServiceImpl_Run(t *testing.T) {
 		},
 		Logger:         log,
 		Metrics:        m,
-		Port:           1234,
-		ReadinessPort:  1235,
-		InternalPort:   1236,
+		EphemeralPorts: true,
 		ShutdownFunc:   func(log sf.Logger) {},
 		VersionBuilder: v,
 		RouterFactory:  rf,
@@ -0,0 +1,205 @@
+package servicetest
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	sf "github.com/Prutswonder/go-servicefoundation"
+)
+
+// The baseline probes of the conformance suite.
+const (
+	// ProbeMethodNotAllowed expects 405 with an Allow header for a method the route doesn't support.
+	ProbeMethodNotAllowed Probe = "method-not-allowed"
+	// ProbeMalformedJSON expects 400 for a malformed JSON body, for routes that accept JSON.
+	ProbeMalformedJSON Probe = "malformed-json"
+	// ProbeMissingAuth expects 401 for a request without credentials, for authenticated routes.
+	ProbeMissingAuth Probe = "missing-auth"
+	// ProbeBodyTooLarge expects 413 for a body that exceeds the maximum body size of the route.
+	ProbeBodyTooLarge Probe = "body-too-large"
+
+	probePathValue = "probe"
+)
+
+var (
+	unsupportedMethodCandidates = []string{http.MethodDelete, http.MethodPut, http.MethodPatch, http.MethodPost, http.MethodGet}
+	bodyMethods                 = []string{http.MethodPost, http.MethodPut, http.MethodPatch}
+)
+
+type (
+	// Probe is the name of a baseline probe of the conformance suite.
+	Probe string
+
+	// ConformanceOptions contains the settings of the conformance suite. Exceptions contains the probes to skip per
+	// route, keyed by the route name or by subsystem and name, like "internal/quit". Authorize adds credentials to the
+	// probes of authenticated routes, other than ProbeMissingAuth.
+	ConformanceOptions struct {
+		Exceptions map[string][]Probe
+		Authorize  func(r *http.Request)
+	}
+
+	probeRequest struct {
+		probe       Probe
+		method      string
+		contentType string
+		body        []byte
+		authorize   bool
+		expected    int
+	}
+)
+
+// Conformance runs the baseline probes that apply to the declared metadata of every route of the service through its
+// in-process handlers, and reports each violated expectation as a test error.
+func Conformance(t testing.TB, svc sf.RouteRegistry, options ConformanceOptions) {
+	for _, route := range svc.Routes() {
+		handler := svc.Handler(route.Subsystem)
+		if handler == nil {
+			t.Errorf("%s route %s: no handler for subsystem", route.Subsystem, route.Name)
+			continue
+		}
+
+		for _, probe := range probesFor(route) {
+			if isException(options, route, probe.probe) {
+				continue
+			}
+
+			for _, path := range route.Paths {
+				runProbe(t, handler, route, probe, concretePath(path), options)
+			}
+		}
+	}
+}
+
+func probesFor(route sf.RouteInfo) []probeRequest {
+	var probes []probeRequest
+
+	if method := firstMissing(unsupportedMethodCandidates, route.Methods); method != "" {
+		probes = append(probes, probeRequest{
+			probe:     ProbeMethodNotAllowed,
+			method:    method,
+			authorize: true,
+			expected:  http.StatusMethodNotAllowed,
+		})
+	}
+
+	if route.Authenticated {
+		probes = append(probes, probeRequest{
+			probe:    ProbeMissingAuth,
+			method:   route.Methods[0],
+			expected: http.StatusUnauthorized,
+		})
+	}
+
+	method := firstPresent(bodyMethods, route.Methods)
+	if method == "" {
+		return probes
+	}
+
+	for _, contentType := range route.ContentTypes {
+		if contentType == sf.ContentTypeJSON || strings.HasSuffix(contentType, "+json") {
+			probes = append(probes, probeRequest{
+				probe:       ProbeMalformedJSON,
+				method:      method,
+				contentType: contentType,
+				body:        []byte(`{"probe":`),
+				authorize:   true,
+				expected:    http.StatusBadRequest,
+			})
+			break
+		}
+	}
+
+	if route.MaxBodySize > 0 {
+		contentType := "application/octet-stream"
+		if len(route.ContentTypes) > 0 {
+			contentType = route.ContentTypes[0]
+		}
+
+		probes = append(probes, probeRequest{
+			probe:       ProbeBodyTooLarge,
+			method:      method,
+			contentType: contentType,
+			body:        bytes.Repeat([]byte("a"), int(route.MaxBodySize)+1),
+			authorize:   true,
+			expected:    http.StatusRequestEntityTooLarge,
+		})
+	}
+	return probes
+}
+
+func runProbe(t testing.TB, handler http.Handler, route sf.RouteInfo, probe probeRequest, path string, options ConformanceOptions) {
+	r := httptest.NewRequest(probe.method, path, bytes.NewReader(probe.body))
+	if probe.contentType != "" {
+		r.Header.Set(sf.ContentTypeHeader, probe.contentType)
+	}
+	if probe.authorize && route.Authenticated && options.Authorize != nil {
+		options.Authorize(r)
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	if w.Code != probe.expected {
+		t.Errorf("%s route %s: %s probe %s %s: expected status %d, got %d", route.Subsystem, route.Name, probe.probe,
+			probe.method, path, probe.expected, w.Code)
+		return
+	}
+
+	if probe.probe != ProbeMethodNotAllowed {
+		return
+	}
+
+	allow := w.Header().Get("Allow")
+	for _, method := range route.Methods {
+		if !strings.Contains(allow, method) {
+			t.Errorf("%s route %s: %s probe %s %s: expected Allow header to contain %s, got '%s'", route.Subsystem,
+				route.Name, probe.probe, probe.method, path, method, allow)
+		}
+	}
+}
+
+func isException(options ConformanceOptions, route sf.RouteInfo, probe Probe) bool {
+	for _, key := range []string{route.Name, route.Subsystem + "/" + route.Name} {
+		for _, exception := range options.Exceptions[key] {
+			if exception == probe {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// concretePath replaces the parameters in the route path with a probe value.
+func concretePath(path string) string {
+	segments := strings.Split(path, "/")
+
+	for i, segment := range segments {
+		if strings.HasPrefix(segment, ":") || strings.HasPrefix(segment, "*") {
+			segments[i] = probePathValue
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+func firstMissing(candidates, methods []string) string {
+	for _, candidate := range candidates {
+		if firstPresent([]string{candidate}, methods) == "" {
+			return candidate
+		}
+	}
+	return ""
+}
+
+func firstPresent(candidates, methods []string) string {
+	for _, candidate := range candidates {
+		for _, method := range methods {
+			if method == candidate {
+				return candidate
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,93 @@
+package servicetest_test
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	sf "github.com/Prutswonder/go-servicefoundation"
+	"github.com/Prutswonder/go-servicefoundation/servicetest"
+	"github.com/stretchr/testify/assert"
+)
+
+type recordingT struct {
+	testing.TB
+	errors []string
+}
+
+func (r *recordingT) Errorf(format string, args ...interface{}) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+func requireToken(next sf.Handle) sf.Handle {
+	return func(w sf.WrappedResponseWriter, r *http.Request, p sf.RouterParams) {
+		if r.Header.Get("Authorization") != "Bearer probe" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		next(w, r, p)
+	}
+}
+
+func newConformanceService() sf.Service {
+	opt := sf.NewServiceOptions("conformance", []string{http.MethodGet, http.MethodPost}, nil)
+	opt.ExitFunc = func(int) {}
+
+	return sf.NewCustomService(opt)
+}
+
+func noContent(w sf.WrappedResponseWriter, _ *http.Request, _ sf.RouterParams) {
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func TestConformance_BuiltInRoutes(t *testing.T) {
+	sut := newConformanceService()
+
+	// Act
+	servicetest.Conformance(t, sut, servicetest.ConformanceOptions{})
+
+	assert.NotEmpty(t, sut.Routes())
+}
+
+func TestConformance_DeclaredMetadata(t *testing.T) {
+	sut := newConformanceService()
+	sut.AddRouteWithMetadata("orders", []string{"/orders/:id"}, sf.MethodsForPost, sf.DefaultMiddlewares,
+		sf.RouteMetadata{
+			ContentTypes: []string{sf.ContentTypeJSON},
+			MaxBodySize:  64,
+			Auth:         requireToken,
+		}, noContent)
+
+	// Act
+	servicetest.Conformance(t, sut, servicetest.ConformanceOptions{
+		Authorize: func(r *http.Request) { r.Header.Set("Authorization", "Bearer probe") },
+	})
+}
+
+func TestConformance_ReportsViolations(t *testing.T) {
+	sut := newConformanceService()
+	// Claims authentication, but lets anonymous requests through.
+	sut.AddRouteWithMetadata("open", []string{"/open"}, sf.MethodsForPost, sf.DefaultMiddlewares,
+		sf.RouteMetadata{Auth: func(next sf.Handle) sf.Handle { return next }}, noContent)
+	rt := &recordingT{TB: t}
+
+	// Act
+	servicetest.Conformance(rt, sut, servicetest.ConformanceOptions{})
+
+	assert.Len(t, rt.errors, 1)
+	assert.Contains(t, rt.errors[0], "public route open: missing-auth probe POST /open: expected status 401, got 204")
+}
+
+func TestConformance_Exceptions(t *testing.T) {
+	sut := newConformanceService()
+	sut.AddRouteWithMetadata("open", []string{"/open"}, sf.MethodsForPost, sf.DefaultMiddlewares,
+		sf.RouteMetadata{Auth: func(next sf.Handle) sf.Handle { return next }}, noContent)
+	rt := &recordingT{TB: t}
+
+	// Act
+	servicetest.Conformance(rt, sut, servicetest.ConformanceOptions{
+		Exceptions: map[string][]servicetest.Probe{"public/open": {servicetest.ProbeMissingAuth}},
+	})
+
+	assert.Empty(t, rt.errors)
+}
@@ -0,0 +1,112 @@
+package servicetest
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	sf "github.com/Prutswonder/go-servicefoundation"
+	"github.com/Prutswonder/go-servicefoundation/env"
+)
+
+// UpdateGoldenEnv is the environment variable that makes GoldenResponses regenerate the golden files instead of
+// verifying them, like `UPDATE_GOLDEN=1 go test ./...`.
+const UpdateGoldenEnv = "UPDATE_GOLDEN"
+
+var updateGoldenVariable = env.Register(UpdateGoldenEnv, env.TypeBool, "",
+	"Regenerates the golden files of servicetest.GoldenResponses instead of verifying them")
+
+type (
+	// GoldenExemplar is an exemplar request for a route, of which the response defines the golden shape. Route is
+	// the route name, or the subsystem and name, like "internal/health_check".
+	GoldenExemplar struct {
+		Route   string
+		Request *http.Request
+	}
+)
+
+// GoldenResponses serves the exemplar requests through the in-process handlers of the service and verifies the
+// shapes of their responses against the golden files in dir. Added fields are reported too, so the golden files are
+// kept up to date. With UpdateGoldenEnv set, the golden files are regenerated from the merged shapes of the exemplars
+// of every route instead.
+func GoldenResponses(t testing.TB, svc sf.RouteRegistry, dir string, exemplars []GoldenExemplar) {
+	update := updateGoldenVariable.IsSet()
+	routes := svc.Routes()
+	shapes := make(map[string]interface{})
+	var names []string
+
+	for _, exemplar := range exemplars {
+		route, ok := findRoute(routes, exemplar.Route)
+		if !ok {
+			t.Errorf("golden route %s: route not found", exemplar.Route)
+			continue
+		}
+
+		actual, ok := exemplarShape(t, svc.Handler(route.Subsystem), route, exemplar.Request)
+		if !ok {
+			continue
+		}
+
+		if !update {
+			verifyShape(t, route, dir, exemplar.Request, actual)
+			continue
+		}
+
+		if existing, ok := shapes[route.Name]; ok {
+			actual = sf.MergeResponseShapes(existing, actual)
+		} else {
+			names = append(names, route.Name)
+		}
+		shapes[route.Name] = actual
+	}
+
+	for _, name := range names {
+		b, _ := json.MarshalIndent(shapes[name], "", "  ")
+		if err := ioutil.WriteFile(sf.ResponseShapePath(dir, name), append(b, '\n'), 0644); err != nil {
+			t.Errorf("golden route %s: %v", name, err)
+		}
+	}
+}
+
+func exemplarShape(t testing.TB, handler http.Handler, route sf.RouteInfo, r *http.Request) (interface{}, bool) {
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	if w.Code < 200 || w.Code >= 300 {
+		t.Errorf("%s route %s: exemplar %s %s: expected a successful status, got %d", route.Subsystem, route.Name,
+			r.Method, r.URL.Path, w.Code)
+		return nil, false
+	}
+
+	shape, err := sf.ResponseShapeOf(w.Body.Bytes())
+	if err != nil {
+		t.Errorf("%s route %s: exemplar %s %s: %v", route.Subsystem, route.Name, r.Method, r.URL.Path, err)
+		return nil, false
+	}
+	return shape, true
+}
+
+func verifyShape(t testing.TB, route sf.RouteInfo, dir string, r *http.Request, actual interface{}) {
+	golden, err := sf.LoadResponseShape(sf.ResponseShapePath(dir, route.Name))
+	if err != nil {
+		t.Errorf("%s route %s: %v (regenerate with %s=1)", route.Subsystem, route.Name, err, UpdateGoldenEnv)
+		return
+	}
+
+	if diff := sf.CompareResponseShapes(golden, actual, false); len(diff) > 0 {
+		t.Errorf("%s route %s: exemplar %s %s doesn't match its golden shape:\n%s", route.Subsystem, route.Name,
+			r.Method, r.URL.Path, strings.Join(diff, "\n"))
+	}
+}
+
+func findRoute(routes []sf.RouteInfo, key string) (sf.RouteInfo, bool) {
+	for _, route := range routes {
+		if route.Name == key || route.Subsystem+"/"+route.Name == key {
+			return route, true
+		}
+	}
+	return sf.RouteInfo{}, false
+}
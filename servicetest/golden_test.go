@@ -0,0 +1,77 @@
+package servicetest_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	sf "github.com/Prutswonder/go-servicefoundation"
+	"github.com/Prutswonder/go-servicefoundation/servicetest"
+	"github.com/stretchr/testify/assert"
+)
+
+func newGoldenService(field string) sf.Service {
+	sut := newConformanceService()
+	sut.AddRoute("product", []string{"/products/:id"}, sf.MethodsForGet, sf.DefaultMiddlewares,
+		func(w sf.WrappedResponseWriter, _ *http.Request, p sf.RouterParams) {
+			if p.Params.ByName("id") == "2" {
+				w.JSON(http.StatusOK, map[string]interface{}{"id": 2, field: "b", "discount": 0.5})
+				return
+			}
+			w.JSON(http.StatusOK, map[string]interface{}{"id": 1, field: "a", "discount": nil})
+		})
+	return sut
+}
+
+func goldenExemplars() []servicetest.GoldenExemplar {
+	return []servicetest.GoldenExemplar{
+		{Route: "product", Request: httptest.NewRequest(http.MethodGet, "/products/1", nil)},
+		{Route: "product", Request: httptest.NewRequest(http.MethodGet, "/products/2", nil)},
+		{Route: "public/version", Request: httptest.NewRequest(http.MethodGet, "/service/version", nil)},
+	}
+}
+
+func TestGoldenResponses_Regenerates(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "golden")
+	defer os.RemoveAll(dir)
+	os.Setenv(servicetest.UpdateGoldenEnv, "1")
+	defer os.Unsetenv(servicetest.UpdateGoldenEnv)
+
+	// Act
+	servicetest.GoldenResponses(t, newGoldenService("name"), dir, goldenExemplars())
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "product.json"))
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"id":"number","name":"string","discount":"number"}`, string(b))
+	_, err = os.Stat(filepath.Join(dir, "version.json"))
+	assert.NoError(t, err)
+
+	os.Unsetenv(servicetest.UpdateGoldenEnv)
+	servicetest.GoldenResponses(t, newGoldenService("name"), dir, goldenExemplars())
+}
+
+func TestGoldenResponses_DetectsRenamedField(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "golden")
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "product.json"), []byte(`{"id":"number","name":"string","discount":"number"}`),
+		0644)
+	rt := &recordingT{TB: t}
+
+	// Act
+	servicetest.GoldenResponses(rt, newGoldenService("title"), dir, goldenExemplars()[:1])
+
+	assert.Len(t, rt.errors, 1)
+	assert.Contains(t, rt.errors[0], "$.name: missing field\n$.title: added field")
+}
+
+func TestGoldenResponses_UnknownRoute(t *testing.T) {
+	rt := &recordingT{TB: t}
+
+	// Act
+	servicetest.GoldenResponses(rt, newGoldenService("name"), "", []servicetest.GoldenExemplar{{Route: "missing"}})
+
+	assert.Equal(t, []string{"golden route missing: route not found"}, rt.errors)
+}
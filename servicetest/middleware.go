@@ -0,0 +1,31 @@
+// Package servicetest contains helpers for testing ServiceFoundation handlers and middleware in isolation.
+package servicetest
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	sf "github.com/Prutswonder/go-servicefoundation"
+)
+
+// RunMiddleware executes the given MiddlewareFunc for the specified request, using a spy handler as the next handler
+// in the chain. It returns the recorded response and whether or not the next handler was called.
+func RunMiddleware(middleware sf.MiddlewareFunc, r *http.Request) (*httptest.ResponseRecorder, bool) {
+	return RunMiddlewareWithHandler(middleware, r, func(sf.WrappedResponseWriter, *http.Request, sf.RouterParams) {})
+}
+
+// RunMiddlewareWithHandler executes the given MiddlewareFunc for the specified request, using the given handler as
+// the next handler in the chain. It returns the recorded response and whether or not the handler was called.
+func RunMiddlewareWithHandler(middleware sf.MiddlewareFunc, r *http.Request, handler sf.Handle) (*httptest.ResponseRecorder, bool) {
+	called := false
+	spy := func(w sf.WrappedResponseWriter, r *http.Request, p sf.RouterParams) {
+		called = true
+		handler(w, r, p)
+	}
+	recorder := httptest.NewRecorder()
+
+	h := sf.NewChain(middleware).Then(spy)
+	h(sf.NewWrappedResponseWriter(recorder), r, sf.RouterParams{})
+
+	return recorder, called
+}
@@ -0,0 +1,112 @@
+package servicetest
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	sf "github.com/Prutswonder/go-servicefoundation"
+)
+
+const (
+	startAttempts     = 200
+	startRetryBackoff = 5 * time.Millisecond
+	stopTimeout       = 5 * time.Second
+)
+
+type (
+	// RunningService is a Service started by StartService, with the base URLs of its public, readiness and internal
+	// servers, like "http://127.0.0.1:34567".
+	RunningService struct {
+		sf.Service
+		Public    string
+		Readiness string
+		Internal  string
+		stopOnce  sync.Once
+		stop      func()
+	}
+)
+
+// StartService creates a Service from the options with ephemeral ports, so tests can run in parallel, and runs it
+// until the test has finished. The setup func, if any, is called before running, for adding routes. StartService
+// returns once all servers accept connections.
+func StartService(t testing.TB, options sf.ServiceOptions, setup func(sf.Service)) *RunningService {
+	options.EphemeralPorts = true
+	// A second signal should not exit the test binary.
+	options.ForceExitFunc = func(int) {}
+
+	svc := sf.NewCustomService(options)
+	if setup != nil {
+		setup(svc)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		svc.Run(ctx)
+		close(stopped)
+	}()
+
+	running := &RunningService{Service: svc}
+	running.stop = func() {
+		cancel()
+		select {
+		case <-stopped:
+		case <-time.After(stopTimeout):
+			t.Errorf("Service did not stop within %v", stopTimeout)
+		}
+	}
+	t.Cleanup(running.Stop)
+
+	urls, err := waitForListeners(svc, stopped)
+	if err != nil {
+		t.Fatalf("Failed starting service: %v", err)
+	}
+	running.Public, running.Readiness, running.Internal = urls[0], urls[1], urls[2]
+	return running
+}
+
+// Stop shuts the service down and waits until it has stopped. It is called when the test has finished.
+func (s *RunningService) Stop() {
+	s.stopOnce.Do(s.stop)
+}
+
+// waitForListeners retries until the servers of all subsystems accept connections and returns their base URLs.
+func waitForListeners(svc sf.Service, stopped <-chan struct{}) ([]string, error) {
+	subsystems := []string{"public", "readiness", "internal"}
+	urls := make([]string, len(subsystems))
+
+	for attempt := 0; attempt < startAttempts; attempt++ {
+		select {
+		case <-stopped:
+			return nil, fmt.Errorf("service stopped before listening")
+		default:
+		}
+
+		ready := 0
+		for i, subsystem := range subsystems {
+			addr, ok := svc.Addr(subsystem).(*net.TCPAddr)
+			if !ok {
+				break
+			}
+
+			host := fmt.Sprintf("127.0.0.1:%d", addr.Port)
+			conn, err := net.DialTimeout("tcp", host, startRetryBackoff)
+			if err != nil {
+				break
+			}
+			conn.Close()
+			urls[i] = "http://" + host
+			ready++
+		}
+
+		if ready == len(subsystems) {
+			return urls, nil
+		}
+		time.Sleep(startRetryBackoff)
+	}
+	return nil, fmt.Errorf("servers not accepting connections after %d attempts", startAttempts)
+}
@@ -0,0 +1,47 @@
+package servicetest_test
+
+import (
+	"net/http"
+	"testing"
+
+	sf "github.com/Prutswonder/go-servicefoundation"
+	"github.com/Prutswonder/go-servicefoundation/servicetest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStartService_Parallel(t *testing.T) {
+	for _, name := range []string{"first", "second", "third"} {
+		name := name
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			opt := sf.NewServiceOptions(name, []string{http.MethodGet}, nil)
+
+			// Act
+			sut := servicetest.StartService(t, opt, func(svc sf.Service) {
+				svc.AddRoute("ping", []string{"/ping"}, sf.MethodsForGet, sf.DefaultMiddlewares, noContent)
+			})
+
+			for _, url := range []string{sut.Public + "/ping", sut.Readiness + "/service/readiness", sut.Internal + "/health_check"} {
+				resp, err := http.Get(url)
+				if assert.NoError(t, err, url) {
+					resp.Body.Close()
+					assert.True(t, resp.StatusCode < 300, url)
+				}
+			}
+			assert.NotEqual(t, sut.Public, sut.Readiness)
+			assert.NotEqual(t, sut.Readiness, sut.Internal)
+		})
+	}
+}
+
+func TestStartService_Stop(t *testing.T) {
+	t.Parallel()
+	sut := servicetest.StartService(t, sf.NewServiceOptions("stop", []string{http.MethodGet}, nil), nil)
+
+	// Act
+	sut.Stop()
+
+	_, err := http.Get(sut.Public + "/service/liveness")
+	assert.Error(t, err)
+	sut.Stop()
+}
@@ -0,0 +1,433 @@
+package servicefoundation
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Prutswonder/go-servicefoundation/events"
+)
+
+const (
+	defaultShadowBudget        = 2 * time.Second
+	defaultShadowMaxMismatches = 50
+	defaultShadowMaxBodySize   = 1 << 20
+
+	shadowResultMatch    = "match"
+	shadowResultMismatch = "mismatch"
+	shadowResultTimeout  = "timeout"
+	shadowResultRefused  = "refused"
+	shadowResultSkipped  = "skipped"
+)
+
+type (
+	// ShadowOptions contains the settings for comparing the responses of a stable and canary handler.
+	ShadowOptions struct {
+		// SampleRate is the fraction (0..1) of requests that are also executed by the canary handler.
+		SampleRate float64
+		// Budget is the maximum time the canary handler is allowed to take. Slower executions are abandoned.
+		Budget time.Duration
+		// IgnoredHeaders contains the response headers that are excluded from the comparison.
+		IgnoredHeaders []string
+		// IgnoredPaths contains the JSON paths (like "data.id" or "items.*.timestamp") that are excluded from the
+		// comparison.
+		IgnoredPaths []string
+		// MaxMismatches is the number of most recent mismatches that are kept for inspection.
+		MaxMismatches int
+		// MaxBodySize is the maximum size of request and response bodies that can be compared.
+		MaxBodySize int
+		// Force allows shadow execution for non-idempotent requests, like POST and PATCH.
+		Force bool
+	}
+
+	// ShadowMismatch contains the redacted details of a difference between the stable and canary responses. Only the
+	// locations of differences are kept, never the response contents.
+	ShadowMismatch struct {
+		Route       string    `json:"route"`
+		Method      string    `json:"method"`
+		Path        string    `json:"path"`
+		Time        time.Time `json:"time"`
+		Differences []string  `json:"differences"`
+	}
+
+	// ShadowComparer executes canary handlers in the shadow of stable handlers and records their differences.
+	ShadowComparer interface {
+		Middleware(route string, canary Handle) MiddlewareFunc
+		Mismatches() []ShadowMismatch
+	}
+
+	shadowComparerImpl struct {
+		options        ShadowOptions
+		log            Logger
+		metrics        Metrics
+		ignoredHeaders map[string]bool
+		mutex          sync.Mutex
+		mismatches     []ShadowMismatch
+	}
+
+	recordedResponse struct {
+		status    int
+		header    http.Header
+		body      []byte
+		truncated bool
+	}
+
+	readCloser struct {
+		io.Reader
+		io.Closer
+	}
+
+	teeResponseWriter struct {
+		http.ResponseWriter
+		maxBodySize int
+		status      int
+		body        bytes.Buffer
+		truncated   bool
+	}
+)
+
+// NewShadowComparer creates and returns a new ShadowComparer.
+func NewShadowComparer(options ShadowOptions, log Logger, metrics Metrics) ShadowComparer {
+	if options.Budget <= 0 {
+		options.Budget = defaultShadowBudget
+	}
+	if options.MaxMismatches <= 0 {
+		options.MaxMismatches = defaultShadowMaxMismatches
+	}
+	if options.MaxBodySize <= 0 {
+		options.MaxBodySize = defaultShadowMaxBodySize
+	}
+
+	ignoredHeaders := map[string]bool{"Date": true, "Content-Length": true}
+	for _, header := range options.IgnoredHeaders {
+		ignoredHeaders[http.CanonicalHeaderKey(header)] = true
+	}
+
+	return &shadowComparerImpl{
+		options:        options,
+		log:            log,
+		metrics:        metrics,
+		ignoredHeaders: ignoredHeaders,
+	}
+}
+
+// NewShadowMismatchesHandler returns a handler that lists the most recent mismatches of the given ShadowComparer.
+func NewShadowMismatchesHandler(comparer ShadowComparer) Handle {
+	return func(w WrappedResponseWriter, _ *http.Request, _ RouterParams) {
+		w.JSON(http.StatusOK, comparer.Mismatches())
+	}
+}
+
+/* ShadowComparer implementation */
+
+func (c *shadowComparerImpl) Middleware(route string, canary Handle) MiddlewareFunc {
+	return func(next Handle) Handle {
+		return func(w WrappedResponseWriter, r *http.Request, p RouterParams) {
+			if rand.Float64() >= c.options.SampleRate {
+				next(w, r, p)
+				return
+			}
+
+			if !isIdempotent(r.Method) && !c.options.Force {
+				c.count(route, shadowResultRefused)
+				next(w, r, p)
+				return
+			}
+
+			body, ok := c.bufferBody(r)
+			if !ok {
+				c.count(route, shadowResultSkipped)
+				next(w, r, p)
+				return
+			}
+
+			// Headers set by outer middleware are handed to the canary as well, so they don't show up as differences.
+			initialHeader := cloneHeader(w.Header())
+			tee := &teeResponseWriter{ResponseWriter: w, maxBodySize: c.options.MaxBodySize, status: http.StatusOK}
+			next(NewWrappedResponseWriter(tee), r, p)
+
+			stable := recordedResponse{
+				status:    tee.status,
+				header:    cloneHeader(w.Header()),
+				body:      tee.body.Bytes(),
+				truncated: tee.truncated,
+			}
+
+			// The real response is complete at this point, so the shadow execution never delays it.
+			go c.shadow(route, canary, r, body, p, initialHeader, stable)
+		}
+	}
+}
+
+func (c *shadowComparerImpl) Mismatches() []ShadowMismatch {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return append([]ShadowMismatch{}, c.mismatches...)
+}
+
+func (c *shadowComparerImpl) bufferBody(r *http.Request) ([]byte, bool) {
+	if r.Body == nil {
+		return nil, true
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, int64(c.options.MaxBodySize)+1))
+
+	if err != nil || len(body) > c.options.MaxBodySize {
+		// Too large to compare, so hand the stable handler the bytes already read followed by the remainder.
+		r.Body = readCloser{Reader: io.MultiReader(bytes.NewReader(body), r.Body), Closer: r.Body}
+		return nil, false
+	}
+
+	r.Body.Close()
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return body, true
+}
+
+func (c *shadowComparerImpl) shadow(route string, canary Handle, r *http.Request, body []byte, p RouterParams,
+	initialHeader http.Header, stable recordedResponse) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.options.Budget)
+	defer cancel()
+
+	shadowRequest := r.WithContext(ctx)
+	shadowRequest.Body = ioutil.NopCloser(bytes.NewReader(body))
+	recorder := httptest.NewRecorder()
+	for k, v := range initialHeader {
+		recorder.Header()[k] = v
+	}
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		defer func() {
+			if rec := recover(); rec != nil {
+				c.log.Warn(events.ShadowPanic, "Canary for %s panicked: %v", route, rec)
+				recorder.Code = http.StatusInternalServerError
+			}
+		}()
+
+		canary(NewWrappedResponseWriter(recorder), shadowRequest, p)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		c.count(route, shadowResultTimeout)
+		return
+	}
+
+	if stable.truncated || recorder.Body.Len() > c.options.MaxBodySize {
+		c.count(route, shadowResultSkipped)
+		return
+	}
+
+	canaryResponse := recordedResponse{
+		status: recorder.Code,
+		header: recorder.Header(),
+		body:   recorder.Body.Bytes(),
+	}
+	differences := c.diff(stable, canaryResponse)
+
+	if len(differences) == 0 {
+		c.count(route, shadowResultMatch)
+		return
+	}
+
+	c.count(route, shadowResultMismatch)
+	c.record(ShadowMismatch{
+		Route:       route,
+		Method:      r.Method,
+		Path:        r.URL.Path,
+		Time:        time.Now().UTC(),
+		Differences: differences,
+	})
+}
+
+func (c *shadowComparerImpl) diff(stable, canary recordedResponse) []string {
+	differences := []string{}
+
+	if stable.status != canary.status {
+		differences = append(differences, fmt.Sprintf("status: %d != %d", stable.status, canary.status))
+	}
+
+	for _, name := range headerNames(stable.header, canary.header) {
+		if c.ignoredHeaders[name] {
+			continue
+		}
+		if !reflect.DeepEqual(stable.header[name], canary.header[name]) {
+			differences = append(differences, "header: "+name)
+		}
+	}
+
+	var stableJSON, canaryJSON interface{}
+	if json.Unmarshal(stable.body, &stableJSON) == nil && json.Unmarshal(canary.body, &canaryJSON) == nil {
+		for _, path := range c.options.IgnoredPaths {
+			stableJSON = removeJSONPath(stableJSON, strings.Split(path, "."))
+			canaryJSON = removeJSONPath(canaryJSON, strings.Split(path, "."))
+		}
+		return append(differences, diffJSON("body", stableJSON, canaryJSON)...)
+	}
+
+	if !bytes.Equal(stable.body, canary.body) {
+		differences = append(differences, "body")
+	}
+	return differences
+}
+
+func (c *shadowComparerImpl) record(mismatch ShadowMismatch) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.mismatches = append(c.mismatches, mismatch)
+
+	if len(c.mismatches) > c.options.MaxMismatches {
+		c.mismatches = c.mismatches[len(c.mismatches)-c.options.MaxMismatches:]
+	}
+}
+
+func (c *shadowComparerImpl) count(route, result string) {
+	c.metrics.CountLabels("", "shadow_comparisons_total", "Total shadow comparisons between stable and canary.",
+		[]string{"route", "result"}, []string{strings.ToLower(route), result})
+}
+
+/* teeResponseWriter implementation */
+
+func (w *teeResponseWriter) WriteHeader(code int) {
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *teeResponseWriter) Write(p []byte) (int, error) {
+	if w.body.Len()+len(p) > w.maxBodySize {
+		w.truncated = true
+	} else {
+		w.body.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+func cloneHeader(header http.Header) http.Header {
+	clone := make(http.Header, len(header))
+
+	for k, v := range header {
+		clone[k] = append([]string(nil), v...)
+	}
+	return clone
+}
+
+func headerNames(headers ...http.Header) []string {
+	unique := make(map[string]bool)
+
+	for _, header := range headers {
+		for name := range header {
+			unique[http.CanonicalHeaderKey(name)] = true
+		}
+	}
+
+	names := make([]string, 0, len(unique))
+	for name := range unique {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// removeJSONPath removes the value at the given path from a decoded JSON document. A "*" segment matches all
+// elements of an array or all keys of an object.
+func removeJSONPath(doc interface{}, path []string) interface{} {
+	if len(path) == 0 {
+		return doc
+	}
+
+	segment, last := path[0], len(path) == 1
+
+	switch v := doc.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if segment != "*" && segment != key {
+				continue
+			}
+			if last {
+				delete(v, key)
+			} else {
+				v[key] = removeJSONPath(value, path[1:])
+			}
+		}
+	case []interface{}:
+		for i, value := range v {
+			if segment != "*" && segment != strconv.Itoa(i) {
+				continue
+			}
+			if last {
+				v[i] = nil
+			} else {
+				v[i] = removeJSONPath(value, path[1:])
+			}
+		}
+	}
+	return doc
+}
+
+func diffJSON(path string, stable, canary interface{}) []string {
+	stableMap, ok1 := stable.(map[string]interface{})
+	canaryMap, ok2 := canary.(map[string]interface{})
+
+	if ok1 && ok2 {
+		keys := make(map[string]bool)
+		for k := range stableMap {
+			keys[k] = true
+		}
+		for k := range canaryMap {
+			keys[k] = true
+		}
+
+		sortedKeys := make([]string, 0, len(keys))
+		for k := range keys {
+			sortedKeys = append(sortedKeys, k)
+		}
+		sort.Strings(sortedKeys)
+
+		differences := []string{}
+		for _, k := range sortedKeys {
+			differences = append(differences, diffJSON(path+"."+k, stableMap[k], canaryMap[k])...)
+		}
+		return differences
+	}
+
+	stableSlice, ok1 := stable.([]interface{})
+	canarySlice, ok2 := canary.([]interface{})
+
+	if ok1 && ok2 && len(stableSlice) == len(canarySlice) {
+		differences := []string{}
+		for i := range stableSlice {
+			differences = append(differences, diffJSON(path+"."+strconv.Itoa(i), stableSlice[i], canarySlice[i])...)
+		}
+		return differences
+	}
+
+	if !reflect.DeepEqual(stable, canary) {
+		return []string{path}
+	}
+	return nil
+}
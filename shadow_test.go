@@ -0,0 +1,134 @@
+package servicefoundation_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	sf "github.com/Prutswonder/go-servicefoundation"
+	"github.com/Prutswonder/go-servicefoundation/servicetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func newTestShadowComparer(options sf.ShadowOptions) (sf.ShadowComparer, chan string) {
+	log := &mockLogger{}
+	m := &mockMetrics{}
+	results := make(chan string, 10)
+
+	log.On("Warn", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	m.
+		On("CountLabels", "", "shadow_comparisons_total", mock.Anything, []string{"route", "result"}, mock.Anything).
+		Run(func(args mock.Arguments) {
+			results <- args.Get(4).([]string)[1]
+		})
+
+	options.SampleRate = 1
+	return sf.NewShadowComparer(options, log, m), results
+}
+
+func newJSONHandle(status int, content interface{}) sf.Handle {
+	return func(w sf.WrappedResponseWriter, _ *http.Request, _ sf.RouterParams) {
+		w.Header().Set("X-Request-Id", time.Now().String())
+		w.JSON(status, content)
+	}
+}
+
+func assertShadowResult(t *testing.T, results chan string, expected string) {
+	select {
+	case actual := <-results:
+		assert.Equal(t, expected, actual)
+	case <-time.After(time.Second):
+		assert.Fail(t, "No shadow result recorded", "Expected %s", expected)
+	}
+}
+
+func TestShadowComparer_DivergenceIsCaptured(t *testing.T) {
+	sut, results := newTestShadowComparer(sf.ShadowOptions{IgnoredHeaders: []string{"X-Request-Id"}})
+	stable := newJSONHandle(http.StatusOK, map[string]interface{}{"id": 1, "price": 10})
+	canary := newJSONHandle(http.StatusOK, map[string]interface{}{"id": 1, "price": 12})
+	r, _ := http.NewRequest(http.MethodGet, "/orders/1?secret=abc", nil)
+
+	// Act
+	w, _ := servicetest.RunMiddlewareWithHandler(sut.Middleware("orders", canary), r, stable)
+
+	assert.JSONEq(t, `{"id":1,"price":10}`, w.Body.String())
+	assertShadowResult(t, results, "mismatch")
+
+	mismatches := sut.Mismatches()
+
+	assert.Len(t, mismatches, 1)
+	assert.Equal(t, "/orders/1", mismatches[0].Path)
+	assert.Equal(t, []string{"body.price"}, mismatches[0].Differences)
+}
+
+func TestShadowComparer_IgnoreRules(t *testing.T) {
+	sut, results := newTestShadowComparer(sf.ShadowOptions{
+		IgnoredHeaders: []string{"X-Request-Id"},
+		IgnoredPaths:   []string{"generatedAt", "items.*.id"},
+	})
+	stable := newJSONHandle(http.StatusOK, map[string]interface{}{
+		"generatedAt": "2017-01-01",
+		"items":       []interface{}{map[string]interface{}{"id": "a", "name": "x"}},
+	})
+	canary := newJSONHandle(http.StatusOK, map[string]interface{}{
+		"generatedAt": "2017-01-02",
+		"items":       []interface{}{map[string]interface{}{"id": "b", "name": "x"}},
+	})
+	r, _ := http.NewRequest(http.MethodGet, "/orders", nil)
+
+	// Act
+	servicetest.RunMiddlewareWithHandler(sut.Middleware("orders", canary), r, stable)
+
+	assertShadowResult(t, results, "match")
+	assert.Empty(t, sut.Mismatches())
+}
+
+func TestShadowComparer_BudgetCutoff(t *testing.T) {
+	sut, results := newTestShadowComparer(sf.ShadowOptions{Budget: 5 * time.Millisecond})
+	stable := newJSONHandle(http.StatusOK, "ok")
+	canary := func(w sf.WrappedResponseWriter, r *http.Request, _ sf.RouterParams) {
+		time.Sleep(100 * time.Millisecond)
+		w.JSON(http.StatusInternalServerError, "slow")
+	}
+	r, _ := http.NewRequest(http.MethodGet, "/orders", nil)
+	start := time.Now()
+
+	// Act
+	servicetest.RunMiddlewareWithHandler(sut.Middleware("orders", canary), r, stable)
+
+	assert.True(t, time.Since(start) < 50*time.Millisecond)
+	assertShadowResult(t, results, "timeout")
+	assert.Empty(t, sut.Mismatches())
+}
+
+func TestShadowComparer_IdempotencyGuard(t *testing.T) {
+	for _, force := range []bool{false, true} {
+		sut, results := newTestShadowComparer(sf.ShadowOptions{Force: force})
+		canaryBody := make(chan string, 1)
+		stable := func(w sf.WrappedResponseWriter, r *http.Request, _ sf.RouterParams) {
+			body, _ := ioutil.ReadAll(r.Body)
+			w.JSON(http.StatusCreated, string(body))
+		}
+		canary := func(w sf.WrappedResponseWriter, r *http.Request, _ sf.RouterParams) {
+			body, _ := ioutil.ReadAll(r.Body)
+			canaryBody <- string(body)
+			w.JSON(http.StatusCreated, string(body))
+		}
+		r, _ := http.NewRequest(http.MethodPost, "/orders", bytes.NewBufferString("order"))
+
+		// Act
+		w, _ := servicetest.RunMiddlewareWithHandler(sut.Middleware("orders", canary), r, stable)
+
+		assert.Equal(t, http.StatusCreated, w.Code)
+		if force {
+			assert.Equal(t, "order", <-canaryBody)
+			assertShadowResult(t, results, "match")
+		} else {
+			assertShadowResult(t, results, "refused")
+			assert.Empty(t, canaryBody)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package servicefoundation
+
+import (
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Prutswonder/go-servicefoundation/events"
+)
+
+// The shutdown modes of a Service.
+const (
+	// ShutdownModeGraceful drains the service and waits for critical sections before exiting.
+	ShutdownModeGraceful ShutdownMode = "graceful"
+	// ShutdownModeFast skips the drain and gives the shutdown hooks fastShutdownDeadline in total, which makes
+	// restarts during development and CI instant.
+	ShutdownModeFast ShutdownMode = "fast"
+
+	// ExitCodeForced is the exit code when a second signal forces the exit during a shutdown.
+	ExitCodeForced = 130
+
+	fastShutdownDeadline = 100 * time.Millisecond
+)
+
+// developmentEnvironments are the deploy environments that select the fast shutdown mode and development checks
+// automatically.
+var developmentEnvironments = []string{"development", "dev", "local"}
+
+// ShutdownMode determines how a Service shuts down after a signal or cancellation.
+type ShutdownMode string
+
+// ResolveShutdownMode returns the shutdown mode for the setting, like the SHUTDOWN_MODE environment variable. Without
+// a valid setting, development deploy environments use the fast mode and all others the graceful mode. Production
+// never selects the fast mode automatically.
+func ResolveShutdownMode(setting, deployEnvironment string) ShutdownMode {
+	switch ShutdownMode(strings.ToLower(setting)) {
+	case ShutdownModeFast:
+		return ShutdownModeFast
+	case ShutdownModeGraceful:
+		return ShutdownModeGraceful
+	}
+
+	if isDevelopmentEnvironment(deployEnvironment) {
+		return ShutdownModeFast
+	}
+	return ShutdownModeGraceful
+}
+
+// isDevelopmentEnvironment returns true for the development deploy environments, which never include production.
+func isDevelopmentEnvironment(deployEnvironment string) bool {
+	environment := strings.ToLower(deployEnvironment)
+	for _, development := range developmentEnvironments {
+		if environment == development {
+			return true
+		}
+	}
+	return false
+}
+
+// NewFastExitFunc returns a new exit function for the fast shutdown mode. It gives the shutdownFunc at most
+// fastShutdownDeadline before calling os.Exit.
+//
+// Deprecated: Run calls the ShutdownFunc of the ServiceOptions and returns; use RunAndExit to exit afterwards.
+func NewFastExitFunc(log Logger, shutdownFunc ShutdownFunc) func(int) {
+	return func(code int) {
+		log.Debug(events.ServiceExit, "Performing fast service exit")
+
+		go func() {
+			if shutdownFunc != nil {
+				done := make(chan struct{})
+				go func() {
+					shutdownFunc(log)
+					close(done)
+				}()
+
+				select {
+				case <-done:
+				case <-time.After(fastShutdownDeadline):
+					log.Warn(events.ShutdownFunc, "Abandoning shutdown func after %v", fastShutdownDeadline)
+				}
+			}
+
+			log.Debug(events.ServiceExit, "Calling os.Exit(%v)", code)
+			os.Exit(code)
+		}()
+
+		// Allow the go-routine to be spawned
+		time.Sleep(1 * time.Millisecond)
+	}
+}
+
+// forceOnSignal forces the exit when another signal is received before stopped is closed.
+func (s *serviceImpl) forceOnSignal(sigs <-chan os.Signal, stopped <-chan struct{}) {
+	select {
+	case sig := <-sigs:
+		s.log.Error(events.ForcedShutdown, "Shutdown forced by %v", sig)
+		s.forceExitFunc(ExitCodeForced)
+	case <-stopped:
+	}
+}
+
+// shutdownHooks waits for the critical sections, stops the task queue and pushes the metrics. In the fast mode they
+// share an aggregate deadline, after which the remaining hooks are abandoned.
+func (s *serviceImpl) shutdownHooks() {
+	if s.shutdownMode != ShutdownModeFast {
+		s.waitForCriticalSections(s.criticalTimeout)
+		s.stopTaskQueue()
+		s.pushMetrics()
+		return
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.waitForCriticalSections(fastShutdownDeadline)
+		s.stopTaskQueue()
+		s.pushMetrics()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(fastShutdownDeadline):
+		s.log.Warn(events.FastShutdown, "Abandoning shutdown hooks after %v", fastShutdownDeadline)
+	}
+}
+
+// runShutdownFunc calls the ShutdownFunc. In the fast mode, it is abandoned after fastShutdownDeadline.
+func (s *serviceImpl) runShutdownFunc() {
+	if s.shutdownFunc == nil {
+		return
+	}
+
+	s.log.Debug(events.ShutdownFunc, "Calling shutdown func")
+	if s.shutdownMode != ShutdownModeFast {
+		s.shutdownFunc(s.log)
+		return
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.shutdownFunc(s.log)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(fastShutdownDeadline):
+		s.log.Warn(events.ShutdownFunc, "Abandoning shutdown func after %v", fastShutdownDeadline)
+	}
+}
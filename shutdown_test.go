@@ -0,0 +1,200 @@
+package servicefoundation_test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	sf "github.com/Prutswonder/go-servicefoundation"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// newShutdownService returns a service with a pending critical section. The expectations of the log are completed
+// with expectations that accept any message, so the expectations of the caller take precedence.
+func newShutdownService(mode sf.ShutdownMode, drainer sf.Drainer, forcedCodes chan int, log *mockLogger) (sf.Service, sf.CriticalOperation) {
+	log.On("Debug", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	log.On("Info", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	log.On("Warn", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	log.On("Error", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	m := &mockMetrics{}
+	m.On("SetGaugeLabels", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+	critical := sf.NewCriticalSections(log, m, 0)
+	operation, _ := critical.Begin("payment")
+
+	opt := sf.NewServiceOptions("shutdown", []string{http.MethodGet}, nil)
+	opt.Logger = log
+	opt.Port, opt.ReadinessPort, opt.InternalPort = 0, 0, 0
+	opt.ShutdownMode = mode
+	opt.Drainer = drainer
+	opt.CriticalSections = critical
+	opt.CriticalDeadline = 10 * time.Second
+	opt.ForceExitFunc = func(code int) { forcedCodes <- code }
+	return sf.NewCustomService(opt), operation
+}
+
+func TestResolveShutdownMode(t *testing.T) {
+	tests := []struct {
+		setting     string
+		environment string
+		expected    sf.ShutdownMode
+	}{
+		{"", "development", sf.ShutdownModeFast},
+		{"", "Local", sf.ShutdownModeFast},
+		{"", "production", sf.ShutdownModeGraceful},
+		{"", "PRODUCTION", sf.ShutdownModeGraceful},
+		{"", "staging", sf.ShutdownModeGraceful},
+		{"", "UNKNOWN", sf.ShutdownModeGraceful},
+		{"turbo", "production", sf.ShutdownModeGraceful},
+		{"graceful", "dev", sf.ShutdownModeGraceful},
+		{"fast", "staging", sf.ShutdownModeFast},
+	}
+
+	for _, test := range tests {
+		// Act
+		actual := sf.ResolveShutdownMode(test.setting, test.environment)
+
+		assert.Equal(t, test.expected, actual, "%q in %q", test.setting, test.environment)
+	}
+}
+
+func TestServiceImpl_FastShutdownSkipsDrain(t *testing.T) {
+	drainer := &mockDrainer{}
+	drainer.On("Middleware", mock.Anything).Return(sf.MiddlewareFunc(func(next sf.Handle) sf.Handle { return next }))
+	drainer.On("ReadinessMiddleware").Return(sf.MiddlewareFunc(func(next sf.Handle) sf.Handle { return next }))
+	drainer.On("Stopped")
+	sut, operation := newShutdownService(sf.ShutdownModeFast, drainer, make(chan int, 1), &mockLogger{})
+	defer operation.Done()
+	ctx, cancel := context.WithCancel(context.Background())
+	start := time.Now()
+	returned := make(chan error, 1)
+
+	// Act
+	go func() { returned <- sut.Run(ctx) }()
+	cancel()
+
+	select {
+	case err := <-returned:
+		assert.NoError(t, err)
+		assert.True(t, time.Since(start) < time.Second, "the pending critical section must not delay the return")
+	case <-time.After(5 * time.Second):
+		t.Fatal("fast shutdown did not return")
+	}
+	drainer.AssertNotCalled(t, "BeginDrain")
+}
+
+func newRunService(shutdowns chan string, exitCodes chan int, configure func(opt *sf.ServiceOptions)) sf.Service {
+	opt := sf.NewServiceOptions("run", []string{http.MethodGet}, func(sf.Logger) { shutdowns <- "shutdown" })
+	opt.EphemeralPorts = true
+	opt.ShutdownMode = sf.ShutdownModeGraceful
+	opt.ExitFunc = func(code int) { exitCodes <- code }
+	opt.ForceExitFunc = func(int) {}
+	if configure != nil {
+		configure(&opt)
+	}
+	return sf.NewCustomService(opt)
+}
+
+// waitForAddr returns the address of the server of the subsystem once it listens, and fails the test when it doesn't
+// listen within 5 seconds.
+func waitForAddr(t *testing.T, sut sf.Service, subsystem string) net.Addr {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if addr := sut.Addr(subsystem); addr != nil {
+			return addr
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("the %s server did not listen within 5 seconds", subsystem)
+	return nil
+}
+
+func TestServiceImpl_RunReturnsAfterShutdown(t *testing.T) {
+	shutdowns := make(chan string, 1)
+	exitCodes := make(chan int, 1)
+	sut := newRunService(shutdowns, exitCodes, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	returned := make(chan error, 1)
+	go func() { returned <- sut.Run(ctx) }()
+	public := "http://" + waitForAddr(t, sut, "public").String() + "/service/liveness"
+
+	// Act
+	cancel()
+
+	select {
+	case err := <-returned:
+		assert.NoError(t, err)
+		assert.Len(t, shutdowns, 1, "the shutdown func is called before Run returns")
+		assert.Len(t, exitCodes, 0, "Run doesn't exit")
+		_, err = http.Get(public)
+		assert.Error(t, err, "the servers are closed")
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return")
+	}
+}
+
+func TestServiceImpl_ShutdownClosesConnectionsWithoutRequests(t *testing.T) {
+	shutdowns := make(chan string, 1)
+	exitCodes := make(chan int, 1)
+	sut := newRunService(shutdowns, exitCodes, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	returned := make(chan error, 1)
+	go func() { returned <- sut.Run(ctx) }()
+	conn, err := net.Dial("tcp", waitForAddr(t, sut, "public").String())
+	if !assert.NoError(t, err) {
+		cancel()
+		return
+	}
+	defer conn.Close()
+	// Accepted by the server, but no request is sent.
+	time.Sleep(20 * time.Millisecond)
+	start := time.Now()
+
+	// Act
+	cancel()
+
+	select {
+	case err := <-returned:
+		assert.NoError(t, err)
+		assert.True(t, time.Since(start) < 2*time.Second, "the shutdown took %v", time.Since(start))
+	case <-time.After(10 * time.Second):
+		t.Fatal("Run did not return")
+	}
+}
+
+func TestServiceImpl_QuitShutsDownGracefully(t *testing.T) {
+	shutdowns := make(chan string, 1)
+	exitCodes := make(chan int, 1)
+	sut := newRunService(shutdowns, exitCodes, nil)
+	go sut.RunAndExit(context.Background())
+	internal := waitForAddr(t, sut, "internal")
+
+	// Act
+	resp, err := http.Get("http://" + internal.String() + "/quit")
+
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+	select {
+	case code := <-exitCodes:
+		assert.Equal(t, 0, code)
+		assert.Len(t, shutdowns, 1, "the shutdown func is called before the exit")
+	case <-time.After(5 * time.Second):
+		t.Fatal("quit did not shut the service down")
+	}
+}
+
+func TestServiceImpl_RunAndExitFailure(t *testing.T) {
+	exitCodes := make(chan int, 1)
+	sut := newRunService(make(chan string, 1), exitCodes, func(opt *sf.ServiceOptions) {
+		opt.TLS = sf.TLSOptions{CertFile: "missing.pem", KeyFile: "missing.key"}
+	})
+
+	// Act
+	sut.RunAndExit(context.Background())
+
+	assert.Equal(t, 1, <-exitCodes)
+}
@@ -0,0 +1,45 @@
+//go:build darwin || freebsd || linux
+// +build darwin freebsd linux
+
+package servicefoundation_test
+
+import (
+	"context"
+	"syscall"
+	"testing"
+	"time"
+
+	sf "github.com/Prutswonder/go-servicefoundation"
+	"github.com/Prutswonder/go-servicefoundation/events"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestServiceImpl_SecondSignalForcesExit(t *testing.T) {
+	forcedCodes := make(chan int, 1)
+	handled := make(chan struct{})
+	log := &mockLogger{}
+	log.On("Debug", events.GracefulShutdown, "Handling Sigterm/SigInt", mock.Anything).Return(nil).
+		Run(func(mock.Arguments) { close(handled) }).Once()
+	sut, operation := newShutdownService(sf.ShutdownModeGraceful, nil, forcedCodes, log)
+	defer operation.Done()
+	go sut.Run(context.Background())
+	// The signals are handled by the service once its servers listen.
+	waitForAddr(t, sut, "public")
+
+	// Act
+	syscall.Kill(syscall.Getpid(), syscall.SIGINT)
+	select {
+	case <-handled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the first signal did not start the shutdown")
+	}
+	syscall.Kill(syscall.Getpid(), syscall.SIGINT)
+
+	select {
+	case code := <-forcedCodes:
+		assert.Equal(t, sf.ExitCodeForced, code)
+	case <-time.After(5 * time.Second):
+		t.Fatal("second signal did not force the exit")
+	}
+}
@@ -0,0 +1,387 @@
+package servicefoundation
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultMaxSignedBodySize = 10 << 20
+
+	// HMACDateHeader is the header containing the signing time for the HMAC-SHA256 signing scheme.
+	HMACDateHeader = "X-Date"
+
+	hmacAlgorithm  = "HMAC-SHA256"
+	sigV4Algorithm = "AWS4-HMAC-SHA256"
+	sigV4Format    = "20060102T150405Z"
+	sigV4Date      = "20060102"
+
+	// Clock differences below this threshold are considered network latency, not skew.
+	minClockSkew = 2 * time.Second
+)
+
+var (
+	// ErrBodyTooLarge is returned when a request body exceeds the buffering cap and no body hash was provided.
+	ErrBodyTooLarge = errors.New("request body too large for signing, provide a pre-computed body hash")
+
+	emptyBodyHash = sha256.Sum256(nil)
+)
+
+type (
+	// RequestSigner signs outbound requests. The bodyHash is the SHA-256 hash of the request body.
+	RequestSigner interface {
+		Sign(req *http.Request, bodyHash []byte) error
+	}
+
+	// SecretFunc is the function signature for resolving the secret used for signing.
+	SecretFunc func() (string, error)
+
+	// HMACSigner signs requests with HMAC-SHA256 over a canonical string of the method, path, query, signed headers
+	// and body hash.
+	HMACSigner struct {
+		// HeaderName is the name of the header containing the signature. Default value is "Authorization".
+		HeaderName string
+		KeyID      string
+		Secret     SecretFunc
+		// SignedHeaders contains the headers, besides Host and X-Date, that are part of the signature.
+		SignedHeaders []string
+		Clock         func() time.Time
+	}
+
+	// SigV4Signer signs requests with AWS Signature Version 4, as used by S3-compatible object stores.
+	SigV4Signer struct {
+		AccessKeyID string
+		Secret      SecretFunc
+		Region      string
+		Service     string
+		// SignedHeaders contains the headers, besides Host and the X-Amz headers, that are part of the signature
+		// when present. Default value is Content-Type, Content-MD5 and Range.
+		SignedHeaders []string
+		Clock         func() time.Time
+	}
+
+	signingTransport struct {
+		base        http.RoundTripper
+		signer      RequestSigner
+		maxBodySize int
+		clockOffset int64
+	}
+
+	clockSetter interface {
+		setClock(clock func() time.Time)
+	}
+
+	bodyHashContextKey struct{}
+)
+
+// NewSigningTransport returns a RoundTripper that signs every request with the given signer before passing it to the
+// base RoundTripper. Request bodies up to maxBodySize are buffered for hashing; larger bodies require a hash provided
+// through WithBodyHash. Requests are signed again on every attempt, so retries get a fresh signing time. Bundled
+// signers use a clock that is corrected for the skew between the local clock and the server's Date header.
+func NewSigningTransport(base http.RoundTripper, signer RequestSigner, maxBodySize int) http.RoundTripper {
+	if maxBodySize <= 0 {
+		maxBodySize = defaultMaxSignedBodySize
+	}
+
+	t := &signingTransport{
+		base:        base,
+		signer:      signer,
+		maxBodySize: maxBodySize,
+	}
+
+	if s, ok := signer.(clockSetter); ok {
+		s.setClock(t.now)
+	}
+	return t
+}
+
+// WithBodyHash returns a copy of the context with a pre-computed SHA-256 hash of the request body, allowing streamed
+// bodies of any size to be signed.
+func WithBodyHash(ctx context.Context, bodyHash []byte) context.Context {
+	return context.WithValue(ctx, bodyHashContextKey{}, bodyHash)
+}
+
+/* http.RoundTripper implementation */
+
+func (t *signingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Never modify the original request, so each attempt is signed from scratch.
+	signed := req.WithContext(req.Context())
+	signed.Header = cloneHeader(req.Header)
+
+	bodyHash, err := t.bodyHash(signed)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := t.signer.Sign(signed, bodyHash); err != nil {
+		if signed.Body != nil {
+			signed.Body.Close()
+		}
+		return nil, fmt.Errorf("Failed signing request: %v", err)
+	}
+
+	resp, err := t.base.RoundTrip(signed)
+	if err == nil {
+		t.observeClock(resp)
+	}
+	return resp, err
+}
+
+func (t *signingTransport) bodyHash(req *http.Request) ([]byte, error) {
+	if hash, ok := req.Context().Value(bodyHashContextKey{}).([]byte); ok {
+		return hash, nil
+	}
+
+	if req.Body == nil || req.Body == http.NoBody {
+		return emptyBodyHash[:], nil
+	}
+
+	body := req.Body
+	if req.GetBody != nil {
+		// Use a fresh copy of the body, so retries of the original request still have a body to send.
+		var err error
+		if body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+
+	b, err := ioutil.ReadAll(io.LimitReader(body, int64(t.maxBodySize)+1))
+	body.Close()
+
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > t.maxBodySize {
+		return nil, ErrBodyTooLarge
+	}
+
+	req.Body = ioutil.NopCloser(bytes.NewReader(b))
+	req.ContentLength = int64(len(b))
+
+	hash := sha256.Sum256(b)
+	return hash[:], nil
+}
+
+func (t *signingTransport) now() time.Time {
+	return time.Now().Add(time.Duration(atomic.LoadInt64(&t.clockOffset)))
+}
+
+func (t *signingTransport) observeClock(resp *http.Response) {
+	serverTime, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return
+	}
+
+	offset := time.Until(serverTime)
+	if offset > -minClockSkew && offset < minClockSkew {
+		offset = 0
+	}
+	atomic.StoreInt64(&t.clockOffset, int64(offset))
+}
+
+/* HMACSigner implementation */
+
+// Sign adds the X-Date and signature headers to the request.
+func (s *HMACSigner) Sign(req *http.Request, bodyHash []byte) error {
+	secret, err := s.Secret()
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set(HMACDateHeader, now(s.Clock).UTC().Format(time.RFC3339))
+
+	signedHeaders := append([]string{"host", strings.ToLower(HMACDateHeader)}, lower(s.SignedHeaders)...)
+	canonical := s.CanonicalString(req, signedHeaders, bodyHash)
+	signature := hmacSHA256([]byte(secret), canonical)
+
+	headerName := s.HeaderName
+	if headerName == "" {
+		headerName = "Authorization"
+	}
+	req.Header.Set(headerName, fmt.Sprintf("%s KeyId=%s, SignedHeaders=%s, Signature=%s", hmacAlgorithm, s.KeyID,
+		strings.Join(signedHeaders, ";"), hex.EncodeToString(signature)))
+	return nil
+}
+
+// CanonicalString returns the string that is signed for the request.
+func (s *HMACSigner) CanonicalString(req *http.Request, signedHeaders []string, bodyHash []byte) string {
+	lines := []string{
+		req.Method,
+		canonicalURI(req.URL),
+		canonicalQuery(req.URL),
+	}
+
+	for _, name := range signedHeaders {
+		lines = append(lines, name+":"+headerValue(req, name))
+	}
+	return strings.Join(append(lines, hex.EncodeToString(bodyHash)), "\n")
+}
+
+func (s *HMACSigner) setClock(clock func() time.Time) {
+	if s.Clock == nil {
+		s.Clock = clock
+	}
+}
+
+/* SigV4Signer implementation */
+
+// Sign adds the X-Amz-Date, X-Amz-Content-Sha256 and Authorization headers to the request.
+func (s *SigV4Signer) Sign(req *http.Request, bodyHash []byte) error {
+	secret, err := s.Secret()
+	if err != nil {
+		return err
+	}
+
+	t := now(s.Clock).UTC()
+	req.Header.Set("X-Amz-Date", t.Format(sigV4Format))
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(bodyHash))
+
+	signedHeaders := s.signedHeaders(req)
+	canonicalRequest := s.CanonicalRequest(req, signedHeaders, bodyHash)
+	scope := strings.Join([]string{t.Format(sigV4Date), s.Region, s.Service, "aws4_request"}, "/")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		sigV4Algorithm,
+		t.Format(sigV4Format),
+		scope,
+		hex.EncodeToString(requestHash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+secret), t.Format(sigV4Date))
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, s.Service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hmacSHA256(key, stringToSign)
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		sigV4Algorithm, s.AccessKeyID, scope, strings.Join(signedHeaders, ";"), hex.EncodeToString(signature)))
+	return nil
+}
+
+// CanonicalRequest returns the canonical request as defined by AWS Signature Version 4.
+func (s *SigV4Signer) CanonicalRequest(req *http.Request, signedHeaders []string, bodyHash []byte) string {
+	headers := ""
+	for _, name := range signedHeaders {
+		headers += name + ":" + headerValue(req, name) + "\n"
+	}
+
+	return strings.Join([]string{
+		req.Method,
+		canonicalURI(req.URL),
+		canonicalQuery(req.URL),
+		headers,
+		strings.Join(signedHeaders, ";"),
+		hex.EncodeToString(bodyHash),
+	}, "\n")
+}
+
+func (s *SigV4Signer) signedHeaders(req *http.Request) []string {
+	optional := s.SignedHeaders
+	if optional == nil {
+		optional = []string{"Content-Type", "Content-MD5", "Range"}
+	}
+
+	names := []string{"host"}
+	for name := range req.Header {
+		if strings.HasPrefix(strings.ToLower(name), "x-amz-") {
+			names = append(names, strings.ToLower(name))
+		}
+	}
+	for _, name := range optional {
+		if req.Header.Get(name) != "" {
+			names = append(names, strings.ToLower(name))
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (s *SigV4Signer) setClock(clock func() time.Time) {
+	if s.Clock == nil {
+		s.Clock = clock
+	}
+}
+
+func now(clock func() time.Time) time.Time {
+	if clock == nil {
+		return time.Now()
+	}
+	return clock()
+}
+
+func lower(values []string) []string {
+	lowered := make([]string, len(values))
+
+	for i, v := range values {
+		lowered[i] = strings.ToLower(v)
+	}
+	return lowered
+}
+
+func headerValue(req *http.Request, name string) string {
+	if name == "host" {
+		if req.Host != "" {
+			return req.Host
+		}
+		return req.URL.Host
+	}
+
+	values := []string{}
+	for _, v := range req.Header[http.CanonicalHeaderKey(name)] {
+		values = append(values, strings.Join(strings.Fields(v), " "))
+	}
+	return strings.Join(values, ",")
+}
+
+func canonicalURI(u *url.URL) string {
+	path := u.EscapedPath()
+
+	if path == "" {
+		return "/"
+	}
+	return path
+}
+
+func canonicalQuery(u *url.URL) string {
+	query := u.Query()
+	keys := make([]string, 0, len(query))
+
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pairs := []string{}
+	for _, k := range keys {
+		values := query[k]
+		sort.Strings(values)
+
+		for _, v := range values {
+			pairs = append(pairs, uriEncode(k)+"="+uriEncode(v))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+func uriEncode(s string) string {
+	return strings.Replace(url.QueryEscape(s), "+", "%20", -1)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
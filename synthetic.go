@@ -0,0 +1,241 @@
+package servicefoundation
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/Prutswonder/go-servicefoundation/events"
+)
+
+const (
+	// SyntheticPolicyLabel records synthetic requests in parallel series with a synthetic="true" label.
+	SyntheticPolicyLabel SyntheticPolicy = "label"
+	// SyntheticPolicyExclude leaves synthetic requests out of the request metrics.
+	SyntheticPolicyExclude SyntheticPolicy = "exclude"
+
+	// DefaultSyntheticHeader is the header that marks synthetic requests with their source.
+	DefaultSyntheticHeader = "X-Synthetic-Source"
+
+	syntheticSubsystem = "synthetic"
+)
+
+type (
+	// SyntheticPolicy determines how synthetic requests are recorded by the request metrics.
+	SyntheticPolicy string
+
+	// SyntheticOptions contains the settings for recognizing synthetic traffic, like uptime monitors and load tests.
+	// Requests are synthetic when their Header contains one of the Sources, or when their client address is in one of
+	// the CIDRs. The header is only honored from peers in TrustedCIDRs, which are also trusted to report the client
+	// address in X-Forwarded-For. MaxConcurrent caps the concurrent synthetic requests, so a load test can't starve
+	// real users; 0 disables the cap.
+	SyntheticOptions struct {
+		Header        string
+		Sources       []string
+		CIDRs         []string
+		TrustedCIDRs  []string
+		Policy        SyntheticPolicy
+		MaxConcurrent int
+	}
+
+	syntheticTraffic struct {
+		options  SyntheticOptions
+		sources  map[string]bool
+		networks []*net.IPNet
+		trusted  []*net.IPNet
+		log      Logger
+		metrics  Metrics
+		inFlight int32
+	}
+
+	// syntheticRequest is the flag of a request on a route with synthetic traffic detection. Source is empty for real
+	// requests, which are flagged too, because the label policy adds the synthetic label to all series.
+	syntheticRequest struct {
+		source string
+		policy SyntheticPolicy
+	}
+
+	syntheticContextKey struct{}
+)
+
+// NewSyntheticTrafficMiddleware returns a MiddlewareFunc that flags synthetic requests on their context, for the
+// request metrics, latency baselines and request logging. Synthetic requests that exceed MaxConcurrent are rejected
+// with 503. Invalid CIDRs are logged and ignored.
+func NewSyntheticTrafficMiddleware(options SyntheticOptions, log Logger, metrics Metrics) MiddlewareFunc {
+	if options.Header == "" {
+		options.Header = DefaultSyntheticHeader
+	}
+	if options.Policy == "" {
+		options.Policy = SyntheticPolicyLabel
+	}
+
+	s := &syntheticTraffic{
+		options:  options,
+		sources:  make(map[string]bool),
+		networks: parseCIDRs(options.CIDRs, log),
+		trusted:  parseCIDRs(options.TrustedCIDRs, log),
+		log:      log,
+		metrics:  metrics,
+	}
+	for _, source := range options.Sources {
+		s.sources[strings.ToLower(source)] = true
+	}
+	return s.middleware
+}
+
+// IsSynthetic returns true if the request of the context was flagged as synthetic traffic.
+func IsSynthetic(ctx context.Context) bool {
+	flag, ok := ctx.Value(syntheticContextKey{}).(syntheticRequest)
+	return ok && flag.source != ""
+}
+
+// SyntheticSource returns the source of the synthetic request of the context, or an empty string for real requests.
+func SyntheticSource(ctx context.Context) string {
+	flag, _ := ctx.Value(syntheticContextKey{}).(syntheticRequest)
+	return flag.source
+}
+
+func (s *syntheticTraffic) middleware(next Handle) Handle {
+	return func(w WrappedResponseWriter, r *http.Request, p RouterParams) {
+		source := s.detect(r)
+		ctx := context.WithValue(r.Context(), syntheticContextKey{}, syntheticRequest{source: source, policy: s.options.Policy})
+
+		if source != "" {
+			s.metrics.CountLabels(syntheticSubsystem, "requests_total", "Total synthetic requests.",
+				[]string{"source"}, []string{source})
+
+			if s.options.MaxConcurrent > 0 {
+				defer atomic.AddInt32(&s.inFlight, -1)
+				if atomic.AddInt32(&s.inFlight, 1) > int32(s.options.MaxConcurrent) {
+					s.metrics.CountLabels(syntheticSubsystem, "rejected_total",
+						"Total synthetic requests rejected by the concurrency cap.", []string{"source"}, []string{source})
+					w.Header().Set("Retry-After", "1")
+					WriteProblem(w, http.StatusServiceUnavailable, "Too many concurrent synthetic requests")
+					return
+				}
+			}
+		}
+
+		next(w, r.WithContext(ctx), p)
+	}
+}
+
+// detect returns the source of a synthetic request, or an empty string for real requests.
+func (s *syntheticTraffic) detect(r *http.Request) string {
+	peer := remoteIP(r.RemoteAddr)
+	trusted := containsIP(s.trusted, peer)
+
+	if trusted {
+		if source := strings.ToLower(strings.TrimSpace(r.Header.Get(s.options.Header))); s.sources[source] {
+			return source
+		}
+	}
+
+	client := peer
+	if trusted {
+		client = forwardedClient(r, s.trusted, peer)
+	}
+	if containsIP(s.networks, client) {
+		return "cidr"
+	}
+	return ""
+}
+
+// forwardedClient returns the rightmost address in X-Forwarded-For that isn't a trusted proxy, because the addresses
+// left of it can be set by the client.
+func forwardedClient(r *http.Request, trusted []*net.IPNet, peer net.IP) net.IP {
+	hops := strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",")
+
+	client := peer
+	for i := len(hops) - 1; i >= 0 && containsIP(trusted, client); i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			break
+		}
+		client = ip
+	}
+	return client
+}
+
+// syntheticMetrics returns the labels and values with the synthetic label when the label policy applies, and whether
+// the request is recorded at all.
+func syntheticMetrics(ctx context.Context, labels, values []string) ([]string, []string, bool) {
+	flag, ok := ctx.Value(syntheticContextKey{}).(syntheticRequest)
+	if !ok {
+		return labels, values, true
+	}
+	if flag.policy == SyntheticPolicyExclude {
+		return labels, values, flag.source == ""
+	}
+
+	synthetic := "false"
+	if flag.source != "" {
+		synthetic = "true"
+	}
+	return append(labels, "synthetic"), append(values, synthetic), true
+}
+
+// syntheticHistogram returns the subsystem of the histograms of the request, which is prefixed for synthetic requests
+// because histograms have no labels, and whether the request is recorded at all.
+func syntheticHistogram(ctx context.Context, subsystem string) (string, bool) {
+	flag, ok := ctx.Value(syntheticContextKey{}).(syntheticRequest)
+	if !ok || flag.source == "" {
+		return subsystem, true
+	}
+	if flag.policy == SyntheticPolicyExclude {
+		return subsystem, false
+	}
+	if subsystem == "" {
+		return syntheticSubsystem, true
+	}
+	return syntheticSubsystem + "_" + subsystem, true
+}
+
+func parseCIDRs(cidrs []string, log Logger) []*net.IPNet {
+	var networks []*net.IPNet
+
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		if !strings.Contains(cidr, "/") {
+			// A single address.
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			log.Error(events.SyntheticTraffic, "Ignoring invalid CIDR: %v", err)
+			continue
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func remoteIP(remoteAddr string) net.IP {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	return net.ParseIP(host)
+}
@@ -0,0 +1,185 @@
+package servicefoundation_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	sf "github.com/Prutswonder/go-servicefoundation"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func newSyntheticMetrics() (*mockMetrics, *mockMetricsHistogram) {
+	m := &mockMetrics{}
+	h := &mockMetricsHistogram{}
+	m.On("CountLabels", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+	m.On("AddHistogram", mock.Anything, mock.Anything, mock.Anything).Return(h)
+	m.On("AddHistogramLabels", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(h)
+	h.On("RecordTimeElapsed", mock.Anything, mock.Anything)
+	return m, h
+}
+
+func TestSyntheticTrafficMiddleware_Detection(t *testing.T) {
+	options := sf.SyntheticOptions{
+		Sources:      []string{"uptime-monitor", "load-test"},
+		CIDRs:        []string{"192.0.2.0/24"},
+		TrustedCIDRs: []string{"10.0.0.0/8"},
+	}
+	tests := []struct {
+		remoteAddr   string
+		source       string
+		forwardedFor string
+		expected     string
+		explanation  string
+	}{
+		{"10.1.2.3:1234", "uptime-monitor", "", "uptime-monitor", "marker from a trusted peer"},
+		{"10.1.2.3:1234", "Load-Test", "", "load-test", "marker values are case-insensitive"},
+		{"10.1.2.3:1234", "someone-else", "", "", "marker value that isn't allowed"},
+		{"203.0.113.7:1234", "uptime-monitor", "", "", "marker from an untrusted peer"},
+		{"192.0.2.10:1234", "", "", "cidr", "peer in a synthetic network"},
+		{"10.1.2.3:1234", "", "192.0.2.10, 10.2.0.1", "cidr", "client in a synthetic network behind trusted proxies"},
+		{"10.1.2.3:1234", "", "192.0.2.10, 203.0.113.7", "", "client address spoofed left of an untrusted hop"},
+		{"203.0.113.7:1234", "", "192.0.2.10", "", "forwarded address from an untrusted peer"},
+		{"10.1.2.3:1234", "", "", "", "real request from a trusted peer"},
+	}
+
+	for _, test := range tests {
+		m, _ := newSyntheticMetrics()
+		var actual string
+		var synthetic bool
+		r, _ := http.NewRequest(http.MethodGet, "/orders", nil)
+		r.RemoteAddr = test.remoteAddr
+		if test.source != "" {
+			r.Header.Set(sf.DefaultSyntheticHeader, test.source)
+		}
+		if test.forwardedFor != "" {
+			r.Header.Set("X-Forwarded-For", test.forwardedFor)
+		}
+		sut := sf.NewSyntheticTrafficMiddleware(options, &mockLogger{}, m)
+
+		// Act
+		sut(func(_ sf.WrappedResponseWriter, r *http.Request, _ sf.RouterParams) {
+			actual = sf.SyntheticSource(r.Context())
+			synthetic = sf.IsSynthetic(r.Context())
+		})(sf.NewWrappedResponseWriter(httptest.NewRecorder()), r, sf.RouterParams{})
+
+		assert.Equal(t, test.expected, actual, test.explanation)
+		assert.Equal(t, test.expected != "", synthetic, test.explanation)
+	}
+}
+
+func TestSyntheticTrafficMiddleware_Policies(t *testing.T) {
+	labels := []string{"app", "server", "env", "code", "method", "handler", "version", "subsystem"}
+	tests := []struct {
+		policy            sf.SyntheticPolicy
+		source            string
+		expectedLabels    []string
+		expectedSynthetic string
+		expectedSubsystem string
+		expectedRecorded  bool
+	}{
+		{sf.SyntheticPolicyLabel, "uptime-monitor", append(labels, "synthetic"), "true", "synthetic_public", true},
+		{sf.SyntheticPolicyLabel, "", append(labels, "synthetic"), "false", "public", true},
+		{sf.SyntheticPolicyExclude, "uptime-monitor", nil, "", "", false},
+		{sf.SyntheticPolicyExclude, "", labels, "", "public", true},
+	}
+
+	for _, test := range tests {
+		m, _ := newSyntheticMetrics()
+		log := &mockLogger{}
+		log.On("Info", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+		wrapper := sf.NewMiddlewareWrapper(log, m, &sf.CORSOptions{}, sf.ServiceGlobals{})
+		synthetic := sf.NewSyntheticTrafficMiddleware(sf.SyntheticOptions{
+			Sources:      []string{"uptime-monitor"},
+			TrustedCIDRs: []string{"127.0.0.1"},
+			Policy:       test.policy,
+		}, log, m)
+		handler := synthetic(sf.NewChainFor(wrapper, "public", "orders", []sf.Middleware{sf.Counter, sf.Histogram}).
+			Then(func(sf.WrappedResponseWriter, *http.Request, sf.RouterParams) {}))
+		r, _ := http.NewRequest(http.MethodGet, "/orders", nil)
+		r.RemoteAddr = "127.0.0.1:1234"
+		r.Header.Set(sf.DefaultSyntheticHeader, test.source)
+
+		// Act
+		handler(sf.NewWrappedResponseWriter(httptest.NewRecorder()), r, sf.RouterParams{})
+
+		if !test.expectedRecorded {
+			m.AssertNotCalled(t, "CountLabels", "", "orders_total", mock.Anything, mock.Anything, mock.Anything)
+			m.AssertNotCalled(t, "AddHistogramLabels", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+			continue
+		}
+		var expectedValues interface{} = mock.Anything
+		if test.expectedSynthetic != "" {
+			expectedValues = mock.MatchedBy(func(values []string) bool {
+				return values[len(values)-1] == test.expectedSynthetic
+			})
+		}
+		m.AssertCalled(t, "CountLabels", "", "orders_total", mock.Anything, test.expectedLabels, expectedValues)
+		m.AssertCalled(t, "AddHistogramLabels", test.expectedSubsystem, "orders_duration_milliseconds", mock.Anything,
+			[]string{"method", "code"}, []string{"get", "200"})
+	}
+}
+
+func TestSyntheticTrafficMiddleware_RequestLoggingMarksSyntheticRequests(t *testing.T) {
+	m, _ := newSyntheticMetrics()
+	log := &mockLogger{}
+	log.On("Info", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	wrapper := sf.NewMiddlewareWrapper(log, m, &sf.CORSOptions{}, sf.ServiceGlobals{})
+	synthetic := sf.NewSyntheticTrafficMiddleware(sf.SyntheticOptions{CIDRs: []string{"127.0.0.1"}}, log, m)
+	r, _ := http.NewRequest(http.MethodGet, "/orders", nil)
+	r.RemoteAddr = "127.0.0.1:1234"
+
+	// Act
+	synthetic(wrapper.Wrap("public", "orders", sf.RequestLogging,
+		func(sf.WrappedResponseWriter, *http.Request, sf.RouterParams) {}))(
+		sf.NewWrappedResponseWriter(httptest.NewRecorder()), r, sf.RouterParams{})
+
+	log.AssertCalled(t, "Info", "Response-orders",
+		"Handled request, duration_us: %v, method: %v, path: %v, remote_addr: %v, status: %v, synthetic_source: %v", mock.Anything)
+	m.AssertCalled(t, "AddHistogram", "synthetic", "http_request_duration_seconds", mock.Anything)
+}
+
+func TestSyntheticTrafficMiddleware_ConcurrencyCap(t *testing.T) {
+	m, _ := newSyntheticMetrics()
+	sut := sf.NewSyntheticTrafficMiddleware(sf.SyntheticOptions{
+		Sources:       []string{"load-test"},
+		TrustedCIDRs:  []string{"127.0.0.1"},
+		MaxConcurrent: 1,
+	}, &mockLogger{}, m)
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	handler := sut(func(w sf.WrappedResponseWriter, r *http.Request, _ sf.RouterParams) {
+		if sf.IsSynthetic(r.Context()) {
+			entered <- struct{}{}
+			<-release
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	request := func(source string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest(http.MethodGet, "/orders", nil)
+		r.RemoteAddr = "127.0.0.1:1234"
+		r.Header.Set(sf.DefaultSyntheticHeader, source)
+		handler(sf.NewWrappedResponseWriter(w), r, sf.RouterParams{})
+		return w
+	}
+	first := make(chan int)
+	go func() { first <- request("load-test").Code }()
+	<-entered
+
+	// Act
+	rejected := request("load-test")
+	regular := request("")
+
+	close(release)
+	assert.Equal(t, http.StatusOK, <-first)
+	assert.Equal(t, http.StatusServiceUnavailable, rejected.Code)
+	assert.Equal(t, "1", rejected.Header().Get("Retry-After"))
+	assert.Equal(t, http.StatusOK, regular.Code, "real requests are not capped")
+	m.AssertCalled(t, "CountLabels", "synthetic", "rejected_total", mock.Anything, []string{"source"}, []string{"load-test"})
+
+	go func() { first <- request("load-test").Code }()
+	<-entered
+	assert.Equal(t, http.StatusOK, <-first, "the cap is released after the response")
+}
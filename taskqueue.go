@@ -0,0 +1,558 @@
+package servicefoundation
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/Prutswonder/go-servicefoundation/events"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	taskQueueSubsystem = "taskqueue"
+
+	defaultTaskVisibilityTimeout = 30 * time.Second
+	defaultTaskMaxAttempts       = 5
+	defaultTaskRetryDelay        = 5 * time.Second
+	defaultTaskPollInterval      = 500 * time.Millisecond
+	defaultTaskMetricsInterval   = 15 * time.Second
+)
+
+var (
+	tasksBucket     = []byte("tasks")
+	dueTasksBucket  = []byte("due")
+	deadTasksBucket = []byte("dead")
+
+	// ErrTaskNotFound is returned when a task with the given ID does not exist.
+	ErrTaskNotFound = errors.New("task not found")
+	// ErrNoTaskQueue is returned when a task is enqueued through a context without a TaskQueue.
+	ErrNoTaskQueue = errors.New("no task queue available in context")
+)
+
+type (
+	// Task contains a unit of work that is persisted in a TaskQueue until it is handled successfully.
+	Task struct {
+		ID         string    `json:"id"`
+		Type       string    `json:"type"`
+		Payload    []byte    `json:"payload"`
+		Attempts   int       `json:"attempts"`
+		EnqueuedAt time.Time `json:"enqueuedAt"`
+		VisibleAt  time.Time `json:"visibleAt"`
+		LastError  string    `json:"lastError,omitempty"`
+	}
+
+	// TaskHandler is the function signature for consumers of tasks. Returning an error schedules the task for retry.
+	TaskHandler func(ctx context.Context, task Task) error
+
+	// TaskQueueStats contains statistics about the current state of a TaskQueue.
+	TaskQueueStats struct {
+		Pending   int           `json:"pending"`
+		Dead      int           `json:"dead"`
+		OldestAge time.Duration `json:"oldestAge"`
+	}
+
+	// TaskQueue is a durable queue for background tasks with at-least-once delivery semantics.
+	TaskQueue interface {
+		Enqueue(ctx context.Context, task Task) error
+		Subscribe(taskType string, concurrency int, handler TaskHandler)
+		Start(ctx context.Context)
+		Stop() error
+		Stats() (TaskQueueStats, error)
+		DeadTasks() ([]Task, error)
+		Redrive(id string) error
+	}
+
+	// TaskQueueOptions contains the settings used by the bundled TaskQueue implementation.
+	TaskQueueOptions struct {
+		// Path is the location of the database file.
+		Path string
+		// VisibilityTimeout is the time a claimed task stays invisible to other consumers. When a consumer crashes,
+		// the task will be delivered again after this timeout.
+		VisibilityTimeout time.Duration
+		// MaxAttempts is the number of deliveries after which a failing task is moved to the dead-letter bucket.
+		MaxAttempts int
+		// RetryDelay is the time before a failed task becomes visible again.
+		RetryDelay time.Duration
+		// PollInterval is the time consumers wait before polling again when no tasks are available.
+		PollInterval time.Duration
+		// MetricsInterval is the interval used for updating the queue metrics.
+		MetricsInterval time.Duration
+	}
+
+	taskSubscription struct {
+		taskType    string
+		concurrency int
+		handler     TaskHandler
+	}
+
+	boltTaskQueue struct {
+		db            *bolt.DB
+		options       TaskQueueOptions
+		log           Logger
+		metrics       Metrics
+		subscriptions []taskSubscription
+		cancel        context.CancelFunc
+		wg            sync.WaitGroup
+	}
+
+	taskQueueContextKey struct{}
+)
+
+// NewTaskQueue opens or creates the database file specified in the options and returns a TaskQueue implementation.
+// Tasks that were pending or in-flight when the file was last closed are delivered again once the queue is started.
+func NewTaskQueue(options TaskQueueOptions, log Logger, metrics Metrics) (TaskQueue, error) {
+	options = mergeTaskQueueOptions(options)
+
+	db, err := bolt.Open(options.Path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("Failed opening task queue %s: %v", options.Path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		tasks, err := tx.CreateBucketIfNotExists(tasksBucket)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists(deadTasksBucket); err != nil {
+			return err
+		}
+		if tx.Bucket(dueTasksBucket) != nil {
+			return nil
+		}
+
+		// Files of earlier versions have no index, so it is built from the pending tasks.
+		due, err := tx.CreateBucket(dueTasksBucket)
+		if err != nil {
+			return err
+		}
+		return tasks.ForEach(func(_, v []byte) error {
+			task := Task{}
+			if err := json.Unmarshal(v, &task); err != nil {
+				return err
+			}
+			return due.Put(dueKey(task), []byte(task.ID))
+		})
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Failed initializing task queue %s: %v", options.Path, err)
+	}
+
+	return &boltTaskQueue{
+		db:      db,
+		options: options,
+		log:     log,
+		metrics: metrics,
+	}, nil
+}
+
+// WithTaskQueue returns a copy of the context that carries the given TaskQueue.
+func WithTaskQueue(ctx context.Context, queue TaskQueue) context.Context {
+	return context.WithValue(ctx, taskQueueContextKey{}, queue)
+}
+
+// TaskQueueFromContext returns the TaskQueue carried by the context, or nil if there is none.
+func TaskQueueFromContext(ctx context.Context) TaskQueue {
+	queue, _ := ctx.Value(taskQueueContextKey{}).(TaskQueue)
+	return queue
+}
+
+// EnqueueTask enqueues the task on the TaskQueue carried by the context.
+func EnqueueTask(ctx context.Context, task Task) error {
+	queue := TaskQueueFromContext(ctx)
+
+	if queue == nil {
+		return ErrNoTaskQueue
+	}
+	return queue.Enqueue(ctx, task)
+}
+
+// NewDeadTasksHandler returns a handler that lists the tasks in the dead-letter bucket of the given TaskQueue.
+func NewDeadTasksHandler(queue TaskQueue) Handle {
+	return func(w WrappedResponseWriter, _ *http.Request, _ RouterParams) {
+		tasks, err := queue.DeadTasks()
+
+		if err != nil {
+			w.JSON(http.StatusInternalServerError, err.Error())
+			return
+		}
+		w.JSON(http.StatusOK, tasks)
+	}
+}
+
+// NewRedriveTaskHandler returns a handler that moves the task with the "id" route parameter from the dead-letter
+// bucket back to the pending tasks of the given TaskQueue.
+func NewRedriveTaskHandler(queue TaskQueue) Handle {
+	return func(w WrappedResponseWriter, _ *http.Request, p RouterParams) {
+		err := queue.Redrive(p.Params.ByName("id"))
+
+		switch err {
+		case nil:
+			w.JSON(http.StatusOK, "ok")
+		case ErrTaskNotFound:
+			w.JSON(http.StatusNotFound, err.Error())
+		default:
+			w.JSON(http.StatusInternalServerError, err.Error())
+		}
+	}
+}
+
+func mergeTaskQueueOptions(options TaskQueueOptions) TaskQueueOptions {
+	if options.VisibilityTimeout <= 0 {
+		options.VisibilityTimeout = defaultTaskVisibilityTimeout
+	}
+	if options.MaxAttempts <= 0 {
+		options.MaxAttempts = defaultTaskMaxAttempts
+	}
+	if options.RetryDelay <= 0 {
+		options.RetryDelay = defaultTaskRetryDelay
+	}
+	if options.PollInterval <= 0 {
+		options.PollInterval = defaultTaskPollInterval
+	}
+	if options.MetricsInterval <= 0 {
+		options.MetricsInterval = defaultTaskMetricsInterval
+	}
+	return options
+}
+
+/* TaskQueue implementation */
+
+func (q *boltTaskQueue) Enqueue(ctx context.Context, task Task) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return q.db.Update(func(tx *bolt.Tx) error {
+		seq, err := tx.Bucket(tasksBucket).NextSequence()
+		if err != nil {
+			return err
+		}
+
+		// The sequence based key makes sure tasks are delivered in order of arrival.
+		task.ID = fmt.Sprintf("%020d", seq)
+		task.Attempts = 0
+		task.EnqueuedAt = time.Now().UTC()
+		task.VisibleAt = time.Time{}
+
+		return putPendingTask(tx, task)
+	})
+}
+
+func (q *boltTaskQueue) Subscribe(taskType string, concurrency int, handler TaskHandler) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	q.subscriptions = append(q.subscriptions, taskSubscription{
+		taskType:    taskType,
+		concurrency: concurrency,
+		handler:     handler,
+	})
+}
+
+func (q *boltTaskQueue) Start(ctx context.Context) {
+	ctx, q.cancel = context.WithCancel(ctx)
+
+	for _, sub := range q.subscriptions {
+		for i := 0; i < sub.concurrency; i++ {
+			q.wg.Add(1)
+			go q.consume(ctx, sub)
+		}
+	}
+
+	q.wg.Add(1)
+	go q.monitor(ctx)
+}
+
+func (q *boltTaskQueue) Stop() error {
+	if q.cancel != nil {
+		q.cancel()
+	}
+	q.wg.Wait()
+
+	return q.db.Close()
+}
+
+func (q *boltTaskQueue) Stats() (TaskQueueStats, error) {
+	stats := TaskQueueStats{}
+
+	err := q.db.View(func(tx *bolt.Tx) error {
+		var oldest time.Time
+
+		err := tx.Bucket(tasksBucket).ForEach(func(_, v []byte) error {
+			task := Task{}
+			if err := json.Unmarshal(v, &task); err != nil {
+				return err
+			}
+
+			stats.Pending++
+			if oldest.IsZero() || task.EnqueuedAt.Before(oldest) {
+				oldest = task.EnqueuedAt
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		if !oldest.IsZero() {
+			stats.OldestAge = time.Since(oldest)
+		}
+
+		return tx.Bucket(deadTasksBucket).ForEach(func(_, _ []byte) error {
+			stats.Dead++
+			return nil
+		})
+	})
+	return stats, err
+}
+
+func (q *boltTaskQueue) DeadTasks() ([]Task, error) {
+	tasks := []Task{}
+
+	err := q.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(deadTasksBucket).ForEach(func(_, v []byte) error {
+			task := Task{}
+			if err := json.Unmarshal(v, &task); err != nil {
+				return err
+			}
+			tasks = append(tasks, task)
+			return nil
+		})
+	})
+	return tasks, err
+}
+
+func (q *boltTaskQueue) Redrive(id string) error {
+	return q.db.Update(func(tx *bolt.Tx) error {
+		dead := tx.Bucket(deadTasksBucket)
+		v := dead.Get([]byte(id))
+
+		if v == nil {
+			return ErrTaskNotFound
+		}
+
+		task := Task{}
+		if err := json.Unmarshal(v, &task); err != nil {
+			return err
+		}
+		task.Attempts = 0
+		task.VisibleAt = time.Time{}
+
+		if err := putPendingTask(tx, task); err != nil {
+			return err
+		}
+		return dead.Delete([]byte(id))
+	})
+}
+
+func (q *boltTaskQueue) consume(ctx context.Context, sub taskSubscription) {
+	defer q.wg.Done()
+
+	for ctx.Err() == nil {
+		task, err := q.claim(sub.taskType)
+
+		if err != nil {
+			q.log.Error(events.TaskQueueClaim, "Failed claiming task of type %s: %v", sub.taskType, err)
+		}
+
+		if task == nil {
+			select {
+			case <-ctx.Done():
+			case <-time.After(q.options.PollInterval):
+			}
+			continue
+		}
+
+		err = q.execute(ctx, sub.handler, *task)
+
+		if err != nil && ctx.Err() != nil {
+			// The service is shutting down, so this attempt should not count.
+			err = q.release(*task)
+		} else {
+			err = q.complete(*task, err)
+		}
+
+		if err != nil {
+			q.log.Error(events.TaskQueueUpdate, "Failed updating task %s: %v", task.ID, err)
+		}
+	}
+}
+
+func (q *boltTaskQueue) execute(ctx context.Context, handler TaskHandler, task Task) (err error) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			err = fmt.Errorf("PANIC recovered: %v", rec)
+			ReportError(ctx, ReportedError{
+				Value:    rec,
+				Panic:    true,
+				Stack:    string(debug.Stack()),
+				Task:     task.Type,
+				Severity: SeverityFatal,
+			})
+		}
+	}()
+
+	err = handler(ctx, task)
+	if err != nil && ctx.Err() == nil {
+		ReportError(ctx, ReportedError{Err: err, Task: task.Type, Severity: SeverityError})
+	}
+	return err
+}
+
+func (q *boltTaskQueue) claim(taskType string) (*Task, error) {
+	var claimed *Task
+
+	err := q.db.Update(func(tx *bolt.Tx) error {
+		now := time.Now().UTC()
+		prefix := dueKeyPrefix(taskType)
+
+		// The index is ordered by due time, so the first task of the type is the only candidate.
+		k, id := tx.Bucket(dueTasksBucket).Cursor().Seek(prefix)
+		if k == nil || !bytes.HasPrefix(k, prefix) || int64(binary.BigEndian.Uint64(k[len(prefix):])) > now.UnixNano() {
+			return nil
+		}
+
+		task := Task{}
+		if err := json.Unmarshal(tx.Bucket(tasksBucket).Get(id), &task); err != nil {
+			return err
+		}
+
+		task.Attempts++
+		task.VisibleAt = now.Add(q.options.VisibilityTimeout)
+		claimed = &task
+
+		return putPendingTask(tx, task)
+	})
+	return claimed, err
+}
+
+func (q *boltTaskQueue) complete(task Task, handlerErr error) error {
+	return q.db.Update(func(tx *bolt.Tx) error {
+		if handlerErr == nil {
+			return deletePendingTask(tx, task.ID)
+		}
+
+		task.LastError = handlerErr.Error()
+
+		if task.Attempts >= q.options.MaxAttempts {
+			q.log.Warn(events.TaskQueueDeadLetter, "Task %s of type %s failed %d times: %v", task.ID, task.Type,
+				task.Attempts, handlerErr)
+
+			if err := putTask(tx.Bucket(deadTasksBucket), task); err != nil {
+				return err
+			}
+			return deletePendingTask(tx, task.ID)
+		}
+
+		q.metrics.Count(taskQueueSubsystem, "retries_total", "Total number of task retries.")
+		task.VisibleAt = time.Now().UTC().Add(q.options.RetryDelay)
+
+		return putPendingTask(tx, task)
+	})
+}
+
+func (q *boltTaskQueue) release(task Task) error {
+	return q.db.Update(func(tx *bolt.Tx) error {
+		task.Attempts--
+		task.VisibleAt = time.Time{}
+
+		return putPendingTask(tx, task)
+	})
+}
+
+func (q *boltTaskQueue) monitor(ctx context.Context) {
+	defer q.wg.Done()
+
+	ticker := time.NewTicker(q.options.MetricsInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			stats, err := q.Stats()
+
+			if err != nil {
+				q.log.Error(events.TaskQueueStats, "Failed reading task queue stats: %v", err)
+				continue
+			}
+			q.metrics.SetGauge(float64(stats.Pending), taskQueueSubsystem, "depth", "Number of pending tasks.")
+			q.metrics.SetGauge(stats.OldestAge.Seconds(), taskQueueSubsystem, "oldest_task_age_seconds",
+				"Age of the oldest pending task in seconds.")
+			q.metrics.SetGauge(float64(stats.Dead), taskQueueSubsystem, "dead_letter_size",
+				"Number of tasks in the dead-letter bucket.")
+		}
+	}
+}
+
+func putTask(b *bolt.Bucket, task Task) error {
+	v, err := json.Marshal(task)
+
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(task.ID), v)
+}
+
+// putPendingTask stores the task with the pending tasks and moves its entry in the index of due tasks.
+func putPendingTask(tx *bolt.Tx, task Task) error {
+	if err := unindexTask(tx, task.ID); err != nil {
+		return err
+	}
+	if err := putTask(tx.Bucket(tasksBucket), task); err != nil {
+		return err
+	}
+	return tx.Bucket(dueTasksBucket).Put(dueKey(task), []byte(task.ID))
+}
+
+// deletePendingTask removes the task with the given ID from the pending tasks and the index of due tasks.
+func deletePendingTask(tx *bolt.Tx, id string) error {
+	if err := unindexTask(tx, id); err != nil {
+		return err
+	}
+	return tx.Bucket(tasksBucket).Delete([]byte(id))
+}
+
+// unindexTask removes the entry of the stored task with the given ID from the index of due tasks.
+func unindexTask(tx *bolt.Tx, id string) error {
+	v := tx.Bucket(tasksBucket).Get([]byte(id))
+
+	if v == nil {
+		return nil
+	}
+
+	task := Task{}
+	if err := json.Unmarshal(v, &task); err != nil {
+		return err
+	}
+	return tx.Bucket(dueTasksBucket).Delete(dueKey(task))
+}
+
+func dueKeyPrefix(taskType string) []byte {
+	return append([]byte(taskType), 0)
+}
+
+// dueKey returns the key of the task in the index of due tasks, which orders the tasks of a type by the time they
+// become visible, and then by order of arrival.
+func dueKey(task Task) []byte {
+	var due uint64
+	if !task.VisibleAt.IsZero() {
+		due = uint64(task.VisibleAt.UnixNano())
+	}
+
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], due)
+
+	key := append(dueKeyPrefix(task.Type), buf[:]...)
+	return append(key, task.ID...)
+}
@@ -0,0 +1,219 @@
+package servicefoundation_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	sf "github.com/Prutswonder/go-servicefoundation"
+	"github.com/julienschmidt/httprouter"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func newTestTaskQueue(t *testing.T, path string) (sf.TaskQueue, *mockLogger, *mockMetrics) {
+	log := &mockLogger{}
+	m := &mockMetrics{}
+
+	log.On("Warn", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	log.On("Error", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	m.On("Count", mock.Anything, mock.Anything, mock.Anything)
+	m.On("SetGauge", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+
+	q, err := sf.NewTaskQueue(sf.TaskQueueOptions{
+		Path:              path,
+		VisibilityTimeout: time.Second,
+		MaxAttempts:       2,
+		RetryDelay:        time.Millisecond,
+		PollInterval:      time.Millisecond,
+	}, log, m)
+
+	assert.NoError(t, err)
+	return q, log, m
+}
+
+func newTaskQueuePath(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "taskqueue")
+	assert.NoError(t, err)
+
+	return filepath.Join(dir, "tasks.db"), func() { os.RemoveAll(dir) }
+}
+
+func waitFor(condition func() bool) bool {
+	for i := 0; i < 200; i++ {
+		if condition() {
+			return true
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return false
+}
+
+func TestTaskQueue_PendingTasksSurviveReopen(t *testing.T) {
+	path, cleanup := newTaskQueuePath(t)
+	defer cleanup()
+	sut, _, _ := newTestTaskQueue(t, path)
+
+	assert.NoError(t, sut.Enqueue(context.Background(), sf.Task{Type: "invoice", Payload: []byte("1")}))
+	assert.NoError(t, sut.Enqueue(context.Background(), sf.Task{Type: "invoice", Payload: []byte("2")}))
+
+	// Simulate a crash by closing the file without consuming anything.
+	assert.NoError(t, sut.Stop())
+
+	// Act
+	sut, _, _ = newTestTaskQueue(t, path)
+	defer sut.Stop()
+
+	stats, err := sut.Stats()
+
+	assert.NoError(t, err)
+	assert.Equal(t, 2, stats.Pending)
+	assert.Equal(t, 0, stats.Dead)
+
+	handled := make(chan string, 2)
+	sut.Subscribe("invoice", 1, func(_ context.Context, task sf.Task) error {
+		handled <- string(task.Payload)
+		return nil
+	})
+	sut.Start(context.Background())
+
+	assert.Equal(t, "1", <-handled)
+	assert.Equal(t, "2", <-handled)
+}
+
+func TestTaskQueue_FailingTaskIsMovedToDeadLetter(t *testing.T) {
+	path, cleanup := newTaskQueuePath(t)
+	defer cleanup()
+	sut, _, m := newTestTaskQueue(t, path)
+	defer sut.Stop()
+
+	sut.Subscribe("invoice", 2, func(context.Context, sf.Task) error {
+		return errors.New("smtp unavailable")
+	})
+	assert.NoError(t, sut.Enqueue(context.Background(), sf.Task{Type: "invoice"}))
+
+	// Act
+	sut.Start(context.Background())
+
+	assert.True(t, waitFor(func() bool {
+		stats, _ := sut.Stats()
+		return stats.Dead == 1
+	}))
+
+	dead, err := sut.DeadTasks()
+
+	assert.NoError(t, err)
+	assert.Len(t, dead, 1)
+	assert.Equal(t, 2, dead[0].Attempts)
+	assert.Equal(t, "smtp unavailable", dead[0].LastError)
+	m.AssertCalled(t, "Count", "taskqueue", "retries_total", mock.Anything)
+}
+
+func TestTaskQueue_RetryingTaskDoesNotBlockLaterTasks(t *testing.T) {
+	path, cleanup := newTaskQueuePath(t)
+	defer cleanup()
+	log := &mockLogger{}
+	m := &mockMetrics{}
+	m.On("Count", mock.Anything, mock.Anything, mock.Anything)
+	sut, err := sf.NewTaskQueue(sf.TaskQueueOptions{
+		Path:         path,
+		RetryDelay:   time.Hour,
+		PollInterval: time.Millisecond,
+	}, log, m)
+	assert.NoError(t, err)
+	defer sut.Stop()
+
+	handled := make(chan string, 3)
+	sut.Subscribe("invoice", 1, func(_ context.Context, task sf.Task) error {
+		handled <- string(task.Payload)
+		if string(task.Payload) == "first" {
+			return errors.New("smtp unavailable")
+		}
+		return nil
+	})
+	assert.NoError(t, sut.Enqueue(context.Background(), sf.Task{Type: "invoice", Payload: []byte("first")}))
+	assert.NoError(t, sut.Enqueue(context.Background(), sf.Task{Type: "receipt", Payload: []byte("other")}))
+	assert.NoError(t, sut.Enqueue(context.Background(), sf.Task{Type: "invoice", Payload: []byte("second")}))
+
+	// Act
+	sut.Start(context.Background())
+
+	for _, expected := range []string{"first", "second"} {
+		select {
+		case payload := <-handled:
+			assert.Equal(t, expected, payload)
+		case <-time.After(time.Second):
+			t.Fatalf("task %s was not handled", expected)
+		}
+	}
+	select {
+	case payload := <-handled:
+		t.Fatalf("task %s was handled before it was due", payload)
+	case <-time.After(50 * time.Millisecond):
+	}
+	assert.True(t, waitFor(func() bool {
+		stats, _ := sut.Stats()
+		return stats.Pending == 2
+	}))
+}
+
+func TestTaskQueue_EnqueueTaskFromContext(t *testing.T) {
+	path, cleanup := newTaskQueuePath(t)
+	defer cleanup()
+	sut, _, _ := newTestTaskQueue(t, path)
+	defer sut.Stop()
+
+	// Act
+	err := sf.EnqueueTask(sf.WithTaskQueue(context.Background(), sut), sf.Task{Type: "invoice"})
+
+	assert.NoError(t, err)
+	assert.Equal(t, sf.ErrNoTaskQueue, sf.EnqueueTask(context.Background(), sf.Task{Type: "invoice"}))
+}
+
+func TestNewRedriveTaskHandler(t *testing.T) {
+	path, cleanup := newTaskQueuePath(t)
+	defer cleanup()
+	sut, _, _ := newTestTaskQueue(t, path)
+	defer sut.Stop()
+
+	sut.Subscribe("invoice", 1, func(context.Context, sf.Task) error {
+		return errors.New("smtp unavailable")
+	})
+	assert.NoError(t, sut.Enqueue(context.Background(), sf.Task{Type: "invoice"}))
+	ctx, cancel := context.WithCancel(context.Background())
+	sut.Start(ctx)
+
+	assert.True(t, waitFor(func() bool {
+		stats, _ := sut.Stats()
+		return stats.Dead == 1
+	}))
+	cancel()
+	time.Sleep(10 * time.Millisecond) // Allow the consumers to stop
+
+	dead, _ := sut.DeadTasks()
+	w := httptest.NewRecorder()
+	p := sf.RouterParams{Params: httprouter.Params{{Key: "id", Value: dead[0].ID}}}
+	r, _ := http.NewRequest(http.MethodPost, "/service/tasks/dead/"+dead[0].ID, nil)
+
+	// Act
+	sf.NewRedriveTaskHandler(sut)(sf.NewWrappedResponseWriter(w), r, p)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	stats, err := sut.Stats()
+
+	assert.NoError(t, err)
+	assert.Equal(t, 1, stats.Pending)
+	assert.Equal(t, 0, stats.Dead)
+
+	w = httptest.NewRecorder()
+	sf.NewRedriveTaskHandler(sut)(sf.NewWrappedResponseWriter(w), r, p)
+
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
@@ -0,0 +1,67 @@
+package servicefoundation
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+)
+
+// TLSOptions contains the TLS settings of the servers. The certificate and key are loaded from CertFile and KeyFile
+// into a copy of Config, which may also provide certificates of its own. Subsystems lists the subsystems of which the
+// servers use TLS, and defaults to the public server; the readiness and internal servers use plain HTTP unless listed.
+type TLSOptions struct {
+	Config     *tls.Config
+	CertFile   string
+	KeyFile    string
+	Subsystems []string
+}
+
+// enabled returns true when TLS is configured.
+func (o TLSOptions) enabled() bool {
+	return o.Config != nil || o.CertFile != "" || o.KeyFile != ""
+}
+
+// load returns the TLS configuration of the servers, or nil when TLS is not configured. It fails when the certificate
+// files are unreadable, or when no certificate is configured at all, so the service doesn't start without TLS.
+func (o TLSOptions) load() (*tls.Config, error) {
+	if !o.enabled() {
+		return nil, nil
+	}
+
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if o.Config != nil {
+		config = o.Config.Clone()
+	}
+
+	switch {
+	case o.CertFile != "" && o.KeyFile != "":
+		certificate, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed loading TLS certificate %s with key %s: %v", o.CertFile, o.KeyFile, err)
+		}
+		config.Certificates = append(config.Certificates, certificate)
+	case o.CertFile != "" || o.KeyFile != "":
+		return nil, errors.New("TLS requires both a certificate file and a key file")
+	}
+
+	if len(config.Certificates) == 0 && config.GetCertificate == nil && config.GetConfigForClient == nil {
+		return nil, errors.New("TLS configuration has no certificate")
+	}
+	return config, nil
+}
+
+// uses returns true when the server of the subsystem uses TLS.
+func (o TLSOptions) uses(subsystem string) bool {
+	if !o.enabled() {
+		return false
+	}
+	if o.Subsystems == nil {
+		return subsystem == publicSubsystem
+	}
+	for _, s := range o.Subsystems {
+		if s == subsystem {
+			return true
+		}
+	}
+	return false
+}
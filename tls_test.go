@@ -0,0 +1,75 @@
+package servicefoundation_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	sf "github.com/Prutswonder/go-servicefoundation"
+	"github.com/Prutswonder/go-servicefoundation/events"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// writeCertificate writes a self-signed certificate and its key to the directory, and returns their paths.
+func writeCertificate(dir string) (string, string) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, _ := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return certFile, keyFile
+}
+
+func TestServiceImpl_RunFailsOnInvalidTLS(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "tls")
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeCertificate(dir)
+	ioutil.WriteFile(filepath.Join(dir, "invalid.pem"), []byte("not a certificate"), 0644)
+
+	tests := []sf.TLSOptions{
+		{CertFile: filepath.Join(dir, "missing.pem"), KeyFile: keyFile},
+		{CertFile: filepath.Join(dir, "invalid.pem"), KeyFile: keyFile},
+		{CertFile: certFile},
+		{Config: &tls.Config{}},
+	}
+
+	for _, test := range tests {
+		log := &mockLogger{}
+		log.On("Info", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+		log.On("Error", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+		opt := sf.NewServiceOptions("tls", []string{http.MethodGet}, nil)
+		opt.Logger = log
+		opt.TLS = test
+		sut := sf.NewCustomService(opt)
+
+		// Act
+		err := sut.Run(context.Background())
+
+		assert.Error(t, err, "%+v", test)
+		log.AssertCalled(t, "Error", events.TLS, "Invalid TLS configuration: %v", mock.Anything)
+		assert.Nil(t, sut.Addr("public"), "the servers are not started")
+	}
+}
@@ -0,0 +1,285 @@
+package servicefoundation
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+const (
+	clientSubsystem = "client"
+
+	defaultDialTimeout           = 5 * time.Second
+	defaultDialKeepAlive         = 30 * time.Second
+	defaultFallbackDelay         = 100 * time.Millisecond
+	defaultTLSHandshakeTimeout   = 5 * time.Second
+	defaultResponseHeaderTimeout = 10 * time.Second
+	defaultExpectContinueTimeout = time.Second
+	defaultIdleConnTimeout       = 90 * time.Second
+	defaultMaxIdleConns          = 1000
+	defaultMaxIdleConnsPerHost   = 100
+	defaultMaxConnLifetime       = 5 * time.Minute
+)
+
+var errConnRetired = errors.New("Connection exceeded its maximum lifetime")
+
+type (
+	// TransportOptions contains the connection settings of the transport of an outbound http client. FallbackDelay is
+	// the delay before falling back to IPv4 when IPv6 doesn't connect (happy eyeballs). HTTP/1 connections older than
+	// MaxConnLifetime are closed instead of reused, so DNS changes and failovers are picked up. Zero values get
+	// defaults for high-throughput services, which differ from those of net/http. TLSConfig is used for HTTPS
+	// connections, like for custom root CAs or client certificates.
+	TransportOptions struct {
+		DialTimeout           time.Duration
+		FallbackDelay         time.Duration
+		TLSHandshakeTimeout   time.Duration
+		ResponseHeaderTimeout time.Duration
+		ExpectContinueTimeout time.Duration
+		IdleConnTimeout       time.Duration
+		MaxIdleConns          int
+		MaxIdleConnsPerHost   int
+		MaxConnLifetime       time.Duration
+		DisableHTTP2          bool
+		TLSConfig             *tls.Config
+	}
+
+	tracingTransport struct {
+		name      string
+		transport *http.Transport
+		lifetime  time.Duration
+		metrics   Metrics
+		dial      MetricsHistogram
+		handshake MetricsHistogram
+		mutex     sync.Mutex
+		conns     map[string]*trackedConn
+	}
+
+	trackedConn struct {
+		net.Conn
+		dialed  time.Time
+		mutex   sync.Mutex
+		retired bool
+		once    sync.Once
+		onClose func()
+	}
+)
+
+// NewTransport returns an http.Transport with the given settings, of which zero values are replaced by defaults.
+func NewTransport(options TransportOptions) *http.Transport {
+	options = transportDefaults(options)
+
+	dialer := &net.Dialer{
+		Timeout:       options.DialTimeout,
+		KeepAlive:     defaultDialKeepAlive,
+		FallbackDelay: options.FallbackDelay,
+	}
+
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   options.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: options.ResponseHeaderTimeout,
+		ExpectContinueTimeout: options.ExpectContinueTimeout,
+		IdleConnTimeout:       options.IdleConnTimeout,
+		MaxIdleConns:          options.MaxIdleConns,
+		MaxIdleConnsPerHost:   options.MaxIdleConnsPerHost,
+		ForceAttemptHTTP2:     !options.DisableHTTP2,
+		TLSClientConfig:       options.TLSConfig,
+	}
+	if options.DisableHTTP2 {
+		// A non-nil, empty map disables HTTP/2.
+		transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+	return transport
+}
+
+func transportDefaults(options TransportOptions) TransportOptions {
+	if options.DialTimeout <= 0 {
+		options.DialTimeout = defaultDialTimeout
+	}
+	if options.FallbackDelay <= 0 {
+		options.FallbackDelay = defaultFallbackDelay
+	}
+	if options.TLSHandshakeTimeout <= 0 {
+		options.TLSHandshakeTimeout = defaultTLSHandshakeTimeout
+	}
+	if options.ResponseHeaderTimeout <= 0 {
+		options.ResponseHeaderTimeout = defaultResponseHeaderTimeout
+	}
+	if options.ExpectContinueTimeout <= 0 {
+		options.ExpectContinueTimeout = defaultExpectContinueTimeout
+	}
+	if options.IdleConnTimeout <= 0 {
+		options.IdleConnTimeout = defaultIdleConnTimeout
+	}
+	if options.MaxIdleConns <= 0 {
+		options.MaxIdleConns = defaultMaxIdleConns
+	}
+	if options.MaxIdleConnsPerHost <= 0 {
+		options.MaxIdleConnsPerHost = defaultMaxIdleConnsPerHost
+	}
+	if options.MaxConnLifetime <= 0 {
+		options.MaxConnLifetime = defaultMaxConnLifetime
+	}
+	return options
+}
+
+// newTracingTransport returns the transport of the named client, which recycles connections after their lifetime
+// and, when metrics are given, collects connection, dial and TLS handshake metrics through httptrace.
+func newTracingTransport(name string, options TransportOptions, metrics Metrics) *tracingTransport {
+	options = transportDefaults(options)
+
+	t := &tracingTransport{
+		name:      name,
+		transport: NewTransport(options),
+		lifetime:  options.MaxConnLifetime,
+		metrics:   metrics,
+		conns:     make(map[string]*trackedConn),
+	}
+
+	if metrics != nil {
+		t.dial = metrics.AddHistogramLabels(clientSubsystem, "dial_duration_seconds",
+			"Duration of dialing connections of outbound requests.", []string{"client"}, []string{name})
+		t.handshake = metrics.AddHistogramLabels(clientSubsystem, "tls_handshake_duration_seconds",
+			"Duration of TLS handshakes of outbound requests.", []string{"client"}, []string{name})
+	}
+
+	dial := t.transport.DialContext
+	t.transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return t.track(conn), nil
+	}
+	return t
+}
+
+/* http.RoundTripper implementation */
+
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.transport.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), t.trace(req))))
+}
+
+func (t *tracingTransport) trace(req *http.Request) *httptrace.ClientTrace {
+	// Requests that can be replayed are retried on another connection when theirs is retired before writing.
+	replayable := req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+
+	var mutex sync.Mutex
+	connectStarts := make(map[string]time.Time)
+	var handshakeStart time.Time
+
+	return &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			state := "opened"
+			if info.Reused {
+				state = "reused"
+			}
+			t.count("connections_total", "Total connections used by outbound requests.", state)
+
+			if info.Reused && replayable && t.retire(info.Conn) {
+				t.count("connections_recycled_total", "Total connections closed after their maximum lifetime.", "")
+			}
+		},
+		ConnectStart: func(network, addr string) {
+			mutex.Lock()
+			connectStarts[network+addr] = time.Now()
+			mutex.Unlock()
+		},
+		ConnectDone: func(network, addr string, err error) {
+			mutex.Lock()
+			start := connectStarts[network+addr]
+			mutex.Unlock()
+			if err == nil && t.dial != nil {
+				t.dial.RecordTimeElapsed(start, time.Second)
+			}
+		},
+		TLSHandshakeStart: func() {
+			handshakeStart = time.Now()
+		},
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			if err == nil && t.handshake != nil {
+				t.handshake.RecordTimeElapsed(handshakeStart, time.Second)
+			}
+		},
+	}
+}
+
+func (t *tracingTransport) count(name, help, state string) {
+	if t.metrics == nil {
+		return
+	}
+	if state == "" {
+		t.metrics.CountLabels(clientSubsystem, name, help, []string{"client"}, []string{t.name})
+		return
+	}
+	t.metrics.CountLabels(clientSubsystem, name, help, []string{"client", "state"}, []string{t.name, state})
+}
+
+// track registers the dialed connection. Connections are identified by their addresses, because TLS wraps the
+// dialed connection before it is handed to the trace.
+func (t *tracingTransport) track(conn net.Conn) net.Conn {
+	key := connKey(conn)
+	tracked := &trackedConn{Conn: conn, dialed: time.Now()}
+	tracked.onClose = func() {
+		t.mutex.Lock()
+		delete(t.conns, key)
+		t.mutex.Unlock()
+	}
+
+	t.mutex.Lock()
+	t.conns[key] = tracked
+	t.mutex.Unlock()
+
+	return tracked
+}
+
+// retire marks the connection for closing when it exceeded its lifetime. The transport retries the request on
+// another connection, because writing to the retired connection fails before anything is written. HTTP/2
+// connections are shared by concurrent requests, so they aren't retired.
+func (t *tracingTransport) retire(conn net.Conn) bool {
+	if tlsConn, ok := conn.(*tls.Conn); ok && tlsConn.ConnectionState().NegotiatedProtocol == "h2" {
+		return false
+	}
+
+	t.mutex.Lock()
+	tracked, ok := t.conns[connKey(conn)]
+	t.mutex.Unlock()
+
+	if !ok || time.Since(tracked.dialed) < t.lifetime {
+		return false
+	}
+
+	tracked.mutex.Lock()
+	tracked.retired = true
+	tracked.mutex.Unlock()
+	return true
+}
+
+func connKey(conn net.Conn) string {
+	return conn.LocalAddr().String() + "|" + conn.RemoteAddr().String()
+}
+
+/* net.Conn implementation */
+
+func (c *trackedConn) Write(b []byte) (int, error) {
+	c.mutex.Lock()
+	retired := c.retired
+	c.mutex.Unlock()
+
+	if retired {
+		c.Close()
+		return 0, errConnRetired
+	}
+	return c.Conn.Write(b)
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(c.onClose)
+	return c.Conn.Close()
+}
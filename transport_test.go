@@ -0,0 +1,142 @@
+package servicefoundation_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	sf "github.com/Prutswonder/go-servicefoundation"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// newCountingServer returns a server that counts the connections it accepted.
+func newCountingServer(tls bool) (*httptest.Server, *int32) {
+	var conns int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	if tls {
+		server.StartTLS()
+	} else {
+		server.Start()
+	}
+	return server, &conns
+}
+
+// rootCAsOf returns the root CAs that trust the certificate of the TLS test server.
+func rootCAsOf(server *httptest.Server) *x509.CertPool {
+	return server.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+}
+
+func get(t *testing.T, client *http.Client, url string) {
+	resp, err := client.Get(url)
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+}
+
+func TestNewTransport(t *testing.T) {
+	// Act
+	defaults := sf.NewTransport(sf.TransportOptions{})
+	custom := sf.NewTransport(sf.TransportOptions{
+		TLSHandshakeTimeout:   time.Second,
+		ResponseHeaderTimeout: 2 * time.Second,
+		ExpectContinueTimeout: 3 * time.Second,
+		IdleConnTimeout:       4 * time.Second,
+		MaxIdleConns:          10,
+		MaxIdleConnsPerHost:   5,
+		DisableHTTP2:          true,
+	})
+
+	assert.Equal(t, 5*time.Second, defaults.TLSHandshakeTimeout)
+	assert.Equal(t, 10*time.Second, defaults.ResponseHeaderTimeout)
+	assert.Equal(t, 1000, defaults.MaxIdleConns)
+	assert.Equal(t, 100, defaults.MaxIdleConnsPerHost)
+	assert.True(t, defaults.ForceAttemptHTTP2)
+	assert.Nil(t, defaults.TLSNextProto)
+
+	assert.Equal(t, time.Second, custom.TLSHandshakeTimeout)
+	assert.Equal(t, 2*time.Second, custom.ResponseHeaderTimeout)
+	assert.Equal(t, 3*time.Second, custom.ExpectContinueTimeout)
+	assert.Equal(t, 4*time.Second, custom.IdleConnTimeout)
+	assert.Equal(t, 10, custom.MaxIdleConns)
+	assert.Equal(t, 5, custom.MaxIdleConnsPerHost)
+	assert.False(t, custom.ForceAttemptHTTP2)
+	assert.NotNil(t, custom.TLSNextProto)
+	assert.Empty(t, custom.TLSNextProto)
+}
+
+func TestClientFactory_RecyclesConnectionsAfterLifetime(t *testing.T) {
+	server, conns := newCountingServer(false)
+	defer server.Close()
+	histogram := &mockMetricsHistogram{}
+	histogram.On("RecordTimeElapsed", mock.Anything, mock.Anything)
+	m := &mockMetrics{}
+	m.On("AddHistogramLabels", "client", mock.Anything, mock.Anything, []string{"client"}, []string{"search"}).
+		Return(histogram)
+	m.On("CountLabels", "client", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+	client := sf.NewClientFactory(sf.ClientOptions{
+		Transports: map[string]sf.TransportOptions{"search": {MaxConnLifetime: 50 * time.Millisecond}},
+		Metrics:    m,
+	}).NewClient("search")
+
+	get(t, client, server.URL)
+	get(t, client, server.URL)
+	assert.Equal(t, int32(1), atomic.LoadInt32(conns), "connection is reused within its lifetime")
+	time.Sleep(60 * time.Millisecond)
+
+	// Act
+	get(t, client, server.URL)
+	resp, err := client.Post(server.URL, sf.ContentTypeJSON, strings.NewReader(`{"id":1}`))
+
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, int32(2), atomic.LoadInt32(conns))
+	m.AssertCalled(t, "CountLabels", "client", "connections_recycled_total", mock.Anything, []string{"client"},
+		[]string{"search"})
+}
+
+func TestClientFactory_CollectsTraceMetrics(t *testing.T) {
+	server, _ := newCountingServer(true)
+	defer server.Close()
+	dial := &mockMetricsHistogram{}
+	dial.On("RecordTimeElapsed", mock.Anything, time.Second)
+	handshake := &mockMetricsHistogram{}
+	handshake.On("RecordTimeElapsed", mock.Anything, time.Second)
+	m := &mockMetrics{}
+	m.On("AddHistogramLabels", "client", "dial_duration_seconds", mock.Anything, []string{"client"},
+		[]string{"orders-api"}).Return(dial)
+	m.On("AddHistogramLabels", "client", "tls_handshake_duration_seconds", mock.Anything, []string{"client"},
+		[]string{"orders-api"}).Return(handshake)
+	m.On("CountLabels", "client", "connections_total", mock.Anything, []string{"client", "state"}, mock.Anything)
+	client := sf.NewClientFactory(sf.ClientOptions{
+		Transports: map[string]sf.TransportOptions{
+			"orders-api": {TLSConfig: &tls.Config{RootCAs: rootCAsOf(server)}},
+		},
+		Metrics: m,
+	}).NewClient("orders-api")
+
+	// Act
+	get(t, client, server.URL)
+	get(t, client, server.URL)
+
+	dial.AssertNumberOfCalls(t, "RecordTimeElapsed", 1)
+	handshake.AssertNumberOfCalls(t, "RecordTimeElapsed", 1)
+	m.AssertCalled(t, "CountLabels", "client", "connections_total", mock.Anything, []string{"client", "state"},
+		[]string{"orders-api", "opened"})
+	m.AssertCalled(t, "CountLabels", "client", "connections_total", mock.Anything, []string{"client", "state"},
+		[]string{"orders-api", "reused"})
+}